@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bquerino/kv-g/internal/store"
+)
+
+const usage = `Usage: kvctl <command> [options]
+
+Commands:
+  cluster init --nodes id=host:port,... --n 3 --r 2 --w 2   Inicializa o cluster
+  replay --log captura.jsonl,... --targets host:port,...    Reexecuta operações capturadas contra um cluster de teste`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Println(usage)
+		os.Exit(2)
+	}
+
+	switch {
+	case os.Args[1] == "replay":
+		replay(os.Args[2:])
+	case len(os.Args) >= 3 && os.Args[1]+" "+os.Args[2] == "cluster init":
+		clusterInit(os.Args[3:])
+	default:
+		fmt.Println(usage)
+		os.Exit(2)
+	}
+}
+
+// Provisiona os tokens do anel, grava o bucket de sistema e verifica a conectividade
+func clusterInit(args []string) {
+	fs := flag.NewFlagSet("cluster init", flag.ExitOnError)
+	nodes := fs.String("nodes", "", "Lista de nós no formato id=host:port separados por vírgula")
+	n := fs.Int("n", 3, "Número de réplicas por chave")
+	r := fs.Int("r", 2, "Número de réplicas para uma leitura")
+	w := fs.Int("w", 2, "Número de réplicas para uma escrita")
+	vNodes := fs.Int("vnodes", 3, "Número de vNodes por nó")
+	degradation := fs.String("degradation", string(store.DegradeHint), "Comportamento com menos de N réplicas vivas: hint, degrade ou reject")
+	name := fs.String("name", "kv-g", "Nome do cluster")
+	token := fs.String("token", "", "Segredo exigido de nós que entram no cluster")
+	dataDir := fs.String("data-dir", ".", "Diretório de dados onde o bucket de sistema é gravado")
+	timeout := fs.Duration("timeout", 2*time.Second, "Timeout da verificação de conectividade")
+	skipVerify := fs.Bool("skip-verify", false, "Não verificar a conectividade com os nós")
+	tlsCert := fs.String("tls-cert", "", "Certificado (PEM) apresentado aos nós na verificação de conectividade, se o cluster usa TLS")
+	tlsKey := fs.String("tls-key", "", "Chave privada (PEM) do --tls-cert")
+	tlsCA := fs.String("tls-ca", "", "CA (PEM) do cluster, que verifica os certificados dos nós")
+	routeDelimiter := fs.String("route-delimiter", "", "Separador dos segmentos da chave para o roteamento por prefixo (vazio = hash da chave inteira)")
+	routeSegments := fs.Int("route-segments", 1, "Segmentos iniciais da chave usados no hash quando --route-delimiter é definido")
+	fs.Parse(args)
+
+	nodeList, err := store.ParseNodeList(*nodes)
+	if err != nil {
+		log.Fatalf("Invalid --nodes: %v", err)
+	}
+
+	config, err := store.NewClusterConfig(nodeList, *n, *r, *w, *vNodes)
+	if err != nil {
+		log.Fatalf("Invalid cluster config: %v", err)
+	}
+	if config.Degradation, err = store.ParseDegradationPolicy(*degradation); err != nil {
+		log.Fatalf("Invalid --degradation: %v", err)
+	}
+	if strings.ContainsAny(*name+*token, " \t\n") {
+		log.Fatalf("--name and --token must not contain whitespace")
+	}
+	config.Name, config.Token = *name, *token
+	if config.Routing, err = store.NewRoutingRule(*routeDelimiter, *routeSegments); err != nil {
+		log.Fatalf("Invalid routing: %v", err)
+	}
+
+	if !*skipVerify {
+		var tlsConfig *tls.Config
+		if *tlsCert != "" || *tlsKey != "" || *tlsCA != "" {
+			if tlsConfig, err = store.LoadTLSConfig(*tlsCert, *tlsKey, *tlsCA); err != nil {
+				log.Fatalf("Invalid TLS settings: %v", err)
+			}
+		}
+		failures := store.VerifyConnectivity(config.Nodes, *timeout, tlsConfig)
+		for id, err := range failures {
+			fmt.Printf("Node %s is unreachable: %v\n", id, err)
+		}
+		if len(failures) > 0 {
+			log.Fatalf("Connectivity check failed for %d of %d nodes", len(failures), len(config.Nodes))
+		}
+	}
+
+	if err := config.Save(*dataDir); err != nil {
+		log.Fatalf("Failed to write system config: %v", err)
+	}
+
+	fmt.Printf("Cluster initialized with %d nodes (N=%d, R=%d, W=%d, degradation=%s, routing by %s)\n", len(config.Nodes), config.N, config.R, config.W, config.Degradation, config.Routing)
+	for _, node := range config.Nodes {
+		fmt.Printf("  %s %s tokens=%v\n", node.ID, node.Address, node.Tokens)
+	}
+	fmt.Printf("System config written to %s\n", store.ClusterConfigPath(*dataDir))
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bquerino/kv-g/internal/store"
+)
+
+// Resultado de uma operação reexecutada
+type replayed struct {
+	op      string
+	latency time.Duration
+	err     error
+}
+
+// Reexecuta as operações dos arquivos de captura (--capture-log dos nós) contra as APIs HTTP de
+// um cluster de teste, no ritmo original multiplicado por --speed, e mostra latências e erros
+func replay(args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	logs := fs.String("log", "", "Arquivos de captura separados por vírgula (um por nó); as operações são intercaladas pelo horário")
+	targets := fs.String("targets", "", "Endereços host:port das APIs HTTP do cluster de teste, separados por vírgula; as operações são distribuídas entre eles")
+	speed := fs.Float64("speed", 1, "Multiplicador do ritmo original (2 = duas vezes mais rápido; 0 = o mais rápido possível)")
+	workers := fs.Int("workers", 64, "Máximo de operações em andamento ao mesmo tempo")
+	timeout := fs.Duration("timeout", 5*time.Second, "Timeout de cada operação")
+	fs.Parse(args)
+
+	if *logs == "" || *targets == "" {
+		log.Fatalf("replay needs --log and --targets")
+	}
+	if *speed < 0 || *workers < 1 {
+		log.Fatalf("--speed must not be negative and --workers must be at least 1")
+	}
+	ops, err := store.ReadCapturedOps(strings.Split(*logs, ",")...)
+	if err != nil {
+		log.Fatalf("Failed to read captured operations: %v", err)
+	}
+	if len(ops) == 0 {
+		fmt.Println("No operations to replay")
+		return
+	}
+	endpoints := strings.Split(*targets, ",")
+	fmt.Printf("Replaying %d operations captured over %s against %d node(s) at speed %g\n", len(ops), ops[len(ops)-1].Time.Sub(ops[0].Time).Round(time.Millisecond), len(endpoints), *speed)
+
+	client := &http.Client{Timeout: *timeout}
+	results := make([]replayed, len(ops))
+	slots := make(chan struct{}, *workers)
+	var wg sync.WaitGroup
+	var maxLag time.Duration
+	start := time.Now()
+	for i, op := range ops {
+		// Com speed 0 as operações saem assim que há um worker livre
+		due := start
+		if *speed > 0 {
+			due = start.Add(time.Duration(float64(op.Time.Sub(ops[0].Time)) / *speed))
+			time.Sleep(time.Until(due))
+		}
+		slots <- struct{}{}
+		maxLag = max(maxLag, time.Since(due))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			began := time.Now()
+			err := replayOp(client, endpoints[i%len(endpoints)], op)
+			results[i] = replayed{op: op.Op, latency: time.Since(began), err: err}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	printReplaySummary(results, elapsed, maxLag, *speed > 0)
+}
+
+// Executa uma operação na API HTTP de um nó; uma leitura de chave ausente não é erro
+func replayOp(client *http.Client, endpoint string, op store.CapturedOp) error {
+	target := &url.URL{Scheme: "http", Host: endpoint, Path: "/kv/" + op.Key}
+	if op.Consistency != store.ConsistencyDefault {
+		target.RawQuery = url.Values{"consistency": {string(op.Consistency)}}.Encode()
+	}
+	var body io.Reader
+	method := http.MethodGet
+	switch op.Op {
+	case store.CapturedPut:
+		method, body = http.MethodPut, strings.NewReader(op.Value)
+	case store.CapturedDelete:
+		method = http.MethodDelete
+	}
+	req, err := http.NewRequest(method, target.String(), body)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 300 && !(op.Op == store.CapturedGet && resp.StatusCode == http.StatusNotFound) {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
+
+// Mostra, por tipo de operação, a quantidade, os erros e os percentis de latência
+func printReplaySummary(results []replayed, elapsed, maxLag time.Duration, paced bool) {
+	byOp := make(map[string][]time.Duration)
+	failures := make(map[string]map[string]int)
+	for _, result := range results {
+		byOp[result.op] = append(byOp[result.op], result.latency)
+		if result.err != nil {
+			if failures[result.op] == nil {
+				failures[result.op] = make(map[string]int)
+			}
+			failures[result.op][result.err.Error()]++
+		}
+	}
+
+	ops := make([]string, 0, len(byOp))
+	for op := range byOp {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+	for _, op := range ops {
+		latencies := byOp[op]
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		failed := 0
+		for _, count := range failures[op] {
+			failed += count
+		}
+		fmt.Printf("%-6s %6d ops, %d errors, p50 %s, p95 %s, p99 %s, max %s\n", op, len(latencies), failed,
+			percentile(latencies, 0.50), percentile(latencies, 0.95), percentile(latencies, 0.99), latencies[len(latencies)-1].Round(time.Microsecond))
+		for message, count := range failures[op] {
+			fmt.Printf("  %d x %s\n", count, message)
+		}
+	}
+	fmt.Printf("Replayed %d operations in %s (%.0f ops/s)\n", len(results), elapsed.Round(time.Millisecond), float64(len(results))/elapsed.Seconds())
+	if paced {
+		fmt.Printf("Largest delay behind the captured schedule: %s\n", maxLag.Round(time.Millisecond))
+	}
+}
+
+// Retorna o percentil p de latências ordenadas
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	i := int(float64(len(sorted)-1) * p)
+	return sorted[i].Round(time.Microsecond)
+}
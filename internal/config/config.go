@@ -0,0 +1,181 @@
+// Package config lê o arquivo de configuração do nó (--config). O arquivo usa um subconjunto de
+// TOML: cada linha "chave = valor" define a opção de linha de comando de mesmo nome (ex.:
+// http-port = "7001", vnodes = 16, seeds = ["kv-1:8081", "kv-2:8082"]). Os valores podem ser
+// strings, números, booleanos ou listas, que viram valores separados por vírgula; comentários
+// começam com #. As opções passadas na linha de comando têm precedência sobre o arquivo.
+//
+// O tamanho das páginas não é uma opção: os arquivos de hints são gravados em páginas de
+// store.PageSize bytes, com o checksum no fim de cada uma, e um nó que mudasse o tamanho não
+// leria mais os hints gravados antes.
+package config
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Aplica o arquivo às opções do FlagSet que não foram passadas na linha de comando; skip lista
+// as opções que não podem vir do arquivo (como a própria --config)
+func Apply(flags *flag.FlagSet, path string, skip ...string) error {
+	settings, err := Read(path)
+	if err != nil {
+		return err
+	}
+
+	explicit := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	for _, setting := range settings {
+		if slices.Contains(skip, setting.Name) || flags.Lookup(setting.Name) == nil {
+			return fmt.Errorf("%s:%d: unknown setting %q (use the command-line option names, e.g. http-port)", path, setting.Line, setting.Name)
+		}
+		if explicit[setting.Name] {
+			continue
+		}
+		if err := flags.Set(setting.Name, setting.Value); err != nil {
+			return fmt.Errorf("%s:%d: invalid value for %s: %v", path, setting.Line, setting.Name, err)
+		}
+	}
+	return nil
+}
+
+// Setting é uma linha "chave = valor" do arquivo de configuração
+type Setting struct {
+	Name  string
+	Value string // Valor no formato aceito pela opção
+	Line  int
+}
+
+// Lê as configurações do arquivo, na ordem em que aparecem
+func Read(path string) ([]Setting, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var settings []Setting
+	seen := make(map[string]int)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(stripComment(scanner.Text()))
+		if text == "" {
+			continue
+		}
+		if strings.HasPrefix(text, "[") {
+			return nil, fmt.Errorf("%s:%d: tables are not supported, use top-level settings", path, line)
+		}
+		name, raw, ok := strings.Cut(text, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected <setting> = <value>", path, line)
+		}
+		name, raw = strings.TrimSpace(name), strings.TrimSpace(raw)
+
+		// Uma lista pode continuar nas linhas seguintes até o ] que a fecha
+		start := line
+		for strings.HasPrefix(raw, "[") && !strings.HasSuffix(raw, "]") && scanner.Scan() {
+			line++
+			raw += " " + strings.TrimSpace(stripComment(scanner.Text()))
+		}
+		value, err := parseConfigValue(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s: %v", path, start, name, err)
+		}
+		if previous, repeated := seen[name]; repeated {
+			return nil, fmt.Errorf("%s:%d: %s is already set at line %d", path, start, name, previous)
+		}
+		seen[name] = start
+		settings = append(settings, Setting{Name: name, Value: value, Line: start})
+	}
+	return settings, scanner.Err()
+}
+
+// Remove o comentário da linha, ignorando # dentro de strings
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote != 0 && c == '\\' && quote == '"':
+			i++
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == 0 && c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// Converte um valor TOML no texto aceito pela opção: strings perdem as aspas e listas viram
+// os itens separados por vírgula
+func parseConfigValue(raw string) (string, error) {
+	if !strings.HasPrefix(raw, "[") {
+		return parseConfigScalar(raw)
+	}
+	if !strings.HasSuffix(raw, "]") {
+		return "", fmt.Errorf("unterminated list %s", raw)
+	}
+	var items []string
+	for _, item := range splitConfigList(raw[1 : len(raw)-1]) {
+		if item = strings.TrimSpace(item); item == "" {
+			continue // Vírgula depois do último item
+		}
+		value, err := parseConfigScalar(item)
+		if err != nil {
+			return "", err
+		}
+		items = append(items, value)
+	}
+	return strings.Join(items, ","), nil
+}
+
+func parseConfigScalar(raw string) (string, error) {
+	switch {
+	case raw == "":
+		return "", fmt.Errorf("missing value")
+	case strings.HasPrefix(raw, `"`):
+		value, err := strconv.Unquote(raw)
+		if err != nil {
+			return "", fmt.Errorf("invalid string %s", raw)
+		}
+		return value, nil
+	case strings.HasPrefix(raw, "'"):
+		if len(raw) < 2 || !strings.HasSuffix(raw, "'") || strings.Contains(raw[1:len(raw)-1], "'") {
+			return "", fmt.Errorf("invalid string %s", raw)
+		}
+		return raw[1 : len(raw)-1], nil
+	case raw == "true" || raw == "false":
+		return raw, nil
+	}
+	if _, err := strconv.ParseFloat(strings.ReplaceAll(raw, "_", ""), 64); err != nil {
+		return "", fmt.Errorf("invalid value %s (quote strings and durations, e.g. \"3s\")", raw)
+	}
+	return strings.ReplaceAll(raw, "_", ""), nil
+}
+
+// Separa os itens de uma lista pelas vírgulas fora de strings
+func splitConfigList(list string) []string {
+	var items []string
+	var quote byte
+	start := 0
+	for i := 0; i < len(list); i++ {
+		switch c := list[i]; {
+		case quote != 0 && c == '\\' && quote == '"':
+			i++
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == 0 && c == ',':
+			items = append(items, list[start:i])
+			start = i + 1
+		}
+	}
+	return append(items, list[start:])
+}
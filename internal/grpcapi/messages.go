@@ -0,0 +1,443 @@
+package grpcapi
+
+import (
+	"fmt"
+	"sort"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// message é implementada pelas mensagens de kv.proto, codificadas à mão com protowire
+type message interface {
+	marshal() []byte
+	unmarshal(data []byte) error
+}
+
+type PutRequest struct {
+	Key         string
+	Value       string
+	Consistency string // one, quorum ou all (vazio = W configurado)
+	Checksum    string // CRC-32C do valor, conferido antes da escrita (opcional)
+}
+
+type DeleteRequest struct {
+	Key         string
+	Consistency string
+}
+
+// WriteResponse é o resultado de um Put ou Delete
+type WriteResponse struct {
+	Requested   int32 // Fator de replicação (N)
+	Replicas    int32 // Réplicas que confirmaram a escrita
+	Hinted      int32 // Réplicas que receberão a escrita via hinted handoff
+	Coordinator string
+	Pending     bool // Confirmada pelo ack rápido; as outras réplicas recebem a escrita em segundo plano
+}
+
+type GetRequest struct {
+	Key         string
+	Consistency string // one, quorum ou all (vazio = R configurado)
+}
+
+type GetResponse struct {
+	Found       bool
+	Value       string
+	VectorClock map[string]int64
+	Coordinator string
+	ServedBy    string
+	Responses   int32 // Réplicas que responderam
+	Required    int32 // Respostas exigidas (R)
+	Stale       bool  // Servida de dados guardados para réplicas fora; pode estar desatualizada
+	Checksum    string
+	Pending     bool // Versão de uma escrita com ack rápido ainda sem as W confirmações
+}
+
+type ScanRequest struct {
+	Prefix    string
+	Limit     int32  // 0 = sem limite
+	Filter    string // Expressão de store.ParseScanFilter
+	PageToken string // next_page_token da página anterior
+	Start     string // Com Start ou End, lê o intervalo [Start, End) em vez do prefixo
+	End       string // Vazio = até a última chave
+}
+
+type KeyValue struct {
+	Key   string
+	Value string
+}
+
+type ScanResponse struct {
+	Items         []*KeyValue
+	NextPageToken string // Vazio na última página
+}
+
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func appendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func appendBytes(b []byte, num protowire.Number, v []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+// Percorre os campos de uma mensagem, chamando field para cada um; campos desconhecidos
+// são ignorados, como no protobuf
+func parseFields(data []byte, field func(num protowire.Number, typ protowire.Type, data []byte) (int, error)) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		n, err := field(num, typ, data)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			n = protowire.ConsumeFieldValue(num, typ, data)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// Lê um campo string; retorna 0 se o tipo não for o esperado, para que o campo seja ignorado
+func consumeString(typ protowire.Type, data []byte, s *string) (int, error) {
+	if typ != protowire.BytesType {
+		return 0, nil
+	}
+	v, n := protowire.ConsumeString(data)
+	if n < 0 {
+		return 0, protowire.ParseError(n)
+	}
+	*s = v
+	return n, nil
+}
+
+func consumeVarint(typ protowire.Type, data []byte, v *uint64) (int, error) {
+	if typ != protowire.VarintType {
+		return 0, nil
+	}
+	x, n := protowire.ConsumeVarint(data)
+	if n < 0 {
+		return 0, protowire.ParseError(n)
+	}
+	*v = x
+	return n, nil
+}
+
+func consumeInt32(typ protowire.Type, data []byte, v *int32) (int, error) {
+	var x uint64
+	n, err := consumeVarint(typ, data, &x)
+	*v = int32(x)
+	return n, err
+}
+
+func consumeBytes(typ protowire.Type, data []byte, v *[]byte) (int, error) {
+	if typ != protowire.BytesType {
+		return 0, nil
+	}
+	x, n := protowire.ConsumeBytes(data)
+	if n < 0 {
+		return 0, protowire.ParseError(n)
+	}
+	*v = x
+	return n, nil
+}
+
+func (m *PutRequest) marshal() []byte {
+	b := appendString(nil, 1, m.Key)
+	b = appendString(b, 2, m.Value)
+	b = appendString(b, 3, m.Consistency)
+	return appendString(b, 4, m.Checksum)
+}
+
+func (m *PutRequest) unmarshal(data []byte) error {
+	return parseFields(data, func(num protowire.Number, typ protowire.Type, data []byte) (int, error) {
+		switch num {
+		case 1:
+			return consumeString(typ, data, &m.Key)
+		case 2:
+			return consumeString(typ, data, &m.Value)
+		case 3:
+			return consumeString(typ, data, &m.Consistency)
+		case 4:
+			return consumeString(typ, data, &m.Checksum)
+		}
+		return 0, nil
+	})
+}
+
+func (m *DeleteRequest) marshal() []byte {
+	b := appendString(nil, 1, m.Key)
+	return appendString(b, 2, m.Consistency)
+}
+
+func (m *DeleteRequest) unmarshal(data []byte) error {
+	return parseFields(data, func(num protowire.Number, typ protowire.Type, data []byte) (int, error) {
+		switch num {
+		case 1:
+			return consumeString(typ, data, &m.Key)
+		case 2:
+			return consumeString(typ, data, &m.Consistency)
+		}
+		return 0, nil
+	})
+}
+
+func (m *GetRequest) marshal() []byte {
+	b := appendString(nil, 1, m.Key)
+	return appendString(b, 2, m.Consistency)
+}
+
+func (m *GetRequest) unmarshal(data []byte) error {
+	return parseFields(data, func(num protowire.Number, typ protowire.Type, data []byte) (int, error) {
+		switch num {
+		case 1:
+			return consumeString(typ, data, &m.Key)
+		case 2:
+			return consumeString(typ, data, &m.Consistency)
+		}
+		return 0, nil
+	})
+}
+
+func (m *WriteResponse) marshal() []byte {
+	b := appendVarint(nil, 1, uint64(m.Requested))
+	b = appendVarint(b, 2, uint64(m.Replicas))
+	b = appendVarint(b, 3, uint64(m.Hinted))
+	b = appendString(b, 4, m.Coordinator)
+	if m.Pending {
+		b = appendVarint(b, 5, 1)
+	}
+	return b
+}
+
+func (m *WriteResponse) unmarshal(data []byte) error {
+	return parseFields(data, func(num protowire.Number, typ protowire.Type, data []byte) (int, error) {
+		switch num {
+		case 1:
+			return consumeInt32(typ, data, &m.Requested)
+		case 2:
+			return consumeInt32(typ, data, &m.Replicas)
+		case 3:
+			return consumeInt32(typ, data, &m.Hinted)
+		case 4:
+			return consumeString(typ, data, &m.Coordinator)
+		case 5:
+			var pending uint64
+			n, err := consumeVarint(typ, data, &pending)
+			m.Pending = pending != 0
+			return n, err
+		}
+		return 0, nil
+	})
+}
+
+func (m *GetResponse) marshal() []byte {
+	var b []byte
+	if m.Found {
+		b = appendVarint(b, 1, 1)
+	}
+	b = appendString(b, 2, m.Value)
+
+	// Entradas do map em ordem, para uma codificação determinística
+	ids := make([]string, 0, len(m.VectorClock))
+	for id := range m.VectorClock {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		entry := appendString(nil, 1, id)
+		entry = appendVarint(entry, 2, uint64(m.VectorClock[id]))
+		b = appendBytes(b, 3, entry)
+	}
+
+	b = appendString(b, 4, m.Coordinator)
+	b = appendString(b, 5, m.ServedBy)
+	b = appendVarint(b, 6, uint64(m.Responses))
+	b = appendVarint(b, 7, uint64(m.Required))
+	if m.Stale {
+		b = appendVarint(b, 8, 1)
+	}
+	b = appendString(b, 9, m.Checksum)
+	if m.Pending {
+		b = appendVarint(b, 10, 1)
+	}
+	return b
+}
+
+func (m *GetResponse) unmarshal(data []byte) error {
+	return parseFields(data, func(num protowire.Number, typ protowire.Type, data []byte) (int, error) {
+		switch num {
+		case 1:
+			var found uint64
+			n, err := consumeVarint(typ, data, &found)
+			m.Found = found != 0
+			return n, err
+		case 2:
+			return consumeString(typ, data, &m.Value)
+		case 3:
+			var entry []byte
+			n, err := consumeBytes(typ, data, &entry)
+			if err != nil || n == 0 {
+				return n, err
+			}
+			var id string
+			var counter uint64
+			err = parseFields(entry, func(num protowire.Number, typ protowire.Type, data []byte) (int, error) {
+				switch num {
+				case 1:
+					return consumeString(typ, data, &id)
+				case 2:
+					return consumeVarint(typ, data, &counter)
+				}
+				return 0, nil
+			})
+			if err != nil {
+				return 0, err
+			}
+			if m.VectorClock == nil {
+				m.VectorClock = make(map[string]int64)
+			}
+			m.VectorClock[id] = int64(counter)
+			return n, nil
+		case 4:
+			return consumeString(typ, data, &m.Coordinator)
+		case 5:
+			return consumeString(typ, data, &m.ServedBy)
+		case 6:
+			return consumeInt32(typ, data, &m.Responses)
+		case 7:
+			return consumeInt32(typ, data, &m.Required)
+		case 8:
+			var stale uint64
+			n, err := consumeVarint(typ, data, &stale)
+			m.Stale = stale != 0
+			return n, err
+		case 9:
+			return consumeString(typ, data, &m.Checksum)
+		case 10:
+			var pending uint64
+			n, err := consumeVarint(typ, data, &pending)
+			m.Pending = pending != 0
+			return n, err
+		}
+		return 0, nil
+	})
+}
+
+func (m *ScanRequest) marshal() []byte {
+	b := appendString(nil, 1, m.Prefix)
+	b = appendVarint(b, 2, uint64(m.Limit))
+	b = appendString(b, 3, m.Filter)
+	b = appendString(b, 4, m.PageToken)
+	b = appendString(b, 5, m.Start)
+	return appendString(b, 6, m.End)
+}
+
+func (m *ScanRequest) unmarshal(data []byte) error {
+	return parseFields(data, func(num protowire.Number, typ protowire.Type, data []byte) (int, error) {
+		switch num {
+		case 1:
+			return consumeString(typ, data, &m.Prefix)
+		case 2:
+			return consumeInt32(typ, data, &m.Limit)
+		case 3:
+			return consumeString(typ, data, &m.Filter)
+		case 4:
+			return consumeString(typ, data, &m.PageToken)
+		case 5:
+			return consumeString(typ, data, &m.Start)
+		case 6:
+			return consumeString(typ, data, &m.End)
+		}
+		return 0, nil
+	})
+}
+
+func (m *KeyValue) marshal() []byte {
+	b := appendString(nil, 1, m.Key)
+	return appendString(b, 2, m.Value)
+}
+
+func (m *KeyValue) unmarshal(data []byte) error {
+	return parseFields(data, func(num protowire.Number, typ protowire.Type, data []byte) (int, error) {
+		switch num {
+		case 1:
+			return consumeString(typ, data, &m.Key)
+		case 2:
+			return consumeString(typ, data, &m.Value)
+		}
+		return 0, nil
+	})
+}
+
+func (m *ScanResponse) marshal() []byte {
+	var b []byte
+	for _, item := range m.Items {
+		b = appendBytes(b, 1, item.marshal())
+	}
+	return appendString(b, 2, m.NextPageToken)
+}
+
+func (m *ScanResponse) unmarshal(data []byte) error {
+	return parseFields(data, func(num protowire.Number, typ protowire.Type, data []byte) (int, error) {
+		if num == 2 {
+			return consumeString(typ, data, &m.NextPageToken)
+		}
+		if num != 1 {
+			return 0, nil
+		}
+		var raw []byte
+		n, err := consumeBytes(typ, data, &raw)
+		if err != nil || n == 0 {
+			return n, err
+		}
+		item := &KeyValue{}
+		if err := item.unmarshal(raw); err != nil {
+			return 0, err
+		}
+		m.Items = append(m.Items, item)
+		return n, nil
+	})
+}
+
+// codec codifica as mensagens de kv.proto no formato binário do protobuf
+type codec struct{}
+
+func (codec) Marshal(v any) ([]byte, error) {
+	m, ok := v.(message)
+	if !ok {
+		return nil, fmt.Errorf("grpcapi: cannot marshal %T", v)
+	}
+	return m.marshal(), nil
+}
+
+func (codec) Unmarshal(data []byte, v any) error {
+	m, ok := v.(message)
+	if !ok {
+		return fmt.Errorf("grpcapi: cannot unmarshal into %T", v)
+	}
+	return m.unmarshal(data)
+}
+
+func (codec) Name() string {
+	return "proto"
+}
@@ -0,0 +1,337 @@
+package grpcapi
+
+import (
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// As mensagens de messages.go são codificadas à mão; estes testes conferem os bytes delas com
+// um descriptor montado a partir de kv.proto, decodificando-os com dynamicpb nos dois sentidos.
+// Um campo que mude de número ou de tipo num dos lados, ou que exista só num deles, falha aqui.
+
+var (
+	protoMessage = regexp.MustCompile(`(?s)message\s+(\w+)\s*\{(.*?)\}`)
+	protoField   = regexp.MustCompile(`^(repeated\s+)?(map<\s*(\w+)\s*,\s*(\w+)\s*>|\w+)\s+(\w+)\s*=\s*(\d+)\s*;$`)
+	protoComment = regexp.MustCompile(`//.*`)
+)
+
+// Tipos escalares usados em kv.proto
+var protoScalars = map[string]descriptorpb.FieldDescriptorProto_Type{
+	"string": descriptorpb.FieldDescriptorProto_TYPE_STRING,
+	"bytes":  descriptorpb.FieldDescriptorProto_TYPE_BYTES,
+	"bool":   descriptorpb.FieldDescriptorProto_TYPE_BOOL,
+	"int32":  descriptorpb.FieldDescriptorProto_TYPE_INT32,
+	"int64":  descriptorpb.FieldDescriptorProto_TYPE_INT64,
+	"uint32": descriptorpb.FieldDescriptorProto_TYPE_UINT32,
+	"uint64": descriptorpb.FieldDescriptorProto_TYPE_UINT64,
+}
+
+// Monta o descriptor das mensagens de kv.proto (o serviço não é necessário para os testes)
+func loadProtoFile(t *testing.T) protoreflect.FileDescriptor {
+	t.Helper()
+	source, err := os.ReadFile("kv.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := protoComment.ReplaceAllString(string(source), "")
+
+	file := &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("kv.proto"),
+		Package: proto.String("kvg"),
+		Syntax:  proto.String("proto3"),
+	}
+	for _, match := range protoMessage.FindAllStringSubmatch(text, -1) {
+		message := &descriptorpb.DescriptorProto{Name: proto.String(match[1])}
+		for _, line := range strings.Split(match[2], "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" {
+				continue
+			}
+			parts := protoField.FindStringSubmatch(line)
+			if parts == nil {
+				t.Fatalf("kv.proto: unsupported field in %s: %q", match[1], line)
+			}
+			number, _ := strconv.Atoi(parts[6])
+			field := &descriptorpb.FieldDescriptorProto{
+				Name:     proto.String(parts[5]),
+				JsonName: proto.String(camelCase(parts[5], false)),
+				Number:   proto.Int32(int32(number)),
+				Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			}
+			switch {
+			case parts[3] != "":
+				// Um map é um campo repeated de uma mensagem de entrada aninhada
+				entry := camelCase(parts[5], true) + "Entry"
+				message.NestedType = append(message.NestedType, &descriptorpb.DescriptorProto{
+					Name: proto.String(entry),
+					Field: []*descriptorpb.FieldDescriptorProto{
+						scalarField(t, "key", 1, parts[3]),
+						scalarField(t, "value", 2, parts[4]),
+					},
+					Options: &descriptorpb.MessageOptions{MapEntry: proto.Bool(true)},
+				})
+				field.Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+				field.Type = descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum()
+				field.TypeName = proto.String(".kvg." + match[1] + "." + entry)
+			default:
+				if parts[1] != "" {
+					field.Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+				}
+				if typ, scalar := protoScalars[parts[2]]; scalar {
+					field.Type = typ.Enum()
+				} else {
+					field.Type = descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum()
+					field.TypeName = proto.String(".kvg." + parts[2])
+				}
+			}
+			message.Field = append(message.Field, field)
+		}
+		file.MessageType = append(file.MessageType, message)
+	}
+
+	fd, err := protodesc.NewFile(file, nil)
+	if err != nil {
+		t.Fatalf("kv.proto: %v", err)
+	}
+	return fd
+}
+
+func scalarField(t *testing.T, name string, number int32, typ string) *descriptorpb.FieldDescriptorProto {
+	t.Helper()
+	scalar, ok := protoScalars[typ]
+	if !ok {
+		t.Fatalf("kv.proto: unsupported map type %q", typ)
+	}
+	return &descriptorpb.FieldDescriptorProto{
+		Name:     proto.String(name),
+		JsonName: proto.String(name),
+		Number:   proto.Int32(number),
+		Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+		Type:     scalar.Enum(),
+	}
+}
+
+// Converte um nome de campo de kv.proto (served_by) para o nome em Go (ServedBy)
+func camelCase(name string, exported bool) string {
+	var b strings.Builder
+	upper := exported
+	for _, r := range name {
+		if r == '_' {
+			upper = true
+			continue
+		}
+		if upper {
+			r = []rune(strings.ToUpper(string(r)))[0]
+		}
+		b.WriteRune(r)
+		upper = false
+	}
+	return b.String()
+}
+
+// Mensagens de exemplo, com todos os campos preenchidos
+func sampleMessages() map[string]message {
+	return map[string]message{
+		"PutRequest":    &PutRequest{Key: "pedidos/1", Value: "pago", Consistency: "quorum", Checksum: "9bc41b20"},
+		"DeleteRequest": &DeleteRequest{Key: "pedidos/1", Consistency: "all"},
+		"WriteResponse": &WriteResponse{Requested: 3, Replicas: 2, Hinted: 1, Coordinator: "node1", Pending: true},
+		"GetRequest":    &GetRequest{Key: "pedidos/1", Consistency: "one"},
+		"GetResponse": &GetResponse{
+			Found:       true,
+			Value:       "pago",
+			VectorClock: map[string]int64{"node1": 3, "node2": 1, "node3": 1 << 40},
+			Coordinator: "node1",
+			ServedBy:    "node2",
+			Responses:   2,
+			Required:    2,
+			Stale:       true,
+			Checksum:    "9bc41b20",
+			Pending:     true,
+		},
+		"ScanRequest": &ScanRequest{Prefix: "pedidos/", Limit: 100, Filter: "contains:pago", PageToken: "pedidos/9", Start: "a", End: "z"},
+		"KeyValue":    &KeyValue{Key: "pedidos/1", Value: "pago"},
+		"ScanResponse": &ScanResponse{
+			Items:         []*KeyValue{{Key: "pedidos/1", Value: "pago"}, {Key: "pedidos/2", Value: "aberto"}},
+			NextPageToken: "pedidos/2",
+		},
+	}
+}
+
+// Cada mensagem de kv.proto tem uma struct com os mesmos campos, e vice-versa
+func TestMessagesMatchProtoFields(t *testing.T) {
+	fd := loadProtoFile(t)
+	samples := sampleMessages()
+	if fd.Messages().Len() != len(samples) {
+		t.Fatalf("kv.proto has %d messages, messages.go has %d", fd.Messages().Len(), len(samples))
+	}
+	for i := 0; i < fd.Messages().Len(); i++ {
+		desc := fd.Messages().Get(i)
+		sample, ok := samples[string(desc.Name())]
+		if !ok {
+			t.Errorf("message %s of kv.proto has no struct in messages.go", desc.Name())
+			continue
+		}
+		typ := reflect.TypeOf(sample).Elem()
+		if typ.NumField() != desc.Fields().Len() {
+			t.Errorf("%s: struct has %d fields, kv.proto has %d", desc.Name(), typ.NumField(), desc.Fields().Len())
+		}
+		for j := 0; j < desc.Fields().Len(); j++ {
+			name := camelCase(string(desc.Fields().Get(j).Name()), true)
+			if _, ok := typ.FieldByName(name); !ok {
+				t.Errorf("%s: field %s of kv.proto is missing from the struct", desc.Name(), name)
+			}
+		}
+	}
+}
+
+// Os bytes codificados por messages.go são lidos pelo protobuf com o descriptor de kv.proto
+// e voltam iguais; os bytes do protobuf são lidos por messages.go
+func TestMessagesRoundTripThroughProtoDescriptor(t *testing.T) {
+	fd := loadProtoFile(t)
+	for name, sample := range sampleMessages() {
+		t.Run(name, func(t *testing.T) {
+			desc := fd.Messages().ByName(protoreflect.Name(name))
+			if desc == nil {
+				t.Fatalf("kv.proto has no message %s", name)
+			}
+
+			decoded := dynamicpb.NewMessage(desc)
+			if err := proto.Unmarshal(sample.marshal(), decoded); err != nil {
+				t.Fatalf("proto.Unmarshal: %v", err)
+			}
+			if unknown := decoded.GetUnknown(); len(unknown) > 0 {
+				t.Fatalf("fields unknown to kv.proto: %x", unknown)
+			}
+			back := reflect.New(reflect.TypeOf(sample).Elem())
+			fromDynamic(t, decoded, back.Elem())
+			if !reflect.DeepEqual(back.Interface(), sample) {
+				t.Fatalf("decoded by kv.proto = %+v, want %+v", back.Interface(), sample)
+			}
+
+			encoded, err := proto.MarshalOptions{Deterministic: true}.Marshal(toDynamic(t, desc, reflect.ValueOf(sample).Elem()))
+			if err != nil {
+				t.Fatalf("proto.Marshal: %v", err)
+			}
+			ours := reflect.New(reflect.TypeOf(sample).Elem()).Interface().(message)
+			if err := ours.unmarshal(encoded); err != nil {
+				t.Fatalf("unmarshal: %v", err)
+			}
+			if !reflect.DeepEqual(ours, sample) {
+				t.Fatalf("decoded by messages.go = %+v, want %+v", ours, sample)
+			}
+		})
+	}
+}
+
+// Os inteiros negativos usam a codificação de 10 bytes do int32 do protobuf
+func TestNegativeInt32RoundTrip(t *testing.T) {
+	fd := loadProtoFile(t)
+	sample := &ScanRequest{Prefix: "a", Limit: -1}
+	decoded := dynamicpb.NewMessage(fd.Messages().ByName("ScanRequest"))
+	if err := proto.Unmarshal(sample.marshal(), decoded); err != nil {
+		t.Fatal(err)
+	}
+	if limit := decoded.Get(decoded.Descriptor().Fields().ByName("limit")).Int(); limit != -1 {
+		t.Fatalf("limit = %d, want -1", limit)
+	}
+	var back ScanRequest
+	if err := back.unmarshal(sample.marshal()); err != nil || back.Limit != -1 {
+		t.Fatalf("unmarshal = %+v, %v", back, err)
+	}
+}
+
+// Copia os campos da mensagem dinâmica para a struct
+func fromDynamic(t *testing.T, m protoreflect.Message, v reflect.Value) {
+	t.Helper()
+	fields := m.Descriptor().Fields()
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		if !m.Has(fd) {
+			continue
+		}
+		target := v.FieldByName(camelCase(string(fd.Name()), true))
+		value := m.Get(fd)
+		switch {
+		case fd.IsMap():
+			entries := reflect.MakeMap(target.Type())
+			value.Map().Range(func(key protoreflect.MapKey, value protoreflect.Value) bool {
+				entries.SetMapIndex(reflect.ValueOf(key.Interface()).Convert(target.Type().Key()), reflect.ValueOf(value.Interface()).Convert(target.Type().Elem()))
+				return true
+			})
+			target.Set(entries)
+		case fd.IsList():
+			list := value.List()
+			items := reflect.MakeSlice(target.Type(), list.Len(), list.Len())
+			for j := 0; j < list.Len(); j++ {
+				item := reflect.New(target.Type().Elem().Elem())
+				fromDynamic(t, list.Get(j).Message(), item.Elem())
+				items.Index(j).Set(item)
+			}
+			target.Set(items)
+		case fd.Kind() == protoreflect.MessageKind:
+			t.Fatalf("field %s: singular messages are not used in kv.proto", fd.Name())
+		default:
+			target.Set(reflect.ValueOf(value.Interface()).Convert(target.Type()))
+		}
+	}
+}
+
+// Monta a mensagem dinâmica com os campos da struct
+func toDynamic(t *testing.T, desc protoreflect.MessageDescriptor, v reflect.Value) *dynamicpb.Message {
+	t.Helper()
+	m := dynamicpb.NewMessage(desc)
+	fields := desc.Fields()
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		source := v.FieldByName(camelCase(string(fd.Name()), true))
+		switch {
+		case fd.IsMap():
+			entries := m.Mutable(fd).Map()
+			iter := source.MapRange()
+			for iter.Next() {
+				key := protoreflect.ValueOf(iter.Key().Convert(reflect.TypeOf("")).Interface()).MapKey()
+				entries.Set(key, scalarValue(fd.MapValue().Kind(), iter.Value()))
+			}
+		case fd.IsList():
+			list := m.Mutable(fd).List()
+			for j := 0; j < source.Len(); j++ {
+				list.Append(protoreflect.ValueOfMessage(toDynamic(t, fd.Message(), source.Index(j).Elem())))
+			}
+		default:
+			if !source.IsZero() {
+				m.Set(fd, scalarValue(fd.Kind(), source))
+			}
+		}
+	}
+	return m
+}
+
+func scalarValue(kind protoreflect.Kind, v reflect.Value) protoreflect.Value {
+	switch kind {
+	case protoreflect.StringKind:
+		return protoreflect.ValueOfString(v.String())
+	case protoreflect.BoolKind:
+		return protoreflect.ValueOfBool(v.Bool())
+	case protoreflect.Int32Kind:
+		return protoreflect.ValueOfInt32(int32(v.Int()))
+	case protoreflect.Int64Kind:
+		return protoreflect.ValueOfInt64(v.Int())
+	case protoreflect.Uint32Kind:
+		return protoreflect.ValueOfUint32(uint32(v.Uint()))
+	case protoreflect.Uint64Kind:
+		return protoreflect.ValueOfUint64(v.Uint())
+	case protoreflect.BytesKind:
+		return protoreflect.ValueOfBytes(v.Bytes())
+	}
+	panic("unsupported kind " + kind.String())
+}
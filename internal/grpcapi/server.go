@@ -0,0 +1,295 @@
+// Package grpcapi serve a API gRPC de acesso ao KV Store (kv.proto). O nó que recebe a
+// requisição a coordena, contatando as réplicas da chave como no CLI. Com tokens criados no
+// cluster, as chamadas se autenticam com o metadado authorization: Bearer <token>.
+package grpcapi
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/bquerino/kv-g/internal/store"
+)
+
+// Metadado da resposta de um Scan com os nós que não responderam (resultado parcial)
+const failedNodesHeader = "kv-failed-nodes"
+
+// Logger das mensagens da API
+var logger = store.Logger("grpc")
+
+// Server implementa o serviço kvg.KV sobre o KeyValueStore do nó
+type Server struct {
+	gossip *store.Gossip
+	grpc   *grpc.Server
+}
+
+// Cria o servidor; com tlsConfig, a API é servida com TLS
+func NewServer(gossip *store.Gossip, tlsConfig *tls.Config) *Server {
+	// Uma escrita pode trazer um valor do tamanho máximo aceito por --max-value-size
+	options := []grpc.ServerOption{grpc.ForceServerCodec(codec{}), grpc.MaxRecvMsgSize(store.MaxValueSizeLimit + store.PageSize)}
+	if tlsConfig != nil {
+		options = append(options, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	s := &Server{gossip: gossip, grpc: grpc.NewServer(options...)}
+	s.grpc.RegisterService(&serviceDesc, s)
+	return s
+}
+
+// Aceita conexões da API na porta
+func (s *Server) Serve(port string) error {
+	listener, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		return err
+	}
+	logger.Info("gRPC API listening", "port", port)
+	return s.grpc.Serve(listener)
+}
+
+// Para de aceitar conexões e espera, por até timeout, as chamadas em andamento; as que passam
+// do prazo são interrompidas
+func (s *Server) Shutdown(timeout time.Duration) error {
+	done := make(chan struct{})
+	go func() {
+		s.grpc.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		s.grpc.Stop()
+		return fmt.Errorf("gRPC calls still running after %s", timeout)
+	}
+}
+
+func (s *Server) put(ctx context.Context, req *PutRequest) (*WriteResponse, error) {
+	if err := s.gossip.ValidateKey(req.Key); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := s.gossip.ValidateValue(req.Value); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if req.Checksum != "" {
+		checksum, err := store.ParseChecksum(req.Checksum)
+		if err == nil {
+			err = store.VerifyChecksum(req.Value, checksum)
+		}
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+	level, err := store.ParseConsistencyLevel(req.Consistency)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := s.gossip.Authorize(bearerToken(ctx), store.AccessWrite, req.Key); err != nil {
+		return nil, statusError(err)
+	}
+	result, err := s.gossip.KeyValueStore.Put(req.Key, req.Value, level, store.ClientCaller(bearerToken(ctx)))
+	return s.writeResponse(result, err)
+}
+
+func (s *Server) delete(ctx context.Context, req *DeleteRequest) (*WriteResponse, error) {
+	if err := s.gossip.ValidateKey(req.Key); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	level, err := store.ParseConsistencyLevel(req.Consistency)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := s.gossip.Authorize(bearerToken(ctx), store.AccessDelete, req.Key); err != nil {
+		return nil, statusError(err)
+	}
+	result, err := s.gossip.KeyValueStore.Delete(req.Key, level, store.ClientCaller(bearerToken(ctx)))
+	return s.writeResponse(result, err)
+}
+
+func (s *Server) writeResponse(result *store.PutResult, err error) (*WriteResponse, error) {
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return &WriteResponse{
+		Requested:   int32(result.Requested),
+		Replicas:    int32(result.Replicas),
+		Hinted:      int32(result.Hinted),
+		Coordinator: s.gossip.Self.ID,
+		Pending:     result.Pending,
+	}, nil
+}
+
+func (s *Server) get(ctx context.Context, req *GetRequest) (*GetResponse, error) {
+	if err := s.gossip.ValidateKey(req.Key); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	level, err := store.ParseConsistencyLevel(req.Consistency)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := s.gossip.Authorize(bearerToken(ctx), store.AccessRead, req.Key); err != nil {
+		return nil, statusError(err)
+	}
+	s.gossip.AuditRead("grpc", remoteAddr(ctx), bearerToken(ctx), store.AuditGet, req.Key, "")
+	result, err := s.gossip.KeyValueStore.Get(req.Key, level, store.ClientCaller(bearerToken(ctx)))
+	if err != nil {
+		return nil, statusError(err)
+	}
+
+	resp := &GetResponse{
+		Found:       result.Found,
+		Coordinator: result.Coordinator,
+		Responses:   int32(result.Responses),
+		Required:    int32(result.Required),
+		Stale:       result.Stale,
+		Pending:     result.Pending,
+	}
+	if result.Found {
+		resp.Value = result.Value
+		resp.ServedBy = result.ServedBy
+		resp.Checksum = result.Checksum
+		resp.VectorClock = make(map[string]int64, len(result.VectorClock.Clock))
+		for id, counter := range result.VectorClock.Clock {
+			resp.VectorClock[id] = int64(counter)
+		}
+	}
+	return resp, nil
+}
+
+func (s *Server) scan(ctx context.Context, req *ScanRequest) (*ScanResponse, error) {
+	if req.Limit < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "limit must not be negative (got %d)", req.Limit)
+	}
+	if req.Prefix != "" {
+		if err := s.gossip.ValidateKey(req.Prefix); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid prefix: %v", err)
+		}
+	}
+	filter, err := store.ParseScanFilter(req.Filter)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	var page *store.ScanPage
+	var cursor *store.ScanCursor
+	if req.Start != "" || req.End != "" {
+		if req.Prefix != "" || req.End != "" && req.End <= req.Start {
+			return nil, status.Error(codes.InvalidArgument, "use either a prefix or a range with end greater than start")
+		}
+		if cursor, err = store.ParseScanRangeToken(req.PageToken, req.Start, req.End, filter); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		if err := s.gossip.AuthorizeRange(bearerToken(ctx), store.AccessRead, req.Start, req.End); err != nil {
+			return nil, statusError(err)
+		}
+		s.gossip.AuditRead("grpc", remoteAddr(ctx), bearerToken(ctx), store.AuditScan, req.Start, req.End)
+		page, err = s.gossip.KeyValueStore.ScanRange(req.Start, req.End, int(req.Limit), filter, cursor)
+	} else {
+		if cursor, err = store.ParseScanToken(req.PageToken, req.Prefix, filter); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		start, end := store.PrefixRange(req.Prefix)
+		if err := s.gossip.AuthorizeRange(bearerToken(ctx), store.AccessRead, start, end); err != nil {
+			return nil, statusError(err)
+		}
+		s.gossip.AuditRead("grpc", remoteAddr(ctx), bearerToken(ctx), store.AuditScan, req.Prefix, "")
+		page, err = s.gossip.KeyValueStore.Scan(req.Prefix, int(req.Limit), filter, cursor)
+	}
+	if err != nil {
+		return nil, statusError(err)
+	}
+
+	// Um resultado parcial informa, nos metadados da resposta, os nós que não responderam
+	if len(page.Failed) > 0 {
+		grpc.SetHeader(ctx, metadata.Pairs(failedNodesHeader, strings.Join(store.FailedNodeIDs(page.Failed), ",")))
+	}
+
+	resp := &ScanResponse{Items: make([]*KeyValue, 0, len(page.Results))}
+	for _, result := range page.Results {
+		resp.Items = append(resp.Items, &KeyValue{Key: result.Key, Value: result.Value})
+	}
+	if page.Next != nil {
+		resp.NextPageToken = page.Next.Token()
+	}
+	return resp, nil
+}
+
+// Converte um erro do store no status gRPC correspondente
+func statusError(err error) error {
+	var quorum *store.QuorumError
+	switch {
+	case errors.As(err, &quorum),
+		errors.Is(err, store.ErrDraining),
+		errors.Is(err, store.ErrElectionInProgress),
+		errors.Is(err, store.ErrBucketFenced):
+		return status.Error(codes.Unavailable, err.Error())
+	case errors.Is(err, store.ErrUnauthenticated):
+		return status.Error(codes.Unauthenticated, err.Error())
+	case errors.Is(err, store.ErrForbidden):
+		return status.Error(codes.PermissionDenied, err.Error())
+	case errors.Is(err, store.ErrTooManySiblings):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, store.ErrValueTooLarge), errors.Is(err, store.ErrKeyTooLarge):
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+// Retorna o token do metadado authorization: Bearer <token> da chamada (vazio se ausente)
+func bearerToken(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, value := range md.Get("authorization") {
+		if scheme, token, _ := strings.Cut(value, " "); strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(token)
+		}
+	}
+	return ""
+}
+
+// Retorna o endereço do cliente da chamada
+func remoteAddr(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok {
+		return p.Addr.String()
+	}
+	return ""
+}
+
+// Descrição do serviço kvg.KV, equivalente à que o protoc-gen-go-grpc geraria para kv.proto
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: "kvg.KV",
+	HandlerType: (*any)(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "Put", Handler: unaryHandler("Put", (*Server).put)},
+		{MethodName: "Get", Handler: unaryHandler("Get", (*Server).get)},
+		{MethodName: "Delete", Handler: unaryHandler("Delete", (*Server).delete)},
+		{MethodName: "Scan", Handler: unaryHandler("Scan", (*Server).scan)},
+	},
+	Metadata: "kv.proto",
+}
+
+// Adapta um método do Server ao handler de uma chamada unária, decodificando a requisição
+// e passando pelos interceptors configurados
+func unaryHandler[Req any, Resp any](method string, fn func(*Server, context.Context, *Req) (*Resp, error)) grpc.MethodHandler {
+	return func(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+		req := new(Req)
+		if err := dec(req); err != nil {
+			return nil, err
+		}
+		if interceptor == nil {
+			return fn(srv.(*Server), ctx, req)
+		}
+		info := &grpc.UnaryServerInfo{Server: srv, FullMethod: fmt.Sprintf("/kvg.KV/%s", method)}
+		return interceptor(ctx, req, info, func(ctx context.Context, req any) (any, error) {
+			return fn(srv.(*Server), ctx, req.(*Req))
+		})
+	}
+}
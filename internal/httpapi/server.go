@@ -0,0 +1,627 @@
+// Package httpapi serve a API HTTP de dados e administração do nó: leitura e escrita de
+// chaves em /kv/{chave}, a espera pela durabilidade de uma escrita com ack rápido em
+// /durable/{chave}, scans e remoções por prefixo em /scan, a visão do cluster em
+// /cluster/nodes, /cluster/ring e /cluster/ring/stats e os tokens dos clientes em
+// /admin/tokens. Com tokens criados no cluster, as requisições se autenticam com o
+// cabeçalho Authorization: Bearer <token>.
+package httpapi
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bquerino/kv-g/internal/store"
+)
+
+// Cabeçalhos com os metadados de uma leitura
+const (
+	headerVectorClock = "X-KV-Vector-Clock"
+	headerCoordinator = "X-KV-Coordinator"
+	headerServedBy    = "X-KV-Served-By"
+	headerResponses   = "X-KV-Responses"    // Respostas recebidas / exigidas (R)
+	headerNextPage    = "X-KV-Next-Page"    // Token da próxima página de um scan
+	headerFailedNodes = "X-KV-Failed-Nodes" // Nós que não responderam a um scan ou remoção por prefixo
+	headerStale       = "X-KV-Stale"        // "true" numa leitura servida de dados guardados para réplicas fora
+	headerChecksum    = "X-KV-Checksum"     // CRC-32C do valor, em 8 dígitos hexadecimais
+	headerDurable     = "X-KV-Durable"      // "false" numa versão com ack rápido ainda sem as W confirmações
+)
+
+// Logger das mensagens da API
+var logger = store.Logger("http")
+
+// Server atende a API HTTP sobre o KeyValueStore do nó, que coordena as requisições recebidas
+type Server struct {
+	gossip *store.Gossip
+	mux    *http.ServeMux
+	tls    *tls.Config  // Serve HTTPS com esta configuração (nil = HTTP)
+	server *http.Server // Criado por Serve, encerrado por Shutdown
+	mutex  sync.Mutex   // Protege server
+}
+
+func NewServer(gossip *store.Gossip, tlsConfig *tls.Config) *Server {
+	s := &Server{gossip: gossip, mux: http.NewServeMux(), tls: tlsConfig}
+	s.mux.HandleFunc("PUT /kv/{key...}", s.handlePut)
+	s.mux.HandleFunc("GET /kv/{key...}", s.handleGet)
+	s.mux.HandleFunc("DELETE /kv/{key...}", s.handleDelete)
+	s.mux.HandleFunc("GET /durable/{key...}", s.handleWaitDurable)
+	s.mux.HandleFunc("GET /scan", s.handleScan)
+	s.mux.HandleFunc("DELETE /scan", s.handleDeletePrefix)
+	s.mux.HandleFunc("GET /cluster/nodes", s.handleNodes)
+	s.mux.HandleFunc("GET /cluster/ring", s.handleRing)
+	s.mux.HandleFunc("GET /cluster/ring/stats", s.handleRingStats)
+	s.mux.HandleFunc("GET /admin/tokens", s.handleTokens)
+	s.mux.HandleFunc("POST /admin/tokens", s.handleCreateToken)
+	s.mux.HandleFunc("DELETE /admin/tokens/{name}", s.handleRevokeToken)
+	return s
+}
+
+// Aceita conexões da API na porta
+func (s *Server) Serve(port string) error {
+	server := &http.Server{Addr: ":" + port, Handler: s.mux, TLSConfig: s.tls}
+	s.mutex.Lock()
+	s.server = server
+	s.mutex.Unlock()
+
+	var err error
+	if s.tls != nil {
+		logger.Info("HTTPS API listening", "port", port)
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		logger.Info("HTTP API listening", "port", port)
+		err = server.ListenAndServe()
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// Para de aceitar conexões e espera, por até timeout, as requisições em andamento
+func (s *Server) Shutdown(timeout time.Duration) error {
+	s.mutex.Lock()
+	server := s.server
+	s.mutex.Unlock()
+	if server == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return server.Shutdown(ctx)
+}
+
+// writeResult é a resposta de um PUT ou DELETE
+type writeResult struct {
+	Key         string `json:"key"`
+	Requested   int    `json:"requested"` // Fator de replicação (N)
+	Replicas    int    `json:"replicas"`  // Réplicas que confirmaram a escrita
+	Hinted      int    `json:"hinted"`    // Réplicas que receberão a escrita via hinted handoff
+	Coordinator string `json:"coordinator"`
+	Pending     bool   `json:"pending,omitempty"` // Confirmada pelo ack rápido; as outras réplicas recebem a escrita em segundo plano
+}
+
+// O corpo da requisição é o valor; uma quebra de linha no final (como a do curl -d @arquivo) é descartada.
+// O cabeçalho X-KV-Checksum, se presente, é conferido com o valor já sem a quebra de linha.
+func (s *Server) handlePut(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	if err := s.gossip.ValidateKey(key); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	// A quebra de linha final não conta para o limite
+	limit := s.gossip.KeyValueStore.MaxValueSize
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(limit)+2))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Errorf("%w: more than %d bytes (--max-value-size)", store.ErrValueTooLarge, limit))
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	value := strings.TrimRight(string(body), "\r\n")
+	if err := s.gossip.ValidateValue(value); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if header := r.Header.Get(headerChecksum); header != "" {
+		checksum, err := store.ParseChecksum(header)
+		if err == nil {
+			err = store.VerifyChecksum(value, checksum)
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	if err := s.gossip.Authorize(bearerToken(r), store.AccessWrite, key); err != nil {
+		writeError(w, statusCode(err), err)
+		return
+	}
+	level, err := store.ParseConsistencyLevel(r.URL.Query().Get("consistency"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	cond, conditional, err := casCondition(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if conditional {
+		result, err := s.gossip.CompareAndSwap(key, value, cond, level)
+		var conflict *store.CASConflictError
+		if errors.As(err, &conflict) {
+			writeConflict(w, conflict)
+			return
+		}
+		s.writeResponse(w, result, err)
+		return
+	}
+
+	result, err := s.gossip.KeyValueStore.Put(key, value, level, store.ClientCaller(bearerToken(r)))
+	s.writeResponse(w, result, err)
+}
+
+// Lê a condição de um PUT condicional: If-Match com o Vector Clock esperado (no formato de
+// X-KV-Vector-Clock) ou If-None-Match: * para gravar só se a chave não existe
+func casCondition(r *http.Request) (store.CASCondition, bool, error) {
+	match, noneMatch := r.Header.Get("If-Match"), r.Header.Get("If-None-Match")
+	switch {
+	case match != "" && noneMatch != "":
+		return store.CASCondition{}, false, errors.New("use either If-Match or If-None-Match")
+	case noneMatch == "*":
+		return store.CASCondition{Absent: true}, true, nil
+	case noneMatch != "":
+		return store.CASCondition{}, false, fmt.Errorf("If-None-Match must be * (got %q)", noneMatch)
+	case match != "":
+		cond, err := store.ParseCASCondition("clock=" + strings.Trim(match, `"`))
+		return cond, err == nil, err
+	}
+	return store.CASCondition{}, false, nil
+}
+
+// casConflict é a resposta 412 de um PUT condicional, com a versão atual da chave
+type casConflict struct {
+	Error       string `json:"error"`
+	Found       bool   `json:"found"`
+	Value       string `json:"value,omitempty"`
+	VectorClock string `json:"vector_clock,omitempty"` // Mesmo formato do cabeçalho X-KV-Vector-Clock
+}
+
+func writeConflict(w http.ResponseWriter, conflict *store.CASConflictError) {
+	body := casConflict{Error: conflict.Error(), Found: conflict.Current.Found}
+	if conflict.Current.Found {
+		body.Value, body.VectorClock = conflict.Current.Value, encodeClock(conflict.Current.VectorClock.Clock)
+		w.Header().Set(headerVectorClock, body.VectorClock)
+	}
+	writeJSON(w, http.StatusPreconditionFailed, body)
+}
+
+func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	if err := s.gossip.ValidateKey(key); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	level, err := store.ParseConsistencyLevel(r.URL.Query().Get("consistency"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := s.gossip.Authorize(bearerToken(r), store.AccessDelete, key); err != nil {
+		writeError(w, statusCode(err), err)
+		return
+	}
+	result, err := s.gossip.KeyValueStore.Delete(key, level, store.ClientCaller(bearerToken(r)))
+	s.writeResponse(w, result, err)
+}
+
+func (s *Server) writeResponse(w http.ResponseWriter, result *store.PutResult, err error) {
+	if err != nil {
+		writeError(w, statusCode(err), err)
+		return
+	}
+	coordinator := result.Coordinator
+	if coordinator == "" {
+		coordinator = s.gossip.Self.ID
+	}
+	writeJSON(w, http.StatusOK, writeResult{
+		Key:         result.Key,
+		Requested:   result.Requested,
+		Replicas:    result.Replicas,
+		Hinted:      result.Hinted,
+		Coordinator: coordinator,
+		Pending:     result.Pending,
+	})
+}
+
+// durableResult é a resposta de /durable/{chave}
+type durableResult struct {
+	Key     string `json:"key"`
+	Durable bool   `json:"durable"`
+}
+
+// Espera a última escrita com ack rápido da chave coordenada por este nó alcançar o W. Com
+// timeout=<duração>, responde 504 se a escrita não ficar durável nesse prazo; sem ele, espera
+// até o cliente desistir. Sem escrita pendente, responde na hora.
+func (s *Server) handleWaitDurable(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	if err := s.gossip.ValidateKey(key); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := s.gossip.Authorize(bearerToken(r), store.AccessRead, key); err != nil {
+		writeError(w, statusCode(err), err)
+		return
+	}
+	ctx := r.Context()
+	if value := r.URL.Query().Get("timeout"); value != "" {
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout <= 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid timeout %q", value))
+			return
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	err := s.gossip.KeyValueStore.WaitDurable(ctx, key)
+	if errors.Is(err, context.DeadlineExceeded) {
+		writeError(w, http.StatusGatewayTimeout, fmt.Errorf("key %s is not yet durable on W replicas", key))
+		return
+	}
+	if err != nil {
+		writeError(w, statusCode(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, durableResult{Key: key, Durable: true})
+}
+
+// Devolve o valor no corpo e os metadados da leitura nos cabeçalhos X-KV-*
+func (s *Server) handleGet(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	if err := s.gossip.ValidateKey(key); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	level, err := store.ParseConsistencyLevel(r.URL.Query().Get("consistency"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := s.gossip.Authorize(bearerToken(r), store.AccessRead, key); err != nil {
+		writeError(w, statusCode(err), err)
+		return
+	}
+	s.gossip.AuditRead("http", r.RemoteAddr, bearerToken(r), store.AuditGet, key, "")
+	result, err := s.gossip.KeyValueStore.Get(key, level, store.ClientCaller(bearerToken(r)))
+	if err != nil {
+		writeError(w, statusCode(err), err)
+		return
+	}
+
+	w.Header().Set(headerCoordinator, result.Coordinator)
+	w.Header().Set(headerResponses, fmt.Sprintf("%d/%d", result.Responses, result.Required))
+	if result.Stale {
+		w.Header().Set(headerStale, "true")
+	}
+	w.Header().Set(headerDurable, strconv.FormatBool(!result.Pending))
+	if !result.Found {
+		writeError(w, http.StatusNotFound, fmt.Errorf("key %s not found", key))
+		return
+	}
+	w.Header().Set(headerVectorClock, encodeClock(result.VectorClock.Clock))
+	w.Header().Set(headerServedBy, result.ServedBy)
+	w.Header().Set(headerChecksum, result.Checksum)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, result.Value)
+}
+
+// scanItem é uma chave devolvida por um scan
+type scanItem struct {
+	Key         string `json:"key"`
+	Value       string `json:"value"`
+	VectorClock string `json:"vector_clock"` // Mesmo formato do cabeçalho X-KV-Vector-Clock
+	ServedBy    string `json:"served_by"`
+}
+
+// Scan por prefixo: /scan?prefix=<prefixo>&limit=<n>&filter=<expressão>&page=<token>, com o
+// filtro avaliado em cada nó (contains:<texto> ou json:<campo>=<valor>), ou por intervalo, com
+// start=<início>&end=<fim> no lugar do prefixo. O token da próxima página vai no cabeçalho
+// X-KV-Next-Page, ausente na última página.
+func (s *Server) handleScan(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	prefix := query.Get("prefix")
+	if prefix != "" {
+		if err := s.gossip.ValidateKey(prefix); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid prefix: %w", err))
+			return
+		}
+	}
+	limit := 0
+	if raw := query.Get("limit"); raw != "" {
+		var err error
+		if limit, err = strconv.Atoi(raw); err != nil || limit < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid limit %q", raw))
+			return
+		}
+	}
+	filter, err := store.ParseScanFilter(query.Get("filter"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	// Com start ou end, o scan é do intervalo [start, end) em vez do prefixo
+	var page *store.ScanPage
+	var cursor *store.ScanCursor
+	if query.Has("start") || query.Has("end") {
+		start, end := query.Get("start"), query.Get("end")
+		if prefix != "" || end != "" && end <= start {
+			writeError(w, http.StatusBadRequest, errors.New("use either a prefix or a range with end greater than start"))
+			return
+		}
+		if cursor, err = store.ParseScanRangeToken(query.Get("page"), start, end, filter); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := s.gossip.AuthorizeRange(bearerToken(r), store.AccessRead, start, end); err != nil {
+			writeError(w, statusCode(err), err)
+			return
+		}
+		s.gossip.AuditRead("http", r.RemoteAddr, bearerToken(r), store.AuditScan, start, end)
+		page, err = s.gossip.KeyValueStore.ScanRange(start, end, limit, filter, cursor)
+	} else {
+		if cursor, err = store.ParseScanToken(query.Get("page"), prefix, filter); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		start, end := store.PrefixRange(prefix)
+		if err := s.gossip.AuthorizeRange(bearerToken(r), store.AccessRead, start, end); err != nil {
+			writeError(w, statusCode(err), err)
+			return
+		}
+		s.gossip.AuditRead("http", r.RemoteAddr, bearerToken(r), store.AuditScan, prefix, "")
+		page, err = s.gossip.KeyValueStore.Scan(prefix, limit, filter, cursor)
+	}
+	if err != nil {
+		writeError(w, statusCode(err), err)
+		return
+	}
+	if page.Next != nil {
+		w.Header().Set(headerNextPage, page.Next.Token())
+	}
+	if len(page.Failed) > 0 {
+		w.Header().Set(headerFailedNodes, strings.Join(store.FailedNodeIDs(page.Failed), ","))
+	}
+	items := make([]scanItem, 0, len(page.Results))
+	for _, result := range page.Results {
+		items = append(items, scanItem{
+			Key:         result.Key,
+			Value:       result.Value,
+			VectorClock: encodeClock(result.VectorClock.Clock),
+			ServedBy:    result.ServedBy,
+		})
+	}
+	writeJSON(w, http.StatusOK, items)
+}
+
+// prefixDeletion é o resultado de uma remoção por prefixo
+type prefixDeletion struct {
+	Prefix      string   `json:"prefix"`
+	At          string   `json:"at"` // Versões gravadas até este momento foram removidas
+	DryRun      bool     `json:"dry_run"`
+	Keys        *int     `json:"keys,omitempty"` // Chaves que seriam removidas (só no dry-run)
+	Nodes       []string `json:"nodes"`
+	FailedNodes []string `json:"failed_nodes,omitempty"`
+}
+
+// Remoção por prefixo: DELETE /scan?prefix=<prefixo>, com dry_run=true para só contar as chaves
+// que seriam removidas. Os nós que não gravaram o range tombstone vão em failed_nodes e no
+// cabeçalho X-KV-Failed-Nodes.
+func (s *Server) handleDeletePrefix(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	prefix := query.Get("prefix")
+	if err := s.gossip.ValidateKey(prefix); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid prefix: %w", err))
+		return
+	}
+	dryRun := false
+	if raw := query.Get("dry_run"); raw != "" {
+		var err error
+		if dryRun, err = strconv.ParseBool(raw); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid dry_run %q", raw))
+			return
+		}
+	}
+	start, end := store.PrefixRange(prefix)
+	if err := s.gossip.AuthorizeRange(bearerToken(r), store.AccessDelete, start, end); err != nil {
+		writeError(w, statusCode(err), err)
+		return
+	}
+	result, err := s.gossip.KeyValueStore.DeletePrefix(prefix, dryRun)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	answer := prefixDeletion{
+		Prefix:      result.Prefix,
+		At:          result.At.Format(time.RFC3339Nano),
+		DryRun:      result.DryRun,
+		Nodes:       result.Nodes,
+		FailedNodes: store.FailedNodeIDs(result.Failed),
+	}
+	if result.DryRun {
+		answer.Keys = &result.Keys
+	}
+	if len(result.Failed) > 0 {
+		w.Header().Set(headerFailedNodes, strings.Join(answer.FailedNodes, ","))
+	}
+	writeJSON(w, http.StatusOK, answer)
+}
+
+func (s *Server) handleNodes(w http.ResponseWriter, r *http.Request) {
+	if err := s.gossip.AuthorizeAdmin(bearerToken(r)); err != nil {
+		writeError(w, statusCode(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.gossip.Members())
+}
+
+func (s *Server) handleRing(w http.ResponseWriter, r *http.Request) {
+	if err := s.gossip.AuthorizeAdmin(bearerToken(r)); err != nil {
+		writeError(w, statusCode(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.gossip.Ring())
+}
+
+func (s *Server) handleRingStats(w http.ResponseWriter, r *http.Request) {
+	if err := s.gossip.AuthorizeAdmin(bearerToken(r)); err != nil {
+		writeError(w, statusCode(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.gossip.RingStats())
+}
+
+func (s *Server) handleTokens(w http.ResponseWriter, r *http.Request) {
+	if err := s.gossip.AuthorizeAdmin(bearerToken(r)); err != nil {
+		writeError(w, statusCode(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.gossip.Tokens())
+}
+
+// tokenRequest é o corpo de POST /admin/tokens
+type tokenRequest struct {
+	Name  string          `json:"name"`
+	Admin bool            `json:"admin"`
+	Rules []store.ACLRule `json:"rules"`
+}
+
+// createdToken é a resposta de POST /admin/tokens, a única com o segredo do token
+type createdToken struct {
+	Name   string `json:"name"`
+	Secret string `json:"secret"`
+	Epoch  int    `json:"epoch"` // Versão da configuração do cluster com o token
+}
+
+// Cria um token em todos os nós. Sem tokens no cluster (autenticação desativada), qualquer
+// cliente pode criar o primeiro, que precisa ser de administração.
+func (s *Server) handleCreateToken(w http.ResponseWriter, r *http.Request) {
+	if err := s.gossip.AuthorizeAdmin(bearerToken(r)); err != nil {
+		writeError(w, statusCode(err), err)
+		return
+	}
+	var req tokenRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, store.PageSize)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid token request: %w", err))
+		return
+	}
+	secret, epoch, err := s.gossip.CreateToken(req.Name, req.Admin, req.Rules)
+	if err != nil {
+		writeError(w, settingStatusCode(err), err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, createdToken{Name: req.Name, Secret: secret, Epoch: epoch})
+}
+
+func (s *Server) handleRevokeToken(w http.ResponseWriter, r *http.Request) {
+	if err := s.gossip.AuthorizeAdmin(bearerToken(r)); err != nil {
+		writeError(w, statusCode(err), err)
+		return
+	}
+	epoch, err := s.gossip.RevokeToken(r.PathValue("name"))
+	if err != nil {
+		writeError(w, settingStatusCode(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"epoch": epoch})
+}
+
+// Retorna o token do cabeçalho Authorization: Bearer <token> (vazio se ausente)
+func bearerToken(r *http.Request) string {
+	scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// Codifica o Vector Clock como "nó=contador" separados por vírgulas, em ordem de nó
+func encodeClock(clock map[string]int) string {
+	ids := make([]string, 0, len(clock))
+	for id := range clock {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	entries := make([]string, len(ids))
+	for i, id := range ids {
+		entries[i] = id + "=" + strconv.Itoa(clock[id])
+	}
+	return strings.Join(entries, ",")
+}
+
+// Converte um erro do store no status HTTP correspondente; erros que podem ser repetidos
+// (quorum, nó sendo desligado, eleição, bucket em remoção) viram 503
+func statusCode(err error) int {
+	var quorum *store.QuorumError
+	switch {
+	case errors.As(err, &quorum),
+		errors.Is(err, store.ErrDraining),
+		errors.Is(err, store.ErrElectionInProgress),
+		errors.Is(err, store.ErrBucketFenced):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, store.ErrUnauthenticated):
+		return http.StatusUnauthorized
+	case errors.Is(err, store.ErrForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, store.ErrTooManySiblings):
+		return http.StatusConflict
+	case errors.Is(err, store.ErrValueTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, store.ErrKeyTooLarge):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// Status de uma mudança de token recusada: a eleição pode ser esperada, os demais erros vêm
+// da validação da mudança
+func settingStatusCode(err error) int {
+	if status := statusCode(err); status != http.StatusInternalServerError {
+		return status
+	}
+	return http.StatusBadRequest
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="kv-g"`)
+	}
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Warn("Failed to write HTTP response", "err", err)
+	}
+}
@@ -0,0 +1,41 @@
+package store
+
+import (
+	"math"
+	"time"
+)
+
+// Tamanho de cluster até o qual o intervalo configurado é usado sem ajuste
+const adaptiveBaseClusterSize = 8
+
+// Retorna quantos pares contatar numa rodada de gossip com peers pares conhecidos.
+// No modo adaptativo o fanout cresce com log2 do tamanho do cluster, o que mantém a
+// propagação em O(log N) rodadas sem o custo de contatar todos os pares.
+func (g *Gossip) currentFanout(peers int) int {
+	if peers == 0 {
+		return 0
+	}
+	fanout := g.Fanout
+	if fanout <= 0 {
+		fanout = int(math.Ceil(math.Log2(float64(peers + 1))))
+	}
+	return min(max(fanout, 1), peers)
+}
+
+// Retorna o intervalo até a próxima rodada de gossip. No modo adaptativo, clusters
+// maiores que adaptiveBaseClusterSize espaçam as rodadas proporcionalmente a log N.
+func (g *Gossip) currentInterval() time.Duration {
+	if !g.AdaptiveInterval {
+		return g.Interval
+	}
+
+	g.Mutex.Lock()
+	size := len(g.Nodes) + 1
+	g.Mutex.Unlock()
+
+	if size <= adaptiveBaseClusterSize {
+		return g.Interval
+	}
+	scale := math.Log2(float64(size)) / math.Log2(adaptiveBaseClusterSize)
+	return time.Duration(float64(g.Interval) * scale)
+}
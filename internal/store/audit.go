@@ -0,0 +1,86 @@
+package store
+
+import (
+	"fmt"
+	"math/rand"
+	"slices"
+	"time"
+)
+
+// Com AuditLog, uma amostra das leituras de clientes (GET e scans, pelas APIs HTTP e gRPC) é
+// acrescentada a um arquivo, uma linha JSON por leitura, com a chave e quem leu: o nome do token
+// do cliente e o endereço de onde veio a requisição. A amostra (1% por padrão) dá visibilidade
+// de quem lê os buckets sensíveis sem o custo de registrar cada leitura; com Buckets, só as
+// leituras desses buckets entram. O registro é feito pelo nó que recebe a requisição do cliente,
+// depois da autorização, e a gravação é assíncrona como a do CaptureLog.
+
+// Percentual padrão das leituras registradas no log de auditoria
+const DefaultAuditSampleRate = 1.0
+
+// Tipos de leitura registrados na auditoria
+const (
+	AuditGet  = "get"
+	AuditScan = "scan"
+)
+
+// AuditEntry é uma leitura registrada no log de auditoria
+type AuditEntry struct {
+	Time   time.Time `json:"time"`
+	Node   string    `json:"node"` // Nó que recebeu a requisição
+	API    string    `json:"api"`  // http ou grpc
+	Op     string    `json:"op"`
+	Key    string    `json:"key"`           // Chave lida; num scan, o prefixo ou o início do intervalo
+	End    string    `json:"end,omitempty"` // Fim do intervalo de um scan
+	Caller string    `json:"caller"`        // Nome do token do cliente ("" sem autenticação)
+	Remote string    `json:"remote"`        // Endereço do cliente
+}
+
+// AuditLog acrescenta uma amostra das leituras de clientes a um arquivo
+type AuditLog struct {
+	*lineLog
+	SampleRate float64  // Percentual das leituras registradas (0 a 100)
+	Buckets    []string // Buckets auditados (vazio = todos)
+}
+
+// Abre (ou cria) o arquivo de auditoria em modo de acréscimo
+func NewAuditLog(path string, sampleRate float64, buckets []string) (*AuditLog, error) {
+	if sampleRate <= 0 || sampleRate > 100 {
+		return nil, fmt.Errorf("sample rate must be between 0 and 100 (got %g)", sampleRate)
+	}
+	l, err := openLineLog(path, "audit")
+	if err != nil {
+		return nil, err
+	}
+	return &AuditLog{lineLog: l, SampleRate: sampleRate, Buckets: buckets}, nil
+}
+
+// Indica se uma leitura da chave entra na amostra
+func (a *AuditLog) sampled(key string) bool {
+	if len(a.Buckets) > 0 && !slices.Contains(a.Buckets, BucketOf(key)) {
+		return false
+	}
+	return rand.Float64()*100 < a.SampleRate
+}
+
+// Registra a leitura no log de auditoria, se houver e se ela entrar na amostra. O segredo só é
+// conferido de novo, para obter o nome do token, nas leituras da amostra.
+func (g *Gossip) AuditRead(api, remote, secret, op, key, end string) {
+	audit := g.KeyValueStore.AuditLog
+	if audit == nil || !audit.sampled(key) {
+		return
+	}
+	caller := ""
+	if token, err := g.Authenticate(secret); err == nil && token != nil {
+		caller = token.Name
+	}
+	audit.record(AuditEntry{
+		Time:   time.Now(),
+		Node:   g.Self.ID,
+		API:    api,
+		Op:     op,
+		Key:    key,
+		End:    end,
+		Caller: caller,
+		Remote: remote,
+	})
+}
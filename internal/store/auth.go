@@ -0,0 +1,363 @@
+package store
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Os clientes das APIs HTTP e gRPC se autenticam com um token. Cada token tem regras (ACLs) que
+// dizem em quais prefixos de chave ele pode ler, gravar e remover; um token de administração
+// pode tudo, inclusive gerenciar os tokens. Os tokens ficam na configuração do cluster (só o
+// hash SHA-256 do segredo, que é mostrado uma única vez ao criar o token) e mudam pelo mesmo
+// protocolo em duas fases das outras configurações. Enquanto o cluster não tem tokens, a
+// autenticação fica desativada. A verificação é feita pelo nó que recebe a requisição do
+// cliente, antes de coordená-la: KeyValueStore.Put, Get e Delete recebem o Caller e recusam a
+// operação sem a permissão, qualquer que seja a API que as chamou (as APIs também verificam o
+// token antes de ler o corpo ou auditar a leitura). As mensagens entre nós (encaminhamentos,
+// réplicas) não levam o token. Por isso, com tokens, os nós só aceitam essas mensagens de pares autenticados pelo TLS
+// mútuo (ver tls.go): sem ele, qualquer processo que alcançasse a porta do gossip contornaria as
+// ACLs com um FORWARD ou uma réplica. Os tokens só podem ser criados com TLS entre os nós. O
+// console do nó não passa pela autenticação.
+
+// ErrUnauthenticated é retornado quando a requisição não traz um token válido
+var ErrUnauthenticated = errors.New("missing or unknown API token")
+
+// ErrForbidden é retornado quando o token não tem permissão para a operação
+var ErrForbidden = errors.New("permission denied")
+
+// Prefixo dos segredos gerados, que facilita reconhecê-los em logs e arquivos
+const tokenSecretPrefix = "kvg_"
+
+// Access é uma permissão de uma regra de acesso
+type Access string
+
+const (
+	AccessRead   Access = "read"
+	AccessWrite  Access = "write"
+	AccessDelete Access = "delete"
+)
+
+// ACLRule concede permissões nas chaves com um prefixo
+type ACLRule struct {
+	Prefix string   `json:"prefix"` // Prefixo das chaves ("*" = todas)
+	Access []Access `json:"access"`
+}
+
+// APIToken é um token de cliente guardado na configuração do cluster
+type APIToken struct {
+	Name      string    `json:"name"`
+	Hash      string    `json:"hash,omitempty"` // SHA-256 (hex) do segredo (vazio na listagem dos tokens)
+	Admin     bool      `json:"admin,omitempty"`
+	Rules     []ACLRule `json:"rules,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Mudanças dos tokens, aplicadas pelo mesmo protocolo em duas fases das configurações
+var tokenSettings = map[string]func(c *ClusterConfig, value string) error{
+	"token-set": func(c *ClusterConfig, value string) error {
+		var token APIToken
+		if err := json.Unmarshal([]byte(value), &token); err != nil {
+			return fmt.Errorf("malformed token: %w", err)
+		}
+		if err := validateToken(&token); err != nil {
+			return err
+		}
+		if _, exists := c.APITokens[token.Name]; exists {
+			return fmt.Errorf("token %s already exists, revoke it first", token.Name)
+		}
+		if !token.Admin && !hasAdminToken(c.APITokens) {
+			return errors.New("create an admin token first, or no one could manage the tokens")
+		}
+		c.APITokens = maps.Clone(c.APITokens)
+		if c.APITokens == nil {
+			c.APITokens = make(map[string]APIToken)
+		}
+		c.APITokens[token.Name] = token
+		return nil
+	},
+	"token-revoke": func(c *ClusterConfig, name string) error {
+		token, exists := c.APITokens[name]
+		if !exists {
+			return fmt.Errorf("unknown token %s", name)
+		}
+		tokens := maps.Clone(c.APITokens)
+		delete(tokens, name)
+		if token.Admin && len(tokens) > 0 && !hasAdminToken(tokens) {
+			return fmt.Errorf("token %s is the last admin token; create another one first", name)
+		}
+		c.APITokens = tokens
+		return nil
+	},
+}
+
+func validateToken(token *APIToken) error {
+	if err := validateField("token name", token.Name); err != nil {
+		return err
+	}
+	if len(token.Hash) != sha256.Size*2 {
+		return fmt.Errorf("token %s has a malformed hash", token.Name)
+	}
+	if !token.Admin && len(token.Rules) == 0 {
+		return fmt.Errorf("token %s needs at least one rule or admin access", token.Name)
+	}
+	for _, rule := range token.Rules {
+		if err := validateField("rule prefix", rule.Prefix); err != nil {
+			return err
+		}
+		if len(rule.Access) == 0 {
+			return fmt.Errorf("rule for %s grants no access", rule.Prefix)
+		}
+		for _, access := range rule.Access {
+			if access != AccessRead && access != AccessWrite && access != AccessDelete {
+				return fmt.Errorf("unknown access %q (use read, write or delete)", access)
+			}
+		}
+	}
+	return nil
+}
+
+func hasAdminToken(tokens map[string]APIToken) bool {
+	for _, token := range tokens {
+		if token.Admin {
+			return true
+		}
+	}
+	return false
+}
+
+// Interpreta as regras de um token: "<prefixo>=<permissões>" separadas por vírgulas, com as
+// permissões como letras r (read), w (write) e d (delete). Ex.: "orders/=rw,reports/=r".
+func ParseACLRules(spec string) ([]ACLRule, error) {
+	letters := map[rune]Access{'r': AccessRead, 'w': AccessWrite, 'd': AccessDelete}
+	var rules []ACLRule
+	for _, part := range strings.Split(spec, ",") {
+		prefix, grants, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok || prefix == "" || grants == "" {
+			return nil, fmt.Errorf("invalid rule %q (use <prefix>=<r|w|d>, e.g. orders/=rw)", part)
+		}
+		rule := ACLRule{Prefix: prefix}
+		for _, letter := range grants {
+			access, known := letters[letter]
+			if !known {
+				return nil, fmt.Errorf("invalid access %q in rule %q (use r, w and d)", letter, part)
+			}
+			if !slices.Contains(rule.Access, access) {
+				rule.Access = append(rule.Access, access)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// Descreve as regras no formato aceito por ParseACLRules
+func FormatACLRules(rules []ACLRule) string {
+	parts := make([]string, len(rules))
+	for i, rule := range rules {
+		letters := ""
+		for _, access := range rule.Access {
+			letters += string(access[0])
+		}
+		parts[i] = rule.Prefix + "=" + letters
+	}
+	return strings.Join(parts, ",")
+}
+
+// Mensagens entre nós que leem ou alteram os dados, o anel ou a configuração do cluster; com
+// tokens, só são aceitas de pares autenticados pelo TLS mútuo
+var peerDataMessages = map[string]bool{
+	"REPLICATE": true,
+	"FETCH":     true,
+	"SCAN":      true,
+	"DELPREFIX": true,
+	"PROMOTE":   true,
+	"REPAIR":    true,
+	"FORWARD":   true,
+	"MULTI":     true,
+	"HINT":      true,
+	"BATCH":     true,
+	"SETTING":   true,
+}
+
+// Recusa uma mensagem de dados de um par sem TLS mútuo enquanto o cluster tem tokens. Retorna
+// se a mensagem foi recusada.
+func (g *Gossip) refuseUnauthenticatedPeer(conn *peerConn, raw net.Conn, op string) bool {
+	if !peerDataMessages[op] || !g.AuthEnabled() || peerAuthenticated(raw) {
+		return false
+	}
+	gossipLog.Warn("Refusing message from a peer without mutual TLS while API tokens are configured", "op", op, "remote", raw.RemoteAddr())
+	conn.send("ERROR", "peer is not authenticated: API tokens need mutual TLS between nodes")
+	return true
+}
+
+// Recusa a entrada no cluster (JOIN, ou o HELLO do handshake de um PING desconhecido) de um par
+// sem TLS mútuo enquanto o cluster tem tokens: o nome e o token do cluster bastariam para um
+// processo qualquer entrar no anel e passar a receber réplicas. Retorna se a entrada foi recusada.
+func (g *Gossip) refuseUnauthenticatedJoin(conn *peerConn, raw net.Conn, nodeID string) bool {
+	if !g.AuthEnabled() || peerAuthenticated(raw) {
+		return false
+	}
+	gossipLog.Warn("Rejected join from a peer without mutual TLS while API tokens are configured", "peer", nodeID, "remote", raw.RemoteAddr())
+	conn.send("DENIED", "peer is not authenticated: API tokens need mutual TLS between nodes")
+	return true
+}
+
+// Cria um token em todos os nós e retorna o segredo, que não é guardado e não pode ser
+// recuperado depois. Exige TLS entre os nós, sem o qual as mensagens entre eles contornariam
+// as ACLs.
+func (g *Gossip) CreateToken(name string, admin bool, rules []ACLRule) (string, int, error) {
+	if g.TLS == nil {
+		return "", 0, errors.New("API tokens need mutual TLS between nodes (--tls-cert, --tls-key and --tls-ca)")
+	}
+	random := make([]byte, 24)
+	if _, err := rand.Read(random); err != nil {
+		return "", 0, err
+	}
+	secret := tokenSecretPrefix + hex.EncodeToString(random)
+	token := APIToken{Name: name, Hash: hashSecret(secret), Admin: admin, Rules: rules, CreatedAt: time.Now()}
+	if err := validateToken(&token); err != nil {
+		return "", 0, err
+	}
+	value, err := json.Marshal(token)
+	if err != nil {
+		return "", 0, err
+	}
+	epoch, err := g.ProposeSetting("token-set", string(value))
+	if err != nil {
+		return "", 0, err
+	}
+	return secret, epoch, nil
+}
+
+// Revoga um token em todos os nós
+func (g *Gossip) RevokeToken(name string) (int, error) {
+	return g.ProposeSetting("token-revoke", name)
+}
+
+// Retorna os tokens do cluster em ordem de nome, sem os hashes
+func (g *Gossip) Tokens() []APIToken {
+	config := g.clusterConfig()
+	if config == nil {
+		return nil
+	}
+	tokens := make([]APIToken, 0, len(config.APITokens))
+	for _, token := range config.APITokens {
+		token.Hash = ""
+		tokens = append(tokens, token)
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].Name < tokens[j].Name })
+	return tokens
+}
+
+// Indica se a autenticação está ativa, isto é, se o cluster tem tokens
+func (g *Gossip) AuthEnabled() bool {
+	config := g.clusterConfig()
+	return config != nil && len(config.APITokens) > 0
+}
+
+// Retorna o token com o segredo; nil, sem erro, se a autenticação está desativada
+func (g *Gossip) Authenticate(secret string) (*APIToken, error) {
+	config := g.clusterConfig()
+	if config == nil || len(config.APITokens) == 0 {
+		return nil, nil
+	}
+	if secret == "" {
+		return nil, ErrUnauthenticated
+	}
+	hash := []byte(hashSecret(secret))
+	for _, token := range config.APITokens {
+		if subtle.ConstantTimeCompare(hash, []byte(token.Hash)) == 1 {
+			return &token, nil
+		}
+	}
+	return nil, ErrUnauthenticated
+}
+
+// Caller identifica quem pede uma leitura, escrita ou remoção ao KeyValueStore: um cliente das
+// APIs, pelo segredo do token, ou o próprio nó (o console e as mensagens dos pares, que com
+// tokens só chegam pelo TLS mútuo), que não passa pelas ACLs. O valor zero é um cliente sem
+// token.
+type Caller struct {
+	secret string
+	node   bool
+}
+
+// NodeCaller pede as operações iniciadas pelo próprio nó ou recebidas de outro nó
+var NodeCaller = Caller{node: true}
+
+// Retorna o Caller de um cliente que apresentou o segredo (vazio quando não há token)
+func ClientCaller(secret string) Caller {
+	return Caller{secret: secret}
+}
+
+// Verifica se quem pede a operação tem a permissão na chave
+func (g *Gossip) authorizeCaller(caller Caller, access Access, key string) error {
+	if caller.node {
+		return nil
+	}
+	return g.Authorize(caller.secret, access, key)
+}
+
+// Verifica se o segredo dá a permissão na chave
+func (g *Gossip) Authorize(secret string, access Access, key string) error {
+	token, err := g.Authenticate(secret)
+	if err != nil || token == nil || token.Admin {
+		return err
+	}
+	for _, rule := range token.Rules {
+		if rule.covers(key) && slices.Contains(rule.Access, access) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: token %s cannot %s key %s", ErrForbidden, token.Name, access, key)
+}
+
+// Verifica se o segredo dá a permissão em todas as chaves do intervalo [start, end) (end
+// vazio = sem limite), como num scan ou numa remoção por prefixo: uma mesma regra precisa
+// cobrir o intervalo inteiro
+func (g *Gossip) AuthorizeRange(secret string, access Access, start, end string) error {
+	token, err := g.Authenticate(secret)
+	if err != nil || token == nil || token.Admin {
+		return err
+	}
+	for _, rule := range token.Rules {
+		if !slices.Contains(rule.Access, access) || !rule.covers(start) {
+			continue
+		}
+		_, ruleEnd := PrefixRange(rule.Prefix)
+		if rule.Prefix == "*" || ruleEnd != "" && end != "" && end <= ruleEnd {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: token %s cannot %s every key in the range", ErrForbidden, token.Name, access)
+}
+
+// Verifica se o segredo é de um token de administração (sempre aceito com a autenticação
+// desativada)
+func (g *Gossip) AuthorizeAdmin(secret string) error {
+	token, err := g.Authenticate(secret)
+	if err != nil || token == nil || token.Admin {
+		return err
+	}
+	return fmt.Errorf("%w: token %s is not an admin token", ErrForbidden, token.Name)
+}
+
+func (r ACLRule) covers(key string) bool {
+	return r.Prefix == "*" || strings.HasPrefix(key, r.Prefix)
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
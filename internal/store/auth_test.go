@@ -0,0 +1,270 @@
+package store
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Gera uma CA e um certificado de node1 emitido por ela, e os carrega com LoadTLSConfig
+func testTLSConfig(t *testing.T) *tls.Config {
+	t.Helper()
+	dir := t.TempDir()
+	write := func(name, kind string, der []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "kvg-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "node1"},
+		DNSNames:     []string{"node1"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := LoadTLSConfig(write("node1.pem", "CERTIFICATE", der), write("node1.key", "EC PRIVATE KEY", keyDER), write("ca.pem", "CERTIFICATE", caDER))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+// Como roundTrip, mas com TLS mútuo entre os dois lados do net.Pipe
+func tlsRoundTrip(t *testing.T, g *Gossip, config *tls.Config, fields ...string) []string {
+	t.Helper()
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		g.handleConnection(tls.Server(server, config))
+	}()
+
+	conn := newPeerConn(tls.Client(client, tlsForAddress(config, "node1:7000")), false)
+	if err := conn.send(fields...); err != nil {
+		t.Fatal(err)
+	}
+	response, err := conn.receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Fechar o lado do cliente libera o aviso de fechamento do TLS do outro lado
+	client.Close()
+	<-done
+	return response
+}
+
+// Aplica ao nó uma configuração de cluster com um token de administração
+func enableTokens(g *Gossip) {
+	g.ApplyClusterConfig(&ClusterConfig{
+		Name:      "teste",
+		N:         1,
+		R:         1,
+		W:         1,
+		Nodes:     []NodeConfig{{ID: g.Self.ID, Index: 1, Address: g.Self.Address, Tokens: g.ConsistentHash.GenerateTokens(g.Self.ID)}},
+		APITokens: map[string]APIToken{"ops": {Name: "ops", Hash: hashSecret("kvg_segredo"), Admin: true}},
+	})
+}
+
+// Com tokens, as mensagens de dados entre nós (que não levam o token do cliente) só são aceitas
+// de pares autenticados pelo TLS mútuo; sem tokens, continuam aceitas sem TLS
+func TestPeerDataMessagesNeedMutualTLSWithTokens(t *testing.T) {
+	g := newTestGossip(t, "node1")
+	if response := roundTrip(t, g, "FETCH", "chave"); len(response) != 1 || response[0] != "NOTFOUND" {
+		t.Fatalf("FETCH without tokens answered %q, want NOTFOUND", formatMessage(response))
+	}
+
+	enableTokens(g)
+	for _, message := range [][]string{
+		{"FETCH", "chave"},
+		{"FORWARD", "PUT", "chave", "valor"},
+		{"FORWARD", "DELETE", "chave"},
+		{"PROMOTE", "node1", "1"},
+	} {
+		response := roundTrip(t, g, message...)
+		if len(response) != 2 || response[0] != "ERROR" || !strings.Contains(response[1], "not authenticated") {
+			t.Fatalf("%s without TLS answered %q, want the authentication error", message[0], formatMessage(response))
+		}
+	}
+	if _, _, found := g.KeyValueStore.LocalGet("chave"); found {
+		t.Fatal("an unauthenticated FORWARD wrote the key")
+	}
+
+	config := testTLSConfig(t)
+	if response := tlsRoundTrip(t, g, config, "FETCH", "chave"); len(response) != 1 || response[0] != "NOTFOUND" {
+		t.Fatalf("FETCH over mutual TLS answered %q, want NOTFOUND", formatMessage(response))
+	}
+}
+
+// Os streams de uma conexão multiplexada herdam a autenticação da conexão TLS que os leva
+func TestPeerAuthenticatedUnwrapsMuxStreams(t *testing.T) {
+	config := testTLSConfig(t)
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	serverConn := tls.Server(server, config)
+	clientConn := tls.Client(client, tlsForAddress(config, "node1:7000"))
+	handshake := make(chan error, 1)
+	go func() { handshake <- clientConn.Handshake() }()
+	if err := serverConn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-handshake; err != nil {
+		t.Fatal(err)
+	}
+
+	if !peerAuthenticated(serverConn) {
+		t.Fatal("TLS connection with a verified client certificate is not authenticated")
+	}
+	stream := &muxStream{session: &muxSession{conn: newPeerConn(serverConn, false)}}
+	if !peerAuthenticated(stream) {
+		t.Fatal("stream of an authenticated connection is not authenticated")
+	}
+	plain, other := net.Pipe()
+	defer plain.Close()
+	defer other.Close()
+	if peerAuthenticated(plain) || peerAuthenticated(&muxStream{session: &muxSession{conn: newPeerConn(plain, false)}}) {
+		t.Fatal("connection without TLS is authenticated")
+	}
+}
+
+// Sem TLS entre os nós, os tokens não podem ser criados, e um nó de um cluster com tokens não
+// passa pelo self-check
+func TestTokensNeedTLSBetweenNodes(t *testing.T) {
+	g := newTestGossip(t, "node1")
+	if _, _, err := g.CreateToken("ops", true, nil); err == nil || !strings.Contains(err.Error(), "mutual TLS") {
+		t.Fatalf("CreateToken without TLS = %v, want the TLS error", err)
+	}
+
+	enableTokens(g)
+	report := &SelfCheckReport{}
+	g.checkPeerAuth(report)
+	if len(report.Errors) != 1 {
+		t.Fatalf("self-check errors = %v, want the TLS error", report.Errors)
+	}
+	g.TLS = testTLSConfig(t)
+	report = &SelfCheckReport{}
+	g.checkPeerAuth(report)
+	if len(report.Errors) != 0 {
+		t.Fatalf("self-check errors with TLS = %v", report.Errors)
+	}
+}
+
+// As ACLs valem no próprio KeyValueStore, qualquer que seja a API que o chame: um cliente sem
+// token ou sem a permissão é recusado, e o nó (console e mensagens de pares) passa sem token
+func TestStoreOperationsEnforceACLs(t *testing.T) {
+	g := newTestGossip(t, "node1")
+	enableTokens(g)
+	config := *g.clusterConfig()
+	config.APITokens = map[string]APIToken{
+		"ops":     config.APITokens["ops"],
+		"leitura": {Name: "leitura", Hash: hashSecret("kvg_leitura"), Rules: []ACLRule{{Prefix: "pedidos/", Access: []Access{AccessRead}}}},
+	}
+	g.ApplyClusterConfig(&config)
+	kv := g.KeyValueStore
+
+	if _, err := kv.Put("pedidos/1", "valor", ConsistencyDefault, Caller{}); !errors.Is(err, ErrUnauthenticated) {
+		t.Fatalf("Put without a token = %v, want ErrUnauthenticated", err)
+	}
+	if _, err := kv.Put("pedidos/1", "valor", ConsistencyDefault, ClientCaller("kvg_leitura")); !errors.Is(err, ErrForbidden) {
+		t.Fatalf("Put with a read-only token = %v, want ErrForbidden", err)
+	}
+	if _, err := kv.Delete("pedidos/1", ConsistencyDefault, ClientCaller("kvg_leitura")); !errors.Is(err, ErrForbidden) {
+		t.Fatalf("Delete with a read-only token = %v, want ErrForbidden", err)
+	}
+	if _, err := kv.Get("outros/1", ConsistencyDefault, ClientCaller("kvg_leitura")); !errors.Is(err, ErrForbidden) {
+		t.Fatalf("Get outside the token's prefix = %v, want ErrForbidden", err)
+	}
+	if _, _, found := kv.LocalGet("pedidos/1"); found {
+		t.Fatal("a refused Put wrote the key")
+	}
+
+	if _, err := kv.Put("pedidos/1", "valor", ConsistencyDefault, ClientCaller("kvg_segredo")); err != nil {
+		t.Fatalf("Put with the admin token: %v", err)
+	}
+	if _, err := kv.Put("pedidos/2", "valor", ConsistencyDefault, NodeCaller); err != nil {
+		t.Fatalf("Put by the node: %v", err)
+	}
+	if result, err := kv.Get("pedidos/1", ConsistencyDefault, ClientCaller("kvg_leitura")); err != nil || result.Value != "valor" {
+		t.Fatalf("Get with the read-only token = %+v, %v", result, err)
+	}
+}
+
+// Com tokens, um nó só entra no cluster pelo TLS mútuo, pelo JOIN ou pelo handshake de um PING
+// desconhecido; o token do cluster sozinho não basta
+func TestJoinNeedsMutualTLSWithTokens(t *testing.T) {
+	g := newTestGossip(t, "node1")
+	enableTokens(g)
+
+	for _, message := range [][]string{
+		{"JOIN", "node2", "node2:7000", "-"},
+		{"PING", "from", "node2"},
+	} {
+		response := roundTrip(t, g, message...)
+		if len(response) != 2 || response[0] != "DENIED" || !strings.Contains(response[1], "not authenticated") {
+			t.Fatalf("%s without TLS answered %q, want the authentication error", message[0], formatMessage(response))
+		}
+	}
+
+	config := testTLSConfig(t)
+	if response := tlsRoundTrip(t, g, config, "JOIN", "node2", "node2:7000", "errado"); len(response) != 2 || response[1] != "cluster token mismatch" {
+		t.Fatalf("JOIN over mutual TLS answered %q, want the token check", formatMessage(response))
+	}
+	if response := tlsRoundTrip(t, g, config, "PING", "from", "node2"); len(response) != 1 || response[0] != "IDENTIFY" {
+		t.Fatalf("PING over mutual TLS answered %q, want IDENTIFY", formatMessage(response))
+	}
+	if _, known := g.GetNode("node2"); known {
+		t.Fatal("node2 joined the cluster")
+	}
+}
@@ -0,0 +1,312 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+// MPut, MGet e MDelete agrupam as chaves pelo coordenador (o primeiro nó vivo da lista de
+// preferência de cada uma) e enviam cada grupo num único pedido MULTI, com até ScatterWorkers
+// grupos em paralelo. O coordenador executa as chaves do grupo em paralelo, com até
+// ReplicaWorkers ao mesmo tempo, e responde uma mensagem por chave assim que ela termina:
+//
+//	MULTI <PUT|GET|DELETE> <n> [<nível>]
+//	<chave> [<valor>]                    (n mensagens)
+//	-> <índice> <resposta de FORWARD>     (n mensagens, na ordem em que as chaves terminam)
+//
+// As chaves que o coordenador não respondeu (falha de conexão ou DRAINING) são coordenadas
+// localmente, como nos encaminhamentos de Put, Get e Delete.
+
+// Máximo de chaves num pedido MULTI; grupos maiores são enviados em vários pedidos
+const maxMultiKeys = 500
+
+// KeyValue é uma chave e o valor a gravar num MPut
+type KeyValue struct {
+	Key   string
+	Value string
+}
+
+// BatchWrite é o resultado de uma chave num MPut ou MDelete
+type BatchWrite struct {
+	Key    string
+	Result *PutResult
+	Err    error
+}
+
+// BatchRead é o resultado de uma chave num MGet
+type BatchRead struct {
+	Key    string
+	Result *GetResult
+	Err    error
+}
+
+// batchOutcome é o resultado de uma chave de um lote, escrita ou leitura
+type batchOutcome struct {
+	write *PutResult
+	read  *GetResult
+	err   error
+}
+
+// Grava as chaves, devolvendo um resultado por chave na ordem recebida
+func (g *Gossip) MPut(entries []KeyValue, level ConsistencyLevel) []BatchWrite {
+	keys := make([]string, len(entries))
+	values := make([]string, len(entries))
+	for i, entry := range entries {
+		keys[i], values[i] = entry.Key, entry.Value
+	}
+	return writeResults(keys, g.runBatch("PUT", keys, values, level))
+}
+
+// Remove as chaves, devolvendo um resultado por chave na ordem recebida
+func (g *Gossip) MDelete(keys []string, level ConsistencyLevel) []BatchWrite {
+	return writeResults(keys, g.runBatch("DELETE", keys, nil, level))
+}
+
+// Lê as chaves, devolvendo um resultado por chave na ordem recebida
+func (g *Gossip) MGet(keys []string, level ConsistencyLevel) []BatchRead {
+	outcomes := g.runBatch("GET", keys, nil, level)
+	results := make([]BatchRead, len(keys))
+	for i, key := range keys {
+		results[i] = BatchRead{Key: key, Result: outcomes[i].read, Err: outcomes[i].err}
+	}
+	return results
+}
+
+func writeResults(keys []string, outcomes []batchOutcome) []BatchWrite {
+	results := make([]BatchWrite, len(keys))
+	for i, key := range keys {
+		results[i] = BatchWrite{Key: key, Result: outcomes[i].write, Err: outcomes[i].err}
+	}
+	return results
+}
+
+// Executa a operação nas chaves (values só no PUT), agrupadas pelo coordenador
+func (g *Gossip) runBatch(op string, keys, values []string, level ConsistencyLevel) []batchOutcome {
+	outcomes := make([]batchOutcome, len(keys))
+
+	// Chaves inválidas ou repetidas falham sem sair do nó
+	var coordinators []*Node
+	groups := make(map[string][]int)
+	seen := make(map[string]bool, len(keys))
+	for i, key := range keys {
+		err := g.ValidateKey(key)
+		if err == nil && op == "PUT" {
+			err = g.ValidateValue(values[i])
+		}
+		if err == nil && seen[key] {
+			err = fmt.Errorf("key %s appears more than once in the batch", key)
+		}
+		if err != nil {
+			outcomes[i].err = err
+			continue
+		}
+		seen[key] = true
+
+		coordinator := g.primaryCoordinator(key)
+		if _, ok := groups[coordinator.ID]; !ok {
+			coordinators = append(coordinators, coordinator)
+		}
+		groups[coordinator.ID] = append(groups[coordinator.ID], i)
+	}
+
+	runBounded(g.KeyValueStore.Workers.ScatterWorkers, len(coordinators), func(n int) {
+		coordinator := coordinators[n]
+		pending := groups[coordinator.ID]
+		if coordinator.ID != g.Self.ID {
+			var err error
+			if pending, err = g.forwardBatch(coordinator, op, keys, values, pending, level, outcomes); err == nil {
+				return
+			}
+			replicationLog.Warn("Failed to forward batch, coordinating locally", "op", op, "keys", len(pending), "peer", coordinator.ID, "err", err)
+		}
+		g.coordinateBatch(op, keys, values, pending, level, outcomes, coordinator.ID != g.Self.ID)
+	})
+	return outcomes
+}
+
+// Retorna o coordenador da chave num lote ou CAS: o primeiro nó vivo da lista de preferência, ou
+// este nó se nenhum estiver vivo
+func (g *Gossip) primaryCoordinator(key string) *Node {
+	for _, node := range g.ConsistentHash.GetPreferenceList(key, g.KeyValueStore.replicationFactor()).Replicas {
+		if node.ID == g.Self.ID || g.IsNodeAlive(node.ID) {
+			return node
+		}
+	}
+	return g.Self
+}
+
+// Coordena localmente as chaves dos índices, com até ReplicaWorkers ao mesmo tempo
+func (g *Gossip) coordinateBatch(op string, keys, values []string, indexes []int, level ConsistencyLevel, outcomes []batchOutcome, fallback bool) {
+	runBounded(g.KeyValueStore.Workers.ReplicaWorkers, len(indexes), func(n int) {
+		i := indexes[n]
+		g.recordCoordination(g.Self.ID, keys[i], op != "GET", fallback)
+
+		outcome := &outcomes[i]
+		switch op {
+		case "PUT":
+			outcome.write, outcome.err = g.KeyValueStore.Put(keys[i], values[i], level, NodeCaller)
+		case "DELETE":
+			outcome.write, outcome.err = g.KeyValueStore.Delete(keys[i], level, NodeCaller)
+		case "GET":
+			outcome.read, outcome.err = g.KeyValueStore.Get(keys[i], level, NodeCaller)
+		}
+		if outcome.write != nil {
+			outcome.write.Coordinator = g.Self.ID
+		}
+	})
+}
+
+// Envia as chaves dos índices ao coordenador em pedidos MULTI, preenchendo os resultados das
+// chaves respondidas. Em caso de falha, retorna as chaves que ficaram sem resposta.
+func (g *Gossip) forwardBatch(node *Node, op string, keys, values []string, indexes []int, level ConsistencyLevel, outcomes []batchOutcome) ([]int, error) {
+	for start := 0; start < len(indexes); start += maxMultiKeys {
+		chunk := indexes[start:min(start+maxMultiKeys, len(indexes))]
+		answered, err := g.sendMulti(node, op, keys, values, chunk, level, outcomes)
+		if err != nil {
+			var pending []int
+			for _, i := range indexes[start:] {
+				if !answered[i] {
+					pending = append(pending, i)
+				}
+			}
+			return pending, err
+		}
+	}
+	return nil, nil
+}
+
+// Envia um pedido MULTI e lê uma resposta por chave, retornando as chaves respondidas
+func (g *Gossip) sendMulti(node *Node, op string, keys, values []string, indexes []int, level ConsistencyLevel, outcomes []batchOutcome) (map[int]bool, error) {
+	answered := make(map[int]bool, len(indexes))
+
+	// O coordenador remoto ainda contata as réplicas antes de responder cada chave
+	conn, err := g.dialReplica(node, g.Timeouts.Replication.withSlowRead(2))
+	if err != nil {
+		return answered, err
+	}
+	defer conn.Close()
+
+	conn.queue(withLevel(level, "MULTI", op, strconv.Itoa(len(indexes)))...)
+	for _, i := range indexes {
+		if op == "PUT" {
+			conn.queue(keys[i], values[i], checksumField(values[i]))
+		} else {
+			conn.queue(keys[i])
+		}
+	}
+	if err := conn.flush(); err != nil {
+		return answered, err
+	}
+
+	for range indexes {
+		response, err := conn.receive()
+		if err != nil {
+			return answered, err
+		}
+		n := -1
+		if len(response) > 0 {
+			if number, err := strconv.Atoi(response[0]); err == nil {
+				n = number
+			}
+		}
+		if n < 0 || n >= len(indexes) || answered[indexes[n]] {
+			// Um erro do pedido inteiro (como "ERROR malformed MULTI") vem sem índice
+			if _, err := parseForwardAnswer(node, response); err != nil {
+				return answered, err
+			}
+			return answered, fmt.Errorf("coordinator %s answered %q", node.ID, formatMessage(response))
+		}
+
+		i := indexes[n]
+		fields, err := parseForwardAnswer(node, response[1:])
+		if errors.Is(err, errCoordinatorDraining) {
+			// A chave fica pendente e é coordenada localmente
+			continue
+		}
+		answered[i] = true
+		g.recordCoordination(node.ID, keys[i], op != "GET", false)
+		if err != nil {
+			outcomes[i].err = err
+			continue
+		}
+		if op == "GET" {
+			outcomes[i].read, outcomes[i].err = g.parseGetAnswer(node, keys[i], fields)
+		} else {
+			outcomes[i].write, outcomes[i].err = parseWriteAnswer(node, keys[i], fields)
+		}
+	}
+	if len(answered) < len(indexes) {
+		return answered, errCoordinatorDraining
+	}
+	return answered, nil
+}
+
+// Coordena um pedido MULTI de outro nó, respondendo cada chave assim que ela termina. As chaves
+// nunca são reencaminhadas.
+func (g *Gossip) handleMulti(conn *peerConn, args []string) {
+	arity := map[string]int{"PUT": 2, "DELETE": 1, "GET": 1}
+	if len(args) != 2 && len(args) != 3 || arity[args[0]] == 0 {
+		conn.send("ERROR", "malformed MULTI")
+		return
+	}
+	op := args[0]
+	n, err := strconv.Atoi(args[1])
+	if err != nil || n < 1 || n > maxMultiKeys {
+		conn.send("ERROR", fmt.Sprintf("invalid MULTI size %q (1 to %d keys)", args[1], maxMultiKeys))
+		return
+	}
+	level := ConsistencyDefault
+	if len(args) == 3 {
+		if level, err = ParseConsistencyLevel(args[2]); err != nil {
+			conn.send("ERROR", err.Error())
+			return
+		}
+	}
+
+	keys := make([]string, n)
+	values := make([]string, n)
+	for i := range n {
+		fields, err := conn.receive()
+		if err != nil {
+			replicationLog.Warn("Error reading MULTI", "op", op, "err", err)
+			return
+		}
+		// Cada valor de um PUT vem com o checksum, conferido antes de coordenar qualquer chave
+		fields, checksum := takeChecksum(fields, arity[op])
+		if len(fields) != arity[op] {
+			conn.send("ERROR", "malformed MULTI")
+			return
+		}
+		keys[i] = fields[0]
+		if op == "PUT" {
+			values[i] = fields[1]
+			if err := VerifyChecksum(values[i], checksum); err != nil {
+				rejectEntry(conn, "MULTI", err)
+				return
+			}
+		}
+	}
+
+	g.routingMutex.Lock()
+	g.routing.Received += n
+	g.routingMutex.Unlock()
+
+	var mutex sync.Mutex
+	runBounded(g.KeyValueStore.Workers.ReplicaWorkers, n, func(i int) {
+		var answer []string
+		switch op {
+		case "PUT":
+			answer = writeAnswer(g.KeyValueStore.Put(keys[i], values[i], level, NodeCaller))
+		case "DELETE":
+			answer = writeAnswer(g.KeyValueStore.Delete(keys[i], level, NodeCaller))
+		case "GET":
+			answer = g.getAnswer(g.KeyValueStore.Get(keys[i], level, NodeCaller))
+		}
+
+		mutex.Lock()
+		defer mutex.Unlock()
+		conn.send(append([]string{strconv.Itoa(i)}, answer...)...)
+	})
+}
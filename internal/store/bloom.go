@@ -0,0 +1,81 @@
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+)
+
+// Cada SSTable tem um Bloom filter com as chaves dela, gravado no próprio arquivo e carregado na
+// abertura. Uma leitura consulta o filtro antes do índice: se ele diz que a chave não está na
+// tabela, a tabela é pulada sem busca no índice nem leitura do disco. Um GET de uma chave que não
+// existe passa só pelos filtros, salvo os falsos positivos (cerca de 1% por tabela).
+
+// Bits por chave e funções de hash dos filtros (cerca de 1% de falsos positivos)
+const (
+	bloomBitsPerKey = 10
+	bloomHashes     = 7
+)
+
+// bloomFilter é um Bloom filter com double hashing sobre o FNV-1a de 64 bits da chave
+type bloomFilter struct {
+	bits   []byte
+	hashes uint32
+}
+
+// Cria um filtro com as chaves dadas
+func newBloomFilter(keys []string) *bloomFilter {
+	size := max(len(keys)*bloomBitsPerKey, 64)
+	f := &bloomFilter{bits: make([]byte, (size+7)/8), hashes: bloomHashes}
+	for _, key := range keys {
+		f.add(key)
+	}
+	return f
+}
+
+func bloomHash(key string) (uint32, uint32) {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	// O segundo hash é ímpar para percorrer todas as posições
+	return uint32(sum), uint32(sum>>32) | 1
+}
+
+func (f *bloomFilter) add(key string) {
+	h1, h2 := bloomHash(key)
+	n := uint32(len(f.bits) * 8)
+	for i := range f.hashes {
+		bit := (h1 + i*h2) % n
+		f.bits[bit/8] |= 1 << (bit % 8)
+	}
+}
+
+// Indica se a chave pode estar no filtro; false garante que não está
+func (f *bloomFilter) mayContain(key string) bool {
+	h1, h2 := bloomHash(key)
+	n := uint32(len(f.bits) * 8)
+	for i := range f.hashes {
+		bit := (h1 + i*h2) % n
+		if f.bits[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Codifica o filtro no fim de b: número de funções de hash, tamanho e bits
+func (f *bloomFilter) append(b []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(f.hashes))
+	b = binary.AppendUvarint(b, uint64(len(f.bits)))
+	return append(b, f.bits...)
+}
+
+// Lê um filtro gravado por append
+func (r *byteReader) bloomFilter() (*bloomFilter, error) {
+	hashes := r.uvarint()
+	bits := r.string()
+	if r.err != nil || hashes == 0 || hashes > 32 || len(bits) == 0 {
+		return nil, errors.New("invalid bloom filter")
+	}
+	return &bloomFilter{bits: []byte(bits), hashes: uint32(hashes)}, nil
+}
@@ -0,0 +1,137 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Cada par tem um circuit breaker em volta das conexões das RPCs de réplica (REPLICATE, FETCH,
+// BATCH, REPAIR, SCAN, DELPREFIX, HINT, FORWARD e MULTI). Depois de breakerThreshold falhas de conexão seguidas o
+// circuito abre, e as operações que incluem o par falham na hora, sem esperar o timeout de
+// conexão. Passado breakerCooldown, o circuito fica meio-aberto: uma única conexão passa como
+// sondagem, e o resultado dela fecha o circuito ou o abre de novo.
+const (
+	breakerThreshold = 3               // Falhas de conexão seguidas que abrem o circuito
+	breakerCooldown  = 5 * time.Second // Tempo com o circuito aberto antes da sondagem
+)
+
+// ErrCircuitOpen é retornado, sem contatar o par, enquanto o circuito dele está aberto
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen // Uma sondagem está em andamento
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+type circuitBreaker struct {
+	state    breakerState
+	failures int       // Falhas de conexão seguidas
+	openedAt time.Time // Quando o circuito abriu pela última vez
+}
+
+// breakerSet guarda os circuitos dos pares; pares sem circuito estão fechados
+type breakerSet struct {
+	mutex sync.Mutex
+	peers map[string]*circuitBreaker
+}
+
+func newBreakerSet() *breakerSet {
+	return &breakerSet{peers: make(map[string]*circuitBreaker)}
+}
+
+// Decide se uma conexão com o par pode ser tentada; com o circuito aberto há mais de
+// breakerCooldown, deixa passar uma sondagem
+func (b *breakerSet) allow(peer string, now time.Time) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	breaker, exists := b.peers[peer]
+	if !exists || breaker.state == breakerClosed {
+		return nil
+	}
+	if breaker.state == breakerOpen {
+		if wait := breakerCooldown - now.Sub(breaker.openedAt); wait > 0 {
+			return fmt.Errorf("%w for node %s, probing again in %s", ErrCircuitOpen, peer, wait.Round(time.Millisecond))
+		}
+		breaker.state = breakerHalfOpen
+		return nil
+	}
+	return fmt.Errorf("%w for node %s, probe in progress", ErrCircuitOpen, peer)
+}
+
+// Registra o resultado de uma conexão com o par
+func (b *breakerSet) record(peer string, err error, now time.Time) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	breaker, exists := b.peers[peer]
+	if err == nil {
+		if exists && breaker.state != breakerClosed {
+			gossipLog.Info("Circuit breaker closed", "peer", peer)
+		}
+		delete(b.peers, peer)
+		return
+	}
+
+	if !exists {
+		breaker = &circuitBreaker{}
+		b.peers[peer] = breaker
+	}
+	breaker.failures++
+	switch {
+	case breaker.state == breakerHalfOpen:
+		breaker.state, breaker.openedAt = breakerOpen, now
+		gossipLog.Warn("Probe failed, circuit breaker open again", "peer", peer, "cooldown", breakerCooldown)
+	case breaker.state == breakerClosed && breaker.failures >= breakerThreshold:
+		breaker.state, breaker.openedAt = breakerOpen, now
+		gossipLog.Warn("Circuit breaker open", "peer", peer, "failures", breaker.failures)
+	}
+}
+
+// Fecha o circuito do par, quando a detecção de falhas o vê voltar
+func (b *breakerSet) reset(peer string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	delete(b.peers, peer)
+}
+
+// Retorna o estado do circuito do par
+func (b *breakerSet) state(peer string) breakerState {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if breaker, exists := b.peers[peer]; exists {
+		return breaker.state
+	}
+	return breakerClosed
+}
+
+// Abre a conexão de uma RPC de réplica com o nó, com os timeouts dados, passando pelo circuit
+// breaker dele. Uma falha de conexão deixa o nó suspeito.
+func (g *Gossip) dialReplica(node *Node, timeouts PeerTimeouts) (*peerConn, error) {
+	if err := g.breakers.allow(node.ID, time.Now()); err != nil {
+		return nil, err
+	}
+	conn, err := g.dialPeer(node.Address, timeouts)
+	g.breakers.record(node.ID, err, time.Now())
+	if err != nil {
+		g.suspectNode(node)
+		return nil, err
+	}
+	return conn, nil
+}
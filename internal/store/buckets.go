@@ -0,0 +1,206 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/bquerino/kv-g/internal/vectorclock"
+)
+
+// ErrBucketFenced é retornado pelas escritas num bucket enquanto a remoção ou o truncamento
+// dele está sendo aplicado no cluster; a escrita pode ser repetida depois
+var ErrBucketFenced = errors.New("bucket drop or truncate in progress (retry later)")
+
+// Chaves processadas entre dois registros de progresso da limpeza de um bucket
+const bucketCleanupBatch = 256
+
+// BucketState registra a remoção ou o truncamento de um bucket: uma faixa de tombstones que
+// cobre todas as chaves do bucket gravadas até At
+type BucketState struct {
+	Dropped bool      `json:"dropped"` // Bucket removido: novas escritas são recusadas
+	At      time.Time `json:"at"`      // Versões gravadas até este momento são consideradas removidas
+}
+
+// Operações sobre buckets aplicadas pelo mesmo protocolo em duas fases das configurações
+var bucketOperations = map[string]func(c *ClusterConfig, bucket string) error{
+	"bucket-drop": func(c *ClusterConfig, bucket string) error {
+		if bucket == DefaultBucket {
+			return fmt.Errorf("the %s bucket cannot be dropped, truncate it instead", DefaultBucket)
+		}
+		return setBucketState(c, bucket, true)
+	},
+	"bucket-truncate": func(c *ClusterConfig, bucket string) error {
+		return setBucketState(c, bucket, false)
+	},
+}
+
+// Registra a faixa de tombstones de um bucket na cópia da configuração
+func setBucketState(c *ClusterConfig, bucket string, dropped bool) error {
+	if bucket == SystemBucket {
+		return fmt.Errorf("the %s bucket is reserved", SystemBucket)
+	}
+	if state, exists := c.Buckets[bucket]; exists && state.Dropped {
+		return fmt.Errorf("bucket %s was already dropped", bucket)
+	}
+
+	buckets := make(map[string]BucketState, len(c.Buckets)+1)
+	for name, state := range c.Buckets {
+		buckets[name] = state
+	}
+	buckets[bucket] = BucketState{Dropped: dropped, At: time.Now()}
+	c.Buckets = buckets
+	return nil
+}
+
+// Remove um bucket em todos os nós: as chaves dele deixam de existir e novas escritas são recusadas
+func (g *Gossip) DropBucket(bucket string) (int, error) {
+	return g.ProposeSetting("bucket-drop", bucket)
+}
+
+// Remove todas as chaves de um bucket em todos os nós, mantendo o bucket disponível para novas escritas
+func (g *Gossip) TruncateBucket(bucket string) (int, error) {
+	return g.ProposeSetting("bucket-truncate", bucket)
+}
+
+// Retorna o estado de remoção ou truncamento do bucket, se houver
+func (g *Gossip) bucketState(bucket string) (BucketState, bool) {
+	config := g.clusterConfig()
+	if config == nil {
+		return BucketState{}, false
+	}
+	state, exists := config.Buckets[bucket]
+	return state, exists
+}
+
+// Indica se uma versão da chave gravada em writtenAt foi removida pela remoção ou truncamento do bucket
+func (g *Gossip) bucketCovers(key string, writtenAt time.Time) bool {
+	state, exists := g.bucketState(BucketOf(key))
+	return exists && (state.Dropped || !writtenAt.After(state.At))
+}
+
+// Verifica se o bucket da chave aceita escritas: ele não pode ter sido removido nem estar
+// com uma remoção ou truncamento em andamento
+func (g *Gossip) checkBucketWritable(key string) error {
+	bucket := BucketOf(key)
+	if state, exists := g.bucketState(bucket); exists && state.Dropped {
+		return fmt.Errorf("bucket %s was dropped", bucket)
+	}
+
+	g.settingsMutex.Lock()
+	pending := g.pendingSetting
+	g.settingsMutex.Unlock()
+	if pending != nil && bucketOperations[pending.Name] != nil && pending.Value == bucket {
+		return fmt.Errorf("bucket %s: %w", bucket, ErrBucketFenced)
+	}
+	return nil
+}
+
+// Runner do job de limpeza de um bucket removido ou truncado: bucket-cleanup <bucket>.
+// Cada réplica remove as próprias cópias das chaves cobertas.
+func (kv *KeyValueStore) bucketCleanupJob(job *Job, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("missing bucket")
+	}
+	bucket := args[0]
+	state, exists := kv.Gossip.bucketState(bucket)
+	if !exists {
+		return nil
+	}
+
+	// As chaves de um bucket nomeado têm o prefixo "<bucket>/" e são removidas por um único
+	// range tombstone; as do bucket padrão não têm prefixo e recebem tombstones uma a uma
+	if bucket != DefaultBucket {
+		rt, err := kv.deletePrefix(bucket+"/", state.At)
+		if err != nil {
+			return err
+		}
+		hints := kv.discardBucketHints(bucket)
+		clusterLog.Info("Bucket cleaned up", "bucket", bucket, "range_tombstone", rt.String(), "hints_discarded", hints)
+		return job.Progress(1, 1)
+	}
+
+	keys := kv.bucketKeys(bucket, "")
+	inMemory := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		inMemory[key] = true
+	}
+	for _, key := range kv.LSM.Keys() {
+		if BucketOf(key) == bucket && !inMemory[key] {
+			keys = append(keys, key)
+		}
+	}
+
+	removed := 0
+	for i, key := range keys {
+		if i%bucketCleanupBatch == 0 {
+			if err := job.Progress(i, len(keys)); err != nil {
+				return err
+			}
+		}
+		covered, err := kv.tombstoneCovered(key, state.At)
+		if err != nil {
+			return err
+		}
+		if covered {
+			removed++
+		}
+	}
+	hints := kv.discardBucketHints(bucket)
+
+	clusterLog.Info("Bucket cleaned up", "bucket", bucket, "removed", removed, "hints_discarded", hints)
+	return job.Progress(len(keys), len(keys))
+}
+
+// Grava um tombstone local para a chave se a versão dela for anterior a at. Chaves que só
+// estão no disco foram gravadas antes deste processo começar e recebem um tombstone na memória,
+// gravado nas SSTables pelo próximo flush.
+func (kv *KeyValueStore) tombstoneCovered(key string, at time.Time) (bool, error) {
+	unlock := kv.keys.lock(key)
+	defer unlock()
+
+	kv.Mutex.Lock()
+	defer kv.Mutex.Unlock()
+
+	item, exists := kv.Data.Get(key)
+	if !exists {
+		if !kv.LSM.Contains(key) {
+			return false, nil
+		}
+		kv.Data.Set(key, &DataItem{VectorClock: vectorclock.NewVectorClock(), WrittenAt: time.Now()})
+		kv.dirty[key] = true
+		return true, nil
+	}
+	if item.Deleted() || item.WrittenAt.After(at) {
+		return false, nil
+	}
+
+	// O Vector Clock é mantido para que a próxima escrita da chave supere as cópias antigas
+	item.Value = ""
+	item.WrittenAt = time.Now()
+	// As irmãs gravadas antes de at também são cobertas
+	var kept []Sibling
+	for _, sibling := range item.Siblings {
+		if sibling.WrittenAt.After(at) {
+			kept = append(kept, sibling)
+		}
+	}
+	item.Siblings = kept
+	kv.dirty[key] = true
+	return true, nil
+}
+
+// Descarta os hints em memória das chaves do bucket cobertas pela remoção ou truncamento
+func (kv *KeyValueStore) discardBucketHints(bucket string) int {
+	kv.Mutex.Lock()
+	defer kv.Mutex.Unlock()
+
+	discarded := 0
+	for id, hint := range kv.HintedData {
+		if BucketOf(hint.Key) == bucket && kv.Gossip.bucketCovers(hint.Key, hint.Timestamp) {
+			delete(kv.HintedData, id)
+			discarded++
+		}
+	}
+	return discarded
+}
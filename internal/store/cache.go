@@ -0,0 +1,207 @@
+package store
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"slices"
+)
+
+// Memória padrão, em bytes, das chaves dos buckets de cache de um nó
+const DefaultCacheMemory = 64 << 20
+
+// Custo fixo estimado de uma chave na memória, além da chave, do valor e do Vector Clock
+const cacheEntryOverhead = 64
+
+// Um bucket em modo cache não é persistido: as chaves dele ficam só na memória das réplicas e,
+// quando elas passam de CacheMemory, as menos usadas recentemente são descartadas (allkeys-lru).
+// Cada descarte é publicado no sink de eventos. Assim o mesmo cluster serve de cache e de
+// armazenamento durável.
+var cacheSettings = map[string]func(c *ClusterConfig, bucket string) error{
+	"bucket-cache": func(c *ClusterConfig, bucket string) error {
+		if err := validateCacheBucket(c, bucket); err != nil {
+			return err
+		}
+		if slices.Contains(c.Caches, bucket) {
+			return fmt.Errorf("bucket %s is already a cache", bucket)
+		}
+		c.Caches = append(slices.Clone(c.Caches), bucket)
+		slices.Sort(c.Caches)
+		return nil
+	},
+	"bucket-durable": func(c *ClusterConfig, bucket string) error {
+		if err := validateCacheBucket(c, bucket); err != nil {
+			return err
+		}
+		i := slices.Index(c.Caches, bucket)
+		if i < 0 {
+			return fmt.Errorf("bucket %s is not a cache", bucket)
+		}
+		c.Caches = slices.Delete(slices.Clone(c.Caches), i, i+1)
+		return nil
+	},
+}
+
+func validateCacheBucket(c *ClusterConfig, bucket string) error {
+	if bucket == SystemBucket {
+		return fmt.Errorf("the %s bucket is reserved", SystemBucket)
+	}
+	if state, exists := c.Buckets[bucket]; exists && state.Dropped {
+		return fmt.Errorf("bucket %s was dropped", bucket)
+	}
+	return nil
+}
+
+// Transforma um bucket em cache em todos os nós
+func (g *Gossip) CacheBucket(bucket string) (int, error) {
+	return g.ProposeSetting("bucket-cache", bucket)
+}
+
+// Volta um bucket de cache a ser persistido em todos os nós
+func (g *Gossip) DurableBucket(bucket string) (int, error) {
+	return g.ProposeSetting("bucket-durable", bucket)
+}
+
+// Indica se o bucket está em modo cache
+func (g *Gossip) IsCacheBucket(bucket string) bool {
+	config := g.clusterConfig()
+	return config != nil && slices.Contains(config.Caches, bucket)
+}
+
+// lruCache ordena as chaves dos buckets de cache pelo último acesso e soma a memória delas
+type lruCache struct {
+	order   *list.List // Da mais recente para a menos recente
+	entries map[string]*list.Element
+	size    int64
+}
+
+type cacheEntry struct {
+	key  string
+	size int64
+}
+
+func newLRUCache() *lruCache {
+	return &lruCache{order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// Registra um acesso à chave, com o tamanho atual dela
+func (c *lruCache) touch(key string, size int64) {
+	if element, exists := c.entries[key]; exists {
+		entry := element.Value.(*cacheEntry)
+		c.size += size - entry.size
+		entry.size = size
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&cacheEntry{key: key, size: size})
+	c.size += size
+}
+
+// Remove e retorna a chave menos usada recentemente
+func (c *lruCache) evict() (string, bool) {
+	element := c.order.Back()
+	if element == nil {
+		return "", false
+	}
+	entry := element.Value.(*cacheEntry)
+	c.order.Remove(element)
+	delete(c.entries, entry.key)
+	c.size -= entry.size
+	return entry.key, true
+}
+
+// Estima a memória ocupada por uma chave
+func cacheEntrySize(key string, item *DataItem) int64 {
+	size := int64(cacheEntryOverhead + len(key) + len(item.Value))
+	for id := range item.VectorClock.Clock {
+		size += int64(len(id) + 8)
+	}
+	return size
+}
+
+// Registra um acesso a uma chave de um bucket de cache e, se a memória dos caches passou do
+// limite, acorda o evictor. Deve ser chamada com o Mutex obtido.
+func (kv *KeyValueStore) touchCache(key string) {
+	if !kv.Gossip.IsCacheBucket(BucketOf(key)) {
+		return
+	}
+	item, exists := kv.Data.Get(key)
+	if !exists {
+		return
+	}
+	kv.cache.touch(key, cacheEntrySize(key, item))
+	if kv.CacheMemory > 0 && kv.cache.size > kv.CacheMemory {
+		select {
+		case kv.evictions <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Função de loop que descarta as chaves menos usadas dos buckets de cache quando a memória
+// deles passa de CacheMemory
+func (kv *KeyValueStore) StartCacheEvictor(ctx context.Context) {
+	kv.runLoop(ctx, func(ctx context.Context) {
+		for {
+			select {
+			case <-kv.evictions:
+				kv.evictCache()
+			case <-ctx.Done():
+				return
+			}
+		}
+	})
+}
+
+// Descarta chaves, da menos usada para a mais usada, até a memória dos caches caber no limite,
+// e publica um evento por chave descartada
+func (kv *KeyValueStore) evictCache() {
+	var events []ConflictEvent
+	kv.Mutex.Lock()
+	for kv.CacheMemory > 0 && kv.cache.size > kv.CacheMemory {
+		key, ok := kv.cache.evict()
+		if !ok {
+			break
+		}
+		// O bucket pode ter voltado a ser durável desde o último acesso
+		if !kv.Gossip.IsCacheBucket(BucketOf(key)) {
+			continue
+		}
+		item, exists := kv.Data.Get(key)
+		if !exists {
+			continue
+		}
+		kv.Data.Delete(key)
+		delete(kv.dirty, key)
+		events = append(events, ConflictEvent{
+			Kind:     KeyEvicted,
+			Key:      key,
+			Clocks:   eventClocks(item.VectorClock),
+			Strategy: StrategyLRU,
+		})
+	}
+	kv.Mutex.Unlock()
+
+	if len(events) > 0 {
+		storageLog.Debug("Evicted least recently used cache keys", "keys", len(events))
+	}
+	for _, event := range events {
+		kv.emitConflict(event)
+	}
+}
+
+// Marca as chaves do bucket na memória para o próximo Flush, quando ele deixa de ser um cache
+func (kv *KeyValueStore) persistBucket(bucket string) {
+	kv.Mutex.Lock()
+	defer kv.Mutex.Unlock()
+
+	marked := 0
+	kv.Data.Ascend(func(key string, item *DataItem) bool {
+		if BucketOf(key) == bucket {
+			kv.dirty[key] = true
+			marked++
+		}
+		return true
+	})
+	storageLog.Info("Bucket is durable again, persisting its keys", "bucket", bucket, "keys", marked)
+}
@@ -0,0 +1,166 @@
+package store
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Com CaptureLog, cada operação de cliente coordenada pelo nó (escritas, remoções e leituras,
+// inclusive as dos lotes e as leituras e escritas de um compare-and-swap) é acrescentada a um
+// arquivo, uma linha JSON por operação. O kvctl replay reexecuta esses arquivos contra um
+// cluster de teste, para reproduzir um incidente ou medir uma mudança com tráfego real. Como
+// cada operação é coordenada por um único nó, os arquivos de todos os nós juntos têm o tráfego
+// do cluster sem repetição. A gravação é assíncrona: se a fila encher, as operações seguintes
+// ficam fora do arquivo e são contadas no log.
+
+// Tipos de operação capturados
+const (
+	CapturedPut    = "put"
+	CapturedDelete = "delete"
+	CapturedGet    = "get"
+)
+
+// Tamanho da fila de registros a gravar (captura e auditoria); registros além dela são descartados
+const lineQueueSize = 4096
+
+// CapturedOp é uma operação de cliente gravada no arquivo de captura
+type CapturedOp struct {
+	Time        time.Time        `json:"time"`
+	Node        string           `json:"node"` // Nó que coordenou a operação
+	Op          string           `json:"op"`
+	Key         string           `json:"key"`
+	Value       string           `json:"value,omitempty"`
+	Consistency ConsistencyLevel `json:"consistency,omitempty"`
+}
+
+// CaptureLog acrescenta as operações capturadas a um arquivo
+type CaptureLog struct {
+	*lineLog
+}
+
+// Abre (ou cria) o arquivo de captura em modo de acréscimo
+func NewCaptureLog(path string) (*CaptureLog, error) {
+	l, err := openLineLog(path, "capture")
+	if err != nil {
+		return nil, err
+	}
+	return &CaptureLog{l}, nil
+}
+
+// lineLog acrescenta registros a um arquivo, uma linha JSON por registro, gravados por uma
+// goroutine própria; se a fila encher, os registros seguintes são descartados e contados no log
+type lineLog struct {
+	kind    string // Nome do arquivo nos logs
+	file    *os.File
+	queue   chan any
+	mutex   sync.Mutex // Protege dropped e closed e impede envios na fila depois do Close
+	dropped int
+	closed  bool
+	done    chan struct{}
+}
+
+func openLineLog(path, kind string) (*lineLog, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	l := &lineLog{kind: kind, file: file, queue: make(chan any, lineQueueSize), done: make(chan struct{})}
+	go l.run()
+	return l, nil
+}
+
+// Grava os registros da fila, descarregando o buffer sempre que a fila esvazia
+func (l *lineLog) run() {
+	defer close(l.done)
+	writer := bufio.NewWriter(l.file)
+	for record := range l.queue {
+		data, err := json.Marshal(record)
+		if err != nil {
+			clusterLog.Error("Failed to encode record", "log", l.kind, "err", err)
+			continue
+		}
+		writer.Write(append(data, '\n'))
+		if len(l.queue) == 0 {
+			if err := writer.Flush(); err != nil {
+				clusterLog.Error("Failed to write records", "log", l.kind, "path", l.file.Name(), "err", err)
+			}
+		}
+	}
+	writer.Flush()
+	l.file.Close()
+}
+
+func (l *lineLog) record(record any) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.closed {
+		return
+	}
+	select {
+	case l.queue <- record:
+	default:
+		l.dropped++
+		if l.dropped == 1 || l.dropped%lineQueueSize == 0 {
+			clusterLog.Warn("Log queue is full", "log", l.kind, "path", l.file.Name(), "dropped", l.dropped)
+		}
+	}
+}
+
+// Grava os registros pendentes e fecha o arquivo
+func (l *lineLog) Close() {
+	l.mutex.Lock()
+	if !l.closed {
+		l.closed = true
+		close(l.queue)
+	}
+	l.mutex.Unlock()
+	<-l.done
+}
+
+// Registra uma operação de cliente no arquivo de captura, se houver
+func (kv *KeyValueStore) capture(op, key, value string, level ConsistencyLevel) {
+	if kv.CaptureLog == nil {
+		return
+	}
+	kv.CaptureLog.record(CapturedOp{Time: time.Now(), Node: kv.Gossip.Self.ID, Op: op, Key: key, Value: value, Consistency: level})
+}
+
+// Lê as operações de um ou mais arquivos de captura, em ordem de horário
+func ReadCapturedOps(paths ...string) ([]CapturedOp, error) {
+	var ops []CapturedOp
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(file)
+		// Um valor escapado em JSON pode passar do tamanho original
+		scanner.Buffer(make([]byte, 0, 64*1024), 2*MaxValueSizeLimit)
+		for line := 1; scanner.Scan(); line++ {
+			var op CapturedOp
+			if err := json.Unmarshal(scanner.Bytes(), &op); err != nil {
+				file.Close()
+				return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+			}
+			switch op.Op {
+			case CapturedPut, CapturedDelete, CapturedGet:
+			default:
+				file.Close()
+				return nil, fmt.Errorf("%s:%d: unknown operation %q", path, line, op.Op)
+			}
+			ops = append(ops, op)
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	sort.SliceStable(ops, func(i, j int) bool { return ops[i].Time.Before(ops[j].Time) })
+	return ops, nil
+}
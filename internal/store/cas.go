@@ -0,0 +1,194 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/bquerino/kv-g/internal/vectorclock"
+)
+
+// Um compare-and-swap lê a versão atual da chave e só grava o novo valor se ela for a esperada.
+// Os CAS de uma chave são sempre coordenados pelo primeiro nó vivo da lista de preferência, que
+// os executa um de cada vez sob um lock da chave: dois CAS concorrentes com a mesma condição não
+// passam os dois. Escritas comuns na chave não passam por esse lock, e uma troca de coordenador
+// (o primeiro nó caiu) pode ver uma versão anterior se a leitura não alcançar a última escrita;
+// por isso o CAS deve usar leituras e escritas de quórum (R + W > N).
+
+// CASCondition é a versão que um CompareAndSwap espera encontrar; exatamente um dos campos
+// deve ser preenchido
+type CASCondition struct {
+	VectorClock *vectorclock.VectorClock // A versão atual deve ter este Vector Clock
+	Value       string                   // O valor atual deve ser este
+	Absent      bool                     // A chave não pode existir (ou deve estar removida)
+}
+
+// CASConflictError indica que a versão atual da chave não é a esperada pelo CompareAndSwap
+type CASConflictError struct {
+	Key     string
+	Current *GetResult // Versão atual (Found é false se a chave não existe)
+}
+
+func (e *CASConflictError) Error() string {
+	if !e.Current.Found {
+		return fmt.Sprintf("compare-and-swap of key %s failed: the key does not exist", e.Key)
+	}
+	return fmt.Sprintf("compare-and-swap of key %s failed: current value is %s with VectorClock %s", e.Key, e.Current.Value, e.Current.VectorClock)
+}
+
+// Verifica se a condição tem exatamente um critério
+func (c CASCondition) validate() error {
+	set := 0
+	for _, ok := range []bool{c.VectorClock != nil, c.Value != "", c.Absent} {
+		if ok {
+			set++
+		}
+	}
+	if set != 1 {
+		return errors.New("compare-and-swap needs exactly one condition: a vector clock, a value or absent")
+	}
+	return nil
+}
+
+// Indica se a versão atual satisfaz a condição
+func (c CASCondition) matches(current *GetResult) bool {
+	switch {
+	case c.Absent:
+		return !current.Found
+	case c.VectorClock != nil:
+		return current.Found && clocksEqual(current.VectorClock, c.VectorClock)
+	}
+	return current.Found && len(current.Siblings) == 0 && current.Value == c.Value
+}
+
+// Grava value na chave se a versão atual satisfaz cond, com a leitura e a escrita no nível
+// level. Se não satisfaz, retorna um *CASConflictError com a versão atual.
+func (kv *KeyValueStore) CompareAndSwap(key, value string, cond CASCondition, level ConsistencyLevel) (*PutResult, error) {
+	if err := kv.checkPutSize(key, value); err != nil {
+		return nil, err
+	}
+	if err := cond.validate(); err != nil {
+		return nil, err
+	}
+
+	unlock := kv.casKeys.lock(key)
+	defer unlock()
+
+	current, err := kv.Get(key, level, NodeCaller)
+	if err != nil {
+		return nil, err
+	}
+	if current.Stale {
+		return nil, fmt.Errorf("cannot compare-and-swap key %s: its replicas are down and only a possibly stale version is available", key)
+	}
+	if !cond.matches(current) {
+		return nil, &CASConflictError{Key: key, Current: current}
+	}
+	// A nova versão supera a lida, inclusive as irmãs dela
+	return kv.write(key, value, current.VectorClock, level)
+}
+
+// Executa o compare-and-swap no primeiro nó vivo da lista de preferência da chave. Se ele não
+// responde, o CAS falha em vez de ser coordenado localmente, o que permitiria dois CAS
+// concorrentes em nós diferentes.
+func (g *Gossip) CompareAndSwap(key, value string, cond CASCondition, level ConsistencyLevel) (*PutResult, error) {
+	coordinator := g.primaryCoordinator(key)
+	g.recordCoordination(coordinator.ID, key, true, false)
+	if coordinator.ID == g.Self.ID {
+		result, err := g.KeyValueStore.CompareAndSwap(key, value, cond, level)
+		if result != nil {
+			result.Coordinator = g.Self.ID
+		}
+		return result, err
+	}
+
+	if err := cond.validate(); err != nil {
+		return nil, err
+	}
+	result, err := g.forwardCAS(coordinator, key, value, cond, level)
+	var remote *RemoteError
+	var conflict *CASConflictError
+	if err != nil && !errors.As(err, &remote) && !errors.As(err, &conflict) {
+		return nil, fmt.Errorf("coordinator %s of key %s is unavailable: %w", coordinator.ID, key, err)
+	}
+	return result, err
+}
+
+// Codifica a condição em dois campos: "absent -", "clock <vc>" ou "value <valor>"
+func (g *Gossip) encodeCASCondition(cond CASCondition) (kind, arg string) {
+	switch {
+	case cond.Absent:
+		return "absent", "-"
+	case cond.VectorClock != nil:
+		return "clock", g.nodeIndex.encodeClock(cond.VectorClock)
+	}
+	return "value", cond.Value
+}
+
+func (g *Gossip) decodeCASCondition(kind, arg string) (CASCondition, error) {
+	switch kind {
+	case "absent":
+		return CASCondition{Absent: true}, nil
+	case "clock":
+		clock, err := g.nodeIndex.decodeClock(arg)
+		return CASCondition{VectorClock: clock}, err
+	case "value":
+		return CASCondition{Value: arg}, nil
+	}
+	return CASCondition{}, fmt.Errorf("unknown compare-and-swap condition %q", kind)
+}
+
+// Encaminha um CAS ao coordenador ("FORWARD CAS <key> <value> <condição> [<nível>] #<checksum>" ->
+// "OK <N> <réplicas> <hints>" ou "CONFLICT <resposta de GET>" com a versão atual)
+func (g *Gossip) forwardCAS(node *Node, key, value string, cond CASCondition, level ConsistencyLevel) (*PutResult, error) {
+	kind, arg := g.encodeCASCondition(cond)
+	fields, err := g.forward(node, append(withLevel(level, "CAS", key, value, kind, arg), checksumField(value))...)
+	if err != nil {
+		return nil, err
+	}
+	if fields[0] == "CONFLICT" && len(fields) > 1 {
+		current, err := g.parseGetAnswer(node, key, fields[1:])
+		if err != nil {
+			return nil, err
+		}
+		return nil, &CASConflictError{Key: key, Current: current}
+	}
+	return parseWriteAnswer(node, key, fields)
+}
+
+// Formata a resposta a um CAS encaminhado
+func (g *Gossip) casAnswer(result *PutResult, err error) []string {
+	var conflict *CASConflictError
+	if errors.As(err, &conflict) {
+		return append([]string{"CONFLICT"}, g.getAnswer(conflict.Current, nil)...)
+	}
+	return writeAnswer(result, err)
+}
+
+// Converte a expressão de condição do CLI num CASCondition: value=<valor>, clock=<nó>=<contador>,...
+// (o formato do cabeçalho X-KV-Vector-Clock) ou absent
+func ParseCASCondition(s string) (CASCondition, error) {
+	if s == "absent" {
+		return CASCondition{Absent: true}, nil
+	}
+	kind, arg, _ := strings.Cut(s, "=")
+	switch kind {
+	case "value":
+		if arg == "" {
+			return CASCondition{}, errors.New("expected value must not be empty (use absent)")
+		}
+		return CASCondition{Value: arg}, nil
+	case "clock":
+		clock, err := decodeVectorClock(arg)
+		if err != nil {
+			return CASCondition{}, err
+		}
+		return CASCondition{VectorClock: clock}, nil
+	}
+	return CASCondition{}, fmt.Errorf("invalid condition %q (use value=<value>, clock=<node>=<counter>,... or absent)", s)
+}
+
+// Formata um Vector Clock como a condição clock= do CLI espera ("node1=2,node2=1")
+func FormatVectorClock(vc *vectorclock.VectorClock) string {
+	return encodeVectorClock(vc.Clock)
+}
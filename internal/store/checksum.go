@@ -0,0 +1,91 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+	"strings"
+)
+
+// Os checksums protegem os valores de ponta a ponta com o CRC-32C (Castagnoli) de cada valor.
+// O cliente pode informar o checksum numa escrita, conferido pelo nó que recebe a requisição, e
+// cada etapa seguinte envia o checksum junto com o valor e o confere ao recebê-lo: o
+// encaminhamento ao coordenador, as escritas nas réplicas, os hints, o read repair, as
+// transferências do rebalanceamento e as respostas das réplicas às leituras e aos scans. As
+// SSTables guardam o checksum de cada versão, conferido em toda leitura do disco, e a leitura
+// devolve o checksum do valor ao cliente. Uma versão com checksum divergente é tratada como
+// corrompida: a réplica recusa a escrita (e o coordenador guarda um hint), a leitura do disco
+// falha e a chave é reparada a partir das outras réplicas.
+
+// ErrChecksumMismatch é retornado quando um valor não confere com o checksum recebido com ele
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+var checksumTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ChecksumError descreve um valor que não confere com o checksum recebido com ele
+type ChecksumError struct {
+	Expected string // Checksum recebido
+	Actual   string // Checksum do valor
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("checksum mismatch: expected %s, value has %s", e.Expected, e.Actual)
+}
+
+func (e *ChecksumError) Unwrap() error {
+	return ErrChecksumMismatch
+}
+
+// Retorna o checksum de um valor: o CRC-32C em 8 dígitos hexadecimais
+func ValueChecksum(value string) string {
+	return fmt.Sprintf("%08x", valueCRC(value))
+}
+
+func valueCRC(value string) uint32 {
+	return crc32.Checksum([]byte(value), checksumTable)
+}
+
+// Valida um checksum informado pelo cliente (8 dígitos hexadecimais), retornando-o em minúsculas
+func ParseChecksum(s string) (string, error) {
+	if len(s) != 8 {
+		return "", fmt.Errorf("invalid checksum %q (use the CRC-32C as 8 hex digits)", s)
+	}
+	if _, err := strconv.ParseUint(s, 16, 32); err != nil {
+		return "", fmt.Errorf("invalid checksum %q (use the CRC-32C as 8 hex digits)", s)
+	}
+	return strings.ToLower(s), nil
+}
+
+// Confere o valor com o checksum recebido com ele; um checksum vazio não é conferido
+func VerifyChecksum(value, checksum string) error {
+	if checksum == "" {
+		return nil
+	}
+	if actual := ValueChecksum(value); actual != checksum {
+		return &ChecksumError{Expected: checksum, Actual: actual}
+	}
+	return nil
+}
+
+// Confere um valor lido do disco com o CRC-32C gravado com ele
+func verifyValueCRC(value string, crc uint32) error {
+	if actual := valueCRC(value); actual != crc {
+		return &ChecksumError{Expected: fmt.Sprintf("%08x", crc), Actual: fmt.Sprintf("%08x", actual)}
+	}
+	return nil
+}
+
+// Campo com o checksum de um valor nas mensagens entre nós ("#<checksum>")
+func checksumField(value string) string {
+	return "#" + ValueChecksum(value)
+}
+
+// Retira da mensagem o campo de checksum na posição at, se houver; nós anteriores não o enviam
+func takeChecksum(fields []string, at int) ([]string, string) {
+	if at < 0 || at >= len(fields) || !strings.HasPrefix(fields[at], "#") {
+		return fields, ""
+	}
+	checksum := fields[at][1:]
+	return append(fields[:at:at], fields[at+1:]...), checksum
+}
@@ -0,0 +1,188 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Um registro do arquivo de páginas precisa caber numa página. Um valor maior (um hint de um
+// valor grande, por exemplo) é gravado em pedaços: cada pedaço é um registro próprio, com a chave
+// "<chave> <geração> <n>" (as chaves com espaços são escapadas pelo hintLog), e a chave recebe um
+// manifesto, uma célula no estado cellManifest com a geração, o número de pedaços, o tamanho e o
+// CRC-32C do valor. A leitura junta os pedaços e confere o tamanho e o CRC. Os pedaços são
+// gravados antes do manifesto e removidos depois dele, então uma queda no meio de uma gravação
+// só deixa pedaços sem manifesto, descartados na abertura do arquivo. As SSTables não têm esse
+// limite: um valor grande fica num único registro.
+
+// Maior chave aceita pelo arquivo de páginas: a chave de cada pedaço precisa caber numa página
+// junto com uma parte do valor
+const maxPageKeySize = PageSize / 2
+
+// Conteúdo do manifesto: geração, pedaços, tamanho e CRC-32C do valor
+const chunkManifestFormat = "%d %d %d %08x"
+
+// chunkManifest descreve um valor gravado em pedaços
+type chunkManifest struct {
+	generation uint64 // Sequência da gravação, que separa os pedaços de versões diferentes da chave
+	chunks     int
+	length     int
+	crc        uint32
+}
+
+func parseChunkManifest(s string) (chunkManifest, error) {
+	var m chunkManifest
+	if _, err := fmt.Sscanf(s, chunkManifestFormat, &m.generation, &m.chunks, &m.length, &m.crc); err != nil {
+		return chunkManifest{}, fmt.Errorf("malformed chunk manifest %q", s)
+	}
+	return m, nil
+}
+
+// Chave do pedaço n de uma gravação da chave
+func chunkKey(key string, generation uint64, n int) string {
+	return key + " " + strconv.FormatUint(generation, 10) + " " + strconv.Itoa(n)
+}
+
+// Indica se a chave é de um pedaço
+func isChunkKey(key string) bool {
+	return strings.Contains(key, " ")
+}
+
+// Separa a chave de um pedaço na chave do valor e na geração
+func parseChunkKey(key string) (owner string, generation uint64, ok bool) {
+	fields := strings.Split(key, " ")
+	if len(fields) != 3 {
+		return "", 0, false
+	}
+	generation, err := strconv.ParseUint(fields[1], 10, 64)
+	return fields[0], generation, err == nil
+}
+
+// Grava o valor em pedaços, do tamanho que cabe numa página, e depois o manifesto na chave,
+// substituindo a versão anterior. Deve ser chamada com o Mutex obtido.
+func (pm *PageManager) putChunksLocked(key, value string) error {
+	generation := pm.nextSeq + 1
+	chunks := 0
+	for rest := value; rest != ""; chunks++ {
+		chunk := chunkKey(key, generation, chunks)
+		size := min(len(rest), PageSize-recordSize(chunk, ""))
+		// Os pedaços já gravados de uma gravação que falha são descartados na próxima abertura
+		if err := pm.putLocked(chunk, rest[:size], cellLive); err != nil {
+			return err
+		}
+		rest = rest[size:]
+	}
+	manifest := fmt.Sprintf(chunkManifestFormat, generation, chunks, len(value), valueCRC(value))
+	return pm.putLocked(key, manifest, cellManifest)
+}
+
+// Remove os pedaços do manifesto de uma chave. Deve ser chamada com o Mutex obtido.
+func (pm *PageManager) dropChunksLocked(key, manifest string) error {
+	m, err := parseChunkManifest(manifest)
+	if err != nil {
+		return err
+	}
+	var failed []error
+	for n := range m.chunks {
+		chunk := chunkKey(key, m.generation, n)
+		pm.indexMutex.Lock()
+		record, exists := pm.index[chunk]
+		delete(pm.index, chunk)
+		pm.indexMutex.Unlock()
+		if exists {
+			failed = append(failed, pm.removeRecordLocked(chunk, record))
+		}
+	}
+	return errors.Join(failed...)
+}
+
+// Junta os pedaços de um valor a partir do manifesto, conferindo o tamanho e o CRC
+func (pm *PageManager) readChunks(key, manifest string) (string, error) {
+	m, err := parseChunkManifest(manifest)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	b.Grow(m.length)
+	for n := range m.chunks {
+		chunk, err := pm.ReadValue(chunkKey(key, m.generation, n))
+		if errors.Is(err, errNotOnDisk) {
+			return "", fmt.Errorf("chunk %d of %d of key %s is missing", n+1, m.chunks, key)
+		}
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(chunk)
+	}
+	value := b.String()
+	if len(value) != m.length {
+		return "", fmt.Errorf("chunks of key %s hold %d bytes, expected %d", key, len(value), m.length)
+	}
+	if err := verifyValueCRC(value, m.crc); err != nil {
+		return "", fmt.Errorf("chunks of key %s: %w", key, err)
+	}
+	return value, nil
+}
+
+// Remove os pedaços sem manifesto que os aponte, deixados por uma gravação interrompida
+func (pm *PageManager) dropOrphanChunks() error {
+	pm.indexMutex.Lock()
+	var chunks []string
+	for key := range pm.index {
+		if isChunkKey(key) {
+			chunks = append(chunks, key)
+		}
+	}
+	pm.indexMutex.Unlock()
+	if len(chunks) == 0 {
+		return nil
+	}
+
+	generations := make(map[string]uint64)
+	var orphans []string
+	for _, chunk := range chunks {
+		owner, generation, ok := parseChunkKey(chunk)
+		current, known := generations[owner]
+		if ok && !known {
+			current = pm.chunkGeneration(owner)
+			generations[owner] = current
+		}
+		if !ok || generation != current {
+			orphans = append(orphans, chunk)
+		}
+	}
+	if len(orphans) == 0 {
+		return nil
+	}
+
+	pm.Mutex.Lock()
+	defer pm.Mutex.Unlock()
+	var failed []error
+	for _, chunk := range orphans {
+		pm.indexMutex.Lock()
+		record := pm.index[chunk]
+		delete(pm.index, chunk)
+		pm.indexMutex.Unlock()
+		failed = append(failed, pm.removeRecordLocked(chunk, record))
+	}
+	storageLog.Warn("Dropped chunks left by an interrupted write", "chunks", len(orphans), "path", pm.Path)
+	return errors.Join(failed...)
+}
+
+// Retorna a geração dos pedaços apontados pelo manifesto da chave (0 se ela não tiver manifesto)
+func (pm *PageManager) chunkGeneration(key string) uint64 {
+	record, exists := pm.Lookup(key)
+	if !exists {
+		return 0
+	}
+	value, manifest, ok, err := pm.readRecord(key, record)
+	if err != nil || !ok || !manifest {
+		return 0
+	}
+	m, err := parseChunkManifest(value)
+	if err != nil {
+		return 0
+	}
+	return m.generation
+}
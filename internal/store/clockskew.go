@@ -0,0 +1,126 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// O descarte dos tombstones, o truncamento de buckets e o desempate last-write-wins comparam
+// horários gravados por nós diferentes, então relógios desalinhados fazem uma escrita antiga
+// vencer ou um tombstone ser descartado antes da hora. Cada ACK de PING leva o horário do nó que responde; quem enviou o
+// PING estima a diferença entre os relógios descontando metade do tempo de ida e volta, e
+// suaviza as amostras por média móvel. Uma diferença acima de MaxClockSkew gera um alerta no log
+// e degrada a saúde do cluster.
+
+// Diferença padrão entre relógios a partir da qual um par é considerado desalinhado
+const DefaultMaxClockSkew = 500 * time.Millisecond
+
+// Peso de uma nova amostra na média móvel da diferença
+const skewSmoothing = 0.25
+
+// ClockSkew é a diferença estimada entre o relógio de um par e o deste nó
+type ClockSkew struct {
+	Skew    time.Duration // Positiva se o relógio do par está adiantado
+	RTT     time.Duration // Tempo de ida e volta da última amostra
+	Samples int
+	At      time.Time // Última amostra
+}
+
+type skewEstimate struct {
+	ClockSkew
+	warned bool // O alerta de desalinhamento já foi registrado
+}
+
+// skewTable guarda a diferença estimada de cada par
+type skewTable struct {
+	mutex sync.Mutex
+	peers map[string]*skewEstimate
+}
+
+func newSkewTable() *skewTable {
+	return &skewTable{peers: make(map[string]*skewEstimate)}
+}
+
+// Registra uma amostra do horário remote de um par, recebido na resposta a uma mensagem enviada
+// em sent e recebida em received
+func (t *skewTable) record(peer string, remote, sent, received time.Time, limit time.Duration) {
+	rtt := received.Sub(sent)
+	sample := remote.Sub(sent.Add(rtt / 2))
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	estimate, exists := t.peers[peer]
+	if !exists {
+		estimate = &skewEstimate{ClockSkew: ClockSkew{Skew: sample}}
+		t.peers[peer] = estimate
+	} else {
+		estimate.Skew += time.Duration(skewSmoothing * float64(sample-estimate.Skew))
+	}
+	estimate.RTT, estimate.At = rtt, received
+	estimate.Samples++
+
+	switch over := limit > 0 && estimate.Skew.Abs() > limit; {
+	case over && !estimate.warned:
+		estimate.warned = true
+		gossipLog.Warn("Clock skew above the limit; tombstone expiry and last-write-wins may misbehave", "peer", peer, "skew", describeSkew(estimate.Skew), "limit", limit)
+	case !over && estimate.warned:
+		estimate.warned = false
+		gossipLog.Info("Clock skew back within the limit", "peer", peer, "limit", limit)
+	}
+}
+
+// Retorna a diferença estimada de um par
+func (t *skewTable) lookup(peer string) (ClockSkew, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	estimate, exists := t.peers[peer]
+	if !exists {
+		return ClockSkew{}, false
+	}
+	return estimate.ClockSkew, true
+}
+
+// Retorna as diferenças estimadas dos pares conhecidos
+func (g *Gossip) ClockSkews() map[string]ClockSkew {
+	g.Mutex.Lock()
+	peers := make([]string, 0, len(g.Nodes))
+	for id := range g.Nodes {
+		peers = append(peers, id)
+	}
+	g.Mutex.Unlock()
+
+	skews := make(map[string]ClockSkew, len(peers))
+	for _, peer := range peers {
+		if skew, known := g.clockSkews.lookup(peer); known {
+			skews[peer] = skew
+		}
+	}
+	return skews
+}
+
+// Retorna os pares cujo relógio passa de MaxClockSkew, em ordem de ID
+func (g *Gossip) skewedPeers() []string {
+	if g.MaxClockSkew <= 0 {
+		return nil
+	}
+	var skewed []string
+	for peer, skew := range g.ClockSkews() {
+		if skew.Skew.Abs() > g.MaxClockSkew {
+			skewed = append(skewed, fmt.Sprintf("%s (%s)", peer, describeSkew(skew.Skew)))
+		}
+	}
+	sort.Strings(skewed)
+	return skewed
+}
+
+// Descreve a diferença como "120ms ahead" ou "3s behind"
+func describeSkew(skew time.Duration) string {
+	if skew < 0 {
+		return skew.Abs().Round(time.Millisecond).String() + " behind"
+	}
+	return skew.Round(time.Millisecond).String() + " ahead"
+}
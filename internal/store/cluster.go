@@ -0,0 +1,206 @@
+package store
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Bucket reservado para a configuração do sistema
+const SystemBucket = "_system"
+
+// Nome do arquivo de configuração do cluster dentro do bucket de sistema
+const clusterConfigFile = "cluster.json"
+
+// NodeConfig descreve um nó participante do cluster
+type NodeConfig struct {
+	ID      string   `json:"id"`
+	Index   int      `json:"index"` // Índice curto do nó nos Vector Clocks
+	Address string   `json:"address"`
+	Tokens  []uint32 `json:"tokens"` // Posições dos vNodes do nó no anel
+}
+
+// ClusterConfig é a configuração inicial do cluster gravada no bucket de sistema
+type ClusterConfig struct {
+	Name        string                 `json:"name"`  // Nome do cluster, validado no handshake de entrada
+	Token       string                 `json:"token"` // Segredo compartilhado exigido para entrar no cluster
+	Nodes       []NodeConfig           `json:"nodes"`
+	N           int                    `json:"n"`                 // Número de réplicas por chave
+	R           int                    `json:"r"`                 // Réplicas necessárias para uma leitura
+	W           int                    `json:"w"`                 // Réplicas necessárias para uma escrita
+	VNodes      int                    `json:"vnodes"`            // Número de vNodes por nó físico
+	Degradation DegradationPolicy      `json:"degradation"`       // Comportamento quando há menos de N réplicas vivas
+	Epoch       int                    `json:"epoch"`             // Versão da configuração, incrementada a cada mudança coordenada
+	Buckets     map[string]BucketState `json:"buckets,omitempty"` // Buckets removidos ou truncados
+	Routing     *RoutingRule           `json:"routing,omitempty"` // Roteamento por prefixo da chave (nil = chave inteira)
+	Export      *ExportPolicy          `json:"export,omitempty"`  // Limites dos exports (nil = sem limites)
+	Caches      []string               `json:"caches,omitempty"`  // Buckets em modo cache: só na memória, com descarte LRU
+	Renamed     map[string]string      `json:"renamed,omitempty"` // ID anterior -> novo ID dos nós renomeados
+	APITokens   map[string]APIToken    `json:"acl,omitempty"`     // Tokens dos clientes das APIs e as regras de acesso deles, por nome
+	Primaries   map[uint32]string      `json:"primary,omitempty"` // Nó promovido a primário por token dos trechos (promote)
+	CreatedAt   time.Time              `json:"created_at"`
+}
+
+// Converte uma lista "id=host:port,id=host:port" em NodeConfigs.
+// Quando o ID é omitido ("host:port"), o próprio endereço é usado como ID.
+func ParseNodeList(list string) ([]NodeConfig, error) {
+	var nodes []NodeConfig
+	seen := make(map[string]bool)
+
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		id, address, found := strings.Cut(entry, "=")
+		if !found {
+			address = id
+		}
+		if id == "" || address == "" {
+			return nil, fmt.Errorf("invalid node entry %q", entry)
+		}
+		if strings.ContainsAny(id, "#=@, \t") {
+			return nil, fmt.Errorf("node id %q must not contain '#', '=', '@', ',' or whitespace", id)
+		}
+		if seen[id] {
+			return nil, fmt.Errorf("duplicate node id %q", id)
+		}
+		seen[id] = true
+
+		nodes = append(nodes, NodeConfig{ID: id, Address: address})
+	}
+
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("no nodes given")
+	}
+	return nodes, nil
+}
+
+// Cria a configuração do cluster validando N/R/W e provisionando os tokens do anel
+func NewClusterConfig(nodes []NodeConfig, n, r, w, vNodes int) (*ClusterConfig, error) {
+	if n < 1 || n > len(nodes) {
+		return nil, fmt.Errorf("n must be between 1 and the number of nodes (%d), got %d", len(nodes), n)
+	}
+	if r < 1 || r > n {
+		return nil, fmt.Errorf("r must be between 1 and n (%d), got %d", n, r)
+	}
+	if w < 1 || w > n {
+		return nil, fmt.Errorf("w must be between 1 and n (%d), got %d", n, w)
+	}
+	if vNodes < 1 {
+		return nil, fmt.Errorf("vnodes must be at least 1, got %d", vNodes)
+	}
+
+	// Provisiona os tokens com o mesmo esquema usado pelo anel
+	ring := NewConsistentHashing(vNodes)
+	for i := range nodes {
+		nodes[i].Tokens = ring.GenerateTokens(nodes[i].ID)
+		nodes[i].Index = i + 1
+	}
+
+	return &ClusterConfig{
+		Nodes:       nodes,
+		N:           n,
+		R:           r,
+		W:           w,
+		VNodes:      vNodes,
+		Degradation: DegradeHint,
+		CreatedAt:   time.Now(),
+	}, nil
+}
+
+// Retorna o caminho da configuração do cluster dentro do diretório de dados
+func ClusterConfigPath(dataDir string) string {
+	return filepath.Join(dataDir, SystemBucket, clusterConfigFile)
+}
+
+// Grava a configuração no bucket de sistema
+func (c *ClusterConfig) Save(dataDir string) error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(ClusterConfigPath(dataDir), data, 0644)
+}
+
+// Carrega a configuração do cluster do bucket de sistema
+func LoadClusterConfig(dataDir string) (*ClusterConfig, error) {
+	data, err := os.ReadFile(ClusterConfigPath(dataDir))
+	if err != nil {
+		return nil, err
+	}
+
+	var config ClusterConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("invalid cluster config: %w", err)
+	}
+	return &config, nil
+}
+
+// Verifica a conectividade com os nós, em paralelo, retornando o erro de cada nó inacessível.
+// Com tlsConfig, a verificação inclui o handshake TLS com cada nó.
+func VerifyConnectivity(nodes []NodeConfig, timeout time.Duration, tlsConfig *tls.Config) map[string]error {
+	ids := make([]string, len(nodes))
+	for i, node := range nodes {
+		ids[i] = node.ID
+	}
+	_, failed := scatterGather(ids, DefaultWorkerConfig().ScatterWorkers, timeout, func(i int) (struct{}, error) {
+		conn, err := dialPeerAddress(nil, nodes[i].Address, timeout, 0, tlsForAddress(tlsConfig, nodes[i].Address))
+		if err != nil {
+			return struct{}{}, err
+		}
+		newPeerConn(conn, false).send("PING", "from", "kvctl")
+		conn.Close()
+		return struct{}{}, nil
+	})
+
+	failures := make(map[string]error)
+	for _, failure := range failed {
+		failures[failure.NodeID] = failure.Err
+	}
+	return failures
+}
+
+// Aplica a configuração do cluster ao Gossip, adicionando os pares com seus tokens. O anel é
+// montado sob o lock dele, para que uma escrita ou réplica concorrente não veja o próprio nó
+// fora do anel entre a remoção e a nova inserção dos tokens.
+func (g *Gossip) ApplyClusterConfig(config *ClusterConfig) {
+	g.Mutex.Lock()
+	defer g.Mutex.Unlock()
+
+	g.clusterMutex.Lock()
+	g.Cluster = config
+	g.clusterMutex.Unlock()
+
+	ch := g.ConsistentHash
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+	ch.VNodes = config.VNodes
+	ch.Routing = config.Routing
+	ch.setPrimariesLocked(config.Primaries, g.KeyValueStore.replicationFactor())
+	if config.Degradation != "" {
+		g.KeyValueStore.Degradation = config.Degradation
+	}
+	for _, nc := range config.Nodes {
+		g.nodeIndex.assign(nc.ID, nc.Index)
+		if nc.ID == g.Self.ID {
+			g.Self.Address = nc.Address
+			ch.removeNodeLocked(nc.ID)
+			ch.addNodeWithTokensLocked(g.Self, nc.Tokens)
+			continue
+		}
+
+		node := &Node{
+			ID:      nc.ID,
+			Address: nc.Address,
+			Alive:   true,
+		}
+		g.Nodes[nc.ID] = node
+		ch.addNodeWithTokensLocked(node, nc.Tokens)
+	}
+}
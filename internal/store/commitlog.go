@@ -0,0 +1,227 @@
+package store
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bquerino/kv-g/internal/vectorclock"
+)
+
+// Uma escrita local fica só na memória até o próximo flush; numa escrita comum, as outras
+// réplicas já a têm quando o cliente recebe a confirmação. Com o ack rápido (ver fastack.go), a
+// confirmação vem antes disso, então a cópia local é antes acrescentada ao commit log e o
+// arquivo é sincronizado. Cada flush persiste todas as chaves alteradas, inclusive as do log,
+// que então é esvaziado. Na abertura, as escritas que ficaram no log são reaplicadas, gravadas
+// num flush e replicadas de novo. Cada linha leva o CRC-32C do restante: uma linha incompleta ou
+// corrompida (queda durante a gravação) é de uma escrita que não foi confirmada e encerra a leitura.
+
+// Nome do commit log no diretório de dados
+const commitLogFile = "commit.log"
+
+// Marca dos registros com a chave e o valor escapados (url.PathEscape), que podem ter espaços e
+// quebras de linha; os registros de versões anteriores, sem a marca, começam pelo timestamp
+const commitLogEscaped = "e"
+
+// commitEntry é uma escrita lida do commit log
+type commitEntry struct {
+	Key         string
+	Value       string // Vazio num tombstone
+	VectorClock *vectorclock.VectorClock
+	WrittenAt   time.Time
+}
+
+// commitLog acrescenta as escritas com ack rápido a um arquivo sincronizado a cada gravação
+type commitLog struct {
+	path  string
+	nodes *nodeTable // Índices dos nós usados nos Vector Clocks gravados
+	mutex sync.Mutex // Serializa as gravações e o esvaziamento do arquivo
+	file  *os.File   // Aberto na primeira gravação
+	size  int64      // Bytes no arquivo desde o último esvaziamento
+}
+
+func newCommitLog(path string, nodes *nodeTable) *commitLog {
+	return &commitLog{path: path, nodes: nodes}
+}
+
+// Acrescenta a escrita ao arquivo e o sincroniza
+func (l *commitLog) append(key, value string, vc *vectorclock.VectorClock, writtenAt time.Time) error {
+	line := fmt.Sprintf("%s %d %s %s %s", commitLogEscaped, writtenAt.UnixNano(), l.nodes.encodeClock(vc), url.PathEscape(key), url.PathEscape(value))
+	record := fmt.Sprintf("%08x %s\n", valueCRC(line), line)
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.file == nil {
+		file, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		l.file = file
+	}
+	if _, err := l.file.WriteString(record); err != nil {
+		return err
+	}
+	l.size += int64(len(record))
+	return l.file.Sync()
+}
+
+// Esvazia o arquivo depois de um flush, que persistiu todas as escritas gravadas nele
+func (l *commitLog) truncate() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.size == 0 {
+		return nil
+	}
+	if l.file == nil {
+		if err := os.Truncate(l.path, 0); err != nil {
+			return err
+		}
+	} else {
+		if err := l.file.Truncate(0); err != nil {
+			return err
+		}
+		if err := l.file.Sync(); err != nil {
+			return err
+		}
+	}
+	l.size = 0
+	return nil
+}
+
+// Lê as escritas do arquivo, na ordem em que foram gravadas, até a primeira linha incompleta ou
+// corrompida
+func (l *commitLog) read() ([]commitEntry, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	file, err := os.Open(l.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if info, err := file.Stat(); err == nil {
+		l.size = info.Size()
+	}
+
+	var entries []commitEntry
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadString('\n')
+		if errors.Is(err, io.EOF) {
+			if line != "" {
+				storageLog.Warn("Ignoring incomplete record at the end of the commit log", "path", l.path)
+			}
+			return entries, nil
+		}
+		if err != nil {
+			return entries, err
+		}
+		entry, err := l.decode(strings.TrimSuffix(line, "\n"))
+		if err != nil {
+			storageLog.Warn("Ignoring the rest of the commit log after a corrupt record", "path", l.path, "records", len(entries), "err", err)
+			return entries, nil
+		}
+		entries = append(entries, entry)
+	}
+}
+
+// Decodifica uma linha gravada por append
+func (l *commitLog) decode(line string) (commitEntry, error) {
+	crc, rest, ok := strings.Cut(line, " ")
+	if !ok {
+		return commitEntry{}, errors.New("malformed commit log record")
+	}
+	expected, err := strconv.ParseUint(crc, 16, 32)
+	if err != nil {
+		return commitEntry{}, fmt.Errorf("malformed commit log record: %w", err)
+	}
+	if err := verifyValueCRC(rest, uint32(expected)); err != nil {
+		return commitEntry{}, err
+	}
+
+	escaped := strings.HasPrefix(rest, commitLogEscaped+" ")
+	if escaped {
+		rest = strings.TrimPrefix(rest, commitLogEscaped+" ")
+	}
+	fields := strings.SplitN(rest, " ", 4)
+	if len(fields) != 4 {
+		return commitEntry{}, errors.New("malformed commit log record")
+	}
+	if escaped {
+		key, err1 := url.PathUnescape(fields[2])
+		value, err2 := url.PathUnescape(fields[3])
+		if err := errors.Join(err1, err2); err != nil {
+			return commitEntry{}, fmt.Errorf("malformed commit log record: %w", err)
+		}
+		fields[2], fields[3] = key, value
+	}
+	timestamp, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return commitEntry{}, fmt.Errorf("malformed commit log record: %w", err)
+	}
+	clock, err := l.nodes.decodeClock(fields[1])
+	if err != nil {
+		return commitEntry{}, err
+	}
+	return commitEntry{Key: fields[2], Value: fields[3], VectorClock: clock, WrittenAt: time.Unix(0, timestamp)}, nil
+}
+
+func (l *commitLog) close() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+}
+
+// Reaplica as escritas que ficaram no commit log de uma execução anterior, persiste-as num flush
+// (que esvazia o log) e as replica de novo em segundo plano, já que a queda pode ter acontecido
+// antes de chegarem às outras réplicas. Deve ser chamada na inicialização, antes do flusher.
+func (kv *KeyValueStore) ReplayCommitLog() error {
+	entries, err := kv.commitLog.read()
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return kv.commitLog.truncate()
+	}
+
+	for _, entry := range entries {
+		kv.ApplyReplica(entry.Key, entry.Value, entry.VectorClock, entry.WrittenAt)
+	}
+	if err := kv.Flush(); err != nil {
+		return err
+	}
+	storageLog.Info("Replayed writes from the commit log", "writes", len(entries))
+
+	n := kv.replicationFactor()
+	for _, entry := range entries {
+		preference, live, down := kv.writeTargets(entry.Key, n)
+		outcomes := make([]ReplicaOutcome, len(live))
+		for i, node := range live {
+			if node.ID == kv.Gossip.Self.ID {
+				outcomes[i] = ReplicaOutcome{NodeID: node.ID, Status: ReplicaOK}
+			}
+		}
+		result := &PutResult{Key: entry.Key, Requested: n}
+		for _, node := range down {
+			result.Outcomes = append(result.Outcomes, ReplicaOutcome{NodeID: node.ID, Status: ReplicaSkipped})
+		}
+		kv.replicateInBackground(result, preference, live, down, outcomes, entry.Value, entry.VectorClock, entry.WrittenAt)
+	}
+	return nil
+}
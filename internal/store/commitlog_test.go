@@ -0,0 +1,55 @@
+package store
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bquerino/kv-g/internal/vectorclock"
+)
+
+// Chaves e valores com espaços, quebras de linha e bytes quaisquer voltam iguais do commit log, e
+// os registros gravados por versões anteriores continuam legíveis
+func TestCommitLogKeepsKeysWithWhitespace(t *testing.T) {
+	dir := t.TempDir()
+	table := loadNodeTable(dir)
+	table.assign("node1", 1)
+	path := filepath.Join(dir, commitLogFile)
+
+	at := time.Unix(0, 1700000000000000000)
+	vc := vectorclock.NewVectorClock()
+	vc.Increment("node1")
+
+	legacy := fmt.Sprintf("%d %s %s %s", at.UnixNano(), table.encodeClock(vc), "antiga", "valor com espaços")
+	if err := os.WriteFile(path, []byte(fmt.Sprintf("%08x %s\n", valueCRC(legacy), legacy)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	writes := []commitEntry{
+		{Key: "chave com espaço", Value: "linha 1\nlinha 2\r\n"},
+		{Key: "tab\tnul\x00%41", Value: "\xff\x00 e"},
+		{Key: "removida por um tombstone"},
+	}
+	log := newCommitLog(path, table)
+	for _, w := range writes {
+		if err := log.append(w.Key, w.Value, vc, at); err != nil {
+			t.Fatal(err)
+		}
+	}
+	log.close()
+
+	entries, err := newCommitLog(path, table).read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := append([]commitEntry{{Key: "antiga", Value: "valor com espaços"}}, writes...)
+	if len(entries) != len(want) {
+		t.Fatalf("read %d entries, want %d: %+v", len(entries), len(want), entries)
+	}
+	for i, entry := range entries {
+		if entry.Key != want[i].Key || entry.Value != want[i].Value || !entry.WrittenAt.Equal(at) || !clocksEqual(entry.VectorClock, vc) {
+			t.Errorf("entry %d = %q %q %v %v; want %q %q", i, entry.Key, entry.Value, entry.WrittenAt, entry.VectorClock.Clock, want[i].Key, want[i].Value)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package store
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/bquerino/kv-g/internal/vectorclock"
+)
+
+// A estratégia de resolução decide o que acontece com versões concorrentes de uma chave, tanto
+// na réplica que recebe uma versão concorrente à local quanto na leitura que encontra versões
+// concorrentes em réplicas diferentes. Cada réplica resolve de forma independente, então uma
+// estratégia precisa chegar ao mesmo resultado para as mesmas versões em qualquer nó.
+
+// ConflictResolver resolve um conflito entre versões de uma chave. Resolve recebe as versões
+// concorrentes (nenhuma supera outra) e retorna as que continuam guardadas: uma única versão
+// encerra o conflito, e as demais ficam como irmãs até um resolve do cliente.
+type ConflictResolver interface {
+	Name() string
+	Resolve(key string, versions []Sibling) []Sibling
+}
+
+// SiblingsResolver guarda todas as versões concorrentes como irmãs (padrão)
+type SiblingsResolver struct{}
+
+func (SiblingsResolver) Name() string { return StrategySiblings }
+
+func (SiblingsResolver) Resolve(key string, versions []Sibling) []Sibling {
+	return versions
+}
+
+// LastWriteWinsResolver fica com a versão gravada por último pelo coordenador. Empates são
+// decididos pela soma dos contadores e, depois, pelo valor. Depende dos relógios dos nós estarem
+// sincronizados: com um relógio adiantado, uma escrita mais antiga pode prevalecer.
+type LastWriteWinsResolver struct{}
+
+func (LastWriteWinsResolver) Name() string { return StrategyLWW }
+
+func (LastWriteWinsResolver) Resolve(key string, versions []Sibling) []Sibling {
+	winner := versions[0]
+	for _, version := range versions[1:] {
+		if version.WrittenAt.Equal(winner.WrittenAt) {
+			weight, winnerWeight := clockWeight(version.VectorClock.Clock), clockWeight(winner.VectorClock.Clock)
+			if weight > winnerWeight || weight == winnerWeight && version.Value > winner.Value {
+				winner = version
+			}
+		} else if version.WrittenAt.After(winner.WrittenAt) {
+			winner = version
+		}
+	}
+	return []Sibling{winner}
+}
+
+// MergeFunc combina os valores de versões concorrentes num único valor ("" grava um tombstone).
+// Deve ser determinística: réplicas diferentes aplicam a função às mesmas versões de forma
+// independente e precisam chegar ao mesmo valor.
+type MergeFunc func(key string, versions []Sibling) string
+
+// MergeResolver substitui as versões concorrentes pelo valor combinado por uma MergeFunc, com um
+// Vector Clock que junta os de todas elas
+type MergeResolver struct {
+	name  string
+	merge MergeFunc
+}
+
+func (r MergeResolver) Name() string { return "merge:" + r.name }
+
+func (r MergeResolver) Resolve(key string, versions []Sibling) []Sibling {
+	merged := Sibling{Value: r.merge(key, versions), VectorClock: vectorclock.NewVectorClock()}
+	for _, version := range versions {
+		merged.VectorClock.Merge(version.VectorClock)
+		if version.WrittenAt.After(merged.WrittenAt) {
+			merged.WrittenAt = version.WrittenAt
+		}
+	}
+	return []Sibling{merged}
+}
+
+var (
+	mergeFuncsMutex sync.Mutex
+	mergeFuncs      = make(map[string]MergeFunc)
+)
+
+// Registra uma função de merge, selecionável na configuração como "merge:<name>". Deve ser
+// chamada antes de o nó começar a atender.
+func RegisterMergeFunc(name string, merge MergeFunc) {
+	mergeFuncsMutex.Lock()
+	defer mergeFuncsMutex.Unlock()
+	mergeFuncs[name] = merge
+}
+
+// Cria uma estratégia a partir da configuração: "siblings", "lww" ou "merge:<name>"
+func ParseConflictResolver(spec string) (ConflictResolver, error) {
+	kind, name, _ := strings.Cut(spec, ":")
+	switch {
+	case kind == StrategySiblings && name == "":
+		return SiblingsResolver{}, nil
+	case kind == StrategyLWW && name == "":
+		return LastWriteWinsResolver{}, nil
+	case kind == "merge" && name != "":
+		mergeFuncsMutex.Lock()
+		merge, exists := mergeFuncs[name]
+		mergeFuncsMutex.Unlock()
+		if !exists {
+			return nil, fmt.Errorf("no merge function registered as %q", name)
+		}
+		return MergeResolver{name: name, merge: merge}, nil
+	}
+	return nil, fmt.Errorf("unknown conflict resolution %q (use siblings, lww or merge:<name>)", spec)
+}
+
+// Retorna a estratégia configurada (nil = guardar as irmãs)
+func (kv *KeyValueStore) conflictResolver() ConflictResolver {
+	if kv.ConflictResolver == nil {
+		return SiblingsResolver{}
+	}
+	return kv.ConflictResolver
+}
+
+// Aplica a estratégia às versões concorrentes encontradas por uma leitura. As versões que já
+// existiam mantêm a réplica que as devolveu; uma versão nova (um merge) é atribuída a este nó.
+func (kv *KeyValueStore) resolveVersions(key string, latest []replicaVersion) []replicaVersion {
+	versions := make([]Sibling, len(latest))
+	for i, version := range latest {
+		versions[i] = Sibling{Value: version.Value, VectorClock: version.VectorClock, WrittenAt: version.WrittenAt}
+	}
+
+	var resolved []replicaVersion
+	for _, sibling := range kv.conflictResolver().Resolve(key, versions) {
+		version := replicaVersion{NodeID: kv.Gossip.Self.ID, Value: sibling.Value, VectorClock: sibling.VectorClock, WrittenAt: sibling.WrittenAt, Found: true}
+		for _, existing := range latest {
+			if clocksEqual(existing.VectorClock, sibling.VectorClock) {
+				version = existing
+				break
+			}
+		}
+		resolved = append(resolved, version)
+	}
+	return resolved
+}
@@ -0,0 +1,190 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bquerino/kv-g/internal/vectorclock"
+)
+
+// Tipos de evento de conflito
+const (
+	ConflictDetected = "detected" // Uma réplica recebeu uma versão concorrente à local
+	ConflictSiblings = "siblings" // Uma leitura devolveu versões concorrentes ao cliente
+	ConflictResolved = "resolved" // Uma versão substituiu as concorrentes (resolve do cliente ou estratégia de resolução)
+	KeyEvicted       = "evicted"  // Uma chave de um bucket de cache foi descartada por falta de memória
+)
+
+// Estratégias usadas para tratar um conflito
+const (
+	StrategySiblings    = "siblings"     // A versão recebida foi guardada como irmã da local
+	StrategyLWW         = "lww"          // Prevaleceu a versão gravada por último pelo coordenador
+	StrategyClockWeight = "clock-weight" // Maior soma dos contadores e, depois, maior valor
+	StrategyClient      = "client"       // O cliente escolheu o valor que substitui as versões concorrentes
+	StrategyLRU         = "allkeys-lru"  // A chave menos usada recentemente foi descartada
+)
+
+// Tamanho da fila de eventos de um sink assíncrono; eventos além dela são descartados
+const conflictQueueSize = 1024
+
+// ConflictEvent descreve um conflito entre versões de uma chave
+type ConflictEvent struct {
+	Time     time.Time        `json:"time"`
+	Node     string           `json:"node"` // Nó que observou o conflito
+	Kind     string           `json:"kind"`
+	Key      string           `json:"key"`
+	Clocks   []map[string]int `json:"clocks"` // Vector Clocks das versões concorrentes
+	Strategy string           `json:"strategy"`
+	Winner   map[string]int   `json:"winner,omitempty"` // Vector Clock da versão escolhida
+}
+
+// ConflictSink recebe os eventos de conflito. Emit não deve bloquear a escrita ou a leitura
+// que gerou o evento.
+type ConflictSink interface {
+	Emit(event ConflictEvent)
+}
+
+// Cria um sink a partir da configuração: "log", "file:<caminho>" ou "webhook:<url>"
+func ParseConflictSink(spec string) (ConflictSink, error) {
+	kind, target, _ := strings.Cut(spec, ":")
+	switch {
+	case kind == "log" && target == "":
+		return LogConflictSink{}, nil
+	case kind == "file" && target != "":
+		return NewFileConflictSink(target)
+	case kind == "webhook" && target != "":
+		return NewWebhookConflictSink(target), nil
+	}
+	return nil, fmt.Errorf("unknown conflict sink %q (use log, file:<path> or webhook:<url>)", spec)
+}
+
+// Publica um evento de conflito no sink configurado, se houver
+func (kv *KeyValueStore) emitConflict(event ConflictEvent) {
+	if kv.ConflictSink == nil {
+		return
+	}
+	event.Time = time.Now()
+	event.Node = kv.Gossip.Self.ID
+	kv.ConflictSink.Emit(event)
+}
+
+// Copia os Vector Clocks para o evento, que é publicado depois que os locks são liberados
+func eventClocks(clocks ...*vectorclock.VectorClock) []map[string]int {
+	copies := make([]map[string]int, 0, len(clocks))
+	for _, vc := range clocks {
+		clock := make(map[string]int, len(vc.Clock))
+		for id, counter := range vc.Clock {
+			clock[id] = counter
+		}
+		copies = append(copies, clock)
+	}
+	return copies
+}
+
+// LogConflictSink escreve cada evento no log do nó como JSON
+type LogConflictSink struct{}
+
+func (LogConflictSink) Emit(event ConflictEvent) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		replicationLog.Error("Failed to encode conflict event", "key", logKey(event.Key), "err", err)
+		return
+	}
+	replicationLog.Info("CONFLICT", "event", json.RawMessage(data))
+}
+
+// asyncSink entrega os eventos numa goroutine própria, descartando-os quando a fila enche
+type asyncSink struct {
+	queue   chan ConflictEvent
+	mutex   sync.Mutex
+	dropped int
+}
+
+func newAsyncSink(deliver func(ConflictEvent)) *asyncSink {
+	s := &asyncSink{queue: make(chan ConflictEvent, conflictQueueSize)}
+	go func() {
+		for event := range s.queue {
+			deliver(event)
+		}
+	}()
+	return s
+}
+
+func (s *asyncSink) Emit(event ConflictEvent) {
+	select {
+	case s.queue <- event:
+	default:
+		s.mutex.Lock()
+		s.dropped++
+		dropped := s.dropped
+		s.mutex.Unlock()
+		if dropped == 1 || dropped%conflictQueueSize == 0 {
+			replicationLog.Warn("Conflict event queue is full", "dropped", dropped)
+		}
+	}
+}
+
+// FileConflictSink acrescenta cada evento como uma linha JSON a um arquivo, que pode ser
+// consumido por um processo de CDC
+type FileConflictSink struct {
+	*asyncSink
+	file *os.File
+}
+
+// Abre (ou cria) o arquivo de eventos em modo de acréscimo
+func NewFileConflictSink(path string) (*FileConflictSink, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s := &FileConflictSink{file: file}
+	s.asyncSink = newAsyncSink(s.write)
+	return s, nil
+}
+
+func (s *FileConflictSink) write(event ConflictEvent) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		replicationLog.Error("Failed to encode conflict event", "key", logKey(event.Key), "err", err)
+		return
+	}
+	if _, err := s.file.Write(append(data, '\n')); err != nil {
+		replicationLog.Error("Failed to write conflict event", "path", s.file.Name(), "err", err)
+	}
+}
+
+// WebhookConflictSink envia cada evento como JSON num POST para uma URL
+type WebhookConflictSink struct {
+	*asyncSink
+	url    string
+	client *http.Client
+}
+
+func NewWebhookConflictSink(url string) *WebhookConflictSink {
+	s := &WebhookConflictSink{url: url, client: &http.Client{Timeout: 5 * time.Second}}
+	s.asyncSink = newAsyncSink(s.post)
+	return s
+}
+
+func (s *WebhookConflictSink) post(event ConflictEvent) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		replicationLog.Error("Failed to encode conflict event", "key", logKey(event.Key), "err", err)
+		return
+	}
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		replicationLog.Warn("Failed to post conflict event", "url", s.url, "err", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		replicationLog.Warn("Conflict webhook answered with an error", "url", s.url, "status", resp.Status)
+	}
+}
@@ -0,0 +1,397 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// CoordinatorLoad conta as requisições coordenadas por um nó
+type CoordinatorLoad struct {
+	Puts int
+	Gets int
+}
+
+// RoutingStats descreve quem coordenou as requisições que entraram por este nó
+type RoutingStats struct {
+	Load       map[string]CoordinatorLoad // Por nó coordenador (este nó ou o nó para o qual a requisição foi encaminhada)
+	Forwarded  int                        // Requisições encaminhadas ao primeiro nó da lista de preferência
+	Fallbacks  int                        // Encaminhamentos que falharam e foram coordenados localmente
+	Received   int                        // Requisições coordenadas a pedido de outros nós
+	Primary    int                        // Coordenadas pelo primeiro nó da lista de preferência da chave
+	Replica    int                        // Coordenadas por outra réplica da chave
+	NonReplica int                        // Coordenadas por um nó fora da lista de preferência
+}
+
+// RemoteError é um erro retornado pelo nó que coordenou uma requisição encaminhada
+type RemoteError struct {
+	NodeID  string
+	Message string
+	Err     error // Erro conhecido que a resposta representa (nil = nenhum)
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("coordinator %s: %s", e.NodeID, e.Message)
+}
+
+func (e *RemoteError) Unwrap() error {
+	return e.Err
+}
+
+// Resposta de um coordenador que está sendo desligado; a requisição é coordenada localmente
+var errCoordinatorDraining = errors.New("coordinator is draining")
+
+// Envia um PUT para o KeyValueStore, encaminhando-o ao primeiro nó da lista de preferência
+// quando PreferPrimary está ativo
+func (g *Gossip) Put(key, value string, level ConsistencyLevel) (*PutResult, error) {
+	if primary := g.preferredCoordinator(key); primary != nil {
+		result, err := g.forwardPut(primary, key, value, level)
+		var remote *RemoteError
+		if err == nil || errors.As(err, &remote) {
+			g.recordCoordination(primary.ID, key, true, false)
+			return result, err
+		}
+		replicationLog.Warn("Failed to forward request, coordinating locally", "op", "put", "key", logKey(key), "peer", primary.ID, "err", err)
+		g.recordCoordination(g.Self.ID, key, true, true)
+	} else {
+		g.recordCoordination(g.Self.ID, key, true, false)
+	}
+
+	result, err := g.KeyValueStore.Put(key, value, level, NodeCaller)
+	if result != nil {
+		result.Coordinator = g.Self.ID
+	}
+	return result, err
+}
+
+// Envia um DELETE para o KeyValueStore, encaminhando-o como um PUT quando PreferPrimary está ativo
+func (g *Gossip) Delete(key string, level ConsistencyLevel) (*PutResult, error) {
+	if primary := g.preferredCoordinator(key); primary != nil {
+		result, err := g.forwardDelete(primary, key, level)
+		var remote *RemoteError
+		if err == nil || errors.As(err, &remote) {
+			g.recordCoordination(primary.ID, key, true, false)
+			return result, err
+		}
+		replicationLog.Warn("Failed to forward request, coordinating locally", "op", "delete", "key", logKey(key), "peer", primary.ID, "err", err)
+		g.recordCoordination(g.Self.ID, key, true, true)
+	} else {
+		g.recordCoordination(g.Self.ID, key, true, false)
+	}
+
+	result, err := g.KeyValueStore.Delete(key, level, NodeCaller)
+	if result != nil {
+		result.Coordinator = g.Self.ID
+	}
+	return result, err
+}
+
+// Envia um GET para o KeyValueStore, encaminhando-o ao primeiro nó da lista de preferência
+// quando PreferPrimary está ativo
+func (g *Gossip) Get(key string, level ConsistencyLevel) (*GetResult, error) {
+	if primary := g.preferredCoordinator(key); primary != nil {
+		result, err := g.forwardGet(primary, key, level)
+		var remote *RemoteError
+		if err == nil || errors.As(err, &remote) {
+			g.recordCoordination(primary.ID, key, false, false)
+			return result, err
+		}
+		replicationLog.Warn("Failed to forward request, coordinating locally", "op", "get", "key", logKey(key), "peer", primary.ID, "err", err)
+		g.recordCoordination(g.Self.ID, key, false, true)
+	} else {
+		g.recordCoordination(g.Self.ID, key, false, false)
+	}
+
+	return g.KeyValueStore.Get(key, level, NodeCaller)
+}
+
+// Retorna o nó para o qual a requisição deve ser encaminhada, ou nil para coordená-la localmente
+func (g *Gossip) preferredCoordinator(key string) *Node {
+	if !g.PreferPrimary {
+		return nil
+	}
+
+	for _, node := range g.ConsistentHash.GetPreferenceList(key, g.KeyValueStore.replicationFactor()).Replicas {
+		if node.ID == g.Self.ID {
+			return nil
+		}
+		// O primeiro nó vivo da lista de preferência coordena a chave
+		if g.IsNodeAlive(node.ID) {
+			return node
+		}
+	}
+	return nil
+}
+
+// Registra quem coordenou uma requisição e a posição dele na lista de preferência da chave
+func (g *Gossip) recordCoordination(coordinatorID, key string, put, fallback bool) {
+	position := -1
+	for i, node := range g.ConsistentHash.GetPreferenceList(key, g.KeyValueStore.replicationFactor()).Replicas {
+		if node.ID == coordinatorID {
+			position = i
+			break
+		}
+	}
+
+	g.routingMutex.Lock()
+	defer g.routingMutex.Unlock()
+
+	if g.routing.Load == nil {
+		g.routing.Load = make(map[string]CoordinatorLoad)
+	}
+	load := g.routing.Load[coordinatorID]
+	if put {
+		load.Puts++
+	} else {
+		load.Gets++
+	}
+	g.routing.Load[coordinatorID] = load
+
+	switch {
+	case position == 0:
+		g.routing.Primary++
+	case position > 0:
+		g.routing.Replica++
+	default:
+		g.routing.NonReplica++
+	}
+	if coordinatorID != g.Self.ID {
+		g.routing.Forwarded++
+	}
+	if fallback {
+		g.routing.Fallbacks++
+	}
+}
+
+// Retorna uma cópia das métricas de coordenação
+func (g *Gossip) RoutingStats() RoutingStats {
+	g.routingMutex.Lock()
+	defer g.routingMutex.Unlock()
+
+	stats := g.routing
+	stats.Load = make(map[string]CoordinatorLoad, len(g.routing.Load))
+	for id, load := range g.routing.Load {
+		stats.Load[id] = load
+	}
+	return stats
+}
+
+// Abre uma conexão com o coordenador e envia uma requisição FORWARD, retornando a resposta
+func (g *Gossip) forward(node *Node, request ...string) ([]string, error) {
+	// O coordenador remoto ainda contata as réplicas antes de responder
+	conn, err := g.dialReplica(node, g.Timeouts.Replication.withSlowRead(2))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := conn.send(append([]string{"FORWARD"}, request...)...); err != nil {
+		return nil, err
+	}
+
+	response, err := conn.receive()
+	if err != nil {
+		return nil, err
+	}
+	return parseForwardAnswer(node, response)
+}
+
+// Confere a resposta de um coordenador, convertendo DRAINING e ERROR em erros
+func parseForwardAnswer(node *Node, fields []string) ([]string, error) {
+	switch {
+	case len(fields) == 0:
+		return nil, fmt.Errorf("coordinator %s sent an empty answer", node.ID)
+	case fields[0] == "DRAINING":
+		return nil, errCoordinatorDraining
+	case fields[0] == "ERROR":
+		return nil, &RemoteError{NodeID: node.ID, Message: messageText(fields)}
+	}
+	return fields, nil
+}
+
+// Encaminha um PUT ao coordenador ("FORWARD PUT <key> <value> [<nível>] #<checksum>" ->
+// "OK <N> <réplicas> <hints>")
+func (g *Gossip) forwardPut(node *Node, key, value string, level ConsistencyLevel) (*PutResult, error) {
+	return g.forwardWrite(node, key, append(withLevel(level, "PUT", key, value), checksumField(value)))
+}
+
+// Encaminha um DELETE ao coordenador ("FORWARD DELETE <key> [<nível>]" -> "OK <N> <réplicas> <hints>")
+func (g *Gossip) forwardDelete(node *Node, key string, level ConsistencyLevel) (*PutResult, error) {
+	return g.forwardWrite(node, key, withLevel(level, "DELETE", key))
+}
+
+// Acrescenta o nível de consistência a uma requisição encaminhada; o nível padrão é omitido,
+// como nas requisições de coordenadores anteriores
+func withLevel(level ConsistencyLevel, request ...string) []string {
+	if level == ConsistencyDefault {
+		return request
+	}
+	return append(request, string(level))
+}
+
+func (g *Gossip) forwardWrite(node *Node, key string, request []string) (*PutResult, error) {
+	fields, err := g.forward(node, request...)
+	if err != nil {
+		return nil, err
+	}
+	return parseWriteAnswer(node, key, fields)
+}
+
+// Decodifica a resposta "OK <N> <réplicas> <hints>" (ou "SIBLINGS <versões> <limite>") de uma
+// escrita encaminhada
+func parseWriteAnswer(node *Node, key string, fields []string) (*PutResult, error) {
+	result := &PutResult{Key: key, Coordinator: node.ID}
+	if len(fields) == 3 && fields[0] == "SIBLINGS" {
+		err := parseSiblingLimit(key, fields)
+		return nil, &RemoteError{NodeID: node.ID, Message: err.Error(), Err: err}
+	}
+	if len(fields) != 4 || fields[0] != "OK" {
+		return nil, fmt.Errorf("coordinator %s answered %q", node.ID, formatMessage(fields))
+	}
+	if _, err := fmt.Sscan(strings.Join(fields[1:], " "), &result.Requested, &result.Replicas, &result.Hinted); err != nil {
+		return nil, fmt.Errorf("coordinator %s answered %q: %w", node.ID, formatMessage(fields), err)
+	}
+	return result, nil
+}
+
+// Encaminha um GET ao coordenador ("FORWARD GET <key> [<nível>]" ->
+// "VALUE <value> <vc> <réplica> <gravada em> <respostas> <R> <N> <reparadas> #<checksum> [STALE]" ou
+// "NOTFOUND <respostas> <R> <N> [STALE]"). Coordenadores anteriores respondem sem os metadados.
+func (g *Gossip) forwardGet(node *Node, key string, level ConsistencyLevel) (*GetResult, error) {
+	fields, err := g.forward(node, withLevel(level, "GET", key)...)
+	if err != nil {
+		return nil, err
+	}
+	return g.parseGetAnswer(node, key, fields)
+}
+
+// Decodifica a resposta VALUE ou NOTFOUND de uma leitura encaminhada
+func (g *Gossip) parseGetAnswer(node *Node, key string, fields []string) (*GetResult, error) {
+	result := &GetResult{Key: key, Coordinator: node.ID}
+	malformed := fmt.Errorf("coordinator %s answered %q", node.ID, formatMessage(fields))
+	// Uma leitura servida de dados guardados para réplicas fora termina com STALE
+	if len(fields) > 1 && fields[len(fields)-1] == "STALE" {
+		result.Stale, fields = true, fields[:len(fields)-1]
+	}
+	switch {
+	case fields[0] == "NOTFOUND" && (len(fields) == 1 || len(fields) == 4):
+		if len(fields) == 4 {
+			if _, err := fmt.Sscan(strings.Join(fields[1:], " "), &result.Responses, &result.Required, &result.Requested); err != nil {
+				return nil, malformed
+			}
+		}
+		return result, nil
+	case fields[0] == "VALUE" && (len(fields) == 3 || len(fields) == 9 || len(fields) == 10):
+		fields, checksum := takeChecksum(fields, 9)
+		if len(fields) == 10 {
+			return nil, malformed
+		}
+		if err := VerifyChecksum(fields[1], checksum); err != nil {
+			return nil, fmt.Errorf("coordinator %s sent key %s: %w", node.ID, key, err)
+		}
+		clock, err := g.nodeIndex.decodeClock(fields[2])
+		if err != nil {
+			return nil, err
+		}
+		result.Value, result.VectorClock, result.Found = fields[1], clock, true
+		result.Checksum = ValueChecksum(result.Value)
+		if len(fields) == 9 {
+			result.ServedBy = fields[3]
+			if result.WrittenAt, err = decodeTime(fields[4]); err != nil {
+				return nil, malformed
+			}
+			if _, err := fmt.Sscan(strings.Join(fields[5:], " "), &result.Responses, &result.Required, &result.Requested, &result.Repaired); err != nil {
+				return nil, malformed
+			}
+		}
+		return result, nil
+	}
+	return nil, malformed
+}
+
+// Coordena uma requisição encaminhada por outro nó. A requisição nunca é reencaminhada.
+func (g *Gossip) handleForward(conn *peerConn, args []string) {
+	g.routingMutex.Lock()
+	g.routing.Received++
+	g.routingMutex.Unlock()
+
+	// O checksum do valor vem por último nas escritas com valor e é conferido antes de tudo
+	arity := map[string]int{"PUT": 3, "DELETE": 2, "GET": 2, "CAS": 5}
+	if len(args) > 0 && (args[0] == "PUT" || args[0] == "CAS") && len(args) > arity[args[0]] {
+		var checksum string
+		args, checksum = takeChecksum(args, len(args)-1)
+		if err := VerifyChecksum(args[2], checksum); err != nil {
+			rejectEntry(conn, "FORWARD", err)
+			return
+		}
+	}
+
+	// O nível de consistência, quando presente, é o último argumento
+	level := ConsistencyDefault
+	if len(args) > 0 && len(args) == arity[args[0]]+1 {
+		var err error
+		if level, err = ParseConsistencyLevel(args[len(args)-1]); err != nil {
+			conn.send("ERROR", err.Error())
+			return
+		}
+		args = args[:len(args)-1]
+	}
+
+	switch {
+	case len(args) == 3 && args[0] == "PUT" || len(args) == 2 && args[0] == "DELETE":
+		var result *PutResult
+		var err error
+		if args[0] == "PUT" {
+			result, err = g.KeyValueStore.Put(args[1], args[2], level, NodeCaller)
+		} else {
+			result, err = g.KeyValueStore.Delete(args[1], level, NodeCaller)
+		}
+		conn.send(writeAnswer(result, err)...)
+	case len(args) == 5 && args[0] == "CAS":
+		cond, err := g.decodeCASCondition(args[3], args[4])
+		if err != nil {
+			conn.send("ERROR", err.Error())
+			return
+		}
+		conn.send(g.casAnswer(g.KeyValueStore.CompareAndSwap(args[1], args[2], cond, level))...)
+	case len(args) == 2 && args[0] == "GET":
+		result, err := g.KeyValueStore.Get(args[1], level, NodeCaller)
+		conn.send(g.getAnswer(result, err)...)
+	default:
+		conn.send("ERROR", "malformed FORWARD")
+	}
+}
+
+// Formata a resposta a uma escrita encaminhada
+func writeAnswer(result *PutResult, err error) []string {
+	var limit *SiblingLimitError
+	switch {
+	case errors.Is(err, ErrDraining):
+		return []string{"DRAINING"}
+	case errors.As(err, &limit):
+		return limit.answer()
+	case err != nil:
+		return []string{"ERROR", err.Error()}
+	}
+	return []string{"OK", strconv.Itoa(result.Requested), strconv.Itoa(result.Replicas), strconv.Itoa(result.Hinted)}
+}
+
+// Formata a resposta a uma leitura encaminhada
+func (g *Gossip) getAnswer(result *GetResult, err error) []string {
+	var answer []string
+	switch {
+	case err != nil:
+		return []string{"ERROR", err.Error()}
+	case !result.Found:
+		answer = []string{"NOTFOUND", strconv.Itoa(result.Responses), strconv.Itoa(result.Required), strconv.Itoa(result.Requested)}
+	default:
+		answer = []string{"VALUE", result.Value, g.nodeIndex.encodeClock(result.VectorClock), result.ServedBy,
+			strconv.FormatInt(encodeTime(result.WrittenAt), 10), strconv.Itoa(result.Responses), strconv.Itoa(result.Required),
+			strconv.Itoa(result.Requested), strconv.Itoa(result.Repaired), checksumField(result.Value)}
+	}
+	if result.Stale {
+		answer = append(answer, "STALE")
+	}
+	return answer
+}
@@ -0,0 +1,141 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// Um nó desativado (decommission) sai do anel de forma definitiva. Ele drena as requisições e
+// para os loops como no desligamento, propõe a remoção dele da configuração do cluster (que cada
+// nó aplica tirando-o do anel, como a saída de um membro) e, antes de sair, envia as chaves de
+// cada trecho de que é réplica ao nó que passa a ser réplica do trecho no lugar dele. As escritas
+// feitas durante a transferência já vão para os novos donos; as versões enviadas se juntam a
+// elas pelos Vector Clocks.
+
+// Entrada (pelos seeds) e remoção de um nó do cluster, aplicadas pelo mesmo protocolo em duas
+// fases das configurações, para que a configuração e o anel de todos os membros tenham os
+// mesmos nós
+var membershipSettings = map[string]func(c *ClusterConfig, value string) error{
+	"node-add": func(c *ClusterConfig, value string) error {
+		var node NodeConfig
+		if err := json.Unmarshal([]byte(value), &node); err != nil || node.ID == "" || node.Address == "" {
+			return fmt.Errorf("node-add needs the node config in JSON, got %q", value)
+		}
+		for _, nc := range c.Nodes {
+			if nc.ID == node.ID {
+				return fmt.Errorf("node %s is already in the cluster config", node.ID)
+			}
+			if nc.Address == node.Address {
+				return fmt.Errorf("address %s is already used by node %s", node.Address, nc.ID)
+			}
+		}
+		c.Nodes = append(c.Nodes, node)
+		return nil
+	},
+	"node-remove": func(c *ClusterConfig, id string) error {
+		i := slices.IndexFunc(c.Nodes, func(nc NodeConfig) bool { return nc.ID == id })
+		if i < 0 {
+			// Nós que entraram pelo handshake do PING não estão na configuração, só no anel
+			return nil
+		}
+		if len(c.Nodes)-1 < c.N {
+			return fmt.Errorf("removing node %s would leave %d nodes for n=%d", id, len(c.Nodes)-1, c.N)
+		}
+		c.Nodes = slices.Delete(c.Nodes, i, i+1)
+		return nil
+	},
+}
+
+// Desativa o nó: transfere os trechos dele aos sucessores, o remove do anel de todos os nós e o
+// desliga. Se a remoção não for aceita, o nó é desligado sem sair do anel.
+func (g *Gossip) Decommission(timeout time.Duration) error {
+	if err := g.CheckDecommission(); err != nil {
+		return err
+	}
+
+	g.quiesce(timeout)
+	tasks := g.KeyValueStore.planDecommission(g.KeyValueStore.replicationFactor())
+	if _, err := g.ProposeSetting("node-remove", g.Self.ID); err != nil {
+		clusterLog.Error("Node removal was not accepted, shutting down without leaving the ring", "err", err)
+		return errors.Join(fmt.Errorf("decommission failed: %w", err), g.leave(timeout))
+	}
+	clusterLog.Info("Node removed from the ring, transferring its ranges", "transfers", len(tasks))
+
+	err := g.KeyValueStore.runDecommission(tasks)
+	return errors.Join(err, g.leave(timeout))
+}
+
+// Verifica se o nó pode ser desativado: a remoção depende da configuração do cluster, e os nós
+// restantes precisam ser suficientes para as N réplicas
+func (g *Gossip) CheckDecommission() error {
+	if g.clusterConfig() == nil {
+		return errors.New("decommission needs the cluster config (run kvctl cluster init)")
+	}
+	n := g.KeyValueStore.replicationFactor()
+	g.Mutex.Lock()
+	remaining := len(g.Nodes)
+	g.Mutex.Unlock()
+	if remaining < n {
+		return fmt.Errorf("cannot decommission: %d nodes would remain for n=%d", remaining, n)
+	}
+	return nil
+}
+
+// Cria as tarefas que levam cada trecho com chaves locais de que este nó é réplica ao nó que
+// passa a ser réplica do trecho quando ele sai do anel: o próximo nó físico da ordem do anel
+func (kv *KeyValueStore) planDecommission(n int) []*RebalanceTask {
+	g := kv.Gossip
+	g.Mutex.Lock()
+	var tasks []*RebalanceTask
+	for _, r := range kv.ConsistentHash.Ranges() {
+		replicas := kv.ConsistentHash.ReplicaNodesForHash(r.End, n+1)
+		if len(replicas) <= n || !slices.Contains(replicas[:n], g.Self) {
+			continue
+		}
+		tasks = append(tasks, &RebalanceTask{TargetID: replicas[n].ID, Range: r})
+	}
+	g.Mutex.Unlock()
+
+	return slices.DeleteFunc(tasks, func(task *RebalanceTask) bool {
+		return len(kv.keysInRange(task.Range, "")) == 0
+	})
+}
+
+// Envia as chaves dos trechos aos novos donos. Uma tarefa que falha não interrompe as demais;
+// as chaves dela continuam nas outras réplicas do trecho (com n > 1).
+func (kv *KeyValueStore) runDecommission(tasks []*RebalanceTask) error {
+	var failed []error
+	for _, task := range tasks {
+		target, known := kv.Gossip.GetNode(task.TargetID)
+		if !known {
+			failed = append(failed, fmt.Errorf("range %s: node %s is no longer a member", task.Range, task.TargetID))
+			continue
+		}
+		if err := kv.transferRange(target, task, "decommission"); err != nil {
+			failed = append(failed, fmt.Errorf("range %s to node %s: %w", task.Range, task.TargetID, err))
+			continue
+		}
+		replicationLog.Info("Transferred range", "op", "decommission", "range", task.Range.String(), "peer", task.TargetID, "keys", task.Transferred)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d range transfers failed: %w", len(failed), len(tasks), errors.Join(failed...))
+	}
+	return nil
+}
+
+// Envia ao nó as chaves locais do trecho da tarefa, contando as enviadas
+func (kv *KeyValueStore) transferRange(target *Node, task *RebalanceTask, op string) error {
+	for _, key := range kv.keysInRange(task.Range, "") {
+		sent, err := kv.transferKey(target, key, nil, op)
+		if err != nil {
+			return err
+		}
+		if sent {
+			task.Transferred++
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package store
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// DefragResult resume o espaço recuperado por uma desfragmentação
+type DefragResult struct {
+	Keys       int
+	TablesFrom int // SSTables antes da desfragmentação
+	TablesTo   int // SSTables depois (0 ou 1)
+	BytesFrom  int64
+	BytesTo    int64
+	Duration   time.Duration
+}
+
+func (r *DefragResult) String() string {
+	return fmt.Sprintf("%d keys, %d -> %d sstables, %d bytes reclaimed in %s",
+		r.Keys, r.TablesFrom, r.TablesTo, r.BytesFrom-r.BytesTo, r.Duration.Round(time.Millisecond))
+}
+
+// Compacta todas as SSTables numa só, contendo somente a versão atual de cada chave e
+// descartando os tombstones e os range tombstones que passaram do TombstoneGrace. Roda com o nó online;
+// keysPerSecond > 0 limita a taxa de leitura para não competir com as requisições dos clientes.
+func (kv *KeyValueStore) Defrag(job *Job, keysPerSecond int) (*DefragResult, error) {
+	start := time.Now()
+	if err := kv.Flush(); err != nil {
+		return nil, err
+	}
+
+	// Impede que o compactador em segundo plano junte SSTables durante a desfragmentação
+	kv.LSM.compaction.Lock()
+	defer kv.LSM.compaction.Unlock()
+
+	kv.LSM.mutex.RLock()
+	run := append([]*ssTable(nil), kv.LSM.tables...)
+	kv.LSM.mutex.RUnlock()
+	result := &DefragResult{TablesFrom: len(run)}
+	records := 0
+	for _, t := range run {
+		records += len(t.keys)
+		result.BytesFrom += t.size
+	}
+	if len(run) == 0 {
+		result.Duration = time.Since(start)
+		return result, nil
+	}
+
+	var throttle <-chan time.Time
+	if keysPerSecond > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(keysPerSecond))
+		defer ticker.Stop()
+		throttle = ticker.C
+	}
+
+	read := 0
+	dropped, err := kv.LSM.compact(run, kv.tombstoneExpired, func() error {
+		if read%compactionProgressGap == 0 {
+			if err := job.Progress(read, records); err != nil {
+				return err
+			}
+		}
+		read++
+		if throttle != nil {
+			<-throttle
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	kv.forgetRangeTombstones(dropped)
+
+	// A SSTable compactada fica no lugar da mais antiga da sequência
+	kv.LSM.mutex.RLock()
+	if len(kv.LSM.tables) > 0 && kv.LSM.tables[0].id > run[len(run)-1].id {
+		output := kv.LSM.tables[0]
+		result.Keys, result.TablesTo, result.BytesTo = len(output.keys), 1, output.size
+	}
+	kv.LSM.mutex.RUnlock()
+	result.Duration = time.Since(start)
+	storageLog.Info("Defragmented sstables", "result", result.String())
+	return result, job.Progress(read, read)
+}
+
+// Runner do job de desfragmentação: defrag [chaves por segundo]
+func (kv *KeyValueStore) defragJob(job *Job, args []string) error {
+	rate := 0
+	if len(args) > 0 {
+		var err error
+		if rate, err = strconv.Atoi(args[0]); err != nil {
+			return fmt.Errorf("invalid rate %q", args[0])
+		}
+	}
+	_, err := kv.Defrag(job, rate)
+	return err
+}
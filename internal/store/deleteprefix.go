@@ -0,0 +1,149 @@
+package store
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Remoção de um prefixo no cluster: o coordenador fixa o momento da remoção e envia o range
+// tombstone do prefixo a cada nó que pode ter chaves dele (as réplicas do grupo, se o prefixo
+// fixa os segmentos da regra de roteamento, ou todos os nós). Cada nó grava o tombstone e deixa
+// de ter as versões gravadas até esse momento; escritas posteriores não são afetadas. Um nó que
+// estava fora fica com as cópias antigas, que voltariam por read repair: ele aparece em Failed e
+// a remoção deve ser repetida quando ele voltar.
+
+// Tamanho das páginas do scan que conta as chaves de um dry-run
+const prefixCountPage = 1000
+
+// PrefixDeletion é o resultado de um DeletePrefix
+type PrefixDeletion struct {
+	Prefix string
+	At     time.Time     // Versões gravadas até este momento foram removidas
+	DryRun bool          // Nada foi removido; Keys tem as chaves que seriam
+	Keys   int           // Chaves com valor cobertas pela remoção (só no dry-run)
+	Nodes  []string      // Nós que gravaram o tombstone (no dry-run, os que o receberiam)
+	Failed []NodeFailure // Nós que não gravaram o tombstone (no dry-run, que não responderam ao scan)
+}
+
+// Remove do cluster as chaves com o prefixo. Com dryRun nada é removido, e Keys recebe quantas
+// chaves com valor o prefixo tem hoje, contadas por um scan.
+func (kv *KeyValueStore) DeletePrefix(prefix string, dryRun bool) (*PrefixDeletion, error) {
+	if err := checkDeletablePrefix(prefix); err != nil {
+		return nil, err
+	}
+	nodes := kv.prefixNodes(prefix)
+	ids := make([]string, len(nodes))
+	for i, node := range nodes {
+		ids[i] = node.ID
+	}
+	result := &PrefixDeletion{Prefix: prefix, At: time.Now(), DryRun: dryRun}
+
+	if dryRun {
+		result.Nodes = ids
+		var cursor *ScanCursor
+		failed := make(map[string]NodeFailure)
+		for {
+			page, err := kv.Scan(prefix, prefixCountPage, nil, cursor)
+			if err != nil {
+				return nil, err
+			}
+			result.Keys += len(page.Results)
+			for _, failure := range page.Failed {
+				failed[failure.NodeID] = failure
+			}
+			if cursor = page.Next; cursor == nil {
+				break
+			}
+		}
+		for _, id := range ids {
+			if failure, ok := failed[id]; ok {
+				result.Failed = append(result.Failed, failure)
+			}
+		}
+		return result, nil
+	}
+
+	_, failed := scatterGather(ids, kv.Workers.ScatterWorkers, kv.ScatterTimeout, func(i int) (struct{}, error) {
+		node := nodes[i]
+		switch {
+		case node.ID == kv.Gossip.Self.ID:
+			_, err := kv.deletePrefix(prefix, result.At)
+			return struct{}{}, err
+		case kv.Gossip.IsNodeAlive(node.ID):
+			return struct{}{}, kv.Gossip.SendDeletePrefix(node, prefix, result.At)
+		}
+		return struct{}{}, errNodeDown
+	})
+	result.Failed = failed
+	down := make(map[string]bool, len(failed))
+	for _, failure := range failed {
+		down[failure.NodeID] = true
+	}
+	for _, id := range ids {
+		if !down[id] {
+			result.Nodes = append(result.Nodes, id)
+		}
+	}
+	if len(failed) > 0 {
+		replicationLog.Warn("Prefix deleted on some nodes", "op", "delprefix", "prefix", prefix, "deleted", len(result.Nodes), "nodes", len(ids), "failed", FormatNodeFailures(failed))
+	} else {
+		replicationLog.Info("Prefix deleted", "op", "delprefix", "prefix", prefix, "nodes", len(ids))
+	}
+	return result, nil
+}
+
+// Recusa o prefixo vazio, que removeria todas as chaves, e os que cobrem o bucket de sistema
+func checkDeletablePrefix(prefix string) error {
+	if prefix == "" {
+		return fmt.Errorf("prefix must not be empty")
+	}
+	system := SystemBucket + "/"
+	if strings.HasPrefix(system, prefix) || strings.HasPrefix(prefix, system) {
+		return fmt.Errorf("prefix %s covers the %s bucket", prefix, SystemBucket)
+	}
+	return nil
+}
+
+// Envia o range tombstone de um prefixo a um nó ("DELPREFIX <prefixo> <momento>")
+func (g *Gossip) SendDeletePrefix(node *Node, prefix string, at time.Time) error {
+	conn, err := g.dialReplica(node, g.Timeouts.Replication)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := conn.send("DELPREFIX", quoteField(prefix), strconv.FormatInt(encodeTime(at), 10)); err != nil {
+		return err
+	}
+	fields, err := conn.receive()
+	if err != nil {
+		return err
+	}
+	if len(fields) == 0 || fields[0] != "OK" {
+		return fmt.Errorf("node %s answered %q", node.ID, formatMessage(fields))
+	}
+	return nil
+}
+
+// Grava o range tombstone de um prefixo recebido do coordenador e responde "OK"
+func (g *Gossip) handleDeletePrefix(conn *peerConn, args []string) {
+	if len(args) != 2 {
+		conn.send("ERROR", "malformed DELPREFIX")
+		return
+	}
+	prefix := unquoteField(args[0])
+	at, err := decodeTime(args[1])
+	if err == nil {
+		err = checkDeletablePrefix(prefix)
+	}
+	if err == nil {
+		_, err = g.KeyValueStore.deletePrefix(prefix, at)
+	}
+	if err != nil {
+		conn.send("ERROR", err.Error())
+		return
+	}
+	conn.send("OK")
+}
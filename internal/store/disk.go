@@ -0,0 +1,15 @@
+package store
+
+// DiskUsage descreve a ocupação do sistema de arquivos do diretório de dados
+type DiskUsage struct {
+	Total uint64 // Bytes do sistema de arquivos
+	Free  uint64 // Bytes disponíveis para o processo
+}
+
+// Retorna a fração ocupada do disco, entre 0 e 1
+func (d *DiskUsage) UsedFraction() float64 {
+	if d.Total == 0 {
+		return 0
+	}
+	return float64(d.Total-d.Free) / float64(d.Total)
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd && !windows
+
+package store
+
+import "errors"
+
+// A ocupação do disco não é suportada nesta plataforma
+func diskUsage(path string) (*DiskUsage, error) {
+	return nil, errors.New("disk usage is not supported on this platform")
+}
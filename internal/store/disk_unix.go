@@ -0,0 +1,17 @@
+//go:build linux || darwin || freebsd
+
+package store
+
+import "syscall"
+
+// Lê a ocupação do sistema de arquivos que contém path
+func diskUsage(path string) (*DiskUsage, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return nil, err
+	}
+	return &DiskUsage{
+		Total: uint64(stat.Blocks) * uint64(stat.Bsize),
+		Free:  uint64(stat.Bavail) * uint64(stat.Bsize),
+	}, nil
+}
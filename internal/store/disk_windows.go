@@ -0,0 +1,30 @@
+//go:build windows
+
+package store
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+var getDiskFreeSpaceEx = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+// Lê a ocupação do volume que contém path
+func diskUsage(path string) (*DiskUsage, error) {
+	name, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var free, total uint64
+	ok, _, err := getDiskFreeSpaceEx.Call(
+		uintptr(unsafe.Pointer(name)),
+		uintptr(unsafe.Pointer(&free)),
+		uintptr(unsafe.Pointer(&total)),
+		0,
+	)
+	if ok == 0 {
+		return nil, err
+	}
+	return &DiskUsage{Total: total, Free: free}, nil
+}
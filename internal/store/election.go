@@ -0,0 +1,198 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrElectionInProgress é retornado pelas operações que dependem do coordenador enquanto
+// ele não é conhecido; a operação pode ser repetida depois que a eleição terminar
+var ErrElectionInProgress = errors.New("no coordinator known, election in progress (retry later)")
+
+// Tempo de espera pelo anúncio do vencedor depois que um nó de ID maior assumiu a eleição
+const electionTimeout = 2 * replicaTimeout
+
+// Intervalo entre verificações de um job aguardando o fim de uma eleição
+const coordinatorPollInterval = 250 * time.Millisecond
+
+// Retorna o ID do coordenador e se ele é conhecido (false durante uma eleição)
+func (g *Gossip) CoordinatorID() (string, bool) {
+	g.Mutex.Lock()
+	defer g.Mutex.Unlock()
+
+	if g.electing || g.Coordinator == nil {
+		return "", false
+	}
+	return g.Coordinator.ID, true
+}
+
+// Verifica se uma operação que depende do coordenador pode prosseguir
+func (g *Gossip) fence(op string) error {
+	if _, known := g.CoordinatorID(); !known {
+		return fmt.Errorf("%s: %w", op, ErrElectionInProgress)
+	}
+	return nil
+}
+
+// Bloqueia um job até que o coordenador seja conhecido, em vez de prosseguir com a liderança
+// indefinida. Retorna ErrJobCancelled se o job for cancelado durante a espera; sem job,
+// rejeita a operação imediatamente.
+func (g *Gossip) awaitCoordinator(job *Job, op string) error {
+	err := g.fence(op)
+	if err == nil || job == nil {
+		return err
+	}
+
+	clusterLog.Info("Job waiting for the coordinator election", "job", job.ID, "op", op)
+	for g.fence(op) != nil {
+		if job.Cancelled() {
+			return ErrJobCancelled
+		}
+		time.Sleep(coordinatorPollInterval)
+	}
+	return nil
+}
+
+// Inicia uma eleição (algoritmo do valentão): os nós de ID maior são consultados e, se nenhum
+// responder, este nó se torna o coordenador
+func (g *Gossip) initiateElection() {
+	g.Mutex.Lock()
+	if g.electing || g.closing {
+		g.Mutex.Unlock()
+		return
+	}
+	g.electing = true
+	g.electionRound++
+	round := g.electionRound
+	higherNodes := g.getHigherNodes()
+	g.Mutex.Unlock()
+
+	gossipLog.Info("Starting election")
+
+	answered := false
+	for _, node := range higherNodes {
+		if g.sendElectionMessage(node) {
+			answered = true
+		}
+	}
+	if !answered {
+		g.becomeCoordinator()
+		return
+	}
+
+	// Um nó de ID maior assumiu a eleição; sem o anúncio dele no prazo, recomeça
+	time.AfterFunc(electionTimeout, func() {
+		g.Mutex.Lock()
+		stalled := g.electing && g.electionRound == round
+		if stalled {
+			g.electing = false
+		}
+		g.Mutex.Unlock()
+
+		if stalled {
+			gossipLog.Warn("No coordinator announced, restarting election")
+			g.initiateElection()
+		}
+	})
+}
+
+// Retorna uma lista de nós com IDs maiores que o do nó atual
+func (g *Gossip) getHigherNodes() []*Node {
+	var higherNodes []*Node
+	for _, node := range g.Nodes {
+		if node.ID > g.Self.ID && node.Alive {
+			higherNodes = append(higherNodes, node)
+		}
+	}
+	return higherNodes
+}
+
+// Envia uma mensagem de eleição para um nó com ID maior e indica se ele respondeu
+func (g *Gossip) sendElectionMessage(node *Node) bool {
+	conn, err := g.dialPeer(node.Address, g.Timeouts.Gossip)
+	if err != nil {
+		gossipLog.Warn("Error connecting to node during election", "peer", node.ID, "err", err)
+		g.markNodeDead(node)
+		return false
+	}
+	defer conn.Close()
+
+	gossipLog.Debug("Sending ELECTION", "peer", node.ID)
+	if err := conn.send("ELECTION", "from", g.Self.ID); err != nil {
+		return false
+	}
+
+	// Espera resposta de "OK"
+	response, err := conn.receive()
+	if err != nil || len(response) != 1 || response[0] != "OK" {
+		return false
+	}
+	gossipLog.Debug("Node responded to election", "peer", node.ID)
+	return true
+}
+
+// Responde a uma mensagem de eleição de um nó de ID menor e assume a eleição
+func (g *Gossip) handleElection(conn *peerConn, nodeID string) {
+	conn.send("OK")
+	gossipLog.Debug("Received ELECTION", "peer", nodeID)
+	go g.initiateElection()
+}
+
+// Registra o coordenador anunciado por outro nó. Um anúncio de um nó de ID menor dispara
+// uma nova eleição, que este nó vence.
+func (g *Gossip) handleCoordinator(nodeID string) {
+	g.Mutex.Lock()
+	node, exists := g.Nodes[nodeID]
+	if !exists {
+		g.Mutex.Unlock()
+		gossipLog.Warn("Ignoring COORDINATOR from unknown node", "peer", nodeID)
+		return
+	}
+	g.Coordinator = node
+	g.electing = false
+	g.Mutex.Unlock()
+
+	gossipLog.Info("New coordinator", "peer", nodeID)
+	if nodeID < g.Self.ID {
+		go g.initiateElection()
+	}
+}
+
+// Define o nó atual como coordenador
+func (g *Gossip) becomeCoordinator() {
+	gossipLog.Info("Becoming the coordinator")
+	g.Mutex.Lock()
+	g.Coordinator = g.Self
+	g.electing = false
+	g.Mutex.Unlock()
+
+	// Anuncia para todos os nós que este nó é o novo coordenador
+	g.announceCoordinator()
+}
+
+// Anuncia que o nó atual é o coordenador para todos os outros nós
+func (g *Gossip) announceCoordinator() {
+	g.Mutex.Lock()
+	defer g.Mutex.Unlock()
+
+	for _, node := range g.Nodes {
+		if node.Alive {
+			go g.sendCoordinatorMessage(node)
+		}
+	}
+}
+
+// Envia uma mensagem de anúncio de coordenador para um nó
+func (g *Gossip) sendCoordinatorMessage(node *Node) {
+	conn, err := g.dialPeer(node.Address, g.Timeouts.Gossip)
+	if err != nil {
+		gossipLog.Warn("Error connecting to node to announce coordinator", "peer", node.ID, "err", err)
+		g.markNodeDead(node)
+		return
+	}
+	defer conn.Close()
+
+	gossipLog.Debug("Announcing self as COORDINATOR", "peer", node.ID)
+	conn.send("COORDINATOR", g.Self.ID)
+}
@@ -0,0 +1,244 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Chaves lidas por página de um export (no máximo; com taxa limitada, a página cabe num segundo)
+const exportPageSize = 100
+
+// Sufixo do arquivo de progresso gravado ao lado do arquivo exportado
+const exportProgressSuffix = ".progress"
+
+// Intervalo entre as verificações de cancelamento enquanto o export aguarda a janela
+const exportWindowPoll = 10 * time.Second
+
+// ExportPolicy limita os exports, para que leituras em massa não degradem a latência das
+// requisições. Faz parte da configuração do cluster e muda com settings set export-rate|export-window.
+type ExportPolicy struct {
+	Rate   int    `json:"rate,omitempty"`   // Chaves lidas por segundo (0 = sem limite)
+	Window string `json:"window,omitempty"` // Janela "HH:MM-HH:MM" (horário local) em que os exports rodam (vazio = qualquer hora)
+}
+
+// TimeWindow é um intervalo diário; uma janela com fim antes do início atravessa a meia-noite
+type TimeWindow struct {
+	Start time.Duration // Desde a meia-noite
+	End   time.Duration
+}
+
+// Converte "HH:MM-HH:MM" numa janela; uma string vazia retorna nil (qualquer hora)
+func ParseTimeWindow(s string) (*TimeWindow, error) {
+	if s == "" {
+		return nil, nil
+	}
+	start, end, found := strings.Cut(s, "-")
+	if !found {
+		return nil, fmt.Errorf("invalid time window %q (use HH:MM-HH:MM)", s)
+	}
+	var window TimeWindow
+	for _, part := range []struct {
+		text string
+		dst  *time.Duration
+	}{{start, &window.Start}, {end, &window.End}} {
+		t, err := time.Parse("15:04", part.text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid time window %q (use HH:MM-HH:MM)", s)
+		}
+		*part.dst = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+	if window.Start == window.End {
+		return nil, fmt.Errorf("time window %q is empty", s)
+	}
+	return &window, nil
+}
+
+// Retorna quanto falta para a janela abrir (0 se t está dentro dela); uma janela nil está sempre aberta
+func (w *TimeWindow) Until(t time.Time) time.Duration {
+	if w == nil {
+		return 0
+	}
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	now := t.Sub(midnight)
+	open := now >= w.Start && now < w.End
+	if w.End < w.Start {
+		open = now >= w.Start || now < w.End
+	}
+	switch {
+	case open:
+		return 0
+	case now < w.Start:
+		return w.Start - now
+	}
+	return 24*time.Hour - now + w.Start
+}
+
+func (w *TimeWindow) String() string {
+	if w == nil {
+		return "any time"
+	}
+	format := func(d time.Duration) string {
+		return fmt.Sprintf("%02d:%02d", int(d.Hours()), int(d.Minutes())%60)
+	}
+	return format(w.Start) + "-" + format(w.End)
+}
+
+// exportEntry é uma linha do arquivo exportado (JSON por linha)
+type exportEntry struct {
+	Key         string         `json:"key"`
+	Value       string         `json:"value"`
+	VectorClock map[string]int `json:"vector_clock"`
+}
+
+// Progresso persistido de um export: o cursor do scan e o tamanho do arquivo já confirmado
+type exportProgress struct {
+	Token    string `json:"token"`
+	Offset   int64  `json:"offset"`
+	Exported int    `json:"exported"`
+}
+
+// Retorna a política de export em vigor (sem limites se o cluster não foi inicializado)
+func (g *Gossip) ExportPolicy() ExportPolicy {
+	if config := g.clusterConfig(); config != nil && config.Export != nil {
+		return *config.Export
+	}
+	return ExportPolicy{}
+}
+
+// Exporta as chaves do prefixo para path, uma por linha, lendo-as do cluster por um scan
+// paginado. A política de export é relida a cada página, então uma mudança de taxa ou de janela
+// vale para o export em andamento. O progresso é gravado a cada página, e um export
+// interrompido continua de onde parou.
+func (kv *KeyValueStore) Export(job *Job, prefix, path string) (int, error) {
+	progressPath := path + exportProgressSuffix
+	var progress exportProgress
+	data, err := os.ReadFile(progressPath)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, &progress); err != nil {
+			return 0, fmt.Errorf("invalid export progress file: %w", err)
+		}
+		clusterLog.Info("Resuming export", "op", "export", "prefix", prefix, "path", path, "exported", progress.Exported)
+	case !errors.Is(err, os.ErrNotExist):
+		return 0, err
+	}
+	cursor, err := ParseScanToken(progress.Token, prefix, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	// Descarta o que foi escrito depois da última página confirmada
+	if err := file.Truncate(progress.Offset); err != nil {
+		return 0, err
+	}
+	if _, err := file.Seek(progress.Offset, 0); err != nil {
+		return 0, err
+	}
+
+	for {
+		if err := job.Progress(progress.Exported, 0); err != nil {
+			return progress.Exported, err
+		}
+		if err := kv.awaitExportWindow(job); err != nil {
+			return progress.Exported, err
+		}
+
+		policy := kv.Gossip.ExportPolicy()
+		limit := exportPageSize
+		if policy.Rate > 0 {
+			limit = min(limit, policy.Rate)
+		}
+		start := time.Now()
+		page, err := kv.Scan(prefix, limit, nil, cursor)
+		if err != nil {
+			return progress.Exported, err
+		}
+		// Com menos de N nós fora, as outras réplicas ainda cobrem as chaves dos que faltaram
+		if len(page.Failed) > 0 {
+			clusterLog.Warn("Export read a page without some nodes", "op", "export", "prefix", prefix, "failed", FormatNodeFailures(page.Failed))
+		}
+
+		var b strings.Builder
+		encoder := json.NewEncoder(&b)
+		for _, result := range page.Results {
+			encoder.Encode(exportEntry{Key: result.Key, Value: result.Value, VectorClock: result.VectorClock.Clock})
+		}
+		written, err := file.WriteString(b.String())
+		if err != nil {
+			return progress.Exported, err
+		}
+		if err := file.Sync(); err != nil {
+			return progress.Exported, err
+		}
+
+		progress.Offset += int64(written)
+		progress.Exported += len(page.Results)
+		if page.Next == nil {
+			break
+		}
+		cursor, progress.Token = page.Next, page.Next.Token()
+		data, _ := json.Marshal(progress)
+		if err := writeFileAtomic(progressPath, data, 0644); err != nil {
+			return progress.Exported, err
+		}
+
+		// Mantém a média abaixo da taxa: a página seguinte só começa quando esta "coube" na cota
+		if policy.Rate > 0 {
+			time.Sleep(time.Until(start.Add(time.Duration(len(page.Results)) * time.Second / time.Duration(policy.Rate))))
+		}
+	}
+
+	if err := job.Progress(progress.Exported, progress.Exported); err != nil {
+		return progress.Exported, err
+	}
+	clusterLog.Info("Export completed", "op", "export", "prefix", prefix, "path", path, "exported", progress.Exported)
+	if err := os.Remove(progressPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return progress.Exported, err
+	}
+	return progress.Exported, nil
+}
+
+// Aguarda a janela de export abrir, verificando periodicamente se o job foi cancelado
+func (kv *KeyValueStore) awaitExportWindow(job *Job) error {
+	logged := false
+	for {
+		window, err := ParseTimeWindow(kv.Gossip.ExportPolicy().Window)
+		if err != nil {
+			return err
+		}
+		wait := window.Until(time.Now())
+		if wait == 0 {
+			return nil
+		}
+		if !logged {
+			clusterLog.Info("Export paused until the export window opens", "op", "export", "window", window.String(), "wait", wait.Round(time.Second))
+			logged = true
+		}
+		if job.Cancelled() {
+			return ErrJobCancelled
+		}
+		time.Sleep(min(wait, exportWindowPoll))
+	}
+}
+
+// Runner do job de export: export <arquivo> [prefixo]
+func (kv *KeyValueStore) exportJob(job *Job, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing export file")
+	}
+	prefix := ""
+	if len(args) > 1 {
+		prefix = args[1]
+	}
+	_, err := kv.Export(job, prefix, args[0])
+	return err
+}
@@ -0,0 +1,130 @@
+package store
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/bquerino/kv-g/internal/vectorclock"
+)
+
+// Com FastAck, um PUT ou DELETE com a consistência padrão é confirmado ao cliente assim que a
+// cópia local é gravada no commit log (ver commitlog.go), sem esperar as outras réplicas: elas
+// recebem a escrita em segundo plano, pelo mesmo caminho de uma escrita comum (com hints para
+// as réplicas fora). Enquanto a escrita não tem as W confirmações, o nó que a coordenou a marca
+// como pendente: a leitura da chave por esse nó informa que a versão ainda não é durável na
+// replicação, e WaitDurable espera as confirmações. Assim a aplicação escolhe, em cada leitura,
+// entre a latência do ack local e a durabilidade do W. Uma escrita com nível de consistência
+// explícito, ou coordenada por um nó que não é réplica da chave, continua síncrona.
+
+// pendingWrite é uma escrita confirmada pelo ack rápido ainda em replicação
+type pendingWrite struct {
+	vc   *vectorclock.VectorClock
+	done chan struct{} // Fechado quando a replicação termina
+	err  error         // Motivo de a escrita não alcançar o W (definido antes de done fechar)
+}
+
+// durabilityTracker guarda, por chave, a última escrita com ack rápido sem as W confirmações
+type durabilityTracker struct {
+	mutex   sync.Mutex
+	pending map[string]*pendingWrite
+}
+
+func newDurabilityTracker() *durabilityTracker {
+	return &durabilityTracker{pending: make(map[string]*pendingWrite)}
+}
+
+// Registra uma escrita em replicação, que passa a ser a pendente da chave
+func (t *durabilityTracker) begin(key string, vc *vectorclock.VectorClock) *pendingWrite {
+	w := &pendingWrite{vc: vc, done: make(chan struct{})}
+	t.mutex.Lock()
+	t.pending[key] = w
+	t.mutex.Unlock()
+	return w
+}
+
+// Encerra a replicação da escrita. Uma escrita que não alcançou o W continua pendente até ser
+// superada por outra.
+func (t *durabilityTracker) finish(key string, w *pendingWrite, err error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	w.err = err
+	close(w.done)
+	if err == nil && t.pending[key] == w {
+		delete(t.pending, key)
+	}
+}
+
+func (t *durabilityTracker) lookup(key string) *pendingWrite {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.pending[key]
+}
+
+// Indica se a versão vc da chave pode ser de uma escrita ainda sem as W confirmações: há uma
+// escrita pendente que vc não supera
+func (t *durabilityTracker) isPending(key string, vc *vectorclock.VectorClock) bool {
+	w := t.lookup(key)
+	return w != nil && (vc == nil || vc.Compare(w.vc) != 1)
+}
+
+// Indica se a escrita pode ser confirmada só com a cópia local: FastAck ativo, consistência
+// padrão e o nó é uma das réplicas vivas (a cópia local já foi gravada)
+func (kv *KeyValueStore) fastAckable(level ConsistencyLevel, live []*Node) bool {
+	if !kv.FastAck || level != ConsistencyDefault {
+		return false
+	}
+	return slices.ContainsFunc(live, func(node *Node) bool { return node.ID == kv.Gossip.Self.ID })
+}
+
+// Completa result com a cópia local, já gravada no commit log, e replica a escrita em segundo
+// plano, marcando a chave como pendente até a escrita alcançar o W. O desligamento espera a
+// replicação como uma requisição em andamento.
+func (kv *KeyValueStore) replicateInBackground(result *PutResult, preference PreferenceList, live, down []*Node, outcomes []ReplicaOutcome, value string, vc *vectorclock.VectorClock, now time.Time) {
+	key := result.Key
+	background := &PutResult{Key: key, Requested: result.Requested, Outcomes: slices.Clone(result.Outcomes)}
+	for _, outcome := range outcomes {
+		if outcome.NodeID == kv.Gossip.Self.ID {
+			result.Outcomes = append(result.Outcomes, outcome)
+			result.Replicas++
+			result.Written = append(result.Written, outcome.NodeID)
+		}
+	}
+	result.Pending = true
+
+	pending := kv.durability.begin(key, vc)
+	kv.inflight.Add(1)
+	go func() {
+		defer kv.inflight.Done()
+		start := time.Now()
+		err := kv.replicateWrite(background, preference, live, down, outcomes, value, vc, now, ConsistencyDefault)
+		kv.durability.finish(key, pending, err)
+		if err != nil {
+			replicationLog.Warn("Fast-acked write did not reach the write quorum", "op", "put", "key", logKey(key), "result", background.String(), "err", err)
+			return
+		}
+		replicationLog.Debug("Fast-acked write is durable", "op", "put", "key", logKey(key), "replicas", background.Replicas, "elapsed", time.Since(start))
+	}()
+}
+
+// Espera a última escrita com ack rápido da chave coordenada por este nó alcançar o W, ou ctx
+// terminar. Retorna nil de imediato se não há escrita pendente, e o erro da replicação se ela
+// não alcançou o W.
+func (kv *KeyValueStore) WaitDurable(ctx context.Context, key string) error {
+	for {
+		w := kv.durability.lookup(key)
+		if w == nil {
+			return nil
+		}
+		select {
+		case <-w.done:
+			if w.err != nil {
+				return w.err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Retorna os nomes das entradas do diretório
+func dirEntries(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, len(entries))
+	for i, entry := range entries {
+		names[i] = entry.Name()
+	}
+	return names
+}
+
+func TestWriteFileAtomicReplacesContent(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.json")
+
+	for _, content := range []string{"primeira", "segunda, mais longa que a primeira", "3"} {
+		if err := writeFileAtomic(path, []byte(content), 0644); err != nil {
+			t.Fatalf("writeFileAtomic(%q): %v", content, err)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != content {
+			t.Fatalf("content = %q, want %q", data, content)
+		}
+	}
+	// Nenhum temporário fica para trás
+	if names := dirEntries(t, dir); len(names) != 1 || names[0] != "config.json" {
+		t.Fatalf("directory has %v, want only config.json", names)
+	}
+	if runtime.GOOS != "windows" {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perm := info.Mode().Perm(); perm != 0644 {
+			t.Fatalf("perm = %o, want 644", perm)
+		}
+	}
+}
+
+func TestWriteFileAtomicCreatesParentDirs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a", "b", "c.json")
+	if err := writeFileAtomic(path, []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "x" {
+		t.Fatalf("ReadFile = %q, %v", data, err)
+	}
+}
+
+// Um rename que falha (o destino é um diretório) mantém o destino e apaga o temporário
+func TestWriteFileAtomicFailureKeepsDestination(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "dest")
+	if err := os.Mkdir(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(path, "inside"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writeFileAtomic(path, []byte("novo"), 0644); err == nil {
+		t.Fatal("writeFileAtomic over a non-empty directory succeeded")
+	}
+	if info, err := os.Stat(path); err != nil || !info.IsDir() {
+		t.Fatalf("destination changed: %v, %v", info, err)
+	}
+	if names := dirEntries(t, dir); len(names) != 1 {
+		t.Fatalf("temporary file left behind: %v", names)
+	}
+}
+
+func TestCopyFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	from, to := filepath.Join(dir, "from"), filepath.Join(dir, "other", "to")
+	if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(from, []byte("conteúdo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(to, []byte("antigo e maior que o novo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := copyFileAtomic(from, to); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(to); err != nil || string(data) != "conteúdo" {
+		t.Fatalf("ReadFile = %q, %v", data, err)
+	}
+	if _, err := os.Stat(to + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("temporary file left behind: %v", err)
+	}
+}
+
+func TestRenameFileReplacesDestination(t *testing.T) {
+	dir := t.TempDir()
+	from, to := filepath.Join(dir, "from"), filepath.Join(dir, "to")
+	if err := os.WriteFile(from, []byte("novo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(to, []byte("antigo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := renameFile(from, to); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(to); err != nil || string(data) != "novo" {
+		t.Fatalf("ReadFile = %q, %v", data, err)
+	}
+}
+
+// Os arquivos do nó ficam dentro do diretório de dados, montados com filepath, mesmo com
+// espaços no caminho e IDs de nós com caracteres inválidos em nomes de arquivo do Windows
+func TestDataPathsStayInsideDataDir(t *testing.T) {
+	dataDir := filepath.Join(t.TempDir(), "dados do nó", "n1")
+	gossip := NewGossip("node1", "localhost:18081", time.Second, 4, dataDir)
+	if gossip.KeyValueStore == nil {
+		t.Fatal("NewGossip did not open the store")
+	}
+	defer gossip.KeyValueStore.Close()
+
+	for _, dir := range []string{lsmDir, hintDir} {
+		if info, err := os.Stat(filepath.Join(dataDir, dir)); err != nil || !info.IsDir() {
+			t.Fatalf("%s: %v, %v", dir, info, err)
+		}
+	}
+
+	config := &ClusterConfig{Name: "teste", Nodes: []NodeConfig{{ID: "node1", Address: "localhost:18081"}}, N: 1, R: 1, W: 1}
+	if err := config.Save(dataDir); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadClusterConfig(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Name != "teste" || len(loaded.Nodes) != 1 {
+		t.Fatalf("loaded config = %+v", loaded)
+	}
+	if !strings.HasPrefix(ClusterConfigPath(dataDir), dataDir+string(filepath.Separator)) {
+		t.Fatalf("cluster config %s is outside %s", ClusterConfigPath(dataDir), dataDir)
+	}
+
+	hints := gossip.KeyValueStore.hints
+	for _, target := range []string{"node:2", `rack\a/node*3`, "localhost:8082"} {
+		path := hints.path(target, hintPagesExt)
+		if filepath.Dir(path) != hints.dir {
+			t.Fatalf("hint path %s for %q is outside %s", path, target, hints.dir)
+		}
+		if strings.ContainsAny(filepath.Base(path), `:\/*`) {
+			t.Fatalf("hint file name %q has characters invalid on Windows", filepath.Base(path))
+		}
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatalf("create %s: %v", path, err)
+		}
+		os.Remove(path)
+	}
+}
@@ -1,49 +1,119 @@
 package store
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
-	"log"
+	"math/rand"
 	"net"
+	"runtime/debug"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/bquerino/kv-g/internal/vectorclock"
 )
 
 type Node struct {
-	ID        string
-	Address   string
-	Alive     bool
-	LastCheck time.Time
+	ID           string
+	Address      string
+	Alive        bool
+	LastCheck    time.Time
+	detector     *phiDetector
+	Incarnation  uint64    // Encarnação anunciada pelo nó, que a incrementa para refutar suspeitas
+	Suspect      bool      // Não respondeu às sondagens; vivo até a suspeita expirar
+	suspectSince time.Time // Início da suspeita
 }
 
 type Gossip struct {
-	Nodes          map[string]*Node
-	Self           *Node
-	Coordinator    *Node
-	Interval       time.Duration
-	ConsistentHash *ConsistentHashing
-	KeyValueStore  *KeyValueStore // Integração com o KeyValueStore
-	Mutex          sync.Mutex
+	Nodes            map[string]*Node
+	Self             *Node
+	Coordinator      *Node
+	Interval         time.Duration
+	PushPullInterval time.Duration // Intervalo da sincronização completa de estado com um par aleatório
+	Fanout           int           // Pares contatados por rodada (0 = adaptativo, log2 do tamanho do cluster)
+	AdaptiveInterval bool          // Aumenta o intervalo das rodadas conforme o cluster cresce
+	SuspicionTimeout time.Duration // Tempo que um nó suspeito tem para refutar a suspeita antes de ser declarado fora
+	PhiSuspect       float64       // Nível de suspeita (phi) a partir do qual um nó passa a ser suspeito
+	PhiDead          float64       // Nível de suspeita (phi) a partir do qual um nó é declarado fora
+	nodeIndex        *nodeTable    // Índices curtos dos nós usados nos Vector Clocks
+	PreferPrimary    bool          // Encaminha as requisições ao primeiro nó da lista de preferência da chave
+	routing          RoutingStats  // Quem coordenou as requisições que entraram por este nó
+	routingMutex     sync.Mutex
+	broadcasts       *broadcastQueue
+	members          *memberVersions // Versões da lista de membros trocadas no push-pull
+	breakers         *breakerSet
+	Timeouts         TimeoutConfig // Timeouts das conexões com os outros nós, por tipo de tráfego
+	ResolveInterval  time.Duration // Intervalo entre as resoluções dos nomes dos pares (0 = desativada)
+	addresses        *addressBook  // Último IP resolvido de cada nome de par
+	MaxClockSkew     time.Duration // Diferença entre relógios a partir da qual um par é alertado (0 = sem alerta)
+	clockSkews       *skewTable    // Diferença estimada entre o relógio de cada par e o deste nó
+	TextProtocol     bool          // Envia as mensagens no protocolo de texto anterior (ver wire.go)
+	PeerConns        int           // Conexões persistentes por par (0 = uma conexão por mensagem; ver pool.go)
+	Transport        Transport     // Conexões entre nós (nil = TCP; ver transport.go)
+	TLS              *tls.Config   // TLS com autenticação mútua nas conexões entre nós (nil = sem TLS; ver tls.go)
+	RingInterval     time.Duration // Intervalo entre as verificações da distribuição do anel (0 = desativada; ver ringstats.go)
+	ringStats        *RingStats    // Última distribuição do anel calculada
+	ringStatsMutex   sync.Mutex
+	pool             *connPool
+	ConsistentHash   *ConsistentHashing
+	KeyValueStore    *KeyValueStore // Integração com o KeyValueStore
+	Cluster          *ClusterConfig // Configuração gravada pelo cluster init (nil se o cluster não foi inicializado)
+	clusterMutex     sync.RWMutex   // Protege a troca de Cluster por uma mudança coordenada de configuração
+	settingsMutex    sync.Mutex     // Serializa as fases das mudanças de configuração
+	pendingSetting   *SettingChange // Mudança preparada aguardando COMMIT ou ABORT
+	Mutex            sync.Mutex
+	listener         net.Listener   // Servidor TCP do GossipIn, fechado no Shutdown
+	handlers         sync.WaitGroup // Conexões recebidas em atendimento, esperadas pelo Shutdown
+	joining          atomic.Bool    // Entrando no cluster pelos seeds, sem a configuração aplicada (ver JoinCluster)
+	panics           atomic.Int64   // Mensagens recebidas cujo handler entrou em pânico (ver handleConnection)
+	closing          bool
+	electing         bool   // Há uma eleição em andamento neste nó
+	electionRound    uint64 // Incrementado a cada eleição, para descartar timeouts antigos
 }
 
 // Inicializa o Gossip Protocol e configura o Consistent Hashing com vNodes
-func NewGossip(selfID, address string, interval time.Duration, vNodes int) *Gossip {
+func NewGossip(selfID, address string, interval time.Duration, vNodes int, dataDir string) *Gossip {
+	// A encarnação parte do horário de início, para superar a de uma execução anterior do nó
 	self := &Node{
-		ID:      selfID,
-		Address: address,
-		Alive:   true,
+		ID:          selfID,
+		Address:     address,
+		Alive:       true,
+		Incarnation: uint64(time.Now().Unix()),
 	}
 
 	gossip := &Gossip{
-		Nodes:          make(map[string]*Node),
-		Self:           self,
-		Interval:       interval,
-		ConsistentHash: NewConsistentHashing(vNodes),
+		Nodes:            make(map[string]*Node),
+		Self:             self,
+		Interval:         interval,
+		PushPullInterval: 10 * interval,
+		AdaptiveInterval: true,
+		SuspicionTimeout: 5 * interval,
+		PhiSuspect:       DefaultPhiSuspect,
+		PhiDead:          DefaultPhiDead,
+		broadcasts:       &broadcastQueue{},
+		members:          newMemberVersions(),
+		breakers:         newBreakerSet(),
+		Timeouts:         DefaultTimeoutConfig(),
+		ResolveInterval:  DefaultResolveInterval,
+		addresses:        newAddressBook(),
+		MaxClockSkew:     DefaultMaxClockSkew,
+		clockSkews:       newSkewTable(),
+		RingInterval:     DefaultRingInterval,
+		PeerConns:        DefaultPeerConns,
+		pool:             newConnPool(),
+		ConsistentHash:   NewConsistentHashing(vNodes),
+		nodeIndex:        loadNodeTable(dataDir),
 	}
 
+	// O próprio nó também é responsável por uma parte do anel
+	gossip.ConsistentHash.AddNode(self)
+
 	// Inicializa o KeyValueStore integrado com o Gossip e PageManager
-	gossip.KeyValueStore, _ = NewKeyValueStore(gossip, gossip.ConsistentHash, 5*time.Second, "data_pages.db")
+	gossip.KeyValueStore, _ = NewKeyValueStore(gossip, gossip.ConsistentHash, 5*time.Second, dataDir, "data_pages.db")
 
 	return gossip
 }
@@ -62,190 +132,531 @@ func (g *Gossip) AddNode(nodeID, address string) {
 	g.ConsistentHash.AddNode(node)
 }
 
-// Remove um nó e seus vNodes da rede de Gossip
+// Remove um nó e seus vNodes da rede de Gossip. Os trechos que ficam com novas réplicas são
+// transferidos a elas pelo rebalanceamento.
 func (g *Gossip) RemoveNode(nodeID string) {
 	g.Mutex.Lock()
-	defer g.Mutex.Unlock()
-
+	n := g.KeyValueStore.replicationFactor()
+	before := g.KeyValueStore.ringOwners(n)
 	delete(g.Nodes, nodeID)
 	g.ConsistentHash.RemoveNode(nodeID)
+	g.Mutex.Unlock()
+
+	g.KeyValueStore.rebalanceOwnershipChange(before, n, "node "+nodeID+" left the ring")
 }
 
-// Envia mensagens para todos os nós conhecidos
+// Envia mensagens para um subconjunto aleatório (fanout) dos nós conhecidos
 func (g *Gossip) GossipOut() {
 	g.Mutex.Lock()
 	defer g.Mutex.Unlock()
 
+	peers := make([]*Node, 0, len(g.Nodes))
 	for _, node := range g.Nodes {
-		go g.sendMessage(node)
+		peers = append(peers, node)
+	}
+	rand.Shuffle(len(peers), func(i, j int) {
+		peers[i], peers[j] = peers[j], peers[i]
+	})
+
+	fanout := g.currentFanout(len(peers))
+	for _, node := range peers[:fanout] {
+		go g.probe(node)
 	}
 }
 
-// Recebe mensagens e atualiza o estado dos nós
-func (g *Gossip) GossipIn() {
-	listener, err := net.Listen("tcp", g.Self.Address)
+// Recebe mensagens e atualiza o estado dos nós até ctx ser cancelado ou o nó ser desligado
+func (g *Gossip) GossipIn(ctx context.Context) {
+	transport := g.Transport
+	if transport == nil {
+		transport = TCPTransport{}
+	}
+	listener, err := transport.Listen(g.Self.Address)
 	if err != nil {
-		log.Printf("Error starting TCP server: %v", err)
+		gossipLog.Error("Error starting TCP server", "address", g.Self.Address, "err", err)
 		return
 	}
+	if g.TLS != nil {
+		listener = tls.NewListener(listener, g.TLS)
+	}
 
 	defer listener.Close()
 
+	g.Mutex.Lock()
+	g.listener = listener
+	g.Mutex.Unlock()
+
+	// Cancelar ctx fecha o listener como no desligamento, encerrando o Accept
+	stop := context.AfterFunc(ctx, func() {
+		g.Mutex.Lock()
+		g.closing = true
+		g.Mutex.Unlock()
+		listener.Close()
+	})
+	defer stop()
+
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			log.Printf("Error accepting connection: %v", err)
+			g.Mutex.Lock()
+			closing := g.closing
+			g.Mutex.Unlock()
+			if closing {
+				return
+			}
+			gossipLog.Warn("Error accepting connection", "err", err)
 			continue
 		}
 
-		go g.handleConnection(conn)
+		g.handlers.Add(1)
+		go func() {
+			defer g.handlers.Done()
+			g.handleConnection(conn)
+		}()
 	}
 }
 
-// Envia uma mensagem de verificação de saúde para o nó
-func (g *Gossip) sendMessage(node *Node) {
-	conn, err := net.Dial("tcp", node.Address)
+// Lida com uma conexão recebida (PING ou REPLICATE de outro nó)
+func (g *Gossip) handleConnection(raw net.Conn) {
+	defer raw.Close()
+
+	// Até a mensagem ser identificada valem os timeouts do gossip
+	timed := &deadlineConn{Conn: raw, timeouts: g.Timeouts.Gossip}
+	conn, err := acceptPeerConn(timed)
 	if err != nil {
-		log.Printf("Error connecting to node %s: %v", node.ID, err)
-		g.markNodeDead(node)
+		gossipLog.Warn("Error reading message", "remote", raw.RemoteAddr(), "err", err)
 		return
 	}
-	defer conn.Close()
+	fields, err := conn.receive()
+	if err != nil {
+		gossipLog.Warn("Error reading message", "remote", raw.RemoteAddr(), "err", err)
+		if !conn.text {
+			conn.send("ERROR", err.Error())
+		}
+		return
+	}
+	if len(fields) == 0 {
+		return
+	}
+	timed.timeouts = g.Timeouts.forMessage(fields[0])
+
+	// Uma mensagem malformada que escape da validação dos handlers derruba só a conexão; o pânico
+	// é contado e aparece no health, porque indica um bug a corrigir
+	defer func() {
+		if r := recover(); r != nil {
+			g.panics.Add(1)
+			gossipLog.Error("Panic handling message", "op", fields[0], "remote", raw.RemoteAddr(), "panic", r, "stack", string(debug.Stack()))
+			conn.send("ERROR", "internal error")
+		}
+	}()
 
-	// Envia um ping simples
-	log.Printf("Sending PING to node %s", node.ID)
-	fmt.Fprintf(conn, "PING from %s\n", g.Self.ID)
-}
+	if g.refuseUnauthenticatedPeer(conn, raw, fields[0]) {
+		return
+	}
 
-// Lida com uma conexão recebida (PING de outro nó)
-func (g *Gossip) handleConnection(conn net.Conn) {
-	defer conn.Close()
+	switch fields[0] {
+	case "MUX":
+		if _, nested := raw.(*muxStream); nested {
+			conn.send("ERROR", "MUX inside a multiplexed stream")
+			return
+		}
+		g.serveMux(timed, conn)
+	case "PING":
+		// PING from <id> [<encarnação> <atualizações de carona>]
+		if len(fields) != 3 && len(fields) != 5 {
+			gossipLog.Warn("Malformed message", "op", "PING", "message", formatMessage(fields))
+			return
+		}
+		g.handlePing(conn, raw, fields[2], fields[3:])
+	case "PINGREQ":
+		g.handlePingReq(conn, fields[1:])
+	case "REPLICATE":
+		if g.refuseWhileJoining(conn, fields[0]) {
+			return
+		}
+		g.handleReplicate(conn, fields[1:])
+	case "FETCH":
+		g.handleFetch(conn, fields[1:])
+	case "SCAN":
+		g.handleScan(conn, fields[1:])
+	case "DELPREFIX":
+		g.handleDeletePrefix(conn, fields[1:])
+	case "PROMOTE":
+		g.handlePromote(conn, fields[1:])
+	case "REPAIR":
+		g.handleRepair(conn, fields[1:])
+	case "FORWARD":
+		g.handleForward(conn, fields[1:])
+	case "MULTI":
+		g.handleMulti(conn, fields[1:])
+	case "HINT":
+		g.handleHint(conn, fields[1:])
+	case "BATCH":
+		if g.refuseWhileJoining(conn, fields[0]) {
+			return
+		}
+		if len(fields) != 2 {
+			gossipLog.Warn("Malformed message", "op", "BATCH", "message", formatMessage(fields))
+			return
+		}
+		g.handleBatch(conn, fields[1])
+	case "SYNC":
+		if len(fields) != 3 {
+			gossipLog.Warn("Malformed message", "op", "SYNC", "message", formatMessage(fields))
+			return
+		}
+		g.handleSync(conn, fields[2])
+	case "JOIN":
+		g.handleJoin(conn, raw, fields[1:])
+	case "LEAVE":
+		if len(fields) != 3 && len(fields) != 4 {
+			gossipLog.Warn("Malformed message", "op", "LEAVE", "message", formatMessage(fields))
+			return
+		}
+		g.handleLeave(fields[2], fields[3:])
+	case "SETTING":
+		g.handleSetting(conn, fields[1:])
+	case "ELECTION":
+		if len(fields) != 3 {
+			gossipLog.Warn("Malformed message", "op", "ELECTION", "message", formatMessage(fields))
+			return
+		}
+		g.handleElection(conn, fields[2])
+	case "COORDINATOR":
+		if len(fields) != 2 {
+			gossipLog.Warn("Malformed message", "op", "COORDINATOR", "message", formatMessage(fields))
+			return
+		}
+		g.handleCoordinator(fields[1])
+	default:
+		gossipLog.Warn("Unknown message", "op", fields[0], "message", formatMessage(fields))
+	}
+}
 
-	var nodeID string
-	fmt.Fscanf(conn, "PING from %s\n", &nodeID)
+// Atualiza o estado do nó que enviou o PING, ou inicia o handshake de entrada se ele for
+// desconhecido. args traz a encarnação do nó e quantas atualizações de membros seguem o PING;
+// o ACK leva de volta as atualizações e o horário (em nanossegundos Unix) deste nó.
+func (g *Gossip) handlePing(conn *peerConn, raw net.Conn, nodeID string, args []string) {
+	var incarnation uint64
+	var updates []memberUpdate
+	if len(args) == 2 {
+		var err error
+		if incarnation, err = strconv.ParseUint(args[0], 10, 64); err != nil {
+			gossipLog.Warn("Malformed PING: invalid incarnation", "peer", nodeID, "incarnation", args[0])
+			return
+		}
+		count, err := strconv.Atoi(args[1])
+		if err != nil {
+			gossipLog.Warn("Malformed PING: invalid update count", "peer", nodeID, "count", args[1])
+			return
+		}
+		if updates, err = readUpdates(conn, count); err != nil {
+			gossipLog.Warn("Malformed PING", "peer", nodeID, "err", err)
+			return
+		}
+	}
 
+	node, exists := g.GetNode(nodeID)
+	if !exists {
+		g.requestJoinHandshake(conn, raw, nodeID)
+		return
+	}
 	g.Mutex.Lock()
-	defer g.Mutex.Unlock()
-
-	if node, exists := g.Nodes[nodeID]; exists {
-		node.LastCheck = time.Now()
-		node.Alive = true
-		log.Printf("Received PING from node %s", node.ID)
-	} else {
-		log.Printf("Unknown node: %s", nodeID)
+	if incarnation > node.Incarnation {
+		node.Incarnation = incarnation
 	}
+	g.Mutex.Unlock()
+	g.markNodeAlive(node)
+	g.applyUpdates(updates)
+
+	gossipLog.Debug("Received PING", "peer", node.ID)
+	acked := g.piggyback()
+	conn.queue("ACK", strconv.Itoa(len(acked)), strconv.FormatInt(time.Now().UnixNano(), 10))
+	queueUpdates(conn, acked)
+	conn.flush()
 }
 
-// Marca um nó como morto se ele não responder
-func (g *Gossip) markNodeDead(node *Node) {
-	g.Mutex.Lock()
-	defer g.Mutex.Unlock()
+// Aplica localmente uma escrita enviada pelo coordenador e confirma com OK, ou responde
+// "SIBLINGS <versões> <limite>" se a réplica a recusa pelo limite de irmãs
+func (g *Gossip) handleReplicate(conn *peerConn, args []string) {
+	key, value, encoded, writtenAt, err := parseEntry(args)
+	if err != nil {
+		rejectEntry(conn, "REPLICATE", err)
+		return
+	}
 
-	node.Alive = false
-	log.Printf("Node %s is marked as dead", node.ID)
-	if g.Coordinator != nil && g.Coordinator.ID == node.ID {
-		log.Printf("Coordinator %s is down! Initiating election.", node.ID)
-		go g.initiateElection()
+	clock, err := g.nodeIndex.decodeClock(encoded)
+	if err != nil {
+		conn.send("ERROR", err.Error())
+		return
 	}
-}
 
-// Função de loop para enviar pings periodicamente
-func (g *Gossip) StartGossip() {
-	ticker := time.NewTicker(g.Interval)
-	for range ticker.C {
-		g.GossipOut()
+	var limit *SiblingLimitError
+	if err := g.KeyValueStore.acceptsVersion(key, clock); errors.As(err, &limit) {
+		conn.send(limit.answer()...)
+		return
 	}
+	g.KeyValueStore.ApplyReplica(key, value, clock, writtenAt)
+	conn.send("OK")
 }
 
-// Função que inicia uma eleição quando o coordenador falha
-func (g *Gossip) initiateElection() {
-	log.Println("Starting election...")
+// Aplica, na ordem recebida, um lote de escritas ("BATCH <n>" seguido de n mensagens
+// "<key> <value> <vc> [@<gravada em>] #<checksum>", ou "<key> <vc> [@<gravada em>]" para remoções) e responde "OK <aplicadas> <obsoletas>"
+func (g *Gossip) handleBatch(conn *peerConn, countField string) {
+	count, err := strconv.Atoi(countField)
+	if err != nil || count < 0 || count > maxBatchSize {
+		conn.send("ERROR", fmt.Sprintf("invalid batch size %q", countField))
+		return
+	}
 
-	g.Mutex.Lock()
-	defer g.Mutex.Unlock()
+	applied, stale := 0, 0
+	for i := 0; i < count; i++ {
+		fields, err := conn.receive()
+		if err != nil {
+			replicationLog.Warn("Error reading batch entry", "op", "BATCH", "entry", i+1, "count", count, "err", err)
+			return
+		}
+		key, value, encoded, writtenAt, err := parseEntry(fields)
+		if err != nil {
+			rejectEntry(conn, fmt.Sprintf("batch entry %d", i+1), err)
+			return
+		}
+		clock, err := g.nodeIndex.decodeClock(encoded)
+		if err != nil {
+			conn.send("ERROR", err.Error())
+			return
+		}
+
+		// A reconciliação por Vector Clock descarta entradas mais antigas que a versão local
+		if g.KeyValueStore.ApplyReplica(key, value, clock, writtenAt) {
+			applied++
+		} else {
+			stale++
+		}
+	}
+	conn.send("OK", strconv.Itoa(applied), strconv.Itoa(stale))
+}
 
-	higherNodes := g.getHigherNodes()
+// Responde com a versão local de uma chave ("VALUE <value> <vc> <gravada em> #<checksum>",
+// "TOMBSTONE <vc> <gravada em>" para uma remoção ou "NOTFOUND"). Com versões concorrentes, a
+// resposta termina com o número de irmãs, enviadas em seguida numa mensagem "SIBLING <versão>"
+// cada. "FETCH <key> HELD" responde, no mesmo formato, com a versão que o nó guarda para
+// réplicas fora.
+func (g *Gossip) handleFetch(conn *peerConn, args []string) {
+	if len(args) != 1 && (len(args) != 2 || args[1] != "HELD") {
+		conn.send("ERROR", "malformed FETCH")
+		return
+	}
 
-	if len(higherNodes) == 0 {
-		// Se não há nós com IDs maiores, o nó atual se torna o coordenador
-		g.becomeCoordinator()
+	var version replicaVersion
+	if len(args) == 2 {
+		version = g.KeyValueStore.heldVersion(args[0])
 	} else {
-		// Envia mensagens para os nós com IDs maiores
-		for _, node := range higherNodes {
-			go g.sendElectionMessage(node)
-		}
+		g.KeyValueStore.hotKeys.record(args[0])
+		version = g.KeyValueStore.localVersion(args[0])
+	}
+	if !version.Found {
+		conn.send("NOTFOUND")
+		return
 	}
+	if len(version.Siblings) == 0 {
+		conn.send(g.formatFetchedVersion(version)...)
+		return
+	}
+	conn.queue(append(g.formatFetchedVersion(version), strconv.Itoa(len(version.Siblings)))...)
+	for _, sibling := range version.Siblings {
+		conn.queue(append([]string{"SIBLING"}, g.formatFetchedVersion(sibling)...)...)
+	}
+	conn.flush()
 }
 
-// Retorna uma lista de nós com IDs maiores que o do nó atual
-func (g *Gossip) getHigherNodes() []*Node {
-	var higherNodes []*Node
-	for _, node := range g.Nodes {
-		if node.ID > g.Self.ID && node.Alive {
-			higherNodes = append(higherNodes, node)
-		}
+// Formata uma versão para a resposta de um FETCH
+func (g *Gossip) formatFetchedVersion(version replicaVersion) []string {
+	clock, writtenAt := g.nodeIndex.encodeClock(version.VectorClock), strconv.FormatInt(encodeTime(version.WrittenAt), 10)
+	if version.Value == "" {
+		return []string{"TOMBSTONE", clock, writtenAt}
 	}
-	return higherNodes
+	return []string{"VALUE", version.Value, clock, writtenAt, checksumField(version.Value)}
 }
 
-// Envia uma mensagem de eleição para um nó com ID maior
-func (g *Gossip) sendElectionMessage(node *Node) {
-	conn, err := net.Dial("tcp", node.Address)
+// Busca a versão de uma chave armazenada em uma réplica, com as irmãs dela
+func (g *Gossip) FetchReplica(node *Node, key string) (replicaVersion, error) {
+	return g.fetch(node, "FETCH", key)
+}
+
+// Busca a versão de uma chave que um standby guarda para réplicas fora ("FETCH <key> HELD")
+func (g *Gossip) fetchHeld(node *Node, key string) (replicaVersion, error) {
+	return g.fetch(node, "FETCH", key, "HELD")
+}
+
+func (g *Gossip) fetch(node *Node, request ...string) (replicaVersion, error) {
+	version := replicaVersion{NodeID: node.ID}
+	conn, err := g.dialReplica(node, g.Timeouts.Replication)
 	if err != nil {
-		log.Printf("Error connecting to node %s during election: %v", node.ID, err)
-		g.markNodeDead(node)
-		return
+		return version, err
 	}
 	defer conn.Close()
 
-	log.Printf("Sending ELECTION message to node %s", node.ID)
-	fmt.Fprintf(conn, "ELECTION from %s\n", g.Self.ID)
+	if err := conn.send(request...); err != nil {
+		return version, err
+	}
 
-	// Espera resposta de "OK"
-	var response string
-	fmt.Fscanf(conn, "%s\n", &response)
-	if response == "OK" {
-		log.Printf("Node %s responded to election", node.ID)
-		return
+	fields, err := conn.receive()
+	if err != nil {
+		return version, err
 	}
-}
+	malformed := fmt.Errorf("replica %s answered %q", node.ID, formatMessage(fields))
 
-// Define o nó atual como coordenador
-func (g *Gossip) becomeCoordinator() {
-	log.Println("Becoming the coordinator.")
-	g.Coordinator = g.Self
+	if len(fields) == 1 && fields[0] == "NOTFOUND" {
+		return version, nil
+	}
+	// Com irmãs, a resposta termina com o número delas, depois do checksum
+	siblings := 0
+	if n := len(fields); n >= 5 && fields[0] == "VALUE" && !strings.HasPrefix(fields[n-1], "#") || n == 4 && fields[0] == "TOMBSTONE" {
+		if siblings, err = strconv.Atoi(fields[n-1]); err != nil || siblings < 0 {
+			return version, malformed
+		}
+		fields = fields[:n-1]
+	}
+	if err := g.parseFetchedVersion(fields, &version); errors.Is(err, ErrChecksumMismatch) {
+		return version, fmt.Errorf("replica %s sent key %s: %w", node.ID, request[1], err)
+	} else if err != nil {
+		return version, malformed
+	}
 
-	// Anuncia para todos os nós que este nó é o novo coordenador
-	g.announceCoordinator()
+	for i := 0; i < siblings; i++ {
+		fields, err := conn.receive()
+		if err != nil {
+			return version, err
+		}
+		sibling := replicaVersion{NodeID: node.ID}
+		if len(fields) == 0 || fields[0] != "SIBLING" {
+			return version, fmt.Errorf("replica %s sent a malformed sibling %q", node.ID, formatMessage(fields))
+		}
+		if err := g.parseFetchedVersion(fields[1:], &sibling); errors.Is(err, ErrChecksumMismatch) {
+			return version, fmt.Errorf("replica %s sent a sibling of key %s: %w", node.ID, request[1], err)
+		} else if err != nil {
+			return version, fmt.Errorf("replica %s sent a malformed sibling %q", node.ID, formatMessage(fields))
+		}
+		version.Siblings = append(version.Siblings, sibling)
+	}
+	return version, nil
 }
 
-// Anuncia que o nó atual é o coordenador para todos os outros nós
-func (g *Gossip) announceCoordinator() {
-	g.Mutex.Lock()
-	defer g.Mutex.Unlock()
-
-	for _, node := range g.Nodes {
-		go g.sendCoordinatorMessage(node)
+// Interpreta uma versão formatada por formatFetchedVersion, conferindo o valor com o checksum
+func (g *Gossip) parseFetchedVersion(fields []string, version *replicaVersion) error {
+	fields, checksum := takeChecksum(fields, 4)
+	switch {
+	case (len(fields) == 3 || len(fields) == 4) && fields[0] == "VALUE":
+		clock, err := g.nodeIndex.decodeClock(fields[2])
+		if err != nil {
+			return errMalformedEntry
+		}
+		// Nós anteriores não informam quando gravaram a versão nem o checksum
+		if len(fields) == 4 {
+			if version.WrittenAt, err = decodeTime(fields[3]); err != nil {
+				return errMalformedEntry
+			}
+		}
+		if err := VerifyChecksum(fields[1], checksum); err != nil {
+			return err
+		}
+		version.Value, version.VectorClock, version.Found = fields[1], clock, true
+		return nil
+	case len(fields) == 3 && fields[0] == "TOMBSTONE":
+		clock, err := g.nodeIndex.decodeClock(fields[1])
+		if err != nil {
+			return errMalformedEntry
+		}
+		if version.WrittenAt, err = decodeTime(fields[2]); err != nil {
+			return errMalformedEntry
+		}
+		version.VectorClock, version.Found = clock, true
+		return nil
 	}
+	return errMalformedEntry
 }
 
-// Envia uma mensagem de anúncio de coordenador para um nó
-func (g *Gossip) sendCoordinatorMessage(node *Node) {
-	conn, err := net.Dial("tcp", node.Address)
+// Envia uma escrita para uma réplica e aguarda a confirmação
+func (g *Gossip) SendReplica(node *Node, key, value string, vc *vectorclock.VectorClock, writtenAt time.Time) error {
+	conn, err := g.dialReplica(node, g.Timeouts.Replication)
 	if err != nil {
-		log.Printf("Error connecting to node %s to announce coordinator: %v", node.ID, err)
-		g.markNodeDead(node)
-		return
+		return err
 	}
 	defer conn.Close()
 
-	log.Printf("Announcing self as COORDINATOR to node %s", node.ID)
-	fmt.Fprintf(conn, "COORDINATOR %s\n", g.Self.ID)
+	if err := conn.send(append([]string{"REPLICATE"}, formatEntry(key, value, g.nodeIndex.encodeClock(vc), writtenAt)...)...); err != nil {
+		return err
+	}
+
+	response, err := conn.receive()
+	if err != nil {
+		return err
+	}
+	if len(response) == 3 && response[0] == "SIBLINGS" {
+		return parseSiblingLimit(key, response)
+	}
+	if len(response) != 1 || response[0] != "OK" {
+		return fmt.Errorf("replica %s answered %q", node.ID, formatMessage(response))
+	}
+	return nil
+}
+
+// Marca um nó como morto se ele não responder
+func (g *Gossip) markNodeDead(node *Node) {
+	g.Mutex.Lock()
+	defer g.Mutex.Unlock()
+
+	if node.Alive {
+		g.KeyValueStore.replicaLog.markDown(node.ID, node.LastCheck)
+	}
+	node.Alive, node.Suspect = false, false
+	gossipLog.Warn("Node is marked as dead", "peer", node.ID)
+	if g.Coordinator != nil && g.Coordinator.ID == node.ID {
+		gossipLog.Warn("Coordinator is down, initiating election", "peer", node.ID)
+		go g.initiateElection()
+	}
+}
+
+// Função de loop para enviar pings periodicamente
+func (g *Gossip) StartGossip(ctx context.Context) {
+	// Anuncia a encarnação atual, que se espalha de carona nas próximas rodadas
+	g.broadcasts.enqueue(g.memberUpdate(updateAlive, g.Self))
+	g.KeyValueStore.runLoop(ctx, func(ctx context.Context) {
+		for {
+			select {
+			case <-time.After(g.currentInterval()):
+			case <-ctx.Done():
+				return
+			}
+			g.evaluatePhi()
+			g.expireSuspects()
+			g.GossipOut()
+			if _, known := g.CoordinatorID(); !known {
+				go g.initiateElection()
+			}
+		}
+	})
 }
 
-// Mapeia uma chave para o nó apropriado
+// Mapeia uma chave para o primeiro nó da lista de preferência dela
 func (g *Gossip) GetNodeForKey(key string) *Node {
-	return g.ConsistentHash.GetNode(key)
+	replicas := g.ConsistentHash.GetPreferenceList(key, 1).Replicas
+	if len(replicas) == 0 {
+		return nil
+	}
+	return replicas[0]
+}
+
+// Retorna um nó conhecido pelo ID (incluindo o próprio nó)
+func (g *Gossip) GetNode(nodeID string) (*Node, bool) {
+	g.Mutex.Lock()
+	defer g.Mutex.Unlock()
+
+	if nodeID == g.Self.ID {
+		return g.Self, true
+	}
+	node, exists := g.Nodes[nodeID]
+	return node, exists
 }
 
 // Verifica se um nó está vivo
@@ -253,27 +664,50 @@ func (g *Gossip) IsNodeAlive(nodeID string) bool {
 	g.Mutex.Lock()
 	defer g.Mutex.Unlock()
 
+	// O próprio nó está sempre vivo do seu ponto de vista
+	if nodeID == g.Self.ID {
+		return true
+	}
+
 	if node, exists := g.Nodes[nodeID]; exists {
 		return node.Alive
 	}
 	return false
 }
 
-// Envia um PUT para o KeyValueStore
-func (g *Gossip) Put(key, value string) {
-	g.KeyValueStore.Put(key, value)
-}
+// Envia um lote de hints para um nó numa única conexão, retornando quantos foram
+// aplicados e quantos foram descartados por serem mais antigos que a versão do nó
+func (g *Gossip) SendBatch(node *Node, hints []*Hint) (applied, stale int, err error) {
+	conn, err := g.dialReplica(node, g.Timeouts.Hints)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer conn.Close()
+
+	conn.queue("BATCH", strconv.Itoa(len(hints)))
+	for _, hint := range hints {
+		conn.queue(formatEntry(hint.Key, hint.Value, g.nodeIndex.encodeClock(hint.VectorClock), hint.Timestamp)...)
+	}
+	if err := conn.flush(); err != nil {
+		return 0, 0, err
+	}
 
-// Envia um GET para o KeyValueStore
-func (g *Gossip) Get(key string) (string, *vectorclock.VectorClock, bool) {
-	return g.KeyValueStore.Get(key)
+	response, err := conn.receive()
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(response) != 3 || response[0] != "OK" {
+		return 0, 0, fmt.Errorf("replica %s answered %q", node.ID, formatMessage(response))
+	}
+	if _, err := fmt.Sscan(response[1]+" "+response[2], &applied, &stale); err != nil {
+		return 0, 0, fmt.Errorf("replica %s answered %q", node.ID, formatMessage(response))
+	}
+	return applied, stale, nil
 }
 
-// Envia um DELETE para o KeyValueStore (implementar no KeyValueStore, se ainda não estiver feito)
-func (g *Gossip) Delete(key string) {
-	// Adicione o método Delete no KeyValueStore para lidar com a remoção de chaves
-	// g.KeyValueStore.Delete(key)
-	log.Println("Delete operation is not yet implemented in KeyValueStore.")
+// Persiste os dados pendentes e fecha o armazenamento local
+func (g *Gossip) Close() error {
+	return g.KeyValueStore.Close()
 }
 
 // Imprime os nós ativos no cluster
@@ -281,11 +715,25 @@ func (g *Gossip) PrintNodes() {
 	g.Mutex.Lock()
 	defer g.Mutex.Unlock()
 
+	now := time.Now()
 	for id, node := range g.Nodes {
 		status := "alive"
-		if !node.Alive {
-			status = "dead"
+		switch {
+		case !node.Alive:
+			fmt.Printf("Node: %s, Address: %s, Status: dead\n", id, g.describeAddress(node.Address))
+			continue
+		case node.Suspect:
+			status = "suspect"
+		}
+		skew := "unknown"
+		if estimate, known := g.clockSkews.lookup(id); known {
+			skew = describeSkew(estimate.Skew)
 		}
-		log.Printf("Node: %s, Address: %s, Status: %s", id, node.Address, status)
+		fmt.Printf("Node: %s, Address: %s, Status: %s, Phi: %.2f, Circuit: %s, Clock: %s\n", id, g.describeAddress(node.Address), status, g.phiOf(node, now), g.breakers.state(id), skew)
+	}
+	if g.electing || g.Coordinator == nil {
+		fmt.Println("Coordinator: unknown (election in progress)")
+	} else {
+		fmt.Printf("Coordinator: %s\n", g.Coordinator.ID)
 	}
 }
@@ -0,0 +1,252 @@
+package store
+
+import (
+	"sort"
+	"time"
+)
+
+// Número de hints enviados por mensagem BATCH
+const hintBatchSize = 128
+
+// Maior lote aceito de um par
+const maxBatchSize = 1024
+
+// Tempo padrão que um nó com hints pendentes pode ficar fora do anel antes do redirecionamento
+const DefaultRerouteAfter = 10 * time.Minute
+
+// Processa hinted handoffs e tenta reenviar os dados para o nó original
+func (kv *KeyValueStore) processHintedHandoff() {
+	kv.rerouteOrphanedHints()
+
+	// Agrupa os hints em memória por nó de destino e libera o Mutex antes de contatar os nós
+	kv.Mutex.Lock()
+	pending := make(map[string][]*Hint)
+	for _, hint := range kv.HintedData {
+		if !kv.Gossip.IsNodeAlive(kv.Gossip.currentID(hint.TargetID)) {
+			replicationLog.Debug("Node still down, keeping hinted handoff", "op", "handoff", "peer", hint.TargetID, "key", logKey(hint.Key))
+			continue
+		}
+		pending[hint.TargetID] = append(pending[hint.TargetID], hint)
+	}
+	kv.Mutex.Unlock()
+
+	// Nós que só possuem hints gravados em disco
+	for _, targetID := range kv.hints.targets() {
+		if _, exists := pending[targetID]; !exists && kv.Gossip.IsNodeAlive(kv.Gossip.currentID(targetID)) {
+			pending[targetID] = nil
+		}
+	}
+
+	targets := make([]string, 0, len(pending))
+	for targetID := range pending {
+		targets = append(targets, targetID)
+	}
+
+	// Cada nó recebe seus hints em sequência; nós diferentes são atendidos em paralelo
+	runBounded(kv.Workers.HintWorkers, len(targets), func(i int) {
+		kv.handoff(targets[i], pending[targets[i]])
+	})
+
+	kv.Mutex.Lock()
+	if kv.hintStats.Capped && len(kv.HintedData) < kv.HintLimit {
+		kv.hintStats.Capped = false
+		replicationLog.Info("Hints in memory back under the limit", "limit", kv.HintLimit)
+	}
+	kv.Mutex.Unlock()
+}
+
+// Entrega a um nó que voltou os hints em memória e em disco destinados a ele (ou ao ID que ele
+// tinha antes de ser renomeado)
+func (kv *KeyValueStore) handoff(targetID string, inMemory []*Hint) {
+	target, known := kv.Gossip.GetNode(kv.Gossip.currentID(targetID))
+	if !known {
+		return
+	}
+
+	stored, err := kv.hints.take(targetID)
+	if err != nil {
+		replicationLog.Error("Failed to read hints from disk", "op", "handoff", "peer", targetID, "err", err)
+	}
+	hints := mergeHints(stored, inMemory)
+	delivered := kv.deliverHints(target, hints)
+
+	// Os hints só saem do disco depois que o nó confirmou a entrega
+	if err := kv.hints.finish(targetID, hints[:delivered]); err != nil {
+		replicationLog.Error("Failed to remove delivered hints from disk", "op", "handoff", "peer", targetID, "err", err)
+	}
+
+	// Remove os hints entregues, a menos que uma escrita mais nova os tenha substituído
+	kv.Mutex.Lock()
+	defer kv.Mutex.Unlock()
+	for _, hint := range hints[:delivered] {
+		id := hintKey(hint.Key, hint.TargetID)
+		if current, exists := kv.HintedData[id]; exists && clocksEqual(current.VectorClock, hint.VectorClock) {
+			delete(kv.HintedData, id)
+		}
+	}
+}
+
+// Redireciona os hints de nós que saíram do anel de vez (removidos, não apenas fora do ar) às
+// réplicas atuais das chaves, depois de RerouteAfter fora do anel
+func (kv *KeyValueStore) rerouteOrphanedHints() {
+	kv.Mutex.Lock()
+	targets := make(map[string]bool)
+	for _, hint := range kv.HintedData {
+		targets[hint.TargetID] = true
+	}
+	kv.Mutex.Unlock()
+	for _, targetID := range kv.hints.targets() {
+		targets[targetID] = true
+	}
+
+	var orphaned []string
+	kv.Mutex.Lock()
+	for targetID := range kv.orphanedSince {
+		if !targets[targetID] {
+			delete(kv.orphanedSince, targetID)
+		}
+	}
+	for targetID := range targets {
+		if _, known := kv.Gossip.GetNode(kv.Gossip.currentID(targetID)); known {
+			delete(kv.orphanedSince, targetID)
+			continue
+		}
+		since, seen := kv.orphanedSince[targetID]
+		if !seen {
+			kv.orphanedSince[targetID] = time.Now()
+			if kv.RerouteAfter > 0 {
+				replicationLog.Warn("Node has pending hints but left the ring; rerouting them if it does not return", "op", "handoff", "peer", targetID, "after", kv.RerouteAfter)
+			}
+			continue
+		}
+		if kv.RerouteAfter > 0 && time.Since(since) >= kv.RerouteAfter {
+			orphaned = append(orphaned, targetID)
+		}
+	}
+	kv.Mutex.Unlock()
+
+	for _, targetID := range orphaned {
+		kv.rerouteHints(targetID)
+	}
+}
+
+// Entrega os hints de um nó que saiu do anel às réplicas atuais de cada chave: a cópia local,
+// se este nó é réplica, ou um novo hint para cada uma das outras, entregue pelo handoff comum
+func (kv *KeyValueStore) rerouteHints(targetID string) {
+	stored, err := kv.hints.take(targetID)
+	if err != nil {
+		replicationLog.Error("Failed to read hints from disk", "op", "handoff", "peer", targetID, "err", err)
+		return
+	}
+	kv.Mutex.Lock()
+	var inMemory []*Hint
+	for _, hint := range kv.HintedData {
+		if hint.TargetID == targetID {
+			inMemory = append(inMemory, hint)
+		}
+	}
+	kv.Mutex.Unlock()
+
+	hints := mergeHints(stored, inMemory)
+	n := kv.replicationFactor()
+	rerouted := 0
+	for _, hint := range hints {
+		// Dados de um bucket removido ou truncado depois do hint não são redirecionados
+		if kv.Gossip.bucketCovers(hint.Key, hint.Timestamp) {
+			continue
+		}
+		for _, node := range kv.ConsistentHash.GetPreferenceList(hint.Key, n).Replicas {
+			if node.ID == kv.Gossip.Self.ID {
+				kv.ApplyReplica(hint.Key, hint.Value, hint.VectorClock, hint.Timestamp)
+				continue
+			}
+			kv.Mutex.Lock()
+			kv.storeHint(&Hint{Key: hint.Key, Value: hint.Value, VectorClock: hint.VectorClock, TargetID: node.ID, Timestamp: hint.Timestamp})
+			kv.Mutex.Unlock()
+		}
+		rerouted++
+	}
+
+	// Como na entrega, um hint substituído por uma escrita mais nova continua pendente
+	kv.Mutex.Lock()
+	for _, hint := range hints {
+		id := hintKey(hint.Key, targetID)
+		if current, exists := kv.HintedData[id]; exists && clocksEqual(current.VectorClock, hint.VectorClock) {
+			delete(kv.HintedData, id)
+		}
+	}
+	delete(kv.orphanedSince, targetID)
+	kv.Mutex.Unlock()
+	if err := kv.hints.finish(targetID, hints); err != nil {
+		replicationLog.Error("Failed to remove rerouted hints from disk", "op", "handoff", "peer", targetID, "err", err)
+	}
+	replicationLog.Info("Rerouted hints of a node that left the ring to the current replicas of their keys", "op", "handoff", "peer", targetID, "hints", rerouted)
+}
+
+// Junta os hints de um nó lidos do disco e da memória, na ordem das escritas originais. O disco
+// tem todos os hints; a memória tem a versão mais recente dos que couberam nela.
+func mergeHints(stored, inMemory []*Hint) []*Hint {
+	byKey := make(map[string]*Hint, len(stored)+len(inMemory))
+	for _, hint := range stored {
+		byKey[hint.Key] = hint
+	}
+	for _, hint := range inMemory {
+		byKey[hint.Key] = hint
+	}
+	hints := make([]*Hint, 0, len(byKey))
+	for _, hint := range byKey {
+		hints = append(hints, hint)
+	}
+	sortHints(hints)
+	return hints
+}
+
+// Envia os hints em lotes, na ordem dada, parando no primeiro lote que falhar.
+// Retorna quantos hints, a partir do início, foram entregues.
+func (kv *KeyValueStore) deliverHints(target *Node, hints []*Hint) int {
+	applied, stale := 0, 0
+	for start := 0; start < len(hints); start += hintBatchSize {
+		// Hints de chaves removidas por um drop ou truncate do bucket não são entregues
+		var batch []*Hint
+		for _, hint := range hints[start:min(start+hintBatchSize, len(hints))] {
+			if !kv.Gossip.bucketCovers(hint.Key, hint.Timestamp) {
+				batch = append(batch, hint)
+			}
+		}
+		if len(batch) == 0 {
+			continue
+		}
+		a, s, err := kv.Gossip.SendBatch(target, batch)
+		if err != nil {
+			replicationLog.Warn("Failed to deliver hinted handoffs", "op", "handoff", "peer", target.ID, "hints", len(hints)-start, "err", err)
+			return start
+		}
+		applied, stale = applied+a, stale+s
+	}
+
+	if len(hints) > 0 {
+		replicationLog.Info("Delivered hinted handoffs", "op", "handoff", "peer", target.ID, "hints", len(hints), "applied", applied, "stale", stale)
+	}
+	return len(hints)
+}
+
+// Ordena os hints pela ordem em que as escritas originais ocorreram: pelo horário do
+// coordenador e, em empates, pelo Vector Clock (uma versão anterior tem soma menor)
+func sortHints(hints []*Hint) {
+	sort.SliceStable(hints, func(i, j int) bool {
+		a, b := hints[i], hints[j]
+		if !a.Timestamp.Equal(b.Timestamp) {
+			return a.Timestamp.Before(b.Timestamp)
+		}
+		return clockWeight(a.VectorClock.Clock) < clockWeight(b.VectorClock.Clock)
+	})
+}
+
+// Soma dos contadores de um Vector Clock
+func clockWeight(clock map[string]int) int {
+	total := 0
+	for _, counter := range clock {
+		total += counter
+	}
+	return total
+}
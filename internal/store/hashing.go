@@ -4,15 +4,28 @@ import (
 	"crypto/sha1"
 	"fmt"
 	"log"
+	"slices"
 	"sort"
+	"sync"
 )
 
-// Definição da estrutura ConsistentHashing
+// Definição da estrutura ConsistentHashing. O anel é lido por toda escrita e leitura enquanto a
+// configuração do cluster e a entrada e saída de nós o alteram, por isso tem um lock próprio: os
+// métodos exportados o obtêm, e os terminados em Locked exigem que ele já esteja obtido.
 type ConsistentHashing struct {
 	VNodes       int                      // Número de nós virtuais (vNodes)
 	HashFunction func(data string) uint32 // Função de hash
 	SortedHashes []uint32                 // Lista de hashes ordenados
 	HashMap      map[uint32]*Node         // Mapa de hashes para os nós
+	Routing      *RoutingRule             // Parte da chave usada no hash (nil = chave inteira)
+
+	mutex       sync.RWMutex      // Protege os campos acima (exceto HashFunction), epoch e os primários
+	epoch       uint64            // Versão do anel, incrementada a cada mudança de tokens
+	cacheMutex  sync.Mutex        // Protege o cache de listas de preferência
+	cacheEpoch  uint64            // Versão do anel em que o cache foi montado
+	preferences map[int][][]*Node // Listas de preferência por N e por índice do token
+	primaries   map[uint32]string // Nó promovido a primário por token dos trechos (ver promote.go)
+	primaryOf   int               // Réplicas entre as quais o nó promovido precisa estar
 }
 
 // Função para criar um novo ConsistentHashing
@@ -35,45 +48,104 @@ func defaultHashFunction(data string) uint32 {
 
 // Adiciona um nó ao anel de Consistent Hashing
 func (ch *ConsistentHashing) AddNode(node *Node) {
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+	ch.addNodeWithTokensLocked(node, ch.generateTokensLocked(node.ID))
+}
+
+// Gera os tokens (posições no anel) dos vNodes de um nó
+func (ch *ConsistentHashing) GenerateTokens(nodeID string) []uint32 {
+	ch.mutex.RLock()
+	defer ch.mutex.RUnlock()
+	return ch.generateTokensLocked(nodeID)
+}
+
+func (ch *ConsistentHashing) generateTokensLocked(nodeID string) []uint32 {
+	tokens := make([]uint32, 0, ch.VNodes)
 	for i := 0; i < ch.VNodes; i++ {
-		vnodeKey := fmt.Sprintf("%s-%d", node.ID, i)
-		hash := ch.HashFunction(vnodeKey)
+		vnodeKey := fmt.Sprintf("%s-%d", nodeID, i)
+		tokens = append(tokens, ch.HashFunction(vnodeKey))
+	}
+	return tokens
+}
+
+// Adiciona um nó ao anel usando tokens já provisionados (ex.: pelo cluster init)
+func (ch *ConsistentHashing) AddNodeWithTokens(node *Node, tokens []uint32) {
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+	ch.addNodeWithTokensLocked(node, tokens)
+}
 
-		ch.SortedHashes = append(ch.SortedHashes, hash)
+func (ch *ConsistentHashing) addNodeWithTokensLocked(node *Node, tokens []uint32) {
+	for _, hash := range tokens {
+		if _, exists := ch.HashMap[hash]; !exists {
+			ch.SortedHashes = append(ch.SortedHashes, hash)
+		}
 		ch.HashMap[hash] = node
 	}
+	ch.epoch++
 
 	sort.Slice(ch.SortedHashes, func(i, j int) bool {
 		return ch.SortedHashes[i] < ch.SortedHashes[j]
 	})
 }
 
+// Retorna os tokens atualmente atribuídos a um nó
+func (ch *ConsistentHashing) Tokens(nodeID string) []uint32 {
+	ch.mutex.RLock()
+	defer ch.mutex.RUnlock()
+	return ch.tokensLocked(nodeID)
+}
+
+func (ch *ConsistentHashing) tokensLocked(nodeID string) []uint32 {
+	var tokens []uint32
+	for _, hash := range ch.SortedHashes {
+		if ch.HashMap[hash].ID == nodeID {
+			tokens = append(tokens, hash)
+		}
+	}
+	return tokens
+}
+
 // Remove um nó do anel de Consistent Hashing
 func (ch *ConsistentHashing) RemoveNode(nodeID string) {
-	for i := 0; i < ch.VNodes; i++ {
-		vnodeKey := fmt.Sprintf("%s-%d", nodeID, i)
-		hash := ch.HashFunction(vnodeKey)
-
-		delete(ch.HashMap, hash)
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+	ch.removeNodeLocked(nodeID)
+}
 
-		// Remover o hash da lista de hashes ordenados
-		for idx, h := range ch.SortedHashes {
-			if h == hash {
-				ch.SortedHashes = append(ch.SortedHashes[:idx], ch.SortedHashes[idx+1:]...)
-				break
-			}
+func (ch *ConsistentHashing) removeNodeLocked(nodeID string) {
+	// Remove pelos tokens atribuídos, já que eles podem ter sido provisionados externamente
+	remaining := ch.SortedHashes[:0]
+	for _, hash := range ch.SortedHashes {
+		if ch.HashMap[hash].ID == nodeID {
+			delete(ch.HashMap, hash)
+			continue
 		}
+		remaining = append(remaining, hash)
 	}
+	ch.SortedHashes = remaining
+	ch.epoch++
+}
+
+// Retorna a versão do anel, que muda sempre que tokens são adicionados ou removidos
+func (ch *ConsistentHashing) Epoch() uint64 {
+	ch.mutex.RLock()
+	defer ch.mutex.RUnlock()
+	return ch.epoch
 }
 
 // Retorna o nó apropriado para uma chave, baseado no Consistent Hashing
 func (ch *ConsistentHashing) GetNode(key string) *Node {
+	ch.mutex.RLock()
+	defer ch.mutex.RUnlock()
+
 	if len(ch.SortedHashes) == 0 {
 		log.Panicln("No nodes available in the Consistent Hashing ring.")
 		return nil
 	}
 
-	hash := ch.HashFunction(key)
+	hash := ch.hashKeyLocked(key)
 	idx := sort.Search(len(ch.SortedHashes), func(i int) bool {
 		return ch.SortedHashes[i] >= hash
 	})
@@ -85,3 +157,170 @@ func (ch *ConsistentHashing) GetNode(key string) *Node {
 
 	return ch.HashMap[ch.SortedHashes[idx]]
 }
+
+// Retorna o token do vNode dono da chave, com a posição e o token lidos da mesma versão do anel
+func (ch *ConsistentHashing) KeyToken(key string) uint32 {
+	ch.mutex.RLock()
+	defer ch.mutex.RUnlock()
+	return ch.tokenForLocked(ch.hashKeyLocked(key))
+}
+
+// Retorna o token do vNode dono de uma posição do anel (o primeiro token a partir dela)
+func (ch *ConsistentHashing) TokenFor(hash uint32) uint32 {
+	ch.mutex.RLock()
+	defer ch.mutex.RUnlock()
+	return ch.tokenForLocked(hash)
+}
+
+func (ch *ConsistentHashing) tokenForLocked(hash uint32) uint32 {
+	if len(ch.SortedHashes) == 0 {
+		return 0
+	}
+	idx := sort.Search(len(ch.SortedHashes), func(i int) bool {
+		return ch.SortedHashes[i] >= hash
+	})
+	return ch.SortedHashes[idx%len(ch.SortedHashes)]
+}
+
+// Retorna até n nós físicos distintos responsáveis pela chave, seguindo o anel a partir da posição dela
+func (ch *ConsistentHashing) GetReplicaNodes(key string, n int) []*Node {
+	return ch.GetPreferenceList(key, n).Replicas
+}
+
+// PreferenceList é a lista de preferência de uma chave: as N réplicas e, em seguida, os demais
+// nós físicos na ordem do anel, reservas que podem guardar a cópia de uma réplica fora (sloppy quorum)
+type PreferenceList struct {
+	Replicas []*Node // Os primeiros N nós físicos distintos a partir da posição da chave
+	Standby  []*Node // Os nós físicos seguintes, na ordem do anel
+}
+
+// Monta a lista de preferência da chave percorrendo o anel a partir da posição dela e pulando
+// os vNodes de nós físicos já incluídos; um nó promovido a primário do trecho vem primeiro. Os
+// slices são compartilhados e não devem ser alterados.
+func (ch *ConsistentHashing) GetPreferenceList(key string, n int) PreferenceList {
+	ch.mutex.RLock()
+	defer ch.mutex.RUnlock()
+
+	hash := ch.hashKeyLocked(key)
+	// Com n igual ao número de tokens, a caminhada chega a todos os nós físicos
+	nodes := ch.replicaNodesForHashLocked(hash, len(ch.SortedHashes))
+	if id, promoted := ch.primaries[ch.tokenForLocked(hash)]; promoted {
+		nodes = ch.promote(nodes, id)
+	}
+	n = max(0, min(n, len(nodes)))
+	return PreferenceList{Replicas: nodes[:n:n], Standby: nodes[n:]}
+}
+
+// Leva o nó promovido ao início da lista, se ele estiver entre as réplicas do trecho; a lista
+// reordenada é uma cópia
+func (ch *ConsistentHashing) promote(nodes []*Node, id string) []*Node {
+	i := slices.IndexFunc(nodes, func(node *Node) bool { return node.ID == id })
+	if i <= 0 || i >= ch.primaryOf {
+		return nodes
+	}
+	reordered := make([]*Node, 0, len(nodes))
+	reordered = append(reordered, nodes[i])
+	reordered = append(reordered, nodes[:i]...)
+	return append(reordered, nodes[i+1:]...)
+}
+
+// Define os primários promovidos por token, válidos enquanto o nó estiver entre as n réplicas
+// do trecho, e muda a versão do anel
+func (ch *ConsistentHashing) SetPrimaries(primaries map[uint32]string, n int) {
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+	ch.setPrimariesLocked(primaries, n)
+}
+
+func (ch *ConsistentHashing) setPrimariesLocked(primaries map[uint32]string, n int) {
+	ch.primaries, ch.primaryOf = primaries, n
+	ch.epoch++
+}
+
+// Retorna até n nós físicos distintos responsáveis por uma posição do anel. Todas as posições
+// de um mesmo trecho têm a mesma lista, que fica em cache até o anel mudar; o slice
+// retornado é compartilhado e não deve ser alterado.
+func (ch *ConsistentHashing) ReplicaNodesForHash(hash uint32, n int) []*Node {
+	ch.mutex.RLock()
+	defer ch.mutex.RUnlock()
+	return ch.replicaNodesForHashLocked(hash, n)
+}
+
+func (ch *ConsistentHashing) replicaNodesForHashLocked(hash uint32, n int) []*Node {
+	if len(ch.SortedHashes) == 0 || n <= 0 {
+		return nil
+	}
+
+	start := sort.Search(len(ch.SortedHashes), func(i int) bool {
+		return ch.SortedHashes[i] >= hash
+	}) % len(ch.SortedHashes)
+
+	ch.cacheMutex.Lock()
+	defer ch.cacheMutex.Unlock()
+
+	if ch.preferences == nil || ch.cacheEpoch != ch.epoch {
+		ch.preferences = make(map[int][][]*Node)
+		ch.cacheEpoch = ch.epoch
+	}
+	lists := ch.preferences[n]
+	if lists == nil {
+		lists = make([][]*Node, len(ch.SortedHashes))
+		ch.preferences[n] = lists
+	}
+	if lists[start] == nil {
+		lists[start] = ch.walkReplicaNodes(start, n)
+	}
+	return lists[start]
+}
+
+// Percorre o anel a partir do token de índice start, descartando nós físicos repetidos
+func (ch *ConsistentHashing) walkReplicaNodes(start, n int) []*Node {
+	var nodes []*Node
+	seen := make(map[string]bool)
+	for i := 0; i < len(ch.SortedHashes) && len(nodes) < n; i++ {
+		node := ch.HashMap[ch.SortedHashes[(start+i)%len(ch.SortedHashes)]]
+		if seen[node.ID] {
+			continue
+		}
+		seen[node.ID] = true
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+// TokenRange é um trecho do anel (Start, End], pertencente ao vNode com token End
+type TokenRange struct {
+	Start uint32 `json:"start"`
+	End   uint32 `json:"end"`
+}
+
+// Indica se uma posição do anel pertence ao trecho, considerando a volta do anel
+func (r TokenRange) Contains(hash uint32) bool {
+	switch {
+	case r.Start < r.End:
+		return hash > r.Start && hash <= r.End
+	case r.Start > r.End:
+		return hash > r.Start || hash <= r.End
+	}
+	return true // Um único token cobre o anel inteiro
+}
+
+func (r TokenRange) String() string {
+	return fmt.Sprintf("(%d, %d]", r.Start, r.End)
+}
+
+// Retorna os trechos do anel, um por token, em ordem
+func (ch *ConsistentHashing) Ranges() []TokenRange {
+	ch.mutex.RLock()
+	defer ch.mutex.RUnlock()
+	return ch.rangesLocked()
+}
+
+func (ch *ConsistentHashing) rangesLocked() []TokenRange {
+	ranges := make([]TokenRange, 0, len(ch.SortedHashes))
+	for i, hash := range ch.SortedHashes {
+		prev := ch.SortedHashes[(i+len(ch.SortedHashes)-1)%len(ch.SortedHashes)]
+		ranges = append(ranges, TokenRange{Start: prev, End: hash})
+	}
+	return ranges
+}
@@ -0,0 +1,63 @@
+package store
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bquerino/kv-g/internal/vectorclock"
+)
+
+// Abre um Gossip com o store num diretório temporário, sem iniciar as rotinas de fundo
+func newTestGossip(t *testing.T, id string) *Gossip {
+	t.Helper()
+	g := NewGossip(id, "localhost:0", time.Second, 8, t.TempDir())
+	t.Cleanup(func() { g.KeyValueStore.Close() })
+	return g
+}
+
+// Aplicar a configuração do cluster remove e reinsere os tokens do próprio nó; leituras
+// concorrentes do anel (como a do log de réplicas durante a entrada no cluster) não podem ver
+// o anel sem o nó. Rodar com -race.
+func TestApplyClusterConfigKeepsSelfInRing(t *testing.T) {
+	g := newTestGossip(t, "node1")
+	config := &ClusterConfig{
+		Name:   "teste",
+		VNodes: 8,
+		N:      2, R: 1, W: 1,
+		Nodes: []NodeConfig{
+			{ID: "node1", Index: 1, Address: "localhost:0", Tokens: g.ConsistentHash.GenerateTokens("node1")},
+			{ID: "node2", Index: 2, Address: "localhost:1", Tokens: g.ConsistentHash.GenerateTokens("node2")},
+		},
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer close(stop)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				g.ApplyClusterConfig(config)
+			}
+		}
+	}()
+
+	for i := 0; i < 2000; i++ {
+		key := string(rune('a' + i%26))
+		g.KeyValueStore.Mutex.Lock()
+		g.KeyValueStore.logApplied(key, "v", vectorclock.NewVectorClock())
+		g.KeyValueStore.Mutex.Unlock()
+		if len(g.ConsistentHash.Tokens("node1")) == 0 {
+			t.Fatal("node1 is missing from the ring while the cluster config is applied")
+		}
+		if list := g.ConsistentHash.GetPreferenceList(key, 2); len(list.Replicas) == 0 {
+			t.Fatalf("empty preference list for %q", key)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package store
+
+import (
+	"fmt"
+)
+
+// HealthStatus é o veredito consolidado da saúde do cluster
+type HealthStatus string
+
+const (
+	HealthOK       HealthStatus = "OK"
+	HealthDegraded HealthStatus = "DEGRADED" // O cluster atende, mas com redundância reduzida
+	HealthCritical HealthStatus = "CRITICAL" // Parte das chaves não atinge quórum de escrita ou o disco está cheio
+)
+
+// Limites de uso do disco que degradam a saúde do nó
+const (
+	diskDegradedUsage = 0.90
+	diskCriticalUsage = 0.97
+)
+
+// RangeHealth descreve a disponibilidade de quórum de um trecho do anel
+type RangeHealth struct {
+	Range TokenRange
+	Alive int // Réplicas vivas do trecho
+	Read  bool
+	Write bool
+}
+
+// HealthReport agrega os sinais de saúde vistos por este nó
+type HealthReport struct {
+	Status          HealthStatus
+	NodesDown       []string
+	Ranges          int
+	NoReadQuorum    []RangeHealth
+	NoWriteQuorum   []RangeHealth
+	UnderReplicated int // Trechos com menos de N réplicas vivas
+	HintBacklog     int
+	Hints           HintStats
+	NeedRepair      []TokenRange // Trechos com hints pendentes ou rebalanceamento inacabado
+	Disk            *DiskUsage   // nil quando o uso do disco não pôde ser obtido
+	Storage         LSMStats
+	HandlerPanics   int64 // Mensagens de outros nós cujo tratamento entrou em pânico desde o início
+	Issues          []string
+}
+
+// Registra um problema e eleva o veredito, sem nunca rebaixá-lo
+func (r *HealthReport) raise(status HealthStatus, format string, args ...any) {
+	r.Issues = append(r.Issues, fmt.Sprintf(format, args...))
+	if r.Status == HealthCritical || status == HealthOK {
+		return
+	}
+	r.Status = status
+}
+
+// Calcula a saúde do cluster do ponto de vista deste nó
+func (g *Gossip) Health() *HealthReport {
+	report := &HealthReport{Status: HealthOK}
+	kv := g.KeyValueStore
+
+	n, r, w := kv.replicationFactor(), kv.readQuorum(), kv.writeQuorum()
+
+	g.Mutex.Lock()
+	for id, node := range g.Nodes {
+		if !node.Alive {
+			report.NodesDown = append(report.NodesDown, id)
+		}
+	}
+	ranges := g.ConsistentHash.Ranges()
+	replicas := make([][]*Node, len(ranges))
+	for i, tr := range ranges {
+		replicas[i] = g.ConsistentHash.ReplicaNodesForHash(tr.End, n)
+	}
+	alive := func(node *Node) bool { return node.ID == g.Self.ID || node.Alive }
+	for i, tr := range ranges {
+		health := RangeHealth{Range: tr}
+		for _, node := range replicas[i] {
+			if alive(node) {
+				health.Alive++
+			}
+		}
+		health.Read, health.Write = health.Alive >= r, health.Alive >= w
+		if !health.Read {
+			report.NoReadQuorum = append(report.NoReadQuorum, health)
+		}
+		if !health.Write {
+			report.NoWriteQuorum = append(report.NoWriteQuorum, health)
+		}
+		if health.Alive < n {
+			report.UnderReplicated++
+		}
+	}
+	g.Mutex.Unlock()
+	report.Ranges = len(ranges)
+
+	if len(report.NodesDown) > 0 {
+		report.raise(HealthDegraded, "%d node(s) down: %v", len(report.NodesDown), report.NodesDown)
+	}
+	if len(report.NoWriteQuorum) > 0 {
+		report.raise(HealthCritical, "%d of %d ranges cannot reach write quorum (W=%d)", len(report.NoWriteQuorum), len(ranges), w)
+	}
+	if len(report.NoReadQuorum) > 0 {
+		report.raise(HealthCritical, "%d of %d ranges cannot reach read quorum (R=%d)", len(report.NoReadQuorum), len(ranges), r)
+	}
+	if report.UnderReplicated > 0 {
+		report.raise(HealthDegraded, "%d of %d ranges have fewer than %d live replicas", report.UnderReplicated, len(ranges), n)
+	}
+
+	if skewed := g.skewedPeers(); len(skewed) > 0 {
+		report.raise(HealthDegraded, "clock of %d node(s) more than %s off: %v", len(skewed), g.MaxClockSkew, skewed)
+	}
+
+	report.Hints = kv.HintStats()
+	report.HintBacklog = max(report.Hints.InMemory, report.Hints.OnDisk)
+	if report.HintBacklog > 0 {
+		report.raise(HealthDegraded, "%d hint(s) waiting for delivery", report.HintBacklog)
+	}
+	if report.Hints.Capped {
+		report.raise(HealthDegraded, "in-memory hint limit of %d reached, %d hint(s) kept only on disk", report.Hints.Limit, report.Hints.OnDisk-report.Hints.InMemory)
+	}
+
+	report.NeedRepair = kv.rangesNeedingRepair(ranges)
+	if len(report.NeedRepair) > 0 {
+		report.raise(HealthDegraded, "%d range(s) need repair", len(report.NeedRepair))
+	}
+
+	report.HandlerPanics = g.panics.Load()
+	if report.HandlerPanics > 0 {
+		report.raise(HealthDegraded, "%d peer message(s) panicked while being handled (see the logs)", report.HandlerPanics)
+	}
+
+	report.Storage = kv.LSM.Stats()
+	usage, err := diskUsage(kv.DataDir)
+	if err != nil {
+		storageLog.Warn("Failed to read disk usage", "dir", kv.DataDir, "err", err)
+	} else {
+		report.Disk = usage
+		switch used := usage.UsedFraction(); {
+		case used >= diskCriticalUsage:
+			report.raise(HealthCritical, "disk %.1f%% full", used*100)
+		case used >= diskDegradedUsage:
+			report.raise(HealthDegraded, "disk %.1f%% full", used*100)
+		}
+	}
+
+	return report
+}
+
+// Retorna os trechos que possuem hints pendentes ou uma tarefa de rebalanceamento inacabada
+func (kv *KeyValueStore) rangesNeedingRepair(ranges []TokenRange) []TokenRange {
+	pending := make(map[TokenRange]bool)
+
+	kv.Mutex.Lock()
+	for _, hint := range kv.HintedData {
+		hash := kv.ConsistentHash.HashKey(hint.Key)
+		for _, tr := range ranges {
+			if tr.Contains(hash) {
+				pending[tr] = true
+				break
+			}
+		}
+	}
+	kv.Mutex.Unlock()
+
+	if plan, err := kv.RebalanceStatus(); err == nil && plan != nil {
+		for _, task := range plan.Tasks {
+			if !task.Done {
+				pending[task.Range] = true
+			}
+		}
+	}
+
+	var result []TokenRange
+	for _, tr := range ranges {
+		if pending[tr] {
+			result = append(result, tr)
+			delete(pending, tr)
+		}
+	}
+	// Trechos de um plano antigo que não existem mais no anel atual
+	for tr := range pending {
+		result = append(result, tr)
+	}
+	return result
+}
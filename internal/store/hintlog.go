@@ -0,0 +1,464 @@
+package store
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Diretório, dentro do diretório de dados, onde ficam os hints
+const hintDir = "hints"
+
+// Número padrão de hints mantidos em memória; os demais ficam somente em disco
+const DefaultHintLimit = 10000
+
+const (
+	hintPagesExt      = ".pages"      // Arquivo de páginas com os hints de um nó de destino
+	hintLogExt        = ".log"        // Formato anterior (um hint JSON por linha), importado na abertura
+	hintDeliveringExt = ".delivering" // Hints do formato anterior retirados do log para entrega
+)
+
+// hintLog grava todos os hints em disco, num arquivo de páginas (PageManager) por nó de destino,
+// para que uma queda do nó não perca as escritas ainda não entregues. Cada hint é uma célula de
+// uma slotted page, com a chave e o valor "<timestamp> <vc> <valor>", e várias cabem numa página;
+// o índice do PageManager aponta para o hint mais recente de cada chave. Um hint só é removido,
+// com a célula marcada como removida na própria página, depois que o nó de destino confirma a
+// entrega, e o arquivo é apagado quando não resta hint pendente.
+type hintLog struct {
+	dir    string
+	mutex  sync.Mutex
+	stores map[string]*PageManager // Arquivo de páginas de cada nó de destino
+	counts map[string]int          // Hints pendentes por nó de destino
+	nodes  *nodeTable              // Índices dos nós usados para gravar os Vector Clocks
+}
+
+// Formato de um hint no log em disco do formato anterior, com o Vector Clock codificado pelos índices dos nós
+type hintRecord struct {
+	Key       string    `json:"key"`
+	Value     string    `json:"value"`
+	Clock     string    `json:"clock"`
+	TargetID  string    `json:"target"`
+	Timestamp time.Time `json:"time"`
+}
+
+// Abre o log de hints, contando os hints que ficaram em disco de execuções anteriores e
+// importando os arquivos do formato anterior
+func openHintLog(dir string, nodes *nodeTable) (*hintLog, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &hintLog{dir: dir, stores: make(map[string]*PageManager), counts: make(map[string]int), nodes: nodes}
+	var legacy []string
+	for _, entry := range entries {
+		name := entry.Name()
+		ext := filepath.Ext(name)
+		target, err := url.QueryUnescape(strings.TrimSuffix(name, ext))
+		if err != nil {
+			continue
+		}
+		switch ext {
+		case hintPagesExt:
+			if _, err := l.store(target); err != nil {
+				l.close()
+				return nil, err
+			}
+		case hintLogExt, hintDeliveringExt:
+			legacy = append(legacy, name)
+		}
+	}
+
+	for _, name := range legacy {
+		path := filepath.Join(dir, name)
+		hints, err := l.readFile(path)
+		if err != nil {
+			l.close()
+			return nil, err
+		}
+		for _, hint := range hints {
+			if err := l.append(hint.TargetID, hint); err != nil {
+				l.close()
+				return nil, err
+			}
+		}
+		if err := os.Remove(path); err != nil {
+			l.close()
+			return nil, err
+		}
+		replicationLog.Info("Imported hints", "hints", len(hints), "path", path)
+	}
+	return l, nil
+}
+
+// Caminho do arquivo de hints de um nó (o ID é escapado por conter ":" quando é um endereço)
+func (l *hintLog) path(target, ext string) string {
+	return filepath.Join(l.dir, url.QueryEscape(target)+ext)
+}
+
+// Retorna o arquivo de páginas de um nó, abrindo-o (ou criando-o) na primeira vez.
+// Deve ser chamada com o mutex obtido ou durante a abertura do log.
+func (l *hintLog) store(target string) (*PageManager, error) {
+	if pm, exists := l.stores[target]; exists {
+		return pm, nil
+	}
+	pm, err := NewPageManager(l.path(target, hintPagesExt))
+	if err != nil {
+		return nil, err
+	}
+	l.stores[target] = pm
+	for _, key := range pm.Keys() {
+		if record, ok := pm.Lookup(key); ok && record.Length > 0 {
+			l.counts[target]++
+		}
+	}
+	return pm, nil
+}
+
+// Codifica o timestamp, o Vector Clock e o valor de um hint no valor da página
+func (l *hintLog) encode(hint *Hint) string {
+	return fmt.Sprintf("%d %s %s", hint.Timestamp.UnixNano(), l.nodes.encodeClock(hint.VectorClock), hint.Value)
+}
+
+// Chave do hint no arquivo de páginas. Uma chave com espaços passaria por um pedaço de valor
+// grande (ver chunks.go), então é escapada e marcada por um tab no início; as demais ficam
+// iguais, como nos arquivos gravados por versões anteriores.
+func hintPageKey(key string) string {
+	if strings.IndexFunc(key, unicode.IsSpace) < 0 {
+		return key
+	}
+	return "\t" + url.PathEscape(key)
+}
+
+// Chave original de uma chave do arquivo de páginas gravada por hintPageKey
+func hintKeyOf(pageKey string) string {
+	if escaped, found := strings.CutPrefix(pageKey, "\t"); found {
+		if key, err := url.PathUnescape(escaped); err == nil {
+			return key
+		}
+	}
+	return pageKey
+}
+
+// Decodifica o valor de uma página gravado por encode
+func (l *hintLog) decode(target, key, data string) (*Hint, error) {
+	fields := strings.SplitN(data, " ", 3)
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("malformed hint for key %s", key)
+	}
+	timestamp, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("malformed hint for key %s: %w", key, err)
+	}
+	clock, err := l.nodes.decodeClock(fields[1])
+	if err != nil {
+		return nil, err
+	}
+	return &Hint{
+		Key:         key,
+		Value:       fields[2],
+		VectorClock: clock,
+		TargetID:    target,
+		Timestamp:   time.Unix(0, timestamp),
+	}, nil
+}
+
+// Grava hints no arquivo do nó de destino e sincroniza o arquivo; um hint substitui o
+// anterior da mesma chave
+func (l *hintLog) append(target string, hints ...*Hint) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if len(hints) == 0 {
+		return nil
+	}
+	pm, err := l.store(target)
+	if err != nil {
+		return err
+	}
+
+	for _, hint := range hints {
+		record, pending := pm.Lookup(hintPageKey(hint.Key))
+		if err := pm.Put(hintPageKey(hint.Key), l.encode(hint)); err != nil {
+			return err
+		}
+		if !pending || record.Length == 0 {
+			l.counts[target]++
+		}
+	}
+	return pm.Sync()
+}
+
+// Lê os hints pendentes de um nó para entrega. Eles só saem do disco em finish, de modo que
+// uma queda durante a entrega apenas faz com que sejam reenviados.
+func (l *hintLog) take(target string) ([]*Hint, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	pm, exists := l.stores[target]
+	if !exists {
+		return nil, nil
+	}
+
+	var hints []*Hint
+	for _, key := range pm.Keys() {
+		data, err := pm.ReadValue(key)
+		if errors.Is(err, errNotOnDisk) {
+			continue
+		}
+		if errors.Is(err, ErrChecksumMismatch) {
+			// A réplica recebe a versão perdida pelo read repair, e a página vai para a quarentena
+			// na próxima compactação do arquivo
+			replicationLog.Error("Dropping corrupt hint", "peer", target, "key", logKey(hintKeyOf(key)), "err", err)
+			if pm.forget(key) {
+				l.counts[target]--
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		hint, err := l.decode(target, hintKeyOf(key), data)
+		if err != nil {
+			replicationLog.Warn("Skipping hint", "peer", target, "err", err)
+			continue
+		}
+		hints = append(hints, hint)
+	}
+	return hints, nil
+}
+
+// Retorna os hints pendentes da chave, um por nó de destino
+func (l *hintLog) lookup(key string) ([]*Hint, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	var hints []*Hint
+	for target, pm := range l.stores {
+		if _, pending := pm.Lookup(hintPageKey(key)); !pending {
+			continue
+		}
+		data, err := pm.ReadValue(hintPageKey(key))
+		if errors.Is(err, errNotOnDisk) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		hint, err := l.decode(target, key, data)
+		if err != nil {
+			return nil, err
+		}
+		hints = append(hints, hint)
+	}
+	return hints, nil
+}
+
+// Remove do disco os hints entregues a um nó, a menos que um hint mais novo da mesma chave
+// tenha sido gravado depois da leitura. Sem hints pendentes, o arquivo do nó é apagado.
+func (l *hintLog) finish(target string, delivered []*Hint) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	pm, exists := l.stores[target]
+	if !exists {
+		return nil
+	}
+
+	for _, hint := range delivered {
+		data, err := pm.ReadValue(hintPageKey(hint.Key))
+		if errors.Is(err, errNotOnDisk) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if current, err := l.decode(target, hint.Key, data); err == nil && !clocksEqual(current.VectorClock, hint.VectorClock) {
+			continue
+		}
+		if err := pm.Delete(hintPageKey(hint.Key)); err != nil {
+			return err
+		}
+		l.counts[target]--
+	}
+
+	if l.counts[target] > 0 {
+		if pm.needsCompaction() {
+			before, after, err := pm.Compact()
+			if err != nil {
+				replicationLog.Warn("Failed to compact hints", "peer", target, "err", err)
+			} else {
+				replicationLog.Info("Compacted hints", "peer", target, "pages_before", before, "pages_after", after)
+			}
+		}
+		return pm.Sync()
+	}
+	delete(l.counts, target)
+	delete(l.stores, target)
+	pm.Mutex.Lock()
+	pm.File.Close()
+	pm.Mutex.Unlock()
+	for _, path := range []string{pm.Path, pm.indexPath()} {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Retorna os nós que possuem hints em disco
+func (l *hintLog) targets() []string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	targets := make([]string, 0, len(l.counts))
+	for target := range l.counts {
+		targets = append(targets, target)
+	}
+	return targets
+}
+
+// Retorna o número de hints em disco
+func (l *hintLog) Len() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	total := 0
+	for _, count := range l.counts {
+		total += count
+	}
+	return total
+}
+
+// Grava os índices e fecha os arquivos de hints
+func (l *hintLog) close() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for target, pm := range l.stores {
+		if err := pm.Close(); err != nil {
+			replicationLog.Error("Error closing hints", "peer", target, "err", err)
+		}
+	}
+	l.stores = make(map[string]*PageManager)
+}
+
+// Lê um arquivo de hints do formato anterior, um hint JSON por linha
+func (l *hintLog) readFile(path string) ([]*Hint, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var hints []*Hint
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var record hintRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			// Uma linha truncada por uma queda no meio da gravação não invalida o restante
+			replicationLog.Warn("Skipping corrupt hint", "path", path, "line", line, "err", err)
+			continue
+		}
+		clock, err := l.nodes.decodeClock(record.Clock)
+		if err != nil {
+			replicationLog.Warn("Skipping hint", "path", path, "line", line, "err", err)
+			continue
+		}
+		hints = append(hints, &Hint{
+			Key:         record.Key,
+			Value:       record.Value,
+			VectorClock: clock,
+			TargetID:    record.TargetID,
+			Timestamp:   record.Timestamp,
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading hints from %s: %w", path, err)
+	}
+	return hints, nil
+}
+
+// HintStats resume o armazenamento de hints do nó
+type HintStats struct {
+	InMemory int // Hints guardados em memória
+	OnDisk   int // Hints gravados em disco aguardando entrega (todos, inclusive os que estão em memória)
+	Limit    int // Limite de hints em memória
+	Spilled  int // Total de hints mantidos somente em disco por exceder o limite
+	CapHits  int // Quantas vezes o limite de memória foi atingido
+	Capped   bool
+}
+
+// Grava um hint no log em disco e o guarda também em memória, se o limite permitir; acima do
+// limite, o hint fica somente em disco. Deve ser chamada com o Mutex obtido.
+func (kv *KeyValueStore) storeHint(hint *Hint) {
+	persisted := true
+	if err := kv.hints.append(hint.TargetID, hint); err != nil {
+		replicationLog.Error("Failed to persist hint, keeping it only in memory", "key", logKey(hint.Key), "peer", hint.TargetID, "err", err)
+		persisted = false
+	}
+
+	id := hintKey(hint.Key, hint.TargetID)
+	if _, replaces := kv.HintedData[id]; replaces || !persisted || kv.HintLimit <= 0 || len(kv.HintedData) < kv.HintLimit {
+		kv.HintedData[id] = hint
+		return
+	}
+
+	if !kv.hintStats.Capped {
+		kv.hintStats.Capped = true
+		kv.hintStats.CapHits++
+		replicationLog.Warn("In-memory hint limit reached, keeping new hints only on disk", "limit", kv.HintLimit, "dir", kv.hints.dir)
+	}
+	kv.hintStats.Spilled++
+}
+
+// Carrega em memória, até o limite, os hints que ficaram em disco de execuções anteriores
+func (kv *KeyValueStore) ReplayHints() {
+	kv.Mutex.Lock()
+	defer kv.Mutex.Unlock()
+
+	loaded, targets := 0, kv.hints.targets()
+	for _, targetID := range targets {
+		hints, err := kv.hints.take(targetID)
+		if err != nil {
+			replicationLog.Error("Failed to read hints", "peer", targetID, "err", err)
+			continue
+		}
+		for _, hint := range hints {
+			if kv.HintLimit > 0 && len(kv.HintedData) >= kv.HintLimit {
+				break
+			}
+			kv.HintedData[hintKey(hint.Key, hint.TargetID)] = hint
+			loaded++
+		}
+	}
+	if len(targets) > 0 {
+		replicationLog.Info("Replayed hints from disk", "loaded", loaded, "hints", kv.hints.Len(), "nodes", len(targets))
+	}
+}
+
+// Retorna as estatísticas do armazenamento de hints
+func (kv *KeyValueStore) HintStats() HintStats {
+	kv.Mutex.Lock()
+	stats := kv.hintStats
+	stats.InMemory = len(kv.HintedData)
+	stats.Limit = kv.HintLimit
+	kv.Mutex.Unlock()
+
+	stats.OnDisk = kv.hints.Len()
+	return stats
+}
@@ -0,0 +1,470 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bquerino/kv-g/internal/vectorclock"
+)
+
+// Cenários de cluster num único processo: os nós conversam por uma MemoryNetwork com os mesmos
+// handlers e o mesmo protocolo de um cluster real. Os loops em segundo plano (gossip, push-pull,
+// hinted handoff) não são iniciados: cada teste dispara as etapas na ordem que quer verificar,
+// o que torna os cenários determinísticos.
+
+// testCluster é um cluster de nós ligados por uma MemoryNetwork
+type testCluster struct {
+	t       *testing.T
+	network *MemoryNetwork
+	config  *ClusterConfig
+	dir     string
+	nodes   map[string]*testNode
+}
+
+// testNode é um nó do cluster de teste; um nó parado mantém o diretório de dados
+type testNode struct {
+	id      string
+	address string
+	gossip  *Gossip
+	cancel  context.CancelFunc
+	served  chan struct{} // Fechado quando o GossipIn retorna
+}
+
+// Cria a configuração de um cluster com os nós informados (N=3, R=2, W=2), sem iniciá-los
+func newTestCluster(t *testing.T, ids ...string) *testCluster {
+	t.Helper()
+	config := &ClusterConfig{Name: "teste", Token: "segredo", N: 3, R: 2, W: 2, VNodes: 16}
+	ring := NewConsistentHashing(16)
+	for i, id := range ids {
+		config.Nodes = append(config.Nodes, NodeConfig{
+			ID:      id,
+			Index:   i + 1,
+			Address: id + ":7000",
+			Tokens:  ring.GenerateTokens(id),
+		})
+	}
+	c := &testCluster{t: t, network: NewMemoryNetwork(), config: config, dir: t.TempDir(), nodes: make(map[string]*testNode)}
+	t.Cleanup(func() {
+		for id := range c.nodes {
+			c.stop(id)
+		}
+	})
+	return c
+}
+
+// Inicia (ou reinicia, com os dados que ficaram no diretório) um nó da configuração
+func (c *testCluster) start(id string) *Gossip {
+	c.t.Helper()
+	node := c.launch(id)
+	node.gossip.ApplyClusterConfig(c.config)
+	node.gossip.KeyValueStore.ReplayHints()
+	if err := node.gossip.KeyValueStore.ReplayCommitLog(); err != nil {
+		c.t.Fatalf("%s: replay commit log: %v", id, err)
+	}
+	c.serve(node)
+	return node.gossip
+}
+
+// Abre o nó sem configuração e sem servir conexões
+func (c *testCluster) launch(id string) *testNode {
+	c.t.Helper()
+	if _, running := c.nodes[id]; running {
+		c.t.Fatalf("%s is already running", id)
+	}
+	address := id + ":7000"
+	g := NewGossip(id, address, time.Second, 16, filepath.Join(c.dir, id))
+	if g.KeyValueStore == nil {
+		c.t.Fatalf("%s: NewGossip did not open the store", id)
+	}
+	g.Transport = c.network
+	node := &testNode{id: id, address: address, gossip: g}
+	c.nodes[id] = node
+	return node
+}
+
+// Passa a aceitar conexões dos outros nós
+func (c *testCluster) serve(node *testNode) {
+	c.t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	node.cancel, node.served = cancel, make(chan struct{})
+	go func() {
+		node.gossip.GossipIn(ctx)
+		close(node.served)
+	}()
+	c.eventually(fmt.Sprintf("%s listening", node.id), func() bool {
+		c.network.mutex.Lock()
+		defer c.network.mutex.Unlock()
+		_, listening := c.network.listeners[node.address]
+		return listening
+	})
+}
+
+// Derruba o nó: as conexões para ele passam a ser recusadas e o que estava em memória é
+// gravado no diretório de dados, como num desligamento
+func (c *testCluster) stop(id string) {
+	node, running := c.nodes[id]
+	if !running {
+		return
+	}
+	delete(c.nodes, id)
+	g := node.gossip
+	if node.cancel != nil {
+		node.cancel()
+		<-node.served
+	}
+	g.pool.close()
+	waitTimeout(&g.handlers, 5*time.Second)
+	if err := g.KeyValueStore.Close(); err != nil {
+		c.t.Errorf("%s: close: %v", id, err)
+	}
+}
+
+func (c *testCluster) node(id string) *Gossip {
+	c.t.Helper()
+	node, running := c.nodes[id]
+	if !running {
+		c.t.Fatalf("%s is not running", id)
+	}
+	return node.gossip
+}
+
+// Espera até que a condição seja verdadeira, falhando o teste depois de alguns segundos
+func (c *testCluster) eventually(what string, condition func() bool) {
+	c.t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			c.t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Retorna a versão local da chave no nó (na memória ou no disco) e quantas irmãs ela guarda
+func localVersion(g *Gossip, key string) (string, bool, int) {
+	kv := g.KeyValueStore
+	kv.Mutex.Lock()
+	defer kv.Mutex.Unlock()
+	item, exists := kv.loadItem(key)
+	if !exists || item.Deleted() || kv.versionRemoved(key, item.WrittenAt) {
+		return "", false, 0
+	}
+	return kv.currentValue(key, item), true, len(item.Siblings)
+}
+
+// Um nó fora recebe, ao voltar, as escritas guardadas como hints, mesmo que o coordenador tenha
+// sido reiniciado nesse meio tempo (os hints ficam em disco)
+func TestHintsAreDeliveredAfterRestart(t *testing.T) {
+	c := newTestCluster(t, "node1", "node2", "node3")
+	for _, id := range []string{"node1", "node2", "node3"} {
+		c.start(id)
+	}
+
+	c.stop("node3")
+	result, err := c.node("node1").KeyValueStore.Put("chave", "valor", ConsistencyDefault, NodeCaller)
+	if err != nil {
+		t.Fatalf("Put with node3 down: %v", err)
+	}
+	if result.Hinted != 1 || result.Replicas != 2 {
+		t.Fatalf("Put = %d replicas, %d hinted; want 2 and 1", result.Replicas, result.Hinted)
+	}
+
+	// O coordenador reinicia antes de o nó voltar: o hint volta do disco
+	c.stop("node1")
+	node1 := c.start("node1")
+	if pending := node1.KeyValueStore.PendingHints(); pending != 1 {
+		t.Fatalf("PendingHints after restart = %d, want 1", pending)
+	}
+
+	node3 := c.start("node3")
+	if _, found, _ := localVersion(node3, "chave"); found {
+		t.Fatal("node3 has the key before the handoff")
+	}
+	node1.KeyValueStore.processHintedHandoff()
+
+	if value, found, _ := localVersion(node3, "chave"); !found || value != "valor" {
+		t.Fatalf("node3 after handoff = %q, %v; want valor", value, found)
+	}
+	if pending := node1.KeyValueStore.PendingHints(); pending != 0 {
+		t.Fatalf("PendingHints after handoff = %d, want 0", pending)
+	}
+}
+
+// Chaves e valores com espaços, quebras de linha e bytes quaisquer chegam inteiros às réplicas
+// pelos quadros binários e aos nós fora pelos hints, que voltam do disco (com o índice das
+// páginas e os pedaços de um valor grande) depois de um restart do coordenador
+func TestKeysWithWhitespaceAreReplicatedAndHinted(t *testing.T) {
+	c := newTestCluster(t, "node1", "node2", "node3")
+	for _, id := range []string{"node1", "node2", "node3"} {
+		c.start(id)
+	}
+	writes := map[string]string{
+		"chave com espaço":  "valor com espaço",
+		"linha\nquebrada":   "linha 1\nlinha 2\r\nfim",
+		"tab\tnul\x00%20":   "\x00\xff\t",
+		"valor grande":      strings.Repeat("a b\n", PageSize),
+		"chave sem espaços": "valor",
+	}
+
+	c.stop("node3")
+	for key, value := range writes {
+		if _, err := c.node("node1").KeyValueStore.Put(key, value, ConsistencyDefault, NodeCaller); err != nil {
+			t.Fatalf("Put(%q): %v", key, err)
+		}
+		if got, found, _ := localVersion(c.node("node2"), key); !found || got != value {
+			t.Fatalf("node2 has %q = %q, %v; want %q", key, got, found, value)
+		}
+	}
+
+	c.stop("node1")
+	node1 := c.start("node1")
+	if pending := node1.KeyValueStore.PendingHints(); pending != len(writes) {
+		t.Fatalf("PendingHints after restart = %d, want %d", pending, len(writes))
+	}
+	node3 := c.start("node3")
+	node1.KeyValueStore.processHintedHandoff()
+	for key, value := range writes {
+		if got, found, _ := localVersion(node3, key); !found || got != value {
+			t.Errorf("node3 after handoff has %q = %q, %v; want %q", key, got, found, value)
+		}
+	}
+	if pending := node1.KeyValueStore.PendingHints(); pending != 0 {
+		t.Fatalf("PendingHints after handoff = %d, want 0", pending)
+	}
+}
+
+// Escritas concorrentes em lados diferentes de uma partição viram irmãs, e um resolve as
+// substitui por uma única versão em todas as réplicas
+func TestConcurrentWritesBecomeSiblingsUntilResolved(t *testing.T) {
+	c := newTestCluster(t, "node1", "node2", "node3")
+	c.start("node1")
+
+	// Cada lado só alcança a própria réplica: as duas escritas não se veem
+	if _, err := c.node("node1").KeyValueStore.Put("chave", "a", ConsistencyOne, NodeCaller); err != nil {
+		t.Fatalf("Put on node1: %v", err)
+	}
+	c.stop("node1")
+	c.start("node2")
+	if _, err := c.node("node2").KeyValueStore.Put("chave", "b", ConsistencyOne, NodeCaller); err != nil {
+		t.Fatalf("Put on node2: %v", err)
+	}
+
+	c.start("node1")
+	c.start("node3")
+	for _, id := range []string{"node1", "node2"} {
+		c.node(id).KeyValueStore.processHintedHandoff()
+	}
+
+	result, err := c.node("node3").KeyValueStore.Get("chave", ConsistencyAll, NodeCaller)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	values := make(map[string]bool)
+	for _, sibling := range result.Siblings {
+		values[sibling.Value] = true
+	}
+	if len(result.Siblings) != 2 || !values["a"] || !values["b"] {
+		t.Fatalf("Get siblings = %+v, want a and b", result.Siblings)
+	}
+
+	resolved, err := c.node("node3").KeyValueStore.Resolve("chave", "c", ConsistencyAll)
+	if err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+	if resolved.Replicas != 3 {
+		t.Fatalf("Resolve reached %d replicas, want 3", resolved.Replicas)
+	}
+	for _, id := range []string{"node1", "node2", "node3"} {
+		if value, found, siblings := localVersion(c.node(id), "chave"); !found || value != "c" || siblings != 0 {
+			t.Fatalf("%s after resolve = %q, %v, %d siblings; want c without siblings", id, value, found, siblings)
+		}
+	}
+	result, err = c.node("node1").KeyValueStore.Get("chave", ConsistencyAll, NodeCaller)
+	if err != nil || result.Value != "c" || len(result.Siblings) != 0 {
+		t.Fatalf("Get after resolve = %+v, %v", result, err)
+	}
+}
+
+// Uma réplica que perdeu a remoção não ressuscita a chave ao enviar a versão antiga às outras
+// (como num reparo ou rebalanceamento); a leitura devolve a remoção e a repara
+func TestDeleteIsNotResurrectedByStaleReplica(t *testing.T) {
+	c := newTestCluster(t, "node1", "node2", "node3")
+	for _, id := range []string{"node1", "node2", "node3"} {
+		c.start(id)
+	}
+	if _, err := c.node("node1").KeyValueStore.Put("chave", "valor", ConsistencyAll, NodeCaller); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	c.stop("node3")
+	if _, err := c.node("node1").KeyValueStore.Delete("chave", ConsistencyDefault, NodeCaller); err != nil {
+		t.Fatalf("Delete with node3 down: %v", err)
+	}
+	// O tombstone sobrevive ao flush e ao restart do coordenador
+	c.stop("node1")
+	c.start("node1")
+
+	// O hint da remoção não é entregue: node3 volta com a versão antiga
+	node3 := c.start("node3")
+	if value, found, _ := localVersion(node3, "chave"); !found || value != "valor" {
+		t.Fatalf("node3 after restart = %q, %v; want the stale valor", value, found)
+	}
+	for _, id := range []string{"node1", "node2"} {
+		target, _ := node3.GetNode(id)
+		if _, err := node3.KeyValueStore.transferKey(target, "chave", nil, "repair"); err != nil {
+			t.Fatalf("transfer to %s: %v", id, err)
+		}
+		if value, found, _ := localVersion(c.node(id), "chave"); found {
+			t.Fatalf("%s resurrected the key with %q", id, value)
+		}
+	}
+
+	result, err := c.node("node2").KeyValueStore.Get("chave", ConsistencyAll, NodeCaller)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if result.Found {
+		t.Fatalf("Get found %q, want the delete", result.Value)
+	}
+	c.eventually("read repair of node3", func() bool {
+		_, found, _ := localVersion(node3, "chave")
+		return !found
+	})
+}
+
+// A entrada e a saída de nós movem as chaves para as novas réplicas pelo rebalanceamento
+func TestRebalanceOnJoinAndLeave(t *testing.T) {
+	members := []string{"node1", "node2", "node3", "node4"}
+	c := newTestCluster(t, members...)
+	for _, id := range members {
+		c.start(id).KeyValueStore.AutoRebalance = true
+	}
+	c.node("node4").initiateElection()
+	c.eventually("coordinator", func() bool {
+		for _, id := range members {
+			if coordinator, known := c.node(id).CoordinatorID(); !known || coordinator != "node4" {
+				return false
+			}
+		}
+		return true
+	})
+
+	keys := make([]string, 60)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("chave%02d", i)
+		if _, err := c.node("node1").KeyValueStore.Put(keys[i], "valor", ConsistencyAll, NodeCaller); err != nil {
+			t.Fatalf("Put %s: %v", keys[i], err)
+		}
+	}
+
+	// node5 entra por node1, que o acrescenta à configuração de todos os membros
+	joining := c.launch("node5")
+	joining.gossip.KeyValueStore.AutoRebalance = true
+	c.serve(joining)
+	if err := joining.gossip.JoinCluster([]string{"node1:7000"}, "segredo"); err != nil {
+		t.Fatalf("JoinCluster: %v", err)
+	}
+	for _, id := range append(members, "node5") {
+		config := c.node(id).clusterConfig()
+		if !slices.ContainsFunc(config.Nodes, func(nc NodeConfig) bool { return nc.ID == "node5" }) {
+			t.Fatalf("%s config does not have node5", id)
+		}
+		if config.Epoch != c.node("node4").clusterConfig().Epoch {
+			t.Fatalf("%s config is at epoch %d, node4 at %d", id, config.Epoch, c.node("node4").clusterConfig().Epoch)
+		}
+		if id != "node5" {
+			if _, known := c.node(id).GetNode("node5"); !known {
+				t.Fatalf("%s did not add node5 to the ring", id)
+			}
+		}
+	}
+	var moved int
+	for _, key := range keys {
+		if slices.Contains(replicasOf(c.node("node1"), key), "node5") {
+			moved++
+		}
+	}
+	if moved == 0 {
+		t.Fatal("node5 does not replicate any of the keys")
+	}
+	c.expectReplicated(keys, "node2")
+
+	// node1 é desativado: as chaves dele vão para as réplicas que o substituem
+	if err := c.node("node1").Decommission(5 * time.Second); err != nil {
+		t.Fatalf("Decommission node1: %v", err)
+	}
+	c.stop("node1")
+	for _, id := range []string{"node2", "node3", "node4", "node5"} {
+		if _, known := c.node(id).GetNode("node1"); known {
+			t.Fatalf("%s still has node1 in the ring", id)
+		}
+	}
+	c.expectReplicated(keys, "node2")
+}
+
+// Uma transferência recusada pelo destino, que ainda está entrando no cluster, é repetida até
+// ele aceitá-la, em vez de deixar o trecho sem a réplica
+func TestRebalanceRetriesTargetThatIsJoining(t *testing.T) {
+	c := newTestCluster(t, "node1", "node2", "node3")
+	node1, node2 := c.start("node1"), c.start("node2")
+	vc := vectorclock.NewVectorClock()
+	vc.Increment("node1")
+	node1.KeyValueStore.ApplyReplica("chave", "valor", vc, time.Now())
+
+	plan := &RebalancePlan{CreatedAt: time.Now()}
+	hash := node1.ConsistentHash.HashKey("chave")
+	for _, r := range node1.ConsistentHash.Ranges() {
+		if r.Contains(hash) {
+			plan.Tasks = append(plan.Tasks, &RebalanceTask{TargetID: "node2", Range: r})
+		}
+	}
+
+	node2.joining.Store(true)
+	done := make(chan error, 1)
+	go func() { done <- node1.KeyValueStore.RunRebalance(nil, plan) }()
+	time.Sleep(2 * rebalanceRetryMin)
+	if _, found, _ := localVersion(node2, "chave"); found {
+		t.Fatal("node2 accepted the key while joining")
+	}
+
+	node2.joining.Store(false)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("RunRebalance: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("rebalance did not finish after node2 joined")
+	}
+	if value, found, _ := localVersion(node2, "chave"); !found || value != "valor" {
+		t.Fatalf("node2 after the rebalance = %q, %v; want valor", value, found)
+	}
+}
+
+// Espera que cada chave esteja em todas as réplicas dela, segundo o anel do nó informado
+func (c *testCluster) expectReplicated(keys []string, viewer string) {
+	c.t.Helper()
+	for _, key := range keys {
+		for _, id := range replicasOf(c.node(viewer), key) {
+			g := c.node(id)
+			c.eventually(fmt.Sprintf("%s on %s", key, id), func() bool {
+				value, found, _ := localVersion(g, key)
+				return found && value == "valor"
+			})
+		}
+	}
+}
+
+// Retorna os IDs das réplicas da chave na visão de g
+func replicasOf(g *Gossip, key string) []string {
+	var ids []string
+	for _, node := range g.ConsistentHash.GetPreferenceList(key, g.KeyValueStore.replicationFactor()).Replicas {
+		ids = append(ids, node.ID)
+	}
+	return ids
+}
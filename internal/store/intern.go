@@ -0,0 +1,241 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/bquerino/kv-g/internal/vectorclock"
+)
+
+// Nome do arquivo, no bucket de sistema, com os índices dos nós
+const nodeTableFile = "nodes.json"
+
+// nodeTable atribui a cada nó um índice curto, igual em todo o cluster, usado no lugar do
+// ID nos Vector Clocks enviados pela rede e gravados em disco ("#2=5" em vez de
+// "datacenter-a-rack-3-node-12=5"). Também mantém uma única cópia de cada ID, compartilhada
+// pelos Vector Clocks decodificados, para que milhões de registros não repitam os nomes.
+type nodeTable struct {
+	path      string
+	mutex     sync.RWMutex
+	byID      map[string]int
+	byIndex   map[int]string
+	names     map[string]string // Cópia canônica de cada ID
+	ambiguous map[int]bool      // Índices reivindicados por mais de um nó, que não são usados
+}
+
+// Carrega a tabela de índices do bucket de sistema, se existir
+func loadNodeTable(dataDir string) *nodeTable {
+	t := &nodeTable{
+		path:      filepath.Join(dataDir, SystemBucket, nodeTableFile),
+		byID:      make(map[string]int),
+		byIndex:   make(map[int]string),
+		names:     make(map[string]string),
+		ambiguous: make(map[int]bool),
+	}
+
+	data, err := os.ReadFile(t.path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			gossipLog.Error("Failed to read node index table", "err", err)
+		}
+		return t
+	}
+
+	var indexes map[string]int
+	if err := json.Unmarshal(data, &indexes); err != nil {
+		gossipLog.Warn("Ignoring invalid node index table", "path", t.path, "err", err)
+		return t
+	}
+	for id, index := range indexes {
+		t.assignLocked(id, index)
+	}
+	return t
+}
+
+// Retorna a cópia canônica de um ID de nó
+func (t *nodeTable) intern(id string) string {
+	t.mutex.RLock()
+	name, exists := t.names[id]
+	t.mutex.RUnlock()
+	if exists {
+		return name
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if name, exists := t.names[id]; exists {
+		return name
+	}
+	t.names[id] = id
+	return id
+}
+
+// Associa um índice a um nó e persiste a tabela quando ela muda
+func (t *nodeTable) assign(id string, index int) {
+	t.mutex.Lock()
+	changed := t.assignLocked(id, index)
+	t.mutex.Unlock()
+
+	if changed {
+		if err := t.save(); err != nil {
+			gossipLog.Error("Failed to save node index table", "err", err)
+		}
+	}
+}
+
+func (t *nodeTable) assignLocked(id string, index int) bool {
+	if index <= 0 || t.ambiguous[index] {
+		return false
+	}
+	if current, exists := t.byID[id]; exists {
+		if current != index {
+			gossipLog.Warn("Node already has an index, ignoring the new one", "peer", id, "index", current, "ignored", index)
+		}
+		return false
+	}
+	if owner, exists := t.byIndex[index]; exists && owner != id {
+		// Dois nós entraram ao mesmo tempo por nós diferentes; o índice deixa de ser usado
+		gossipLog.Warn("Node index is claimed by two nodes; clocks will use full node IDs", "index", index, "peer", id, "owner", owner)
+		t.ambiguous[index] = true
+		return true
+	}
+
+	if _, exists := t.names[id]; !exists {
+		t.names[id] = id
+	}
+	id = t.names[id]
+	t.byID[id] = index
+	t.byIndex[index] = id
+	return true
+}
+
+// Retorna o índice de um nó, ou 0 se ele ainda não tem um
+func (t *nodeTable) index(id string) int {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	return t.byID[id]
+}
+
+// Retorna o próximo índice livre, para um nó que entra no cluster
+func (t *nodeTable) nextIndex() int {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	next := 1
+	for index := range t.byIndex {
+		next = max(next, index+1)
+	}
+	for index := range t.ambiguous {
+		next = max(next, index+1)
+	}
+	return next
+}
+
+// Grava a tabela no bucket de sistema
+func (t *nodeTable) save() error {
+	t.mutex.RLock()
+	indexes := make(map[string]int, len(t.byID))
+	for id, index := range t.byID {
+		if !t.ambiguous[index] {
+			indexes[id] = index
+		}
+	}
+	t.mutex.RUnlock()
+
+	data, err := json.MarshalIndent(indexes, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(t.path, data, 0644)
+}
+
+// Codifica um Vector Clock usando os índices dos nós ("#1=3,#2=1"), com o ID completo
+// para os nós sem índice, e o horário de cada contador quando conhecido ("#1=3@1700000000"). Um
+// Vector Clock vazio é codificado como "-".
+func (t *nodeTable) encodeClock(vc *vectorclock.VectorClock) string {
+	clock := vc.Clock
+	if len(clock) == 0 {
+		return "-"
+	}
+
+	ids := make([]string, 0, len(clock))
+	for id := range clock {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	var b strings.Builder
+	for i, id := range ids {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		if index := t.byID[id]; index > 0 && !t.ambiguous[index] {
+			b.WriteByte('#')
+			b.WriteString(strconv.Itoa(index))
+		} else {
+			b.WriteString(id)
+		}
+		b.WriteByte('=')
+		b.WriteString(strconv.Itoa(clock[id]))
+		if updated := vc.Updated[id]; updated > 0 {
+			b.WriteByte('@')
+			b.WriteString(strconv.FormatInt(updated, 10))
+		}
+	}
+	return b.String()
+}
+
+// Decodifica um Vector Clock codificado por encodeClock (ou por encodeVectorClock)
+func (t *nodeTable) decodeClock(s string) (*vectorclock.VectorClock, error) {
+	vc, err := decodeVectorClock(s)
+	if err != nil {
+		return nil, err
+	}
+
+	decoded := vectorclock.NewVectorClock()
+	for id, counter := range vc.Clock {
+		updated := vc.Updated[id]
+		if !strings.HasPrefix(id, "#") {
+			if _, exists := decoded.Clock[id]; exists {
+				return nil, fmt.Errorf("duplicate vector clock entry for node %q", id)
+			}
+			id = t.intern(id)
+			decoded.Clock[id] = counter
+			if updated > 0 {
+				decoded.Updated[id] = updated
+			}
+			continue
+		}
+
+		index, err := strconv.Atoi(id[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid node index %q in vector clock", id)
+		}
+		t.mutex.RLock()
+		name, known := t.byIndex[index]
+		ambiguous := t.ambiguous[index]
+		t.mutex.RUnlock()
+		if !known || ambiguous {
+			return nil, fmt.Errorf("unknown node index %d in vector clock", index)
+		}
+		if _, exists := decoded.Clock[name]; exists {
+			return nil, fmt.Errorf("duplicate vector clock entry for node %q", name)
+		}
+		decoded.Clock[name] = counter
+		if updated > 0 {
+			decoded.Updated[name] = updated
+		}
+	}
+	return decoded, nil
+}
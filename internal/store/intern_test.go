@@ -0,0 +1,40 @@
+package store
+
+import (
+	"maps"
+	"testing"
+)
+
+// Um Vector Clock aceito por decodeClock volta igual depois de codificado por encodeClock, e a
+// codificação é canônica
+func FuzzDecodeClock(f *testing.F) {
+	table := loadNodeTable(f.TempDir())
+	table.assign("node1", 1)
+	table.assign("node2", 2)
+	table.assign("node3", 3)
+	table.assign("node4", 3) // Índice ambíguo, que não é usado
+	for _, seed := range []string{
+		"", "-", "#1=3", "#1=3,#2=1", "#1=3@1700000000,node9=2", "node1=1,#1=2", "#3=1",
+		"#x=1", "node5=1@0", "a=1,,b=2", "=1", "node1=-1", "node1=1@-5", "#1=1,#1=2",
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, s string) {
+		vc, err := table.decodeClock(s)
+		if err != nil {
+			return
+		}
+		encoded := table.encodeClock(vc)
+		decoded, err := table.decodeClock(encoded)
+		if err != nil {
+			t.Fatalf("decodeClock(%q) = %v, but its encoding %q does not decode: %v", s, vc, encoded, err)
+		}
+		if !maps.Equal(vc.Clock, decoded.Clock) || !maps.Equal(vc.Updated, decoded.Updated) {
+			t.Fatalf("round trip of %q changed %v@%v into %v@%v", s, vc.Clock, vc.Updated, decoded.Clock, decoded.Updated)
+		}
+		if again := table.encodeClock(decoded); again != encoded {
+			t.Fatalf("encoding is not canonical: %q then %q", encoded, again)
+		}
+	})
+}
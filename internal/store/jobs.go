@@ -0,0 +1,339 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Nome do arquivo com os jobs dentro do bucket de sistema
+const jobsFile = "jobs.json"
+
+// Número de jobs finalizados mantidos no histórico
+const finishedJobsKept = 50
+
+// Intervalo mínimo entre gravações do progresso dos jobs
+const jobSaveInterval = time.Second
+
+// ErrJobCancelled é retornado pelo Progress de um job cancelado; o runner deve parar ao recebê-lo
+var ErrJobCancelled = errors.New("job cancelled")
+
+// ErrJobInProgress é retornado por Start quando um job do mesmo tipo ainda não terminou
+var ErrJobInProgress = errors.New("job already in progress")
+
+// JobState é o estado de um job em segundo plano
+type JobState string
+
+const (
+	JobRunning   JobState = "running"
+	JobPaused    JobState = "paused"
+	JobDone      JobState = "done"
+	JobFailed    JobState = "failed"
+	JobCancelled JobState = "cancelled"
+)
+
+// Indica se o job já terminou (com sucesso ou não)
+func (s JobState) Finished() bool {
+	return s == JobDone || s == JobFailed || s == JobCancelled
+}
+
+// Job é uma operação longa em segundo plano (rebalanceamento, migração, desfragmentação...)
+type Job struct {
+	ID        string    `json:"id"`
+	Kind      string    `json:"kind"`
+	Args      []string  `json:"args"`
+	State     JobState  `json:"state"`
+	Done      int       `json:"done"`
+	Total     int       `json:"total"`
+	Error     string    `json:"error,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	manager *JobManager
+}
+
+// JobRunner executa um tipo de job. Deve chamar job.Progress periodicamente e
+// retomar do próprio checkpoint persistido quando o job é reiniciado após um restart.
+type JobRunner func(job *Job, args []string) error
+
+// JobManager controla os jobs em segundo plano e persiste o estado deles no bucket de sistema
+type JobManager struct {
+	mutex    sync.Mutex
+	cond     *sync.Cond
+	jobs     map[string]*Job
+	nextID   int
+	path     string
+	runners  map[string]JobRunner
+	lastSave time.Time
+}
+
+// Formato persistido do arquivo de jobs
+type jobsState struct {
+	NextID int    `json:"next_id"`
+	Jobs   []*Job `json:"jobs"`
+}
+
+// Cria o gerenciador de jobs persistido em path
+func NewJobManager(path string) *JobManager {
+	m := &JobManager{
+		jobs:    make(map[string]*Job),
+		nextID:  1,
+		path:    path,
+		runners: make(map[string]JobRunner),
+	}
+	m.cond = sync.NewCond(&m.mutex)
+	return m
+}
+
+// Registra o runner de um tipo de job
+func (m *JobManager) Register(kind string, runner JobRunner) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.runners[kind] = runner
+}
+
+// Cria e inicia um job em segundo plano
+func (m *JobManager) Start(kind string, args ...string) (*Job, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	runner, exists := m.runners[kind]
+	if !exists {
+		return nil, fmt.Errorf("unknown job kind %q", kind)
+	}
+	for _, job := range m.jobs {
+		if job.Kind == kind && !job.State.Finished() {
+			return nil, fmt.Errorf("%w: %s (%s)", ErrJobInProgress, kind, job.ID)
+		}
+	}
+
+	now := time.Now()
+	job := &Job{
+		ID:        "job-" + strconv.Itoa(m.nextID),
+		Kind:      kind,
+		Args:      args,
+		State:     JobRunning,
+		CreatedAt: now,
+		UpdatedAt: now,
+		manager:   m,
+	}
+	m.nextID++
+	m.jobs[job.ID] = job
+	m.saveLocked(true)
+
+	go m.run(job, runner)
+	return job, nil
+}
+
+// Executa o runner e registra o resultado do job
+func (m *JobManager) run(job *Job, runner JobRunner) {
+	err := runner(job, job.Args)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	switch {
+	case errors.Is(err, ErrJobCancelled):
+		job.State = JobCancelled
+	case err != nil:
+		job.State = JobFailed
+		job.Error = err.Error()
+		clusterLog.Error("Job failed", "job", job.ID, "op", job.Kind, "err", err)
+	default:
+		job.State = JobDone
+		clusterLog.Info("Job completed", "job", job.ID, "op", job.Kind)
+	}
+	job.UpdatedAt = time.Now()
+	m.saveLocked(true)
+}
+
+// Registra o progresso do job. Bloqueia enquanto o job estiver pausado e
+// retorna ErrJobCancelled se ele for cancelado. Um job nil é ignorado.
+func (j *Job) Progress(done, total int) error {
+	if j == nil {
+		return nil
+	}
+	m := j.manager
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	j.Done, j.Total = done, total
+	j.UpdatedAt = time.Now()
+	for j.State == JobPaused {
+		m.cond.Wait()
+	}
+	if j.State == JobCancelled {
+		return ErrJobCancelled
+	}
+	m.saveLocked(false)
+	return nil
+}
+
+// Indica se o job foi cancelado. Um job nil nunca é cancelado.
+func (j *Job) Cancelled() bool {
+	if j == nil {
+		return false
+	}
+	j.manager.mutex.Lock()
+	defer j.manager.mutex.Unlock()
+	return j.State == JobCancelled
+}
+
+// Pausa um job em andamento; ele para no próximo Progress
+func (m *JobManager) Pause(id string) error {
+	return m.transition(id, JobRunning, JobPaused)
+}
+
+// Retoma um job pausado
+func (m *JobManager) Resume(id string) error {
+	return m.transition(id, JobPaused, JobRunning)
+}
+
+// Cancela um job em andamento ou pausado
+func (m *JobManager) Cancel(id string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	job, exists := m.jobs[id]
+	if !exists {
+		return fmt.Errorf("job %s not found", id)
+	}
+	if job.State.Finished() {
+		return fmt.Errorf("job %s is already %s", id, job.State)
+	}
+
+	job.State = JobCancelled
+	job.UpdatedAt = time.Now()
+	m.cond.Broadcast()
+	m.saveLocked(true)
+	return nil
+}
+
+func (m *JobManager) transition(id string, from, to JobState) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	job, exists := m.jobs[id]
+	if !exists {
+		return fmt.Errorf("job %s not found", id)
+	}
+	if job.State != from {
+		return fmt.Errorf("job %s is %s, not %s", id, job.State, from)
+	}
+
+	job.State = to
+	job.UpdatedAt = time.Now()
+	m.cond.Broadcast()
+	m.saveLocked(true)
+	return nil
+}
+
+// Retorna uma cópia dos jobs conhecidos, em ordem de criação
+func (m *JobManager) List() []Job {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	jobs := make([]Job, 0, len(m.jobs))
+	for _, job := range m.jobs {
+		jobs = append(jobs, *job)
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].CreatedAt.Before(jobs[j].CreatedAt)
+	})
+	return jobs
+}
+
+// Carrega os jobs persistidos e reinicia os que não terminaram antes do restart
+func (m *JobManager) ResumeAll() error {
+	data, err := os.ReadFile(m.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var state jobsState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("invalid jobs file: %w", err)
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.nextID = state.NextID
+	for _, job := range state.Jobs {
+		job.manager = m
+		m.jobs[job.ID] = job
+		if job.State.Finished() {
+			continue
+		}
+
+		runner, exists := m.runners[job.Kind]
+		if !exists {
+			job.State = JobFailed
+			job.Error = "no runner registered for this job kind"
+			continue
+		}
+		clusterLog.Info("Resuming job", "job", job.ID, "op", job.Kind, "state", job.State)
+		go m.run(job, runner)
+	}
+	m.saveLocked(true)
+	return nil
+}
+
+// Grava o estado dos jobs; sem force, no máximo uma vez por jobSaveInterval
+func (m *JobManager) saveLocked(force bool) {
+	if !force && time.Since(m.lastSave) < jobSaveInterval {
+		return
+	}
+	m.lastSave = time.Now()
+
+	state := jobsState{NextID: m.nextID}
+	var finished []*Job
+	for _, job := range m.jobs {
+		if job.State.Finished() {
+			finished = append(finished, job)
+		} else {
+			state.Jobs = append(state.Jobs, job)
+		}
+	}
+
+	// Mantém somente os jobs finalizados mais recentes
+	sort.Slice(finished, func(i, j int) bool {
+		return finished[i].UpdatedAt.After(finished[j].UpdatedAt)
+	})
+	for i, job := range finished {
+		if i >= finishedJobsKept {
+			delete(m.jobs, job.ID)
+			continue
+		}
+		state.Jobs = append(state.Jobs, job)
+	}
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(m.path, data, 0644)
+	}
+	if err != nil {
+		clusterLog.Error("Error saving jobs", "err", err)
+	}
+}
+
+// Registra os runners dos jobs do KeyValueStore
+func (kv *KeyValueStore) registerJobRunners() {
+	kv.Jobs.Register("rebalance", kv.rebalanceJob)
+	kv.Jobs.Register("migrate", kv.migrateJob)
+	kv.Jobs.Register("defrag", kv.defragJob)
+	kv.Jobs.Register("bucket-cleanup", kv.bucketCleanupJob)
+	kv.Jobs.Register("export", kv.exportJob)
+	kv.Jobs.Register("snapshot", kv.snapshotJob)
+	kv.Jobs.Register("promote", kv.promoteJob)
+}
@@ -0,0 +1,23 @@
+package store
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// Número de mutexes entre os quais as chaves são distribuídas
+const keyLockStripes = 256
+
+// keyLocks serializa as operações sobre uma mesma chave sem bloquear chaves não relacionadas.
+// Cada chave é mapeada por hash para um de keyLockStripes mutexes; chaves que colidem
+// apenas compartilham a espera. O lock de chave é sempre obtido antes do Mutex do store.
+type keyLocks [keyLockStripes]sync.Mutex
+
+// Bloqueia a chave e retorna a função que a libera
+func (l *keyLocks) lock(key string) func() {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	m := &l[h.Sum32()%keyLockStripes]
+	m.Lock()
+	return m.Unlock
+}
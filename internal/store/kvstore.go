@@ -1,93 +1,249 @@
 package store
 
 import (
-	"log"
+	"context"
+	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"time"
+	"unicode"
 
 	"github.com/bquerino/kv-g/internal/vectorclock"
 )
 
 const PageSize = 4096 // Tamanho fixo da página (4KB)
 
+// Tamanho máximo padrão de um valor (1MB)
+const DefaultMaxValueSize = 1 << 20
+
+// Maior MaxValueSize aceito: as versões concorrentes de uma chave viajam juntas numa mensagem
+// entre nós, limitada a maxMessageSize
+const MaxValueSizeLimit = maxMessageSize / 4
+
+// ErrValueTooLarge é retornado por uma escrita com valor maior que MaxValueSize
+var ErrValueTooLarge = errors.New("value too large")
+
+// ErrKeyTooLarge é retornado por uma escrita com chave maior que a metade de uma página
+var ErrKeyTooLarge = errors.New("key too large")
+
 type DataItem struct {
-	Value       string
-	VectorClock *vectorclock.VectorClock // Versão do dado
+	Value         string
+	VectorClock   *vectorclock.VectorClock // Versão do dado
+	SchemaVersion int                      // Versão do formato do valor (migrações do bucket)
+	WrittenAt     time.Time                // Quando o coordenador da escrita gravou a versão
+	Siblings      []Sibling                // Versões concorrentes à principal, guardadas até um resolve
+}
+
+// Indica se a versão é uma remoção (tombstone). Um valor vazio representa a remoção, já que
+// o protocolo em texto não admite valores vazios; o tombstone guarda o Vector Clock da remoção
+// para que versões antigas não ressuscitem a chave.
+func (item *DataItem) Deleted() bool {
+	return item.Value == ""
 }
 
 type Hint struct {
-	Key       string
-	Value     string
-	TargetID  string // O nó que deveria receber o dado originalmente
-	Timestamp time.Time
+	Key         string
+	Value       string
+	VectorClock *vectorclock.VectorClock // Versão gerada pelo coordenador
+	TargetID    string                   // O nó que deveria receber o dado originalmente
+	Timestamp   time.Time
+}
+
+// Chave de um hint no HintedData (uma por chave e nó de destino)
+func hintKey(key, targetID string) string {
+	return key + "@" + targetID
 }
 
 // KeyValueStore gerencia os dados e lida com escrita em disco, reconciliação, e hinted handoff
 type KeyValueStore struct {
-	Data            map[string]*DataItem // Armazena os dados na memória
-	HintedData      map[string]*Hint     // Armazena dados para hinted handoff
-	PageManager     *PageManager         // Gerenciamento de páginas para escrita em disco
-	Gossip          *Gossip              // Integração com o protocolo Gossip
-	ConsistentHash  *ConsistentHashing   // Integração com Consistent Hashing
-	Mutex           sync.Mutex
-	HandoffInterval time.Duration // Intervalo para verificar hinted handoff
+	Data              *Memtable          // Armazena os dados na memória, ordenados por chave
+	HintedData        map[string]*Hint   // Armazena dados para hinted handoff
+	HintLimit         int                // Máximo de hints em memória; o excedente fica só no log em disco (0 = sem limite)
+	hints             *hintLog           // Todos os hints pendentes, gravados em disco por nó de destino
+	hintStats         HintStats          // Métricas do armazenamento de hints
+	RerouteAfter      time.Duration      // Tempo fora do anel depois do qual os hints de um nó vão para as réplicas atuais das chaves (0 = nunca)
+	replicaLog        *replicaLog        // Escritas recentes por trecho, para a retomada de pares que ficaram fora
+	LSM               *LSMTree           // SSTables gravadas pelo flush e compactadas em segundo plano
+	Gossip            *Gossip            // Integração com o protocolo Gossip
+	ConsistentHash    *ConsistentHashing // Integração com Consistent Hashing
+	Mutex             sync.Mutex         // Protege os mapas; mantido só por trechos curtos, nunca durante I/O de rede
+	keys              keyLocks           // Locks por chave para escritas e aplicação de réplicas
+	casKeys           keyLocks           // Locks por chave que serializam os compare-and-swap coordenados pelo nó
+	DataDir           string             // Diretório onde ficam os arquivos de dados do nó
+	HandoffInterval   time.Duration      // Intervalo para verificar hinted handoff
+	Degradation       DegradationPolicy  // Comportamento quando há menos de N réplicas vivas
+	FlushInterval     time.Duration      // Intervalo do flusher periódico
+	dirty             map[string]bool    // Chaves alteradas em memória ainda não persistidas
+	closed            bool
+	draining          bool                    // Nó em desligamento, recusando novas requisições
+	drainMutex        sync.Mutex              // Protege draining (separado do Mutex para não esperar operações longas)
+	inflight          sync.WaitGroup          // Requisições de cliente em andamento
+	ctx               context.Context         // Cancelado no desligamento para parar os loops em segundo plano
+	cancel            context.CancelFunc      // Cancela ctx (chamado com drainMutex)
+	loops             sync.WaitGroup          // Loops em segundo plano em execução
+	migrations        map[string][]*Migration // Migrações registradas por bucket, em ordem de versão
+	schemaMutex       sync.Mutex              // Serializa as gravações do arquivo de schemas
+	Jobs              *JobManager             // Jobs em segundo plano (rebalanceamento, migrações, desfragmentação)
+	Workers           WorkerConfig            // Tamanho dos pools de workers de disco e rede
+	ConflictSink      ConflictSink            // Destino dos eventos de conflito (nil = nenhum)
+	ConflictResolver  ConflictResolver        // Estratégia para versões concorrentes (nil = guardar as irmãs)
+	CaptureLog        *CaptureLog             // Arquivo onde as operações de cliente coordenadas são gravadas (nil = nenhum)
+	AuditLog          *AuditLog               // Arquivo onde uma amostra das leituras de clientes é gravada (nil = nenhum)
+	TombstoneGrace    time.Duration           // Tempo que um tombstone é mantido antes do descarte (0 = nunca descarta)
+	ReplicationFactor int                     // Número de réplicas por chave (0 = valor da configuração do cluster)
+	ReadQuorum        int                     // Respostas exigidas numa leitura (0 = valor da configuração do cluster)
+	WriteQuorum       int                     // Confirmações exigidas numa escrita (0 = valor da configuração do cluster)
+	ClockEntries      int                     // Máximo de nós num Vector Clock; os contadores menos recentes são podados (0 = sem limite)
+	MaxSiblings       int                     // Máximo de versões concorrentes guardadas por chave (0 = sem limite)
+	SiblingOverflow   SiblingOverflow         // O que fazer com uma escrita que passaria de MaxSiblings
+	CacheMemory       int64                   // Bytes das chaves dos buckets de cache acima dos quais as menos usadas são descartadas (0 = sem limite)
+	cache             *lruCache               // Chaves dos buckets de cache por ordem de acesso
+	evictions         chan struct{}           // Acorda o evictor quando os caches passam de CacheMemory
+	compactions       chan struct{}           // Acorda o compactador depois de um flush
+	ColdAfter         time.Duration           // Tempo sem leitura depois do qual uma SSTable vai para a camada fria (0 = desativado)
+	ScatterTimeout    time.Duration           // Prazo de cada nó num comando de todo o cluster (0 = sem prazo)
+	NegativeCacheTTL  time.Duration           // Tempo que uma chave não encontrada é lembrada pelas leituras (0 = desativado)
+	negatives         *negativeCache          // Chaves que uma leitura recente não encontrou
+	orphanedSince     map[string]time.Time    // Desde quando cada nó com hints pendentes está fora do anel
+	StaleReads        bool                    // Serve de hints ou cópias locais as leituras sem resposta das réplicas fora
+	AutoRebalance     bool                    // Transfere os trechos que mudam de dono quando um nó entra ou sai do anel
+	RebalanceRate     int                     // Chaves por segundo enviadas pelo rebalanceamento (0 = sem limite)
+	rebalanceMutex    sync.Mutex              // Protege o plano de rebalanceamento em andamento
+	rebalancePlan     *RebalancePlan          // Plano carregado pelo job de rebalanceamento
+	rebalanceRunning  bool                    // Um job de rebalanceamento está executando o plano
+	WarmupRate        int                     // Chaves mais lidas carregadas por segundo na inicialização (0 = sem aquecimento)
+	hotKeys           *hotKeySketch           // Chaves mais lidas por este nó, gravadas no desligamento
+	MaxValueSize      int                     // Maior valor aceito numa escrita, em bytes (até MaxValueSizeLimit)
+	FastAck           bool                    // Confirma as escritas depois do commit log local, replicando em segundo plano
+	commitLog         *commitLog              // Escritas com ack rápido ainda não persistidas pelo flush
+	durability        *durabilityTracker      // Escritas com ack rápido ainda sem as W confirmações
 }
 
-// Page gerencia a estrutura de uma página no disco
+// Page gerencia a estrutura de uma página no disco (uma slotted page, ver slottedpage.go)
 type Page struct {
 	ID     int64  // Identificador único da página
 	Buffer []byte // Buffer de dados da página
-	Used   int    // Bytes atualmente usados na página
+	Used   int    // Bytes ocupados pelo cabeçalho, pelos slots e pelas células vivas
 }
 
 // PageManager gerencia a escrita e leitura de páginas no disco
 type PageManager struct {
+	Path       string
 	File       *os.File
 	NextPageID int64
-	Mutex      sync.Mutex
+	Mutex      sync.RWMutex          // Leituras usam ReadAt e podem rodar em paralelo; gravações alteram páginas e são exclusivas
+	index      map[string]pageRecord // Versão mais recente de cada chave gravada
+	ranges     []*RangeTombstone     // Range tombstones gravados no arquivo, protegidos por indexMutex
+	indexMutex sync.Mutex
+	free       map[int64]int // Espaço livre das páginas que ainda recebem registros, protegido por Mutex
+	nextSeq    uint64        // Sequência do último registro gravado, protegida por Mutex
 }
 
 // Função para inicializar o KeyValueStore com todos os componentes integrados
-func NewKeyValueStore(gossip *Gossip, consistentHash *ConsistentHashing, handoffInterval time.Duration, pageFileName string) (*KeyValueStore, error) {
-	pageManager, err := NewPageManager(pageFileName)
+func NewKeyValueStore(gossip *Gossip, consistentHash *ConsistentHashing, handoffInterval time.Duration, dataDir, pageFileName string) (*KeyValueStore, error) {
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return nil, err
+	}
+
+	lsm, err := OpenLSMTree(filepath.Join(dataDir, lsmDir))
 	if err != nil {
 		return nil, err
 	}
+	// Versões anteriores gravavam uma página por escrita em pageFileName
+	if err := lsm.importPageFile(filepath.Join(dataDir, pageFileName)); err != nil {
+		lsm.Close()
+		return nil, err
+	}
 
-	return &KeyValueStore{
-		Data:            make(map[string]*DataItem),
+	hints, err := openHintLog(filepath.Join(dataDir, hintDir), gossip.nodeIndex)
+	if err != nil {
+		return nil, err
+	}
+
+	kv := &KeyValueStore{
+		Data:            NewMemtable(),
 		HintedData:      make(map[string]*Hint),
-		PageManager:     pageManager,
+		HintLimit:       DefaultHintLimit,
+		RerouteAfter:    DefaultRerouteAfter,
+		hints:           hints,
+		replicaLog:      newReplicaLog(),
+		LSM:             lsm,
 		Gossip:          gossip,
 		ConsistentHash:  consistentHash,
+		DataDir:         dataDir,
 		HandoffInterval: handoffInterval,
-	}, nil
+		Degradation:     DegradeHint,
+		FlushInterval:   time.Second,
+		dirty:           make(map[string]bool),
+		migrations:      make(map[string][]*Migration),
+		Jobs:            NewJobManager(filepath.Join(dataDir, SystemBucket, jobsFile)),
+		Workers:         DefaultWorkerConfig(),
+		TombstoneGrace:  DefaultTombstoneGrace,
+		ScatterTimeout:  DefaultScatterTimeout,
+		CacheMemory:     DefaultCacheMemory,
+		AutoRebalance:   true,
+		StaleReads:      true,
+		cache:           newLRUCache(),
+		evictions:       make(chan struct{}, 1),
+		compactions:     make(chan struct{}, 1),
+		negatives:       newNegativeCache(),
+		orphanedSince:   make(map[string]time.Time),
+		hotKeys:         newHotKeySketch(hotKeyCapacity),
+		MaxValueSize:    DefaultMaxValueSize,
+		commitLog:       newCommitLog(filepath.Join(dataDir, commitLogFile), gossip.nodeIndex),
+		durability:      newDurabilityTracker(),
+	}
+	kv.ctx, kv.cancel = context.WithCancel(context.Background())
+	kv.loadHotKeys()
+	kv.registerJobRunners()
+	return kv, nil
 }
 
 // Função para inicializar o PageManager e abrir o arquivo de páginas
 func NewPageManager(filename string) (*PageManager, error) {
+	// Uma compactação interrompida antes do rename deixa só o arquivo temporário
+	if err := os.Remove(filename + pageCompactSuffix); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
 	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0755)
 	if err != nil {
 		return nil, err
 	}
 
-	return &PageManager{
+	pm := &PageManager{
+		Path:       filename,
 		File:       file,
 		NextPageID: 0,
-	}, nil
+		free:       make(map[int64]int),
+	}
+	if err := pm.loadIndex(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if err := pm.dropOrphanChunks(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return pm, nil
 }
 
-// Função para alocar uma nova página
+// Função para alocar uma nova página, já formatada como slotted page
 func (pm *PageManager) AllocatePage() *Page {
 	pm.Mutex.Lock()
 	defer pm.Mutex.Unlock()
+	return pm.allocatePageLocked()
+}
 
+func (pm *PageManager) allocatePageLocked() *Page {
 	page := &Page{
 		ID:     pm.NextPageID,
 		Buffer: make([]byte, PageSize),
-		Used:   0,
 	}
+	page.initSlotted()
 	pm.NextPageID++
 	return page
 }
@@ -96,193 +252,728 @@ func (pm *PageManager) AllocatePage() *Page {
 func (pm *PageManager) WritePage(page *Page) error {
 	pm.Mutex.Lock()
 	defer pm.Mutex.Unlock()
+	return pm.writePageLocked(page)
+}
 
-	offset := page.ID * PageSize
-	_, err := pm.File.Seek(offset, 0)
-	if err != nil {
-		return err
-	}
-	_, err = pm.File.Write(page.Buffer)
-	if err != nil {
-		return err
+func (pm *PageManager) writePageLocked(page *Page) error {
+	if page.checksummed() {
+		page.sealChecksum()
 	}
-	return nil
+	offset := page.ID * PageSize
+	_, err := pm.File.WriteAt(page.Buffer, offset)
+	return err
 }
 
-// Função para ler uma página do disco
-func (pm *PageManager) ReadPage(pageID int64) (*Page, error) {
+// Força a gravação em disco das páginas escritas
+func (pm *PageManager) Sync() error {
 	pm.Mutex.Lock()
 	defer pm.Mutex.Unlock()
 
+	return pm.File.Sync()
+}
+
+// Grava o índice de chaves e fecha o arquivo de páginas
+func (pm *PageManager) Close() error {
+	if err := pm.SaveIndex(); err != nil {
+		storageLog.Error("Error saving page index", "err", err)
+	}
+
+	pm.Mutex.Lock()
+	defer pm.Mutex.Unlock()
+
+	return pm.File.Close()
+}
+
+// Função para ler uma página do disco. Uma página cujo checksum não confere retorna um erro
+// com ErrChecksumMismatch.
+func (pm *PageManager) ReadPage(pageID int64) (*Page, error) {
+	pm.Mutex.RLock()
+	defer pm.Mutex.RUnlock()
+	return pm.readPageLocked(pageID)
+}
+
+func (pm *PageManager) readPageLocked(pageID int64) (*Page, error) {
 	offset := pageID * PageSize
-	_, err := pm.File.Seek(offset, 0)
+	buffer := make([]byte, PageSize)
+	_, err := pm.File.ReadAt(buffer, offset)
 	if err != nil {
 		return nil, err
 	}
 
-	buffer := make([]byte, PageSize)
-	_, err = pm.File.Read(buffer)
-	if err != nil {
+	page := &Page{ID: pageID, Buffer: buffer, Used: PageSize}
+	if page.checksummed() {
+		if err := page.verifyChecksum(); err != nil {
+			return nil, fmt.Errorf("page %d of %s: %w", pageID, pm.Path, err)
+		}
+	}
+	if page.slotted() {
+		page.Used = PageSize - page.freeSpace()
+	}
+	return page, nil
+}
+
+// Grava a chave nas N réplicas responsáveis, aplicando a política de degradação quando há réplicas fora.
+// level define quantas confirmações a escrita exige (ConsistencyDefault usa o W configurado), e
+// caller precisa da permissão de escrita na chave.
+func (kv *KeyValueStore) Put(key, value string, level ConsistencyLevel, caller Caller) (*PutResult, error) {
+	if err := kv.Gossip.authorizeCaller(caller, AccessWrite, key); err != nil {
 		return nil, err
 	}
+	if err := kv.checkPutSize(key, value); err != nil {
+		return nil, err
+	}
+	return kv.write(key, value, nil, level)
+}
 
-	return &Page{
-		ID:     pageID,
-		Buffer: buffer,
-		Used:   PageSize,
-	}, nil
+// Verifica se o valor de um PUT não é vazio nem maior que MaxValueSize, e se a chave cabe numa página
+func (kv *KeyValueStore) checkPutSize(key, value string) error {
+	if value == "" {
+		return errors.New("empty value: use delete to remove a key")
+	}
+	if len(key) > maxPageKeySize {
+		return fmt.Errorf("%w: %d bytes, the limit is %d", ErrKeyTooLarge, len(key), maxPageKeySize)
+	}
+	if limit := kv.MaxValueSize; limit > 0 && len(value) > limit {
+		return fmt.Errorf("%w: %d bytes, the limit is %d (--max-value-size)", ErrValueTooLarge, len(value), limit)
+	}
+	return nil
 }
 
-// Função para persistir dados em uma página no disco
-func (kv *KeyValueStore) writeDataToDisk(key, value string) {
-	page := kv.PageManager.AllocatePage()
+// Remove a chave gravando um tombstone nas N réplicas responsáveis, como uma escrita
+func (kv *KeyValueStore) Delete(key string, level ConsistencyLevel, caller Caller) (*PutResult, error) {
+	if err := kv.Gossip.authorizeCaller(caller, AccessDelete, key); err != nil {
+		return nil, err
+	}
+	return kv.write(key, "", nil, level)
+}
 
-	// Escreve a chave e o valor no buffer da página
-	binaryKey := []byte(key)
-	binaryValue := []byte(value)
+// Número padrão de nós mantidos num Vector Clock (o mesmo limite do Dynamo)
+const DefaultClockEntries = 10
 
-	copy(page.Buffer, binaryKey)
-	copy(page.Buffer[len(binaryKey):], binaryValue)
+// Grava uma nova versão da chave (ou um tombstone, com valor vazio) nas réplicas. A versão
+// supera a local e, se context não for nil, também as versões de context.
+func (kv *KeyValueStore) write(key, value string, context *vectorclock.VectorClock, level ConsistencyLevel) (*PutResult, error) {
+	if err := kv.beginRequest(); err != nil {
+		return nil, err
+	}
+	defer kv.endRequest()
 
-	err := kv.PageManager.WritePage(page)
-	if err != nil {
-		log.Printf("Error writing page for key %s: %v", key, err)
+	if err := kv.Gossip.checkBucketWritable(key); err != nil {
+		return nil, err
+	}
+	kv.negatives.invalidate(key)
+	if value == "" {
+		kv.capture(CapturedDelete, key, "", level)
 	} else {
-		log.Printf("Wrote key %s to disk", key)
+		kv.capture(CapturedPut, key, value, level)
 	}
-}
 
-func (kv *KeyValueStore) Put(key, value string) {
+	n := kv.replicationFactor()
+	result := &PutResult{Key: key, Requested: n}
+	preference, live, down := kv.writeTargets(key, n)
+	for _, node := range down {
+		result.Outcomes = append(result.Outcomes, ReplicaOutcome{NodeID: node.ID, Status: ReplicaSkipped})
+	}
+
+	if len(live) < n && kv.Degradation == DegradeReject {
+		return result, fmt.Errorf("only %d of %d replicas for key %s are alive", len(live), n, key)
+	}
+
+	// Gera a nova versão a partir da versão local e grava a cópia local sob o lock da chave,
+	// para que escritas concorrentes na mesma chave não regridam o Vector Clock
+	unlock := kv.keys.lock(key)
 	kv.Mutex.Lock()
-	defer kv.Mutex.Unlock()
+	vc := vectorclock.NewVectorClock()
+	if item, exists := kv.loadItem(key); exists {
+		vc.Merge(item.VectorClock)
+	}
+	if context != nil {
+		vc.Merge(context)
+	}
+	vc.Increment(kv.Gossip.Self.ID)
+	// Com a troca de nós, o Vector Clock acumularia contadores de nós que não escrevem mais
+	if pruned := vc.Prune(kv.ClockEntries); pruned > 0 {
+		replicationLog.Info("Pruned least recently updated entries from the VectorClock", "op", "put", "key", logKey(key), "pruned", pruned)
+	}
+	// O mesmo horário acompanha a versão em todas as réplicas (last-write-wins)
+	now := time.Now()
+
+	outcomes := make([]ReplicaOutcome, len(live))
+	for i, node := range live {
+		if node.ID == kv.Gossip.Self.ID {
+			if err := kv.checkSiblingLimit(key, vc); err != nil {
+				kv.Mutex.Unlock()
+				unlock()
+				return result, err
+			}
+			start := time.Now()
+			kv.storeLocal(key, value, vc, now)
+			outcomes[i] = newReplicaOutcome(node.ID, start, nil)
+		}
+	}
+	kv.Mutex.Unlock()
+	unlock()
+
+	// Com ack rápido, a escrita é confirmada depois de gravada no commit log, e as outras
+	// réplicas a recebem em segundo plano (ver fastack.go)
+	if kv.fastAckable(level, live) {
+		err := kv.commitLog.append(key, value, vc, now)
+		if err == nil {
+			kv.replicateInBackground(result, preference, live, down, outcomes, value, vc, now)
+			return result, nil
+		}
+		replicationLog.Warn("Failed to write the commit log, replicating before the ack", "op", "put", "key", logKey(key), "err", err)
+	}
+	return result, kv.replicateWrite(result, preference, live, down, outcomes, value, vc, now, level)
+}
+
+// Retorna a lista de preferência da chave e as réplicas dela separadas entre vivas e fora.
+// Réplicas com phi acima do limiar de suspeita recebem a escrita como hint, sem esperar o timeout.
+func (kv *KeyValueStore) writeTargets(key string, n int) (preference PreferenceList, live, down []*Node) {
+	preference = kv.ConsistentHash.GetPreferenceList(key, n)
+	for _, node := range preference.Replicas {
+		if kv.Gossip.IsNodeAvailable(node.ID) {
+			live = append(live, node)
+		} else {
+			down = append(down, node)
+		}
+	}
+	return preference, live, down
+}
+
+// Envia a versão às réplicas vivas além do nó local (cuja cópia já está em outcomes), guarda
+// hints para as que falharem ou estiverem fora e confere as confirmações exigidas por level
+func (kv *KeyValueStore) replicateWrite(result *PutResult, preference PreferenceList, live, down []*Node, outcomes []ReplicaOutcome, value string, vc *vectorclock.VectorClock, now time.Time, level ConsistencyLevel) error {
+	key := result.Key
+	n := result.Requested
+
+	// Envia para as outras réplicas em paralelo, limitado pelo pool de workers de réplica.
+	// Nenhum lock é mantido durante o envio: a réplica remota pode estar aplicando uma escrita nossa.
+	runBounded(kv.Workers.ReplicaWorkers, len(live), func(i int) {
+		node := live[i]
+		if node.ID == kv.Gossip.Self.ID {
+			return
+		}
+		start := time.Now()
+		err := kv.Gossip.SendReplica(node, key, value, vc, now)
+		outcomes[i] = newReplicaOutcome(node.ID, start, err)
+	})
+
+	var rejected error
+	for i, outcome := range outcomes {
+		result.Outcomes = append(result.Outcomes, outcome)
+		// Uma réplica que recusou a versão pelo limite de irmãs não recebe hint, que a gravaria
+		if errors.Is(outcome.Err, ErrTooManySiblings) {
+			replicationLog.Info("Replica rejected the write, too many siblings", "op", "put", "key", logKey(key), "peer", outcome.NodeID)
+			rejected = outcome.Err
+			continue
+		}
+		if outcome.Err != nil {
+			replicationLog.Warn("Failed to replicate key", "op", "put", "key", logKey(key), "peer", outcome.NodeID, "err", outcome.Err)
+			down = append(down, live[i])
+			continue
+		}
+		result.Replicas++
+		result.Written = append(result.Written, outcome.NodeID)
+	}
 
-	vnode := kv.ConsistentHash.GetNode(key)
+	// Se o nó responsável pela chave está offline, fazer hinted handoff: o hint vai para o
+	// próximo standby saudável (sloppy quorum) ou, sem standby, fica com o coordenador
+	if len(down) > 0 && kv.Degradation == DegradeHint {
+		hints := make([]*Hint, len(down))
+		for i, node := range down {
+			hints[i] = &Hint{
+				Key:         key,
+				Value:       value,
+				VectorClock: vc,
+				TargetID:    node.ID,
+				Timestamp:   now,
+			}
+		}
+		result.Standbys = kv.handOffToStandbys(hints, kv.availableStandbys(preference))
+		result.Hinted = len(hints)
+	}
 
-	// Se o nó responsável pela chave está offline, fazer hinted handoff
-	if !kv.Gossip.IsNodeAlive(vnode.ID) {
-		log.Printf("Node %s is down. Storing hinted handoff for key %s", vnode.ID, key)
-		kv.HintedData[key] = &Hint{
-			Key:       key,
-			Value:     value,
-			TargetID:  vnode.ID,
-			Timestamp: time.Now(),
+	if result.Degraded() {
+		replicationLog.Warn("Degraded write", "op", "put", "key", logKey(key), "result", result.String())
+	}
+
+	if w, acks := level.required(n, kv.writeQuorum()), result.Replicas+len(result.Standbys); acks < w {
+		if rejected != nil {
+			return rejected
 		}
-		return
+		return &QuorumError{Op: "write", Key: key, Required: w, Acks: acks, Replicas: result.Outcomes}
 	}
+	return nil
+}
+
+// Grava uma versão da chave na memória e no disco do nó local. Deve ser chamada com o Mutex obtido.
+func (kv *KeyValueStore) storeLocal(key, value string, vc *vectorclock.VectorClock, writtenAt time.Time) {
+	// Escritas novas já chegam no formato mais recente do bucket
+	schemaVersion := kv.latestSchemaVersion(BucketOf(key))
 
-	// Se a chave já existe, faz merge dos vector clocks
-	if item, exists := kv.Data[key]; exists {
-		item.VectorClock.Increment(kv.Gossip.Self.ID) // Incrementa o Vector Clock local
-		log.Printf("Updated key %s with new value. VectorClock: %s", key, item.VectorClock.String())
-		item.Value = value
+	if item, exists := kv.loadItem(key); exists {
+		// Irmãs que a nova versão não supera são tratadas pela estratégia de resolução
+		item.addVersion(key, value, vc, writtenAt, schemaVersion, kv.resolverFor(key, item, vc))
+		replicationLog.Debug("Updated key", "op", "put", "key", logKey(key), "clock", vc.String())
 	} else {
-		// Se for um novo dado, cria um Vector Clock e adiciona
-		vc := vectorclock.NewVectorClock()
-		vc.Increment(kv.Gossip.Self.ID)
-		kv.Data[key] = &DataItem{
-			Value:       value,
-			VectorClock: vc,
-		}
-		log.Printf("Stored key %s with initial VectorClock: %s", key, vc.String())
+		kv.Data.Set(key, &DataItem{
+			Value:         value,
+			VectorClock:   vc,
+			SchemaVersion: schemaVersion,
+			WrittenAt:     writtenAt,
+		})
+		replicationLog.Debug("Stored new key", "op", "put", "key", logKey(key), "clock", vc.String())
 	}
 
-	// Persistir o dado no disco usando páginas
-	kv.writeDataToDisk(key, value)
+	// O dado é persistido no disco pelo próximo Flush
+	kv.dirty[key] = true
+	kv.logApplied(key, value, vc)
+	kv.touchCache(key)
 }
 
-func (kv *KeyValueStore) Get(key string) (string, *vectorclock.VectorClock, bool) {
+// Aplica uma escrita recebida de outro nó (coordenador ou hinted handoff), gravada pelo
+// coordenador em writtenAt (zero = desconhecido, vale o horário do recebimento).
+// Usa somente o lock da chave e trechos curtos do Mutex, sem esperar escritas de clientes em outras chaves.
+// Retorna false quando a versão local é mais recente ou a escrita foi descartada na resolução de conflito.
+func (kv *KeyValueStore) ApplyReplica(key, value string, vc *vectorclock.VectorClock, writtenAt time.Time) bool {
+	if state, exists := kv.Gossip.bucketState(BucketOf(key)); exists && state.Dropped {
+		replicationLog.Info("Ignoring write to a dropped bucket", "op", "replicate", "key", logKey(key), "bucket", BucketOf(key))
+		return false
+	}
+
+	unlock := kv.keys.lock(key)
+	defer unlock()
+
+	if !kv.ResolveConflicts(key, value, vc, writtenAt) {
+		return false
+	}
+
+	kv.Mutex.Lock()
+	defer kv.Mutex.Unlock()
+	kv.dirty[key] = true
+	return true
+}
+
+// Persiste numa nova SSTable todas as chaves alteradas desde o último Flush
+func (kv *KeyValueStore) Flush() error {
 	kv.Mutex.Lock()
 	defer kv.Mutex.Unlock()
 
-	vnode := kv.ConsistentHash.GetNode(key)
+	return kv.flushLocked()
+}
 
-	// Verifica se o nó responsável está online
-	if kv.Gossip.IsNodeAlive(vnode.ID) {
-		if item, exists := kv.Data[key]; exists {
-			return item.Value, item.VectorClock, true
-		}
-		log.Printf("Key %s not found in node %s", key, vnode.ID)
-	} else {
-		log.Printf("Node %s is down. Key %s might be in hinted handoff.", vnode.ID, key)
+func (kv *KeyValueStore) flushLocked() error {
+	if kv.closed {
+		return nil
 	}
 
-	// Se não estiver na memória, tenta carregar do disco
-	value, found := kv.readDataFromDisk(key)
-	if found {
-		return value, nil, true
+	records := make([]ssRecord, 0, len(kv.dirty))
+	for key := range kv.dirty {
+		// Chaves dos buckets de cache ficam só na memória
+		if item, exists := kv.Data.Get(key); exists && !kv.Gossip.IsCacheBucket(BucketOf(key)) {
+			records = append(records, newSSRecord(key, item))
+		} else {
+			delete(kv.dirty, key)
+		}
+	}
+	// As escritas do commit log estão todas entre as chaves alteradas (ou nos buckets de cache)
+	if len(records) == 0 {
+		return kv.commitLog.truncate()
 	}
 
-	return "", nil, false
+	if err := kv.LSM.WriteParallel(records, nil, kv.Workers.FlushWorkers); err != nil {
+		return err
+	}
+	clear(kv.dirty)
+	storageLog.Debug("Flushed keys to disk", "keys", len(records))
+	kv.requestCompaction()
+	return kv.commitLog.truncate()
 }
 
-// Função para ler dados de uma página do disco
-func (kv *KeyValueStore) readDataFromDisk(key string) (string, bool) {
-	pageID := kv.getPageIDForKey(key)
+// Persiste os dados pendentes e fecha as SSTables
+func (kv *KeyValueStore) Close() error {
+	kv.Mutex.Lock()
+	defer kv.Mutex.Unlock()
 
-	page, err := kv.PageManager.ReadPage(pageID)
-	if err != nil {
-		log.Printf("Error reading page for key %s: %v", key, err)
-		return "", false
+	if kv.closed {
+		return nil
+	}
+	if err := kv.flushLocked(); err != nil {
+		return err
 	}
 
-	value := string(page.Buffer)
-	log.Printf("Read key %s from disk", key)
-	return value, true
+	kv.closed = true
+	kv.saveHotKeys()
+	kv.hints.close()
+	kv.commitLog.close()
+	if kv.CaptureLog != nil {
+		kv.CaptureLog.Close()
+	}
+	if kv.AuditLog != nil {
+		kv.AuditLog.Close()
+	}
+	return kv.LSM.Close()
 }
 
-// Função que mapeia uma chave para um ID de página
-func (kv *KeyValueStore) getPageIDForKey(key string) int64 {
-	return int64(len(key)) // Exemplo simples de mapeamento de chave para página
+// Função de loop para persistir periodicamente os dados alterados
+func (kv *KeyValueStore) StartFlusher(ctx context.Context) {
+	kv.every(ctx, kv.FlushInterval, func() {
+		if err := kv.Flush(); err != nil {
+			storageLog.Error("Error flushing data to disk", "err", err)
+		}
+	})
 }
 
-// Função para processar hinted handoff e reenviar dados para o nó de destino quando ele voltar
-func (kv *KeyValueStore) StartHintedHandoff() {
-	ticker := time.NewTicker(kv.HandoffInterval)
-	for range ticker.C {
-		kv.processHintedHandoff()
+// Lê a chave de R réplicas (ou das exigidas por level) e reconcilia as versões recebidas pelos
+// Vector Clocks. A cópia local conta como uma resposta quando este nó é réplica da chave.
+func (kv *KeyValueStore) Get(key string, level ConsistencyLevel, caller Caller) (*GetResult, error) {
+	if err := kv.Gossip.authorizeCaller(caller, AccessRead, key); err != nil {
+		return nil, err
 	}
+	kv.capture(CapturedGet, key, "", level)
+	n := kv.replicationFactor()
+	r := level.required(n, kv.readQuorum())
+	result := &GetResult{Key: key, Coordinator: kv.Gossip.Self.ID, Requested: n, Required: r}
+	// Vale para todas as respostas, inclusive as servidas de dados guardados para réplicas fora
+	defer func() { result.Pending = kv.durability.isPending(key, result.VectorClock) }()
+	// Uma leitura mais forte que o R configurado não confia em ausências vistas por leituras mais fracas
+	if kv.NegativeCacheTTL > 0 && r <= kv.readQuorum() && kv.negatives.contains(key) {
+		result.Cached = true
+		return result, nil
+	}
+	generation := kv.negatives.generation(key)
+
+	var versions []replicaVersion
+	var outcomes []ReplicaOutcome
+	var remote []*Node
+	preference := kv.ConsistentHash.GetPreferenceList(key, n)
+	for _, node := range preference.Replicas {
+		switch {
+		case node.ID == kv.Gossip.Self.ID:
+			start := time.Now()
+			kv.hotKeys.record(key)
+			versions = append(versions, kv.localVersion(key))
+			outcomes = append(outcomes, newReplicaOutcome(node.ID, start, nil))
+		case kv.Gossip.IsNodeAlive(node.ID):
+			remote = append(remote, node)
+		default:
+			outcomes = append(outcomes, ReplicaOutcome{NodeID: node.ID, Status: ReplicaSkipped})
+		}
+	}
+
+	// Consulta as réplicas remotas em paralelo e para assim que houver R respostas;
+	// as consultas restantes terminam sozinhas, limitadas pelo timeout de réplica
+	if len(versions) < r && len(remote) > 0 {
+		type answer struct {
+			version replicaVersion
+			outcome ReplicaOutcome
+		}
+		answers := make(chan answer, len(remote))
+		slots := make(chan struct{}, max(kv.Workers.ReplicaWorkers, 1))
+		for _, node := range remote {
+			go func() {
+				slots <- struct{}{}
+				defer func() { <-slots }()
+
+				start := time.Now()
+				version, err := kv.Gossip.FetchReplica(node, key)
+				answers <- answer{version: version, outcome: newReplicaOutcome(node.ID, start, err)}
+			}()
+		}
+
+		for range remote {
+			a := <-answers
+			outcomes = append(outcomes, a.outcome)
+			if a.outcome.Err != nil {
+				replicationLog.Warn("Failed to fetch key", "op", "get", "key", logKey(key), "peer", a.outcome.NodeID, "err", a.outcome.Err)
+				continue
+			}
+			versions = append(versions, a.version)
+			if len(versions) >= r {
+				break
+			}
+		}
+	}
+
+	result.Responses = len(versions)
+	if len(versions) < r {
+		if kv.staleReadAllowed(level, outcomes) && kv.serveStale(key, preference, versions, result) {
+			return result, nil
+		}
+		return result, &QuorumError{Op: "read", Key: key, Required: r, Acks: len(versions), Replicas: outcomes}
+	}
+
+	siblings := concurrentVersions(versions)
+	if len(siblings) == 0 {
+		if kv.staleReadAllowed(level, outcomes) && kv.serveStale(key, preference, versions, result) {
+			return result, nil
+		}
+		if kv.NegativeCacheTTL > 0 {
+			kv.negatives.add(key, kv.NegativeCacheTTL, generation)
+		}
+		return result, nil
+	}
+	if len(siblings) > 1 {
+		found := siblings
+		if siblings = kv.resolveVersions(key, found); len(siblings) == 1 {
+			replicationLog.Info("Read found concurrent versions, resolved them", "op", "get", "key", logKey(key), "versions", len(found), "strategy", kv.conflictResolver().Name())
+			kv.emitConflict(ConflictEvent{
+				Kind:     ConflictResolved,
+				Key:      key,
+				Clocks:   eventClocks(versionClocks(found)...),
+				Strategy: kv.conflictResolver().Name(),
+				Winner:   eventClocks(siblings[0].VectorClock)[0],
+			})
+		}
+	}
+	latest := principalVersion(siblings)
+	result.ServedBy, result.WrittenAt = latest.NodeID, latest.WrittenAt
+	if len(siblings) > 1 {
+		replicationLog.Info("Read found concurrent versions", "op", "get", "key", logKey(key), "versions", len(siblings))
+		clocks := make([]*vectorclock.VectorClock, 0, len(siblings))
+		for _, sibling := range siblings {
+			result.Siblings = append(result.Siblings, Sibling{Value: sibling.Value, VectorClock: sibling.VectorClock, WrittenAt: sibling.WrittenAt})
+			clocks = append(clocks, sibling.VectorClock)
+		}
+		kv.emitConflict(ConflictEvent{
+			Kind:     ConflictSiblings,
+			Key:      key,
+			Clocks:   eventClocks(clocks...),
+			Strategy: StrategyClockWeight,
+			Winner:   eventClocks(latest.VectorClock)[0],
+		})
+		// O Vector Clock devolvido junta os de todas as irmãs: é o contexto de um resolve
+		latest.VectorClock = mergedClock(siblings)
+	}
+	// Um tombstone é devolvido como chave inexistente, mas ainda é propagado pelo read repair
+	if latest.Value != "" {
+		result.Found = true
+		result.Value, result.VectorClock, result.Checksum = latest.Value, latest.VectorClock, ValueChecksum(latest.Value)
+	} else if kv.NegativeCacheTTL > 0 {
+		kv.negatives.add(key, kv.NegativeCacheTTL, generation)
+	}
+
+	// Devolve às réplicas as versões que faltam a cada uma sem atrasar a leitura
+	if missing := missingVersions(siblings, versions); len(missing) > 0 {
+		result.Repaired = len(missing)
+		go kv.readRepair(key, missing)
+	}
+	return result, nil
 }
 
-// Processa hinted handoffs e tenta reenviar os dados para o nó original
-func (kv *KeyValueStore) processHintedHandoff() {
+// Retorna a versão local de uma chave, da memória ou, se não estiver nela, do disco
+func (kv *KeyValueStore) localVersion(key string) replicaVersion {
+	version := kv.memoryVersion(key)
+	if version.Found {
+		return version
+	}
+	if state, exists := kv.Gossip.bucketState(BucketOf(key)); exists && state.Dropped {
+		return version
+	}
+
+	kv.Mutex.Lock()
+	_, loaded := kv.loadItem(key)
+	kv.Mutex.Unlock()
+	if !loaded {
+		return version
+	}
+	return kv.memoryVersion(key)
+}
+
+// Retorna a versão da chave guardada na memória deste nó, com uma cópia do Vector Clock
+func (kv *KeyValueStore) memoryVersion(key string) replicaVersion {
 	kv.Mutex.Lock()
 	defer kv.Mutex.Unlock()
 
-	for key, hint := range kv.HintedData {
-		if kv.Gossip.IsNodeAlive(hint.TargetID) {
-			log.Printf("Reapplying hinted handoff for key %s to node %s", key, hint.TargetID)
-			kv.Data[key] = &DataItem{
-				Value: hint.Value,
+	version := replicaVersion{NodeID: kv.Gossip.Self.ID}
+	if item, exists := kv.Data.Get(key); exists {
+		version.VectorClock = vectorclock.NewVectorClock()
+		version.VectorClock.Merge(item.VectorClock)
+		version.Value, version.WrittenAt, version.Found = kv.currentValue(key, item), item.WrittenAt, true
+		// Versões cobertas pela remoção ou truncamento do bucket ou por um range tombstone valem como tombstones
+		if kv.versionRemoved(key, item.WrittenAt) {
+			version.Value = ""
+		}
+		for _, s := range item.Siblings {
+			sibling := replicaVersion{NodeID: version.NodeID, Value: s.Value, VectorClock: vectorclock.NewVectorClock(), WrittenAt: s.WrittenAt, Found: true}
+			sibling.VectorClock.Merge(s.VectorClock)
+			if kv.versionRemoved(key, s.WrittenAt) {
+				sibling.Value = ""
 			}
-			delete(kv.HintedData, key) // Remove o hint após a transferência
-		} else {
-			log.Printf("Node %s still down, keeping hinted handoff for key %s", hint.TargetID, key)
+			version.Siblings = append(version.Siblings, sibling)
 		}
+		kv.touchCache(key)
 	}
+	return version
 }
 
-// Função para resolver conflitos de escrita concorrente usando Vector Clocks
-func (kv *KeyValueStore) ResolveConflicts(key string, newValue string, newVectorClock *vectorclock.VectorClock) {
+// Retorna a versão local de uma chave (usada para responder a outras réplicas)
+func (kv *KeyValueStore) LocalGet(key string) (string, *vectorclock.VectorClock, bool) {
 	kv.Mutex.Lock()
 	defer kv.Mutex.Unlock()
 
-	if item, exists := kv.Data[key]; exists {
-		comparison := item.VectorClock.Compare(newVectorClock)
-		switch comparison {
-		case -1: // Novo dado é mais recente
-			log.Printf("Key %s updated with more recent value. New VectorClock: %s", key, newVectorClock.String())
-			item.Value = newValue
-			item.VectorClock.Merge(newVectorClock)
-		case 0: // Conflito detectado
-			log.Printf("Conflict detected for key %s. Keeping both versions.", key)
-		case 1: // Dado existente é mais recente, nenhuma atualização aplicada
-			log.Printf("Existing value for key %s is more recent. No update applied.", key)
+	item, exists := kv.Data.Get(key)
+	if !exists || item.Deleted() || kv.versionRemoved(key, item.WrittenAt) {
+		return "", nil, false
+	}
+	kv.touchCache(key)
+	vc := vectorclock.NewVectorClock()
+	vc.Merge(item.VectorClock)
+	return kv.currentValue(key, item), vc, true
+}
+
+// Verifica se a chave pode ser gravada. Nos quadros binários os campos são delimitados pelo
+// tamanho, então a chave pode ter espaços e bytes quaisquer; num nó com TextProtocol, que separa
+// os campos por espaços, ela não chegaria inteira às outras réplicas (ver wire.go)
+func (g *Gossip) ValidateKey(key string) error {
+	return g.validateData("key", key)
+}
+
+// Verifica se o valor pode ser gravado (o valor vazio é reservado aos tombstones)
+func (g *Gossip) ValidateValue(value string) error {
+	return g.validateData("value", value)
+}
+
+func (g *Gossip) validateData(field, s string) error {
+	if s == "" {
+		return fmt.Errorf("%s must not be empty", field)
+	}
+	if g.TextProtocol && strings.IndexFunc(s, unicode.IsSpace) >= 0 {
+		return fmt.Errorf("%s must not contain whitespace while the node uses the text protocol", field)
+	}
+	return nil
+}
+
+// Verifica um nome usado nas configurações, como o de um token ou de um bucket
+func validateField(field, s string) error {
+	if s == "" {
+		return fmt.Errorf("%s must not be empty", field)
+	}
+	if strings.IndexFunc(s, unicode.IsSpace) >= 0 {
+		return fmt.Errorf("%s must not contain whitespace", field)
+	}
+	return nil
+}
+
+// Retorna, em ordem e sem repetição, as chaves locais do intervalo [start, end) maiores que
+// after (end vazio = sem limite, after vazio = desde o início): as da memória e as que só estão
+// nas SSTables
+func (kv *KeyValueStore) localKeys(start, end, after string) []string {
+	var keys []string
+	kv.Mutex.Lock()
+	kv.ascendRange(max(start, after), end, func(key string, item *DataItem) {
+		if key > after {
+			keys = append(keys, key)
 		}
-	} else {
-		kv.Data[key] = &DataItem{
-			Value:       newValue,
-			VectorClock: newVectorClock,
+	})
+	kv.Mutex.Unlock()
+
+	seen := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		seen[key] = true
+	}
+	for _, key := range kv.LSM.Keys() {
+		if key >= start && (end == "" || key < end) && key > after && !seen[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Retorna a versão da chave na memória ou, se ela só está nas SSTables (foi gravada antes do
+// restart), carrega para a memória a versão do disco, com o Vector Clock e as irmãs gravados.
+// Deve ser chamada com o Mutex obtido.
+func (kv *KeyValueStore) loadItem(key string) (*DataItem, bool) {
+	if item, exists := kv.Data.Get(key); exists {
+		return item, true
+	}
+	// Uma chave de cache fora da memória foi descartada; a cópia no disco é de antes do modo cache
+	if kv.Gossip.IsCacheBucket(BucketOf(key)) {
+		return nil, false
+	}
+
+	record, found, err := kv.LSM.Get(key)
+	if err != nil {
+		storageLog.Error("Error reading key from disk", "key", logKey(key), "err", err)
+		return nil, false
+	}
+	if !found {
+		return nil, false
+	}
+	item := record.dataItem()
+	kv.Data.Set(key, item)
+	storageLog.Debug("Loaded key from disk", "key", logKey(key), "clock", item.VectorClock.String())
+	return item, true
+}
+
+// Função para processar hinted handoff e reenviar dados para o nó de destino quando ele voltar
+func (kv *KeyValueStore) StartHintedHandoff(ctx context.Context) {
+	kv.every(ctx, kv.HandoffInterval, kv.processHintedHandoff)
+}
+
+// Função para resolver conflitos de escrita concorrente usando Vector Clocks e a estratégia de
+// resolução configurada. Retorna se o novo valor foi aplicado.
+func (kv *KeyValueStore) ResolveConflicts(key string, newValue string, newVectorClock *vectorclock.VectorClock, writtenAt time.Time) bool {
+	if writtenAt.IsZero() {
+		writtenAt = time.Now()
+	}
+	// O evento de conflito é publicado depois de liberar o Mutex
+	var conflict *ConflictEvent
+	defer func() {
+		if conflict != nil {
+			kv.emitConflict(*conflict)
 		}
-		log.Printf("Stored new key %s with VectorClock: %s", key, newVectorClock.String())
+	}()
+
+	kv.Mutex.Lock()
+	defer kv.Mutex.Unlock()
+
+	if item, exists := kv.loadItem(key); exists {
+		local := item.VectorClock
+		resolver := kv.resolverFor(key, item, newVectorClock)
+		applied, detected := item.addVersion(key, newValue, newVectorClock, writtenAt, kv.latestSchemaVersion(BucketOf(key)), resolver)
+		if detected {
+			conflict = &ConflictEvent{
+				Kind:     ConflictDetected,
+				Key:      key,
+				Clocks:   eventClocks(local, newVectorClock),
+				Strategy: resolver.Name(),
+			}
+			if len(item.Siblings) == 0 {
+				conflict.Winner = eventClocks(item.VectorClock)[0]
+			}
+		}
+		switch {
+		case detected && !applied: // A estratégia manteve a versão local
+			replicationLog.Info("Conflict detected, strategy kept the local version", "op", "replicate", "key", logKey(key), "strategy", resolver.Name())
+			return false
+		case !applied: // Uma versão local é igual ou mais recente
+			replicationLog.Debug("Key already has this version or a more recent one, no update applied", "op", "replicate", "key", logKey(key), "clock", newVectorClock.String())
+			return false
+		case detected && len(item.Siblings) > 0: // Conflito detectado, versões guardadas como irmãs
+			replicationLog.Info("Conflict detected, keeping the received version as a sibling", "op", "replicate", "key", logKey(key), "versions", len(item.Siblings)+1)
+		case detected:
+			replicationLog.Info("Conflict detected and resolved", "op", "replicate", "key", logKey(key), "strategy", resolver.Name(), "clock", item.VectorClock.String())
+		default: // Novo dado é mais recente
+			replicationLog.Debug("Key updated with a more recent value", "op", "replicate", "key", logKey(key), "clock", newVectorClock.String())
+		}
+		kv.logApplied(key, newValue, newVectorClock)
+		kv.touchCache(key)
+		kv.negatives.invalidate(key)
+		return true
 	}
+
+	kv.Data.Set(key, &DataItem{
+		Value:         newValue,
+		VectorClock:   newVectorClock,
+		SchemaVersion: kv.latestSchemaVersion(BucketOf(key)),
+		WrittenAt:     writtenAt,
+	})
+	replicationLog.Debug("Stored new key", "op", "replicate", "key", logKey(key), "clock", newVectorClock.String())
+	kv.logApplied(key, newValue, newVectorClock)
+	kv.touchCache(key)
+	kv.negatives.invalidate(key)
+	return true
 }
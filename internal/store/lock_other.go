@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd
+
+package store
+
+import "os"
+
+// O lock de diretórios não é suportado nesta plataforma: o diretório é sempre considerado livre
+func lockFile(file *os.File) (ok bool, err error) {
+	return true, nil
+}
@@ -0,0 +1,17 @@
+//go:build linux || darwin || freebsd
+
+package store
+
+import (
+	"os"
+	"syscall"
+)
+
+// Obtém um lock exclusivo no arquivo, sem esperar; ok é false se outro processo o tem
+func lockFile(file *os.File) (ok bool, err error) {
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return false, nil
+	}
+	return err == nil, err
+}
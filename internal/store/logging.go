@@ -0,0 +1,171 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// Os logs do nó são estruturados (log/slog): cada módulo tem o próprio logger, com o campo
+// module, e as mensagens levam campos como peer (o par envolvido), key (a chave e o hash dela)
+// e op (a operação). O nível pode ser ajustado por módulo, o que permite, por exemplo, silenciar
+// o gossip e manter os erros do armazenamento. Os loggers dos módulos são criados na
+// inicialização do pacote e consultam a configuração atual a cada mensagem, então
+// ConfigureLogging vale também para eles.
+
+// Módulos com logger próprio
+const (
+	ModuleGossip      = "gossip"      // Membros, detecção de falhas, eleição e conexões entre nós
+	ModuleReplication = "replication" // Réplicas, hints, reparos, rebalanceamento e conflitos
+	ModuleStorage     = "storage"     // LSM, SSTables, arquivo de páginas e camada fria
+	ModuleCluster     = "cluster"     // Configuração do cluster, jobs e desligamento
+)
+
+// Loggers dos módulos do pacote
+var (
+	gossipLog      = Logger(ModuleGossip)
+	replicationLog = Logger(ModuleReplication)
+	storageLog     = Logger(ModuleStorage)
+	clusterLog     = Logger(ModuleCluster)
+)
+
+// LogConfig configura os logs do processo
+type LogConfig struct {
+	Output io.Writer // Destino dos logs (nil = stderr)
+	Level  string    // Nível padrão e por módulo, ex.: "info" ou "warn,gossip=error,storage=debug"
+	Format string    // text (padrão, chave=valor) ou json (uma mensagem JSON por linha)
+	NodeID string    // Incluído em todas as mensagens como node
+}
+
+// Configuração atual dos logs
+type logSettings struct {
+	handler slog.Handler
+	level   slog.Level
+	modules map[string]slog.Level
+}
+
+var currentLogSettings atomic.Pointer[logSettings]
+
+func init() {
+	currentLogSettings.Store(&logSettings{handler: slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug})})
+}
+
+// Aplica a configuração dos logs aos loggers de todos os módulos
+func ConfigureLogging(config LogConfig) error {
+	level, modules, err := ParseLogLevels(config.Level)
+	if err != nil {
+		return err
+	}
+	output := config.Output
+	if output == nil {
+		output = os.Stderr
+	}
+	// O nível é verificado por módulo em moduleHandler; o handler de saída aceita tudo
+	options := &slog.HandlerOptions{Level: slog.LevelDebug}
+	var handler slog.Handler
+	switch config.Format {
+	case "", "text":
+		handler = slog.NewTextHandler(output, options)
+	case "json":
+		handler = slog.NewJSONHandler(output, options)
+	default:
+		return fmt.Errorf("invalid log format %q (use text or json)", config.Format)
+	}
+	if config.NodeID != "" {
+		handler = handler.WithAttrs([]slog.Attr{slog.String("node", config.NodeID)})
+	}
+	currentLogSettings.Store(&logSettings{handler: handler, level: level, modules: modules})
+
+	// As mensagens do pacote log (erros fatais da inicialização) saem pelo mesmo handler
+	log.SetFlags(0)
+	log.SetOutput(slog.NewLogLogger(Logger("main").Handler(), slog.LevelError).Writer())
+	return nil
+}
+
+// Interpreta os níveis dos logs: um nível padrão e níveis por módulo (<módulo>=<nível>),
+// separados por vírgulas; sem o nível padrão, vale info
+func ParseLogLevels(spec string) (slog.Level, map[string]slog.Level, error) {
+	level := slog.LevelInfo
+	modules := make(map[string]slog.Level)
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		module, name, scoped := strings.Cut(part, "=")
+		if !scoped {
+			name = part
+		}
+		var parsed slog.Level
+		if err := parsed.UnmarshalText([]byte(name)); err != nil {
+			return 0, nil, fmt.Errorf("invalid log level %q (use debug, info, warn or error)", name)
+		}
+		if !scoped {
+			level = parsed
+			continue
+		}
+		if module = strings.TrimSpace(module); module == "" {
+			return 0, nil, fmt.Errorf("invalid log level %q (use <module>=<level>)", part)
+		}
+		modules[module] = parsed
+	}
+	return level, modules, nil
+}
+
+// Retorna o logger de um módulo, que segue a configuração de ConfigureLogging mesmo se ela
+// for aplicada depois
+func Logger(module string) *slog.Logger {
+	return slog.New(&moduleHandler{module: module})
+}
+
+// moduleHandler filtra as mensagens pelo nível do módulo e as entrega ao handler configurado
+type moduleHandler struct {
+	module string
+	wrap   []func(slog.Handler) slog.Handler // WithAttrs e WithGroup aplicados ao logger, em ordem
+}
+
+func (h *moduleHandler) Enabled(_ context.Context, level slog.Level) bool {
+	settings := currentLogSettings.Load()
+	minimum, scoped := settings.modules[h.module]
+	if !scoped {
+		minimum = settings.level
+	}
+	return level >= minimum
+}
+
+func (h *moduleHandler) Handle(ctx context.Context, record slog.Record) error {
+	handler := currentLogSettings.Load().handler.WithAttrs([]slog.Attr{slog.String("module", h.module)})
+	for _, wrap := range h.wrap {
+		handler = wrap(handler)
+	}
+	return handler.Handle(ctx, record)
+}
+
+func (h *moduleHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(handler slog.Handler) slog.Handler { return handler.WithAttrs(attrs) })
+}
+
+func (h *moduleHandler) WithGroup(name string) slog.Handler {
+	return h.with(func(handler slog.Handler) slog.Handler { return handler.WithGroup(name) })
+}
+
+func (h *moduleHandler) with(wrap func(slog.Handler) slog.Handler) *moduleHandler {
+	wraps := append(h.wrap[:len(h.wrap):len(h.wrap)], wrap)
+	return &moduleHandler{module: h.module, wrap: wraps}
+}
+
+// logKey registra uma chave com o hash dela (a posição no anel sem regra de roteamento), que
+// permite seguir a chave pelos logs de todos os nós
+type logKey string
+
+func (k logKey) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("name", string(k)),
+		slog.String("hash", fmt.Sprintf("%08x", defaultHashFunction(string(k)))),
+	)
+}
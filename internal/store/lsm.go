@@ -0,0 +1,677 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// O armazenamento em disco é uma LSM tree: a memtable (Data) guarda as escritas, e o flush grava
+// as chaves alteradas numa nova SSTable, imutável e ordenada. Uma leitura que não encontra a
+// chave na memória procura nas SSTables da mais nova para a mais antiga. A compactação em
+// segundo plano junta SSTables de tamanhos parecidos (size-tiered) numa só, mantendo somente a
+// versão mais nova de cada chave, e apaga os arquivos substituídos.
+
+// Diretório das SSTables dentro do --data-dir
+const lsmDir = "sstables"
+
+// Arquivo com a lista das SSTables ativas, da mais antiga para a mais nova
+const lsmManifestFile = "MANIFEST"
+
+// Parâmetros da compactação size-tiered
+const (
+	compactionMinTables   = 4       // SSTables de tamanho parecido que disparam uma compactação
+	compactionMaxTables   = 32      // Máximo de SSTables juntadas de uma vez
+	compactionSmallTable  = 1 << 20 // SSTables menores que isto ficam todas na mesma faixa de tamanho
+	flushTableMinRecords  = 10000   // Registros por SSTable a partir dos quais o flush grava em paralelo
+	compactionProgressGap = 1000    // Registros entre as atualizações de progresso da desfragmentação
+)
+
+// errLSMClosed interrompe uma compactação quando o armazenamento é fechado
+var errLSMClosed = errors.New("storage is closed")
+
+// LSMTree guarda as SSTables do nó
+type LSMTree struct {
+	dir        string
+	coldDir    string       // Diretório da camada fria ("" = sem camada fria), alterado com compaction e mutex obtidos
+	mutex      sync.RWMutex // Protege tables e nextID; leituras dos arquivos seguram o RLock
+	tables     []*ssTable   // Da mais antiga para a mais nova
+	nextID     uint64
+	compaction sync.Mutex // Serializa as rodadas de compactação e as mudanças de camada
+	closing    atomic.Bool
+	skipped    atomic.Int64 // Buscas em SSTables evitadas pelos Bloom filters
+	moved      atomic.Int64 // SSTables movidas para a camada fria desde o início
+}
+
+// Formato do MANIFEST
+type lsmManifest struct {
+	NextID  uint64   `json:"next_id"`
+	Tables  []uint64 `json:"tables"`
+	ColdDir string   `json:"cold_dir,omitempty"` // Diretório da camada fria
+	Cold    []uint64 `json:"cold,omitempty"`     // SSTables que estão na camada fria
+}
+
+// Abre as SSTables do diretório e da camada fria, apagando as que não estão no MANIFEST (restos
+// de um flush, de uma compactação ou de uma mudança de camada interrompidos)
+func OpenLSMTree(dir string) (*LSMTree, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	l := &LSMTree{dir: dir, nextID: 1}
+
+	var manifest lsmManifest
+	data, err := os.ReadFile(filepath.Join(dir, lsmManifestFile))
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			return nil, fmt.Errorf("invalid sstable manifest: %w", err)
+		}
+		l.nextID = max(manifest.NextID, 1)
+		l.coldDir = manifest.ColdDir
+	case !errors.Is(err, os.ErrNotExist):
+		return nil, err
+	}
+
+	cold := make(map[uint64]bool)
+	for _, id := range manifest.Cold {
+		cold[id] = true
+	}
+	live := map[bool]map[string]bool{false: {}, true: {}}
+	for _, id := range manifest.Tables {
+		t, err := openSSTable(l.tablePath(id, cold[id]), id)
+		if err != nil {
+			l.closeTables()
+			return nil, err
+		}
+		t.cold = cold[id]
+		l.tables = append(l.tables, t)
+		live[t.cold][sstableName(id)] = true
+	}
+
+	err = removeOrphanTables(dir, live[false])
+	if err == nil && l.coldDir != "" {
+		err = removeOrphanTables(l.coldDir, live[true])
+	}
+	if err != nil {
+		l.closeTables()
+		return nil, err
+	}
+	return l, nil
+}
+
+// Caminho do arquivo de uma SSTable na camada quente ou na fria
+func (l *LSMTree) tablePath(id uint64, cold bool) string {
+	if cold {
+		return filepath.Join(l.coldDir, sstableName(id))
+	}
+	return filepath.Join(l.dir, sstableName(id))
+}
+
+// Apaga do diretório os arquivos de SSTables que não estão em live
+func removeOrphanTables(dir string, live map[string]bool) error {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if (strings.HasSuffix(name, sstableExt) || strings.HasSuffix(name, sstableExt+".tmp")) && !live[name] {
+			storageLog.Warn("Removing sstable that is not in the manifest", "path", filepath.Join(dir, name))
+			os.Remove(filepath.Join(dir, name))
+		}
+	}
+	return nil
+}
+
+// Grava o MANIFEST. Deve ser chamada com o mutex obtido para escrita.
+func (l *LSMTree) saveManifestLocked() error {
+	manifest := lsmManifest{NextID: l.nextID, Tables: make([]uint64, len(l.tables)), ColdDir: l.coldDir}
+	for i, t := range l.tables {
+		manifest.Tables[i] = t.id
+		if t.cold {
+			manifest.Cold = append(manifest.Cold, t.id)
+		}
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(l.dir, lsmManifestFile), data, 0644)
+}
+
+// Reserva o identificador de uma nova SSTable
+func (l *LSMTree) newTableID() uint64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	id := l.nextID
+	l.nextID++
+	return id
+}
+
+// Grava os registros (em qualquer ordem, sem chaves repetidas) e os range tombstones numa nova
+// SSTable, mais nova que todas as existentes
+func (l *LSMTree) Write(records []ssRecord, ranges []*RangeTombstone) error {
+	return l.WriteParallel(records, ranges, 1)
+}
+
+// Como Write, mas divide muitos registros em até workers SSTables gravadas em paralelo. As
+// SSTables de um mesmo flush não têm chaves em comum, então a ordem entre elas não importa.
+func (l *LSMTree) WriteParallel(records []ssRecord, ranges []*RangeTombstone, workers int) error {
+	if len(records) == 0 && len(ranges) == 0 {
+		return nil
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].key < records[j].key })
+
+	parts := max(1, min(workers, len(records)/flushTableMinRecords))
+	if len(ranges) > 0 {
+		// Os range tombstones cobrem as SSTables anteriores, inclusive as do mesmo Write
+		parts = 1
+	}
+	size := (len(records) + parts - 1) / max(parts, 1)
+	tables := make([]*ssTable, parts)
+	errs := make([]error, parts)
+	runBounded(parts, parts, func(i int) {
+		chunk := records[min(i*size, len(records)):min((i+1)*size, len(records))]
+		var chunkRanges []*RangeTombstone
+		if i == parts-1 {
+			chunkRanges = ranges
+		}
+		tables[i], errs[i] = l.writeTable(chunk, chunkRanges)
+	})
+	for i, err := range errs {
+		if err != nil {
+			for _, t := range tables {
+				if t != nil {
+					t.remove()
+				}
+			}
+			return fmt.Errorf("writing sstable %d of %d: %w", i+1, parts, err)
+		}
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.tables = append(l.tables, tables...)
+	return l.saveManifestLocked()
+}
+
+// Grava uma SSTable com registros já ordenados
+func (l *LSMTree) writeTable(records []ssRecord, ranges []*RangeTombstone) (*ssTable, error) {
+	id := l.newTableID()
+	w, err := newSSTableWriter(filepath.Join(l.dir, sstableName(id)))
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		if err := w.add(record); err != nil {
+			return nil, w.abort(err)
+		}
+	}
+	return w.finish(id, ranges)
+}
+
+// Busca a versão mais nova da chave nas SSTables. found é false se nenhuma tem a chave ou se um
+// range tombstone mais novo que a versão a cobre; um tombstone é retornado com found true.
+func (l *LSMTree) Get(key string) (record ssRecord, found bool, err error) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	// Os range tombstones de uma tabela removem as versões das mais antigas gravadas até o
+	// momento deles; removedAt é o mais novo entre os das tabelas já percorridas
+	var removedAt time.Time
+	for i := len(l.tables) - 1; i >= 0; i-- {
+		if l.tables[i].filter.mayContain(key) {
+			record, found, err := l.tables[i].get(key)
+			if found {
+				l.tables[i].used.Store(time.Now().UnixNano())
+			}
+			if err != nil {
+				return record, found, err
+			}
+			if found {
+				if !removedAt.IsZero() && !record.writtenAt.After(removedAt) {
+					return ssRecord{}, false, nil
+				}
+				return record, true, nil
+			}
+		} else {
+			l.skipped.Add(1)
+		}
+		if at := l.tables[i].coveredAt(key); at.After(removedAt) {
+			removedAt = at
+		}
+	}
+	return ssRecord{}, false, nil
+}
+
+// Indica se alguma SSTable tem um registro (valor ou tombstone) visível da chave
+func (l *LSMTree) Contains(key string) bool {
+	_, found, err := l.Get(key)
+	return found && err == nil
+}
+
+// Retorna, em ordem, as chaves com registro (valor ou tombstone) nas SSTables que não foram
+// removidas por range tombstones
+func (l *LSMTree) Keys() []string {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	seen := make(map[string]bool)
+	var keys []string
+	for i := len(l.tables) - 1; i >= 0; i-- {
+		for _, key := range l.tables[i].keys {
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			if !l.coveredAfterLocked(key, i) {
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Indica se um range tombstone de uma SSTable mais nova que a de índice i remove a versão da
+// chave gravada nela
+func (l *LSMTree) coveredAfterLocked(key string, i int) bool {
+	var removedAt time.Time
+	for _, t := range l.tables[i+1:] {
+		if at := t.coveredAt(key); at.After(removedAt) {
+			removedAt = at
+		}
+	}
+	if removedAt.IsZero() {
+		return false
+	}
+	record, found, err := l.tables[i].get(key)
+	if err != nil || !found {
+		return false
+	}
+	return !record.writtenAt.After(removedAt)
+}
+
+// Indica se uma versão da chave gravada em memória em writtenAt foi removida por um range tombstone
+func (l *LSMTree) rangeCovers(key string, writtenAt time.Time) bool {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	for _, t := range l.tables {
+		for _, rt := range t.ranges {
+			if !writtenAt.After(rt.At) && rt.Contains(key) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Retorna uma cópia dos range tombstones ativos
+func (l *LSMTree) RangeTombstones() []RangeTombstone {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	var ranges []RangeTombstone
+	for _, t := range l.tables {
+		for _, rt := range t.ranges {
+			ranges = append(ranges, *rt)
+		}
+	}
+	return ranges
+}
+
+// LSMStats resume as SSTables do nó
+type LSMStats struct {
+	Tables      int   // SSTables ativas
+	Records     int   // Registros em todas elas, incluindo versões substituídas
+	Bytes       int64 // Tamanho dos arquivos
+	FilterBytes int64 // Memória ocupada pelos Bloom filters
+	Skipped     int64 // Buscas em SSTables evitadas pelos Bloom filters desde o início
+	ColdTables  int   // SSTables na camada fria (incluídas em Tables)
+	ColdBytes   int64 // Tamanho dos arquivos da camada fria (incluído em Bytes)
+	Moved       int64 // SSTables movidas para a camada fria desde o início
+}
+
+func (l *LSMTree) Stats() LSMStats {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	stats := LSMStats{Tables: len(l.tables), Skipped: l.skipped.Load(), Moved: l.moved.Load()}
+	for _, t := range l.tables {
+		stats.Records += len(t.keys)
+		stats.Bytes += t.size
+		stats.FilterBytes += int64(len(t.filter.bits))
+		if t.cold {
+			stats.ColdTables++
+			stats.ColdBytes += t.size
+		}
+	}
+	return stats
+}
+
+// Fecha as SSTables, esperando a compactação em andamento parar
+func (l *LSMTree) Close() error {
+	l.closing.Store(true)
+	l.compaction.Lock()
+	defer l.compaction.Unlock()
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.closeTables()
+	return nil
+}
+
+func (l *LSMTree) closeTables() {
+	for _, t := range l.tables {
+		t.file.Close()
+	}
+	l.tables = nil
+}
+
+// Fecha e apaga o arquivo de uma SSTable que deixou de ser usada
+func (t *ssTable) remove() {
+	t.file.Close()
+	if err := os.Remove(t.path); err != nil {
+		storageLog.Error("Error removing obsolete sstable", "path", t.path, "err", err)
+	}
+}
+
+// Retorna as sequências de SSTables vizinhas com tamanhos parecidos que devem ser compactadas.
+// Só SSTables vizinhas são juntadas, para que a SSTable compactada fique no lugar delas na
+// ordem de idade.
+func (l *LSMTree) compactionRuns() [][]*ssTable {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	similar := func(size, average int64) bool {
+		return size < compactionSmallTable && average < compactionSmallTable || size >= average/2 && size <= average*3/2
+	}
+
+	var runs [][]*ssTable
+	for i := 0; i < len(l.tables); {
+		total := l.tables[i].size
+		j := i + 1
+		for j < len(l.tables) && j-i < compactionMaxTables && similar(l.tables[j].size, total/int64(j-i)) {
+			total += l.tables[j].size
+			j++
+		}
+		if j-i < compactionMinTables {
+			i++
+			continue
+		}
+		runs = append(runs, slices.Clone(l.tables[i:j]))
+		i = j
+	}
+	return runs
+}
+
+// Indica se a SSTable é a mais antiga: uma compactação que a inclui não tem versões mais antigas
+// fora dela para esconder
+func (l *LSMTree) isOldest(t *ssTable) bool {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	return len(l.tables) > 0 && l.tables[0] == t
+}
+
+// Junta as SSTables vizinhas de run numa só, com a versão mais nova de cada chave. As versões
+// cobertas por range tombstones de run são descartadas e, se run inclui a SSTable mais antiga,
+// também os tombstones e os range tombstones cujo horário passou do prazo dado por expired; os
+// range tombstones descartados são retornados. step é chamada a cada registro lido e pode
+// interromper a compactação. Se todas as SSTables de run estão na camada fria, a compactada
+// também fica nela.
+func (l *LSMTree) compact(run []*ssTable, expired func(at time.Time) bool, step func() error) ([]*RangeTombstone, error) {
+	bottom := l.isOldest(run[0])
+	cold := !slices.ContainsFunc(run, func(t *ssTable) bool { return !t.cold })
+
+	iterators := make([]*sstableIterator, len(run))
+	for i, t := range run {
+		iterators[i] = t.iterator()
+		iterators[i].advance()
+	}
+
+	var w *sstableWriter
+	id := l.newTableID()
+	l.mutex.RLock()
+	path := l.tablePath(id, cold)
+	l.mutex.RUnlock()
+	abort := func(err error) ([]*RangeTombstone, error) {
+		if w != nil {
+			w.abort(nil)
+		}
+		return nil, err
+	}
+
+	for {
+		if l.closing.Load() {
+			return abort(errLSMClosed)
+		}
+		// A menor chave entre as tabelas; com a mesma chave, vale a tabela mais nova
+		newest := -1
+		for i, it := range iterators {
+			if it.err != nil {
+				return abort(it.err)
+			}
+			if it.valid && (newest < 0 || it.current.key <= iterators[newest].current.key) {
+				newest = i
+			}
+		}
+		if newest < 0 {
+			break
+		}
+		record := iterators[newest].current
+		covered := false
+		for _, t := range run[newest+1:] {
+			covered = covered || t.covers(record.key, record.writtenAt)
+		}
+		for _, it := range iterators {
+			if it.valid && it.current.key == record.key {
+				it.advance()
+			}
+		}
+		if err := step(); err != nil {
+			return abort(err)
+		}
+		if covered || bottom && record.discardable(expired) {
+			continue
+		}
+
+		if w == nil {
+			var err error
+			if w, err = newSSTableWriter(path); err != nil {
+				return nil, err
+			}
+		}
+		if err := w.add(record); err != nil {
+			return abort(err)
+		}
+	}
+
+	var kept, dropped []*RangeTombstone
+	for _, t := range run {
+		for _, rt := range t.ranges {
+			if bottom && expired(rt.At) {
+				dropped = append(dropped, rt)
+			} else {
+				kept = append(kept, rt)
+			}
+		}
+	}
+
+	var output []*ssTable
+	if w != nil || len(kept) > 0 {
+		if w == nil {
+			var err error
+			if w, err = newSSTableWriter(path); err != nil {
+				return nil, err
+			}
+		}
+		t, err := w.finish(id, kept)
+		if err != nil {
+			return nil, err
+		}
+		t.cold = cold
+		output = append(output, t)
+	}
+
+	if err := l.replace(run, output); err != nil {
+		for _, t := range output {
+			t.remove()
+		}
+		return nil, err
+	}
+	for _, t := range run {
+		t.remove()
+	}
+	return dropped, nil
+}
+
+// Troca as SSTables vizinhas de run pelas de output, na mesma posição
+func (l *LSMTree) replace(run, output []*ssTable) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	start := slices.Index(l.tables, run[0])
+	if start < 0 || start+len(run) > len(l.tables) || !slices.Equal(l.tables[start:start+len(run)], run) {
+		return errors.New("compacted sstables are no longer adjacent")
+	}
+	l.tables = slices.Concat(l.tables[:start], output, l.tables[start+len(run):])
+	return l.saveManifestLocked()
+}
+
+// Importa o arquivo de páginas de versões anteriores (uma página por registro) numa SSTable,
+// junto com os range tombstones dele, e o apaga
+func (l *LSMTree) importPageFile(path string) error {
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	pm, err := NewPageManager(path)
+	if err != nil {
+		return err
+	}
+
+	var records []ssRecord
+	for _, key := range pm.Keys() {
+		value, err := pm.ReadValue(key)
+		switch {
+		case errors.Is(err, errNotOnDisk):
+			records = append(records, ssRecord{key: key, tombstone: true, bucket: BucketOf(key)})
+		case err != nil:
+			pm.File.Close()
+			return fmt.Errorf("importing key %s from %s: %w", key, path, err)
+		default:
+			records = append(records, ssRecord{key: key, value: value, bucket: BucketOf(key)})
+		}
+	}
+	// As versões cobertas já ficaram de fora; os range tombstones continuam valendo para as
+	// versões mais antigas que ainda estejam em outras réplicas
+	var ranges []*RangeTombstone
+	for _, rt := range pm.RangeTombstones() {
+		ranges = append(ranges, &rt)
+	}
+	if err := l.Write(records, ranges); err != nil {
+		pm.File.Close()
+		return err
+	}
+
+	pm.File.Close()
+	os.Remove(path)
+	os.Remove(path + pageIndexSuffix)
+	storageLog.Info("Imported keys from page file into an sstable", "keys", len(records), "path", path)
+	return nil
+}
+
+// Sinaliza ao compactador que uma SSTable foi gravada
+func (kv *KeyValueStore) requestCompaction() {
+	select {
+	case kv.compactions <- struct{}{}:
+	default:
+	}
+}
+
+// Função de loop da compactação em segundo plano, acordada a cada flush
+func (kv *KeyValueStore) StartCompactor(ctx context.Context) {
+	kv.requestCompaction()
+	kv.runLoop(ctx, func(ctx context.Context) {
+		for {
+			select {
+			case <-kv.compactions:
+				for ctx.Err() == nil && kv.compactTiers() {
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	})
+}
+
+// Compacta, em paralelo, as sequências de SSTables de tamanhos parecidos. Retorna se alguma
+// foi compactada, o que pode formar novas sequências.
+func (kv *KeyValueStore) compactTiers() bool {
+	kv.LSM.compaction.Lock()
+	defer kv.LSM.compaction.Unlock()
+
+	runs := kv.LSM.compactionRuns()
+	if len(runs) == 0 || kv.LSM.closing.Load() {
+		return false
+	}
+	compacted := false
+	var mutex sync.Mutex
+	runBounded(kv.Workers.CompactionWorkers, len(runs), func(i int) {
+		start := time.Now()
+		dropped, err := kv.LSM.compact(runs[i], kv.tombstoneExpired, func() error { return nil })
+		if err != nil {
+			if !errors.Is(err, errLSMClosed) {
+				storageLog.Error("Error compacting sstables", "sstables", len(runs[i]), "err", err)
+			}
+			return
+		}
+		kv.forgetRangeTombstones(dropped)
+		storageLog.Info("Compacted sstables", "sstables", len(runs[i]), "duration", time.Since(start).Round(time.Millisecond))
+		mutex.Lock()
+		compacted = true
+		mutex.Unlock()
+	})
+	return compacted
+}
+
+// Indica se um tombstone gravado em at passou do TombstoneGrace e pode ser descartado
+func (kv *KeyValueStore) tombstoneExpired(at time.Time) bool {
+	return kv.TombstoneGrace > 0 && at.Before(time.Now().Add(-kv.TombstoneGrace))
+}
+
+// Remove da memória as versões cobertas somente por range tombstones descartados, que deixam de
+// existir junto com eles
+func (kv *KeyValueStore) forgetRangeTombstones(dropped []*RangeTombstone) {
+	if len(dropped) == 0 {
+		return
+	}
+	kv.Mutex.Lock()
+	defer kv.Mutex.Unlock()
+
+	var removed []string
+	for _, rt := range dropped {
+		kv.ascendRange(rt.Start, rt.End, func(key string, item *DataItem) {
+			if !item.WrittenAt.After(rt.At) && !kv.LSM.rangeCovers(key, item.WrittenAt) {
+				removed = append(removed, key)
+			}
+		})
+	}
+	for _, key := range removed {
+		kv.Data.Delete(key)
+		delete(kv.dirty, key)
+	}
+}
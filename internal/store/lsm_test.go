@@ -0,0 +1,74 @@
+package store
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/bquerino/kv-g/internal/vectorclock"
+)
+
+// Um range tombstone remove as versões das SSTables mais antigas gravadas até o momento dele;
+// uma versão mais nova que chegou ao disco antes do tombstone (a réplica de uma escrita feita
+// depois da remoção, recebida antes dela) continua valendo depois do flush, do restart e da
+// compactação
+func TestRangeTombstoneKeepsNewerVersionsOnDisk(t *testing.T) {
+	dir := t.TempDir()
+	open := func() *KeyValueStore {
+		g := NewGossip("node1", "localhost:0", time.Second, 8, dir)
+		t.Cleanup(func() { g.KeyValueStore.Close() })
+		return g.KeyValueStore
+	}
+	at := time.Now()
+	vc := vectorclock.NewVectorClock()
+	vc.Increment("node2")
+
+	kv := open()
+	kv.ApplyReplica("pedidos/1", "antigo", vc, at.Add(-time.Second))
+	kv.ApplyReplica("pedidos/2", "novo", vc, at.Add(time.Second))
+	if err := kv.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Depois do restart, as versões estão só no disco, numa SSTable mais antiga que a do tombstone
+	kv = open()
+	if _, err := kv.DeleteRange("pedidos/", "pedidos0", at); err != nil {
+		t.Fatal(err)
+	}
+	if err := kv.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	expect := func(stage string) {
+		t.Helper()
+		if record, found, err := kv.LSM.Get("pedidos/1"); err != nil || found {
+			t.Fatalf("%s: Get(pedidos/1) = %q, %v, %v; want removed", stage, record.value, found, err)
+		}
+		if record, found, err := kv.LSM.Get("pedidos/2"); err != nil || !found || record.value != "novo" {
+			t.Fatalf("%s: Get(pedidos/2) = %q, %v, %v; want novo", stage, record.value, found, err)
+		}
+		if keys := kv.LSM.Keys(); !slices.Equal(keys, []string{"pedidos/2"}) {
+			t.Fatalf("%s: Keys = %v, want [pedidos/2]", stage, keys)
+		}
+	}
+
+	kv = open()
+	expect("after restart")
+
+	kv.LSM.mutex.RLock()
+	run := slices.Clone(kv.LSM.tables)
+	kv.LSM.mutex.RUnlock()
+	if len(run) < 2 {
+		t.Fatalf("%d sstables, want the data and the tombstone in separate ones", len(run))
+	}
+	if _, err := kv.LSM.compact(run, kv.tombstoneExpired, func() error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	expect("after compaction")
+	if err := kv.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	kv = open()
+	expect("after compaction and restart")
+}
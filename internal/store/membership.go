@@ -0,0 +1,441 @@
+package store
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Retorna o nome do cluster, ou vazio se o cluster não foi inicializado
+func (g *Gossip) clusterName() string {
+	cluster := g.clusterConfig()
+	if cluster == nil {
+		return ""
+	}
+	return cluster.Name
+}
+
+// Retorna o token de entrada do cluster, ou vazio se o cluster não foi inicializado
+func (g *Gossip) clusterToken() string {
+	cluster := g.clusterConfig()
+	if cluster == nil {
+		return ""
+	}
+	return cluster.Token
+}
+
+// Pede a identificação de um nó desconhecido que enviou um PING e, se ele
+// pertencer ao mesmo cluster, o adiciona ao anel (com tokens, só pelo TLS mútuo)
+func (g *Gossip) requestJoinHandshake(conn *peerConn, raw net.Conn, nodeID string) {
+	if g.refuseUnauthenticatedJoin(conn, raw, nodeID) {
+		return
+	}
+	gossipLog.Info("Unknown node, requesting identification", "peer", nodeID)
+	if err := conn.send("IDENTIFY"); err != nil {
+		gossipLog.Warn("Join handshake failed", "peer", nodeID, "err", err)
+		return
+	}
+
+	fields, err := conn.receive()
+	if err != nil {
+		gossipLog.Warn("Join handshake failed", "peer", nodeID, "err", err)
+		return
+	}
+
+	// HELLO <id> <endereço> <cluster> <token> <tokens do anel>
+	if len(fields) != 6 || fields[0] != "HELLO" {
+		gossipLog.Warn("Join handshake failed: malformed HELLO", "peer", nodeID, "message", formatMessage(fields))
+		conn.send("DENIED", "malformed HELLO")
+		return
+	}
+	id, address, name, token := fields[1], fields[2], unquoteField(fields[3]), unquoteField(fields[4])
+
+	if id != nodeID {
+		conn.send("DENIED", "node id mismatch")
+		gossipLog.Warn("Rejected join: node identified itself with another id", "peer", nodeID, "identified_as", id)
+		return
+	}
+	// Sem configuração, ou com nome ou token vazio, não há o que conferir: um nó qualquer entraria
+	config := g.clusterConfig()
+	if config == nil {
+		conn.send("DENIED", "cluster not initialized on this node")
+		gossipLog.Warn("Rejected join: cluster not initialized on this node", "peer", id, "address", address)
+		return
+	}
+	if config.Name == "" || config.Token == "" {
+		conn.send("DENIED", "cluster has no name or token")
+		gossipLog.Warn("Rejected join: the cluster needs --name and --token for joins by PING", "peer", id, "address", address)
+		return
+	}
+	if name != config.Name || subtle.ConstantTimeCompare([]byte(token), []byte(config.Token)) != 1 {
+		conn.send("DENIED", "cluster name or token mismatch")
+		gossipLog.Warn("Rejected join: cluster name or token mismatch", "peer", id, "address", address)
+		return
+	}
+
+	tokens, err := decodeTokens(fields[5])
+	if err != nil {
+		conn.send("DENIED", err.Error())
+		gossipLog.Warn("Rejected join", "peer", id, "err", err)
+		return
+	}
+
+	// Mudanças no anel aguardam o fim de uma eleição; o nó tenta de novo no próximo PING
+	if err := g.fence("join"); err != nil {
+		conn.send("DENIED", err.Error())
+		gossipLog.Info("Deferred join", "peer", id, "err", err)
+		return
+	}
+
+	g.addJoinedNode(id, address, tokens)
+
+	// Atribui ao novo nó o próximo índice livre, propagado aos demais pelo push-pull
+	index := g.nodeIndex.index(id)
+	if index == 0 {
+		index = g.nodeIndex.nextIndex()
+		g.nodeIndex.assign(id, index)
+	}
+	conn.send("WELCOME", strconv.Itoa(index))
+}
+
+// Responde ao pedido de identificação de um nó que ainda não nos conhece
+func (g *Gossip) answerJoinHandshake(conn *peerConn, node *Node) {
+	g.Mutex.Lock()
+	tokens := encodeTokens(g.ConsistentHash.Tokens(g.Self.ID))
+	g.Mutex.Unlock()
+
+	if err := conn.send("HELLO", g.Self.ID, g.Self.Address, quoteField(g.clusterName()), quoteField(g.clusterToken()), tokens); err != nil {
+		gossipLog.Warn("Join handshake failed", "peer", node.ID, "err", err)
+		return
+	}
+
+	fields, err := conn.receive()
+	if err != nil {
+		gossipLog.Warn("Join handshake failed", "peer", node.ID, "err", err)
+		return
+	}
+	if len(fields) == 0 || fields[0] != "WELCOME" {
+		gossipLog.Warn("Node refused our join", "peer", node.ID, "message", formatMessage(fields))
+		return
+	}
+	if len(fields) == 2 {
+		if index, err := strconv.Atoi(fields[1]); err == nil {
+			g.nodeIndex.assign(g.Self.ID, index)
+		}
+	}
+	gossipLog.Info("Joined node", "peer", node.ID)
+}
+
+// Adiciona ao Gossip e ao anel um nó que concluiu o handshake de entrada. Um nó com os tokens
+// de um membro conhecido é esse membro com um novo ID (ver Relocate).
+func (g *Gossip) addJoinedNode(nodeID, address string, tokens []uint32) {
+	g.Mutex.Lock()
+	if _, exists := g.Nodes[nodeID]; exists {
+		g.Mutex.Unlock()
+		return
+	}
+	if previous := g.tokenOwner(tokens); previous != nil {
+		g.renameNode(previous, nodeID, address, tokens)
+		g.Mutex.Unlock()
+		g.recordRelocation(nodeID, previous.ID, address)
+		return
+	}
+	n := g.KeyValueStore.replicationFactor()
+	before := g.KeyValueStore.ringOwners(n)
+
+	node := &Node{
+		ID:        nodeID,
+		Address:   address,
+		Alive:     true,
+		LastCheck: time.Now(),
+	}
+	g.Nodes[nodeID] = node
+	if len(tokens) > 0 {
+		g.ConsistentHash.AddNodeWithTokens(node, tokens)
+	} else {
+		g.ConsistentHash.AddNode(node)
+	}
+	g.Mutex.Unlock()
+	gossipLog.Info("Node joined the cluster", "peer", nodeID, "address", address)
+
+	g.KeyValueStore.rebalanceOwnershipChange(before, n, "node "+nodeID+" joined")
+}
+
+// Adiciona ao anel o nó que a mudança node-add acrescentou à configuração do cluster
+func (g *Gossip) addConfiguredNode(value string) {
+	var node NodeConfig
+	if err := json.Unmarshal([]byte(value), &node); err != nil || node.ID == g.Self.ID {
+		return
+	}
+	if node.Index > 0 {
+		g.nodeIndex.assign(node.ID, node.Index)
+	}
+	g.addJoinedNode(node.ID, node.Address, node.Tokens)
+}
+
+// Campos vazios são enviados como "-", que o formato de texto do protocolo exige
+func quoteField(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func unquoteField(s string) string {
+	if s == "-" {
+		return ""
+	}
+	return s
+}
+
+// Codifica os tokens do anel como uma lista separada por vírgulas
+func encodeTokens(tokens []uint32) string {
+	if len(tokens) == 0 {
+		return "-"
+	}
+
+	parts := make([]string, 0, len(tokens))
+	for _, token := range tokens {
+		parts = append(parts, strconv.FormatUint(uint64(token), 10))
+	}
+	return strings.Join(parts, ",")
+}
+
+func decodeTokens(s string) ([]uint32, error) {
+	if s == "-" {
+		return nil, nil
+	}
+
+	var tokens []uint32
+	for _, part := range strings.Split(s, ",") {
+		token, err := strconv.ParseUint(part, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ring token %q", part)
+		}
+		tokens = append(tokens, uint32(token))
+	}
+	return tokens, nil
+}
+
+// NodeStatus descreve um membro do cluster do ponto de vista deste nó
+type NodeStatus struct {
+	ID          string    `json:"id"`
+	Address     string    `json:"address"`
+	Resolved    string    `json:"resolved,omitempty"` // Último IP resolvido do nome do endereço
+	Alive       bool      `json:"alive"`
+	Suspect     bool      `json:"suspect"` // Não respondeu às sondagens e aguarda a refutação
+	Phi         float64   `json:"phi"`     // Nível de suspeita do detector phi-accrual (0 para o próprio nó)
+	Circuit     string    `json:"circuit"` // Estado do circuit breaker das RPCs de réplica (closed, open ou half-open)
+	Self        bool      `json:"self"`
+	ClockSkewMs *float64  `json:"clock_skew_ms,omitempty"` // Diferença estimada do relógio do nó em relação ao deste (positiva = adiantado)
+	Coordinator bool      `json:"coordinator"`
+	LastCheck   time.Time `json:"last_check"` // Último PING respondido (zero para o próprio nó)
+}
+
+// RingRange é um trecho do anel com as réplicas responsáveis por ele, em ordem de preferência
+type RingRange struct {
+	TokenRange
+	Replicas []string `json:"replicas"`
+}
+
+// Retorna os membros conhecidos, incluindo este nó, ordenados por ID
+func (g *Gossip) Members() []NodeStatus {
+	coordinator, _ := g.CoordinatorID()
+
+	g.Mutex.Lock()
+	now := time.Now()
+	members := []NodeStatus{{ID: g.Self.ID, Address: g.Self.Address, Alive: true, Self: true}}
+	for _, node := range g.Nodes {
+		status := NodeStatus{ID: node.ID, Address: node.Address, Alive: node.Alive, Suspect: node.Suspect, LastCheck: node.LastCheck}
+		if node.Alive {
+			status.Phi = g.phiOf(node, now)
+		}
+		status.Circuit = g.breakers.state(node.ID).String()
+		status.Resolved = g.addresses.lookup(node.Address)
+		if skew, known := g.clockSkews.lookup(node.ID); known {
+			ms := float64(skew.Skew) / float64(time.Millisecond)
+			status.ClockSkewMs = &ms
+		}
+		members = append(members, status)
+	}
+	g.Mutex.Unlock()
+
+	for i := range members {
+		members[i].Coordinator = members[i].ID == coordinator
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].ID < members[j].ID })
+	return members
+}
+
+// Retorna os trechos do anel, em ordem, com as N réplicas de cada um
+func (g *Gossip) Ring() []RingRange {
+	n := g.KeyValueStore.replicationFactor()
+
+	g.Mutex.Lock()
+	defer g.Mutex.Unlock()
+
+	ranges := g.ConsistentHash.Ranges()
+	ring := make([]RingRange, len(ranges))
+	for i, tr := range ranges {
+		ring[i].TokenRange = tr
+		for _, node := range g.ConsistentHash.ReplicaNodesForHash(tr.End, n) {
+			ring[i].Replicas = append(ring[i].Replicas, node.ID)
+		}
+	}
+	return ring
+}
+
+// Entra num cluster em execução pedindo a entrada a um dos seeds (host:port). O seed acrescenta
+// o nó à configuração do cluster pela mudança coordenada node-add, que o coloca no anel de todos
+// os membros, e devolve a configuração resultante, que é gravada no bucket de sistema. Até a
+// configuração ser aplicada, o anel deste nó só tem ele mesmo, então as escritas de réplica são
+// recusadas: quem as envia guarda hints, entregues depois da entrada, e o rebalanceamento
+// repete as transferências.
+func (g *Gossip) JoinCluster(seeds []string, token string) error {
+	g.joining.Store(true)
+	defer g.joining.Store(false)
+
+	var failures []string
+	for _, seed := range seeds {
+		config, err := g.requestJoin(seed, token)
+		if err != nil {
+			gossipLog.Warn("Seed refused the join", "seed", seed, "err", err)
+			failures = append(failures, fmt.Sprintf("%s: %v", seed, err))
+			continue
+		}
+
+		g.ApplyClusterConfig(config)
+		if err := config.Save(g.KeyValueStore.DataDir); err != nil {
+			return fmt.Errorf("joined via seed %s but failed to save the cluster config: %w", seed, err)
+		}
+		gossipLog.Info("Joined cluster", "cluster", config.Name, "seed", seed, "nodes", len(config.Nodes))
+		return nil
+	}
+	return fmt.Errorf("no seed accepted the join (%s)", strings.Join(failures, "; "))
+}
+
+// Recusa uma escrita de réplica recebida enquanto o nó entra no cluster
+func (g *Gossip) refuseWhileJoining(conn *peerConn, op string) bool {
+	if !g.joining.Load() {
+		return false
+	}
+	gossipLog.Debug("Refusing replica write while joining the cluster", "op", op, "remote", conn.RemoteAddr())
+	conn.send("ERROR", "node is joining the cluster")
+	return true
+}
+
+// Envia JOIN a um seed e lê a resposta: WELCOME <índice> seguido de CONFIG <json>, ou DENIED <motivo>
+func (g *Gossip) requestJoin(seed, token string) (*ClusterConfig, error) {
+	// O seed só responde depois que a entrada é aplicada em todos os membros
+	conn, err := g.dialPeer(seed, g.Timeouts.Gossip.withReadTimeout(settingProposeTimeout))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := conn.send("JOIN", g.Self.ID, g.Self.Address, quoteField(token)); err != nil {
+		return nil, err
+	}
+
+	fields, err := conn.receive()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case len(fields) > 0 && fields[0] == "DENIED":
+		return nil, errors.New(messageText(fields))
+	case len(fields) == 0 || fields[0] != "WELCOME":
+		return nil, fmt.Errorf("malformed join response %q", formatMessage(fields))
+	}
+
+	fields, err = conn.receive()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) < 2 || fields[0] != "CONFIG" {
+		return nil, fmt.Errorf("malformed join response %q", formatMessage(fields))
+	}
+	config := &ClusterConfig{}
+	if err := json.Unmarshal([]byte(messageText(fields)), config); err != nil {
+		return nil, fmt.Errorf("invalid cluster config: %w", err)
+	}
+	return config, nil
+}
+
+// Responde ao JOIN de um nó novo: exige o TLS mútuo enquanto o cluster tem tokens, valida o
+// token do cluster, propõe a entrada do nó na configuração do cluster com tokens gerados aqui
+// (com o número de vNodes do cluster) e devolve a configuração resultante. Um nó que já está na configuração (uma nova entrada depois de perder os dados)
+// recebe a configuração atual.
+func (g *Gossip) handleJoin(conn *peerConn, raw net.Conn, args []string) {
+	if len(args) != 3 {
+		conn.send("DENIED", "malformed JOIN")
+		return
+	}
+	id, address, token := args[0], args[1], unquoteField(args[2])
+	if g.refuseUnauthenticatedJoin(conn, raw, id) {
+		return
+	}
+
+	config := g.clusterConfig()
+	if config == nil {
+		conn.send("DENIED", "cluster not initialized on this node")
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(config.Token)) != 1 {
+		conn.send("DENIED", "cluster token mismatch")
+		gossipLog.Warn("Rejected join: cluster token mismatch", "peer", id, "address", address)
+		return
+	}
+	if err := g.fence("join"); err != nil {
+		conn.send("DENIED", err.Error())
+		return
+	}
+
+	g.Mutex.Lock()
+	existing, known := g.Nodes[id]
+	conflict := id == g.Self.ID || known && existing.Address != address
+	tokens := g.ConsistentHash.Tokens(id)
+	if len(tokens) == 0 {
+		tokens = g.ConsistentHash.GenerateTokens(id)
+	}
+	g.Mutex.Unlock()
+	if conflict {
+		conn.send("DENIED", fmt.Sprintf("node id %s is already in use", id))
+		gossipLog.Warn("Rejected join: node id already in use", "peer", id, "address", address)
+		return
+	}
+
+	index := g.nodeIndex.index(id)
+	if index == 0 {
+		index = g.nodeIndex.nextIndex()
+		g.nodeIndex.assign(id, index)
+	}
+	if !slices.ContainsFunc(config.Nodes, func(nc NodeConfig) bool { return nc.ID == id }) {
+		node, err := json.Marshal(NodeConfig{ID: id, Index: index, Address: address, Tokens: tokens})
+		if err != nil {
+			conn.send("DENIED", err.Error())
+			return
+		}
+		if _, err := g.ProposeSetting("node-add", string(node)); err != nil {
+			conn.send("DENIED", fmt.Sprintf("the cluster did not accept the node: %v", err))
+			gossipLog.Warn("Rejected join: node-add was not accepted", "peer", id, "address", address, "err", err)
+			return
+		}
+	}
+
+	encoded, err := json.Marshal(g.clusterConfig())
+	if err != nil {
+		conn.send("DENIED", err.Error())
+		return
+	}
+	conn.queue("WELCOME", strconv.Itoa(index))
+	conn.queue("CONFIG", string(encoded))
+	conn.flush()
+}
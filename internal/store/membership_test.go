@@ -0,0 +1,126 @@
+package store
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bquerino/kv-g/internal/vectorclock"
+)
+
+// Envia uma mensagem a handleConnection por um net.Pipe e retorna a resposta
+func roundTrip(t *testing.T, g *Gossip, fields ...string) []string {
+	t.Helper()
+	client, server := net.Pipe()
+	defer client.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		g.handleConnection(server)
+	}()
+
+	conn := newPeerConn(client, false)
+	if err := conn.send(fields...); err != nil {
+		t.Fatal(err)
+	}
+	response, err := conn.receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	return response
+}
+
+// Enquanto a entrada no cluster não aplicou a configuração, o anel só tem o próprio nó: as
+// escritas de réplica são recusadas, para que o remetente guarde hints
+func TestReplicateIsRefusedWhileJoining(t *testing.T) {
+	g := newTestGossip(t, "node1")
+	vc := vectorclock.NewVectorClock()
+	vc.Increment("node2")
+	message := append([]string{"REPLICATE"}, formatEntry("chave", "valor", g.nodeIndex.encodeClock(vc), time.Now())...)
+
+	g.joining.Store(true)
+	if response := roundTrip(t, g, message...); len(response) == 0 || response[0] != "ERROR" {
+		t.Fatalf("REPLICATE while joining answered %q, want ERROR", formatMessage(response))
+	}
+	if _, _, found := g.KeyValueStore.LocalGet("chave"); found {
+		t.Fatal("replica write was applied while joining")
+	}
+
+	g.joining.Store(false)
+	if response := roundTrip(t, g, message...); len(response) != 1 || response[0] != "OK" {
+		t.Fatalf("REPLICATE after the join answered %q, want OK", formatMessage(response))
+	}
+	if value, _, found := g.KeyValueStore.LocalGet("chave"); !found || value != "valor" {
+		t.Fatalf("LocalGet = %q, %v", value, found)
+	}
+}
+
+// Envia um PING de um nó desconhecido e responde ao IDENTIFY com o HELLO; retorna a resposta ao
+// HELLO
+func joinHandshake(t *testing.T, g *Gossip, hello ...string) []string {
+	t.Helper()
+	client, server := net.Pipe()
+	defer client.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		g.handleConnection(server)
+	}()
+
+	conn := newPeerConn(client, false)
+	if err := conn.send("PING", "from", hello[1]); err != nil {
+		t.Fatal(err)
+	}
+	if response, err := conn.receive(); err != nil || len(response) != 1 || response[0] != "IDENTIFY" {
+		t.Fatalf("PING from an unknown node answered %q, %v; want IDENTIFY", formatMessage(response), err)
+	}
+	if err := conn.send(hello...); err != nil {
+		t.Fatal(err)
+	}
+	response, err := conn.receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	return response
+}
+
+// Um nó sem configuração, ou com nome ou token vazio, não aceita a entrada de um nó qualquer
+// pelo handshake do PING, e um HELLO com o token errado é recusado
+func TestJoinHandshakeNeedsClusterNameAndToken(t *testing.T) {
+	g := newTestGossip(t, "node1")
+	g.Coordinator = g.Self // Com o coordenador conhecido, só o nome e o token barram a entrada
+	hello := []string{"HELLO", "intruder", "evil:1", "-", "-", "-"}
+	config := &ClusterConfig{
+		N:     1,
+		R:     1,
+		W:     1,
+		Nodes: []NodeConfig{{ID: "node1", Index: 1, Address: g.Self.Address, Tokens: g.ConsistentHash.GenerateTokens("node1")}},
+	}
+
+	for _, stage := range []string{"without config", "without name and token", "with another token"} {
+		switch stage {
+		case "without name and token":
+			g.ApplyClusterConfig(config)
+		case "with another token":
+			config.Name, config.Token = "teste", "segredo"
+			g.ApplyClusterConfig(config)
+			hello = []string{"HELLO", "intruder", "evil:1", "teste", "outro", "-"}
+		}
+		if response := joinHandshake(t, g, hello...); len(response) == 0 || response[0] != "DENIED" {
+			t.Fatalf("HELLO %s answered %q, want DENIED", stage, formatMessage(response))
+		}
+		if _, joined := g.GetNode("intruder"); joined {
+			t.Fatalf("intruder joined the ring %s", stage)
+		}
+	}
+
+	response := joinHandshake(t, g, "HELLO", "node2", "node2:7000", "teste", "segredo", "-")
+	if len(response) == 0 || response[0] != "WELCOME" {
+		t.Fatalf("HELLO with the cluster name and token answered %q, want WELCOME", formatMessage(response))
+	}
+	if _, joined := g.GetNode("node2"); !joined {
+		t.Fatal("node2 did not join the ring")
+	}
+}
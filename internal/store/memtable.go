@@ -0,0 +1,205 @@
+package store
+
+import "time"
+
+// Altura máxima das torres do skiplist (suficiente para centenas de milhões de chaves com p = 1/4)
+const memtableMaxHeight = 16
+
+// Quantidade mínima de nós removidos antes de reconstruir as arenas
+const memtableCompactMin = 1024
+
+// Nó do skiplist. As ligações são índices nas arenas, não ponteiros, para que o coletor de
+// lixo não precise percorrer milhões de nós: o único ponteiro por chave é o DataItem.
+type memtableNode struct {
+	keyOffset uint32 // Posição da chave na arena de chaves
+	keyLen    uint32
+	tower     uint32 // Posição dos próximos nós de cada nível na arena de torres
+	height    uint8
+	item      *DataItem // nil quando o nó foi removido
+}
+
+// Memtable guarda os dados em memória num skiplist ordenado por chave, com as chaves,
+// os nós e as ligações em arenas contíguas. A ordem permite percorrer as chaves sem
+// ordená-las (flush, scans, rebalanceamento). Não é segura para uso concorrente: o
+// KeyValueStore a protege com seu Mutex.
+type Memtable struct {
+	keys   []byte         // Arena das chaves
+	nodes  []memtableNode // nodes[0] é a cabeça; o índice 0 numa ligação indica o fim da lista
+	towers []uint32       // Arena das ligações de todos os nós
+	height int            // Altura atual do skiplist
+	count  int            // Chaves presentes
+	dead   int            // Nós removidos ainda ocupando as arenas
+	rnd    uint64
+}
+
+// Cria uma memtable vazia
+func NewMemtable() *Memtable {
+	m := &Memtable{
+		nodes:  []memtableNode{{height: memtableMaxHeight}},
+		towers: make([]uint32, memtableMaxHeight),
+		height: 1,
+		rnd:    uint64(time.Now().UnixNano()) | 1,
+	}
+	return m
+}
+
+// Retorna o número de chaves
+func (m *Memtable) Len() int {
+	return m.count
+}
+
+func (m *Memtable) next(n uint32, level int) uint32 {
+	return m.towers[m.nodes[n].tower+uint32(level)]
+}
+
+func (m *Memtable) setNext(n uint32, level int, to uint32) {
+	m.towers[m.nodes[n].tower+uint32(level)] = to
+}
+
+func (m *Memtable) keyBytes(n uint32) []byte {
+	node := &m.nodes[n]
+	return m.keys[node.keyOffset : node.keyOffset+node.keyLen]
+}
+
+// Compara a chave do nó com key sem alocar
+func (m *Memtable) compare(n uint32, key string) int {
+	k := m.keyBytes(n)
+	switch {
+	case string(k) < key:
+		return -1
+	case string(k) > key:
+		return 1
+	}
+	return 0
+}
+
+// Retorna o primeiro nó com chave >= key, preenchendo prev com o último nó anterior em cada nível
+func (m *Memtable) seek(key string, prev *[memtableMaxHeight]uint32) uint32 {
+	x := uint32(0)
+	for level := m.height - 1; level >= 0; level-- {
+		for {
+			next := m.next(x, level)
+			if next == 0 || m.compare(next, key) >= 0 {
+				break
+			}
+			x = next
+		}
+		if prev != nil {
+			prev[level] = x
+		}
+	}
+	return m.next(x, 0)
+}
+
+// Sorteia a altura de um novo nó (cada nível com probabilidade 1/4)
+func (m *Memtable) randomHeight() int {
+	height := 1
+	for height < memtableMaxHeight {
+		// xorshift64
+		m.rnd ^= m.rnd << 13
+		m.rnd ^= m.rnd >> 7
+		m.rnd ^= m.rnd << 17
+		if m.rnd&3 != 0 {
+			break
+		}
+		height++
+	}
+	return height
+}
+
+// Retorna o item da chave
+func (m *Memtable) Get(key string) (*DataItem, bool) {
+	n := m.seek(key, nil)
+	if n == 0 || m.compare(n, key) != 0 {
+		return nil, false
+	}
+	return m.nodes[n].item, true
+}
+
+// Grava o item da chave, substituindo o anterior
+func (m *Memtable) Set(key string, item *DataItem) {
+	var prev [memtableMaxHeight]uint32
+	if n := m.seek(key, &prev); n != 0 && m.compare(n, key) == 0 {
+		m.nodes[n].item = item
+		return
+	}
+
+	height := m.randomHeight()
+	for level := m.height; level < height; level++ {
+		prev[level] = 0
+	}
+	m.height = max(m.height, height)
+
+	n := uint32(len(m.nodes))
+	m.nodes = append(m.nodes, memtableNode{
+		keyOffset: uint32(len(m.keys)),
+		keyLen:    uint32(len(key)),
+		tower:     uint32(len(m.towers)),
+		height:    uint8(height),
+		item:      item,
+	})
+	m.keys = append(m.keys, key...)
+	for level := 0; level < height; level++ {
+		m.towers = append(m.towers, m.next(prev[level], level))
+		m.setNext(prev[level], level, n)
+	}
+	m.count++
+}
+
+// Remove a chave, retornando se ela existia
+func (m *Memtable) Delete(key string) bool {
+	var prev [memtableMaxHeight]uint32
+	n := m.seek(key, &prev)
+	if n == 0 || m.compare(n, key) != 0 {
+		return false
+	}
+
+	for level := 0; level < int(m.nodes[n].height); level++ {
+		if m.next(prev[level], level) == n {
+			m.setNext(prev[level], level, m.next(n, level))
+		}
+	}
+	m.nodes[n].item = nil
+	m.count--
+	m.dead++
+
+	// Reconstrói as arenas quando a maior parte delas pertence a nós removidos
+	if m.dead >= memtableCompactMin && m.dead > m.count {
+		m.compact()
+	}
+	return true
+}
+
+// Reconstrói as arenas somente com as chaves presentes
+func (m *Memtable) compact() {
+	fresh := NewMemtable()
+	fresh.keys = make([]byte, 0, len(m.keys))
+	fresh.nodes = append(make([]memtableNode, 0, m.count+1), fresh.nodes...)
+	m.Ascend(func(key string, item *DataItem) bool {
+		fresh.Set(key, item)
+		return true
+	})
+	*m = *fresh
+}
+
+// Percorre as chaves em ordem crescente até fn retornar false
+func (m *Memtable) Ascend(fn func(key string, item *DataItem) bool) {
+	for n := m.next(0, 0); n != 0; n = m.next(n, 0) {
+		if !fn(string(m.keyBytes(n)), m.nodes[n].item) {
+			return
+		}
+	}
+}
+
+// Percorre, em ordem crescente, as chaves maiores que after até fn retornar false
+func (m *Memtable) AscendAfter(after string, fn func(key string, item *DataItem) bool) {
+	n := m.seek(after, nil)
+	if n != 0 && m.compare(n, after) == 0 {
+		n = m.next(n, 0)
+	}
+	for ; n != 0; n = m.next(n, 0) {
+		if !fn(string(m.keyBytes(n)), m.nodes[n].item) {
+			return
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Bucket das chaves sem prefixo "bucket/"
+const DefaultBucket = "default"
+
+// Nome do arquivo com a versão de schema de cada bucket dentro do bucket de sistema
+const schemaFile = "schemas.json"
+
+// Retorna o bucket de uma chave: o prefixo antes da primeira "/", ou o bucket padrão
+func BucketOf(key string) string {
+	if bucket, _, found := strings.Cut(key, "/"); found && bucket != "" {
+		return bucket
+	}
+	return DefaultBucket
+}
+
+// MigrateFunc converte um valor do formato da versão anterior para o da nova versão.
+// Deve ser determinística, já que cada réplica migra a sua cópia de forma independente.
+type MigrateFunc func(key, value string) (string, error)
+
+// Migration leva os valores de um bucket para a versão Version
+type Migration struct {
+	Bucket  string
+	Version int
+	Migrate MigrateFunc
+}
+
+// BucketSchema é o estado persistido das migrações de um bucket
+type BucketSchema struct {
+	Version int    `json:"version"`  // Versão em que todos os valores locais já estão
+	Target  int    `json:"target"`   // Versão da migração em andamento (igual a Version se não houver)
+	LastKey string `json:"last_key"` // Última chave migrada (as chaves são migradas em ordem)
+}
+
+// Registra uma migração; as versões de um bucket precisam ser registradas em ordem crescente
+func (kv *KeyValueStore) RegisterMigration(bucket string, version int, fn MigrateFunc) error {
+	kv.Mutex.Lock()
+	defer kv.Mutex.Unlock()
+
+	if latest := kv.latestSchemaVersion(bucket); version <= latest {
+		return fmt.Errorf("migration version %d for bucket %s must be greater than %d", version, bucket, latest)
+	}
+	kv.migrations[bucket] = append(kv.migrations[bucket], &Migration{Bucket: bucket, Version: version, Migrate: fn})
+	return nil
+}
+
+// Retorna a versão mais recente registrada para o bucket (0 se não houver migrações)
+func (kv *KeyValueStore) latestSchemaVersion(bucket string) int {
+	migrations := kv.migrations[bucket]
+	if len(migrations) == 0 {
+		return 0
+	}
+	return migrations[len(migrations)-1].Version
+}
+
+// Aplica as migrações registradas acima de from, retornando o valor no formato mais recente
+func (kv *KeyValueStore) upgradeValue(key, value string, from int) (string, int, error) {
+	version := from
+	for _, migration := range kv.migrations[BucketOf(key)] {
+		if migration.Version <= version {
+			continue
+		}
+		migrated, err := migration.Migrate(key, value)
+		if err != nil {
+			return "", version, fmt.Errorf("migration %s v%d failed for key %s: %w", migration.Bucket, migration.Version, key, err)
+		}
+		value, version = migrated, migration.Version
+	}
+	return value, version, nil
+}
+
+// Retorna o valor de um item no formato mais recente, migrando-o na leitura se ainda
+// estiver num formato antigo (durante a transição convivem as duas versões)
+func (kv *KeyValueStore) currentValue(key string, item *DataItem) string {
+	if item.Deleted() || item.SchemaVersion >= kv.latestSchemaVersion(BucketOf(key)) {
+		return item.Value
+	}
+
+	value, _, err := kv.upgradeValue(key, item.Value, item.SchemaVersion)
+	if err != nil {
+		storageLog.Warn("Returning key in its stored schema version", "op", "get", "key", logKey(key), "schema_version", item.SchemaVersion, "err", err)
+		return item.Value
+	}
+	return value
+}
+
+// Retorna o caminho do arquivo de schemas
+func (kv *KeyValueStore) schemaPath() string {
+	return filepath.Join(kv.DataDir, SystemBucket, schemaFile)
+}
+
+// Carrega o estado das migrações de todos os buckets
+func (kv *KeyValueStore) loadSchemas() (map[string]*BucketSchema, error) {
+	schemas := make(map[string]*BucketSchema)
+
+	data, err := os.ReadFile(kv.schemaPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return schemas, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &schemas); err != nil {
+		return nil, fmt.Errorf("invalid schema file: %w", err)
+	}
+	return schemas, nil
+}
+
+// Grava o estado das migrações de um bucket
+func (kv *KeyValueStore) saveSchema(bucket string, schema *BucketSchema) error {
+	kv.schemaMutex.Lock()
+	defer kv.schemaMutex.Unlock()
+
+	schemas, err := kv.loadSchemas()
+	if err != nil {
+		return err
+	}
+	schemas[bucket] = schema
+
+	data, err := json.MarshalIndent(schemas, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(kv.schemaPath(), data, 0644)
+}
+
+// Retorna o estado das migrações de um bucket
+func (kv *KeyValueStore) BucketSchema(bucket string) (*BucketSchema, error) {
+	schemas, err := kv.loadSchemas()
+	if err != nil {
+		return nil, err
+	}
+	if schema, exists := schemas[bucket]; exists {
+		return schema, nil
+	}
+	return &BucketSchema{}, nil
+}
+
+// Reescreve todos os valores locais do bucket para a versão mais recente registrada.
+// O progresso é gravado a cada chave, então uma migração interrompida continua
+// de onde parou; keysPerSecond > 0 limita a taxa da reescrita.
+func (kv *KeyValueStore) MigrateBucket(job *Job, bucket string, keysPerSecond int) error {
+	kv.Mutex.Lock()
+	target := kv.latestSchemaVersion(bucket)
+	kv.Mutex.Unlock()
+
+	schema, err := kv.BucketSchema(bucket)
+	if err != nil {
+		return err
+	}
+	if schema.Version >= target {
+		clusterLog.Info("Bucket is already at the schema version", "op", "migrate", "bucket", bucket, "schema_version", schema.Version)
+		return nil
+	}
+	if schema.Target != target {
+		// Nova migração (ou nova versão registrada): recomeça o cursor
+		schema.Target, schema.LastKey = target, ""
+	}
+	if err := kv.saveSchema(bucket, schema); err != nil {
+		return err
+	}
+
+	var throttle <-chan time.Time
+	if keysPerSecond > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(keysPerSecond))
+		defer ticker.Stop()
+		throttle = ticker.C
+	}
+
+	migrated := 0
+	keys := kv.bucketKeys(bucket, schema.LastKey)
+	for i, key := range keys {
+		if err := job.Progress(i, len(keys)); err != nil {
+			return err
+		}
+		if throttle != nil {
+			<-throttle
+		}
+
+		kv.Mutex.Lock()
+		if item, exists := kv.Data.Get(key); exists && !item.Deleted() && item.SchemaVersion < target {
+			value, version, err := kv.upgradeValue(key, item.Value, item.SchemaVersion)
+			if err != nil {
+				kv.Mutex.Unlock()
+				return err
+			}
+			// A versão (Vector Clock) não muda: a migração é determinística em todas as réplicas
+			item.Value, item.SchemaVersion = value, version
+			kv.dirty[key] = true
+			migrated++
+		}
+		kv.Mutex.Unlock()
+
+		schema.LastKey = key
+		if err := kv.saveSchema(bucket, schema); err != nil {
+			return err
+		}
+	}
+
+	schema.Version, schema.LastKey = target, ""
+	clusterLog.Info("Bucket migrated", "op", "migrate", "bucket", bucket, "schema_version", target, "rewritten", migrated)
+	return kv.saveSchema(bucket, schema)
+}
+
+// Runner do job de migração: migrate <bucket> [chaves por segundo]
+func (kv *KeyValueStore) migrateJob(job *Job, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing bucket")
+	}
+	rate := 0
+	if len(args) > 1 {
+		var err error
+		if rate, err = strconv.Atoi(args[1]); err != nil {
+			return fmt.Errorf("invalid rate %q", args[1])
+		}
+	}
+	if err := kv.Gossip.awaitCoordinator(job, "migrate"); err != nil {
+		return err
+	}
+	return kv.MigrateBucket(job, args[0], rate)
+}
+
+// Retorna, em ordem, as chaves locais do bucket posteriores a after
+func (kv *KeyValueStore) bucketKeys(bucket, after string) []string {
+	kv.Mutex.Lock()
+	defer kv.Mutex.Unlock()
+
+	var keys []string
+	kv.Data.AscendAfter(after, func(key string, item *DataItem) bool {
+		if BucketOf(key) == bucket {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	return keys
+}
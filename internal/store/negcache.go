@@ -0,0 +1,90 @@
+package store
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// Máximo de chaves no cache negativo; com ele cheio, novas ausências não são guardadas
+const negativeCacheMaxKeys = 100000
+
+// Faixas de chaves com contadores de escrita próprios
+const negativeCacheStripes = 256
+
+// negativeCache guarda, por NegativeCacheTTL, as chaves que uma leitura com quórum não
+// encontrou, para que leituras repetidas de chaves inexistentes não consultem o disco e as
+// réplicas a cada vez. Qualquer escrita aplicada neste nó (do cliente, de uma réplica, de um
+// hint ou de um read repair) remove a chave do cache; escritas que não passam por este nó
+// deixam de ser escondidas quando o TTL expira.
+type negativeCache struct {
+	mutex       sync.Mutex
+	entries     map[string]time.Time         // Expiração de cada chave ausente
+	generations [negativeCacheStripes]uint64 // Escritas por faixa de chaves, para descartar ausências lidas antes de uma escrita
+}
+
+func newNegativeCache() *negativeCache {
+	return &negativeCache{entries: make(map[string]time.Time)}
+}
+
+// Indica se a chave está no cache e ainda não expirou
+func (c *negativeCache) contains(key string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	expires, exists := c.entries[key]
+	if !exists {
+		return false
+	}
+	if time.Now().After(expires) {
+		delete(c.entries, key)
+		return false
+	}
+	return true
+}
+
+// Retorna a faixa de contadores da chave
+func negativeCacheStripe(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % negativeCacheStripes)
+}
+
+// Retorna o contador de escritas da faixa da chave, lido antes de consultar as réplicas
+func (c *negativeCache) generation(key string) uint64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.generations[negativeCacheStripe(key)]
+}
+
+// Guarda a ausência da chave por ttl, a menos que uma escrita na faixa dela tenha chegado
+// depois de generation (a leitura pode ter perdido essa escrita)
+func (c *negativeCache) add(key string, ttl time.Duration, generation uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.generations[negativeCacheStripe(key)] != generation {
+		return
+	}
+	now := time.Now()
+	if len(c.entries) >= negativeCacheMaxKeys {
+		for k, expires := range c.entries {
+			if now.After(expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= negativeCacheMaxKeys {
+			return
+		}
+	}
+	c.entries[key] = now.Add(ttl)
+}
+
+// Remove a chave do cache
+func (c *negativeCache) invalidate(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	delete(c.entries, key)
+	c.generations[negativeCacheStripe(key)]++
+}
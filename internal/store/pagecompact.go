@@ -0,0 +1,180 @@
+package store
+
+import (
+	"errors"
+	"maps"
+	"os"
+)
+
+// O PageManager guarda somente os hints (hints/<nó>.pages): os dados ficam nas SSTables, que
+// são compactadas pelo LSM (ver lsm.go), e o arquivo de páginas de dados das versões anteriores
+// é importado para elas na abertura. O arquivo de hints reaproveita o espaço dos registros
+// removidos (ver slottedpage.go), mas não diminui: depois de uma rajada de hints entregues só em
+// parte, ele fica com muitas páginas quase vazias. A compactação regrava os registros vivos em
+// páginas novas, em sequência, num arquivo temporário e troca o arquivo pelo novo com um rename,
+// junto com o índice. Uma queda antes do rename deixa só o temporário, apagado na abertura; uma
+// queda depois deixa o arquivo novo, indexado na abertura.
+//
+// As páginas cujo checksum não confere não são copiadas para o arquivo novo: antes da troca,
+// elas são acrescentadas, como estão, ao arquivo de quarentena ao lado do arquivo de páginas,
+// para que possam ser examinadas. Se a cópia para a quarentena falha, a compactação é descartada.
+
+// Sufixo do arquivo temporário da compactação
+const pageCompactSuffix = ".compact"
+
+// Sufixo do arquivo de quarentena, com as páginas corrompidas deixadas de fora pela compactação
+const pageQuarantineSuffix = ".quarantine"
+
+// Arquivos com menos páginas que isto não são compactados
+const pageCompactMinPages = 64
+
+// Fração livre do arquivo a partir da qual ele é compactado
+const pageCompactFreeRatio = 0.5
+
+// errPageFileChanged indica que o arquivo recebeu gravações durante a compactação
+var errPageFileChanged = errors.New("page file changed during compaction")
+
+// Indica se o espaço livre das páginas passa de pageCompactFreeRatio do arquivo
+func (pm *PageManager) needsCompaction() bool {
+	pm.Mutex.RLock()
+	defer pm.Mutex.RUnlock()
+
+	if pm.NextPageID < pageCompactMinPages {
+		return false
+	}
+	free := 0
+	for _, space := range pm.free {
+		free += space
+	}
+	return float64(free) >= pageCompactFreeRatio*float64(pm.NextPageID*PageSize)
+}
+
+// Regrava os registros vivos num arquivo novo e o troca pelo atual, retornando o número de
+// páginas antes e depois. As páginas corrompidas vão para a quarentena; se o arquivo receber
+// gravações durante a cópia, a compactação é descartada. Arquivos com range tombstones (do formato
+// anterior, importados para as SSTables na abertura) não são compactados.
+func (pm *PageManager) Compact() (before, after int64, err error) {
+	pm.indexMutex.Lock()
+	snapshot := maps.Clone(pm.index)
+	ranges := len(pm.ranges)
+	pm.indexMutex.Unlock()
+	pm.Mutex.RLock()
+	before = pm.NextPageID
+	pm.Mutex.RUnlock()
+	if ranges > 0 {
+		return before, before, nil
+	}
+
+	tmpPath := pm.Path + pageCompactSuffix
+	if err := os.Remove(tmpPath); err != nil && !os.IsNotExist(err) {
+		return before, before, err
+	}
+	compacted, err := NewPageManager(tmpPath)
+	if err != nil {
+		return before, before, err
+	}
+	discard := func(err error) (int64, int64, error) {
+		compacted.File.Close()
+		os.Remove(tmpPath)
+		return before, before, err
+	}
+
+	for _, key := range pm.Keys() {
+		record, exists := pm.Lookup(key)
+		if !exists {
+			continue
+		}
+		value := ""
+		if record.Length > 0 {
+			value, err = pm.ReadValue(key)
+			if errors.Is(err, ErrChecksumMismatch) {
+				continue // A página do registro vai para a quarentena antes da troca
+			}
+			if err != nil {
+				return discard(err)
+			}
+		}
+		if err := compacted.Put(key, value); err != nil {
+			return discard(err)
+		}
+	}
+	if err := compacted.Sync(); err != nil {
+		return discard(err)
+	}
+
+	pm.Mutex.Lock()
+	defer pm.Mutex.Unlock()
+
+	pm.indexMutex.Lock()
+	unchanged := maps.Equal(snapshot, pm.index)
+	pm.indexMutex.Unlock()
+	if !unchanged {
+		return discard(errPageFileChanged)
+	}
+	if err := pm.quarantineCorruptLocked(); err != nil {
+		return discard(err)
+	}
+
+	// No Windows os arquivos precisam estar fechados antes do rename
+	compacted.File.Close()
+	pm.File.Close()
+	renamed := renameFile(tmpPath, pm.Path)
+	file, err := os.OpenFile(pm.Path, os.O_RDWR, 0755)
+	if err != nil {
+		return before, before, errors.Join(renamed, err)
+	}
+	pm.File = file
+	if renamed != nil {
+		os.Remove(tmpPath)
+		return before, before, renamed
+	}
+
+	pm.indexMutex.Lock()
+	pm.index = compacted.index
+	pm.indexMutex.Unlock()
+	pm.free = compacted.free
+	pm.NextPageID = compacted.NextPageID
+	pm.nextSeq = compacted.nextSeq
+	return before, pm.NextPageID, nil
+}
+
+// Acrescenta ao arquivo de quarentena as páginas cujo checksum não confere. Deve ser chamada com
+// o Mutex obtido.
+func (pm *PageManager) quarantineCorruptLocked() error {
+	path := pm.Path + pageQuarantineSuffix
+	var quarantine *os.File
+	buffer := make([]byte, PageSize)
+	for id := range pm.NextPageID {
+		_, err := pm.readPageLocked(id)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, ErrChecksumMismatch) {
+			return closeQuarantine(quarantine, err)
+		}
+		if _, err := pm.File.ReadAt(buffer, id*PageSize); err != nil {
+			return closeQuarantine(quarantine, err)
+		}
+		if quarantine == nil {
+			if quarantine, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644); err != nil {
+				return err
+			}
+		}
+		if _, err := quarantine.Write(buffer); err != nil {
+			return closeQuarantine(quarantine, err)
+		}
+		storageLog.Error("Moved corrupt page to quarantine", "page", id, "path", pm.Path, "quarantine", path)
+	}
+	if quarantine == nil {
+		return nil
+	}
+	return closeQuarantine(quarantine, quarantine.Sync())
+}
+
+// Fecha o arquivo de quarentena, se aberto, retornando err ou o erro do fechamento
+func closeQuarantine(file *os.File, err error) error {
+	if file == nil {
+		return err
+	}
+	return errors.Join(err, file.Close())
+}
@@ -0,0 +1,92 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// A compactação não descarta um registro corrompido: a página dele vai, como estava, para o
+// arquivo de quarentena, e os demais registros continuam legíveis no arquivo novo
+func TestCompactQuarantinesCorruptPages(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "teste.pages")
+	pm, err := NewPageManager(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pm.Close()
+	for i := range 200 {
+		if err := pm.Put(fmt.Sprintf("chave-%03d", i), fmt.Sprintf("valor-%03d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := range 150 {
+		if err := pm.Delete(fmt.Sprintf("chave-%03d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	corruptValue(t, pm, "chave-199")
+	record, _ := pm.Lookup("chave-199")
+	corrupted := make([]byte, PageSize)
+	if _, err := pm.File.ReadAt(corrupted, record.PageID*PageSize); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := pm.Compact(); err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+	quarantined, err := os.ReadFile(path + pageQuarantineSuffix)
+	if err != nil {
+		t.Fatalf("reading the quarantine file: %v", err)
+	}
+	if !bytes.Equal(quarantined, corrupted) {
+		t.Fatalf("quarantine file has %d bytes, want the %d bytes of the corrupt page", len(quarantined), len(corrupted))
+	}
+	if _, exists := pm.Lookup("chave-199"); exists {
+		t.Fatal("corrupt record was copied to the compacted file")
+	}
+	for i := 150; i < 199; i++ {
+		key := fmt.Sprintf("chave-%03d", i)
+		if value, err := pm.ReadValue(key); err != nil || value != fmt.Sprintf("valor-%03d", i) {
+			t.Fatalf("ReadValue(%s) after compaction = %q, %v", key, value, err)
+		}
+	}
+	if _, corrupt := pm.Verify(); len(corrupt) > 0 {
+		t.Fatalf("compacted file has corrupt pages: %+v", corrupt)
+	}
+}
+
+// Se a página corrompida não pode ir para a quarentena, a compactação falha e o arquivo fica
+// como estava
+func TestCompactKeepsFileWhenQuarantineFails(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "teste.pages")
+	pm, err := NewPageManager(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pm.Close()
+	for _, key := range []string{"a", "b"} {
+		if err := pm.Put(key, "valor-"+key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	corruptValue(t, pm, "a")
+	// Um diretório no lugar do arquivo de quarentena impede a cópia
+	if err := os.Mkdir(path+pageQuarantineSuffix, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := pm.Compact(); err == nil {
+		t.Fatal("Compact succeeded without quarantining the corrupt page")
+	}
+	if value, err := pm.ReadValue("a"); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("ReadValue(a) = %q, %v; want the corrupt record still in the file", value, err)
+	}
+	if value, err := pm.ReadValue("b"); err != nil || value != "valor-b" {
+		t.Fatalf("ReadValue(b) = %q, %v", value, err)
+	}
+}
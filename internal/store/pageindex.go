@@ -0,0 +1,562 @@
+package store
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Cabeçalho de um registro no formato anterior, de um registro por página: "KV", versão do
+// formato, tamanho da chave (2 bytes) e tamanho do valor (4 bytes). Páginas nesse formato
+// continuam legíveis; as novas gravações usam slotted pages.
+const (
+	recordMagic      = "KV"
+	recordVersion    = 1
+	recordHeaderSize = 9
+)
+
+// Extensão do arquivo onde o índice de chaves é gravado, ao lado do arquivo de páginas
+const pageIndexSuffix = ".idx"
+
+// Cabeçalho do arquivo do índice: páginas cobertas e a última sequência gravada
+const pageIndexHeader = "slotted %d %d"
+
+// Páginas com menos espaço livre que isto deixam de receber registros
+const pageMinFree = slotSize + cellHeaderSize + cellChecksumSize + 16
+
+// errNotOnDisk indica que a chave não tem versão gravada no arquivo de páginas
+var errNotOnDisk = errors.New("key not on disk")
+
+// pageRecord é a posição do valor de uma chave no arquivo de páginas
+type pageRecord struct {
+	PageID int64
+	Slot   int    // Slot da célula na página (-1 = página de registro único do formato anterior)
+	Offset int    // Início do valor dentro da página
+	Length int    // Tamanho do valor (0 = tombstone)
+	Seq    uint64 // Ordem de gravação entre as versões da chave (0 no formato anterior)
+}
+
+// Indica se o registro é mais novo que other
+func (r pageRecord) newer(other pageRecord) bool {
+	if r.Seq != other.Seq {
+		return r.Seq > other.Seq
+	}
+	return r.PageID > other.PageID
+}
+
+// Decodifica o registro de uma página do formato anterior; ok é false se a página não contém
+// um registro válido
+func decodeRecord(buffer []byte) (key string, record pageRecord, ok bool) {
+	if len(buffer) < recordHeaderSize || string(buffer[:2]) != recordMagic || buffer[2] != recordVersion {
+		return "", pageRecord{}, false
+	}
+	keyLen := int(binary.BigEndian.Uint16(buffer[3:]))
+	valueLen := int(binary.BigEndian.Uint32(buffer[5:]))
+	if recordHeaderSize+keyLen+valueLen > len(buffer) {
+		return "", pageRecord{}, false
+	}
+	key = string(buffer[recordHeaderSize : recordHeaderSize+keyLen])
+	return key, pageRecord{Slot: -1, Offset: recordHeaderSize + keyLen, Length: valueLen}, true
+}
+
+// Registra no índice a versão mais recente de uma chave
+func (pm *PageManager) indexRecord(key string, record pageRecord) {
+	pm.indexMutex.Lock()
+	defer pm.indexMutex.Unlock()
+
+	if current, exists := pm.index[key]; !exists || record.newer(current) {
+		pm.index[key] = record
+	}
+}
+
+// Retorna a posição da versão mais recente da chave no arquivo de páginas, se ela não tiver
+// sido removida por um range tombstone
+func (pm *PageManager) Lookup(key string) (pageRecord, bool) {
+	pm.indexMutex.Lock()
+	defer pm.indexMutex.Unlock()
+
+	record, exists := pm.index[key]
+	if !exists || pm.pageCoveredLocked(key, record.PageID) {
+		return pageRecord{}, false
+	}
+	return record, true
+}
+
+// Retorna as chaves presentes no índice e não removidas por range tombstones, em ordem (sem os
+// pedaços dos valores grandes)
+func (pm *PageManager) Keys() []string {
+	pm.indexMutex.Lock()
+	defer pm.indexMutex.Unlock()
+
+	keys := make([]string, 0, len(pm.index))
+	for key, record := range pm.index {
+		if !isChunkKey(key) && !pm.pageCoveredLocked(key, record.PageID) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Grava a chave e o valor numa página com espaço livre (ou numa nova) e marca como removida
+// a versão anterior da chave. Um valor que não cabe numa página é gravado em pedaços.
+func (pm *PageManager) Put(key, value string) error {
+	if len(key) > maxPageKeySize {
+		return fmt.Errorf("key %s does not fit in a page (%d bytes, the limit is %d)", key, len(key), maxPageKeySize)
+	}
+	pm.Mutex.Lock()
+	defer pm.Mutex.Unlock()
+
+	if recordSize(key, value) > PageSize {
+		return pm.putChunksLocked(key, value)
+	}
+	return pm.putLocked(key, value, cellLive)
+}
+
+// Grava um registro que cabe numa página, com o estado state. Deve ser chamada com o Mutex obtido.
+func (pm *PageManager) putLocked(key, value string, state byte) error {
+	pm.indexMutex.Lock()
+	previous, exists := pm.index[key]
+	pm.indexMutex.Unlock()
+
+	page, err := pm.pageWithSpace(recordSize(key, value) - slottedHeaderSize - pageChecksumSize)
+	if err != nil {
+		return err
+	}
+	pm.nextSeq++
+	cell, ok := page.insert(key, value, pm.nextSeq, state)
+	if !ok {
+		return fmt.Errorf("record for key %s does not fit in page %d", key, page.ID)
+	}
+	// A versão anterior na mesma página é removida na mesma gravação
+	samePage := exists && previous.PageID == page.ID && previous.Slot >= 0
+	manifest := ""
+	if samePage {
+		if old, ok := page.cell(previous.Slot); ok && old.state == cellManifest {
+			manifest = string(page.Buffer[old.value : old.value+old.length])
+		}
+		if err := page.markDeleted(previous.Slot); err != nil {
+			return err
+		}
+	}
+	if err := pm.writePageLocked(page); err != nil {
+		return err
+	}
+	pm.pageWritten(page)
+
+	pm.indexMutex.Lock()
+	pm.index[key] = pageRecord{PageID: page.ID, Slot: cell.slot, Offset: cell.value, Length: cell.length, Seq: cell.seq}
+	pm.indexMutex.Unlock()
+
+	// A versão nova já está gravada: uma queda antes de remover a anterior só deixa as duas no
+	// arquivo, e a sequência decide qual vale
+	if exists && !samePage {
+		return pm.removeRecordLocked(key, previous)
+	}
+	if manifest != "" {
+		return pm.dropChunksLocked(key, manifest)
+	}
+	return nil
+}
+
+// Marca como removida, na própria página, a versão da chave. Sem versão gravada, não faz nada.
+func (pm *PageManager) Delete(key string) error {
+	pm.Mutex.Lock()
+	defer pm.Mutex.Unlock()
+
+	pm.indexMutex.Lock()
+	record, exists := pm.index[key]
+	delete(pm.index, key)
+	pm.indexMutex.Unlock()
+	if !exists {
+		return nil
+	}
+	return pm.removeRecordLocked(key, record)
+}
+
+// Retira a chave do índice sem alterar a página, que está corrompida e não pode ser regravada;
+// retorna false se a chave não estava no índice
+func (pm *PageManager) forget(key string) bool {
+	pm.indexMutex.Lock()
+	defer pm.indexMutex.Unlock()
+
+	_, exists := pm.index[key]
+	delete(pm.index, key)
+	return exists
+}
+
+// Remove um registro da página, e os pedaços dele se for um manifesto. Um registro do formato
+// anterior ocupa a página inteira, que é reformatada como uma slotted page vazia. Deve ser
+// chamada com o Mutex obtido.
+func (pm *PageManager) removeRecordLocked(key string, record pageRecord) error {
+	page, err := pm.readPageLocked(record.PageID)
+	if err != nil {
+		return err
+	}
+	manifest := ""
+	if record.Slot < 0 {
+		if stored, _, ok := decodeRecord(page.Buffer); !ok || stored != key {
+			return nil
+		}
+		page.initSlotted()
+	} else {
+		cell, ok := page.cell(record.Slot)
+		if !ok || cell.key != key || cell.seq != record.Seq {
+			return nil
+		}
+		if cell.state == cellManifest {
+			manifest = string(page.Buffer[cell.value : cell.value+cell.length])
+		}
+		if err := page.markDeleted(record.Slot); err != nil {
+			return err
+		}
+	}
+	if err := pm.writePageLocked(page); err != nil {
+		return err
+	}
+	pm.pageWritten(page)
+	if manifest != "" {
+		return pm.dropChunksLocked(key, manifest)
+	}
+	return nil
+}
+
+// Retorna uma página com pelo menos need bytes livres, alocando uma nova se nenhuma tiver.
+// Deve ser chamada com o Mutex obtido.
+func (pm *PageManager) pageWithSpace(need int) (*Page, error) {
+	best := int64(-1)
+	for id, free := range pm.free {
+		if free >= need && (best < 0 || id < best) {
+			best = id
+		}
+	}
+	if best < 0 {
+		return pm.allocatePageLocked(), nil
+	}
+
+	page, err := pm.readPageLocked(best)
+	if errors.Is(err, ErrChecksumMismatch) {
+		// Uma página corrompida não recebe mais registros; as chaves dela aparecem no verify
+		storageLog.Warn("Page is corrupt, no longer writing to it", "page", best, "path", pm.Path, "err", err)
+		delete(pm.free, best)
+		return pm.allocatePageLocked(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Uma página sem formato reconhecido (gravação interrompida) é reaproveitada vazia
+	if !page.slotted() {
+		page.initSlotted()
+	}
+	page.upgrade()
+	return page, nil
+}
+
+// Retorna o espaço livre de uma página para um novo registro, descontando os checksums que uma
+// página de uma versão anterior passa a ter ao recebê-lo
+func pageFree(page *Page) int {
+	return page.freeSpace() - page.upgradeSize()
+}
+
+// Atualiza o espaço livre da página gravada e a posição, no índice, das células vivas dela,
+// que mudam quando a página é reagrupada. Deve ser chamada com o Mutex obtido.
+func (pm *PageManager) pageWritten(page *Page) {
+	if free := pageFree(page); free >= pageMinFree {
+		pm.free[page.ID] = free
+	} else {
+		delete(pm.free, page.ID)
+	}
+
+	pm.indexMutex.Lock()
+	defer pm.indexMutex.Unlock()
+	for _, cell := range page.cells() {
+		if record, exists := pm.index[cell.key]; exists && record.PageID == page.ID && record.Slot == cell.slot && liveCell(cell.state) {
+			record.Offset = cell.value
+			pm.index[cell.key] = record
+		}
+	}
+}
+
+// Lê o valor de uma chave gravado no arquivo de páginas. Se a página apontada pelo índice
+// não contiver a chave, o índice está desatualizado e é reconstruído a partir das páginas.
+func (pm *PageManager) ReadValue(key string) (string, error) {
+	for attempt := 0; ; attempt++ {
+		record, exists := pm.Lookup(key)
+		if !exists || record.Length == 0 {
+			return "", errNotOnDisk
+		}
+
+		value, manifest, ok, err := pm.readRecord(key, record)
+		if err != nil {
+			return "", err
+		}
+		if ok && manifest {
+			return pm.readChunks(key, value)
+		}
+		if ok {
+			return value, nil
+		}
+		if attempt > 0 {
+			return "", fmt.Errorf("page %d does not hold key %s", record.PageID, key)
+		}
+
+		storageLog.Warn("Page index is stale, rebuilding it", "page", record.PageID, "key", logKey(key))
+		if err := pm.RebuildIndex(); err != nil {
+			return "", err
+		}
+	}
+}
+
+// Lê o registro apontado pelo índice. Numa página da versão atual, somente a célula é lida e o
+// checksum dela é conferido; se a célula não confere com o índice, ou a página é de uma versão
+// sem checksum nas células, a página é lida inteira e o checksum dela é conferido. Um registro
+// do formato anterior, sem checksum, é lido sozinho. manifest indica um valor gravado em
+// pedaços; ok é false se o registro lido não confere com o índice.
+func (pm *PageManager) readRecord(key string, record pageRecord) (value string, manifest, ok bool, err error) {
+	pm.Mutex.RLock()
+	defer pm.Mutex.RUnlock()
+
+	if record.Slot >= 0 {
+		if value, manifest, ok, err := pm.readCellLocked(key, record); ok || err != nil {
+			return value, manifest, ok, err
+		}
+		page, err := pm.readPageLocked(record.PageID)
+		if err != nil {
+			return "", false, false, err
+		}
+		if !page.slotted() {
+			return "", false, false, nil
+		}
+		cell, valid := page.cell(record.Slot)
+		if !valid || !liveCell(cell.state) || cell.key != key || cell.seq != record.Seq || cell.length != record.Length {
+			return "", false, false, nil
+		}
+		return string(page.Buffer[cell.value : cell.value+cell.length]), cell.state == cellManifest, true, nil
+	}
+
+	buffer := make([]byte, record.Offset+record.Length)
+	if _, err := pm.File.ReadAt(buffer, record.PageID*PageSize); err != nil {
+		return "", false, false, err
+	}
+	stored, found, valid := decodeRecord(buffer)
+	if !valid || stored != key || found.Offset != record.Offset || found.Length != record.Length {
+		return "", false, false, nil
+	}
+	return string(buffer[record.Offset:]), false, true, nil
+}
+
+// Lê somente a célula apontada pelo índice, numa página da versão atual, e confere o checksum
+// dela; ok é false se a página é de outra versão ou a célula não confere com o índice. Deve ser
+// chamada com o Mutex obtido.
+func (pm *PageManager) readCellLocked(key string, record pageRecord) (value string, manifest, ok bool, err error) {
+	header := make([]byte, slottedHeaderSize)
+	if _, err := pm.File.ReadAt(header, record.PageID*PageSize); err != nil {
+		return "", false, false, err
+	}
+	if page := (&Page{Buffer: header}); !page.cellsChecksummed() {
+		return "", false, false, nil
+	}
+
+	start := record.Offset - cellHeaderSize - len(key)
+	size := cellHeaderSize + len(key) + record.Length + cellChecksumSize
+	if start < slottedHeaderSize || start+size > PageSize-pageChecksumSize {
+		return "", false, false, nil
+	}
+	buffer := make([]byte, size)
+	if _, err := pm.File.ReadAt(buffer, record.PageID*PageSize+int64(start)); err != nil {
+		return "", false, false, err
+	}
+	cell, valid := decodeCell(buffer, record.Slot, start)
+	if !valid || !liveCell(cell.state) || cell.key != key || cell.seq != record.Seq || cell.length != record.Length {
+		return "", false, false, nil
+	}
+	if err := verifyCell(buffer); err != nil {
+		return "", false, false, fmt.Errorf("page %d of %s, slot %d: %w", record.PageID, pm.Path, record.Slot, err)
+	}
+	value = string(buffer[cell.value-start : cell.value-start+cell.length])
+	return value, cell.state == cellManifest, true, nil
+}
+
+// Reconstrói o índice percorrendo todas as páginas do arquivo
+func (pm *PageManager) RebuildIndex() error {
+	pm.indexMutex.Lock()
+	pm.index = make(map[string]pageRecord)
+	pm.ranges = nil
+	pm.indexMutex.Unlock()
+
+	return pm.scanPages(0)
+}
+
+// Acrescenta ao índice os registros das páginas a partir de from e posiciona NextPageID
+// depois da última página do arquivo
+func (pm *PageManager) scanPages(from int64) error {
+	pm.Mutex.Lock()
+	defer pm.Mutex.Unlock()
+
+	info, err := pm.File.Stat()
+	if err != nil {
+		return err
+	}
+	pages := (info.Size() + PageSize - 1) / PageSize
+
+	buffer := make([]byte, PageSize)
+	skipped, corrupt := 0, 0
+	for id := from; id < pages; id++ {
+		n, err := pm.File.ReadAt(buffer, id*PageSize)
+		if err != nil && n == 0 {
+			return err
+		}
+		page := &Page{ID: id, Buffer: buffer[:n]}
+		switch {
+		case n == PageSize && page.checksummed() && page.verifyChecksum() != nil:
+			// As chaves de uma página corrompida ficam de fora do índice, e ela não recebe registros
+			corrupt++
+		case n == PageSize && page.slotted():
+			for _, cell := range page.cells() {
+				pm.nextSeq = max(pm.nextSeq, cell.seq)
+				if liveCell(cell.state) {
+					pm.indexRecord(cell.key, pageRecord{PageID: id, Slot: cell.slot, Offset: cell.value, Length: cell.length, Seq: cell.seq})
+				}
+			}
+			if free := pageFree(page); free >= pageMinFree {
+				pm.free[id] = free
+			}
+		default:
+			if rt, ok := decodeRangeTombstone(buffer[:n]); ok {
+				rt.PageID = id
+				pm.addRangeTombstone(rt)
+				continue
+			}
+			key, record, ok := decodeRecord(buffer[:n])
+			if !ok {
+				// Uma página completa é reaproveitada pela próxima gravação
+				if n == PageSize {
+					pm.free[id] = PageSize - slottedHeaderSize - pageChecksumSize
+				}
+				skipped++
+				continue
+			}
+			record.PageID = id
+			pm.indexRecord(key, record)
+		}
+	}
+	if skipped > 0 {
+		storageLog.Warn("Skipped pages without a valid record while indexing", "pages", skipped, "path", pm.Path)
+	}
+	if corrupt > 0 {
+		storageLog.Error("Skipped corrupt pages while indexing", "pages", corrupt, "path", pm.Path)
+	}
+
+	pm.NextPageID = max(pm.NextPageID, pages)
+	return nil
+}
+
+func (pm *PageManager) indexPath() string {
+	return pm.Path + pageIndexSuffix
+}
+
+// Grava o índice em disco. A primeira linha guarda quantas páginas ele cobre e a última
+// sequência gravada; as linhas iniciadas por "free" guardam o espaço livre das páginas e as
+// iniciadas por "range", os range tombstones.
+func (pm *PageManager) SaveIndex() error {
+	pm.Mutex.RLock()
+	var b strings.Builder
+	fmt.Fprintf(&b, pageIndexHeader+"\n", pm.NextPageID, pm.nextSeq)
+	for id, free := range pm.free {
+		fmt.Fprintf(&b, "free %d %d\n", id, free)
+	}
+	pm.Mutex.RUnlock()
+
+	pm.indexMutex.Lock()
+	for key, record := range pm.index {
+		fmt.Fprintf(&b, "%d %d %d %d %d %s\n", record.PageID, record.Slot, record.Offset, record.Length, record.Seq, key)
+	}
+	for _, rt := range pm.ranges {
+		b.WriteString(formatRangeIndexEntry(rt))
+	}
+	pm.indexMutex.Unlock()
+
+	return writeFileAtomic(pm.indexPath(), []byte(b.String()), 0644)
+}
+
+// Carrega o índice gravado e indexa as páginas escritas depois dele; sem índice gravado
+// (ou com um índice inválido), percorre o arquivo inteiro. As gravações alteram páginas já
+// cobertas pelo índice, então ele só vale para um arquivo fechado corretamente: é apagado na
+// abertura e gravado de novo por Close, e depois de uma queda o arquivo inteiro é percorrido.
+func (pm *PageManager) loadIndex() error {
+	pm.index = make(map[string]pageRecord)
+
+	from, err := pm.readIndexFile()
+	if err != nil {
+		if !os.IsNotExist(err) {
+			storageLog.Warn("Ignoring page index", "path", pm.indexPath(), "err", err)
+		}
+		pm.index = make(map[string]pageRecord)
+		pm.ranges = nil
+		pm.free = make(map[int64]int)
+		pm.nextSeq = 0
+		from = 0
+	}
+	if err := os.Remove(pm.indexPath()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return pm.scanPages(from)
+}
+
+// Lê o arquivo do índice, retornando quantas páginas ele cobre
+func (pm *PageManager) readIndexFile() (int64, error) {
+	file, err := os.Open(pm.indexPath())
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	if !scanner.Scan() {
+		return 0, errors.New("empty index")
+	}
+	var pages int64
+	if _, err := fmt.Sscanf(scanner.Text(), pageIndexHeader, &pages, &pm.nextSeq); err != nil {
+		return 0, fmt.Errorf("invalid header %q", scanner.Text())
+	}
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, rangeIndexPrefix):
+			rt, err := parseRangeIndexEntry(line, pages)
+			if err != nil {
+				return 0, err
+			}
+			pm.ranges = append(pm.ranges, rt)
+			continue
+		case strings.HasPrefix(line, "free "):
+			var id int64
+			var free int
+			if _, err := fmt.Sscanf(line, "free %d %d", &id, &free); err != nil || id < 0 || id >= pages || free < 0 || free > PageSize {
+				return 0, fmt.Errorf("invalid entry %q", line)
+			}
+			pm.free[id] = free
+			continue
+		}
+		fields := strings.SplitN(line, " ", 6)
+		if len(fields) != 6 {
+			return 0, fmt.Errorf("invalid entry %q", line)
+		}
+		pageID, err1 := strconv.ParseInt(fields[0], 10, 64)
+		slot, err2 := strconv.Atoi(fields[1])
+		offset, err3 := strconv.Atoi(fields[2])
+		length, err4 := strconv.Atoi(fields[3])
+		seq, err5 := strconv.ParseUint(fields[4], 10, 64)
+		if err := errors.Join(err1, err2, err3, err4, err5); err != nil || pageID < 0 || pageID >= pages || slot < -1 || offset < 0 || length < 0 || offset+length > PageSize {
+			return 0, fmt.Errorf("invalid entry %q", line)
+		}
+		pm.index[fields[5]] = pageRecord{PageID: pageID, Slot: slot, Offset: offset, Length: length, Seq: seq}
+	}
+	return pages, scanner.Err()
+}
@@ -0,0 +1,114 @@
+package store
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+// Troca um byte do valor da chave no arquivo de páginas
+func corruptValue(t *testing.T, pm *PageManager, key string) {
+	t.Helper()
+	record, ok := pm.Lookup(key)
+	if !ok {
+		t.Fatalf("key %s is not indexed", key)
+	}
+	at := record.PageID*PageSize + int64(record.Offset)
+	b := make([]byte, 1)
+	if _, err := pm.File.ReadAt(b, at); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pm.File.WriteAt([]byte{b[0] ^ 0x01}, at); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A leitura de um valor confere somente a célula dele: um byte trocado em outra célula da mesma
+// página não a impede, e um byte trocado na própria célula retorna ErrChecksumMismatch
+func TestReadValueChecksOnlyItsCell(t *testing.T) {
+	pm, err := NewPageManager(filepath.Join(t.TempDir(), "teste.pages"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pm.Close()
+	for _, key := range []string{"a", "b"} {
+		if err := pm.Put(key, "valor-"+key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a, _ := pm.Lookup("a")
+	b, _ := pm.Lookup("b")
+	if a.PageID != b.PageID {
+		t.Fatalf("keys were written to pages %d and %d, want the same page", a.PageID, b.PageID)
+	}
+
+	corruptValue(t, pm, "b")
+	if value, err := pm.ReadValue("a"); err != nil || value != "valor-a" {
+		t.Fatalf("ReadValue(a) = %q, %v; want valor-a", value, err)
+	}
+	if value, err := pm.ReadValue("b"); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("ReadValue(b) = %q, %v; want ErrChecksumMismatch", value, err)
+	}
+	if _, err := pm.ReadPage(a.PageID); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("ReadPage = %v; want ErrChecksumMismatch", err)
+	}
+}
+
+// Uma página da versão 2 continua legível e, ao receber um registro, passa a guardar o checksum
+// de cada célula, inclusive das que já tinha
+func TestPageUpgradeChecksumsExistingCells(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "teste.pages")
+	pm, err := NewPageManager(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := pm.AllocatePage()
+	page.Buffer[2] = slottedVersionV2
+	page.setCellStart(page.cellEnd())
+	for i, key := range []string{"a", "b"} {
+		if _, ok := page.insert(key, "valor-"+key, uint64(i+1), cellLive); !ok {
+			t.Fatalf("insert(%s) did not fit", key)
+		}
+	}
+	if err := pm.WritePage(page); err != nil {
+		t.Fatal(err)
+	}
+	if err := pm.File.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	pm, err = NewPageManager(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pm.Close()
+	if value, err := pm.ReadValue("a"); err != nil || value != "valor-a" {
+		t.Fatalf("ReadValue(a) on a version 2 page = %q, %v", value, err)
+	}
+	if err := pm.Put("c", "valor-c"); err != nil {
+		t.Fatal(err)
+	}
+	page, err = pm.ReadPage(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !page.cellsChecksummed() {
+		t.Fatalf("page has version %d after receiving a record, want %d", page.Buffer[2], slottedVersion)
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		if record, _ := pm.Lookup(key); record.PageID != 0 {
+			t.Fatalf("key %s moved to page %d", key, record.PageID)
+		}
+		if value, err := pm.ReadValue(key); err != nil || value != "valor-"+key {
+			t.Fatalf("ReadValue(%s) = %q, %v", key, value, err)
+		}
+	}
+
+	corruptValue(t, pm, "a")
+	if value, err := pm.ReadValue("a"); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("ReadValue(a) = %q, %v; want ErrChecksumMismatch", value, err)
+	}
+	if value, err := pm.ReadValue("b"); err != nil || value != "valor-b" {
+		t.Fatalf("ReadValue(b) = %q, %v; want valor-b", value, err)
+	}
+}
@@ -0,0 +1,356 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+// Escritor mínimo de arquivos Parquet, usado pelos snapshots: colunas sem aninhamento, páginas
+// de dados v1 em PLAIN sem compressão e os metadados em Thrift (compact protocol), o bastante
+// para Spark, DuckDB e pandas lerem os arquivos. As linhas ficam em memória até completar uma
+// row group, gravada com uma página por coluna.
+
+const parquetMagic = "PAR1"
+
+// Linhas por row group
+const parquetRowGroupRows = 10000
+
+// Tipos físicos do Parquet
+const (
+	parquetBoolean   int32 = 0
+	parquetInt64     int32 = 2
+	parquetByteArray int32 = 6
+)
+
+// Tipos convertidos (lógicos) do Parquet; parquetPlain indica uma coluna sem tipo lógico
+const (
+	parquetPlain           int32 = -1
+	parquetUTF8            int32 = 0
+	parquetTimestampMicros int32 = 10
+)
+
+// parquetColumn é uma coluna do arquivo com os valores da row group em andamento
+type parquetColumn struct {
+	name      string
+	kind      int32 // Tipo físico
+	converted int32 // Tipo lógico (parquetPlain = nenhum)
+	optional  bool  // Aceita nulos
+
+	values  bytes.Buffer // Valores não nulos em PLAIN (exceto booleanos)
+	bits    []bool       // Valores das colunas booleanas, empacotados ao gravar a página
+	present []bool       // Se cada linha tem valor (só nas colunas opcionais)
+}
+
+// Local de uma coluna gravada no arquivo
+type parquetChunk struct {
+	offset int64
+	size   int64
+}
+
+// Row group já gravada
+type parquetRowGroup struct {
+	rows   int64
+	size   int64
+	chunks []parquetChunk
+}
+
+// parquetWriter grava linhas num arquivo Parquet; Close grava a última row group e o rodapé
+type parquetWriter struct {
+	w        io.Writer
+	offset   int64
+	columns  []*parquetColumn
+	rows     int // Linhas da row group em andamento
+	groups   []parquetRowGroup
+	metadata [][2]string // Pares chave-valor gravados no rodapé
+}
+
+func newParquetWriter(w io.Writer, columns []*parquetColumn, metadata [][2]string) (*parquetWriter, error) {
+	pw := &parquetWriter{w: w, columns: columns, metadata: metadata}
+	if err := pw.write([]byte(parquetMagic)); err != nil {
+		return nil, err
+	}
+	return pw, nil
+}
+
+func (pw *parquetWriter) write(data []byte) error {
+	n, err := pw.w.Write(data)
+	pw.offset += int64(n)
+	return err
+}
+
+// Acrescenta uma linha com um valor por coluna, na ordem das colunas: string, int64 ou bool,
+// conforme o tipo da coluna, ou nil para nulo numa coluna opcional
+func (pw *parquetWriter) writeRow(values ...any) error {
+	for i, value := range values {
+		column := pw.columns[i]
+		if column.optional {
+			column.present = append(column.present, value != nil)
+		}
+		switch v := value.(type) {
+		case string:
+			column.values.Write(binary.LittleEndian.AppendUint32(nil, uint32(len(v))))
+			column.values.WriteString(v)
+		case int64:
+			column.values.Write(binary.LittleEndian.AppendUint64(nil, uint64(v)))
+		case bool:
+			column.bits = append(column.bits, v)
+		}
+	}
+	pw.rows++
+	if pw.rows >= parquetRowGroupRows {
+		return pw.flushRowGroup()
+	}
+	return nil
+}
+
+// Grava as linhas em memória como uma row group, com uma página de dados por coluna
+func (pw *parquetWriter) flushRowGroup() error {
+	group := parquetRowGroup{rows: int64(pw.rows)}
+	for _, column := range pw.columns {
+		var page bytes.Buffer
+		if column.optional {
+			levels := encodeDefinitionLevels(column.present)
+			page.Write(binary.LittleEndian.AppendUint32(nil, uint32(len(levels))))
+			page.Write(levels)
+		}
+		if column.kind == parquetBoolean {
+			packed := make([]byte, (len(column.bits)+7)/8)
+			for i, bit := range column.bits {
+				if bit {
+					packed[i/8] |= 1 << (i % 8)
+				}
+			}
+			page.Write(packed)
+		} else {
+			page.Write(column.values.Bytes())
+		}
+
+		var header thriftWriter
+		header.writeI32(1, 0) // DATA_PAGE
+		header.writeI32(2, int32(page.Len()))
+		header.writeI32(3, int32(page.Len()))
+		header.beginStruct(5)
+		header.writeI32(1, int32(pw.rows))
+		header.writeI32(2, 0) // PLAIN
+		header.writeI32(3, 3) // RLE
+		header.writeI32(4, 3) // RLE
+		header.endStruct()
+		header.stop()
+
+		chunk := parquetChunk{offset: pw.offset, size: int64(header.buf.Len() + page.Len())}
+		if err := pw.write(header.buf.Bytes()); err != nil {
+			return err
+		}
+		if err := pw.write(page.Bytes()); err != nil {
+			return err
+		}
+		group.chunks = append(group.chunks, chunk)
+		group.size += chunk.size
+
+		column.values.Reset()
+		column.bits, column.present = column.bits[:0], column.present[:0]
+	}
+	pw.groups = append(pw.groups, group)
+	pw.rows = 0
+	return nil
+}
+
+// Codifica os níveis de definição (1 = valor presente) no híbrido RLE/bit-packing com largura
+// de 1 bit, usando só sequências RLE
+func encodeDefinitionLevels(present []bool) []byte {
+	var out []byte
+	for i := 0; i < len(present); {
+		run := 1
+		for i+run < len(present) && present[i+run] == present[i] {
+			run++
+		}
+		out = binary.AppendUvarint(out, uint64(run)<<1)
+		level := byte(0)
+		if present[i] {
+			level = 1
+		}
+		out = append(out, level)
+		i += run
+	}
+	return out
+}
+
+// Grava a row group pendente e o rodapé com o schema e a posição de cada coluna
+func (pw *parquetWriter) Close() error {
+	if pw.rows > 0 {
+		if err := pw.flushRowGroup(); err != nil {
+			return err
+		}
+	}
+
+	var rows int64
+	for _, group := range pw.groups {
+		rows += group.rows
+	}
+
+	var meta thriftWriter
+	meta.writeI32(1, 1) // Versão do formato
+	meta.beginList(2, thriftStruct, len(pw.columns)+1)
+	meta.beginElement()
+	meta.writeString(4, "schema")
+	meta.writeI32(5, int32(len(pw.columns)))
+	meta.endStruct()
+	for _, column := range pw.columns {
+		repetition := int32(0) // REQUIRED
+		if column.optional {
+			repetition = 1 // OPTIONAL
+		}
+		meta.beginElement()
+		meta.writeI32(1, column.kind)
+		meta.writeI32(3, repetition)
+		meta.writeString(4, column.name)
+		if column.converted != parquetPlain {
+			meta.writeI32(6, column.converted)
+		}
+		meta.endStruct()
+	}
+	meta.writeI64(3, rows)
+
+	meta.beginList(4, thriftStruct, len(pw.groups))
+	for _, group := range pw.groups {
+		meta.beginElement()
+		meta.beginList(1, thriftStruct, len(group.chunks))
+		for i, chunk := range group.chunks {
+			column := pw.columns[i]
+			meta.beginElement()
+			meta.writeI64(2, chunk.offset)
+			meta.beginStruct(3)
+			meta.writeI32(1, column.kind)
+			meta.beginList(2, thriftI32, 2)
+			meta.listI32(0) // PLAIN, nos valores
+			meta.listI32(3) // RLE, nos níveis de definição
+			meta.beginList(3, thriftBinary, 1)
+			meta.listString(column.name)
+			meta.writeI32(4, 0) // UNCOMPRESSED
+			meta.writeI64(5, group.rows)
+			meta.writeI64(6, chunk.size)
+			meta.writeI64(7, chunk.size)
+			meta.writeI64(9, chunk.offset)
+			meta.endStruct()
+			meta.endStruct()
+		}
+		meta.writeI64(2, group.size)
+		meta.writeI64(3, group.rows)
+		meta.endStruct()
+	}
+
+	if len(pw.metadata) > 0 {
+		meta.beginList(5, thriftStruct, len(pw.metadata))
+		for _, pair := range pw.metadata {
+			meta.beginElement()
+			meta.writeString(1, pair[0])
+			meta.writeString(2, pair[1])
+			meta.endStruct()
+		}
+	}
+	meta.writeString(6, "kv-g")
+	meta.stop()
+
+	if err := pw.write(meta.buf.Bytes()); err != nil {
+		return err
+	}
+	if err := pw.write(binary.LittleEndian.AppendUint32(nil, uint32(meta.buf.Len()))); err != nil {
+		return err
+	}
+	return pw.write([]byte(parquetMagic))
+}
+
+// Tipos do Thrift compact protocol usados nos metadados
+const (
+	thriftI32    byte = 5
+	thriftI64    byte = 6
+	thriftBinary byte = 8
+	thriftList   byte = 9
+	thriftStruct byte = 12
+)
+
+// thriftWriter codifica structs no Thrift compact protocol. Os IDs dos campos são gravados como
+// diferença em relação ao campo anterior da mesma struct, guardado em last.
+type thriftWriter struct {
+	buf   bytes.Buffer
+	last  int16
+	stack []int16 // last das structs externas
+}
+
+func (t *thriftWriter) field(id int16, kind byte) {
+	if delta := id - t.last; delta > 0 && delta <= 15 {
+		t.buf.WriteByte(byte(delta)<<4 | kind)
+	} else {
+		t.buf.WriteByte(kind)
+		t.varint(zigzag(int64(id)))
+	}
+	t.last = id
+}
+
+func (t *thriftWriter) varint(v uint64) {
+	t.buf.Write(binary.AppendUvarint(nil, v))
+}
+
+func zigzag(v int64) uint64 {
+	return uint64(v<<1) ^ uint64(v>>63)
+}
+
+func (t *thriftWriter) writeI32(id int16, v int32) {
+	t.field(id, thriftI32)
+	t.varint(zigzag(int64(v)))
+}
+
+func (t *thriftWriter) writeI64(id int16, v int64) {
+	t.field(id, thriftI64)
+	t.varint(zigzag(v))
+}
+
+func (t *thriftWriter) writeString(id int16, s string) {
+	t.field(id, thriftBinary)
+	t.listString(s)
+}
+
+// Inicia uma struct como campo da struct atual
+func (t *thriftWriter) beginStruct(id int16) {
+	t.field(id, thriftStruct)
+	t.beginElement()
+}
+
+// Inicia uma struct como elemento de uma lista
+func (t *thriftWriter) beginElement() {
+	t.stack = append(t.stack, t.last)
+	t.last = 0
+}
+
+// Encerra a struct atual e volta à externa
+func (t *thriftWriter) endStruct() {
+	t.stop()
+	t.last = t.stack[len(t.stack)-1]
+	t.stack = t.stack[:len(t.stack)-1]
+}
+
+// Marca o fim dos campos da struct
+func (t *thriftWriter) stop() {
+	t.buf.WriteByte(0)
+}
+
+// Inicia uma lista de size elementos do tipo kind; os elementos são gravados em seguida
+func (t *thriftWriter) beginList(id int16, kind byte, size int) {
+	t.field(id, thriftList)
+	if size < 15 {
+		t.buf.WriteByte(byte(size)<<4 | kind)
+		return
+	}
+	t.buf.WriteByte(0xf0 | kind)
+	t.varint(uint64(size))
+}
+
+func (t *thriftWriter) listI32(v int32) {
+	t.varint(zigzag(int64(v)))
+}
+
+func (t *thriftWriter) listString(s string) {
+	t.varint(uint64(len(s)))
+	t.buf.WriteString(s)
+}
@@ -0,0 +1,142 @@
+package store
+
+import (
+	"math"
+	"time"
+)
+
+// Detector de falhas phi-accrual (Hayashibara et al.): em vez de um veredito binário, cada nó
+// recebe um nível de suspeita phi calculado a partir dos intervalos entre os sinais de vida
+// (PINGs recebidos e ACKs) que ele mandou. phi = -log10(P(o próximo sinal ainda chegar)), por
+// isso phi 1 significa 10% de chance de engano, phi 2 1%, e assim por diante. Um nó lento, cujos
+// sinais já chegavam espaçados, demora mais a ser suspeito do que um nó que sempre respondeu rápido.
+const (
+	DefaultPhiSuspect = 5.0 // phi a partir do qual um nó passa a ser suspeito
+	DefaultPhiDead    = 8.0 // phi a partir do qual um nó é declarado fora
+	phiWindow         = 100 // Intervalos mantidos por nó
+)
+
+// phiDetector guarda os intervalos mais recentes entre os sinais de vida de um nó
+type phiDetector struct {
+	intervals []float64 // Intervalos em milissegundos, numa janela circular
+	next      int
+	last      time.Time // Último sinal de vida
+}
+
+// Cria um detector que começa a contar a partir de now, com o intervalo esperado como primeira
+// amostra, para que um nó que nunca respondeu também acumule suspeita
+func newPhiDetector(expected time.Duration, now time.Time) *phiDetector {
+	return &phiDetector{
+		intervals: []float64{float64(expected.Milliseconds())},
+		last:      now,
+	}
+}
+
+// Registra um sinal de vida
+func (d *phiDetector) heartbeat(now time.Time) {
+	interval := float64(now.Sub(d.last).Milliseconds())
+	d.last = now
+	if len(d.intervals) < phiWindow {
+		d.intervals = append(d.intervals, interval)
+		return
+	}
+	d.intervals[d.next] = interval
+	d.next = (d.next + 1) % phiWindow
+}
+
+// Calcula o nível de suspeita no instante now, supondo intervalos com distribuição normal
+func (d *phiDetector) phi(now time.Time) float64 {
+	var sum float64
+	for _, interval := range d.intervals {
+		sum += interval
+	}
+	mean := sum / float64(len(d.intervals))
+
+	var variance float64
+	for _, interval := range d.intervals {
+		variance += (interval - mean) * (interval - mean)
+	}
+	// Um desvio mínimo evita que intervalos muito regulares tornem qualquer atraso uma falha
+	stdDev := max(math.Sqrt(variance/float64(len(d.intervals))), mean/4, 1)
+
+	// Aproximação logística da cauda da distribuição normal
+	elapsed := float64(now.Sub(d.last).Milliseconds())
+	y := (elapsed - mean) / stdDev
+	e := math.Exp(-y * (1.5976 + 0.070566*y*y))
+	if elapsed > mean {
+		return -math.Log10(e / (1 + e))
+	}
+	return -math.Log10(1 - 1/(1+e))
+}
+
+// Registra um sinal de vida do nó; chamado com g.Mutex travado
+func (g *Gossip) recordHeartbeat(node *Node, now time.Time) {
+	if node.detector == nil {
+		node.detector = newPhiDetector(g.Interval, now)
+		return
+	}
+	node.detector.heartbeat(now)
+}
+
+// Calcula o phi de um nó; chamado com g.Mutex travado
+func (g *Gossip) phiOf(node *Node, now time.Time) float64 {
+	if node.detector == nil {
+		node.detector = newPhiDetector(g.Interval, now)
+	}
+	return node.detector.phi(now)
+}
+
+// Retorna o nível de suspeita de um nó (0 para o próprio nó e para nós desconhecidos)
+func (g *Gossip) Phi(nodeID string) float64 {
+	g.Mutex.Lock()
+	defer g.Mutex.Unlock()
+
+	node, exists := g.Nodes[nodeID]
+	if !exists || !node.Alive {
+		return 0
+	}
+	return g.phiOf(node, time.Now())
+}
+
+// Verifica se um nó está vivo e com phi abaixo do limiar de suspeita, isto é, se vale a pena
+// enviar uma escrita a ele em vez de guardá-la direto como hint
+func (g *Gossip) IsNodeAvailable(nodeID string) bool {
+	g.Mutex.Lock()
+	defer g.Mutex.Unlock()
+
+	if nodeID == g.Self.ID {
+		return true
+	}
+	node, exists := g.Nodes[nodeID]
+	return exists && node.Alive && g.phiOf(node, time.Now()) < g.PhiSuspect
+}
+
+// Avalia o phi dos nós vivos: acima de PhiSuspect o nó passa a ser suspeito e acima de PhiDead é
+// declarado fora, e a falha é disseminada
+func (g *Gossip) evaluatePhi() {
+	now := time.Now()
+	g.Mutex.Lock()
+	var suspects, dead []*Node
+	for _, node := range g.Nodes {
+		if !node.Alive {
+			continue
+		}
+		switch phi := g.phiOf(node, now); {
+		case phi >= g.PhiDead:
+			gossipLog.Warn("Node reached the dead threshold", "peer", node.ID, "phi", phi, "threshold", g.PhiDead)
+			dead = append(dead, node)
+		case phi >= g.PhiSuspect && !node.Suspect:
+			gossipLog.Info("Node reached the suspect threshold", "peer", node.ID, "phi", phi, "threshold", g.PhiSuspect)
+			suspects = append(suspects, node)
+		}
+	}
+	g.Mutex.Unlock()
+
+	for _, node := range suspects {
+		g.suspectNode(node)
+	}
+	for _, node := range dead {
+		g.markNodeDead(node)
+		g.broadcasts.enqueue(g.memberUpdate(updateDead, node))
+	}
+}
@@ -0,0 +1,592 @@
+package store
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Com PeerConns > 0, as mensagens para um par vão em streams de conexões TCP persistentes (até
+// PeerConns por par) em vez de uma conexão nova por mensagem, o que tira o handshake TCP da
+// latência dos PINGs e das escritas replicadas. A conexão começa com a mensagem MUX; depois do
+// OK, cada mensagem do protocolo binário é um quadro de um stream:
+//
+//	OPEN <stream>           abre o stream, que o par atende como uma conexão recebida
+//	DATA <stream> <bytes>   bytes do stream, em ordem
+//	CLOSE <stream>          fecha o stream
+//
+// Os streams são numerados por quem abriu a conexão, então as respostas de requisições
+// simultâneas não se misturam, e cada stream se comporta como uma conexão: as RPCs continuam
+// abrindo, usando e fechando a "conexão" como antes. Uma conexão sem streams por
+// peerIdleTimeout é fechada, e o keep-alive do TCP detecta pares que sumiram sem fechá-la.
+// Depois de uma falha ao conectar, as novas tentativas esperam um backoff exponencial (de
+// peerRetryMin a peerRetryMax) e, enquanto ele não passa, falham na hora. Um par que não conhece
+// a mensagem MUX (versão anterior) recebe conexões avulsas, e o suporte é verificado de novo
+// depois de muxRecheck. Com TextProtocol o pool não é usado.
+
+// Conexões persistentes por par, por padrão
+const DefaultPeerConns = 2
+
+const (
+	peerKeepAlive   = 15 * time.Second       // Intervalo do keep-alive do TCP
+	peerIdleTimeout = 90 * time.Second       // Tempo sem streams até a conexão ser fechada
+	peerRetryMin    = 100 * time.Millisecond // Primeiro backoff depois de uma falha ao conectar
+	peerRetryMax    = 2 * time.Second        // Maior backoff entre tentativas de conexão
+	muxRecheck      = time.Minute            // Tempo até verificar de novo se o par conhece MUX
+	muxChunkSize    = 64 << 10               // Maior quantidade de bytes num quadro DATA
+	muxWriteTimeout = 5 * time.Second        // Prazo de escrita dos quadros OPEN e CLOSE
+)
+
+// errNoMux indica que o par deve receber uma conexão avulsa
+var errNoMux = errors.New("peer does not support multiplexed connections")
+
+// errPeerBackoff é retornado, sem tentar conectar, enquanto o backoff de um par não passou
+var errPeerBackoff = errors.New("waiting to reconnect")
+
+// connPool guarda as conexões persistentes com os pares e as recebidas deles
+type connPool struct {
+	mutex    sync.Mutex
+	peers    map[string]*peerPool // Por endereço do par
+	incoming map[*muxSession]bool
+	sweeping bool
+	closed   bool
+}
+
+// Conexões com um par
+type peerPool struct {
+	mutex      sync.Mutex // Serializa a escolha e a abertura de conexões com o par
+	sessions   []*muxSession
+	failures   int       // Falhas seguidas ao conectar
+	retryAt    time.Time // Próxima tentativa de conexão permitida
+	plainUntil time.Time // Até quando o par recebe conexões avulsas
+}
+
+func newConnPool() *connPool {
+	return &connPool{peers: make(map[string]*peerPool), incoming: make(map[*muxSession]bool)}
+}
+
+// Abre um stream para o par numa das até size conexões persistentes com ele, conectando a
+// dialAddress (com TLS, se tlsConfig não é nil) se for preciso. Retorna errNoMux se o par deve
+// receber uma conexão avulsa.
+func (p *connPool) open(transport Transport, address, dialAddress string, size int, timeouts PeerTimeouts, tlsConfig *tls.Config) (*muxStream, error) {
+	p.mutex.Lock()
+	if p.closed {
+		p.mutex.Unlock()
+		return nil, errNoMux
+	}
+	peer, exists := p.peers[address]
+	if !exists {
+		peer = &peerPool{}
+		p.peers[address] = peer
+	}
+	if !p.sweeping {
+		p.sweeping = true
+		go p.sweep()
+	}
+	p.mutex.Unlock()
+
+	peer.mutex.Lock()
+	defer peer.mutex.Unlock()
+
+	now := time.Now()
+	if now.Before(peer.plainUntil) {
+		return nil, errNoMux
+	}
+
+	// Usa a conexão com menos streams, a menos que todas estejam ocupadas e ainda caiba outra
+	var best *muxSession
+	live := peer.sessions[:0]
+	for _, session := range peer.sessions {
+		if session.failed() {
+			continue
+		}
+		live = append(live, session)
+		if best == nil || session.streamCount() < best.streamCount() {
+			best = session
+		}
+	}
+	peer.sessions = live
+	if best != nil && (best.streamCount() == 0 || len(live) >= size) {
+		return best.open()
+	}
+	if now.Before(peer.retryAt) {
+		if best != nil {
+			return best.open()
+		}
+		return nil, fmt.Errorf("%w to %s for %s", errPeerBackoff, address, peer.retryAt.Sub(now).Round(time.Millisecond))
+	}
+
+	session, err := dialMux(transport, dialAddress, timeouts, tlsConfig)
+	if errors.Is(err, errNoMux) {
+		gossipLog.Info("Peer does not support multiplexed connections, using a connection per message", "address", address)
+		peer.plainUntil = now.Add(muxRecheck)
+		return nil, err
+	}
+	if err != nil {
+		peer.failures++
+		peer.retryAt = now.Add(min(peerRetryMin<<(peer.failures-1), peerRetryMax))
+		if best != nil {
+			return best.open()
+		}
+		return nil, err
+	}
+	peer.failures, peer.retryAt = 0, time.Time{}
+	peer.sessions = append(peer.sessions, session)
+	return session.open()
+}
+
+// Fecha as conexões com um par, para que as próximas mensagens conectem de novo (por exemplo,
+// depois que o IP dele mudou)
+func (p *connPool) reset(address string) {
+	p.mutex.Lock()
+	peer := p.peers[address]
+	delete(p.peers, address)
+	p.mutex.Unlock()
+	if peer == nil {
+		return
+	}
+
+	peer.mutex.Lock()
+	defer peer.mutex.Unlock()
+	for _, session := range peer.sessions {
+		session.fail(net.ErrClosed)
+	}
+}
+
+// Fecha as conexões sem streams há mais de peerIdleTimeout, até o pool ser fechado
+func (p *connPool) sweep() {
+	ticker := time.NewTicker(peerIdleTimeout / 3)
+	defer ticker.Stop()
+	for range ticker.C {
+		p.mutex.Lock()
+		if p.closed {
+			p.mutex.Unlock()
+			return
+		}
+		peers := make([]*peerPool, 0, len(p.peers))
+		for _, peer := range p.peers {
+			peers = append(peers, peer)
+		}
+		p.mutex.Unlock()
+
+		now := time.Now()
+		for _, peer := range peers {
+			peer.mutex.Lock()
+			live := peer.sessions[:0]
+			for _, session := range peer.sessions {
+				if session.idleFor(now) > peerIdleTimeout {
+					session.fail(net.ErrClosed)
+					continue
+				}
+				live = append(live, session)
+			}
+			peer.sessions = live
+			peer.mutex.Unlock()
+		}
+	}
+}
+
+// Registra ou remove uma conexão recebida, fechada junto com o pool
+func (p *connPool) track(session *muxSession, active bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if !active {
+		delete(p.incoming, session)
+		return
+	}
+	if p.closed {
+		session.fail(net.ErrClosed)
+		return
+	}
+	p.incoming[session] = true
+}
+
+// Fecha todas as conexões persistentes; as mensagens seguintes usam conexões avulsas
+func (p *connPool) close() {
+	p.mutex.Lock()
+	p.closed = true
+	var sessions []*muxSession
+	for _, peer := range p.peers {
+		peer.mutex.Lock()
+		sessions = append(sessions, peer.sessions...)
+		peer.sessions = nil
+		peer.mutex.Unlock()
+	}
+	for session := range p.incoming {
+		sessions = append(sessions, session)
+	}
+	p.mutex.Unlock()
+
+	for _, session := range sessions {
+		session.fail(net.ErrClosed)
+	}
+}
+
+// Conecta ao par e pede uma conexão multiplexada (MUX). Retorna errNoMux se o par fecha a
+// conexão ou recusa a mensagem.
+func dialMux(transport Transport, address string, timeouts PeerTimeouts, tlsConfig *tls.Config) (*muxSession, error) {
+	raw, err := dialPeerAddress(transport, address, timeouts.Dial, peerKeepAlive, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	timed := &deadlineConn{Conn: raw, timeouts: timeouts}
+	conn := newPeerConn(timed, false)
+	if err := conn.send("MUX"); err != nil {
+		raw.Close()
+		return nil, err
+	}
+	fields, err := conn.receive()
+	switch {
+	case errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || err == nil && (len(fields) == 0 || fields[0] != "OK"):
+		raw.Close()
+		return nil, errNoMux
+	case err != nil:
+		raw.Close()
+		return nil, err
+	}
+
+	// A conexão fica aberta esperando streams: as leituras não têm prazo
+	timed.timeouts = PeerTimeouts{}
+	session := newMuxSession(raw, conn.reader)
+	go session.run(nil)
+	return session, nil
+}
+
+// Atende uma conexão multiplexada recebida: cada stream aberto pelo par é tratado como uma
+// conexão recebida. Retorna quando a conexão é fechada.
+func (g *Gossip) serveMux(timed *deadlineConn, conn *peerConn) {
+	if conn.text {
+		conn.send("ERROR", "MUX needs the binary protocol")
+		return
+	}
+	if err := conn.send("OK"); err != nil {
+		return
+	}
+	timed.timeouts = PeerTimeouts{}
+	session := newMuxSession(timed.Conn, conn.reader)
+	g.pool.track(session, true)
+	defer g.pool.track(session, false)
+	session.run(func(stream *muxStream) {
+		g.handleConnection(stream)
+	})
+}
+
+// muxSession é uma conexão TCP com vários streams
+type muxSession struct {
+	conn       *peerConn
+	writeMutex sync.Mutex // Serializa os quadros enviados
+	mutex      sync.Mutex // Protege os campos abaixo
+	streams    map[uint64]*muxStream
+	nextID     uint64
+	idleSince  time.Time // Quando o último stream foi fechado
+	err        error     // Motivo do fechamento da conexão (nil enquanto aberta)
+}
+
+// Cria a sessão sobre a conexão; reader é o buffer de leitura já usado no handshake
+func newMuxSession(raw net.Conn, reader io.Reader) *muxSession {
+	conn := newPeerConn(raw, false)
+	conn.reader.Reset(reader)
+	return &muxSession{conn: conn, streams: make(map[uint64]*muxStream), idleSince: time.Now()}
+}
+
+// Lê os quadros até a conexão falhar. accept recebe os streams abertos pelo par; é nil numa
+// conexão aberta por este nó, que não aceita streams.
+func (s *muxSession) run(accept func(*muxStream)) {
+	for {
+		fields, err := s.conn.receive()
+		if err != nil {
+			s.fail(err)
+			return
+		}
+		var id uint64
+		if len(fields) >= 2 {
+			id, err = strconv.ParseUint(fields[1], 10, 64)
+		}
+		switch {
+		case len(fields) < 2 || err != nil:
+			s.fail(fmt.Errorf("malformed multiplexed frame %q", formatMessage(fields)))
+			return
+		case fields[0] == "OPEN" && len(fields) == 2 && accept != nil:
+			stream, err := s.register(id)
+			if err != nil {
+				s.fail(err)
+				return
+			}
+			go accept(stream)
+		case fields[0] == "DATA" && len(fields) == 3:
+			if stream := s.stream(id); stream != nil {
+				stream.deliver(fields[2])
+			}
+		case fields[0] == "CLOSE" && len(fields) == 2:
+			if stream := s.stream(id); stream != nil {
+				s.forget(id)
+				stream.remoteClose()
+			}
+		default:
+			s.fail(fmt.Errorf("unexpected multiplexed frame %q", formatMessage(fields)))
+			return
+		}
+	}
+}
+
+// Abre um stream para o par
+func (s *muxSession) open() (*muxStream, error) {
+	s.mutex.Lock()
+	if s.err != nil {
+		s.mutex.Unlock()
+		return nil, s.err
+	}
+	s.nextID++
+	stream := newMuxStream(s, s.nextID)
+	s.streams[stream.id] = stream
+	s.mutex.Unlock()
+
+	// O OPEN vai junto com os primeiros bytes do stream
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	s.conn.SetWriteDeadline(time.Now().Add(muxWriteTimeout))
+	s.conn.queue("OPEN", strconv.FormatUint(stream.id, 10))
+	return stream, nil
+}
+
+// Registra um stream aberto pelo par
+func (s *muxSession) register(id uint64) (*muxStream, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, exists := s.streams[id]; exists || id <= s.nextID {
+		return nil, fmt.Errorf("stream %d opened twice", id)
+	}
+	s.nextID = id
+	stream := newMuxStream(s, id)
+	s.streams[id] = stream
+	return stream, nil
+}
+
+func (s *muxSession) stream(id uint64) *muxStream {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.streams[id]
+}
+
+func (s *muxSession) forget(id uint64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.streams, id)
+	if len(s.streams) == 0 {
+		s.idleSince = time.Now()
+	}
+}
+
+func (s *muxSession) streamCount() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.streams)
+}
+
+func (s *muxSession) failed() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.err != nil
+}
+
+// Retorna há quanto tempo a conexão está sem streams (0 se há algum)
+func (s *muxSession) idleFor(now time.Time) time.Duration {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.streams) > 0 {
+		return 0
+	}
+	return now.Sub(s.idleSince)
+}
+
+// Envia um quadro com o prazo dado. Um erro no meio de um quadro deixa a conexão inutilizável,
+// então qualquer erro a fecha.
+func (s *muxSession) send(deadline time.Time, fields ...string) error {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	s.conn.SetWriteDeadline(deadline)
+	err := s.conn.send(fields...)
+	if err != nil {
+		s.fail(err)
+	}
+	return err
+}
+
+// Fecha a conexão e encerra os streams com o erro
+func (s *muxSession) fail(err error) {
+	s.mutex.Lock()
+	if s.err != nil {
+		s.mutex.Unlock()
+		return
+	}
+	s.err = err
+	streams := s.streams
+	s.streams = make(map[uint64]*muxStream)
+	s.mutex.Unlock()
+
+	s.conn.Close()
+	for _, stream := range streams {
+		stream.fail(err)
+	}
+}
+
+// muxStream é um stream de uma conexão multiplexada, usado como uma conexão
+type muxStream struct {
+	session       *muxSession
+	id            uint64
+	mutex         sync.Mutex // Protege os campos abaixo
+	buffer        bytes.Buffer
+	remoteClosed  bool  // O par fechou o stream
+	closed        bool  // Este nó fechou o stream
+	err           error // Falha da conexão
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readable      chan struct{} // Avisa a leitura de novos bytes, fechamento ou mudança de prazo
+}
+
+func newMuxStream(session *muxSession, id uint64) *muxStream {
+	return &muxStream{session: session, id: id, readable: make(chan struct{}, 1)}
+}
+
+func (s *muxStream) notify() {
+	select {
+	case s.readable <- struct{}{}:
+	default:
+	}
+}
+
+func (s *muxStream) deliver(data string) {
+	s.mutex.Lock()
+	s.buffer.WriteString(data)
+	s.mutex.Unlock()
+	s.notify()
+}
+
+func (s *muxStream) remoteClose() {
+	s.mutex.Lock()
+	s.remoteClosed = true
+	s.mutex.Unlock()
+	s.notify()
+}
+
+func (s *muxStream) fail(err error) {
+	s.mutex.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.mutex.Unlock()
+	s.notify()
+}
+
+func (s *muxStream) Read(b []byte) (int, error) {
+	for {
+		s.mutex.Lock()
+		switch {
+		case s.closed:
+			s.mutex.Unlock()
+			return 0, net.ErrClosed
+		case s.buffer.Len() > 0:
+			n, _ := s.buffer.Read(b)
+			s.mutex.Unlock()
+			return n, nil
+		case s.remoteClosed:
+			s.mutex.Unlock()
+			return 0, io.EOF
+		case s.err != nil:
+			err := s.err
+			s.mutex.Unlock()
+			return 0, err
+		}
+		deadline := s.readDeadline
+		s.mutex.Unlock()
+
+		if deadline.IsZero() {
+			<-s.readable
+			continue
+		}
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return 0, os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-s.readable:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+func (s *muxStream) Write(b []byte) (int, error) {
+	s.mutex.Lock()
+	closed, remoteClosed, err, deadline := s.closed, s.remoteClosed, s.err, s.writeDeadline
+	s.mutex.Unlock()
+	switch {
+	case closed:
+		return 0, net.ErrClosed
+	case err != nil:
+		return 0, err
+	case remoteClosed:
+		return 0, io.ErrClosedPipe
+	}
+
+	id := strconv.FormatUint(s.id, 10)
+	written := 0
+	for written < len(b) {
+		chunk := b[written:min(len(b), written+muxChunkSize)]
+		if err := s.session.send(deadline, "DATA", id, string(chunk)); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+	}
+	return written, nil
+}
+
+// Fecha o stream, avisando o par se ele ainda não o fechou
+func (s *muxStream) Close() error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.closed = true
+	notifyPeer := !s.remoteClosed && s.err == nil
+	s.mutex.Unlock()
+	s.notify()
+
+	s.session.forget(s.id)
+	if notifyPeer {
+		s.session.send(time.Now().Add(muxWriteTimeout), "CLOSE", strconv.FormatUint(s.id, 10))
+	}
+	return nil
+}
+
+func (s *muxStream) LocalAddr() net.Addr  { return s.session.conn.LocalAddr() }
+func (s *muxStream) RemoteAddr() net.Addr { return s.session.conn.RemoteAddr() }
+
+func (s *muxStream) SetDeadline(t time.Time) error {
+	s.SetReadDeadline(t)
+	return s.SetWriteDeadline(t)
+}
+
+func (s *muxStream) SetReadDeadline(t time.Time) error {
+	s.mutex.Lock()
+	s.readDeadline = t
+	s.mutex.Unlock()
+	s.notify()
+	return nil
+}
+
+func (s *muxStream) SetWriteDeadline(t time.Time) error {
+	s.mutex.Lock()
+	s.writeDeadline = t
+	s.mutex.Unlock()
+	return nil
+}
@@ -0,0 +1,224 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// O primário de um trecho do anel é o primeiro nó da lista de preferência das chaves dele: é
+// quem coordena as requisições com PreferPrimary. Quando esse nó está degradado mas não fora
+// (disco lento, GC longo), o operador pode promover outra réplica do trecho com
+// "promote <nó> <posição>". A promoção só reordena as N réplicas, sem mudar quais nós guardam o
+// trecho. Antes de trocar o primário, as demais réplicas enviam ao nó promovido as versões do
+// trecho que elas têm (o destino descarta as que já conhece), para que ele assuma sem precisar
+// de read repair. A troca é a configuração range-primary, aplicada em todos os nós pela mudança
+// em duas fases e que muda a versão do anel; promover o primário natural desfaz a promoção.
+// Com tokens, a mensagem PROMOTE só é aceita de pares autenticados pelo TLS mútuo (ver auth.go).
+
+// Configuração do primário promovido de um trecho
+var primarySettings = map[string]func(c *ClusterConfig, value string) error{
+	// "<token>=<nó>" promove o nó no trecho do token; "<token>=" volta ao primário natural
+	"range-primary": func(c *ClusterConfig, value string) error {
+		tokenField, id, found := strings.Cut(value, "=")
+		token, err := strconv.ParseUint(tokenField, 10, 32)
+		if !found || err != nil {
+			return fmt.Errorf("invalid range-primary %q (use <token>=<node>)", value)
+		}
+		known := slices.ContainsFunc(c.Nodes, func(nc NodeConfig) bool {
+			return slices.Contains(nc.Tokens, uint32(token))
+		})
+		if !known {
+			return fmt.Errorf("no range ends at token %d", token)
+		}
+		if id != "" && !slices.ContainsFunc(c.Nodes, func(nc NodeConfig) bool { return nc.ID == id }) {
+			return fmt.Errorf("node %s is not a cluster member", id)
+		}
+
+		c.Primaries = maps.Clone(c.Primaries)
+		if id == "" {
+			delete(c.Primaries, uint32(token))
+			return nil
+		}
+		if c.Primaries == nil {
+			c.Primaries = make(map[uint32]string)
+		}
+		c.Primaries[uint32(token)] = id
+		return nil
+	},
+}
+
+// PromotedRange é um trecho do anel com o primário promovido
+type PromotedRange struct {
+	Range  TokenRange `json:"range"`
+	NodeID string     `json:"node"`
+}
+
+// Retorna o trecho do vNode com o token
+func (ch *ConsistentHashing) rangeEndingAt(token uint32) (TokenRange, bool) {
+	ch.mutex.RLock()
+	defer ch.mutex.RUnlock()
+	return ch.rangeEndingAtLocked(token)
+}
+
+func (ch *ConsistentHashing) rangeEndingAtLocked(token uint32) (TokenRange, bool) {
+	i, found := slices.BinarySearch(ch.SortedHashes, token)
+	if !found {
+		return TokenRange{}, false
+	}
+	prev := ch.SortedHashes[(i+len(ch.SortedHashes)-1)%len(ch.SortedHashes)]
+	return TokenRange{Start: prev, End: token}, true
+}
+
+// Retorna os trechos com primário promovido, em ordem. Deve ser chamada com o lock do anel obtido.
+func (ch *ConsistentHashing) promotedRangesLocked() []PromotedRange {
+	var promoted []PromotedRange
+	for _, r := range ch.rangesLocked() {
+		if id, exists := ch.primaries[r.End]; exists {
+			promoted = append(promoted, PromotedRange{Range: r, NodeID: id})
+		}
+	}
+	return promoted
+}
+
+// Promove o nó a primário do trecho que contém a posição do anel: as outras réplicas enviam a
+// ele as versões do trecho e, em seguida, a troca é proposta a todos os nós
+func (g *Gossip) PromotePrimary(job *Job, nodeID string, position uint32) error {
+	if g.clusterConfig() == nil {
+		return errors.New("promote needs the cluster config (run kvctl cluster init)")
+	}
+	n := g.KeyValueStore.replicationFactor()
+
+	ch := g.ConsistentHash
+	ch.mutex.RLock()
+	token := ch.tokenForLocked(position)
+	r, _ := ch.rangeEndingAtLocked(token)
+	replicas := slices.Clone(ch.replicaNodesForHashLocked(token, n))
+	current, promoted := ch.primaries[token]
+	ch.mutex.RUnlock()
+
+	if !slices.ContainsFunc(replicas, func(node *Node) bool { return node.ID == nodeID }) {
+		return fmt.Errorf("node %s is not a replica of range %s", nodeID, r)
+	}
+	if !promoted {
+		current = replicas[0].ID
+	}
+	if current == nodeID {
+		return fmt.Errorf("node %s is already the primary of range %s", nodeID, r)
+	}
+	if !g.IsNodeAlive(nodeID) {
+		return fmt.Errorf("node %s is down", nodeID)
+	}
+	target, _ := g.GetNode(nodeID)
+
+	// As réplicas que falham não impedem a promoção: o nó promovido recebe o que faltar delas
+	// por read repair
+	streamed := 0
+	for i, replica := range replicas {
+		if err := job.Progress(i, len(replicas)); err != nil {
+			return err
+		}
+		if replica.ID == nodeID {
+			continue
+		}
+		sent, err := g.streamRange(replica, target, r)
+		if err != nil {
+			replicationLog.Warn("Failed to stream range to the promoted node", "op", "promote", "range", r.String(), "peer", replica.ID, "target", nodeID, "err", err)
+			continue
+		}
+		streamed += sent
+	}
+
+	// O primário natural não precisa de promoção
+	value := fmt.Sprintf("%d=%s", token, nodeID)
+	if replicas[0].ID == nodeID {
+		value = fmt.Sprintf("%d=", token)
+	}
+	if _, err := g.ProposeSetting("range-primary", value); err != nil {
+		return err
+	}
+	clusterLog.Info("Promoted range primary", "op", "promote", "range", r.String(), "primary", nodeID, "previous", current, "keys", streamed)
+	return job.Progress(len(replicas), len(replicas))
+}
+
+// Faz a réplica enviar ao destino as chaves que ela tem do trecho, retornando quantas enviou
+func (g *Gossip) streamRange(replica, target *Node, r TokenRange) (int, error) {
+	if replica.ID == g.Self.ID {
+		task := &RebalanceTask{TargetID: target.ID, Range: r}
+		err := g.KeyValueStore.transferRange(target, task, "promote")
+		return task.Transferred, err
+	}
+	if !g.IsNodeAlive(replica.ID) {
+		return 0, errNodeDown
+	}
+	return g.SendPromote(replica, target.ID, r.End)
+}
+
+// Pede a uma réplica que envie ao nó promovido as chaves do trecho do token
+// ("PROMOTE <token> <nó>"); a resposta é "OK <chaves enviadas>"
+func (g *Gossip) SendPromote(node *Node, targetID string, token uint32) (int, error) {
+	// A réplica só responde depois de enviar o trecho inteiro
+	conn, err := g.dialReplica(node, g.Timeouts.Replication.withSlowRead(10))
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	if err := conn.send("PROMOTE", strconv.FormatUint(uint64(token), 10), targetID); err != nil {
+		return 0, err
+	}
+	fields, err := conn.receive()
+	if err != nil {
+		return 0, err
+	}
+	if len(fields) != 2 || fields[0] != "OK" {
+		return 0, fmt.Errorf("node %s answered %q", node.ID, formatMessage(fields))
+	}
+	return strconv.Atoi(fields[1])
+}
+
+// Envia ao nó promovido as chaves locais do trecho do token e responde "OK <chaves enviadas>"
+func (g *Gossip) handlePromote(conn *peerConn, args []string) {
+	if len(args) != 2 {
+		conn.send("ERROR", "malformed PROMOTE")
+		return
+	}
+	token, err := strconv.ParseUint(args[0], 10, 32)
+	if err != nil {
+		conn.send("ERROR", "invalid token")
+		return
+	}
+	target, known := g.GetNode(args[1])
+	if !known {
+		conn.send("ERROR", fmt.Sprintf("unknown node %s", args[1]))
+		return
+	}
+
+	r, found := g.ConsistentHash.rangeEndingAt(uint32(token))
+	if !found {
+		conn.send("ERROR", fmt.Sprintf("no range ends at token %d", token))
+		return
+	}
+
+	task := &RebalanceTask{TargetID: target.ID, Range: r}
+	if err := g.KeyValueStore.transferRange(target, task, "promote"); err != nil {
+		conn.send("ERROR", err.Error())
+		return
+	}
+	conn.send("OK", strconv.Itoa(task.Transferred))
+}
+
+// Runner do job de promoção: promote <nó> <posição do anel>
+func (kv *KeyValueStore) promoteJob(job *Job, args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: promote <node> <position>")
+	}
+	position, err := strconv.ParseUint(args[1], 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid ring position %q", args[1])
+	}
+	return kv.Gossip.PromotePrimary(job, args[0], uint32(position))
+}
@@ -0,0 +1,410 @@
+package store
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// O push-pull envia só os membros que mudaram desde a última troca com o par. Cada nó numera as
+// mudanças da própria lista de membros (geração, sorteada no início, e versão), e cada membro
+// guarda a versão em que mudou pela última vez. Numa troca, cada lado informa a versão do outro
+// que já mesclou (KNOWN) e envia os membros que mudaram depois da base que o par confirmou
+// (VERSION <geração> <versão> <base>). Quando o par não tem a base (ele reiniciou ou perdeu uma
+// troca), ele responde com a versão que conhece e o nó repete a troca com o estado completo. Com
+// os membros estáveis, cada troca leva só as versões e o resumo dos dados, qualquer que seja o
+// tamanho do cluster.
+
+// memberState é a visão de um membro do cluster trocada no push-pull
+type memberState struct {
+	ID      string
+	Address string
+	Tokens  []uint32
+	Index   int // Índice do nó nos Vector Clocks (0 = ainda sem índice)
+}
+
+// clusterState é o estado trocado entre dois nós no push-pull
+type clusterState struct {
+	Members []memberState
+	Digest  string            // Resumo dos dados do nó, usado para detectar divergências
+	Version membershipVersion // Versão da lista de membros de quem enviou (geração 0 = não informada)
+	Base    uint64            // Versão a partir da qual os membros foram enviados (0 = estado completo)
+	Known   membershipVersion // Versão da lista de membros do destino já mesclada por quem enviou
+}
+
+// membershipVersion identifica uma versão da lista de membros de um nó
+type membershipVersion struct {
+	Generation uint64
+	Version    uint64
+}
+
+// memberVersions numera as mudanças da lista de membros local e guarda, por par, as versões
+// trocadas no push-pull
+type memberVersions struct {
+	mutex      sync.Mutex
+	generation uint64
+	version    uint64
+	entries    map[string]memberEntry
+	seen       map[string]membershipVersion // Versão da lista de cada par já mesclada
+	acked      map[string]membershipVersion // Versão local que cada par confirmou ter mesclado
+}
+
+// memberEntry é a versão em que um membro mudou e o conteúdo que ele tinha
+type memberEntry struct {
+	version uint64
+	state   string
+}
+
+func newMemberVersions() *memberVersions {
+	return &memberVersions{
+		generation: max(rand.Uint64(), 1),
+		entries:    make(map[string]memberEntry),
+		seen:       make(map[string]membershipVersion),
+		acked:      make(map[string]membershipVersion),
+	}
+}
+
+// Numera os membros que mudaram desde a última chamada e retorna a versão atual
+func (mv *memberVersions) observe(members []memberState) membershipVersion {
+	mv.mutex.Lock()
+	defer mv.mutex.Unlock()
+
+	present := make(map[string]bool, len(members))
+	for _, member := range members {
+		present[member.ID] = true
+		state := strings.Join([]string{member.Address, encodeTokens(member.Tokens), strconv.Itoa(member.Index)}, " ")
+		if entry, exists := mv.entries[member.ID]; !exists || entry.state != state {
+			mv.version++
+			mv.entries[member.ID] = memberEntry{version: mv.version, state: state}
+		}
+	}
+	// Um membro removido não precisa ser anunciado: o push-pull só adiciona membros
+	for id := range mv.entries {
+		if !present[id] {
+			delete(mv.entries, id)
+		}
+	}
+	return membershipVersion{Generation: mv.generation, Version: mv.version}
+}
+
+// Retorna os membros que mudaram depois da versão base
+func (mv *memberVersions) since(members []memberState, base uint64) []memberState {
+	if base == 0 {
+		return members
+	}
+	mv.mutex.Lock()
+	defer mv.mutex.Unlock()
+
+	var changed []memberState
+	for _, member := range members {
+		if mv.entries[member.ID].version > base {
+			changed = append(changed, member)
+		}
+	}
+	return changed
+}
+
+// Retorna a base para enviar a quem conhece a versão known da lista local (0 = estado completo)
+func (mv *memberVersions) baseFor(known membershipVersion) uint64 {
+	mv.mutex.Lock()
+	defer mv.mutex.Unlock()
+
+	if known.Generation != mv.generation || known.Version > mv.version {
+		return 0
+	}
+	return known.Version
+}
+
+// Retorna a base confirmada pelo par na última troca
+func (mv *memberVersions) ackedBy(peerID string) uint64 {
+	mv.mutex.Lock()
+	acked := mv.acked[peerID]
+	mv.mutex.Unlock()
+	return mv.baseFor(acked)
+}
+
+// Guarda a versão local que o par informou ter mesclado
+func (mv *memberVersions) ack(peerID string, known membershipVersion) {
+	mv.mutex.Lock()
+	defer mv.mutex.Unlock()
+	mv.acked[peerID] = known
+}
+
+// Retorna a versão da lista do par já mesclada
+func (mv *memberVersions) seenFrom(peerID string) membershipVersion {
+	mv.mutex.Lock()
+	defer mv.mutex.Unlock()
+	return mv.seen[peerID]
+}
+
+// Registra o estado recebido do par e retorna a versão da lista dele mesclada até aqui. Membros
+// enviados a partir de uma base que este nó não tem são mesclados, mas não avançam a versão.
+func (mv *memberVersions) merged(peerID string, remote *clusterState) membershipVersion {
+	mv.mutex.Lock()
+	defer mv.mutex.Unlock()
+
+	seen := mv.seen[peerID]
+	switch {
+	case remote.Version.Generation == 0:
+	case remote.Base == 0:
+		seen = remote.Version
+	case seen.Generation == remote.Version.Generation && seen.Version >= remote.Base:
+		seen.Version = max(seen.Version, remote.Version.Version)
+	case seen.Generation != remote.Version.Generation:
+		seen = membershipVersion{}
+	}
+	mv.seen[peerID] = seen
+	return seen
+}
+
+// Função de loop para sincronizar periodicamente o estado completo com um par aleatório
+func (g *Gossip) StartPushPull(ctx context.Context) {
+	g.KeyValueStore.every(ctx, g.PushPullInterval, func() {
+		if peer := g.randomAlivePeer(); peer != nil {
+			if err := g.pushPull(peer); err != nil {
+				gossipLog.Warn("Push-pull failed", "op", "SYNC", "peer", peer.ID, "err", err)
+			}
+		}
+	})
+}
+
+// Escolhe um par vivo aleatório
+func (g *Gossip) randomAlivePeer() *Node {
+	g.Mutex.Lock()
+	defer g.Mutex.Unlock()
+
+	var peers []*Node
+	for _, node := range g.Nodes {
+		if node.Alive {
+			peers = append(peers, node)
+		}
+	}
+	if len(peers) == 0 {
+		return nil
+	}
+	return peers[rand.Intn(len(peers))]
+}
+
+// Envia ao par os membros que mudaram desde a última troca e mescla os recebidos dele; se o par
+// não tiver a base da troca, repete com o estado completo
+func (g *Gossip) pushPull(peer *Node) error {
+	complete, err := g.syncWith(peer, g.members.ackedBy(peer.ID))
+	if err == nil && !complete {
+		gossipLog.Debug("Membership versions gap, falling back to full push-pull", "op", "SYNC", "peer", peer.ID)
+		_, err = g.syncWith(peer, 0)
+	}
+	return err
+}
+
+// Faz uma troca com o par enviando os membros que mudaram depois da versão base, e indica se o
+// par tinha essa base
+func (g *Gossip) syncWith(peer *Node, base uint64) (bool, error) {
+	conn, err := g.dialPeer(peer.Address, g.Timeouts.Gossip)
+	if err != nil {
+		g.suspectNode(peer)
+		return false, err
+	}
+	defer conn.Close()
+
+	conn.queue("SYNC", "from", g.Self.ID)
+	if err := writeClusterState(conn, g.localState(peer.ID, base)); err != nil {
+		return false, err
+	}
+
+	remote, err := readClusterState(conn)
+	if err != nil {
+		return false, err
+	}
+	g.members.merged(peer.ID, remote)
+	g.mergeState(peer.ID, remote)
+	g.members.ack(peer.ID, remote.Known)
+
+	// Um par sem versões (anterior à troca de diferenças) sempre recebe o estado completo
+	complete := base == 0 || remote.Version.Generation == 0 ||
+		remote.Known.Generation == g.members.generation && remote.Known.Version >= base
+	return complete, nil
+}
+
+// Responde a um SYNC de um par: recebe os membros dele e devolve os que mudaram desde a versão
+// que ele conhece
+func (g *Gossip) handleSync(conn *peerConn, nodeID string) {
+	if _, known := g.GetNode(nodeID); !known {
+		gossipLog.Warn("Rejected push-pull from unknown node", "op", "SYNC", "peer", nodeID)
+		return
+	}
+
+	remote, err := readClusterState(conn)
+	if err != nil {
+		gossipLog.Warn("Push-pull from node failed", "op", "SYNC", "peer", nodeID, "err", err)
+		return
+	}
+	g.members.merged(nodeID, remote)
+	g.members.ack(nodeID, remote.Known)
+	if err := writeClusterState(conn, g.localState(nodeID, g.members.baseFor(remote.Known))); err != nil {
+		gossipLog.Warn("Push-pull to node failed", "op", "SYNC", "peer", nodeID, "err", err)
+		return
+	}
+	g.mergeState(nodeID, remote)
+}
+
+// Monta o estado local para o par: os membros conhecidos (incluindo o próprio nó) que mudaram
+// depois da versão base, as versões da lista de membros e o resumo dos dados
+func (g *Gossip) localState(peerID string, base uint64) *clusterState {
+	state := &clusterState{Digest: g.KeyValueStore.Digest(), Base: base, Known: g.members.seenFrom(peerID)}
+
+	g.Mutex.Lock()
+	members := []memberState{{
+		ID:      g.Self.ID,
+		Address: g.Self.Address,
+		Tokens:  g.ConsistentHash.Tokens(g.Self.ID),
+		Index:   g.nodeIndex.index(g.Self.ID),
+	}}
+	for _, node := range g.Nodes {
+		members = append(members, memberState{
+			ID:      node.ID,
+			Address: node.Address,
+			Tokens:  g.ConsistentHash.Tokens(node.ID),
+			Index:   g.nodeIndex.index(node.ID),
+		})
+	}
+	g.Mutex.Unlock()
+
+	state.Version = g.members.observe(members)
+	state.Members = g.members.since(members, base)
+	return state
+}
+
+// Mescla o estado recebido de um par: adiciona membros desconhecidos, adota o endereço que o
+// par anuncia para si mesmo e compara os dados
+func (g *Gossip) mergeState(peerID string, remote *clusterState) {
+	for _, member := range remote.Members {
+		if member.Index > 0 && g.nodeIndex.index(member.ID) == 0 {
+			g.nodeIndex.assign(member.ID, member.Index)
+		}
+		if member.ID == g.Self.ID {
+			continue
+		}
+		node, known := g.GetNode(member.ID)
+		if !known {
+			gossipLog.Info("Learned about node via push-pull", "node_id", member.ID, "peer", peerID)
+			g.addJoinedNode(member.ID, member.Address, member.Tokens)
+			continue
+		}
+		if member.ID == peerID && g.nodeAddress(node) != member.Address {
+			g.updateAddress(node, member.Address)
+		}
+	}
+
+	if local := g.KeyValueStore.Digest(); remote.Digest != local {
+		gossipLog.Debug("Data digest differs", "op", "SYNC", "peer", peerID, "local", local[:8], "remote", remote.Digest[:8])
+	}
+}
+
+// Envia o estado nas mensagens do push-pull, depois das que já estiverem no buffer:
+// VERSION <geração> <versão> <base> KNOWN <geração> <versão>
+// MEMBER <id> <endereço> <tokens> <índice> ... DIGEST <hash> END
+func writeClusterState(conn *peerConn, state *clusterState) error {
+	conn.queue("VERSION", strconv.FormatUint(state.Version.Generation, 10), strconv.FormatUint(state.Version.Version, 10), strconv.FormatUint(state.Base, 10))
+	conn.queue("KNOWN", strconv.FormatUint(state.Known.Generation, 10), strconv.FormatUint(state.Known.Version, 10))
+	for _, member := range state.Members {
+		conn.queue("MEMBER", member.ID, member.Address, encodeTokens(member.Tokens), strconv.Itoa(member.Index))
+	}
+	conn.queue("DIGEST", state.Digest)
+	conn.queue("END")
+	return conn.flush()
+}
+
+// Lê o estado enviado por um par até a mensagem END
+func readClusterState(conn *peerConn) (*clusterState, error) {
+	state := &clusterState{}
+	for {
+		fields, err := conn.receive()
+		if err != nil {
+			return nil, err
+		}
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch fields[0] {
+		case "VERSION":
+			if len(fields) != 4 {
+				return nil, fmt.Errorf("malformed VERSION %q", formatMessage(fields))
+			}
+			versions, err := parseUints(fields[1:])
+			if err != nil {
+				return nil, err
+			}
+			state.Version = membershipVersion{Generation: versions[0], Version: versions[1]}
+			state.Base = versions[2]
+		case "KNOWN":
+			if len(fields) != 3 {
+				return nil, fmt.Errorf("malformed KNOWN %q", formatMessage(fields))
+			}
+			versions, err := parseUints(fields[1:])
+			if err != nil {
+				return nil, err
+			}
+			state.Known = membershipVersion{Generation: versions[0], Version: versions[1]}
+		case "MEMBER":
+			if len(fields) != 4 && len(fields) != 5 {
+				return nil, fmt.Errorf("malformed MEMBER %q", formatMessage(fields))
+			}
+			tokens, err := decodeTokens(fields[3])
+			if err != nil {
+				return nil, err
+			}
+			member := memberState{ID: fields[1], Address: fields[2], Tokens: tokens}
+			if len(fields) == 5 {
+				if member.Index, err = strconv.Atoi(fields[4]); err != nil {
+					return nil, fmt.Errorf("invalid member index %q", fields[4])
+				}
+			}
+			state.Members = append(state.Members, member)
+		case "DIGEST":
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("malformed DIGEST %q", formatMessage(fields))
+			}
+			state.Digest = fields[1]
+		case "END":
+			return state, nil
+		default:
+			return nil, fmt.Errorf("unexpected push-pull message %q", formatMessage(fields))
+		}
+	}
+}
+
+// Converte os campos numéricos de uma mensagem do push-pull
+func parseUints(fields []string) ([]uint64, error) {
+	values := make([]uint64, len(fields))
+	for i, field := range fields {
+		value, err := strconv.ParseUint(field, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid version %q", field)
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
+// Retorna um resumo (SHA-1) das chaves, valores e versões armazenados localmente
+func (kv *KeyValueStore) Digest() string {
+	kv.Mutex.Lock()
+	defer kv.Mutex.Unlock()
+
+	hash := sha1.New()
+	kv.Data.Ascend(func(key string, item *DataItem) bool {
+		hash.Write([]byte(key + "\x00" + item.Value + "\x00"))
+		if item.VectorClock != nil {
+			hash.Write([]byte(encodeVectorClock(item.VectorClock.Clock)))
+		}
+		hash.Write([]byte("\n"))
+		return true
+	})
+	return hex.EncodeToString(hash.Sum(nil))
+}
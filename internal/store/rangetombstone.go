@@ -0,0 +1,175 @@
+package store
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Cabeçalho de uma página com um range tombstone no arquivo de páginas de versões anteriores:
+// "RT", versão do formato, tamanho do início e do fim do intervalo (2 bytes cada) e o momento da
+// remoção em nanossegundos (8 bytes)
+const (
+	rangeTombstoneMagic      = "RT"
+	rangeTombstoneVersion    = 1
+	rangeTombstoneHeaderSize = 15
+)
+
+// Prefixo das linhas de range tombstones no arquivo do índice
+const rangeIndexPrefix = "range "
+
+// RangeTombstone remove de uma vez as chaves do intervalo [Start, End) gravadas até At. Ele é
+// gravado numa SSTable própria e aplicado na leitura: uma versão em memória é removida se foi
+// gravada até At, e uma versão no disco se também foi gravada até At e está numa SSTable mais
+// antiga que a do tombstone. A compactação descarta as versões cobertas e, passado o
+// TombstoneGrace, o próprio tombstone.
+type RangeTombstone struct {
+	Start  string    // Primeira chave do intervalo
+	End    string    // Fim do intervalo, exclusivo (vazio = sem limite)
+	At     time.Time // Versões gravadas até este momento são removidas
+	PageID int64     // Página do registro no arquivo de páginas de versões anteriores
+}
+
+// Indica se a chave está no intervalo do tombstone
+func (rt *RangeTombstone) Contains(key string) bool {
+	return key >= rt.Start && (rt.End == "" || key < rt.End)
+}
+
+func (rt *RangeTombstone) String() string {
+	end := rt.End
+	if end == "" {
+		end = "∞"
+	}
+	return fmt.Sprintf("[%s, %s) at %s", rt.Start, end, rt.At.Format(time.RFC3339))
+}
+
+// Retorna o intervalo [start, end) das chaves com o prefixo; end é vazio se não houver limite
+func PrefixRange(prefix string) (start, end string) {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] < 0xFF {
+			return prefix, prefix[:i] + string(prefix[i]+1)
+		}
+	}
+	return prefix, ""
+}
+
+// Decodifica o range tombstone de uma página; ok é false se a página não contém um
+func decodeRangeTombstone(buffer []byte) (rt *RangeTombstone, ok bool) {
+	if len(buffer) < rangeTombstoneHeaderSize || string(buffer[:2]) != rangeTombstoneMagic || buffer[2] != rangeTombstoneVersion {
+		return nil, false
+	}
+	startLen := int(binary.BigEndian.Uint16(buffer[3:]))
+	endLen := int(binary.BigEndian.Uint16(buffer[5:]))
+	if rangeTombstoneHeaderSize+startLen+endLen > len(buffer) {
+		return nil, false
+	}
+	start := buffer[rangeTombstoneHeaderSize : rangeTombstoneHeaderSize+startLen]
+	end := buffer[rangeTombstoneHeaderSize+startLen : rangeTombstoneHeaderSize+startLen+endLen]
+	at := time.Unix(0, int64(binary.BigEndian.Uint64(buffer[7:])))
+	return &RangeTombstone{Start: string(start), End: string(end), At: at}, true
+}
+
+func (pm *PageManager) addRangeTombstone(rt *RangeTombstone) {
+	pm.indexMutex.Lock()
+	defer pm.indexMutex.Unlock()
+
+	for _, existing := range pm.ranges {
+		if existing.PageID == rt.PageID {
+			return
+		}
+	}
+	pm.ranges = append(pm.ranges, rt)
+}
+
+// Retorna uma cópia dos range tombstones ativos
+func (pm *PageManager) RangeTombstones() []RangeTombstone {
+	pm.indexMutex.Lock()
+	defer pm.indexMutex.Unlock()
+
+	ranges := make([]RangeTombstone, len(pm.ranges))
+	for i, rt := range pm.ranges {
+		ranges[i] = *rt
+	}
+	return ranges
+}
+
+// Indica se a página da chave é anterior a um range tombstone que a cobre. Chamado com indexMutex.
+func (pm *PageManager) pageCoveredLocked(key string, pageID int64) bool {
+	for _, rt := range pm.ranges {
+		if rt.PageID > pageID && rt.Contains(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// Remove as chaves do intervalo [start, end) gravadas até at com uma SSTable que contém só o
+// range tombstone. As versões em memória cobertas deixam de ser gravadas no disco no próximo flush.
+func (kv *KeyValueStore) DeleteRange(start, end string, at time.Time) (*RangeTombstone, error) {
+	if end != "" && end <= start {
+		return nil, fmt.Errorf("invalid range [%s, %s)", start, end)
+	}
+	rt := &RangeTombstone{Start: start, End: end, At: at}
+
+	kv.Mutex.Lock()
+	defer kv.Mutex.Unlock()
+
+	if err := kv.LSM.Write(nil, []*RangeTombstone{rt}); err != nil {
+		return nil, err
+	}
+
+	// Uma versão coberta gravada depois do tombstone voltaria a existir após um restart; já as
+	// versões mais novas que at continuam valendo e são regravadas depois dele
+	covered := 0
+	kv.ascendRange(start, end, func(key string, item *DataItem) {
+		if item.WrittenAt.After(at) {
+			kv.dirty[key] = true
+			return
+		}
+		delete(kv.dirty, key)
+		covered++
+	})
+	storageLog.Info("Wrote range tombstone", "range_tombstone", rt.String(), "covered", covered)
+	return rt, nil
+}
+
+// Remove deste nó as chaves com o prefixo gravadas até at
+func (kv *KeyValueStore) deletePrefix(prefix string, at time.Time) (*RangeTombstone, error) {
+	start, end := PrefixRange(prefix)
+	return kv.DeleteRange(start, end, at)
+}
+
+// Percorre as chaves em memória do intervalo [start, end). Chamado com kv.Mutex.
+func (kv *KeyValueStore) ascendRange(start, end string, fn func(key string, item *DataItem)) {
+	if item, exists := kv.Data.Get(start); exists {
+		fn(start, item)
+	}
+	kv.Data.AscendAfter(start, func(key string, item *DataItem) bool {
+		if end != "" && key >= end {
+			return false
+		}
+		fn(key, item)
+		return true
+	})
+}
+
+// Indica se a versão em memória da chave foi removida, pelo bucket ou por um range tombstone
+func (kv *KeyValueStore) versionRemoved(key string, writtenAt time.Time) bool {
+	return kv.Gossip.bucketCovers(key, writtenAt) || kv.LSM.rangeCovers(key, writtenAt)
+}
+
+// Codifica um range tombstone como uma linha do arquivo do índice
+func formatRangeIndexEntry(rt *RangeTombstone) string {
+	return fmt.Sprintf("%s%d %d %s %s\n", rangeIndexPrefix, rt.PageID, rt.At.UnixNano(), quoteField(rt.Start), quoteField(rt.End))
+}
+
+// Decodifica uma linha de range tombstone do arquivo do índice
+func parseRangeIndexEntry(line string, pages int64) (*RangeTombstone, error) {
+	var pageID, at int64
+	var start, end string
+	if _, err := fmt.Sscanf(strings.TrimPrefix(line, rangeIndexPrefix), "%d %d %s %s", &pageID, &at, &start, &end); err != nil || pageID < 0 || pageID >= pages {
+		return nil, fmt.Errorf("invalid entry %q", line)
+	}
+	return &RangeTombstone{Start: unquoteField(start), End: unquoteField(end), At: time.Unix(0, at), PageID: pageID}, nil
+}
@@ -0,0 +1,83 @@
+package store
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/bquerino/kv-g/internal/vectorclock"
+)
+
+// Envia a cada réplica que respondeu à leitura as versões mais recentes que faltam a ela
+// (read repair). Versões concorrentes são enviadas uma a uma e a réplica as guarda como irmãs.
+func (kv *KeyValueStore) readRepair(key string, missing map[string][]replicaVersion) {
+	for nodeID, versions := range missing {
+		for _, version := range versions {
+			if nodeID == kv.Gossip.Self.ID {
+				if kv.ApplyReplica(key, version.Value, version.VectorClock, version.WrittenAt) {
+					replicationLog.Info("Read repair updated local copy", "op", "repair", "key", logKey(key))
+				}
+				continue
+			}
+
+			node, exists := kv.Gossip.GetNode(nodeID)
+			if !exists {
+				break
+			}
+			applied, err := kv.Gossip.SendRepair(node, key, version.Value, version.VectorClock, version.WrittenAt)
+			switch {
+			case err != nil:
+				replicationLog.Warn("Read repair failed", "op", "repair", "key", logKey(key), "peer", nodeID, "err", err)
+			case applied:
+				replicationLog.Info("Read repair updated key", "op", "repair", "key", logKey(key), "peer", nodeID)
+			}
+		}
+	}
+}
+
+// Envia uma versão reconciliada a uma réplica ("REPAIR <key> <value> <vc> [@<gravada em>] #<checksum>", ou
+// "REPAIR <key> <vc> [@<gravada em>]" para um tombstone -> "OK <aplicada>"),
+// retornando se a réplica a aplicou
+func (g *Gossip) SendRepair(node *Node, key, value string, vc *vectorclock.VectorClock, writtenAt time.Time) (bool, error) {
+	conn, err := g.dialReplica(node, g.Timeouts.Replication)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	if err := conn.send(append([]string{"REPAIR"}, formatEntry(key, value, g.nodeIndex.encodeClock(vc), writtenAt)...)...); err != nil {
+		return false, err
+	}
+
+	fields, err := conn.receive()
+	if err != nil {
+		return false, err
+	}
+	switch {
+	case len(fields) == 2 && fields[0] == "OK" && fields[1] == "1":
+		return true, nil
+	case len(fields) == 2 && fields[0] == "OK" && fields[1] == "0":
+		return false, nil
+	}
+	return false, fmt.Errorf("replica %s answered %q", node.ID, formatMessage(fields))
+}
+
+// Aplica uma versão enviada por read repair, que só prevalece se for mais recente que a local
+func (g *Gossip) handleRepair(conn *peerConn, args []string) {
+	key, value, encoded, writtenAt, err := parseEntry(args)
+	if err != nil {
+		rejectEntry(conn, "REPAIR", err)
+		return
+	}
+
+	clock, err := g.nodeIndex.decodeClock(encoded)
+	if err != nil {
+		conn.send("ERROR", err.Error())
+		return
+	}
+
+	if g.KeyValueStore.ApplyReplica(key, value, clock, writtenAt) {
+		conn.send("OK", "1")
+		return
+	}
+	conn.send("OK", "0")
+}
@@ -0,0 +1,543 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/bquerino/kv-g/internal/vectorclock"
+)
+
+// Nome do arquivo de progresso do rebalanceamento dentro do bucket de sistema
+const rebalanceFile = "rebalance.json"
+
+// Número de chaves transferidas entre cada gravação do progresso
+const rebalanceCheckpointEvery = 16
+
+// RebalanceTask transfere as chaves locais de um trecho do anel para um nó de destino
+type RebalanceTask struct {
+	TargetID    string     `json:"target"`
+	Range       TokenRange `json:"range"`
+	LastKey     string     `json:"last_key"` // Última chave transferida (as chaves são enviadas em ordem)
+	Transferred int        `json:"transferred"`
+	Done        bool       `json:"done"`
+}
+
+// RebalancePlan é o conjunto de transferências em andamento, persistido a cada checkpoint
+type RebalancePlan struct {
+	CreatedAt time.Time        `json:"created_at"`
+	Tasks     []*RebalanceTask `json:"tasks"`
+}
+
+// Argumento do job de rebalanceamento iniciado por uma mudança de membros: sem plano pendente,
+// não há o que transferir (o rebalance manual cria um plano completo)
+const rebalanceMembershipArg = "membership"
+
+// Intervalo entre as tentativas de iniciar o job enquanto o anterior termina
+const rebalanceStartRetry = 100 * time.Millisecond
+
+// Uma transferência que falha (o destino fora, ou ainda entrando no cluster e recusando as
+// réplicas) é repetida a partir da última chave enviada, com um backoff exponencial entre as
+// tentativas; esgotadas as tentativas, o job para e o plano fica pendente
+const (
+	rebalanceRetryMin     = 500 * time.Millisecond
+	rebalanceRetryMax     = 10 * time.Second
+	rebalanceTaskAttempts = 10
+)
+
+// Retorna a primeira tarefa pendente do plano e o índice dela (nil se o plano terminou)
+func (p *RebalancePlan) nextTask() (int, *RebalanceTask) {
+	if p == nil {
+		return 0, nil
+	}
+	for i, task := range p.Tasks {
+		if !task.Done {
+			return i, task
+		}
+	}
+	return len(p.Tasks), nil
+}
+
+// Acrescenta ao plano as tarefas que ainda não estão pendentes nele, retornando quantas entraram
+func (p *RebalancePlan) add(tasks []*RebalanceTask) int {
+	added := 0
+	for _, task := range tasks {
+		if slices.ContainsFunc(p.Tasks, func(t *RebalanceTask) bool {
+			return !t.Done && t.TargetID == task.TargetID && t.Range == task.Range
+		}) {
+			continue
+		}
+		p.Tasks = append(p.Tasks, task)
+		added++
+	}
+	return added
+}
+
+// Retorna uma cópia do plano, que pode ser lida sem o rebalanceMutex
+func (p *RebalancePlan) clone() *RebalancePlan {
+	plan := &RebalancePlan{CreatedAt: p.CreatedAt, Tasks: make([]*RebalanceTask, len(p.Tasks))}
+	for i, task := range p.Tasks {
+		copied := *task
+		plan.Tasks[i] = &copied
+	}
+	return plan
+}
+
+// Retorna o caminho do arquivo de progresso do rebalanceamento
+func (kv *KeyValueStore) rebalancePath() string {
+	return filepath.Join(kv.DataDir, SystemBucket, rebalanceFile)
+}
+
+// Carrega o plano de rebalanceamento persistido, ou nil se não houver um em andamento
+func (kv *KeyValueStore) loadRebalancePlan() (*RebalancePlan, error) {
+	data, err := os.ReadFile(kv.rebalancePath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var plan RebalancePlan
+	if err := json.Unmarshal(data, &plan); err != nil {
+		return nil, fmt.Errorf("invalid rebalance progress file: %w", err)
+	}
+	return &plan, nil
+}
+
+// Grava o progresso do rebalanceamento de forma atômica. Deve ser chamada com o
+// rebalanceMutex obtido.
+func (kv *KeyValueStore) saveRebalancePlan(plan *RebalancePlan) error {
+	data, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(kv.rebalancePath(), data, 0644)
+}
+
+// Retorna o plano em andamento: o carregado pelo job ou, se nenhum job o carregou, o persistido.
+// Deve ser chamada com o rebalanceMutex obtido.
+func (kv *KeyValueStore) activeRebalancePlan() (*RebalancePlan, error) {
+	if kv.rebalancePlan != nil {
+		return kv.rebalancePlan, nil
+	}
+	return kv.loadRebalancePlan()
+}
+
+// Cria um plano que envia cada chave local para as réplicas atuais do seu trecho do anel
+func (kv *KeyValueStore) PlanRebalance() (*RebalancePlan, error) {
+	kv.rebalanceMutex.Lock()
+	defer kv.rebalanceMutex.Unlock()
+
+	if plan, err := kv.activeRebalancePlan(); err != nil || plan != nil {
+		if plan != nil {
+			return nil, fmt.Errorf("a rebalance created at %s is still in progress", plan.CreatedAt.Format(time.RFC3339))
+		}
+		return nil, err
+	}
+
+	n := kv.replicationFactor()
+	plan := &RebalancePlan{CreatedAt: time.Now()}
+
+	kv.Gossip.Mutex.Lock()
+	ranges := kv.ConsistentHash.Ranges()
+	owners := make([][]*Node, len(ranges))
+	for i, r := range ranges {
+		owners[i] = kv.ConsistentHash.ReplicaNodesForHash(r.End, n)
+	}
+	kv.Gossip.Mutex.Unlock()
+
+	for i, r := range ranges {
+		if len(kv.keysInRange(r, "")) == 0 {
+			continue
+		}
+		for _, node := range owners[i] {
+			if node.ID != kv.Gossip.Self.ID {
+				plan.Tasks = append(plan.Tasks, &RebalanceTask{TargetID: node.ID, Range: r})
+			}
+		}
+	}
+
+	if len(plan.Tasks) == 0 {
+		return plan, nil
+	}
+	kv.rebalancePlan = plan
+	return plan, kv.saveRebalancePlan(plan)
+}
+
+// Runner do job de rebalanceamento: retoma o plano persistido ou cria um novo. Tarefas
+// acrescentadas ao plano enquanto o job roda são executadas por ele.
+func (kv *KeyValueStore) rebalanceJob(job *Job, args []string) error {
+	kv.rebalanceMutex.Lock()
+	kv.rebalanceRunning = true
+	kv.rebalanceMutex.Unlock()
+
+	err := kv.executeRebalance(job, args)
+	if err != nil {
+		kv.rebalanceMutex.Lock()
+		kv.rebalanceRunning = false
+		kv.rebalanceMutex.Unlock()
+	}
+	return err
+}
+
+func (kv *KeyValueStore) executeRebalance(job *Job, args []string) error {
+	if err := kv.Gossip.awaitCoordinator(job, "rebalance"); err != nil {
+		return err
+	}
+
+	kv.rebalanceMutex.Lock()
+	plan, err := kv.activeRebalancePlan()
+	kv.rebalancePlan = plan
+	kv.rebalanceMutex.Unlock()
+	if err != nil {
+		return err
+	}
+	switch {
+	case plan != nil:
+		replicationLog.Info("Resuming rebalance", "created_at", plan.CreatedAt.Format(time.RFC3339))
+	case slices.Contains(args, rebalanceMembershipArg):
+		// As tarefas da mudança de membros já foram concluídas por um job anterior
+	default:
+		if plan, err = kv.PlanRebalance(); err != nil {
+			return err
+		}
+	}
+
+	err = kv.RunRebalance(job, plan)
+	if errors.Is(err, ErrJobCancelled) {
+		// Rebalanceamento abandonado: descarta o progresso para permitir um novo plano
+		kv.rebalanceMutex.Lock()
+		kv.rebalancePlan = nil
+		os.Remove(kv.rebalancePath())
+		kv.rebalanceMutex.Unlock()
+	}
+	return err
+}
+
+// Executa as tarefas pendentes do plano, gravando o progresso a cada checkpoint. Quando não
+// resta tarefa pendente, o plano é descartado.
+func (kv *KeyValueStore) RunRebalance(job *Job, plan *RebalancePlan) error {
+	failures := 0
+	for {
+		kv.rebalanceMutex.Lock()
+		index, task := plan.nextTask()
+		total := 0
+		if plan != nil {
+			total = len(plan.Tasks)
+		}
+		if task == nil {
+			// O fim do job é decidido com o lock, para que uma tarefa acrescentada depois
+			// inicie um novo job
+			kv.rebalancePlan = nil
+			kv.rebalanceRunning = false
+			err := os.Remove(kv.rebalancePath())
+			kv.rebalanceMutex.Unlock()
+
+			if plan != nil && len(plan.Tasks) > 0 {
+				replicationLog.Info("Rebalance completed")
+			}
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+			return nil
+		}
+		kv.rebalanceMutex.Unlock()
+
+		if err := job.Progress(index, total); err != nil {
+			return err
+		}
+		err := kv.runRebalanceTask(job, plan, task, index)
+		if err == nil {
+			failures = 0
+			continue
+		}
+		failures++
+		if errors.Is(err, ErrJobCancelled) || failures >= rebalanceTaskAttempts {
+			return fmt.Errorf("rebalance of range %s to node %s stopped: %w", task.Range, task.TargetID, err)
+		}
+		delay := min(rebalanceRetryMin<<(failures-1), rebalanceRetryMax)
+		replicationLog.Warn("Range transfer failed, retrying", "op", "rebalance", "range", task.Range.String(), "peer", task.TargetID, "attempt", failures, "retry_in", delay, "err", err)
+		if err := waitRetry(job, delay); err != nil {
+			return err
+		}
+	}
+}
+
+// Espera o intervalo até a próxima tentativa, interrompida se o job for cancelado
+func waitRetry(job *Job, delay time.Duration) error {
+	deadline := time.Now().Add(delay)
+	for time.Now().Before(deadline) {
+		if job.Cancelled() {
+			return ErrJobCancelled
+		}
+		time.Sleep(min(coordinatorPollInterval, time.Until(deadline)))
+	}
+	return nil
+}
+
+func (kv *KeyValueStore) runRebalanceTask(job *Job, plan *RebalancePlan, task *RebalanceTask, index int) error {
+	// Grava o progresso com o lock, já que novas tarefas podem entrar no plano a qualquer momento
+	checkpoint := func(update func()) error {
+		kv.rebalanceMutex.Lock()
+		defer kv.rebalanceMutex.Unlock()
+		update()
+		return kv.saveRebalancePlan(plan)
+	}
+
+	target, known := kv.Gossip.GetNode(kv.Gossip.currentID(task.TargetID))
+	if !known {
+		// O nó saiu do cluster; não há mais para onde enviar o trecho
+		replicationLog.Warn("Skipping rebalance of range: node is no longer a member", "op", "rebalance", "range", task.Range.String(), "peer", task.TargetID)
+		return checkpoint(func() { task.Done = true })
+	}
+
+	var throttle <-chan time.Time
+	if kv.RebalanceRate > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(kv.RebalanceRate))
+		defer ticker.Stop()
+		throttle = ticker.C
+	}
+
+	kv.rebalanceMutex.Lock()
+	after := task.LastKey
+	kv.rebalanceMutex.Unlock()
+
+	for i, key := range kv.keysInRange(task.Range, after) {
+		kv.rebalanceMutex.Lock()
+		total := len(plan.Tasks)
+		kv.rebalanceMutex.Unlock()
+		if err := job.Progress(index, total); err != nil {
+			checkpoint(func() {})
+			return err
+		}
+
+		exists, err := kv.transferKey(target, key, throttle, "rebalance")
+		if err != nil {
+			checkpoint(func() {})
+			return err
+		}
+
+		kv.rebalanceMutex.Lock()
+		if exists {
+			task.Transferred++
+		}
+		task.LastKey = key
+		if (i+1)%rebalanceCheckpointEvery == 0 {
+			err = kv.saveRebalancePlan(plan)
+		}
+		kv.rebalanceMutex.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	kv.rebalanceMutex.Lock()
+	task.Done = true
+	transferred := task.Transferred
+	err := kv.saveRebalancePlan(plan)
+	kv.rebalanceMutex.Unlock()
+	replicationLog.Info("Transferred range", "op", "rebalance", "range", task.Range.String(), "peer", task.TargetID, "keys", transferred)
+	return err
+}
+
+// Envia a versão local da chave ao nó, esperando throttle (se houver) antes do envio. Retorna
+// se a chave existia.
+func (kv *KeyValueStore) transferKey(target *Node, key string, throttle <-chan time.Time, op string) (bool, error) {
+	// Copia a versão atual para enviá-la sem segurar o lock durante a transferência
+	kv.Mutex.Lock()
+	item, exists := kv.loadItem(key)
+	var value string
+	var writtenAt time.Time
+	vc := vectorclock.NewVectorClock()
+	if exists {
+		value, writtenAt = item.Value, item.WrittenAt
+		vc.Merge(item.VectorClock)
+	}
+	kv.Mutex.Unlock()
+	if !exists {
+		return false, nil
+	}
+
+	if throttle != nil {
+		<-throttle
+	}
+	// Um destino que recusa a versão pelo limite de irmãs já guarda versões concorrentes
+	// demais da chave, que o cliente precisa resolver; isso não interrompe a transferência
+	err := kv.Gossip.SendReplica(target, key, value, vc, writtenAt)
+	if errors.Is(err, ErrTooManySiblings) {
+		replicationLog.Warn("Transfer target rejected the key, too many siblings", "op", op, "key", logKey(key), "peer", target.ID)
+		return true, nil
+	}
+	return true, err
+}
+
+// Retorna, em ordem, as chaves locais do trecho posteriores a after
+func (kv *KeyValueStore) keysInRange(r TokenRange, after string) []string {
+	var keys []string
+	for _, key := range kv.localKeys("", "", after) {
+		if r.Contains(kv.ConsistentHash.HashKey(key)) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// Retorna o progresso do rebalanceamento em andamento, ou nil se não houver um
+func (kv *KeyValueStore) RebalanceStatus() (*RebalancePlan, error) {
+	kv.rebalanceMutex.Lock()
+	defer kv.rebalanceMutex.Unlock()
+
+	plan, err := kv.activeRebalancePlan()
+	if plan == nil || err != nil {
+		return nil, err
+	}
+	return plan.clone(), nil
+}
+
+// Quando um nó entra ou sai do anel, cada nó compara as réplicas de cada trecho antes e depois
+// da mudança e envia as chaves que guarda aos nós que passaram a ser réplicas de um trecho. Cada
+// trecho é enviado por uma única réplica anterior, a primeira viva na ordem do anel, e não pelas N.
+
+// ringOwners guarda as réplicas de cada trecho do anel num momento
+type ringOwners struct {
+	tokens []uint32   // Tokens do anel, em ordem
+	owners [][]string // IDs das réplicas do trecho que termina em cada token
+}
+
+// Retorna as réplicas de cada trecho do anel atual
+func (kv *KeyValueStore) ringOwners(n int) ringOwners {
+	ch := kv.ConsistentHash
+	ch.mutex.RLock()
+	defer ch.mutex.RUnlock()
+
+	snapshot := ringOwners{
+		tokens: slices.Clone(ch.SortedHashes),
+		owners: make([][]string, len(ch.SortedHashes)),
+	}
+	for i, token := range snapshot.tokens {
+		for _, node := range ch.replicaNodesForHashLocked(token, n) {
+			snapshot.owners[i] = append(snapshot.owners[i], node.ID)
+		}
+	}
+	return snapshot
+}
+
+// Retorna as réplicas de uma posição do anel
+func (o ringOwners) at(hash uint32) []string {
+	if len(o.tokens) == 0 {
+		return nil
+	}
+	i := sort.Search(len(o.tokens), func(i int) bool { return o.tokens[i] >= hash })
+	return o.owners[i%len(o.tokens)]
+}
+
+// Divide o anel pelos tokens de dois momentos, em trechos que têm as mesmas réplicas em cada um
+func ringPieces(before, after []uint32) []TokenRange {
+	tokens := slices.Concat(before, after)
+	slices.Sort(tokens)
+	tokens = slices.Compact(tokens)
+
+	pieces := make([]TokenRange, 0, len(tokens))
+	for i, token := range tokens {
+		pieces = append(pieces, TokenRange{Start: tokens[(i+len(tokens)-1)%len(tokens)], End: token})
+	}
+	return pieces
+}
+
+// Cria as tarefas que levam aos novos donos os trechos que este nó deve enviar depois de uma
+// mudança de membros. before são as réplicas anteriores, calculadas com o mesmo n.
+func (kv *KeyValueStore) planOwnershipChange(before ringOwners, n int) []*RebalanceTask {
+	g := kv.Gossip
+	g.Mutex.Lock()
+	after := kv.ringOwners(n)
+	alive := func(id string) bool {
+		node, exists := g.Nodes[id]
+		return id == g.Self.ID || exists && node.Alive
+	}
+
+	var tasks []*RebalanceTask
+	for _, piece := range ringPieces(before.tokens, after.tokens) {
+		previous := before.at(piece.End)
+		sender := slices.IndexFunc(previous, alive)
+		if sender < 0 || previous[sender] != g.Self.ID {
+			continue
+		}
+		for _, id := range after.at(piece.End) {
+			if !slices.Contains(previous, id) {
+				tasks = append(tasks, &RebalanceTask{TargetID: id, Range: piece})
+			}
+		}
+	}
+	g.Mutex.Unlock()
+
+	// Só os trechos com chaves locais têm o que transferir
+	return slices.DeleteFunc(tasks, func(task *RebalanceTask) bool {
+		return len(kv.keysInRange(task.Range, "")) == 0
+	})
+}
+
+// Agenda as transferências causadas por uma mudança de membros (reason descreve a mudança)
+func (kv *KeyValueStore) rebalanceOwnershipChange(before ringOwners, n int, reason string) {
+	if !kv.AutoRebalance {
+		return
+	}
+	tasks := kv.planOwnershipChange(before, n)
+	if len(tasks) == 0 {
+		return
+	}
+
+	kv.rebalanceMutex.Lock()
+	plan, err := kv.activeRebalancePlan()
+	if err != nil {
+		kv.rebalanceMutex.Unlock()
+		replicationLog.Error("Cannot schedule the rebalance", "reason", reason, "err", err)
+		return
+	}
+	if plan == nil {
+		plan = &RebalancePlan{CreatedAt: time.Now()}
+	}
+	added := plan.add(tasks)
+	kv.rebalancePlan = plan
+	err = kv.saveRebalancePlan(plan)
+	running := kv.rebalanceRunning
+	kv.rebalanceMutex.Unlock()
+
+	if err != nil {
+		replicationLog.Error("Error saving the rebalance plan", "err", err)
+	}
+	replicationLog.Info("Scheduled range transfers", "transfers", added, "reason", reason)
+	if !running {
+		go kv.startRebalanceJob()
+	}
+}
+
+// Inicia o job de rebalanceamento para as tarefas pendentes, a menos que um job já as esteja
+// executando. Se o job anterior ainda está terminando, tenta de novo em seguida.
+func (kv *KeyValueStore) startRebalanceJob() {
+	for {
+		kv.rebalanceMutex.Lock()
+		_, pending := kv.rebalancePlan.nextTask()
+		idle := pending != nil && !kv.rebalanceRunning
+		kv.rebalanceMutex.Unlock()
+		if !idle {
+			return
+		}
+
+		job, err := kv.Jobs.Start("rebalance", rebalanceMembershipArg)
+		switch {
+		case err == nil:
+			replicationLog.Info("Started rebalance", "job", job.ID)
+			return
+		case !errors.Is(err, ErrJobInProgress):
+			replicationLog.Error("Cannot start the rebalance", "err", err)
+			return
+		}
+		time.Sleep(rebalanceStartRetry)
+	}
+}
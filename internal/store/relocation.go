@@ -0,0 +1,177 @@
+package store
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Um nó muda de endereço (e, opcionalmente, de ID) sem perder dados: o operador o reinicia com o
+// mesmo diretório de dados e com --address (e --previous-id). O nó grava a troca na própria
+// configuração do cluster e a anuncia aos pares por gossip, com a encarnação do novo início, que
+// supera a anterior. Um nó renomeado mantém os tokens do anel, então nenhuma chave muda de dono:
+// os pares o reconhecem por eles, trocam o ID no anel e passam a entregar a ele os hints que
+// guardavam para o ID antigo.
+
+// Retorna uma cópia da configuração com o nó previousID (ou id, se previousID for vazio)
+// renomeado para id e, se address não for vazio, com o novo endereço
+func (c *ClusterConfig) Relocate(id, previousID, address string) (*ClusterConfig, error) {
+	current := id
+	if previousID != "" && previousID != id {
+		if strings.ContainsAny(id, "#=@, \t") {
+			return nil, fmt.Errorf("node id %q must not contain '#', '=', '@', ',' or whitespace", id)
+		}
+		if slices.ContainsFunc(c.Nodes, func(nc NodeConfig) bool { return nc.ID == id }) {
+			return nil, fmt.Errorf("node id %s is already in the cluster config", id)
+		}
+		current = previousID
+	}
+	if !slices.ContainsFunc(c.Nodes, func(nc NodeConfig) bool { return nc.ID == current }) {
+		return nil, fmt.Errorf("node %s is not in the cluster config", current)
+	}
+	return c.withRelocation(id, current, address), nil
+}
+
+// Retorna uma cópia da configuração com o membro previousID trocado por id no endereço address
+// (vazio mantém o endereço). Um ID trocado fica registrado em Renamed.
+func (c *ClusterConfig) withRelocation(id, previousID, address string) *ClusterConfig {
+	next := *c
+	next.Nodes = append([]NodeConfig(nil), c.Nodes...)
+	for i := range next.Nodes {
+		if next.Nodes[i].ID != previousID {
+			continue
+		}
+		next.Nodes[i].ID = id
+		if address != "" {
+			next.Nodes[i].Address = address
+		}
+	}
+	if previousID != id {
+		next.Renamed = make(map[string]string, len(c.Renamed)+1)
+		for old, renamed := range c.Renamed {
+			next.Renamed[old] = renamed
+		}
+		next.Renamed[previousID] = id
+		next.Primaries = maps.Clone(c.Primaries)
+		for token, primary := range next.Primaries {
+			if primary == previousID {
+				next.Primaries[token] = id
+			}
+		}
+	}
+	return &next
+}
+
+// Anuncia aos pares o endereço e o ID deste nó, depois de uma troca feita com Relocate
+func (g *Gossip) AnnounceRelocation() {
+	gossipLog.Info("Announcing new address", "address", g.Self.Address, "incarnation", g.Self.Incarnation)
+	g.broadcasts.enqueue(g.memberUpdate(updateAlive, g.Self))
+}
+
+// Retorna o ID atual de um nó, seguindo as trocas de ID registradas na configuração
+func (g *Gossip) currentID(nodeID string) string {
+	config := g.clusterConfig()
+	if config == nil {
+		return nodeID
+	}
+	for range len(config.Renamed) {
+		renamed, exists := config.Renamed[nodeID]
+		if !exists {
+			break
+		}
+		nodeID = renamed
+	}
+	return nodeID
+}
+
+// Retorna o membro que possui exatamente os tokens dados, que é o mesmo nó com outro ID: os
+// tokens são gerados a partir do ID, e um nó renomeado mantém os anteriores. Deve ser chamada
+// com o Mutex obtido.
+func (g *Gossip) tokenOwner(tokens []uint32) *Node {
+	if len(tokens) == 0 {
+		return nil
+	}
+	ch := g.ConsistentHash
+	ch.mutex.RLock()
+	defer ch.mutex.RUnlock()
+
+	owner, exists := ch.HashMap[tokens[0]]
+	if !exists || owner == g.Self || !slices.Equal(ch.tokensLocked(owner.ID), sortedTokens(tokens)) {
+		return nil
+	}
+	return owner
+}
+
+func sortedTokens(tokens []uint32) []uint32 {
+	sorted := slices.Clone(tokens)
+	slices.Sort(sorted)
+	return sorted
+}
+
+// Troca o ID de um membro no anel, mantendo os tokens. Deve ser chamada com o Mutex obtido;
+// a configuração é gravada por recordRelocation depois que o Mutex é liberado.
+func (g *Gossip) renameNode(previous *Node, id, address string, tokens []uint32) {
+	node := &Node{
+		ID:        id,
+		Address:   address,
+		Alive:     previous.Alive,
+		LastCheck: time.Now(),
+	}
+	delete(g.Nodes, previous.ID)
+	g.Nodes[id] = node
+	ch := g.ConsistentHash
+	ch.mutex.Lock()
+	ch.removeNodeLocked(previous.ID)
+	ch.addNodeWithTokensLocked(node, tokens)
+	ch.mutex.Unlock()
+	g.breakers.reset(previous.ID)
+	// Um nó fora continua com as escritas que perdeu registradas para a retomada
+	g.KeyValueStore.replicaLog.rename(previous.ID, id)
+	gossipLog.Info("Node was renamed", "peer", id, "previous_id", previous.ID, "address", address)
+}
+
+// Retorna o endereço atual de um membro
+func (g *Gossip) nodeAddress(node *Node) string {
+	g.Mutex.Lock()
+	defer g.Mutex.Unlock()
+	return node.Address
+}
+
+// Troca o endereço de um membro que anunciou um novo
+func (g *Gossip) updateAddress(node *Node, address string) {
+	g.Mutex.Lock()
+	previous := node.Address
+	node.Address = address
+	g.Mutex.Unlock()
+
+	gossipLog.Info("Address of node changed", "peer", node.ID, "previous", previous, "address", address)
+	// As falhas de conexão eram com o endereço antigo
+	g.breakers.reset(node.ID)
+	g.recordRelocation(node.ID, node.ID, address)
+}
+
+// Grava na configuração do cluster o novo ID ou endereço de um membro, se o cluster foi
+// inicializado
+func (g *Gossip) recordRelocation(id, previousID, address string) {
+	g.settingsMutex.Lock()
+	defer g.settingsMutex.Unlock()
+
+	config := g.clusterConfig()
+	if config == nil {
+		return
+	}
+	next := config.withRelocation(id, previousID, address)
+	if err := next.Save(g.KeyValueStore.DataDir); err != nil {
+		clusterLog.Error("Failed to save the new address of node", "peer", id, "err", err)
+	}
+	g.clusterMutex.Lock()
+	g.Cluster = next
+	g.clusterMutex.Unlock()
+	if previousID != id && len(next.Primaries) > 0 {
+		g.Mutex.Lock()
+		g.ConsistentHash.SetPrimaries(next.Primaries, g.KeyValueStore.replicationFactor())
+		g.Mutex.Unlock()
+	}
+}
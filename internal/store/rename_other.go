@@ -0,0 +1,10 @@
+//go:build !windows
+
+package store
+
+import "os"
+
+// Substitui o destino atomicamente (rename é atômico em sistemas POSIX)
+func renameFile(from, to string) error {
+	return os.Rename(from, to)
+}
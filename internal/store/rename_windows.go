@@ -0,0 +1,43 @@
+//go:build windows
+
+package store
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"time"
+)
+
+// Erros do Windows retornados quando outro processo (antivírus, indexador,
+// outro nó lendo o arquivo) mantém o destino aberto durante o rename
+const (
+	errorAccessDenied     syscall.Errno = 5
+	errorSharingViolation syscall.Errno = 32
+	errorLockViolation    syscall.Errno = 33
+)
+
+const (
+	renameAttempts = 10
+	renameBackoff  = 20 * time.Millisecond
+)
+
+// Substitui o destino, tentando novamente enquanto ele estiver bloqueado por outro processo
+func renameFile(from, to string) error {
+	var err error
+	for attempt := 0; attempt < renameAttempts; attempt++ {
+		if err = os.Rename(from, to); err == nil || !isLockError(err) {
+			return err
+		}
+		time.Sleep(renameBackoff * time.Duration(attempt+1))
+	}
+	return err
+}
+
+func isLockError(err error) bool {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return false
+	}
+	return errno == errorAccessDenied || errno == errorSharingViolation || errno == errorLockViolation
+}
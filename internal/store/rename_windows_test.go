@@ -0,0 +1,120 @@
+//go:build windows
+
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Abre o arquivo sem compartilhamento, como um antivírus ou indexador que o mantém aberto:
+// enquanto o handle estiver aberto, o rename sobre ele falha com violação de compartilhamento
+func lockExclusively(t *testing.T, path string) syscall.Handle {
+	t.Helper()
+	name, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handle, err := syscall.CreateFile(name, syscall.GENERIC_READ, 0, nil, syscall.OPEN_EXISTING, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+	if err != nil {
+		t.Fatalf("lock %s: %v", path, err)
+	}
+	return handle
+}
+
+func TestRenameFileRetriesWhileDestinationIsLocked(t *testing.T) {
+	dir := t.TempDir()
+	from, to := filepath.Join(dir, "from"), filepath.Join(dir, "to")
+	if err := os.WriteFile(from, []byte("novo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(to, []byte("antigo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	handle := lockExclusively(t, to)
+	// Sem a nova tentativa, o rename falharia agora
+	if err := os.Rename(from, to); !isLockError(err) {
+		syscall.CloseHandle(handle)
+		t.Fatalf("rename over a locked file = %v, want a lock error", err)
+	}
+	released := make(chan struct{})
+	go func() {
+		time.Sleep(3 * renameBackoff)
+		syscall.CloseHandle(handle)
+		close(released)
+	}()
+
+	err := renameFile(from, to)
+	<-released
+	if err != nil {
+		t.Fatalf("renameFile did not retry until the lock was released: %v", err)
+	}
+	if data, err := os.ReadFile(to); err != nil || string(data) != "novo" {
+		t.Fatalf("ReadFile = %q, %v", data, err)
+	}
+}
+
+func TestRenameFileGivesUpOnPersistentLock(t *testing.T) {
+	dir := t.TempDir()
+	from, to := filepath.Join(dir, "from"), filepath.Join(dir, "to")
+	if err := os.WriteFile(from, []byte("novo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(to, []byte("antigo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	handle := lockExclusively(t, to)
+	defer syscall.CloseHandle(handle)
+
+	err := renameFile(from, to)
+	if !isLockError(err) {
+		t.Fatalf("renameFile = %v, want the lock error after %d attempts", err, renameAttempts)
+	}
+	// A origem continua no lugar para a próxima tentativa
+	if _, statErr := os.Stat(from); statErr != nil {
+		t.Fatalf("source was lost: %v", statErr)
+	}
+}
+
+// writeFileAtomic usa o rename com novas tentativas: um leitor que segura o destino por pouco
+// tempo não faz a gravação falhar
+func TestWriteFileAtomicWaitsForLockedDestination(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cluster.json")
+	if err := writeFileAtomic(path, []byte("antigo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	handle := lockExclusively(t, path)
+	go func() {
+		time.Sleep(2 * renameBackoff)
+		syscall.CloseHandle(handle)
+	}()
+
+	if err := writeFileAtomic(path, []byte("novo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "novo" {
+		t.Fatalf("ReadFile = %q, %v", data, err)
+	}
+}
+
+func TestIsLockError(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{&os.LinkError{Op: "rename", Err: errorSharingViolation}, true},
+		{&os.LinkError{Op: "rename", Err: errorLockViolation}, true},
+		{&os.LinkError{Op: "rename", Err: errorAccessDenied}, true},
+		{&os.LinkError{Op: "rename", Err: syscall.ERROR_FILE_NOT_FOUND}, false},
+		{os.ErrNotExist, false},
+		{nil, false},
+	} {
+		if got := isLockError(tc.err); got != tc.want {
+			t.Errorf("isLockError(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package store
+
+import (
+	"sync"
+	"time"
+
+	"github.com/bquerino/kv-g/internal/vectorclock"
+)
+
+// Número de escritas mantidas no log de cada trecho do anel
+const replicaLogSize = 1024
+
+// Escrita aplicada localmente, registrada no log do trecho da chave
+type replicaLogEntry struct {
+	Seq         uint64
+	Key         string
+	Value       string
+	VectorClock *vectorclock.VectorClock
+	Time        time.Time
+}
+
+// Log das escritas aplicadas num trecho, numeradas por uma sequência crescente
+type rangeLog struct {
+	seq     uint64
+	entries []replicaLogEntry
+}
+
+// replicaLog guarda as escritas aplicadas recentemente por trecho do anel (identificado pelo
+// token do vNode dono). Quando um par fica fora por pouco tempo, o nó envia a ele somente as
+// escritas posteriores à queda, em vez de um reparo completo.
+type replicaLog struct {
+	mutex  sync.Mutex
+	ranges map[uint32]*rangeLog
+	downAt map[string]map[uint32]uint64 // Por nó fora: última sequência de cada trecho que ele já possuía
+}
+
+func newReplicaLog() *replicaLog {
+	return &replicaLog{
+		ranges: make(map[uint32]*rangeLog),
+		downAt: make(map[string]map[uint32]uint64),
+	}
+}
+
+// Registra uma escrita aplicada no trecho e retorna sua sequência
+func (l *replicaLog) append(token uint32, key, value string, vc *vectorclock.VectorClock) uint64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	r, exists := l.ranges[token]
+	if !exists {
+		r = &rangeLog{}
+		l.ranges[token] = r
+	}
+
+	clock := vectorclock.NewVectorClock()
+	clock.Merge(vc)
+
+	r.seq++
+	r.entries = append(r.entries, replicaLogEntry{Seq: r.seq, Key: key, Value: value, VectorClock: clock, Time: time.Now()})
+
+	// Descarta as entradas mais antigas em blocos, para não copiar o log a cada escrita
+	if len(r.entries) >= 2*replicaLogSize {
+		r.entries = append([]replicaLogEntry(nil), r.entries[len(r.entries)-replicaLogSize:]...)
+	}
+	return r.seq
+}
+
+// Registra a posição de cada trecho no momento em que o nó foi visto pela última vez,
+// para que a retomada envie somente as escritas aplicadas desde então
+func (l *replicaLog) markDown(nodeID string, lastSeen time.Time) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if _, exists := l.downAt[nodeID]; exists {
+		return
+	}
+
+	positions := make(map[uint32]uint64, len(l.ranges))
+	for token, r := range l.ranges {
+		positions[token] = r.seq
+		for i := len(r.entries) - 1; i >= 0 && !r.entries[i].Time.Before(lastSeen); i-- {
+			positions[token] = r.entries[i].Seq - 1
+		}
+	}
+	l.downAt[nodeID] = positions
+}
+
+// Retira as escritas que um nó perdeu enquanto estava fora. complete é false quando
+// parte delas já saiu do log e o nó precisa de um reparo completo; ok é false quando
+// o nó não estava marcado como fora.
+func (l *replicaLog) delta(nodeID string) (entries []replicaLogEntry, positions map[uint32]uint64, complete, ok bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	positions, ok = l.downAt[nodeID]
+	if !ok {
+		return nil, nil, false, false
+	}
+	delete(l.downAt, nodeID)
+
+	complete = true
+	for token, r := range l.ranges {
+		since := positions[token] // Trechos criados depois da queda começam em 0
+		if len(r.entries) > 0 && r.entries[0].Seq > since+1 {
+			complete = false
+		}
+		for _, entry := range r.entries {
+			if entry.Seq > since {
+				entries = append(entries, entry)
+			}
+		}
+	}
+	return entries, positions, complete, true
+}
+
+// Devolve as posições de um nó cuja retomada falhou, para tentar de novo na próxima volta
+func (l *replicaLog) restore(nodeID string, positions map[uint32]uint64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if _, exists := l.downAt[nodeID]; !exists {
+		l.downAt[nodeID] = positions
+	}
+}
+
+// Passa ao novo ID de um nó renomeado as posições registradas para o ID anterior
+func (l *replicaLog) rename(previousID, id string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if positions, exists := l.downAt[previousID]; exists {
+		delete(l.downAt, previousID)
+		l.downAt[id] = positions
+	}
+}
+
+// Registra no log do trecho uma escrita aplicada localmente. Deve ser chamada com o Mutex do
+// KeyValueStore obtido, para que o log tenha as escritas da chave na ordem em que foram aplicadas;
+// o anel é lido sob o lock próprio dele.
+func (kv *KeyValueStore) logApplied(key, value string, vc *vectorclock.VectorClock) {
+	token := kv.ConsistentHash.KeyToken(key)
+	kv.replicaLog.append(token, key, value, vc)
+}
+
+// Envia a um nó que voltou as escritas que ele perdeu, a partir do log de réplicas
+func (kv *KeyValueStore) catchUp(node *Node) {
+	entries, positions, complete, ok := kv.replicaLog.delta(node.ID)
+	if !ok {
+		return
+	}
+
+	var hints []*Hint
+	for _, entry := range entries {
+		for _, replica := range kv.ConsistentHash.GetReplicaNodes(entry.Key, kv.replicationFactor()) {
+			if replica.ID == node.ID {
+				hints = append(hints, &Hint{
+					Key:         entry.Key,
+					Value:       entry.Value,
+					VectorClock: entry.VectorClock,
+					TargetID:    node.ID,
+					Timestamp:   entry.Time,
+				})
+				break
+			}
+		}
+	}
+
+	if !complete {
+		replicationLog.Warn("Replica log no longer holds every write the node missed; the node needs a full repair", "peer", node.ID)
+	}
+	if len(hints) == 0 {
+		return
+	}
+
+	sortHints(hints)
+	replicationLog.Info("Sending missed writes from the replica log", "peer", node.ID, "writes", len(hints))
+	if delivered := kv.deliverHints(node, hints); delivered < len(hints) {
+		kv.replicaLog.restore(node.ID, positions)
+	}
+}
@@ -0,0 +1,416 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bquerino/kv-g/internal/vectorclock"
+)
+
+// DegradationPolicy define o comportamento de uma escrita quando há menos de N réplicas vivas
+type DegradationPolicy string
+
+const (
+	DegradeHint      DegradationPolicy = "hint"    // Escreve nas réplicas vivas e guarda hints para as que estão fora
+	DegradeAvailable DegradationPolicy = "degrade" // Escreve somente nas réplicas vivas, sem hints
+	DegradeReject    DegradationPolicy = "reject"  // Rejeita a escrita se não houver N réplicas vivas
+)
+
+// Converte o nome de uma política de degradação, validando o valor
+func ParseDegradationPolicy(name string) (DegradationPolicy, error) {
+	switch policy := DegradationPolicy(name); policy {
+	case DegradeHint, DegradeAvailable, DegradeReject:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown degradation policy %q (use hint, degrade or reject)", name)
+}
+
+// PutResult descreve quantas cópias de uma escrita foram efetivamente gravadas
+type PutResult struct {
+	Key         string
+	Requested   int      // Fator de replicação configurado (N)
+	Replicas    int      // Réplicas que confirmaram a escrita
+	Hinted      int      // Réplicas que receberão a escrita via hinted handoff
+	Standbys    []string // IDs dos standbys que guardaram hints e contam para o W (sloppy quorum)
+	Resolved    int      // Versões concorrentes substituídas pela escrita (resolve)
+	Written     []string // IDs dos nós que gravaram a escrita
+	Coordinator string   // Nó que coordenou a escrita
+	Pending     bool     // Confirmada pelo ack rápido; as outras réplicas recebem a escrita em segundo plano
+	Outcomes    []ReplicaOutcome
+}
+
+// Indica se a escrita foi gravada em menos cópias do que o configurado
+func (r *PutResult) Degraded() bool {
+	return r.Replicas < r.Requested
+}
+
+func (r *PutResult) String() string {
+	s := fmt.Sprintf("replication %d/%d", r.Replicas, r.Requested)
+	if r.Hinted > 0 {
+		s += fmt.Sprintf(", %d hinted", r.Hinted)
+	}
+	if len(r.Standbys) > 0 {
+		s += fmt.Sprintf(" (standbys %s)", strings.Join(r.Standbys, ", "))
+	}
+	if r.Resolved > 0 {
+		s += fmt.Sprintf(", %d siblings resolved", r.Resolved)
+	}
+	if r.Pending {
+		s += ", replicating in the background"
+	} else if r.Degraded() {
+		s += " (degraded)"
+	}
+	return s
+}
+
+// GetResult descreve o valor devolvido por uma leitura e como ele foi obtido
+type GetResult struct {
+	Key         string
+	Value       string
+	VectorClock *vectorclock.VectorClock
+	Found       bool
+	Checksum    string    // Checksum do valor (vazio se a chave não foi encontrada)
+	Coordinator string    // Nó que coordenou a leitura
+	ServedBy    string    // Réplica cuja versão foi devolvida
+	WrittenAt   time.Time // Quando essa réplica gravou a versão (zero se desconhecido)
+	Requested   int       // Fator de replicação (N)
+	Required    int       // Respostas exigidas (R)
+	Responses   int       // Réplicas que responderam
+	Repaired    int       // Réplicas desatualizadas que receberam read repair
+	Cached      bool      // Ausência respondida pelo cache negativo, sem consultar as réplicas
+	Siblings    []Sibling // Versões concorrentes encontradas (vazio sem conflito); o VectorClock junta os de todas
+	Stale       bool      // Servida de um hint ou cópia deste nó com réplicas fora: pode estar desatualizada
+	Pending     bool      // A versão pode ser de uma escrita com ack rápido ainda sem as W confirmações
+}
+
+// Descreve a consistência obtida pela leitura (ex.: "2 responses (R=2, N=3)")
+func (r *GetResult) Consistency() string {
+	if r.Cached {
+		return fmt.Sprintf("not found in the negative cache (R=%d, N=%d)", r.Required, r.Requested)
+	}
+	s := fmt.Sprintf("%d responses (R=%d, N=%d)", r.Responses, r.Required, r.Requested)
+	if r.Repaired > 0 {
+		s += fmt.Sprintf(", %d read-repaired", r.Repaired)
+	}
+	if r.Stale {
+		s += ", served from data held for down replicas (possibly stale)"
+	}
+	if r.Pending {
+		s += ", not yet durable on W replicas"
+	}
+	return s
+}
+
+// Fator de replicação usado quando nem o nó nem o cluster o configuram
+const DefaultReplicationFactor = 3
+
+// Retorna o fator de replicação: o do nó, o do cluster ou o padrão, nessa ordem
+func (kv *KeyValueStore) replicationFactor() int {
+	if kv.ReplicationFactor > 0 {
+		return kv.ReplicationFactor
+	}
+	if cluster := kv.Gossip.clusterConfig(); cluster != nil && cluster.N > 0 {
+		return cluster.N
+	}
+	return DefaultReplicationFactor
+}
+
+// Indica se este nó é uma das N réplicas da chave
+func (kv *KeyValueStore) isReplica(key string) bool {
+	for _, node := range kv.ConsistentHash.GetReplicaNodes(key, kv.replicationFactor()) {
+		if node.ID == kv.Gossip.Self.ID {
+			return true
+		}
+	}
+	return false
+}
+
+// Codifica um Vector Clock para o protocolo em texto ("node1=3,node2=1")
+func encodeVectorClock(clock map[string]int) string {
+	ids := make([]string, 0, len(clock))
+	for id := range clock {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	parts := make([]string, 0, len(ids))
+	for _, id := range ids {
+		parts = append(parts, fmt.Sprintf("%s=%d", id, clock[id]))
+	}
+	return strings.Join(parts, ",")
+}
+
+// Decodifica um Vector Clock do protocolo em texto
+func decodeVectorClock(s string) (*vectorclock.VectorClock, error) {
+	vc := vectorclock.NewVectorClock()
+	if s == "" || s == "-" {
+		return vc, nil
+	}
+
+	for _, part := range strings.Split(s, ",") {
+		id, counter, found := strings.Cut(part, "=")
+		if !found || id == "" {
+			return nil, fmt.Errorf("invalid vector clock entry %q", part)
+		}
+		if _, exists := vc.Clock[id]; exists {
+			return nil, fmt.Errorf("duplicate vector clock entry for node %q", id)
+		}
+		// O horário do contador é opcional: "<id>=<contador>@<segundos Unix>"
+		counter, updated, timed := strings.Cut(counter, "@")
+		if timed {
+			seconds, err := strconv.ParseInt(updated, 10, 64)
+			if err != nil || seconds < 0 {
+				return nil, fmt.Errorf("invalid vector clock timestamp %q", part)
+			}
+			vc.Updated[id] = seconds
+		}
+		n, err := strconv.Atoi(counter)
+		if err != nil {
+			return nil, fmt.Errorf("invalid vector clock counter %q: %w", part, err)
+		}
+		if n < 0 {
+			return nil, fmt.Errorf("negative vector clock counter %q", part)
+		}
+		vc.Clock[id] = n
+	}
+	return vc, nil
+}
+
+// Tempo máximo de espera pela resposta de uma réplica
+const replicaTimeout = 2 * time.Second
+
+// Resultado do contato com uma réplica durante uma operação de quórum
+type ReplicaStatus string
+
+const (
+	ReplicaOK      ReplicaStatus = "ok"
+	ReplicaTimeout ReplicaStatus = "timeout"
+	ReplicaError   ReplicaStatus = "error"
+	ReplicaSkipped ReplicaStatus = "skipped" // Réplica conhecida como fora e não contatada
+)
+
+// ReplicaOutcome registra como uma réplica respondeu a uma operação
+type ReplicaOutcome struct {
+	NodeID  string
+	Status  ReplicaStatus
+	Latency time.Duration
+	Err     error
+}
+
+func (o ReplicaOutcome) String() string {
+	switch o.Status {
+	case ReplicaOK:
+		return fmt.Sprintf("%s ok in %s", o.NodeID, o.Latency)
+	case ReplicaTimeout:
+		return fmt.Sprintf("%s timed out after %s", o.NodeID, o.Latency)
+	case ReplicaError:
+		return fmt.Sprintf("%s failed in %s: %v", o.NodeID, o.Latency, o.Err)
+	}
+	return fmt.Sprintf("%s not contacted (down)", o.NodeID)
+}
+
+// Cria o ReplicaOutcome de uma chamada a uma réplica, classificando timeouts
+func newReplicaOutcome(nodeID string, start time.Time, err error) ReplicaOutcome {
+	outcome := ReplicaOutcome{NodeID: nodeID, Status: ReplicaOK, Latency: time.Since(start), Err: err}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		outcome.Status = ReplicaTimeout
+	} else if err != nil {
+		outcome.Status = ReplicaError
+	}
+	return outcome
+}
+
+// QuorumError é retornado quando uma leitura ou escrita não atinge o quórum,
+// com o diagnóstico de cada réplica envolvida
+type QuorumError struct {
+	Op       string // "read" ou "write"
+	Key      string
+	Required int
+	Acks     int
+	Replicas []ReplicaOutcome
+}
+
+func (e *QuorumError) Error() string {
+	details := make([]string, 0, len(e.Replicas))
+	for _, outcome := range e.Replicas {
+		details = append(details, outcome.String())
+	}
+	return fmt.Sprintf("%s quorum not reached for key %s: %d of %d required replicas answered [%s]",
+		e.Op, e.Key, e.Acks, e.Required, strings.Join(details, "; "))
+}
+
+// Retorna o número de confirmações necessárias para uma escrita (W), limitado a N
+func (kv *KeyValueStore) writeQuorum() int {
+	if kv.WriteQuorum > 0 {
+		return min(kv.WriteQuorum, kv.replicationFactor())
+	}
+	if cluster := kv.Gossip.clusterConfig(); cluster != nil && cluster.W > 0 {
+		return min(cluster.W, kv.replicationFactor())
+	}
+	return 1
+}
+
+// Retorna o número de respostas necessárias para uma leitura (R), limitado a N
+func (kv *KeyValueStore) readQuorum() int {
+	if kv.ReadQuorum > 0 {
+		return min(kv.ReadQuorum, kv.replicationFactor())
+	}
+	if cluster := kv.Gossip.clusterConfig(); cluster != nil && cluster.R > 0 {
+		return min(cluster.R, kv.replicationFactor())
+	}
+	return 1
+}
+
+// ConsistencyLevel escolhe, por operação, quantas réplicas precisam responder a uma leitura ou
+// confirmar uma escrita, no lugar do R ou W configurado
+type ConsistencyLevel string
+
+const (
+	ConsistencyDefault ConsistencyLevel = ""       // R ou W configurado
+	ConsistencyOne     ConsistencyLevel = "one"    // Uma réplica
+	ConsistencyQuorum  ConsistencyLevel = "quorum" // Maioria das N réplicas
+	ConsistencyAll     ConsistencyLevel = "all"    // Todas as N réplicas
+)
+
+// Converte o nome de um nível de consistência (one, quorum ou all, sem diferenciar maiúsculas);
+// uma string vazia retorna o nível padrão
+func ParseConsistencyLevel(name string) (ConsistencyLevel, error) {
+	switch level := ConsistencyLevel(strings.ToLower(name)); level {
+	case ConsistencyDefault, ConsistencyOne, ConsistencyQuorum, ConsistencyAll:
+		return level, nil
+	}
+	return "", fmt.Errorf("unknown consistency level %q (use one, quorum or all)", name)
+}
+
+// Retorna quantas réplicas, de n, o nível exige; configured é o R ou W em vigor
+func (l ConsistencyLevel) required(n, configured int) int {
+	switch l {
+	case ConsistencyOne:
+		return 1
+	case ConsistencyQuorum:
+		return n/2 + 1
+	case ConsistencyAll:
+		return n
+	}
+	return configured
+}
+
+// Versão de uma chave informada por uma réplica numa leitura
+type replicaVersion struct {
+	NodeID      string
+	Value       string
+	VectorClock *vectorclock.VectorClock
+	WrittenAt   time.Time // Quando a réplica gravou a versão (zero se ela não informou)
+	Found       bool
+	Siblings    []replicaVersion // Versões concorrentes que a réplica guarda junto com esta
+}
+
+// Escolhe a versão mais recente entre as respostas de uma leitura. Versões concorrentes são
+// desempatadas de forma determinística (principalVersion) e a versão escolhida recebe a junção
+// dos Vector Clocks, para superar todas as respondidas.
+// Retorna se alguma réplica tinha a chave e se havia versões concorrentes.
+func reconcileVersions(key string, versions []replicaVersion) (replicaVersion, bool, bool) {
+	siblings := concurrentVersions(versions)
+	if len(siblings) == 0 {
+		return replicaVersion{}, false, false
+	}
+	latest := principalVersion(siblings)
+	if len(siblings) == 1 {
+		return latest, true, false
+	}
+	replicationLog.Info("Conflict detected between concurrent versions", "key", logKey(key), "versions", len(siblings))
+	latest.VectorClock = mergedClock(siblings)
+	return latest, true, true
+}
+
+// Indica se dois Vector Clocks têm exatamente os mesmos contadores
+func clocksEqual(a, b *vectorclock.VectorClock) bool {
+	if len(a.Clock) != len(b.Clock) {
+		return false
+	}
+	for id, counter := range a.Clock {
+		if b.Clock[id] != counter {
+			return false
+		}
+	}
+	return true
+}
+
+// Codifica um horário para o protocolo entre nós (nanossegundos Unix; 0 = desconhecido)
+func encodeTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func decodeTime(s string) (time.Time, error) {
+	nanos, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || nanos < 0 {
+		return time.Time{}, fmt.Errorf("invalid timestamp %q", s)
+	}
+	if nanos == 0 {
+		return time.Time{}, nil
+	}
+	return time.Unix(0, nanos), nil
+}
+
+// Formata uma escrita como os campos de uma mensagem entre nós ("<key> <value> <vc> [@<gravada
+// em>] #<checksum>"). O valor vazio de um tombstone é omitido, assim como o checksum dele:
+// "<key> <vc> [@<gravada em>]". O horário em que o coordenador gravou a versão é omitido quando
+// desconhecido.
+func formatEntry(key, value, clock string, writtenAt time.Time) []string {
+	entry := []string{key, clock}
+	if value != "" {
+		entry = []string{key, value, clock}
+	}
+	if !writtenAt.IsZero() {
+		entry = append(entry, "@"+strconv.FormatInt(writtenAt.UnixNano(), 10))
+	}
+	if value != "" {
+		entry = append(entry, checksumField(value))
+	}
+	return entry
+}
+
+// Escrita recebida fora do formato de formatEntry
+var errMalformedEntry = errors.New("malformed entry")
+
+// Interpreta os campos de uma escrita formatada por formatEntry, conferindo o valor com o
+// checksum, quando informado. writtenAt é zero quando o remetente não informou o horário.
+func parseEntry(fields []string) (key, value, clock string, writtenAt time.Time, err error) {
+	fields, checksum := takeChecksum(fields, len(fields)-1)
+	if n := len(fields); n > 0 && strings.HasPrefix(fields[n-1], "@") {
+		t, err := decodeTime(fields[n-1][1:])
+		if err != nil {
+			return "", "", "", time.Time{}, errMalformedEntry
+		}
+		writtenAt, fields = t, fields[:n-1]
+	}
+	switch len(fields) {
+	case 2:
+		return fields[0], "", fields[1], writtenAt, nil
+	case 3:
+		if err := VerifyChecksum(fields[1], checksum); err != nil {
+			return "", "", "", time.Time{}, fmt.Errorf("key %s: %w", fields[0], err)
+		}
+		return fields[0], fields[1], fields[2], writtenAt, nil
+	}
+	return "", "", "", time.Time{}, errMalformedEntry
+}
+
+// Recusa uma escrita recebida de outro nó que não pôde ser interpretada, registrando no log os
+// valores corrompidos
+func rejectEntry(conn *peerConn, op string, err error) {
+	if errors.Is(err, ErrChecksumMismatch) {
+		replicationLog.Error("Received a corrupted value, rejecting it", "op", op, "remote", conn.RemoteAddr(), "err", err)
+	}
+	conn.send("ERROR", fmt.Sprintf("invalid %s: %v", op, err))
+}
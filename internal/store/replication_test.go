@@ -0,0 +1,37 @@
+package store
+
+import (
+	"maps"
+	"testing"
+)
+
+// Um Vector Clock aceito por decodeVectorClock volta com os mesmos contadores depois de
+// codificado por encodeVectorClock (que não leva os horários)
+func FuzzDecodeVectorClock(f *testing.F) {
+	for _, seed := range []string{
+		"", "-", "node1=3", "node1=3,node2=1", "node1=3@1700000000", "a=1,a=2", "=1", "a=",
+		"a=-1", "a=1@x", "a=+1", "a@b=1", "a=1,,b=2",
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, s string) {
+		vc, err := decodeVectorClock(s)
+		if err != nil {
+			return
+		}
+		for id, counter := range vc.Clock {
+			if id == "" || counter < 0 {
+				t.Fatalf("decodeVectorClock(%q) accepted entry %q=%d", s, id, counter)
+			}
+		}
+		encoded := encodeVectorClock(vc.Clock)
+		decoded, err := decodeVectorClock(encoded)
+		if err != nil {
+			t.Fatalf("decodeVectorClock(%q) = %v, but its encoding %q does not decode: %v", s, vc, encoded, err)
+		}
+		if !maps.Equal(vc.Clock, decoded.Clock) {
+			t.Fatalf("round trip of %q changed %v into %v", s, vc.Clock, decoded.Clock)
+		}
+	})
+}
@@ -0,0 +1,158 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// Pares configurados por nome (ex.: "kv-2.kv:8082") têm o nome resolvido de novo a cada
+// ResolveInterval. As conexões usam o último IP resolvido, então uma falha temporária do DNS não
+// interrompe a comunicação, e uma troca de IP (restart de um container, IP flutuante) é percebida
+// sem intervenção: o circuit breaker do par é fechado e o par é sondado no novo endereço.
+
+// Intervalo padrão entre as resoluções dos nomes dos pares
+const DefaultResolveInterval = 30 * time.Second
+
+// Tempo máximo de uma consulta ao DNS
+const resolveTimeout = 5 * time.Second
+
+// addressBook guarda o último IP resolvido de cada nome de par
+type addressBook struct {
+	mutex sync.Mutex
+	hosts map[string]string
+}
+
+func newAddressBook() *addressBook {
+	return &addressBook{hosts: make(map[string]string)}
+}
+
+// Retorna o nome do endereço, ou "" se o endereço já é um IP
+func addressHost(address string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil || net.ParseIP(host) != nil {
+		return ""
+	}
+	return host
+}
+
+// Retorna o último IP resolvido do nome do endereço ("" se ele ainda não foi resolvido)
+func (b *addressBook) lookup(address string) string {
+	host := addressHost(address)
+	if host == "" {
+		return ""
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.hosts[host]
+}
+
+// Retorna o endereço usado nas conexões: o nome trocado pelo último IP resolvido, se houver
+func (b *addressBook) dialAddress(address string) string {
+	ip := b.lookup(address)
+	if ip == "" {
+		return address
+	}
+	_, port, _ := net.SplitHostPort(address)
+	return net.JoinHostPort(ip, port)
+}
+
+// Resolve o nome e guarda o IP, retornando o IP anterior ("" se o nome não era conhecido). Numa
+// falha de resolução, o último IP continua valendo.
+func (b *addressBook) refresh(host string) (previous, current string, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	previous = b.hosts[host]
+	if err != nil {
+		return previous, previous, err
+	}
+	current = pickAddress(addrs, previous)
+	b.hosts[host] = current
+	return previous, current, nil
+}
+
+// Escolhe um IP entre os resolvidos: o anterior, se continua na lista, ou o primeiro IPv4
+// (o mesmo que o servidor do par escolhe ao ouvir no nome)
+func pickAddress(addrs []net.IPAddr, previous string) string {
+	for _, addr := range addrs {
+		if addr.IP.String() == previous {
+			return previous
+		}
+	}
+	for _, addr := range addrs {
+		if addr.IP.To4() != nil {
+			return addr.IP.String()
+		}
+	}
+	return addrs[0].IP.String()
+}
+
+// Resolve de novo, a cada ResolveInterval, os nomes dos pares (ResolveInterval 0 desativa)
+func (g *Gossip) StartAddressResolver(ctx context.Context) {
+	if g.ResolveInterval <= 0 {
+		return
+	}
+	g.resolvePeers()
+	g.KeyValueStore.every(ctx, g.ResolveInterval, g.resolvePeers)
+}
+
+// Resolve os nomes dos pares e trata os que mudaram de IP
+func (g *Gossip) resolvePeers() {
+	g.Mutex.Lock()
+	byHost := make(map[string][]*Node)
+	for _, node := range g.Nodes {
+		if host := addressHost(node.Address); host != "" {
+			byHost[host] = append(byHost[host], node)
+		}
+	}
+	g.Mutex.Unlock()
+
+	for host, nodes := range byHost {
+		previous, current, err := g.addresses.refresh(host)
+		switch {
+		case err != nil:
+			gossipLog.Warn("Failed to resolve peer, keeping its address", "host", host, "address", previous, "err", err)
+		case previous != "" && previous != current:
+			for _, node := range nodes {
+				gossipLog.Info("Address of node changed", "peer", node.ID, "host", host, "previous", previous, "address", current)
+				// As falhas de conexão eram com o IP antigo: o par é sondado logo no novo
+				g.breakers.reset(node.ID)
+				g.pool.reset(node.Address)
+				go g.probe(node)
+			}
+		}
+	}
+}
+
+// Descreve o endereço de um par com o último IP resolvido ("kv-2:8082 (10.0.0.5)")
+func (g *Gossip) describeAddress(address string) string {
+	if ip := g.addresses.lookup(address); ip != "" {
+		return address + " (" + ip + ")"
+	}
+	return address
+}
+
+// Conecta a um par com os timeouts dados, pelo último IP resolvido do nome dele. Com PeerConns,
+// a "conexão" é um stream de uma das conexões persistentes com o par (ver pool.go).
+func (g *Gossip) dialPeer(address string, timeouts PeerTimeouts) (*peerConn, error) {
+	if g.PeerConns > 0 && !g.TextProtocol {
+		stream, err := g.pool.open(g.Transport, address, g.addresses.dialAddress(address), g.PeerConns, timeouts, tlsForAddress(g.TLS, address))
+		if err == nil {
+			return newPeerConn(&deadlineConn{Conn: stream, timeouts: timeouts}, false), nil
+		}
+		if !errors.Is(err, errNoMux) {
+			return nil, err
+		}
+	}
+	conn, err := dialWithTimeouts(g.Transport, g.addresses.dialAddress(address), timeouts, tlsForAddress(g.TLS, address))
+	if err != nil {
+		return nil, err
+	}
+	return newPeerConn(conn, g.TextProtocol), nil
+}
@@ -0,0 +1,165 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// Com poucos vNodes por nó (3 por padrão), os trechos do anel variam muito de tamanho e um nó
+// pode ficar com bem mais chaves que os outros. A distribuição do anel mostra, para cada nó
+// físico, a fração do anel de que ele é a réplica primária e de que ele é uma das N réplicas,
+// e o maior trecho contínuo que ele possui como primário; o desvio padrão das frações entre os
+// nós resume o desequilíbrio. Ela é recalculada a cada RingInterval, quando o anel muda,
+// e registrada no log.
+
+// Intervalo padrão entre as verificações de mudança do anel
+const DefaultRingInterval = 30 * time.Second
+
+// Tamanho do espaço de hashes do anel
+const ringSize = float64(1 << 32)
+
+// NodeOwnership é a parte do anel de um nó físico
+type NodeOwnership struct {
+	ID           string  `json:"id"`
+	Tokens       int     `json:"tokens"`        // vNodes do nó
+	Primary      float64 `json:"primary"`       // Fração do anel de que o nó é a réplica primária
+	Replica      float64 `json:"replica"`       // Fração do anel de que o nó é uma das N réplicas
+	LargestRange float64 `json:"largest_range"` // Maior trecho contínuo de que o nó é o primário, como fração do anel
+}
+
+// RingStats é a distribuição do anel entre os nós físicos
+type RingStats struct {
+	Epoch         uint64          `json:"epoch"` // Versão do anel
+	VNodes        int             `json:"vnodes"`
+	N             int             `json:"n"`
+	Nodes         []NodeOwnership `json:"nodes"`
+	StdDev        float64         `json:"stddev"`         // Desvio padrão das frações primárias entre os nós
+	ReplicaStdDev float64         `json:"replica_stddev"` // Desvio padrão das frações de réplica entre os nós
+	Imbalance     float64         `json:"imbalance"`      // Maior fração primária sobre a ideal (1 = anel equilibrado)
+	ComputedAt    time.Time       `json:"computed_at"`
+	Promoted      []PromotedRange `json:"promoted,omitempty"` // Trechos com primário promovido (promote)
+}
+
+func (s *RingStats) String() string {
+	return fmt.Sprintf("%d nodes, %d vnodes each: primary share stddev %.1f%%, replica share stddev %.1f%%, largest owner %.2fx its fair share",
+		len(s.Nodes), s.VNodes, s.StdDev*100, s.ReplicaStdDev*100, s.Imbalance)
+}
+
+// Calcula a distribuição do anel para o fator de replicação n
+func (ch *ConsistentHashing) Distribution(n int) *RingStats {
+	ch.mutex.RLock()
+	defer ch.mutex.RUnlock()
+
+	stats := &RingStats{Epoch: ch.epoch, VNodes: ch.VNodes, N: n, ComputedAt: time.Now(), Promoted: ch.promotedRangesLocked()}
+	byID := make(map[string]*NodeOwnership)
+	owner := func(id string) *NodeOwnership {
+		if byID[id] == nil {
+			byID[id] = &NodeOwnership{ID: id}
+		}
+		return byID[id]
+	}
+
+	ranges := ch.rangesLocked()
+	lengths := make([]float64, len(ranges))
+	for i, tr := range ranges {
+		lengths[i] = ringSize
+		if len(ranges) > 1 {
+			lengths[i] = float64(tr.End - tr.Start) // Com a volta do anel, a subtração em uint32 dá o tamanho
+		}
+		primary := owner(ch.HashMap[tr.End].ID)
+		primary.Tokens++
+		primary.Primary += lengths[i] / ringSize
+		for _, node := range ch.replicaNodesForHashLocked(tr.End, n) {
+			owner(node.ID).Replica += lengths[i] / ringSize
+		}
+	}
+
+	// Trechos vizinhos do mesmo primário formam um trecho contínuo; a busca começa depois de uma
+	// troca de dono para não partir em dois o trecho que atravessa o fim do anel
+	start := 0
+	for i := range ranges {
+		if ch.HashMap[ranges[i].End].ID != ch.HashMap[ranges[(i+len(ranges)-1)%len(ranges)].End].ID {
+			start = i
+			break
+		}
+	}
+	run := 0.0
+	for k := range ranges {
+		i := (start + k) % len(ranges)
+		id := ch.HashMap[ranges[i].End].ID
+		if k > 0 && id != ch.HashMap[ranges[(i+len(ranges)-1)%len(ranges)].End].ID {
+			run = 0
+		}
+		run += lengths[i] / ringSize
+		if node := byID[id]; run > node.LargestRange {
+			node.LargestRange = run
+		}
+	}
+
+	for _, node := range byID {
+		stats.Nodes = append(stats.Nodes, *node)
+	}
+	sort.Slice(stats.Nodes, func(i, j int) bool { return stats.Nodes[i].ID < stats.Nodes[j].ID })
+	if len(stats.Nodes) == 0 {
+		return stats
+	}
+
+	primaries := make([]float64, len(stats.Nodes))
+	replicas := make([]float64, len(stats.Nodes))
+	for i, node := range stats.Nodes {
+		primaries[i], replicas[i] = node.Primary, node.Replica
+		stats.Imbalance = max(stats.Imbalance, node.Primary*float64(len(stats.Nodes)))
+	}
+	stats.StdDev, stats.ReplicaStdDev = stdDev(primaries), stdDev(replicas)
+	return stats
+}
+
+// Desvio padrão populacional
+func stdDev(values []float64) float64 {
+	mean := 0.0
+	for _, v := range values {
+		mean += v
+	}
+	mean /= float64(len(values))
+	variance := 0.0
+	for _, v := range values {
+		variance += (v - mean) * (v - mean)
+	}
+	return math.Sqrt(variance / float64(len(values)))
+}
+
+// Retorna a distribuição do anel, recalculada se o anel mudou desde o último cálculo
+func (g *Gossip) RingStats() *RingStats {
+	n := g.KeyValueStore.replicationFactor()
+	g.Mutex.Lock()
+	epoch := g.ConsistentHash.Epoch()
+	g.Mutex.Unlock()
+
+	g.ringStatsMutex.Lock()
+	defer g.ringStatsMutex.Unlock()
+	if g.ringStats != nil && g.ringStats.Epoch == epoch && g.ringStats.N == n {
+		return g.ringStats
+	}
+	g.Mutex.Lock()
+	g.ringStats = g.ConsistentHash.Distribution(n)
+	g.Mutex.Unlock()
+	return g.ringStats
+}
+
+// Verifica a cada RingInterval se o anel mudou e, se sim, recalcula a distribuição e a
+// registra no log (RingInterval 0 desativa)
+func (g *Gossip) StartRingStats(ctx context.Context) {
+	if g.RingInterval <= 0 {
+		return
+	}
+	var logged *RingStats
+	g.KeyValueStore.every(ctx, g.RingInterval, func() {
+		if stats := g.RingStats(); stats != logged {
+			clusterLog.Info("Ring distribution", "nodes", len(stats.Nodes), "vnodes", stats.VNodes, "stddev", stats.StdDev, "replica_stddev", stats.ReplicaStdDev, "imbalance", stats.Imbalance)
+			logged = stats
+		}
+	})
+}
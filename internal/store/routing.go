@@ -0,0 +1,71 @@
+package store
+
+import (
+	"fmt"
+	"strings"
+)
+
+// RoutingRule define qual parte da chave posiciona a chave no anel. Chaves com o mesmo prefixo
+// (um grupo de co-localização, como order:123:itens e order:123:total) caem na mesma lista de
+// preferência, o que permite lotes atômicos num único nó e scans eficientes por prefixo.
+type RoutingRule struct {
+	Delimiter string `json:"delimiter"` // Separador dos segmentos da chave (ex.: ":")
+	Segments  int    `json:"segments"`  // Segmentos iniciais usados no hash
+}
+
+// Cria uma regra de roteamento; um delimitador vazio desativa o roteamento por prefixo
+func NewRoutingRule(delimiter string, segments int) (*RoutingRule, error) {
+	if delimiter == "" {
+		return nil, nil
+	}
+	if strings.ContainsAny(delimiter, " \t\n") {
+		return nil, fmt.Errorf("routing delimiter must not contain whitespace")
+	}
+	if segments < 1 {
+		return nil, fmt.Errorf("routing segments must be at least 1, got %d", segments)
+	}
+	return &RoutingRule{Delimiter: delimiter, Segments: segments}, nil
+}
+
+// Retorna a parte da chave usada no hash: os primeiros Segments segmentos, se a chave tiver
+// mais segmentos do que isso, ou a chave inteira
+func (r *RoutingRule) RoutingKey(key string) string {
+	if r == nil {
+		return key
+	}
+	end, from := 0, 0
+	for i := 0; i < r.Segments; i++ {
+		next := strings.Index(key[from:], r.Delimiter)
+		if next < 0 {
+			return key
+		}
+		end = from + next
+		from = end + len(r.Delimiter)
+	}
+	return key[:end]
+}
+
+func (r *RoutingRule) String() string {
+	if r == nil {
+		return "whole key"
+	}
+	return fmt.Sprintf("first %d segment(s) split by %q", r.Segments, r.Delimiter)
+}
+
+// Retorna a posição da chave no anel, aplicando a regra de roteamento
+func (ch *ConsistentHashing) HashKey(key string) uint32 {
+	ch.mutex.RLock()
+	defer ch.mutex.RUnlock()
+	return ch.hashKeyLocked(key)
+}
+
+func (ch *ConsistentHashing) hashKeyLocked(key string) uint32 {
+	return ch.HashFunction(ch.Routing.RoutingKey(key))
+}
+
+// Retorna a chave de roteamento fixada pelo prefixo, se ele contém todos os segmentos da regra
+func (ch *ConsistentHashing) PrefixRoutingKey(prefix string) (string, bool) {
+	ch.mutex.RLock()
+	defer ch.mutex.RUnlock()
+	return ch.Routing.PrefixRoutingKey(prefix)
+}
@@ -0,0 +1,491 @@
+package store
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// ScanFilter é um filtro avaliado em cada nó durante um scan, antes de enviar as chaves ao
+// coordenador. As expressões aceitas são "contains:<texto>" (o valor contém o texto) e
+// "json:<campo>=<valor>" (o valor é um objeto JSON cujo campo, que pode ser um caminho com
+// pontos como cliente.uf, é igual ao valor; strings são comparadas sem as aspas).
+type ScanFilter struct {
+	Expr     string   // Expressão original, enviada aos outros nós
+	contains string   // Texto procurado por contains:
+	path     []string // Caminho do campo de json:
+	equals   string   // Valor esperado do campo de json:
+}
+
+// Interpreta uma expressão de filtro; a expressão vazia não filtra e retorna nil
+func ParseScanFilter(expr string) (*ScanFilter, error) {
+	if expr == "" {
+		return nil, nil
+	}
+	if strings.IndexFunc(expr, unicode.IsSpace) >= 0 {
+		return nil, fmt.Errorf("scan filter must not contain whitespace")
+	}
+
+	kind, arg, _ := strings.Cut(expr, ":")
+	switch kind {
+	case "contains":
+		if arg == "" {
+			return nil, fmt.Errorf("scan filter %q has no text to search for", expr)
+		}
+		return &ScanFilter{Expr: expr, contains: arg}, nil
+	case "json":
+		field, value, ok := strings.Cut(arg, "=")
+		if !ok || field == "" {
+			return nil, fmt.Errorf("scan filter %q must be json:<field>=<value>", expr)
+		}
+		path := strings.Split(field, ".")
+		for _, name := range path {
+			if name == "" {
+				return nil, fmt.Errorf("scan filter %q has an empty field name", expr)
+			}
+		}
+		return &ScanFilter{Expr: expr, path: path, equals: value}, nil
+	}
+	return nil, fmt.Errorf("unknown scan filter %q (use contains:<text> or json:<field>=<value>)", expr)
+}
+
+// Indica se o valor passa no filtro; um filtro nil aceita qualquer valor
+func (f *ScanFilter) Match(value string) bool {
+	if f == nil {
+		return true
+	}
+	if f.path == nil {
+		return strings.Contains(value, f.contains)
+	}
+
+	decoder := json.NewDecoder(strings.NewReader(value))
+	decoder.UseNumber()
+	var field any
+	if err := decoder.Decode(&field); err != nil {
+		return false
+	}
+	for _, name := range f.path {
+		object, ok := field.(map[string]any)
+		if !ok {
+			return false
+		}
+		if field, ok = object[name]; !ok {
+			return false
+		}
+	}
+
+	switch field := field.(type) {
+	case string:
+		return field == f.equals
+	case json.Number:
+		return field.String() == f.equals
+	case bool:
+		return strconv.FormatBool(field) == f.equals
+	case nil:
+		return f.equals == "null"
+	}
+	return false
+}
+
+func (f *ScanFilter) String() string {
+	if f == nil {
+		return "none"
+	}
+	return f.Expr
+}
+
+// Retorna a parte da chave usada no hash comum a todas as chaves com o prefixo; ok é false se
+// o prefixo não chega a fixar os segmentos de roteamento e as chaves podem estar em qualquer nó
+func (r *RoutingRule) PrefixRoutingKey(prefix string) (routingKey string, ok bool) {
+	if r == nil {
+		return "", false
+	}
+	routingKey = r.RoutingKey(prefix)
+	return routingKey, routingKey != prefix
+}
+
+// ScanCursor é a posição de um scan paginado em cada nó. Ele volta ao cliente como um token
+// opaco (Token) e, na próxima página, cada nó continua depois da sua posição em vez de
+// percorrer de novo o prefixo desde o início.
+type ScanCursor struct {
+	Prefix string            `json:"p"`
+	Start  string            `json:"s,omitempty"` // Início do intervalo de um ScanRange
+	End    string            `json:"e,omitempty"` // Fim do intervalo de um ScanRange
+	Filter string            `json:"f,omitempty"`
+	After  map[string]string `json:"a"`           // Última chave já coberta em cada nó
+	Done   []string          `json:"d,omitempty"` // Nós que não têm mais chaves no prefixo
+}
+
+// Codifica o cursor como um token opaco para o cliente
+func (c *ScanCursor) Token() string {
+	encoded, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(encoded)
+}
+
+// Decodifica o token de uma página, que precisa ser de um scan com o mesmo prefixo e filtro;
+// o token vazio começa do início e retorna nil
+func ParseScanToken(token, prefix string, filter *ScanFilter) (*ScanCursor, error) {
+	cursor, err := decodeScanToken(token)
+	if err != nil || cursor == nil {
+		return nil, err
+	}
+	if cursor.Prefix != prefix || cursor.Start != "" || cursor.End != "" || cursor.Filter != filter.expr() {
+		return nil, fmt.Errorf("page token belongs to a scan with another prefix or filter")
+	}
+	return cursor, nil
+}
+
+// Decodifica o token de uma página de um ScanRange, que precisa ser do mesmo intervalo e filtro
+func ParseScanRangeToken(token, start, end string, filter *ScanFilter) (*ScanCursor, error) {
+	cursor, err := decodeScanToken(token)
+	if err != nil || cursor == nil {
+		return nil, err
+	}
+	if cursor.Prefix != "" || cursor.Start != start || cursor.End != end || cursor.Filter != filter.expr() {
+		return nil, fmt.Errorf("page token belongs to a scan with another range or filter")
+	}
+	return cursor, nil
+}
+
+func decodeScanToken(token string) (*ScanCursor, error) {
+	if token == "" {
+		return nil, nil
+	}
+	encoded, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("invalid page token")
+	}
+	cursor := &ScanCursor{}
+	if err := json.Unmarshal(encoded, cursor); err != nil || len(cursor.After) == 0 {
+		return nil, fmt.Errorf("invalid page token")
+	}
+	return cursor, nil
+}
+
+// Retorna de onde o nó continua o scan; um nó que não estava no cursor (entrou no cluster
+// depois da página anterior) continua da menor posição
+func (c *ScanCursor) position(nodeID string) (after string, done bool) {
+	if c == nil {
+		return "", false
+	}
+	if slices.Contains(c.Done, nodeID) {
+		return "", true
+	}
+	if after, ok := c.After[nodeID]; ok {
+		return after, false
+	}
+	first := true
+	for _, position := range c.After {
+		if first || position < after {
+			after, first = position, false
+		}
+	}
+	return after, false
+}
+
+// Retorna a interseção dos intervalos [start, end) e [otherStart, otherEnd); fim vazio não limita
+func intersectRange(start, end, otherStart, otherEnd string) (string, string) {
+	start = max(start, otherStart)
+	if end == "" || otherEnd != "" && otherEnd < end {
+		end = otherEnd
+	}
+	return start, end
+}
+
+func (f *ScanFilter) expr() string {
+	if f == nil {
+		return ""
+	}
+	return f.Expr
+}
+
+// ScanPage é uma página de um scan
+type ScanPage struct {
+	Results []*GetResult
+	Next    *ScanCursor   // Cursor da próxima página (nil na última)
+	Failed  []NodeFailure // Nós que não responderam; as cópias deles ficaram fora da página
+}
+
+// Resposta de um nó a um scan: as versões das chaves do prefixo, a maior chave enviada e a
+// última chave que passou no filtro, se o nó parou no limite
+type scanPartial struct {
+	versions map[string]replicaVersion
+	maxKey   string
+	lastKey  string
+}
+
+func (p *scanPartial) add(key string, version replicaVersion) {
+	p.versions[key] = version
+	p.maxKey = max(p.maxKey, key)
+}
+
+// Lê as chaves com o prefixo espalhando o scan pelos nós: cada nó avalia o filtro sobre as
+// suas cópias e envia só os valores que passam nele (e, sem o valor, as versões das demais
+// chaves, para que cópias antigas que passariam no filtro sejam descartadas). O coordenador
+// escolhe a versão mais recente de cada chave. Se o prefixo fixa os segmentos da regra de
+// roteamento, só as réplicas do grupo são consultadas. Os nós são consultados em paralelo (até
+// ScatterWorkers ao mesmo tempo, cada um com ScatterTimeout para responder); os que estão fora
+// ou não respondem ficam em Failed e o resultado é montado com os demais.
+// limit = 0 não limita; com cursor, o scan continua da página anterior.
+func (kv *KeyValueStore) Scan(prefix string, limit int, filter *ScanFilter, cursor *ScanCursor) (*ScanPage, error) {
+	start, end := PrefixRange(prefix)
+	return kv.scan(prefix, start, end, limit, filter, cursor, false)
+}
+
+// Lê as chaves do intervalo [start, end), em ordem, como o Scan; end vazio não limita o fim.
+// Todos os nós são consultados, porque as chaves de um intervalo se espalham pelo anel.
+func (kv *KeyValueStore) ScanRange(start, end string, limit int, filter *ScanFilter, cursor *ScanCursor) (*ScanPage, error) {
+	if end != "" && end <= start {
+		return nil, fmt.Errorf("scan range end %q must be greater than start %q", end, start)
+	}
+	return kv.scan("", start, end, limit, filter, cursor, false)
+}
+
+// Executa um scan das chaves com o prefixo no intervalo [start, end); um ScanRange tem o prefixo
+// vazio. Com tombstones, as chaves removidas também entram na página, com Found false.
+func (kv *KeyValueStore) scan(prefix, start, end string, limit int, filter *ScanFilter, cursor *ScanCursor, tombstones bool) (*ScanPage, error) {
+	candidates := kv.prefixNodes(prefix)
+
+	// Nós que terminaram numa página anterior não são consultados de novo
+	var targets []*Node
+	var done []string
+	for _, node := range candidates {
+		if _, finished := cursor.position(node.ID); finished {
+			done = append(done, node.ID)
+			continue
+		}
+		targets = append(targets, node)
+	}
+
+	ids := make([]string, len(targets))
+	for i, node := range targets {
+		ids[i] = node.ID
+	}
+	partials, failed := scatterGather(ids, kv.Workers.ScatterWorkers, kv.ScatterTimeout, func(i int) (*scanPartial, error) {
+		node := targets[i]
+		after, _ := cursor.position(node.ID)
+		switch {
+		case node.ID == kv.Gossip.Self.ID:
+			return kv.scanLocal(start, end, after, limit, filter, nil), nil
+		case kv.Gossip.IsNodeAlive(node.ID):
+			return kv.Gossip.FetchScan(node, prefix, start, end, after, limit, filter)
+		}
+		return nil, errNodeDown
+	})
+	if len(failed) > 0 {
+		replicationLog.Warn("Scan is missing nodes", "op", "scan", "start", start, "end", end, "missing", len(failed), "nodes", len(targets), "failed", FormatNodeFailures(failed))
+	}
+
+	// Um nó que parou no limite pode ter mais chaves depois da última enviada: o resultado só é
+	// completo até a menor dessas chaves
+	cutoff := ""
+	versions := make(map[string][]replicaVersion)
+	for _, partial := range partials {
+		if partial == nil {
+			continue
+		}
+		if partial.lastKey != "" && (cutoff == "" || partial.lastKey < cutoff) {
+			cutoff = partial.lastKey
+		}
+		for key, version := range partial.versions {
+			versions[key] = append(versions[key], version)
+		}
+	}
+
+	keys := make([]string, 0, len(versions))
+	for key := range versions {
+		if cutoff == "" || key <= cutoff {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	page := &ScanPage{Failed: failed}
+	pageEnd := cutoff
+	for _, key := range keys {
+		if limit > 0 && len(page.Results) >= limit {
+			pageEnd = page.Results[len(page.Results)-1].Key
+			break
+		}
+		latest, found, _ := reconcileVersions(key, versions[key])
+		if !found || (latest.Value == "" && !tombstones) {
+			continue
+		}
+		page.Results = append(page.Results, &GetResult{
+			Key:         key,
+			Value:       latest.Value,
+			VectorClock: latest.VectorClock,
+			Found:       latest.Value != "",
+			Coordinator: kv.Gossip.Self.ID,
+			ServedBy:    latest.NodeID,
+			WrittenAt:   latest.WrittenAt,
+			Responses:   len(versions[key]),
+		})
+	}
+	if pageEnd == "" {
+		return page, nil
+	}
+
+	// Todos os nós continuam depois do fim da página; os que não tinham chaves além dele terminaram
+	next := &ScanCursor{Prefix: prefix, Filter: filter.expr(), After: make(map[string]string), Done: done}
+	if prefix == "" {
+		next.Start, next.End = start, end
+	}
+	for i, node := range targets {
+		if partial := partials[i]; partial != nil && partial.lastKey == "" && partial.maxKey <= pageEnd {
+			next.Done = append(next.Done, node.ID)
+			continue
+		}
+		next.After[node.ID] = pageEnd
+	}
+	if len(next.After) > 0 {
+		page.Next = next
+	}
+	return page, nil
+}
+
+// Avalia o scan sobre as cópias locais do intervalo [start, end) com chave maior que after. As
+// chaves que passam no filtro vêm com o valor; as demais e os tombstones, com o valor vazio.
+// Para depois de limit chaves que passam no filtro. emit, se informado, recebe cada versão na
+// ordem das chaves, para responder a outro nó.
+func (kv *KeyValueStore) scanLocal(start, end, after string, limit int, filter *ScanFilter, emit func(key string, version replicaVersion)) *scanPartial {
+	partial := &scanPartial{versions: make(map[string]replicaVersion)}
+	matched := 0
+	for _, key := range kv.localKeys(start, end, after) {
+		version := kv.localVersion(key)
+		if !version.Found {
+			continue
+		}
+		if version.Value != "" && !filter.Match(version.Value) {
+			version.Value = ""
+		}
+		partial.add(key, version)
+		if emit != nil {
+			emit(key, version)
+		}
+
+		if version.Value != "" {
+			matched++
+			if limit > 0 && matched >= limit {
+				partial.lastKey = key
+				break
+			}
+		}
+	}
+	return partial
+}
+
+// Responde a um scan de outro nó ("SCAN <prefixo> <limite> <filtro> [<depois de> [<início> <fim>]]")
+// com uma mensagem por chave do prefixo e a final: ENTRY <chave> <valor> <vc> <gravação>
+// (passou no filtro), SKIP <chave> <vc> <gravação> (não passou ou é tombstone) e END <última
+// chave, se parou no limite>. Com início e fim, só as chaves do intervalo [início, fim) entram.
+func (g *Gossip) handleScan(conn *peerConn, args []string) {
+	if len(args) != 3 && len(args) != 4 && len(args) != 6 {
+		conn.send("ERROR", "malformed SCAN")
+		return
+	}
+	limit, err := strconv.Atoi(args[1])
+	if err != nil || limit < 0 {
+		conn.send("ERROR", fmt.Sprintf("invalid limit %q", args[1]))
+		return
+	}
+	filter, err := ParseScanFilter(unquoteField(args[2]))
+	if err != nil {
+		conn.send("ERROR", err.Error())
+		return
+	}
+	after := ""
+	if len(args) >= 4 {
+		after = unquoteField(args[3])
+	}
+	start, end := PrefixRange(unquoteField(args[0]))
+	if len(args) == 6 {
+		start, end = intersectRange(start, end, unquoteField(args[4]), unquoteField(args[5]))
+	}
+
+	partial := g.KeyValueStore.scanLocal(start, end, after, limit, filter, func(key string, version replicaVersion) {
+		clock, writtenAt := g.nodeIndex.encodeClock(version.VectorClock), strconv.FormatInt(encodeTime(version.WrittenAt), 10)
+		if version.Value == "" {
+			conn.queue("SKIP", key, clock, writtenAt)
+			return
+		}
+		conn.queue("ENTRY", key, version.Value, clock, writtenAt, checksumField(version.Value))
+	})
+	conn.queue("END", quoteField(partial.lastKey))
+	if err := conn.flush(); err != nil {
+		replicationLog.Warn("Failed to answer SCAN", "op", "SCAN", "err", err)
+	}
+}
+
+// Retorna os nós que podem ter chaves com o prefixo: as réplicas do grupo, se o prefixo fixa os
+// segmentos da regra de roteamento, ou todos os nós
+func (kv *KeyValueStore) prefixNodes(prefix string) []*Node {
+	if routingKey, ok := kv.ConsistentHash.PrefixRoutingKey(prefix); ok {
+		return kv.ConsistentHash.GetReplicaNodes(routingKey, kv.replicationFactor())
+	}
+	nodes := []*Node{kv.Gossip.Self}
+	kv.Gossip.Mutex.Lock()
+	for _, node := range kv.Gossip.Nodes {
+		nodes = append(nodes, node)
+	}
+	kv.Gossip.Mutex.Unlock()
+	return nodes
+}
+
+// Envia um scan a um nó e lê as versões que ele devolve. Um scan de prefixo vai sem o
+// intervalo, que o nó deriva do prefixo.
+func (g *Gossip) FetchScan(node *Node, prefix, start, end, after string, limit int, filter *ScanFilter) (*scanPartial, error) {
+	conn, err := g.dialReplica(node, g.Timeouts.Replication)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	request := []string{"SCAN", quoteField(prefix), strconv.Itoa(limit), quoteField(filter.expr()), quoteField(after)}
+	if prefixStart, prefixEnd := PrefixRange(prefix); start != prefixStart || end != prefixEnd {
+		request = append(request, quoteField(start), quoteField(end))
+	}
+	if err := conn.send(request...); err != nil {
+		return nil, err
+	}
+
+	partial := &scanPartial{versions: make(map[string]replicaVersion)}
+	for {
+		fields, err := conn.receive()
+		if err != nil {
+			return nil, err
+		}
+		version := replicaVersion{NodeID: node.ID, Found: true}
+		var clock, writtenAt string
+		switch {
+		case len(fields) == 2 && fields[0] == "END":
+			partial.lastKey = unquoteField(fields[1])
+			return partial, nil
+		case (len(fields) == 5 || len(fields) == 6) && fields[0] == "ENTRY":
+			fields, checksum := takeChecksum(fields, 5)
+			if err := VerifyChecksum(fields[2], checksum); err != nil {
+				return nil, fmt.Errorf("node %s sent key %s: %w", node.ID, fields[1], err)
+			}
+			version.Value, clock, writtenAt = fields[2], fields[3], fields[4]
+		case len(fields) == 4 && fields[0] == "SKIP":
+			clock, writtenAt = fields[2], fields[3]
+		default:
+			return nil, fmt.Errorf("node %s answered %q", node.ID, formatMessage(fields))
+		}
+
+		decoded, err := g.nodeIndex.decodeClock(clock)
+		if err != nil {
+			return nil, err
+		}
+		if version.WrittenAt, err = decodeTime(writtenAt); err != nil {
+			return nil, err
+		}
+		version.VectorClock = decoded
+		partial.add(fields[1], version)
+	}
+}
@@ -0,0 +1,89 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Os comandos de todo o cluster (scan, export, verificação de conectividade) consultam os nós
+// com scatterGather: em paralelo, com no máximo ScatterWorkers nós ao mesmo tempo e um prazo
+// total por nó. Um nó que falha ou não responde no prazo não derruba o comando, que devolve o
+// resultado dos demais junto com a lista dos nós que faltaram.
+
+// Prazo padrão para cada nó responder a um comando de todo o cluster
+const DefaultScatterTimeout = 10 * time.Second
+
+// errNodeDown indica que o nó estava fora e não foi consultado
+var errNodeDown = errors.New("node is down")
+
+// NodeFailure é um nó que não respondeu a um comando de todo o cluster
+type NodeFailure struct {
+	NodeID string
+	Err    error
+}
+
+func (f NodeFailure) String() string {
+	return fmt.Sprintf("%s (%v)", f.NodeID, f.Err)
+}
+
+// Formata as falhas numa linha ("node2 (node is down), node3 (no answer within 10s)")
+func FormatNodeFailures(failures []NodeFailure) string {
+	parts := make([]string, len(failures))
+	for i, failure := range failures {
+		parts[i] = failure.String()
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Retorna os IDs dos nós que falharam
+func FailedNodeIDs(failures []NodeFailure) []string {
+	ids := make([]string, len(failures))
+	for i, failure := range failures {
+		ids[i] = failure.NodeID
+	}
+	return ids
+}
+
+// Executa fn(i) para cada nó ids[i], com no máximo workers execuções simultâneas e timeout para
+// cada uma (0 = sem prazo). Retorna os resultados na ordem dos nós, com o valor zero nos que
+// falharam, e as falhas, também na ordem dos nós. Uma chamada que passa do prazo é abandonada:
+// o resultado dela é descartado quando chegar, e as conexões dela expiram pelos próprios
+// timeouts.
+func scatterGather[T any](ids []string, workers int, timeout time.Duration, fn func(i int) (T, error)) ([]T, []NodeFailure) {
+	type outcome struct {
+		value T
+		err   error
+	}
+	results := make([]T, len(ids))
+	errs := make([]error, len(ids))
+	runBounded(workers, len(ids), func(i int) {
+		done := make(chan outcome, 1)
+		go func() {
+			value, err := fn(i)
+			done <- outcome{value, err}
+		}()
+
+		var expired <-chan time.Time
+		if timeout > 0 {
+			timer := time.NewTimer(timeout)
+			defer timer.Stop()
+			expired = timer.C
+		}
+		select {
+		case o := <-done:
+			results[i], errs[i] = o.value, o.err
+		case <-expired:
+			errs[i] = fmt.Errorf("no answer within %s", timeout)
+		}
+	})
+
+	var failures []NodeFailure
+	for i, err := range errs {
+		if err != nil {
+			failures = append(failures, NodeFailure{NodeID: ids[i], Err: err})
+		}
+	}
+	return results, failures
+}
@@ -0,0 +1,264 @@
+package store
+
+import (
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Na inicialização, o nó verifica a própria configuração antes de começar a atender: problemas
+// que o fariam falhar em execução (porta ocupada, disco sem escrita, diretório de dados em uso por
+// outro processo, relógio sem sentido) interrompem a inicialização com uma mensagem de como
+// corrigi-los, e configurações arriscadas (quóruns que não se sobrepõem, N maior que o cluster)
+// geram avisos.
+
+// Nome do arquivo de lock dos diretórios de dados
+const lockFileName = "LOCK"
+
+// Diferença a partir da qual um arquivo de dados gravado "no futuro" indica um relógio atrasado
+const clockBackwardsTolerance = time.Minute
+
+// Horário mínimo aceito para o relógio do sistema: antes disso ele certamente não foi acertado
+var clockFloor = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Arquivos de lock mantidos abertos (fechar o arquivo soltaria o lock) até o fim do processo
+var (
+	heldLocks      []*os.File
+	heldLocksMutex sync.Mutex
+)
+
+// Impede que dois processos usem o mesmo diretório de dados: obtém um lock no arquivo LOCK do
+// diretório, mantido até o fim do processo, e falha se outro processo já o tem
+func LockDataDir(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, lockFileName)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	ok, err := lockFile(file)
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to lock %s: %w", path, err)
+	}
+	if !ok {
+		owner, _ := os.ReadFile(path)
+		file.Close()
+		return fmt.Errorf("directory %s is in use by another process (pid %s); each node needs its own --data-dir and --cold-dir", dir, strings.TrimSpace(string(owner)))
+	}
+	file.Truncate(0)
+	file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+
+	heldLocksMutex.Lock()
+	heldLocks = append(heldLocks, file)
+	heldLocksMutex.Unlock()
+	return nil
+}
+
+// SelfCheckConfig traz o que o self-check verifica além do estado do nó
+type SelfCheckConfig struct {
+	Ports   map[string]string // Portas das APIs, pelo nome da opção (ex.: "http-port"); nil no modo CLI-only, sem portas
+	ColdDir string            // Diretório da camada fria (vazio = sem camada fria)
+}
+
+// SelfCheckReport é o resultado do self-check
+type SelfCheckReport struct {
+	Errors   []string // Problemas que fariam o nó falhar; a inicialização deve ser interrompida
+	Warnings []string // Configurações arriscadas que o nó aceita
+}
+
+func (r *SelfCheckReport) fail(format string, args ...any) {
+	r.Errors = append(r.Errors, fmt.Sprintf(format, args...))
+}
+
+func (r *SelfCheckReport) warn(format string, args ...any) {
+	r.Warnings = append(r.Warnings, fmt.Sprintf(format, args...))
+}
+
+// Verifica a configuração do nó: quóruns e tamanho do cluster, TLS exigido pelos tokens, portas,
+// diretórios, disco e relógio
+func (g *Gossip) SelfCheck(config SelfCheckConfig) *SelfCheckReport {
+	report := &SelfCheckReport{}
+	g.checkQuorums(report)
+	g.checkPeerAuth(report)
+	if config.Ports != nil {
+		addresses := map[string]string{"port": g.Self.Address}
+		for name, port := range config.Ports {
+			if port != "" {
+				addresses[name] = ":" + port
+			}
+		}
+		checkPorts(addresses, report)
+	}
+	g.KeyValueStore.checkDirectories(config, report)
+	g.KeyValueStore.checkClock(report)
+	return report
+}
+
+// Com tokens, os pares só aceitam as mensagens de dados de nós com TLS mútuo (ver auth.go)
+func (g *Gossip) checkPeerAuth(report *SelfCheckReport) {
+	if g.AuthEnabled() && g.TLS == nil {
+		report.fail("the cluster has API tokens but this node has no TLS between nodes: peers would refuse its forwarded requests and replicas; start it with --tls-cert, --tls-key and --tls-ca")
+	}
+}
+
+// Verifica N, R e W entre si e contra o tamanho do cluster
+func (g *Gossip) checkQuorums(report *SelfCheckReport) {
+	kv := g.KeyValueStore
+	n := kv.replicationFactor()
+	r, w := kv.ReadQuorum, kv.WriteQuorum
+	cluster := g.clusterConfig()
+	if cluster != nil {
+		if r == 0 {
+			r = cluster.R
+		}
+		if w == 0 {
+			w = cluster.W
+		}
+	}
+	r, w = max(r, 1), max(w, 1)
+
+	if r > n || w > n {
+		report.warn("R=%d and W=%d cannot exceed N=%d; they are capped at N (lower -r/-w or raise -n)", r, w, n)
+		r, w = min(r, n), min(w, n)
+	}
+	if r+w <= n {
+		report.warn("R+W=%d does not exceed N=%d: a read may miss the latest write; use R+W > N (e.g. -r %d -w %d) for read-your-writes", r+w, n, n/2+1, n/2+1)
+	}
+	if cluster == nil {
+		return
+	}
+	if size := len(cluster.Nodes); n > size {
+		report.warn("N=%d but the cluster has %d nodes: keys get at most %d replicas and writes depend on the degradation policy; lower -n or add nodes", n, size, size)
+	}
+	found := false
+	for _, node := range cluster.Nodes {
+		found = found || node.ID == g.Self.ID
+	}
+	if !found {
+		report.warn("node %s is not in the cluster config; start it with its configured --id (or --previous-id to rename it)", g.Self.ID)
+	}
+}
+
+// Verifica se os endereços que o nó vai ouvir (pelo nome da opção) estão livres e têm portas
+// diferentes entre si
+func checkPorts(addresses map[string]string, report *SelfCheckReport) {
+	names := make([]string, 0, len(addresses))
+	for name := range addresses {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	byPort := make(map[string]string)
+	for _, name := range names {
+		address := addresses[name]
+		_, port, err := net.SplitHostPort(address)
+		if err != nil {
+			report.fail("invalid address %q for --%s: %v", address, name, err)
+			continue
+		}
+		if other, taken := byPort[port]; taken {
+			report.fail("--%s and --%s both use port %s; give each one its own port", other, name, port)
+			continue
+		}
+		byPort[port] = name
+		listener, err := net.Listen("tcp", address)
+		if err != nil {
+			report.fail("cannot listen on %s (--%s): %v; stop the process using it or choose another port", address, name, err)
+			continue
+		}
+		listener.Close()
+	}
+}
+
+// Verifica se os diretórios aceitam escrita, se não se sobrepõem e se há espaço livre
+func (kv *KeyValueStore) checkDirectories(config SelfCheckConfig, report *SelfCheckReport) {
+	dirs := []string{kv.DataDir}
+	if config.ColdDir != "" {
+		dirs = append(dirs, config.ColdDir)
+	}
+	for _, dir := range dirs {
+		if err := checkWritable(dir); err != nil {
+			report.fail("directory %s is not writable: %v; check its permissions and free space", dir, err)
+		}
+		usage, err := diskUsage(dir)
+		if err == nil && usage.UsedFraction() >= diskDegradedUsage {
+			report.warn("disk of %s is %.1f%% full; free space before the node runs out of it", dir, usage.UsedFraction()*100)
+		}
+	}
+
+	// Cada camada apaga as SSTables que não estão no próprio MANIFEST: com os diretórios
+	// sobrepostos, uma apagaria as tabelas da outra
+	sstables := filepath.Join(kv.DataDir, lsmDir)
+	if config.ColdDir != "" && (within(config.ColdDir, sstables) || within(sstables, config.ColdDir)) {
+		report.fail("--cold-dir %s overlaps the SSTables directory %s; use a directory outside it", config.ColdDir, sstables)
+	}
+}
+
+// Verifica se o relógio do sistema faz sentido: não pode estar antes de clockFloor nem atrás dos
+// arquivos de dados gravados por execuções anteriores
+func (kv *KeyValueStore) checkClock(report *SelfCheckReport) {
+	now := time.Now()
+	if now.Before(clockFloor) {
+		report.fail("system clock reads %s, which cannot be right; synchronize it (NTP) before starting the node", now.Format(time.RFC3339))
+		return
+	}
+
+	var newest time.Time
+	var newestPath string
+	filepath.WalkDir(kv.DataDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return nil
+		}
+		if info, err := entry.Info(); err == nil && info.ModTime().After(newest) {
+			newest, newestPath = info.ModTime(), path
+		}
+		return nil
+	})
+	if ahead := newest.Sub(now); ahead > clockBackwardsTolerance {
+		report.warn("%s was written at %s, %s ahead of the system clock: the clock went backwards, which breaks last-write-wins resolution and tombstone expiry; synchronize it (NTP)", newestPath, newest.Format(time.RFC3339), ahead.Round(time.Second))
+	}
+}
+
+// Cria, grava, sincroniza e apaga um arquivo no diretório
+func checkWritable(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(dir, ".selfcheck-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	_, err = file.Write([]byte("ok"))
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Indica se path é o diretório dir ou está dentro dele
+func within(path, dir string) bool {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
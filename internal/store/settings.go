@@ -0,0 +1,518 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Arquivo, dentro do bucket de sistema, com a mudança aceita na fase de preparação
+const pendingSettingFile = "pending-setting.json"
+
+// Tempo que um nó preparado aguarda o COMMIT ou ABORT antes de consultar o coordenador
+const settingDecisionTimeout = 10 * time.Second
+
+// Tempo máximo de uma proposta encaminhada ao coordenador, que contata todos os nós duas vezes
+const settingProposeTimeout = 30 * time.Second
+
+// SettingChange é uma mudança de configuração do cluster em duas fases: o coordenador
+// prepara todos os nós e só então manda aplicá-la, e todos passam à mesma versão (Epoch)
+type SettingChange struct {
+	Epoch       int       `json:"epoch"` // Versão da configuração a partir da qual a mudança vale
+	Name        string    `json:"name"`
+	Value       string    `json:"value"`
+	Coordinator string    `json:"coordinator"` // Nó que propôs a mudança e decide o COMMIT
+	ProposedAt  time.Time `json:"proposed_at"`
+}
+
+// Configurações que só podem mudar de forma coordenada: cada função valida o valor e o
+// aplica a uma cópia da configuração do cluster
+var clusterSettings = map[string]func(c *ClusterConfig, value string) error{
+	"n": func(c *ClusterConfig, value string) error {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > len(c.Nodes) {
+			return fmt.Errorf("n must be between 1 and the number of nodes (%d), got %q", len(c.Nodes), value)
+		}
+		if c.R > n || c.W > n {
+			return fmt.Errorf("n=%d is lower than r=%d or w=%d; lower them first", n, c.R, c.W)
+		}
+		c.N = n
+		return nil
+	},
+	"r": func(c *ClusterConfig, value string) error {
+		r, err := strconv.Atoi(value)
+		if err != nil || r < 1 || r > c.N {
+			return fmt.Errorf("r must be between 1 and n (%d), got %q", c.N, value)
+		}
+		c.R = r
+		return nil
+	},
+	"w": func(c *ClusterConfig, value string) error {
+		w, err := strconv.Atoi(value)
+		if err != nil || w < 1 || w > c.N {
+			return fmt.Errorf("w must be between 1 and n (%d), got %q", c.N, value)
+		}
+		c.W = w
+		return nil
+	},
+	"degradation": func(c *ClusterConfig, value string) error {
+		policy, err := ParseDegradationPolicy(value)
+		if err != nil {
+			return err
+		}
+		c.Degradation = policy
+		return nil
+	},
+	"export-rate": func(c *ClusterConfig, value string) error {
+		rate, err := strconv.Atoi(value)
+		if err != nil || rate < 0 {
+			return fmt.Errorf("export-rate must be a number of keys per second (0 = unlimited), got %q", value)
+		}
+		c.Export = c.exportPolicy()
+		c.Export.Rate = rate
+		return nil
+	},
+	"export-window": func(c *ClusterConfig, value string) error {
+		if value == "any" {
+			value = ""
+		}
+		if _, err := ParseTimeWindow(value); err != nil {
+			return err
+		}
+		c.Export = c.exportPolicy()
+		c.Export.Window = value
+		return nil
+	},
+}
+
+// Retorna uma cópia da política de export, para ser alterada sem afetar a configuração original
+func (c *ClusterConfig) exportPolicy() *ExportPolicy {
+	if c.Export == nil {
+		return &ExportPolicy{}
+	}
+	policy := *c.Export
+	return &policy
+}
+
+// Retorna os nomes das configurações que podem ser alteradas, em ordem
+func SettingNames() []string {
+	names := make([]string, 0, len(clusterSettings))
+	for name := range clusterSettings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Retorna uma cópia da configuração com a mudança aplicada, sem alterar a original
+func (c *ClusterConfig) withSetting(name, value string) (*ClusterConfig, error) {
+	apply, ok := clusterSettings[name]
+	if !ok {
+		apply, ok = bucketOperations[name]
+	}
+	if !ok {
+		apply, ok = cacheSettings[name]
+	}
+	if !ok {
+		apply, ok = tokenSettings[name]
+	}
+	if !ok {
+		apply, ok = membershipSettings[name]
+	}
+	if !ok {
+		apply, ok = primarySettings[name]
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown setting %q (use %s)", name, strings.Join(SettingNames(), ", "))
+	}
+	next := *c
+	next.Nodes = append([]NodeConfig(nil), c.Nodes...)
+	if err := apply(&next, value); err != nil {
+		return nil, err
+	}
+	return &next, nil
+}
+
+// Retorna a configuração do cluster em vigor (nil se o cluster não foi inicializado)
+func (g *Gossip) clusterConfig() *ClusterConfig {
+	g.clusterMutex.RLock()
+	defer g.clusterMutex.RUnlock()
+	return g.Cluster
+}
+
+// Retorna a configuração em vigor e a mudança preparada ainda não decidida, se houver
+func (g *Gossip) Settings() (*ClusterConfig, *SettingChange) {
+	g.settingsMutex.Lock()
+	defer g.settingsMutex.Unlock()
+	return g.clusterConfig(), g.pendingSetting
+}
+
+// Propõe a mudança de uma configuração do cluster. A proposta é encaminhada ao coordenador,
+// que a aplica em todos os nós ou em nenhum; retorna a nova versão da configuração.
+func (g *Gossip) ProposeSetting(name, value string) (int, error) {
+	coordinatorID, known := g.CoordinatorID()
+	if !known {
+		return 0, fmt.Errorf("setting change: %w", ErrElectionInProgress)
+	}
+	if coordinatorID == g.Self.ID {
+		return g.coordinateSetting(name, value)
+	}
+
+	node, exists := g.GetNode(coordinatorID)
+	if !exists {
+		return 0, fmt.Errorf("unknown coordinator %s", coordinatorID)
+	}
+	fields, err := g.settingRequest(node, g.Timeouts.Gossip.withReadTimeout(settingProposeTimeout), "PROPOSE", name, value)
+	if err != nil {
+		return 0, err
+	}
+	if len(fields) != 2 || fields[0] != "OK" {
+		return 0, fmt.Errorf("coordinator %s sent a malformed answer %q", node.ID, strings.Join(fields, " "))
+	}
+	return strconv.Atoi(fields[1])
+}
+
+// Conduz as duas fases de uma mudança: prepara todos os nós do cluster e, se todos
+// aceitarem, manda aplicá-la; se algum recusar ou estiver fora, aborta nos já preparados
+func (g *Gossip) coordinateSetting(name, value string) (int, error) {
+	if coordinatorID, known := g.CoordinatorID(); !known || coordinatorID != g.Self.ID {
+		return 0, fmt.Errorf("setting change: %w", ErrElectionInProgress)
+	}
+	config := g.clusterConfig()
+	if config == nil {
+		return 0, errors.New("cluster not initialized (run kvctl cluster init)")
+	}
+	if _, err := config.withSetting(name, value); err != nil {
+		return 0, err
+	}
+
+	change := &SettingChange{
+		Epoch:       config.Epoch + 1,
+		Name:        name,
+		Value:       value,
+		Coordinator: g.Self.ID,
+		ProposedAt:  time.Now(),
+	}
+
+	// Todos os nós precisam aceitar: um nó fora ficaria com a configuração antiga
+	var members []*Node
+	for _, nc := range config.Nodes {
+		if nc.ID == g.Self.ID {
+			continue
+		}
+		node, exists := g.GetNode(nc.ID)
+		if !exists || !g.IsNodeAlive(nc.ID) {
+			return 0, fmt.Errorf("setting change needs every node, but %s is down", nc.ID)
+		}
+		members = append(members, node)
+	}
+
+	if err := g.prepareSetting(change); err != nil {
+		return 0, err
+	}
+	for i, node := range members {
+		_, err := g.settingRequest(node, g.Timeouts.Gossip, "PREPARE", strconv.Itoa(change.Epoch), name, value, g.Self.ID)
+		if err != nil {
+			clusterLog.Warn("Node did not prepare setting", "op", "PREPARE", "peer", node.ID, "setting", name, "value", value, "err", err)
+			for _, prepared := range members[:i] {
+				if _, err := g.settingRequest(prepared, g.Timeouts.Gossip, "ABORT", strconv.Itoa(change.Epoch)); err != nil {
+					clusterLog.Warn("Failed to abort setting change", "op", "ABORT", "peer", prepared.ID, "err", err)
+				}
+			}
+			g.abortSetting(change.Epoch)
+			return 0, fmt.Errorf("node %s rejected the change: %w", node.ID, err)
+		}
+	}
+
+	// Decisão tomada: os nós que não receberem o COMMIT o descobrem consultando este nó
+	for _, node := range members {
+		if _, err := g.settingRequest(node, g.Timeouts.Gossip, "COMMIT", strconv.Itoa(change.Epoch)); err != nil {
+			clusterLog.Warn("Failed to commit setting change, the node will ask for the outcome", "op", "COMMIT", "peer", node.ID, "err", err)
+		}
+	}
+	if err := g.commitSetting(change.Epoch); err != nil {
+		return 0, err
+	}
+	return change.Epoch, nil
+}
+
+// Fase de preparação: valida a mudança contra a configuração local e a grava em disco,
+// recusando-a se outra estiver pendente ou se este nó estiver numa versão diferente
+func (g *Gossip) prepareSetting(change *SettingChange) error {
+	g.settingsMutex.Lock()
+	defer g.settingsMutex.Unlock()
+
+	config := g.clusterConfig()
+	switch {
+	case config == nil:
+		return errors.New("cluster not initialized")
+	case g.pendingSetting != nil && (g.pendingSetting.Epoch != change.Epoch || g.pendingSetting.Name != change.Name || g.pendingSetting.Value != change.Value):
+		return fmt.Errorf("another setting change (epoch %d) is pending", g.pendingSetting.Epoch)
+	case config.Epoch != change.Epoch-1:
+		return fmt.Errorf("config epoch mismatch: at %d, change is for %d", config.Epoch, change.Epoch)
+	}
+	if _, err := config.withSetting(change.Name, change.Value); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(change, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(g.pendingSettingPath(), data, 0644); err != nil {
+		return err
+	}
+	g.pendingSetting = change
+	clusterLog.Info("Prepared setting", "setting", change.Name, "value", change.Value, "epoch", change.Epoch)
+
+	if change.Coordinator != g.Self.ID {
+		time.AfterFunc(settingDecisionTimeout, func() { g.resolvePendingSetting(change.Epoch) })
+	}
+	return nil
+}
+
+// Fase de aplicação: grava a nova configuração e passa a usá-la
+func (g *Gossip) commitSetting(epoch int) error {
+	g.settingsMutex.Lock()
+	defer g.settingsMutex.Unlock()
+
+	change := g.pendingSetting
+	config := g.clusterConfig()
+	if change == nil || change.Epoch != epoch {
+		if config != nil && config.Epoch >= epoch {
+			return nil // COMMIT repetido
+		}
+		return fmt.Errorf("no prepared setting change for epoch %d", epoch)
+	}
+
+	next, err := config.withSetting(change.Name, change.Value)
+	if err != nil {
+		return err
+	}
+	next.Epoch = change.Epoch
+	if err := next.Save(g.KeyValueStore.DataDir); err != nil {
+		return err
+	}
+
+	g.clusterMutex.Lock()
+	g.Cluster = next
+	g.clusterMutex.Unlock()
+	if change.Name == "degradation" {
+		g.KeyValueStore.Degradation = next.Degradation
+	}
+	if change.Name == "bucket-durable" {
+		g.KeyValueStore.persistBucket(change.Value)
+	}
+	if change.Name == "node-add" {
+		g.addConfiguredNode(change.Value)
+	}
+	if change.Name == "node-remove" && change.Value != g.Self.ID {
+		g.RemoveNode(change.Value)
+	}
+	if change.Name == "range-primary" || change.Name == "n" {
+		g.Mutex.Lock()
+		g.ConsistentHash.SetPrimaries(next.Primaries, g.KeyValueStore.replicationFactor())
+		g.Mutex.Unlock()
+	}
+
+	g.pendingSetting = nil
+	os.Remove(g.pendingSettingPath())
+	clusterLog.Info("Setting committed", "setting", change.Name, "value", change.Value, "epoch", next.Epoch)
+
+	// Cada réplica limpa em segundo plano as próprias cópias das chaves do bucket
+	if bucketOperations[change.Name] != nil {
+		if _, err := g.KeyValueStore.Jobs.Start("bucket-cleanup", change.Value); err != nil {
+			clusterLog.Error("Failed to start cleanup of bucket", "bucket", change.Value, "err", err)
+		}
+	}
+	return nil
+}
+
+// Descarta a mudança preparada da versão epoch, se ainda estiver pendente
+func (g *Gossip) abortSetting(epoch int) {
+	g.settingsMutex.Lock()
+	defer g.settingsMutex.Unlock()
+
+	if g.pendingSetting == nil || g.pendingSetting.Epoch != epoch {
+		return
+	}
+	clusterLog.Info("Setting change aborted", "setting", g.pendingSetting.Name, "value", g.pendingSetting.Value, "epoch", epoch)
+	g.pendingSetting = nil
+	os.Remove(g.pendingSettingPath())
+}
+
+// Decide uma mudança preparada que não recebeu COMMIT nem ABORT: segue a decisão do nó que a
+// propôs; se ele estiver inacessível, aplica a mudança se algum nó já a aplicou e a descarta
+// caso contrário (o proponente só manda aplicar depois que todos se prepararam)
+func (g *Gossip) resolvePendingSetting(epoch int) {
+	g.settingsMutex.Lock()
+	change := g.pendingSetting
+	g.settingsMutex.Unlock()
+	if change == nil || change.Epoch != epoch {
+		return
+	}
+
+	if change.Coordinator != g.Self.ID {
+		if node, exists := g.GetNode(change.Coordinator); exists {
+			current, pending, err := g.settingStatus(node)
+			switch {
+			case err == nil && current >= epoch:
+				g.commitSetting(epoch)
+				return
+			case err == nil && pending == epoch:
+				// O proponente ainda não decidiu
+				time.AfterFunc(settingDecisionTimeout, func() { g.resolvePendingSetting(epoch) })
+				return
+			case err == nil:
+				g.abortSetting(epoch)
+				return
+			}
+			clusterLog.Warn("Proposer of setting change is unreachable, asking the other nodes", "peer", change.Coordinator, "epoch", epoch)
+		}
+	}
+
+	config := g.clusterConfig()
+	for _, nc := range config.Nodes {
+		if nc.ID == g.Self.ID || nc.ID == change.Coordinator {
+			continue
+		}
+		node, exists := g.GetNode(nc.ID)
+		if !exists {
+			continue
+		}
+		if current, _, err := g.settingStatus(node); err == nil && current >= epoch {
+			g.commitSetting(epoch)
+			return
+		}
+	}
+	g.abortSetting(epoch)
+}
+
+// Retoma, após um restart, a decisão de uma mudança que estava preparada
+func (g *Gossip) ResumePendingSetting() error {
+	data, err := os.ReadFile(g.pendingSettingPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var change SettingChange
+	if err := json.Unmarshal(data, &change); err != nil {
+		return fmt.Errorf("invalid pending setting change: %w", err)
+	}
+
+	g.settingsMutex.Lock()
+	g.pendingSetting = &change
+	g.settingsMutex.Unlock()
+
+	clusterLog.Info("Setting change is pending, resolving it", "setting", change.Name, "value", change.Value, "epoch", change.Epoch)
+	time.AfterFunc(settingDecisionTimeout, func() { g.resolvePendingSetting(change.Epoch) })
+	return nil
+}
+
+func (g *Gossip) pendingSettingPath() string {
+	return filepath.Join(g.KeyValueStore.DataDir, SystemBucket, pendingSettingFile)
+}
+
+// Consulta a versão da configuração de um nó e a mudança que ele tem preparada (0 se nenhuma)
+func (g *Gossip) settingStatus(node *Node) (int, int, error) {
+	fields, err := g.settingRequest(node, g.Timeouts.Gossip, "STATUS")
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(fields) != 3 || fields[0] != "EPOCH" {
+		return 0, 0, fmt.Errorf("node %s sent a malformed STATUS answer", node.ID)
+	}
+	current, err1 := strconv.Atoi(fields[1])
+	pending, err2 := strconv.Atoi(fields[2])
+	if err1 != nil || err2 != nil {
+		return 0, 0, fmt.Errorf("node %s sent a malformed STATUS answer", node.ID)
+	}
+	return current, pending, nil
+}
+
+// Envia uma mensagem SETTING a um nó e retorna os campos da resposta
+func (g *Gossip) settingRequest(node *Node, timeouts PeerTimeouts, request ...string) ([]string, error) {
+	conn, err := g.dialPeer(node.Address, timeouts)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := conn.send(append([]string{"SETTING"}, request...)...); err != nil {
+		return nil, err
+	}
+
+	fields, err := conn.receive()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case len(fields) == 0:
+		return nil, fmt.Errorf("node %s sent an empty answer", node.ID)
+	case fields[0] == "ERROR":
+		return nil, &RemoteError{NodeID: node.ID, Message: messageText(fields)}
+	}
+	return fields, nil
+}
+
+// Atende as mensagens da mudança coordenada de configuração:
+// PROPOSE <nome> <valor>, PREPARE <epoch> <nome> <valor> <proponente>, COMMIT <epoch>,
+// ABORT <epoch> e STATUS
+func (g *Gossip) handleSetting(conn *peerConn, args []string) {
+	if len(args) == 0 {
+		conn.send("ERROR", "malformed SETTING")
+		return
+	}
+
+	var err error
+	switch {
+	case args[0] == "PROPOSE" && len(args) == 3:
+		var epoch int
+		if epoch, err = g.coordinateSetting(args[1], args[2]); err == nil {
+			conn.send("OK", strconv.Itoa(epoch))
+			return
+		}
+	case args[0] == "PREPARE" && len(args) == 5:
+		var epoch int
+		if epoch, err = strconv.Atoi(args[1]); err == nil {
+			err = g.prepareSetting(&SettingChange{Epoch: epoch, Name: args[2], Value: args[3], Coordinator: args[4], ProposedAt: time.Now()})
+		}
+	case args[0] == "COMMIT" && len(args) == 2:
+		var epoch int
+		if epoch, err = strconv.Atoi(args[1]); err == nil {
+			err = g.commitSetting(epoch)
+		}
+	case args[0] == "ABORT" && len(args) == 2:
+		var epoch int
+		if epoch, err = strconv.Atoi(args[1]); err == nil {
+			g.abortSetting(epoch)
+		}
+	case args[0] == "STATUS" && len(args) == 1:
+		config, pending := g.Settings()
+		current, pendingEpoch := 0, 0
+		if config != nil {
+			current = config.Epoch
+		}
+		if pending != nil {
+			pendingEpoch = pending.Epoch
+		}
+		conn.send("EPOCH", strconv.Itoa(current), strconv.Itoa(pendingEpoch))
+		return
+	default:
+		err = errors.New("malformed SETTING")
+	}
+
+	if err != nil {
+		conn.send("ERROR", err.Error())
+		return
+	}
+	conn.send("OK")
+}
@@ -0,0 +1,225 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrDraining é retornado para requisições recebidas enquanto o nó está sendo desligado
+var ErrDraining = errors.New("node is draining, retry on another node")
+
+// Registra o início de uma requisição de cliente, recusando-a se o nó estiver em drenagem
+func (kv *KeyValueStore) beginRequest() error {
+	kv.drainMutex.Lock()
+	defer kv.drainMutex.Unlock()
+
+	if kv.draining {
+		return ErrDraining
+	}
+	kv.inflight.Add(1)
+	return nil
+}
+
+// Registra o fim de uma requisição de cliente
+func (kv *KeyValueStore) endRequest() {
+	kv.inflight.Done()
+}
+
+// Para de aceitar novas requisições e espera as que estão em andamento terminarem
+func (kv *KeyValueStore) Drain(timeout time.Duration) error {
+	kv.drainMutex.Lock()
+	kv.draining = true
+	kv.drainMutex.Unlock()
+
+	if !waitTimeout(&kv.inflight, timeout) {
+		return fmt.Errorf("in-flight requests did not finish within %s", timeout)
+	}
+	return nil
+}
+
+// Desliga o nó de forma planejada: drena as requisições em andamento, para os loops em segundo
+// plano, entrega os hints possíveis, anuncia a saída aos pares, fecha as conexões recebidas e
+// persiste os dados. As conexões são fechadas antes do armazenamento, para que nenhuma réplica
+// seja aplicada depois do último flush.
+func (g *Gossip) Shutdown(timeout time.Duration) error {
+	g.quiesce(timeout)
+	return g.leave(timeout)
+}
+
+// Primeira parte do desligamento: recusa novas requisições de cliente e para os loops
+func (g *Gossip) quiesce(timeout time.Duration) {
+	clusterLog.Info("Draining node")
+	if err := g.KeyValueStore.Drain(timeout); err != nil {
+		clusterLog.Warn("Drain incomplete", "err", err)
+	}
+	if err := g.KeyValueStore.stopLoops(timeout); err != nil {
+		clusterLog.Warn("Background loops still running", "err", err)
+	}
+}
+
+// Segunda parte do desligamento: entrega os hints, sai do cluster e fecha o armazenamento
+func (g *Gossip) leave(timeout time.Duration) error {
+	// Última tentativa de entregar os hints antes de sair
+	g.KeyValueStore.processHintedHandoff()
+	if pending := g.KeyValueStore.PendingHints(); pending > 0 {
+		clusterLog.Warn("Hinted handoffs could not be delivered before shutdown", "hints", pending)
+	}
+
+	g.announceLeave()
+
+	g.Mutex.Lock()
+	listener := g.listener
+	g.closing = true
+	g.Mutex.Unlock()
+	if listener != nil {
+		listener.Close()
+	}
+	g.pool.close()
+	if !waitTimeout(&g.handlers, timeout) {
+		clusterLog.Warn("Peer connections still open at shutdown", "timeout", timeout)
+	}
+
+	if err := g.KeyValueStore.Close(); err != nil {
+		return err
+	}
+	clusterLog.Info("Node stopped")
+	return nil
+}
+
+// Espera o WaitGroup por até timeout, retornando se ele terminou
+func waitTimeout(group *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		group.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Executa um loop em segundo plano com um contexto cancelado quando ctx é cancelado ou quando o
+// nó é desligado; não executa se o nó já está sendo desligado
+func (kv *KeyValueStore) runLoop(ctx context.Context, loop func(ctx context.Context)) {
+	kv.drainMutex.Lock()
+	if kv.ctx.Err() != nil {
+		kv.drainMutex.Unlock()
+		return
+	}
+	kv.loops.Add(1)
+	kv.drainMutex.Unlock()
+	defer kv.loops.Done()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(kv.ctx, cancel)
+	defer stop()
+	loop(ctx)
+}
+
+// Executa fn a cada interval até ctx ser cancelado ou o nó ser desligado
+func (kv *KeyValueStore) every(ctx context.Context, interval time.Duration, fn func()) {
+	kv.runLoop(ctx, func(ctx context.Context) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				fn()
+			case <-ctx.Done():
+				return
+			}
+		}
+	})
+}
+
+// Cancela os loops em segundo plano e espera a rodada em andamento de cada um terminar
+func (kv *KeyValueStore) stopLoops(timeout time.Duration) error {
+	kv.drainMutex.Lock()
+	kv.cancel()
+	kv.drainMutex.Unlock()
+
+	if !waitTimeout(&kv.loops, timeout) {
+		return fmt.Errorf("background loops did not stop within %s", timeout)
+	}
+	return nil
+}
+
+// Anuncia a saída deste nó a um subconjunto aleatório (fanout) dos pares vivos, que a
+// disseminam aos demais de carona nos PINGs
+func (g *Gossip) announceLeave() {
+	g.Mutex.Lock()
+	var peers []*Node
+	for _, node := range g.Nodes {
+		if node.Alive {
+			peers = append(peers, node)
+		}
+	}
+	incarnation := g.Self.Incarnation
+	g.Mutex.Unlock()
+
+	rand.Shuffle(len(peers), func(i, j int) {
+		peers[i], peers[j] = peers[j], peers[i]
+	})
+	for _, node := range peers[:g.currentFanout(len(peers))] {
+		conn, err := g.dialPeer(node.Address, g.Timeouts.Gossip)
+		if err != nil {
+			continue
+		}
+		gossipLog.Info("Announcing LEAVE", "peer", node.ID)
+		conn.send("LEAVE", "from", g.Self.ID, strconv.FormatUint(incarnation, 10))
+		conn.Close()
+	}
+}
+
+// Recebe o anúncio de saída de um nó (args traz a encarnação dele, se informada)
+func (g *Gossip) handleLeave(nodeID string, args []string) {
+	node, exists := g.GetNode(nodeID)
+	if !exists || node == g.Self {
+		return
+	}
+	update := g.memberUpdate(updateLeft, node)
+	if len(args) == 1 {
+		incarnation, err := strconv.ParseUint(args[0], 10, 64)
+		if err != nil {
+			gossipLog.Warn("Malformed LEAVE: invalid incarnation", "peer", nodeID, "incarnation", args[0])
+			return
+		}
+		update.Incarnation = incarnation
+	}
+	g.applyUpdate(update)
+}
+
+// Marca como fora um nó que saiu do cluster, para que as escritas gerem hints sem esperar timeouts
+func (g *Gossip) markNodeLeft(node *Node) {
+	g.Mutex.Lock()
+	defer g.Mutex.Unlock()
+
+	if node.Alive {
+		g.KeyValueStore.replicaLog.markDown(node.ID, time.Now())
+	}
+	node.Alive, node.Suspect = false, false
+	gossipLog.Info("Node left the cluster", "peer", node.ID)
+	if g.Coordinator == node {
+		go g.initiateElection()
+	}
+}
+
+// Retorna o número de hints aguardando entrega. Todo hint em memória também está em disco,
+// exceto os que não puderam ser gravados.
+func (kv *KeyValueStore) PendingHints() int {
+	kv.Mutex.Lock()
+	inMemory := len(kv.HintedData)
+	kv.Mutex.Unlock()
+
+	return max(inMemory, kv.hints.Len())
+}
@@ -0,0 +1,348 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bquerino/kv-g/internal/vectorclock"
+)
+
+// Escritas concorrentes numa chave (Vector Clocks em conflito) não descartam nenhuma versão com a
+// estratégia padrão (ver ConflictResolver): a réplica guarda a versão recebida como irmã
+// (sibling) da local, e uma leitura devolve todas as irmãs com os seus Vector Clocks, como no
+// Dynamo e no Riak. O cliente resolve o conflito gravando um valor com o Vector Clock que junta
+// os de todas as irmãs (resolve), que supera cada uma delas e as substitui em todas as réplicas.
+
+// Sibling é uma versão de uma chave concorrente a outras versões da mesma chave
+type Sibling struct {
+	Value       string // Vazio para uma remoção (tombstone)
+	VectorClock *vectorclock.VectorClock
+	WrittenAt   time.Time // Quando o coordenador da escrita gravou a versão
+}
+
+// Indica se a irmã é uma remoção (tombstone)
+func (s *Sibling) Deleted() bool {
+	return s.Value == ""
+}
+
+// Escritas coordenadas por nós diferentes ou gravadas com o contexto de uma leitura antiga criam
+// irmãs, e um cliente patológico pode fazer uma chave acumular versões sem limite. MaxSiblings limita as versões
+// concorrentes guardadas por chave: acima dele, com a política resolve, a estratégia de
+// resolução configurada reduz as versões (last-write-wins, se a estratégia guarda as irmãs);
+// com a política reject, a réplica recusa a escrita de cliente até as irmãs serem resolvidas.
+// O limite é verificado por réplica, com a versão local, e é aproximado: versões recebidas por
+// hints, reparos e rebalanceamento já foram aceitas por outra réplica e não são recusadas.
+
+// Limite padrão de versões concorrentes por chave
+const DefaultMaxSiblings = 64
+
+// ErrTooManySiblings é retornado quando uma escrita passaria do limite de irmãs da chave
+var ErrTooManySiblings = errors.New("too many siblings")
+
+// SiblingOverflow define o que acontece com uma escrita que passaria de MaxSiblings
+type SiblingOverflow string
+
+const (
+	SiblingsResolve SiblingOverflow = "resolve" // Reduz as versões com a estratégia de resolução
+	SiblingsReject  SiblingOverflow = "reject"  // Recusa a escrita até as irmãs serem resolvidas
+)
+
+// Converte o nome de uma política de excesso de irmãs, validando o valor
+func ParseSiblingOverflow(name string) (SiblingOverflow, error) {
+	switch policy := SiblingOverflow(name); policy {
+	case SiblingsResolve, SiblingsReject:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown sibling overflow policy %q (use resolve or reject)", name)
+}
+
+// SiblingLimitError é a recusa de uma escrita que passaria do limite de irmãs
+type SiblingLimitError struct {
+	Key      string
+	Versions int // Versões concorrentes que a chave guardaria com a escrita
+	Limit    int
+}
+
+func (e *SiblingLimitError) Error() string {
+	return fmt.Sprintf("%v: key %s would keep %d concurrent versions (limit %d), resolve them first", ErrTooManySiblings, e.Key, e.Versions, e.Limit)
+}
+
+func (e *SiblingLimitError) Unwrap() error {
+	return ErrTooManySiblings
+}
+
+// Formata a recusa como resposta entre nós ("SIBLINGS <versões> <limite>")
+func (e *SiblingLimitError) answer() []string {
+	return []string{"SIBLINGS", strconv.Itoa(e.Versions), strconv.Itoa(e.Limit)}
+}
+
+// Decodifica a resposta "SIBLINGS <versões> <limite>" de uma réplica ou de um coordenador
+func parseSiblingLimit(key string, fields []string) error {
+	limit := &SiblingLimitError{Key: key}
+	if _, err := fmt.Sscan(strings.Join(fields[1:], " "), &limit.Versions, &limit.Limit); err != nil {
+		return fmt.Errorf("malformed answer %q: %w", formatMessage(fields), err)
+	}
+	return limit
+}
+
+// Retorna quantas versões o item guardaria se vc fosse mantida como mais uma irmã
+func (item *DataItem) versionsWith(vc *vectorclock.VectorClock) int {
+	current := 1 + len(item.Siblings)
+	if clocksEqual(item.VectorClock, vc) || item.VectorClock.Compare(vc) > 0 {
+		return current
+	}
+	for _, s := range item.Siblings {
+		if clocksEqual(s.VectorClock, vc) || s.VectorClock.Compare(vc) > 0 {
+			return current
+		}
+	}
+	versions := 1 + len(concurrentSiblings(item.Siblings, vc))
+	if item.VectorClock.Compare(vc) == 0 {
+		versions++
+	}
+	return versions
+}
+
+// Retorna a estratégia para uma nova versão do item: acima de MaxSiblings, com a política
+// resolve, a configurada ou, se ela guarda as irmãs, last-write-wins. Deve ser chamada com o
+// Mutex obtido.
+func (kv *KeyValueStore) resolverFor(key string, item *DataItem, vc *vectorclock.VectorClock) ConflictResolver {
+	resolver := kv.conflictResolver()
+	if kv.MaxSiblings <= 0 || kv.SiblingOverflow == SiblingsReject || item.versionsWith(vc) <= kv.MaxSiblings {
+		return resolver
+	}
+	if _, keeps := resolver.(SiblingsResolver); keeps {
+		resolver = LastWriteWinsResolver{}
+	}
+	replicationLog.Warn("Sibling limit reached, resolving the concurrent versions", "key", logKey(key), "limit", kv.MaxSiblings, "strategy", resolver.Name())
+	return resolver
+}
+
+// Verifica se a réplica local aceita vc com a política reject, que recusa a versão que passaria
+// de MaxSiblings. Deve ser chamada com o Mutex obtido.
+func (kv *KeyValueStore) checkSiblingLimit(key string, vc *vectorclock.VectorClock) error {
+	if kv.MaxSiblings <= 0 || kv.SiblingOverflow != SiblingsReject {
+		return nil
+	}
+	item, exists := kv.loadItem(key)
+	if !exists {
+		return nil
+	}
+	if versions := item.versionsWith(vc); versions > kv.MaxSiblings {
+		return &SiblingLimitError{Key: key, Versions: versions, Limit: kv.MaxSiblings}
+	}
+	return nil
+}
+
+// Verifica, com o Mutex, se a réplica local aceita a versão de uma escrita de cliente
+func (kv *KeyValueStore) acceptsVersion(key string, vc *vectorclock.VectorClock) error {
+	kv.Mutex.Lock()
+	defer kv.Mutex.Unlock()
+	return kv.checkSiblingLimit(key, vc)
+}
+
+// Retorna as irmãs que vc não supera
+func concurrentSiblings(siblings []Sibling, vc *vectorclock.VectorClock) []Sibling {
+	var kept []Sibling
+	for _, sibling := range siblings {
+		if sibling.VectorClock.Compare(vc) == 0 && !clocksEqual(sibling.VectorClock, vc) {
+			kept = append(kept, sibling)
+		}
+	}
+	return kept
+}
+
+// Aplica uma nova versão ao item. As versões que ela supera são descartadas; se sobrarem versões
+// concorrentes a ela, resolver decide quais continuam guardadas. Retorna se o item mudou e se
+// houve conflito.
+func (item *DataItem) addVersion(key, value string, vc *vectorclock.VectorClock, writtenAt time.Time, schemaVersion int, resolver ConflictResolver) (applied, conflict bool) {
+	if clocksEqual(item.VectorClock, vc) || item.VectorClock.Compare(vc) > 0 {
+		return false, false
+	}
+	for _, s := range item.Siblings {
+		if clocksEqual(s.VectorClock, vc) || s.VectorClock.Compare(vc) > 0 {
+			return false, false
+		}
+	}
+
+	received := Sibling{Value: value, VectorClock: vc, WrittenAt: writtenAt}
+	item.Siblings = concurrentSiblings(item.Siblings, vc)
+	var versions []Sibling
+	if item.VectorClock.Compare(vc) < 0 {
+		if len(item.Siblings) == 0 {
+			item.setPrincipal(received, schemaVersion)
+			return true, false
+		}
+		versions = append([]Sibling{received}, item.Siblings...)
+	} else {
+		versions = append([]Sibling{{Value: item.Value, VectorClock: item.VectorClock, WrittenAt: item.WrittenAt}}, item.Siblings...)
+		versions = append(versions, received)
+	}
+
+	before := append([]*vectorclock.VectorClock{item.VectorClock}, siblingClocks(item.Siblings)...)
+	resolved := resolver.Resolve(key, versions)
+	if !clocksEqual(resolved[0].VectorClock, item.VectorClock) {
+		item.setPrincipal(resolved[0], schemaVersion)
+	}
+	item.Siblings = resolved[1:]
+	return !sameClocks(before, append([]*vectorclock.VectorClock{item.VectorClock}, siblingClocks(item.Siblings)...)), true
+}
+
+// Troca a versão principal do item. Versões novas já chegam no formato mais recente do bucket.
+func (item *DataItem) setPrincipal(version Sibling, schemaVersion int) {
+	item.Value, item.VectorClock = version.Value, version.VectorClock
+	item.SchemaVersion, item.WrittenAt = schemaVersion, version.WrittenAt
+}
+
+// Retorna os Vector Clocks das irmãs
+func siblingClocks(siblings []Sibling) []*vectorclock.VectorClock {
+	clocks := make([]*vectorclock.VectorClock, len(siblings))
+	for i, sibling := range siblings {
+		clocks[i] = sibling.VectorClock
+	}
+	return clocks
+}
+
+// Indica se as duas listas têm os mesmos Vector Clocks, em qualquer ordem
+func sameClocks(a, b []*vectorclock.VectorClock) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, clock := range a {
+		found := false
+		for _, other := range b {
+			if clocksEqual(clock, other) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Retorna a versão e as irmãs que a réplica informou junto com ela
+func (v replicaVersion) withSiblings() []replicaVersion {
+	return append([]replicaVersion{v}, v.Siblings...)
+}
+
+// Retorna as versões encontradas numa leitura que nenhuma outra supera, sem repetir Vector
+// Clocks, incluindo as irmãs informadas pelas réplicas. Mais de uma versão indica escritas
+// concorrentes.
+func concurrentVersions(versions []replicaVersion) []replicaVersion {
+	var latest []replicaVersion
+	for _, response := range versions {
+		for _, version := range response.withSiblings() {
+			if !version.Found {
+				continue
+			}
+			superseded := false
+			var kept []replicaVersion
+			for _, current := range latest {
+				switch {
+				case clocksEqual(current.VectorClock, version.VectorClock) || current.VectorClock.Compare(version.VectorClock) > 0:
+					superseded = true
+				case current.VectorClock.Compare(version.VectorClock) == 0:
+					kept = append(kept, current)
+				}
+			}
+			if !superseded {
+				latest = append(kept, version)
+			}
+		}
+	}
+	return latest
+}
+
+// Escolhe, de forma determinística, a versão devolvida como valor de uma leitura entre versões
+// concorrentes: a de maior soma dos contadores e, depois, a de maior valor
+func principalVersion(siblings []replicaVersion) replicaVersion {
+	principal := siblings[0]
+	for _, sibling := range siblings[1:] {
+		weight, principalWeight := clockWeight(sibling.VectorClock.Clock), clockWeight(principal.VectorClock.Clock)
+		if weight > principalWeight || weight == principalWeight && sibling.Value > principal.Value {
+			principal = sibling
+		}
+	}
+	return principal
+}
+
+// Retorna os Vector Clocks das versões
+func versionClocks(versions []replicaVersion) []*vectorclock.VectorClock {
+	clocks := make([]*vectorclock.VectorClock, len(versions))
+	for i, version := range versions {
+		clocks[i] = version.VectorClock
+	}
+	return clocks
+}
+
+// Retorna a junção dos Vector Clocks das versões, que supera todas elas
+func mergedClock(versions []replicaVersion) *vectorclock.VectorClock {
+	merged := vectorclock.NewVectorClock()
+	for _, version := range versions {
+		merged.Merge(version.VectorClock)
+	}
+	return merged
+}
+
+// Retorna, por réplica que respondeu à leitura, as versões mais recentes que faltam a ela
+func missingVersions(latest, versions []replicaVersion) map[string][]replicaVersion {
+	missing := make(map[string][]replicaVersion)
+	for _, response := range versions {
+		for _, version := range latest {
+			has := false
+			for _, held := range response.withSiblings() {
+				if held.Found && clocksEqual(held.VectorClock, version.VectorClock) {
+					has = true
+					break
+				}
+			}
+			if !has {
+				missing[response.NodeID] = append(missing[response.NodeID], version)
+			}
+		}
+	}
+	return missing
+}
+
+// Grava value como sucessora de todas as versões da chave vistas por uma leitura com level,
+// substituindo as irmãs de escritas concorrentes por uma única versão
+func (kv *KeyValueStore) Resolve(key, value string, level ConsistencyLevel) (*PutResult, error) {
+	if err := kv.checkPutSize(key, value); err != nil {
+		return nil, err
+	}
+	current, err := kv.Get(key, level, NodeCaller)
+	if err != nil {
+		return nil, err
+	}
+
+	context := vectorclock.NewVectorClock()
+	if current.VectorClock != nil {
+		context.Merge(current.VectorClock)
+	}
+	clocks := make([]*vectorclock.VectorClock, 0, len(current.Siblings))
+	for _, sibling := range current.Siblings {
+		context.Merge(sibling.VectorClock)
+		clocks = append(clocks, sibling.VectorClock)
+	}
+
+	result, err := kv.write(key, value, context, level)
+	if result != nil {
+		result.Coordinator, result.Resolved = kv.Gossip.Self.ID, len(current.Siblings)
+	}
+	if err == nil && len(current.Siblings) > 0 {
+		replicationLog.Info("Resolved siblings", "op", "resolve", "key", logKey(key), "siblings", len(current.Siblings))
+		kv.emitConflict(ConflictEvent{
+			Kind:     ConflictResolved,
+			Key:      key,
+			Clocks:   eventClocks(clocks...),
+			Strategy: StrategyClient,
+		})
+	}
+	return result, err
+}
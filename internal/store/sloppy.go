@@ -0,0 +1,135 @@
+package store
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Sloppy quorum (Dynamo): quando uma réplica da preference list está fora, a escrita vai para o
+// próximo nó saudável do anel depois das N réplicas (um standby), junto com um hint indicando a
+// réplica a que ela pertence. O standby guarda o hint sem aplicá-lo aos próprios dados e o entrega
+// pelo hinted handoff quando a réplica volta. Os hints aceitos por standbys contam para o W.
+
+// Envia uma escrita a um standby como hint para a réplica hint.TargetID
+// ("HINT <target> <timestamp> <key> <value> <vc> #<checksum>", ou "HINT <target> <timestamp>
+// <key> <vc>" para um tombstone -> "OK")
+func (g *Gossip) SendHint(node *Node, hint *Hint) error {
+	conn, err := g.dialReplica(node, g.Timeouts.Hints)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	request := []string{"HINT", hint.TargetID, strconv.FormatInt(hint.Timestamp.UnixNano(), 10)}
+	request = append(request, formatEntry(hint.Key, hint.Value, g.nodeIndex.encodeClock(hint.VectorClock), time.Time{})...)
+	if err := conn.send(request...); err != nil {
+		return err
+	}
+
+	response, err := conn.receive()
+	if err != nil {
+		return err
+	}
+	if len(response) != 1 || response[0] != "OK" {
+		return fmt.Errorf("standby %s answered %q", node.ID, formatMessage(response))
+	}
+	return nil
+}
+
+// Guarda um hint recebido de um coordenador, para entregá-lo à réplica quando ela voltar
+func (g *Gossip) handleHint(conn *peerConn, args []string) {
+	if len(args) < 2 {
+		conn.send("ERROR", "malformed HINT")
+		return
+	}
+	targetID := args[0]
+	timestamp, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		conn.send("ERROR", "malformed HINT")
+		return
+	}
+	key, value, encoded, _, err := parseEntry(args[2:])
+	if err != nil {
+		rejectEntry(conn, "HINT", err)
+		return
+	}
+	if targetID == g.Self.ID {
+		conn.send("ERROR", fmt.Sprintf("node %s is the replica itself", targetID))
+		return
+	}
+
+	clock, err := g.nodeIndex.decodeClock(encoded)
+	if err != nil {
+		conn.send("ERROR", err.Error())
+		return
+	}
+
+	g.KeyValueStore.acceptHint(&Hint{
+		Key:         key,
+		Value:       value,
+		VectorClock: clock,
+		TargetID:    targetID,
+		Timestamp:   time.Unix(0, timestamp),
+	})
+	conn.send("OK")
+}
+
+// Guarda um hint vindo de outro coordenador, a menos que já exista um mais recente para a
+// mesma chave e réplica (coordenadores diferentes podem usar este nó como standby)
+func (kv *KeyValueStore) acceptHint(hint *Hint) {
+	kv.Mutex.Lock()
+	defer kv.Mutex.Unlock()
+
+	if current, exists := kv.HintedData[hintKey(hint.Key, hint.TargetID)]; exists && current.VectorClock.Compare(hint.VectorClock) > 0 {
+		return
+	}
+	replicationLog.Debug("Holding hinted handoff on behalf of a node", "op", "hint", "key", logKey(hint.Key), "peer", hint.TargetID)
+	kv.storeHint(hint)
+}
+
+// Retorna os standbys saudáveis da chave, na ordem do anel
+func (kv *KeyValueStore) availableStandbys(preference PreferenceList) []*Node {
+	var standbys []*Node
+	for _, node := range preference.Standby {
+		if kv.Gossip.IsNodeAvailable(node.ID) {
+			standbys = append(standbys, node)
+		}
+	}
+	return standbys
+}
+
+// Entrega os hints das réplicas fora aos standbys, um standby por réplica, e retorna os IDs dos
+// standbys que aceitaram. Os hints que não encontram standby ficam com o coordenador.
+func (kv *KeyValueStore) handOffToStandbys(hints []*Hint, standbys []*Node) []string {
+	accepted := make([]bool, len(hints))
+	runBounded(kv.Workers.ReplicaWorkers, min(len(hints), len(standbys)), func(i int) {
+		standby, hint := standbys[i], hints[i]
+		if standby.ID == kv.Gossip.Self.ID {
+			// O próprio coordenador é o standby da vez
+			accepted[i] = true
+			return
+		}
+		if err := kv.Gossip.SendHint(standby, hint); err != nil {
+			replicationLog.Warn("Failed to hand hint off to standby", "op", "hint", "key", logKey(hint.Key), "peer", standby.ID, "err", err)
+			return
+		}
+		accepted[i] = true
+	})
+
+	var ids []string
+	kv.Mutex.Lock()
+	defer kv.Mutex.Unlock()
+	for i, hint := range hints {
+		if accepted[i] {
+			ids = append(ids, standbys[i].ID)
+			if standbys[i].ID != kv.Gossip.Self.ID {
+				replicationLog.Info("Node is down, standby holds the hinted handoff", "op", "hint", "key", logKey(hint.Key), "peer", hint.TargetID, "standby", standbys[i].ID)
+				continue
+			}
+		}
+		replicationLog.Info("Node is down, storing hinted handoff", "op", "hint", "key", logKey(hint.Key), "peer", hint.TargetID)
+		kv.storeHint(hint)
+	}
+	return ids
+}
@@ -0,0 +1,357 @@
+package store
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+)
+
+// As páginas gravadas pelo PageManager são slotted pages, com vários registros por página:
+//
+//	cabeçalho: "SP", versão, número de slots e início da área de células (2 bytes cada)
+//	slots:     posição e tamanho de cada célula (2 bytes cada; tamanho 0 = slot livre)
+//	livre:     espaço entre o fim dos slots e o início das células
+//	células:   gravadas do fim da página para o início: estado, sequência (8 bytes), tamanho da
+//	           chave e do valor (2 bytes cada), chave, valor e o CRC-32C do restante da célula
+//	           (4 bytes)
+//	checksum:  CRC-32C do restante da página (4 bytes), gravado a cada escrita da página
+//
+// O checksum da página é conferido quando ela é lida inteira (para gravar um registro, no
+// verify e ao reconstruir o índice); a leitura de um valor lê somente a célula dele e confere o
+// checksum da célula.
+// Uma remoção marca a célula como removida na própria página (tombstone in-place). O espaço das
+// células removidas é recuperado quando a página recebe um registro que não cabe no espaço livre
+// contíguo: as células vivas são reagrupadas no fim da página. A sequência ordena as versões de
+// uma chave, que podem estar em qualquer página. As páginas da versão 1, sem checksum, e as da
+// versão 2, sem o checksum das células, continuam legíveis e passam à versão atual quando
+// recebem um registro.
+const (
+	slottedMagic      = "SP"
+	slottedVersion    = 3
+	slottedVersionV2  = 2 // Sem checksum nas células
+	slottedVersionV1  = 1 // Sem checksum
+	slottedHeaderSize = 7
+	pageChecksumSize  = 4
+	slotSize          = 4
+	cellHeaderSize    = 13
+	cellChecksumSize  = 4
+)
+
+// Estados de uma célula
+const (
+	cellLive     byte = 0
+	cellDeleted  byte = 1
+	cellManifest byte = 2 // Viva, com o manifesto de um valor gravado em pedaços (ver chunks.go)
+)
+
+// Indica se a célula no estado state está viva
+func liveCell(state byte) bool {
+	return state == cellLive || state == cellManifest
+}
+
+// pageCell é uma célula decodificada de uma slotted page
+type pageCell struct {
+	slot   int
+	offset int // Início da célula na página
+	state  byte
+	seq    uint64
+	key    string
+	value  int // Início do valor na página
+	length int // Tamanho do valor
+}
+
+// Retorna o espaço que um registro com a chave e o valor ocupa numa página vazia
+func recordSize(key, value string) int {
+	return slottedHeaderSize + slotSize + cellHeaderSize + len(key) + len(value) + cellChecksumSize + pageChecksumSize
+}
+
+// Indica se a página está no formato slotted
+func (p *Page) slotted() bool {
+	return len(p.Buffer) >= slottedHeaderSize && string(p.Buffer[:2]) == slottedMagic &&
+		p.Buffer[2] >= slottedVersionV1 && p.Buffer[2] <= slottedVersion
+}
+
+// Indica se a página guarda o checksum no fim
+func (p *Page) checksummed() bool {
+	return p.slotted() && p.Buffer[2] >= slottedVersionV2
+}
+
+// Indica se as células da página guardam o próprio checksum
+func (p *Page) cellsChecksummed() bool {
+	return p.slotted() && p.Buffer[2] == slottedVersion
+}
+
+// Retorna o tamanho da célula de um registro nesta página
+func (p *Page) cellSize(key, value string) int {
+	if p.cellsChecksummed() {
+		return cellHeaderSize + len(key) + len(value) + cellChecksumSize
+	}
+	return cellHeaderSize + len(key) + len(value)
+}
+
+// Fim da área de células: o início do checksum, ou o fim da página na versão 1
+func (p *Page) cellEnd() int {
+	if p.checksummed() {
+		return len(p.Buffer) - pageChecksumSize
+	}
+	return len(p.Buffer)
+}
+
+// Grava no fim da página o checksum do restante dela
+func (p *Page) sealChecksum() {
+	end := p.cellEnd()
+	binary.BigEndian.PutUint32(p.Buffer[end:], crc32.Checksum(p.Buffer[:end], checksumTable))
+}
+
+// Confere o checksum gravado no fim da página
+func (p *Page) verifyChecksum() error {
+	end := p.cellEnd()
+	return verifyValueCRC(string(p.Buffer[:end]), binary.BigEndian.Uint32(p.Buffer[end:]))
+}
+
+// Grava no fim da célula o checksum do restante dela
+func sealCell(buffer []byte) {
+	end := len(buffer) - cellChecksumSize
+	binary.BigEndian.PutUint32(buffer[end:], crc32.Checksum(buffer[:end], checksumTable))
+}
+
+// Confere o checksum gravado no fim da célula
+func verifyCell(buffer []byte) error {
+	if len(buffer) < cellHeaderSize+cellChecksumSize {
+		return ErrChecksumMismatch
+	}
+	end := len(buffer) - cellChecksumSize
+	return verifyValueCRC(string(buffer[:end]), binary.BigEndian.Uint32(buffer[end:]))
+}
+
+// Retorna o espaço que upgrade consome: o checksum da página, na versão 1, e o de cada célula viva
+func (p *Page) upgradeSize() int {
+	if p.cellsChecksummed() {
+		return 0
+	}
+	need := 0
+	if !p.checksummed() {
+		need = pageChecksumSize
+	}
+	for i := range p.slots() {
+		if offset, size := p.slot(i); size > 0 && liveCell(p.Buffer[offset]) {
+			need += cellChecksumSize
+		}
+	}
+	return need
+}
+
+// Passa uma página de uma versão anterior para a atual, acrescentando o checksum às células
+// vivas e reagrupando-as antes do checksum da página; ok é false se ela não tem espaço livre
+// para os checksums
+func (p *Page) upgrade() (ok bool) {
+	if p.cellsChecksummed() {
+		return true
+	}
+	if p.freeSpace() < p.upgradeSize() {
+		return false
+	}
+	live := p.liveCells()
+	for i, cell := range live {
+		if cell != nil {
+			live[i] = append(cell, make([]byte, cellChecksumSize)...)
+			sealCell(live[i])
+		}
+	}
+	p.Buffer[2] = slottedVersion
+	p.placeCells(live)
+	p.Used = len(p.Buffer) - p.freeSpace()
+	return true
+}
+
+// Formata a página como uma slotted page vazia
+func (p *Page) initSlotted() {
+	clear(p.Buffer)
+	copy(p.Buffer, slottedMagic)
+	p.Buffer[2] = slottedVersion
+	p.setSlots(0)
+	p.setCellStart(p.cellEnd())
+	p.Used = slottedHeaderSize + pageChecksumSize
+}
+
+func (p *Page) slots() int {
+	return int(binary.BigEndian.Uint16(p.Buffer[3:]))
+}
+
+func (p *Page) setSlots(n int) {
+	binary.BigEndian.PutUint16(p.Buffer[3:], uint16(n))
+}
+
+// Início da área de células (o fim dela, se a página não tem células)
+func (p *Page) cellStart() int {
+	return int(binary.BigEndian.Uint16(p.Buffer[5:]))
+}
+
+func (p *Page) setCellStart(start int) {
+	binary.BigEndian.PutUint16(p.Buffer[5:], uint16(start))
+}
+
+func (p *Page) slot(i int) (offset, size int) {
+	at := slottedHeaderSize + i*slotSize
+	return int(binary.BigEndian.Uint16(p.Buffer[at:])), int(binary.BigEndian.Uint16(p.Buffer[at+2:]))
+}
+
+func (p *Page) setSlot(i, offset, size int) {
+	at := slottedHeaderSize + i*slotSize
+	binary.BigEndian.PutUint16(p.Buffer[at:], uint16(offset))
+	binary.BigEndian.PutUint16(p.Buffer[at+2:], uint16(size))
+}
+
+// Decodifica a célula do slot i; ok é false para um slot livre ou inválido
+func (p *Page) cell(i int) (cell pageCell, ok bool) {
+	offset, size := p.slot(i)
+	if size < cellHeaderSize || offset+size > p.cellEnd() {
+		return pageCell{}, false
+	}
+	return decodeCell(p.Buffer[offset:offset+size], i, offset)
+}
+
+// Decodifica uma célula a partir do início dela; offset é a posição da célula na página
+func decodeCell(buffer []byte, slot, offset int) (pageCell, bool) {
+	if len(buffer) < cellHeaderSize {
+		return pageCell{}, false
+	}
+	keyLen := int(binary.BigEndian.Uint16(buffer[9:]))
+	valueLen := int(binary.BigEndian.Uint16(buffer[11:]))
+	if cellHeaderSize+keyLen+valueLen > len(buffer) || buffer[0] > cellManifest {
+		return pageCell{}, false
+	}
+	return pageCell{
+		slot:   slot,
+		offset: offset,
+		state:  buffer[0],
+		seq:    binary.BigEndian.Uint64(buffer[1:]),
+		key:    string(buffer[cellHeaderSize : cellHeaderSize+keyLen]),
+		value:  offset + cellHeaderSize + keyLen,
+		length: valueLen,
+	}, true
+}
+
+// Retorna as células da página, vivas e removidas
+func (p *Page) cells() []pageCell {
+	var cells []pageCell
+	for i := range p.slots() {
+		if cell, ok := p.cell(i); ok {
+			cells = append(cells, cell)
+		}
+	}
+	return cells
+}
+
+// Retorna o espaço disponível para um novo registro depois de reagrupar as células vivas:
+// tudo o que não é cabeçalho, célula viva ou slot até o da última célula viva
+func (p *Page) freeSpace() int {
+	directory, cells := slottedHeaderSize, 0
+	for i := range p.slots() {
+		if offset, size := p.slot(i); size > 0 && liveCell(p.Buffer[offset]) {
+			directory = slottedHeaderSize + (i+1)*slotSize
+			cells += size
+		}
+	}
+	return p.cellEnd() - directory - cells
+}
+
+// Grava um registro na página com o estado state, retornando a célula criada; ok é false se o
+// registro não cabe
+func (p *Page) insert(key, value string, seq uint64, state byte) (cell pageCell, ok bool) {
+	size := p.cellSize(key, value)
+	if len(key) > 0xFFFF || len(value) > 0xFFFF || size+slotSize > p.freeSpace() {
+		return pageCell{}, false
+	}
+
+	// Sem espaço contíguo para a célula e um novo slot, recupera o espaço das células removidas
+	if p.cellStart()-size < slottedHeaderSize+(p.slots()+1)*slotSize {
+		p.compact()
+	}
+	slot := p.freeSlot()
+	if slot == p.slots() {
+		p.setSlots(slot + 1)
+	}
+
+	offset := p.cellStart() - size
+	buffer := p.Buffer[offset : offset+size]
+	buffer[0] = state
+	binary.BigEndian.PutUint64(buffer[1:], seq)
+	binary.BigEndian.PutUint16(buffer[9:], uint16(len(key)))
+	binary.BigEndian.PutUint16(buffer[11:], uint16(len(value)))
+	copy(buffer[cellHeaderSize:], key)
+	copy(buffer[cellHeaderSize+len(key):], value)
+	if p.cellsChecksummed() {
+		sealCell(buffer)
+	}
+	p.setSlot(slot, offset, size)
+	p.setCellStart(offset)
+	p.Used = len(p.Buffer) - p.freeSpace()
+
+	cell, _ = p.cell(slot)
+	return cell, true
+}
+
+// Retorna um slot livre, ou o próximo slot do diretório se não houver
+func (p *Page) freeSlot() int {
+	for i := range p.slots() {
+		if _, size := p.slot(i); size == 0 {
+			return i
+		}
+	}
+	return p.slots()
+}
+
+// Marca a célula do slot como removida, sem apagá-la (o espaço é recuperado por compact)
+func (p *Page) markDeleted(slot int) error {
+	if slot < 0 || slot >= p.slots() {
+		return fmt.Errorf("page %d has no slot %d", p.ID, slot)
+	}
+	offset, size := p.slot(slot)
+	if size == 0 {
+		return fmt.Errorf("page %d has no record in slot %d", p.ID, slot)
+	}
+	p.Buffer[offset] = cellDeleted
+	if p.cellsChecksummed() {
+		sealCell(p.Buffer[offset : offset+size])
+	}
+	p.Used = len(p.Buffer) - p.freeSpace()
+	return nil
+}
+
+// Reagrupa as células vivas no fim da página e libera os slots das removidas. Os slots das
+// células vivas não mudam, mas a posição delas sim.
+func (p *Page) compact() {
+	p.placeCells(p.liveCells())
+}
+
+// Retorna uma cópia das células vivas, indexada pelo slot (nil nos slots livres ou removidos)
+func (p *Page) liveCells() [][]byte {
+	live := make([][]byte, p.slots())
+	for i := range p.slots() {
+		if offset, size := p.slot(i); size > 0 && liveCell(p.Buffer[offset]) {
+			live[i] = append([]byte(nil), p.Buffer[offset:offset+size]...)
+		}
+	}
+	return live
+}
+
+// Grava as células no fim da página, cada uma no seu slot, e libera os slots vazios
+func (p *Page) placeCells(live [][]byte) {
+	start := p.cellEnd()
+	last := 0
+	for i, cell := range live {
+		if cell == nil {
+			p.setSlot(i, 0, 0)
+			continue
+		}
+		start -= len(cell)
+		copy(p.Buffer[start:], cell)
+		p.setSlot(i, start, len(cell))
+		last = i + 1
+	}
+	// Os slots livres do fim do diretório são descartados
+	p.setSlots(last)
+	clear(p.Buffer[slottedHeaderSize+last*slotSize : start])
+	p.setCellStart(start)
+}
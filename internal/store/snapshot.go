@@ -0,0 +1,218 @@
+package store
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Um snapshot grava as chaves de buckets escolhidos em arquivos Parquet, um por bucket, para
+// que equipes de dados as analisem no Spark ou no DuckDB sem varrer o cluster a cada consulta.
+// As chaves são lidas do cluster pelo scan paginado, como no export e com a mesma política de
+// taxa e janela, incluindo os tombstones ainda não descartados. Cada arquivo é gravado com
+// outro nome e só aparece completo; o manifesto (_snapshot.json) registra o início do snapshot
+// e os buckets concluídos, e um snapshot interrompido refaz só o bucket em andamento. O snapshot
+// não é um retrato de um único instante: cada chave vem na versão mais recente quando a página
+// dela é lida, então uma chave gravada durante o snapshot aparece na versão nova, com write_time
+// posterior a started_at no manifesto, e a versão anterior dela não fica no arquivo.
+
+// Nome do manifesto gravado no diretório do snapshot
+const snapshotManifestFile = "_snapshot.json"
+
+// snapshotManifest é o estado de um snapshot: o início e os buckets já gravados
+type snapshotManifest struct {
+	StartedAt  time.Time                 `json:"started_at"`
+	FinishedAt *time.Time                `json:"finished_at,omitempty"`
+	Buckets    map[string]snapshotBucket `json:"buckets"`
+}
+
+// snapshotBucket é o arquivo de um bucket concluído
+type snapshotBucket struct {
+	File       string `json:"file"`
+	Rows       int    `json:"rows"`
+	Tombstones int    `json:"tombstones"`
+}
+
+// Colunas dos arquivos do snapshot
+func snapshotColumns() []*parquetColumn {
+	return []*parquetColumn{
+		{name: "bucket", kind: parquetByteArray, converted: parquetUTF8},
+		{name: "key", kind: parquetByteArray, converted: parquetUTF8},
+		{name: "value", kind: parquetByteArray, converted: parquetUTF8, optional: true},             // Nulo nos tombstones
+		{name: "write_time", kind: parquetInt64, converted: parquetTimestampMicros, optional: true}, // Nulo se a réplica não informou
+		{name: "tombstone", kind: parquetBoolean, converted: parquetPlain},
+	}
+}
+
+// Grava em dir um arquivo Parquet por bucket com as chaves do cluster, retornando o total de
+// linhas gravadas
+func (kv *KeyValueStore) Snapshot(job *Job, dir string, buckets []string) (int, error) {
+	for _, bucket := range buckets {
+		if bucket == SystemBucket {
+			return 0, fmt.Errorf("the %s bucket cannot be exported", SystemBucket)
+		}
+		if validateField("bucket", bucket) != nil || strings.Contains(bucket, "/") {
+			return 0, fmt.Errorf("invalid bucket name %q", bucket)
+		}
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return 0, err
+	}
+
+	manifestPath := filepath.Join(dir, snapshotManifestFile)
+	var manifest snapshotManifest
+	data, err := os.ReadFile(manifestPath)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			return 0, fmt.Errorf("invalid snapshot manifest: %w", err)
+		}
+		clusterLog.Info("Resuming snapshot", "op", "snapshot", "path", dir, "started_at", manifest.StartedAt, "completed", len(manifest.Buckets))
+	case errors.Is(err, os.ErrNotExist):
+		manifest.StartedAt = time.Now()
+	default:
+		return 0, err
+	}
+	if manifest.Buckets == nil {
+		manifest.Buckets = make(map[string]snapshotBucket)
+	}
+
+	total := 0
+	for _, written := range manifest.Buckets {
+		total += written.Rows
+	}
+	for _, bucket := range buckets {
+		if _, done := manifest.Buckets[bucket]; done {
+			continue
+		}
+		written, err := kv.snapshotBucket(job, dir, bucket, manifest.StartedAt, &total)
+		if err != nil {
+			return total, fmt.Errorf("bucket %s: %w", bucket, err)
+		}
+		manifest.Buckets[bucket] = written
+		data, _ := json.MarshalIndent(manifest, "", "  ")
+		if err := writeFileAtomic(manifestPath, data, 0644); err != nil {
+			return total, err
+		}
+		clusterLog.Info("Bucket snapshot written", "op", "snapshot", "bucket", bucket, "file", written.File, "rows", written.Rows, "tombstones", written.Tombstones)
+	}
+
+	finished := time.Now()
+	manifest.FinishedAt = &finished
+	data, _ = json.MarshalIndent(manifest, "", "  ")
+	if err := writeFileAtomic(manifestPath, data, 0644); err != nil {
+		return total, err
+	}
+	if err := job.Progress(total, total); err != nil {
+		return total, err
+	}
+	clusterLog.Info("Snapshot completed", "op", "snapshot", "path", dir, "buckets", len(manifest.Buckets), "rows", total)
+	return total, nil
+}
+
+// Grava o arquivo Parquet de um bucket, somando as linhas gravadas a total
+func (kv *KeyValueStore) snapshotBucket(job *Job, dir, bucket string, startedAt time.Time, total *int) (snapshotBucket, error) {
+	written := snapshotBucket{File: bucket + ".parquet"}
+	path := filepath.Join(dir, written.File)
+	tmpPath := path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return written, err
+	}
+	defer file.Close()
+
+	buffered := bufio.NewWriter(file)
+	metadata := [][2]string{{"kv-g.bucket", bucket}, {"kv-g.snapshot_started_at", startedAt.UTC().Format(time.RFC3339Nano)}}
+	parquet, err := newParquetWriter(buffered, snapshotColumns(), metadata)
+	if err != nil {
+		return written, err
+	}
+
+	// As chaves do bucket padrão não têm prefixo próprio: o scan percorre todas e filtra
+	prefix := bucket + "/"
+	if bucket == DefaultBucket {
+		prefix = ""
+	}
+	start, end := PrefixRange(prefix)
+	var cursor *ScanCursor
+	for {
+		if err := job.Progress(*total, 0); err != nil {
+			return written, err
+		}
+		if err := kv.awaitExportWindow(job); err != nil {
+			return written, err
+		}
+
+		policy := kv.Gossip.ExportPolicy()
+		limit := exportPageSize
+		if policy.Rate > 0 {
+			limit = min(limit, policy.Rate)
+		}
+		pageStart := time.Now()
+		page, err := kv.scan(prefix, start, end, limit, nil, cursor, true)
+		if err != nil {
+			return written, err
+		}
+		if len(page.Failed) > 0 {
+			clusterLog.Warn("Snapshot read a page without some nodes", "op", "snapshot", "bucket", bucket, "failed", FormatNodeFailures(page.Failed))
+		}
+
+		for _, result := range page.Results {
+			if BucketOf(result.Key) != bucket {
+				continue
+			}
+			var value, writtenAt any
+			if result.Found {
+				value = result.Value
+			} else {
+				written.Tombstones++
+			}
+			if !result.WrittenAt.IsZero() {
+				writtenAt = result.WrittenAt.UnixMicro()
+			}
+			if err := parquet.writeRow(bucket, result.Key, value, writtenAt, !result.Found); err != nil {
+				return written, err
+			}
+			written.Rows++
+			*total++
+		}
+		if page.Next == nil {
+			break
+		}
+		cursor = page.Next
+
+		// Mesma cota do export: a página seguinte só começa quando esta "coube" na taxa
+		if policy.Rate > 0 {
+			time.Sleep(time.Until(pageStart.Add(time.Duration(len(page.Results)) * time.Second / time.Duration(policy.Rate))))
+		}
+	}
+
+	if err := parquet.Close(); err != nil {
+		return written, err
+	}
+	if err := buffered.Flush(); err != nil {
+		return written, err
+	}
+	if err := file.Sync(); err != nil {
+		return written, err
+	}
+	// No Windows o arquivo precisa estar fechado antes do rename
+	if err := file.Close(); err != nil {
+		return written, err
+	}
+	return written, renameFile(tmpPath, path)
+}
+
+// Runner do job de snapshot: snapshot <diretório> <bucket>...
+func (kv *KeyValueStore) snapshotJob(job *Job, args []string) error {
+	if len(args) < 2 {
+		return errors.New("usage: snapshot <dir> <bucket>...")
+	}
+	_, err := kv.Snapshot(job, args[0], args[1:])
+	return err
+}
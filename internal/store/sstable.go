@@ -0,0 +1,620 @@
+package store
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/bquerino/kv-g/internal/vectorclock"
+)
+
+// Uma SSTable é um arquivo imutável com registros ordenados por chave, gravado de uma vez por um
+// flush ou por uma compactação. O arquivo tem quatro seções:
+//
+//	dados:   registros (tipo, tamanhos da chave, do valor e dos metadados em uvarint, chave,
+//	         valor, metadados), em ordem
+//	índice:  para cada registro, a chave e a posição dele na seção de dados
+//	ranges:  os range tombstones gravados junto com a tabela e o Bloom filter das chaves
+//	rodapé:  posição do índice e dos ranges, número de registros e sstableMagic
+//
+// Os metadados guardam o restante da versão: bucket, horário da escrita, expiração, versão do
+// schema, Vector Clock, irmãs e o checksum (CRC-32C) do valor e de cada irmã, conferido em toda
+// leitura. Assim, depois de um restart, a chave volta com o mesmo histórico
+// causal e uma versão antiga de outra réplica não prevalece sobre ela. As tabelas "SST1" não têm
+// metadados; seus registros são lidos com um Vector Clock vazio. As tabelas "SST1" e "SST2" não
+// têm o Bloom filter, que é montado na abertura a partir do índice, e as anteriores à "SST4" não
+// têm os checksums.
+//
+// O índice é carregado inteiro na abertura; uma leitura busca a chave nele e lê do arquivo só os
+// bytes do registro.
+const (
+	sstableMagic      = "SST4"
+	sstableFooterSize = 8 + 8 + 4 + len(sstableMagic)
+	sstableExt        = ".sst"
+)
+
+// Versões do formato, identificadas pelo sstableMagic do rodapé
+var sstableVersions = map[string]int{"SST1": 1, "SST2": 2, "SST3": 3, sstableMagic: 4}
+
+// Tipos de registro da seção de dados
+const (
+	recordPut       byte = 0
+	recordTombstone byte = 1
+)
+
+// Tamanho do buffer de leitura e escrita sequencial das SSTables
+const sstableBufferSize = 64 * 1024
+
+// ssTable é uma SSTable aberta para leitura
+type ssTable struct {
+	id      uint64 // Identificador, que dá o nome do arquivo (a idade vem da posição no MANIFEST)
+	path    string
+	file    *os.File
+	size    int64
+	keys    []string          // Chaves dos registros, em ordem
+	offsets []int64           // Posição de cada registro; o último termina em dataEnd
+	dataEnd int64             // Fim da seção de dados (início do índice)
+	ranges  []*RangeTombstone // Cobrem as versões das tabelas mais antigas
+	filter  *bloomFilter      // Chaves da tabela
+	version int               // Versão do formato (ver sstableVersions)
+	cold    bool              // O arquivo está no diretório da camada fria
+	used    atomic.Int64      // Última leitura de um registro (UnixNano); começa no horário do arquivo
+}
+
+// ssRecord é a versão de uma chave gravada numa SSTable
+type ssRecord struct {
+	key           string
+	value         string
+	tombstone     bool
+	bucket        string
+	vectorClock   *vectorclock.VectorClock
+	writtenAt     time.Time
+	expiresAt     time.Time // Zero = não expira (o store ainda não tem TTL por chave)
+	schemaVersion int
+	siblings      []Sibling
+}
+
+// Cria o registro da versão em memória de uma chave
+func newSSRecord(key string, item *DataItem) ssRecord {
+	return ssRecord{
+		key:           key,
+		value:         item.Value,
+		tombstone:     item.Deleted(),
+		bucket:        BucketOf(key),
+		vectorClock:   item.VectorClock,
+		writtenAt:     item.WrittenAt,
+		schemaVersion: item.SchemaVersion,
+		siblings:      item.Siblings,
+	}
+}
+
+// Reconstrói a versão em memória gravada no registro
+func (r *ssRecord) dataItem() *DataItem {
+	item := &DataItem{
+		Value:         r.value,
+		VectorClock:   r.vectorClock,
+		SchemaVersion: r.schemaVersion,
+		WrittenAt:     r.writtenAt,
+		Siblings:      r.siblings,
+	}
+	if item.VectorClock == nil {
+		item.VectorClock = vectorclock.NewVectorClock()
+	}
+	return item
+}
+
+// Indica se o registro pode ser descartado por uma compactação que inclui a SSTable mais antiga:
+// um tombstone sem irmãs que passou do prazo dado por expired
+func (r *ssRecord) discardable(expired func(at time.Time) bool) bool {
+	return r.tombstone && len(r.siblings) == 0 && expired(r.writtenAt)
+}
+
+// Retorna o nome do arquivo de uma SSTable
+func sstableName(id uint64) string {
+	return fmt.Sprintf("%010d%s", id, sstableExt)
+}
+
+// sstableWriter grava uma SSTable em sequência. Os registros devem ser adicionados em ordem
+// crescente de chave, sem repetição.
+type sstableWriter struct {
+	file    *os.File
+	buffer  *bufio.Writer
+	path    string
+	offset  int64
+	keys    []string
+	offsets []int64
+	scratch [3 * binary.MaxVarintLen64]byte
+	meta    []byte // Metadados do registro em gravação, reaproveitado entre registros
+}
+
+// Cria o arquivo temporário de uma nova SSTable; finish o renomeia para path
+func newSSTableWriter(path string) (*sstableWriter, error) {
+	file, err := os.OpenFile(path+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &sstableWriter{file: file, buffer: bufio.NewWriterSize(file, sstableBufferSize), path: path}, nil
+}
+
+// Acrescenta um registro à seção de dados
+func (w *sstableWriter) add(record ssRecord) error {
+	if n := len(w.keys); n > 0 && record.key <= w.keys[n-1] {
+		return fmt.Errorf("sstable keys out of order: %q after %q", record.key, w.keys[n-1])
+	}
+	kind := recordPut
+	if record.tombstone {
+		kind = recordTombstone
+	}
+
+	w.meta = encodeRecordMeta(w.meta[:0], &record)
+	header := w.scratch[:0]
+	header = binary.AppendUvarint(header, uint64(len(record.key)))
+	header = binary.AppendUvarint(header, uint64(len(record.value)))
+	header = binary.AppendUvarint(header, uint64(len(w.meta)))
+	w.keys = append(w.keys, record.key)
+	w.offsets = append(w.offsets, w.offset)
+
+	w.buffer.WriteByte(kind)
+	w.buffer.Write(header)
+	w.buffer.WriteString(record.key)
+	w.buffer.WriteString(record.value)
+	if _, err := w.buffer.Write(w.meta); err != nil {
+		return err
+	}
+	w.offset += int64(1 + len(header) + len(record.key) + len(record.value) + len(w.meta))
+	return nil
+}
+
+// Codifica os metadados do registro no fim de b
+func encodeRecordMeta(b []byte, record *ssRecord) []byte {
+	b = binary.AppendUvarint(b, uint64(len(record.bucket)))
+	b = append(b, record.bucket...)
+	b = binary.BigEndian.AppendUint64(b, uint64(encodeTime(record.writtenAt)))
+	b = binary.BigEndian.AppendUint64(b, uint64(encodeTime(record.expiresAt)))
+	b = binary.AppendUvarint(b, uint64(record.schemaVersion))
+	b = appendClock(b, record.vectorClock)
+	b = binary.AppendUvarint(b, uint64(len(record.siblings)))
+	for _, sibling := range record.siblings {
+		b = binary.AppendUvarint(b, uint64(len(sibling.Value)))
+		b = append(b, sibling.Value...)
+		b = binary.BigEndian.AppendUint64(b, uint64(encodeTime(sibling.WrittenAt)))
+		b = appendClock(b, sibling.VectorClock)
+		b = binary.BigEndian.AppendUint32(b, valueCRC(sibling.Value))
+	}
+	return binary.BigEndian.AppendUint32(b, valueCRC(record.value))
+}
+
+// Codifica um Vector Clock como o número de nós seguido, em ordem de ID, do ID, do contador e do
+// horário do contador (0 = desconhecido)
+func appendClock(b []byte, vc *vectorclock.VectorClock) []byte {
+	if vc == nil {
+		return binary.AppendUvarint(b, 0)
+	}
+	ids := make([]string, 0, len(vc.Clock))
+	for id := range vc.Clock {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	b = binary.AppendUvarint(b, uint64(len(ids)))
+	for _, id := range ids {
+		b = binary.AppendUvarint(b, uint64(len(id)))
+		b = append(b, id...)
+		b = binary.AppendUvarint(b, uint64(vc.Clock[id]))
+		b = binary.AppendUvarint(b, uint64(max(vc.Updated[id], 0)))
+	}
+	return b
+}
+
+// Decodifica um horário gravado com encodeTime (0 = desconhecido)
+func unixNanoTime(v uint64) time.Time {
+	if v == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(v))
+}
+
+// Número de registros adicionados
+func (w *sstableWriter) len() int {
+	return len(w.keys)
+}
+
+// Grava o índice, os range tombstones e o rodapé, sincroniza o arquivo e o renomeia para o
+// nome definitivo. Retorna a tabela aberta para leitura.
+func (w *sstableWriter) finish(id uint64, ranges []*RangeTombstone) (*ssTable, error) {
+	dataEnd := w.offset
+	var section []byte
+	for i, key := range w.keys {
+		section = binary.AppendUvarint(section, uint64(len(key)))
+		section = append(section, key...)
+		section = binary.AppendUvarint(section, uint64(w.offsets[i]))
+	}
+	rangesOffset := dataEnd + int64(len(section))
+	section = binary.AppendUvarint(section, uint64(len(ranges)))
+	for _, rt := range ranges {
+		section = binary.AppendUvarint(section, uint64(len(rt.Start)))
+		section = append(section, rt.Start...)
+		section = binary.AppendUvarint(section, uint64(len(rt.End)))
+		section = append(section, rt.End...)
+		section = binary.BigEndian.AppendUint64(section, uint64(rt.At.UnixNano()))
+	}
+	section = newBloomFilter(w.keys).append(section)
+	section = binary.BigEndian.AppendUint64(section, uint64(dataEnd))
+	section = binary.BigEndian.AppendUint64(section, uint64(rangesOffset))
+	section = binary.BigEndian.AppendUint32(section, uint32(len(w.keys)))
+	section = append(section, sstableMagic...)
+
+	if _, err := w.buffer.Write(section); err != nil {
+		return nil, w.abort(err)
+	}
+	if err := w.buffer.Flush(); err != nil {
+		return nil, w.abort(err)
+	}
+	if err := w.file.Sync(); err != nil {
+		return nil, w.abort(err)
+	}
+	// No Windows o arquivo precisa estar fechado antes do rename
+	if err := w.file.Close(); err != nil {
+		os.Remove(w.path + ".tmp")
+		return nil, err
+	}
+	if err := renameFile(w.path+".tmp", w.path); err != nil {
+		os.Remove(w.path + ".tmp")
+		return nil, err
+	}
+	return openSSTable(w.path, id)
+}
+
+// Descarta a tabela em gravação
+func (w *sstableWriter) abort(err error) error {
+	w.file.Close()
+	os.Remove(w.path + ".tmp")
+	return err
+}
+
+// Abre uma SSTable, carregando o índice e os range tombstones
+func openSSTable(path string, id uint64) (*ssTable, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	t, err := loadSSTable(file, path, id)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("sstable %s: %w", path, err)
+	}
+	return t, nil
+}
+
+func loadSSTable(file *os.File, path string, id uint64) (*ssTable, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+	if size < int64(sstableFooterSize) {
+		return nil, errors.New("file too small")
+	}
+
+	footer := make([]byte, sstableFooterSize)
+	if _, err := file.ReadAt(footer, size-int64(sstableFooterSize)); err != nil {
+		return nil, err
+	}
+	version, known := sstableVersions[string(footer[20:])]
+	if !known {
+		return nil, errors.New("invalid footer")
+	}
+	dataEnd := int64(binary.BigEndian.Uint64(footer[0:]))
+	rangesOffset := int64(binary.BigEndian.Uint64(footer[8:]))
+	count := int(binary.BigEndian.Uint32(footer[16:]))
+	metaEnd := size - int64(sstableFooterSize)
+	if dataEnd < 0 || rangesOffset < dataEnd || rangesOffset > metaEnd || int64(count) > rangesOffset-dataEnd {
+		return nil, errors.New("invalid section offsets")
+	}
+
+	meta := make([]byte, metaEnd-dataEnd)
+	if _, err := file.ReadAt(meta, dataEnd); err != nil {
+		return nil, err
+	}
+	r := &byteReader{buf: meta}
+
+	t := &ssTable{id: id, path: path, file: file, size: size, dataEnd: dataEnd, version: version, keys: make([]string, 0, count), offsets: make([]int64, 0, count)}
+	t.used.Store(info.ModTime().UnixNano())
+	for i := 0; i < count; i++ {
+		key := r.string()
+		offset := int64(r.uvarint())
+		if r.err != nil || offset < 0 || offset >= dataEnd || len(t.offsets) > 0 && offset <= t.offsets[len(t.offsets)-1] {
+			return nil, errors.New("invalid index entry")
+		}
+		t.keys = append(t.keys, key)
+		t.offsets = append(t.offsets, offset)
+	}
+	if int64(r.pos) != rangesOffset-dataEnd {
+		return nil, errors.New("index does not end at the range section")
+	}
+
+	ranges := int(r.uvarint())
+	for i := 0; i < ranges && r.err == nil; i++ {
+		rt := &RangeTombstone{Start: r.string(), End: r.string()}
+		rt.At = time.Unix(0, int64(r.uint64()))
+		t.ranges = append(t.ranges, rt)
+	}
+	if r.err != nil {
+		return nil, errors.New("invalid range section")
+	}
+	if version >= 3 {
+		if t.filter, err = r.bloomFilter(); err != nil {
+			return nil, err
+		}
+	} else {
+		t.filter = newBloomFilter(t.keys)
+	}
+	if r.pos != len(meta) {
+		return nil, errors.New("unexpected data after the range section")
+	}
+	return t, nil
+}
+
+// Busca a chave na tabela. found é false se a tabela não tem registro da chave.
+func (t *ssTable) get(key string) (record ssRecord, found bool, err error) {
+	i := sort.SearchStrings(t.keys, key)
+	if i == len(t.keys) || t.keys[i] != key {
+		return ssRecord{}, false, nil
+	}
+	record, err = t.readRecord(i)
+	return record, err == nil, err
+}
+
+// Lê do arquivo os bytes do i-ésimo registro
+func (t *ssTable) readRecord(i int) (ssRecord, error) {
+	end := t.dataEnd
+	if i+1 < len(t.offsets) {
+		end = t.offsets[i+1]
+	}
+	buffer := make([]byte, end-t.offsets[i])
+	if _, err := t.file.ReadAt(buffer, t.offsets[i]); err != nil {
+		return ssRecord{}, err
+	}
+	record, err := decodeSSRecord(&byteReader{buf: buffer}, t.version)
+	if err == nil && record.key != t.keys[i] {
+		err = fmt.Errorf("record %d holds key %q, index says %q", i, record.key, t.keys[i])
+	}
+	if err != nil {
+		return ssRecord{}, fmt.Errorf("sstable %s: %w", t.path, err)
+	}
+	return record, nil
+}
+
+// recordReader é a origem dos registros: o buffer de um registro ou a leitura sequencial da tabela
+type recordReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// Decodifica um registro da seção de dados de uma tabela na versão informada
+func decodeSSRecord(r recordReader, version int) (ssRecord, error) {
+	meta := version >= 2
+	kind, err := r.ReadByte()
+	if err != nil {
+		return ssRecord{}, err
+	}
+	if kind != recordPut && kind != recordTombstone {
+		return ssRecord{}, fmt.Errorf("invalid record type %d", kind)
+	}
+	keyLen, err := binary.ReadUvarint(r)
+	if err != nil {
+		return ssRecord{}, err
+	}
+	valueLen, err := binary.ReadUvarint(r)
+	if err != nil {
+		return ssRecord{}, err
+	}
+	var metaLen uint64
+	if meta {
+		if metaLen, err = binary.ReadUvarint(r); err != nil {
+			return ssRecord{}, err
+		}
+	}
+	if keyLen > 0xFFFF || valueLen > 1<<31 || metaLen > 1<<31 {
+		return ssRecord{}, errors.New("invalid record lengths")
+	}
+	data := make([]byte, keyLen+valueLen+metaLen)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return ssRecord{}, err
+	}
+	record := ssRecord{key: string(data[:keyLen]), value: string(data[keyLen : keyLen+valueLen]), tombstone: kind == recordTombstone}
+	if !meta {
+		record.bucket = BucketOf(record.key)
+		return record, nil
+	}
+	if err := decodeRecordMeta(&byteReader{buf: data[keyLen+valueLen:]}, &record, version >= 4); err != nil {
+		return ssRecord{}, fmt.Errorf("key %s: %w", record.key, err)
+	}
+	return record, nil
+}
+
+// Decodifica os metadados gravados por encodeRecordMeta, conferindo os valores com os checksums
+// se a tabela os tiver
+func decodeRecordMeta(r *byteReader, record *ssRecord, checksums bool) error {
+	record.bucket = r.string()
+	record.writtenAt = unixNanoTime(r.uint64())
+	record.expiresAt = unixNanoTime(r.uint64())
+	record.schemaVersion = int(r.uvarint())
+	record.vectorClock = r.clock()
+	siblings := r.uvarint()
+	if siblings > uint64(len(r.buf)) {
+		return errors.New("invalid sibling count")
+	}
+	for range siblings {
+		sibling := Sibling{Value: r.string(), WrittenAt: unixNanoTime(r.uint64())}
+		sibling.VectorClock = r.clock()
+		if checksums {
+			if err := verifyValueCRC(sibling.Value, r.uint32()); err != nil && r.err == nil {
+				return fmt.Errorf("sibling: %w", err)
+			}
+		}
+		record.siblings = append(record.siblings, sibling)
+	}
+	if checksums {
+		if err := verifyValueCRC(record.value, r.uint32()); err != nil && r.err == nil {
+			return err
+		}
+	}
+	if r.err != nil || r.pos != len(r.buf) {
+		return errors.New("invalid record metadata")
+	}
+	return nil
+}
+
+// Percorre os registros da tabela em ordem, lendo a seção de dados em sequência
+func (t *ssTable) iterator() *sstableIterator {
+	section := io.NewSectionReader(t.file, 0, t.dataEnd)
+	return &sstableIterator{table: t, reader: bufio.NewReaderSize(section, sstableBufferSize)}
+}
+
+// sstableIterator percorre os registros de uma SSTable
+type sstableIterator struct {
+	table   *ssTable
+	reader  *bufio.Reader
+	next    int
+	current ssRecord
+	valid   bool // current tem um registro
+	err     error
+}
+
+// Avança para o próximo registro; retorna false no fim da tabela ou num erro (ver err)
+func (it *sstableIterator) advance() bool {
+	it.valid = false
+	if it.err != nil || it.next >= len(it.table.keys) {
+		return false
+	}
+	record, err := decodeSSRecord(it.reader, it.table.version)
+	if err == nil && record.key != it.table.keys[it.next] {
+		err = fmt.Errorf("record %d holds key %q, index says %q", it.next, record.key, it.table.keys[it.next])
+	}
+	if err != nil {
+		it.err = fmt.Errorf("sstable %s: %w", it.table.path, err)
+		return false
+	}
+	it.current, it.valid = record, true
+	it.next++
+	return true
+}
+
+// Indica se algum range tombstone da tabela remove a versão da chave gravada em writtenAt
+func (t *ssTable) covers(key string, writtenAt time.Time) bool {
+	at := t.coveredAt(key)
+	return !at.IsZero() && !writtenAt.After(at)
+}
+
+// Retorna o momento do range tombstone mais novo da tabela que cobre a chave (zero se nenhum)
+func (t *ssTable) coveredAt(key string) time.Time {
+	var at time.Time
+	for _, rt := range t.ranges {
+		if rt.Contains(key) && rt.At.After(at) {
+			at = rt.At
+		}
+	}
+	return at
+}
+
+// byteReader lê os campos do índice e da seção de ranges, guardando o primeiro erro
+type byteReader struct {
+	buf []byte
+	pos int
+	err error
+}
+
+func (r *byteReader) Read(p []byte) (int, error) {
+	if r.pos >= len(r.buf) {
+		return 0, io.EOF
+	}
+	n := copy(p, r.buf[r.pos:])
+	r.pos += n
+	return n, nil
+}
+
+func (r *byteReader) ReadByte() (byte, error) {
+	if r.pos >= len(r.buf) {
+		return 0, io.EOF
+	}
+	r.pos++
+	return r.buf[r.pos-1], nil
+}
+
+func (r *byteReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.buf[r.pos:])
+	if n <= 0 {
+		r.err = errors.New("invalid uvarint")
+		return 0
+	}
+	r.pos += n
+	return v
+}
+
+func (r *byteReader) string() string {
+	n := r.uvarint()
+	if r.err != nil {
+		return ""
+	}
+	if n > uint64(len(r.buf)-r.pos) {
+		r.err = errors.New("truncated string")
+		return ""
+	}
+	s := string(r.buf[r.pos : r.pos+int(n)])
+	r.pos += int(n)
+	return s
+}
+
+// Lê um Vector Clock gravado por appendClock
+func (r *byteReader) clock() *vectorclock.VectorClock {
+	vc := vectorclock.NewVectorClock()
+	n := r.uvarint()
+	if n > uint64(len(r.buf)) {
+		r.err = errors.New("invalid vector clock size")
+		return vc
+	}
+	for range n {
+		id := r.string()
+		vc.Clock[id] = int(r.uvarint())
+		if updated := int64(r.uvarint()); updated > 0 {
+			vc.Updated[id] = updated
+		}
+	}
+	return vc
+}
+
+func (r *byteReader) uint64() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	if len(r.buf)-r.pos < 8 {
+		r.err = errors.New("truncated integer")
+		return 0
+	}
+	v := binary.BigEndian.Uint64(r.buf[r.pos:])
+	r.pos += 8
+	return v
+}
+
+func (r *byteReader) uint32() uint32 {
+	if r.err != nil {
+		return 0
+	}
+	if len(r.buf)-r.pos < 4 {
+		r.err = errors.New("truncated integer")
+		return 0
+	}
+	v := binary.BigEndian.Uint32(r.buf[r.pos:])
+	r.pos += 4
+	return v
+}
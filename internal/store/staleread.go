@@ -0,0 +1,100 @@
+package store
+
+import "github.com/bquerino/kv-g/internal/vectorclock"
+
+// Quando réplicas da chave estão fora e a leitura não alcança o R (ou não encontra a chave nas
+// réplicas que responderam), o coordenador pode servir uma versão guardada para elas: um hint
+// ainda não entregue, no próprio coordenador ou nos standbys da chave (sloppy quorum), ou uma
+// cópia que ficou num nó depois de uma mudança do anel. A resposta é marcada como Stale, porque
+// pode estar desatualizada. Só as leituras com o nível padrão ou one fazem isso: quorum e all
+// continuam exigindo as respostas das réplicas.
+
+// Indica se a leitura pode ser servida de versões guardadas para réplicas fora
+func (kv *KeyValueStore) staleReadAllowed(level ConsistencyLevel, outcomes []ReplicaOutcome) bool {
+	if !kv.StaleReads || level != ConsistencyDefault && level != ConsistencyOne {
+		return false
+	}
+	for _, outcome := range outcomes {
+		if outcome.Status == ReplicaSkipped || outcome.Err != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Retorna a versão da chave que este nó guarda fora do papel de réplica: os hints pendentes e,
+// se o nó não é réplica da chave, a cópia local. Versões concorrentes vão como irmãs.
+func (kv *KeyValueStore) heldVersion(key string) replicaVersion {
+	var versions []replicaVersion
+	hints, err := kv.hints.lookup(key)
+	if err != nil {
+		replicationLog.Error("Failed to read hints of key", "op", "get", "key", logKey(key), "err", err)
+	}
+	for _, hint := range hints {
+		clock := vectorclock.NewVectorClock()
+		clock.Merge(hint.VectorClock)
+		versions = append(versions, replicaVersion{NodeID: kv.Gossip.Self.ID, Value: hint.Value, VectorClock: clock, WrittenAt: hint.Timestamp, Found: true})
+	}
+	if !kv.isReplica(key) {
+		versions = append(versions, kv.localVersion(key))
+	}
+
+	siblings := concurrentVersions(versions)
+	if len(siblings) == 0 {
+		return replicaVersion{NodeID: kv.Gossip.Self.ID}
+	}
+	version := siblings[0]
+	version.Siblings = siblings[1:]
+	return version
+}
+
+// Tenta servir a leitura com as versões recebidas das réplicas somadas às guardadas por este nó
+// e pelos standbys da chave, preenchendo result. Retorna false se ninguém guarda uma versão.
+func (kv *KeyValueStore) serveStale(key string, preference PreferenceList, versions []replicaVersion, result *GetResult) bool {
+	var held []replicaVersion
+	if version := kv.heldVersion(key); version.Found {
+		held = append(held, version)
+	}
+
+	var standbys []*Node
+	for _, node := range kv.availableStandbys(preference) {
+		if node.ID != kv.Gossip.Self.ID {
+			standbys = append(standbys, node)
+		}
+	}
+	answers := make([]replicaVersion, len(standbys))
+	runBounded(kv.Workers.ReplicaWorkers, len(standbys), func(i int) {
+		version, err := kv.Gossip.fetchHeld(standbys[i], key)
+		if err != nil {
+			replicationLog.Warn("Failed to fetch versions held by standby", "op", "get", "key", logKey(key), "peer", standbys[i].ID, "err", err)
+			return
+		}
+		answers[i] = version
+	})
+	for _, version := range answers {
+		if version.Found {
+			held = append(held, version)
+		}
+	}
+	if len(held) == 0 {
+		return false
+	}
+
+	siblings := concurrentVersions(append(versions, held...))
+	latest := principalVersion(siblings)
+	if len(siblings) > 1 {
+		for _, sibling := range siblings {
+			result.Siblings = append(result.Siblings, Sibling{Value: sibling.Value, VectorClock: sibling.VectorClock, WrittenAt: sibling.WrittenAt})
+		}
+		latest.VectorClock = mergedClock(siblings)
+	}
+	result.Stale = true
+	result.ServedBy, result.WrittenAt = latest.NodeID, latest.WrittenAt
+	// Um tombstone guardado para a réplica também vale: a chave foi removida
+	if latest.Value != "" {
+		result.Found = true
+		result.Value, result.VectorClock, result.Checksum = latest.Value, latest.VectorClock, ValueChecksum(latest.Value)
+	}
+	replicationLog.Warn("Read served a possibly stale version", "op", "get", "key", logKey(key), "peer", latest.NodeID, "responses", result.Responses, "required", result.Required)
+	return true
+}
@@ -0,0 +1,448 @@
+package store
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Disseminação de membros no estilo do SWIM: entradas, falhas e saídas viram atualizações que
+// seguem de carona nos PINGs e ACKs e se espalham de forma epidêmica, sem PINGs entre todos os
+// pares. Um nó que não responde ao PING direto é sondado por outros pares (PINGREQ) e, se
+// nenhum deles o alcança, fica suspeito; a suspeita vira falha depois de SuspicionTimeout, a
+// menos que o nó a refute anunciando uma encarnação maior.
+const (
+	maxPiggyback         = 8 // Atualizações enviadas de carona por mensagem
+	retransmitMultiplier = 3 // Cada atualização é enviada retransmitMultiplier * log2(N) vezes
+	indirectProbes       = 3 // Pares que sondam um nó que não respondeu ao PING direto
+)
+
+// Tipos de atualização de membro, em ordem de precedência para a mesma encarnação
+const (
+	updateAlive   = "alive"
+	updateSuspect = "suspect"
+	updateDead    = "dead"
+	updateLeft    = "left"
+)
+
+// memberUpdate é uma mudança no estado de um membro. A encarnação é incrementada só pelo próprio
+// nó, para refutar uma suspeita; por isso ela desempata atualizações sobre o mesmo nó.
+type memberUpdate struct {
+	Kind        string
+	ID          string
+	Incarnation uint64
+	Address     string
+	Tokens      []uint32 // Tokens do anel, para que um nó desconhecido seja adicionado
+}
+
+// Formata a atualização como uma mensagem: <tipo> <id> <encarnação> <endereço> <tokens>
+func formatUpdate(u memberUpdate) []string {
+	return []string{u.Kind, u.ID, strconv.FormatUint(u.Incarnation, 10), u.Address, encodeTokens(u.Tokens)}
+}
+
+func parseUpdate(fields []string) (memberUpdate, error) {
+	if len(fields) != 5 {
+		return memberUpdate{}, fmt.Errorf("malformed member update %q", formatMessage(fields))
+	}
+	switch fields[0] {
+	case updateAlive, updateSuspect, updateDead, updateLeft:
+	default:
+		return memberUpdate{}, fmt.Errorf("unknown member update %q", fields[0])
+	}
+	incarnation, err := strconv.ParseUint(fields[2], 10, 64)
+	if err != nil {
+		return memberUpdate{}, fmt.Errorf("invalid incarnation %q", fields[2])
+	}
+	tokens, err := decodeTokens(fields[4])
+	if err != nil {
+		return memberUpdate{}, err
+	}
+	return memberUpdate{Kind: fields[0], ID: fields[1], Incarnation: incarnation, Address: fields[3], Tokens: tokens}, nil
+}
+
+// Enfileira as atualizações, uma por mensagem, depois de um PING ou ACK que informa a quantidade
+func queueUpdates(conn *peerConn, updates []memberUpdate) {
+	for _, u := range updates {
+		conn.queue(formatUpdate(u)...)
+	}
+}
+
+// Lê as count atualizações enviadas de carona
+func readUpdates(conn *peerConn, count int) ([]memberUpdate, error) {
+	if count < 0 || count > maxPiggyback {
+		return nil, fmt.Errorf("invalid member update count %d", count)
+	}
+	updates := make([]memberUpdate, 0, count)
+	for i := 0; i < count; i++ {
+		fields, err := conn.receive()
+		if err != nil {
+			return nil, err
+		}
+		u, err := parseUpdate(fields)
+		if err != nil {
+			return nil, err
+		}
+		updates = append(updates, u)
+	}
+	return updates, nil
+}
+
+// broadcastQueue guarda as atualizações a disseminar e quantas vezes cada uma já foi enviada
+type broadcastQueue struct {
+	mutex sync.Mutex
+	items []*queuedUpdate
+}
+
+type queuedUpdate struct {
+	update    memberUpdate
+	transmits int
+}
+
+// Enfileira uma atualização, substituindo a anterior sobre o mesmo nó
+func (q *broadcastQueue) enqueue(u memberUpdate) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for _, item := range q.items {
+		if item.update.ID == u.ID {
+			item.update, item.transmits = u, 0
+			return
+		}
+	}
+	q.items = append(q.items, &queuedUpdate{update: u})
+}
+
+// Retorna até count atualizações, priorizando as menos enviadas, e descarta as que atingiram limit envios
+func (q *broadcastQueue) take(count, limit int) []memberUpdate {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	sort.SliceStable(q.items, func(i, j int) bool { return q.items[i].transmits < q.items[j].transmits })
+	var updates []memberUpdate
+	for _, item := range q.items[:min(count, len(q.items))] {
+		updates = append(updates, item.update)
+		item.transmits++
+	}
+	kept := q.items[:0]
+	for _, item := range q.items {
+		if item.transmits < limit {
+			kept = append(kept, item)
+		}
+	}
+	q.items = kept
+	return updates
+}
+
+// Retorna as atualizações que seguem de carona na próxima mensagem
+func (g *Gossip) piggyback() []memberUpdate {
+	g.Mutex.Lock()
+	size := len(g.Nodes) + 1
+	g.Mutex.Unlock()
+
+	limit := retransmitMultiplier * int(math.Ceil(math.Log2(float64(size+1))))
+	return g.broadcasts.take(maxPiggyback, limit)
+}
+
+// Monta uma atualização com o estado que este nó conhece do membro
+func (g *Gossip) memberUpdate(kind string, node *Node) memberUpdate {
+	g.Mutex.Lock()
+	defer g.Mutex.Unlock()
+
+	return memberUpdate{
+		Kind:        kind,
+		ID:          node.ID,
+		Incarnation: node.Incarnation,
+		Address:     node.Address,
+		Tokens:      g.ConsistentHash.Tokens(node.ID),
+	}
+}
+
+// Aplica as atualizações recebidas de carona
+func (g *Gossip) applyUpdates(updates []memberUpdate) {
+	for _, u := range updates {
+		g.applyUpdate(u)
+	}
+}
+
+// Aplica uma atualização se ela for mais nova que o estado conhecido do membro e a repassa
+// adiante. Uma atualização de falha sobre este nó é refutada com uma encarnação maior.
+func (g *Gossip) applyUpdate(u memberUpdate) {
+	g.Mutex.Lock()
+	if u.ID == g.Self.ID {
+		refute := u.Kind != updateAlive && u.Incarnation >= g.Self.Incarnation
+		if refute {
+			g.Self.Incarnation = u.Incarnation + 1
+		}
+		g.Mutex.Unlock()
+		if refute {
+			gossipLog.Info("Refuting update about this node", "update", u.Kind, "incarnation", u.Incarnation+1)
+			g.broadcasts.enqueue(g.memberUpdate(updateAlive, g.Self))
+		}
+		return
+	}
+	node, known := g.Nodes[u.ID]
+	g.Mutex.Unlock()
+
+	// Nós desconhecidos só são adicionados por atualizações de nós vivos
+	if !known {
+		if u.Kind != updateAlive && u.Kind != updateSuspect {
+			return
+		}
+		gossipLog.Info("Learned about node via gossip", "peer", u.ID)
+		g.addJoinedNode(u.ID, u.Address, u.Tokens)
+		if node, known = g.GetNode(u.ID); known {
+			g.Mutex.Lock()
+			node.Incarnation = u.Incarnation
+			g.Mutex.Unlock()
+		}
+		g.broadcasts.enqueue(u)
+		return
+	}
+
+	g.Mutex.Lock()
+	accept := false
+	switch u.Kind {
+	case updateAlive:
+		accept = u.Incarnation > node.Incarnation
+	case updateSuspect:
+		accept = node.Alive && (u.Incarnation > node.Incarnation || u.Incarnation == node.Incarnation && !node.Suspect)
+	case updateDead, updateLeft:
+		accept = node.Alive && u.Incarnation >= node.Incarnation
+	}
+	if accept {
+		node.Incarnation = u.Incarnation
+		if u.Kind == updateSuspect {
+			node.Suspect, node.suspectSince = true, time.Now()
+		}
+	}
+	g.Mutex.Unlock()
+	if !accept {
+		return
+	}
+
+	g.broadcasts.enqueue(u)
+	switch u.Kind {
+	case updateAlive:
+		// Uma encarnação maior com outro endereço anuncia a troca de endereço do nó
+		if u.Address != g.nodeAddress(node) {
+			g.updateAddress(node, u.Address)
+		}
+		g.markNodeAlive(node)
+	case updateSuspect:
+		gossipLog.Info("Node is suspected to be down", "peer", node.ID, "incarnation", u.Incarnation)
+	case updateDead:
+		gossipLog.Warn("Learned via gossip that node is down", "peer", node.ID)
+		g.markNodeDead(node)
+	case updateLeft:
+		g.markNodeLeft(node)
+	}
+}
+
+// Marca um nó como vivo após uma resposta dele, encerrando a suspeita, e registra o sinal de
+// vida no detector de phi; um nó que estava fora recebe as escritas que perdeu
+func (g *Gossip) markNodeAlive(node *Node) {
+	g.Mutex.Lock()
+	recovered := !node.Alive
+	if recovered {
+		// O tempo fora não é um intervalo entre sinais: o histórico recomeça
+		node.detector = nil
+	}
+	node.Alive, node.Suspect, node.LastCheck = true, false, time.Now()
+	g.recordHeartbeat(node, node.LastCheck)
+	g.Mutex.Unlock()
+
+	if recovered {
+		gossipLog.Info("Node is alive again", "peer", node.ID)
+		g.breakers.reset(node.ID)
+		// Envia ao nó as escritas que ele perdeu enquanto estava fora
+		go g.KeyValueStore.catchUp(node)
+	}
+}
+
+// Sonda um nó: PING direto e, se ele não responder, PINGs indiretos por outros pares. Uma
+// sondagem sem resposta não muda o estado do nó: ele só fica suspeito quando o phi, que cresce
+// enquanto faltam sinais de vida, passa de PhiSuspect (ver evaluatePhi).
+func (g *Gossip) probe(node *Node) {
+	gossipLog.Debug("Sending PING", "peer", node.ID)
+	err := g.ping(node)
+	if err == nil {
+		g.markNodeAlive(node)
+		return
+	}
+	gossipLog.Debug("Error pinging node", "peer", node.ID, "err", err)
+
+	// Um nó já fora ou suspeito só volta respondendo; a suspeita segue até expirar
+	g.Mutex.Lock()
+	probed := node.Alive && !node.Suspect
+	g.Mutex.Unlock()
+	if !probed {
+		return
+	}
+	if g.indirectProbe(node) {
+		gossipLog.Info("Node answered an indirect probe", "peer", node.ID)
+		g.markNodeAlive(node)
+		return
+	}
+	gossipLog.Info("Node did not answer direct or indirect probes", "peer", node.ID, "phi", g.Phi(node.ID))
+}
+
+// Envia um PING com as atualizações de carona e aplica as que vierem no ACK, junto com o horário
+// do nó, usado para estimar a diferença entre os relógios. Um nó que ainda não nos conhece
+// responde IDENTIFY e inicia o handshake de entrada.
+func (g *Gossip) ping(node *Node) error {
+	conn, err := g.dialPeer(node.Address, g.Timeouts.Gossip)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	g.Mutex.Lock()
+	incarnation := g.Self.Incarnation
+	g.Mutex.Unlock()
+
+	updates := g.piggyback()
+	conn.queue("PING", "from", g.Self.ID, strconv.FormatUint(incarnation, 10), strconv.Itoa(len(updates)))
+	queueUpdates(conn, updates)
+	sent := time.Now()
+	if err := conn.flush(); err != nil {
+		return err
+	}
+
+	fields, err := conn.receive()
+	if err != nil {
+		return err
+	}
+	received := time.Now()
+	switch {
+	case len(fields) == 1 && fields[0] == "IDENTIFY":
+		g.answerJoinHandshake(conn, node)
+		return nil
+	case len(fields) == 1 && fields[0] == "ACK":
+		return nil
+	case (len(fields) == 2 || len(fields) == 3) && fields[0] == "ACK":
+		count, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return fmt.Errorf("invalid member update count %q", fields[1])
+		}
+		// O horário do par segue a contagem de atualizações (nós de versões anteriores não o enviam)
+		if len(fields) == 3 {
+			remote, err := strconv.ParseInt(fields[2], 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid clock %q", fields[2])
+			}
+			g.clockSkews.record(node.ID, time.Unix(0, remote), sent, received, g.MaxClockSkew)
+		}
+		acked, err := readUpdates(conn, count)
+		if err != nil {
+			return err
+		}
+		g.applyUpdates(acked)
+		return nil
+	}
+	return fmt.Errorf("node %s answered %q", node.ID, formatMessage(fields))
+}
+
+// Pede a até indirectProbes pares vivos que enviem um PING ao nó; retorna se algum o alcançou
+func (g *Gossip) indirectProbe(target *Node) bool {
+	g.Mutex.Lock()
+	var helpers []*Node
+	for _, node := range g.Nodes {
+		if node != target && node.Alive && !node.Suspect {
+			helpers = append(helpers, node)
+		}
+	}
+	g.Mutex.Unlock()
+
+	rand.Shuffle(len(helpers), func(i, j int) {
+		helpers[i], helpers[j] = helpers[j], helpers[i]
+	})
+	helpers = helpers[:min(indirectProbes, len(helpers))]
+
+	acks := make(chan bool, len(helpers))
+	for _, helper := range helpers {
+		go func() { acks <- g.requestPing(helper, target) }()
+	}
+	for range helpers {
+		if <-acks {
+			return true
+		}
+	}
+	return false
+}
+
+// Envia PINGREQ <alvo> a um par e espera ACK (o par alcançou o alvo) ou NACK
+func (g *Gossip) requestPing(helper, target *Node) bool {
+	// O par tem o seu próprio timeout para alcançar o alvo
+	conn, err := g.dialPeer(helper.Address, g.Timeouts.Gossip.withSlowRead(2))
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+
+	if err := conn.send("PINGREQ", target.ID); err != nil {
+		return false
+	}
+	response, err := conn.receive()
+	return err == nil && len(response) == 1 && response[0] == "ACK"
+}
+
+// Responde a um PINGREQ enviando um PING ao alvo em nome de outro nó
+func (g *Gossip) handlePingReq(conn *peerConn, args []string) {
+	if len(args) != 1 {
+		conn.send("ERROR", "malformed PINGREQ")
+		return
+	}
+	target, known := g.GetNode(args[0])
+	switch {
+	case !known:
+		conn.send("NACK")
+		return
+	case target == g.Self:
+		conn.send("ACK")
+		return
+	}
+
+	if err := g.ping(target); err != nil {
+		gossipLog.Debug("Indirect probe failed", "peer", target.ID, "err", err)
+		conn.send("NACK")
+		return
+	}
+	g.markNodeAlive(target)
+	conn.send("ACK")
+}
+
+// Marca um nó vivo como suspeito e dissemina a suspeita
+func (g *Gossip) suspectNode(node *Node) {
+	g.Mutex.Lock()
+	if !node.Alive || node.Suspect {
+		g.Mutex.Unlock()
+		return
+	}
+	node.Suspect, node.suspectSince = true, time.Now()
+	g.Mutex.Unlock()
+
+	gossipLog.Info("Node is suspected to be down", "peer", node.ID)
+	g.broadcasts.enqueue(g.memberUpdate(updateSuspect, node))
+}
+
+// Declara fora os nós suspeitos há mais de SuspicionTimeout e dissemina a falha
+func (g *Gossip) expireSuspects() {
+	g.Mutex.Lock()
+	var expired []*Node
+	for _, node := range g.Nodes {
+		if node.Alive && node.Suspect && time.Since(node.suspectSince) >= g.SuspicionTimeout {
+			expired = append(expired, node)
+		}
+	}
+	g.Mutex.Unlock()
+
+	for _, node := range expired {
+		gossipLog.Warn("Node did not refute the suspicion", "peer", node.ID, "timeout", g.SuspicionTimeout)
+		g.markNodeDead(node)
+		g.broadcasts.enqueue(g.memberUpdate(updateDead, node))
+	}
+}
@@ -0,0 +1,174 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Camada fria: as SSTables que ficam sem leitura por ColdAfter são movidas para um segundo
+// diretório (--cold-dir, por exemplo num disco mais barato) e continuam sendo lidas de lá. A
+// mudança de camada copia o arquivo, grava o MANIFEST apontando para a cópia e só então apaga o
+// original; uma queda no meio deixa um arquivo fora do MANIFEST, que é apagado na abertura. Uma
+// compactação de SSTables que estão todas na camada fria grava o resultado também nela; se
+// alguma está na camada quente, o resultado fica na quente.
+
+// Tempo padrão sem leitura depois do qual uma SSTable vai para a camada fria
+const DefaultColdAfter = 7 * 24 * time.Hour
+
+// TierStatus resume uma camada de armazenamento
+type TierStatus struct {
+	Name     string    // hot ou cold
+	Dir      string    // Diretório das SSTables da camada
+	Tables   int       // SSTables na camada
+	Records  int       // Registros nelas, incluindo versões substituídas
+	Bytes    int64     // Tamanho dos arquivos
+	LastUsed time.Time // Leitura mais antiga entre as SSTables da camada (zero sem SSTables)
+}
+
+// Configura o diretório da camada fria. As SSTables que já estão na camada fria continuam no
+// diretório em que foram gravadas, então ele só pode mudar com a camada vazia.
+func (l *LSMTree) SetColdDir(dir string) error {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	hot, err := filepath.Abs(l.dir)
+	if err != nil {
+		return err
+	}
+	if dir == hot {
+		return fmt.Errorf("cold directory must differ from %s", l.dir)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	l.compaction.Lock()
+	defer l.compaction.Unlock()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if dir == l.coldDir {
+		return nil
+	}
+	cold := 0
+	for _, t := range l.tables {
+		if t.cold {
+			cold++
+		}
+	}
+	if cold > 0 {
+		return fmt.Errorf("cold tier %s still holds %d sstables", l.coldDir, cold)
+	}
+	l.coldDir = dir
+	return l.saveManifestLocked()
+}
+
+// Move para a camada fria as SSTables da camada quente sem leitura desde before, retornando
+// quantas foram movidas
+func (l *LSMTree) moveColdTables(before time.Time) (int, error) {
+	l.compaction.Lock()
+	defer l.compaction.Unlock()
+
+	l.mutex.RLock()
+	var candidates []*ssTable
+	for _, t := range l.tables {
+		if !t.cold && t.used.Load() < before.UnixNano() {
+			candidates = append(candidates, t)
+		}
+	}
+	enabled := l.coldDir != ""
+	l.mutex.RUnlock()
+	if !enabled {
+		return 0, nil
+	}
+
+	moved := 0
+	for _, t := range candidates {
+		if l.closing.Load() {
+			return moved, errLSMClosed
+		}
+		if err := l.moveToCold(t); err != nil {
+			return moved, fmt.Errorf("moving sstable %s to the cold tier: %w", t.path, err)
+		}
+		moved++
+	}
+	return moved, nil
+}
+
+// Copia o arquivo da SSTable para a camada fria e passa a lê-la de lá. Deve ser chamada com
+// compaction obtido, para que a SSTable não seja substituída durante a cópia.
+func (l *LSMTree) moveToCold(t *ssTable) error {
+	path := l.tablePath(t.id, true)
+	if err := copyFileAtomic(t.path, path); err != nil {
+		return err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+
+	l.mutex.Lock()
+	previous, previousPath := t.file, t.path
+	t.file, t.path, t.cold = file, path, true
+	if err := l.saveManifestLocked(); err != nil {
+		t.file, t.path, t.cold = previous, previousPath, false
+		l.mutex.Unlock()
+		file.Close()
+		os.Remove(path)
+		return err
+	}
+	l.mutex.Unlock()
+
+	previous.Close()
+	if err := os.Remove(previousPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		storageLog.Error("Error removing sstable after moving it to the cold tier", "path", previousPath, "err", err)
+	}
+	l.moved.Add(1)
+	return nil
+}
+
+// Retorna o resumo da camada quente e, se configurada, da fria
+func (l *LSMTree) Tiers() []TierStatus {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	tiers := []TierStatus{{Name: "hot", Dir: l.dir}}
+	if l.coldDir != "" {
+		tiers = append(tiers, TierStatus{Name: "cold", Dir: l.coldDir})
+	}
+	for _, t := range l.tables {
+		tier := &tiers[0]
+		if t.cold {
+			tier = &tiers[len(tiers)-1]
+		}
+		tier.Tables++
+		tier.Records += len(t.keys)
+		tier.Bytes += t.size
+		if used := time.Unix(0, t.used.Load()); tier.LastUsed.IsZero() || used.Before(tier.LastUsed) {
+			tier.LastUsed = used
+		}
+	}
+	return tiers
+}
+
+// Função de loop que move periodicamente para a camada fria as SSTables sem leitura há ColdAfter
+func (kv *KeyValueStore) StartTiering(ctx context.Context) {
+	if kv.ColdAfter <= 0 {
+		return
+	}
+	kv.every(ctx, min(kv.ColdAfter/2, time.Hour), func() {
+		moved, err := kv.LSM.moveColdTables(time.Now().Add(-kv.ColdAfter))
+		if err != nil && !errors.Is(err, errLSMClosed) {
+			storageLog.Error("Error moving sstables to the cold tier", "err", err)
+		}
+		if moved > 0 {
+			storageLog.Info("Moved unused sstables to the cold tier", "sstables", moved, "unused_for", kv.ColdAfter)
+		}
+	})
+}
@@ -0,0 +1,132 @@
+package store
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// PeerTimeouts limita uma conexão entre nós: o tempo para conectar e o tempo máximo de cada
+// leitura e de cada escrita. Os prazos de leitura e escrita são renovados a cada operação, então
+// uma conexão que transfere muitas linhas (um BATCH, um SCAN) só expira se ficar parada.
+type PeerTimeouts struct {
+	Dial  time.Duration
+	Read  time.Duration
+	Write time.Duration
+}
+
+// Converte "<dial>,<read>,<write>" (ex.: "1s,2s,2s") em timeouts
+func ParsePeerTimeouts(s string) (PeerTimeouts, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 3 {
+		return PeerTimeouts{}, fmt.Errorf("invalid timeouts %q (use <dial>,<read>,<write>, e.g. 1s,2s,2s)", s)
+	}
+	var values [3]time.Duration
+	for i, part := range parts {
+		d, err := time.ParseDuration(strings.TrimSpace(part))
+		if err != nil || d <= 0 {
+			return PeerTimeouts{}, fmt.Errorf("invalid timeouts %q: each timeout must be a positive duration", s)
+		}
+		values[i] = d
+	}
+	return PeerTimeouts{Dial: values[0], Read: values[1], Write: values[2]}, nil
+}
+
+func (t PeerTimeouts) String() string {
+	return fmt.Sprintf("dial %s, read %s, write %s", t.Dial, t.Read, t.Write)
+}
+
+// Retorna os timeouts com a leitura multiplicada por factor, para requisições em que o par
+// ainda contata outros nós antes de responder
+func (t PeerTimeouts) withSlowRead(factor int) PeerTimeouts {
+	t.Read *= time.Duration(factor)
+	return t
+}
+
+// Retorna os timeouts com a leitura trocada por read
+func (t PeerTimeouts) withReadTimeout(read time.Duration) PeerTimeouts {
+	t.Read = read
+	return t
+}
+
+// TimeoutConfig separa os timeouts das conexões entre nós por tipo de tráfego
+type TimeoutConfig struct {
+	Gossip      PeerTimeouts // PING, PINGREQ, SYNC, JOIN, LEAVE, eleição e settings
+	Replication PeerTimeouts // REPLICATE, FETCH, REPAIR, SCAN, DELPREFIX, FORWARD e MULTI
+	Hints       PeerTimeouts // BATCH e HINT
+}
+
+// Timeouts padrão: replicaTimeout para tudo
+func DefaultTimeoutConfig() TimeoutConfig {
+	t := PeerTimeouts{Dial: replicaTimeout, Read: replicaTimeout, Write: replicaTimeout}
+	return TimeoutConfig{Gossip: t, Replication: t, Hints: t}
+}
+
+// Retorna os timeouts do tráfego a que uma mensagem recebida pertence
+func (c TimeoutConfig) forMessage(kind string) PeerTimeouts {
+	switch kind {
+	case "REPLICATE", "FETCH", "REPAIR", "SCAN", "DELPREFIX", "FORWARD", "MULTI":
+		return c.Replication
+	case "BATCH", "HINT":
+		return c.Hints
+	}
+	return c.Gossip
+}
+
+// deadlineConn renova o prazo de leitura antes de cada Read e o de escrita antes de cada Write
+// (timeouts zerados tiram o prazo)
+type deadlineConn struct {
+	net.Conn
+	timeouts PeerTimeouts
+}
+
+func (c *deadlineConn) Read(b []byte) (int, error) {
+	c.Conn.SetReadDeadline(deadlineAfter(c.timeouts.Read))
+	return c.Conn.Read(b)
+}
+
+func (c *deadlineConn) Write(b []byte) (int, error) {
+	c.Conn.SetWriteDeadline(deadlineAfter(c.timeouts.Write))
+	return c.Conn.Write(b)
+}
+
+// Retorna o prazo de uma operação que começa agora; timeout 0 não tem prazo
+func deadlineAfter(timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
+
+// Conecta a um endereço com os timeouts dados, aplicados a todas as operações da conexão; com
+// tlsConfig, o handshake TLS também precisa terminar no timeout de conexão
+func dialWithTimeouts(transport Transport, address string, timeouts PeerTimeouts, tlsConfig *tls.Config) (net.Conn, error) {
+	conn, err := dialPeerAddress(transport, address, timeouts.Dial, 0, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &deadlineConn{Conn: conn, timeouts: timeouts}, nil
+}
+
+// Abre a conexão com um par pelo transporte (nil = TCP) e, com tlsConfig, a sessão TLS, cujo
+// handshake também precisa terminar no timeout de conexão
+func dialPeerAddress(transport Transport, address string, timeout, keepAlive time.Duration, tlsConfig *tls.Config) (net.Conn, error) {
+	if transport == nil {
+		transport = TCPTransport{}
+	}
+	conn, err := transport.Dial(address, timeout, keepAlive)
+	if err != nil || tlsConfig == nil {
+		return conn, err
+	}
+
+	conn.SetDeadline(deadlineAfter(timeout))
+	session := tls.Client(conn, tlsConfig)
+	if err := session.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return session, nil
+}
@@ -0,0 +1,69 @@
+package store
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+)
+
+// Com TLS, as conexões entre nós usam TLS com autenticação mútua: cada nó apresenta o próprio
+// certificado e só aceita pares (e só se conecta a pares) com certificados emitidos pela CA do
+// cluster. Um processo sem um certificado da CA não consegue entrar no cluster nem enviar
+// escritas. O certificado do nó deve valer para autenticação de servidor e de cliente e ter o
+// nome (ou IP) do endereço do nó, que é verificado por quem se conecta a ele. Todos os nós do
+// cluster precisam usar TLS ao mesmo tempo.
+
+// Carrega o certificado e a chave do nó e a CA do cluster (arquivos PEM) numa configuração que
+// serve para os dois lados das conexões entre nós, com autenticação mútua
+func LoadTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	if certFile == "" || keyFile == "" || caFile == "" {
+		return nil, errors.New("TLS needs a certificate, a key and a CA")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificate %s: %w", certFile, err)
+	}
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	cas := x509.NewCertPool()
+	if !cas.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in CA file %s", caFile)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      cas,
+		ClientCAs:    cas,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// Retorna a configuração TLS para conectar ao endereço, que verifica o certificado do par
+// pelo nome (ou IP) do endereço; nil se config é nil
+func tlsForAddress(config *tls.Config, address string) *tls.Config {
+	if config == nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	config = config.Clone()
+	config.ServerName = host
+	return config
+}
+
+// Indica se a conexão recebida (ou a conexão multiplexada que leva o stream) é TLS com o
+// certificado do par verificado pela CA do cluster
+func peerAuthenticated(conn net.Conn) bool {
+	if stream, ok := conn.(*muxStream); ok {
+		conn = stream.session.conn.Conn
+	}
+	tlsConn, ok := conn.(*tls.Conn)
+	return ok && len(tlsConn.ConnectionState().VerifiedChains) > 0
+}
@@ -0,0 +1,50 @@
+package store
+
+import (
+	"context"
+	"time"
+)
+
+// Tempo padrão que um tombstone é mantido antes de ser descartado
+const DefaultTombstoneGrace = 24 * time.Hour
+
+// Função de loop para descartar periodicamente os tombstones mais antigos que TombstoneGrace
+func (kv *KeyValueStore) StartTombstoneGC(ctx context.Context) {
+	if kv.TombstoneGrace <= 0 {
+		return
+	}
+	kv.every(ctx, min(kv.TombstoneGrace/2, time.Hour), func() {
+		if removed := kv.collectTombstones(time.Now()); removed > 0 {
+			storageLog.Info("Discarded expired tombstones", "tombstones", removed, "grace", kv.TombstoneGrace)
+		}
+	})
+}
+
+// Remove da memória os tombstones gravados antes de now - TombstoneGrace. O prazo deve ser
+// maior que o tempo em que uma réplica pode ficar fora: depois dele, uma versão antiga vinda
+// de uma réplica que não recebeu a remoção volta a ser aceita.
+func (kv *KeyValueStore) collectTombstones(now time.Time) int {
+	kv.Mutex.Lock()
+	defer kv.Mutex.Unlock()
+
+	// Tombstones com hints pendentes ainda precisam chegar às réplicas que estavam fora
+	pending := make(map[string]bool)
+	for _, hint := range kv.HintedData {
+		pending[hint.Key] = true
+	}
+
+	cutoff := now.Add(-kv.TombstoneGrace)
+	var expired []string
+	kv.Data.Ascend(func(key string, item *DataItem) bool {
+		// Um tombstone com irmãs ainda é uma das versões concorrentes da chave
+		if item.Deleted() && len(item.Siblings) == 0 && item.WrittenAt.Before(cutoff) && !pending[key] {
+			expired = append(expired, key)
+		}
+		return true
+	})
+
+	for _, key := range expired {
+		kv.Data.Delete(key)
+	}
+	return len(expired)
+}
@@ -0,0 +1,142 @@
+package store
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// As conexões entre nós passam por um Transport: o TCP, por padrão, ou uma MemoryNetwork, em
+// que os nós de um mesmo processo se conectam por pares de net.Pipe. A rede em memória permite
+// simular um cluster inteiro num único processo (como fazem os testes de integração), com os
+// mesmos handlers, o mesmo protocolo e os mesmos timeouts de um cluster real: derrubar um nó é
+// fechar o listener dele, e as conexões para o endereço passam a ser recusadas. O TLS, quando
+// configurado, é negociado sobre a conexão aberta pelo transporte.
+
+// Transport abre e aceita as conexões entre nós
+type Transport interface {
+	Listen(address string) (net.Listener, error)
+	Dial(address string, timeout, keepAlive time.Duration) (net.Conn, error)
+}
+
+// TCPTransport conecta os nós por TCP
+type TCPTransport struct{}
+
+func (TCPTransport) Listen(address string) (net.Listener, error) {
+	return net.Listen("tcp", address)
+}
+
+func (TCPTransport) Dial(address string, timeout, keepAlive time.Duration) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout, KeepAlive: keepAlive}
+	return dialer.Dial("tcp", address)
+}
+
+// MemoryNetwork conecta, em memória, os nós de um mesmo processo pelos endereços em que eles
+// ouvem
+type MemoryNetwork struct {
+	mutex     sync.Mutex
+	listeners map[string]*memoryListener
+	clients   atomic.Uint64 // Numera os endereços locais das conexões abertas
+}
+
+func NewMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{listeners: make(map[string]*memoryListener)}
+}
+
+// Passa a aceitar conexões no endereço, que não pode estar em uso
+func (n *MemoryNetwork) Listen(address string) (net.Listener, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if _, exists := n.listeners[address]; exists {
+		return nil, &net.OpError{Op: "listen", Net: "memory", Addr: memoryAddr(address), Err: fmt.Errorf("address already in use")}
+	}
+	l := &memoryListener{
+		network: n,
+		address: memoryAddr(address),
+		conns:   make(chan net.Conn),
+		closed:  make(chan struct{}),
+	}
+	n.listeners[address] = l
+	return l, nil
+}
+
+// Conecta ao endereço, esperando até timeout (0 = sem prazo) que o listener aceite a conexão
+func (n *MemoryNetwork) Dial(address string, timeout, keepAlive time.Duration) (net.Conn, error) {
+	n.mutex.Lock()
+	l, exists := n.listeners[address]
+	n.mutex.Unlock()
+	refused := &net.OpError{Op: "dial", Net: "memory", Addr: memoryAddr(address), Err: fmt.Errorf("connection refused")}
+	if !exists {
+		return nil, refused
+	}
+
+	local := memoryAddr(fmt.Sprintf("client-%d", n.clients.Add(1)))
+	client, server := net.Pipe()
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case l.conns <- &memoryConn{Conn: server, local: l.address, remote: local}:
+		return &memoryConn{Conn: client, local: local, remote: l.address}, nil
+	case <-l.closed:
+		return nil, refused
+	case <-expired:
+		client.Close()
+		server.Close()
+		return nil, &net.OpError{Op: "dial", Net: "memory", Addr: memoryAddr(address), Err: fmt.Errorf("i/o timeout")}
+	}
+}
+
+// memoryListener entrega as conexões abertas para um endereço da MemoryNetwork
+type memoryListener struct {
+	network *MemoryNetwork
+	address memoryAddr
+	conns   chan net.Conn
+	closed  chan struct{}
+	once    sync.Once
+}
+
+func (l *memoryListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Libera o endereço; as conexões já aceitas continuam abertas até serem fechadas
+func (l *memoryListener) Close() error {
+	l.once.Do(func() {
+		l.network.mutex.Lock()
+		if l.network.listeners[string(l.address)] == l {
+			delete(l.network.listeners, string(l.address))
+		}
+		l.network.mutex.Unlock()
+		close(l.closed)
+	})
+	return nil
+}
+
+func (l *memoryListener) Addr() net.Addr { return l.address }
+
+// memoryConn é uma ponta de um net.Pipe com os endereços dos dois lados
+type memoryConn struct {
+	net.Conn
+	local, remote memoryAddr
+}
+
+func (c *memoryConn) LocalAddr() net.Addr  { return c.local }
+func (c *memoryConn) RemoteAddr() net.Addr { return c.remote }
+
+// memoryAddr é um endereço da MemoryNetwork
+type memoryAddr string
+
+func (a memoryAddr) Network() string { return "memory" }
+func (a memoryAddr) String() string  { return string(a) }
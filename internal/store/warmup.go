@@ -0,0 +1,215 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Depois de um restart a memória do nó está vazia e as primeiras leituras das chaves mais
+// usadas vão todas ao disco. Para suavizar esse pico, o nó acompanha as chaves que mais lê num
+// sketch Space-Saving (as hotKeyCapacity mais frequentes, com contagens aproximadas) e grava o
+// sketch no diretório de dados ao fechar o armazenamento. Na inicialização seguinte, com
+// WarmupRate, um loop em segundo plano carrega essas chaves do disco para a memória, das mais
+// lidas para as menos lidas e no máximo WarmupRate por segundo, pulando as que já foram lidas ou
+// gravadas e as que o nó deixou de replicar. O sketch gravado volta com as contagens pela
+// metade, para que as chaves que esfriaram deem lugar às novas.
+
+// Arquivo do sketch no diretório de dados ("<contagem> <chave>" por linha, das mais lidas às menos)
+const hotKeysFile = "hotkeys"
+
+// Chaves acompanhadas pelo sketch
+const hotKeyCapacity = 10000
+
+// hotKey é uma chave do sketch com a contagem, que pode estar acima da real
+type hotKey struct {
+	key   string
+	count uint64
+	index int // Posição no heap
+}
+
+// hotKeySketch guarda as chaves mais lidas pelo algoritmo Space-Saving: uma chave nova ocupa o
+// lugar da menos contada, herdando a contagem dela
+type hotKeySketch struct {
+	mutex    sync.Mutex
+	capacity int
+	keys     map[string]*hotKey
+	heap     hotKeyHeap // Menor contagem no topo
+}
+
+func newHotKeySketch(capacity int) *hotKeySketch {
+	return &hotKeySketch{capacity: capacity, keys: make(map[string]*hotKey)}
+}
+
+// Conta uma leitura da chave
+func (s *hotKeySketch) record(key string) {
+	s.add(key, 1)
+}
+
+func (s *hotKeySketch) add(key string, count uint64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if entry, exists := s.keys[key]; exists {
+		entry.count += count
+		heap.Fix(&s.heap, entry.index)
+		return
+	}
+	if len(s.heap) < s.capacity {
+		entry := &hotKey{key: key, count: count}
+		s.keys[key] = entry
+		heap.Push(&s.heap, entry)
+		return
+	}
+	// Substitui a chave menos contada, somando à contagem dela
+	entry := s.heap[0]
+	delete(s.keys, entry.key)
+	entry.key = key
+	entry.count += count
+	s.keys[key] = entry
+	heap.Fix(&s.heap, 0)
+}
+
+// Retorna as chaves com as contagens, das mais lidas às menos
+func (s *hotKeySketch) top() []hotKey {
+	s.mutex.Lock()
+	keys := make([]hotKey, 0, len(s.heap))
+	for _, entry := range s.heap {
+		keys = append(keys, *entry)
+	}
+	s.mutex.Unlock()
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].count != keys[j].count {
+			return keys[i].count > keys[j].count
+		}
+		return keys[i].key < keys[j].key
+	})
+	return keys
+}
+
+// hotKeyHeap implementa heap.Interface sobre as chaves do sketch
+type hotKeyHeap []*hotKey
+
+func (h hotKeyHeap) Len() int           { return len(h) }
+func (h hotKeyHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+func (h hotKeyHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+
+func (h *hotKeyHeap) Push(x any) {
+	entry := x.(*hotKey)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *hotKeyHeap) Pop() any {
+	old := *h
+	entry := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return entry
+}
+
+// Grava o sketch no arquivo, das chaves mais lidas às menos, uma por linha; as chaves com
+// quebras de linha ficam de fora do aquecimento
+func (s *hotKeySketch) save(path string) error {
+	var buf bytes.Buffer
+	for _, entry := range s.top() {
+		if strings.ContainsAny(entry.key, "\r\n") {
+			continue
+		}
+		fmt.Fprintf(&buf, "%d %s\n", entry.count, entry.key)
+	}
+	return writeFileAtomic(path, buf.Bytes(), 0644)
+}
+
+// Carrega o sketch gravado por save, com as contagens pela metade; um arquivo ausente deixa o
+// sketch vazio
+func (s *hotKeySketch) load(path string) error {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		countField, key, found := strings.Cut(scanner.Text(), " ")
+		count, err := strconv.ParseUint(countField, 10, 64)
+		if !found || err != nil || key == "" {
+			return fmt.Errorf("%s:%d: malformed line", path, line)
+		}
+		s.add(key, max(count/2, 1))
+	}
+	return scanner.Err()
+}
+
+// Carrega o sketch da execução anterior; um arquivo corrompido só desativa o aquecimento
+func (kv *KeyValueStore) loadHotKeys() {
+	if err := kv.hotKeys.load(filepath.Join(kv.DataDir, hotKeysFile)); err != nil {
+		storageLog.Warn("Ignoring the saved hot keys", "err", err)
+		kv.hotKeys = newHotKeySketch(hotKeyCapacity)
+	}
+}
+
+// Grava o sketch para o aquecimento da próxima inicialização
+func (kv *KeyValueStore) saveHotKeys() {
+	if err := kv.hotKeys.save(filepath.Join(kv.DataDir, hotKeysFile)); err != nil {
+		storageLog.Warn("Failed to save the hot keys", "err", err)
+	}
+}
+
+// Carrega na memória, em segundo plano e no máximo WarmupRate por segundo, as chaves mais lidas
+// antes do último desligamento
+func (kv *KeyValueStore) StartWarmup(ctx context.Context) {
+	if kv.WarmupRate <= 0 {
+		return
+	}
+	keys := kv.hotKeys.top()
+	if len(keys) == 0 {
+		return
+	}
+	kv.runLoop(ctx, func(ctx context.Context) {
+		ticker := time.NewTicker(time.Second / time.Duration(kv.WarmupRate))
+		defer ticker.Stop()
+
+		start, loaded := time.Now(), 0
+		storageLog.Info("Warming up the read cache", "keys", len(keys), "rate", kv.WarmupRate)
+		for _, entry := range keys {
+			if !kv.isReplica(entry.key) {
+				continue
+			}
+			if state, exists := kv.Gossip.bucketState(BucketOf(entry.key)); exists && state.Dropped {
+				continue
+			}
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				storageLog.Info("Read cache warmup interrupted", "loaded", loaded)
+				return
+			}
+			kv.Mutex.Lock()
+			if _, exists := kv.Data.Get(entry.key); !exists {
+				if _, ok := kv.loadItem(entry.key); ok {
+					loaded++
+				}
+			}
+			kv.Mutex.Unlock()
+		}
+		storageLog.Info("Read cache warmed up", "loaded", loaded, "duration", time.Since(start).Round(time.Millisecond))
+	})
+}
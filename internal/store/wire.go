@@ -0,0 +1,205 @@
+package store
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+// Protocolo entre nós: cada mensagem é uma lista de campos, o primeiro com o tipo da requisição
+// (PING, REPLICATE, FORWARD...) ou da resposta (ACK, OK, ERROR...). No formato binário a
+// mensagem vai num quadro:
+//
+//	<versão: 1 byte> <tamanho do corpo: uvarint> <corpo>
+//
+// e o corpo é a sequência de campos, cada um com o tamanho (uvarint) seguido dos bytes. Como os
+// campos são delimitados pelo tamanho, IDs de nós e mensagens de erro podem ter espaços e um
+// campo pode ser vazio. O formato de texto anterior (uma linha por mensagem, com os campos
+// separados por espaços) continua aceito: o primeiro byte de uma conexão recebida indica o
+// formato, e as respostas seguem o da requisição. Com TextProtocol o nó também envia em texto,
+// para que um cluster com nós de versões anteriores seja atualizado aos poucos.
+//
+// Nos quadros, chaves e valores podem ter espaços, quebras de linha e bytes quaisquer; o commit
+// log e os arquivos de hints os gravam escapados. Só um nó com TextProtocol recusa chaves e
+// valores com espaços (ver ValidateKey), que o formato de texto não separaria.
+
+// Versão do formato binário; um quadro de outra versão é recusado
+const wireVersion = 1
+
+// Tamanho máximo do corpo de uma mensagem
+const maxMessageSize = 16 << 20
+
+// peerConn troca mensagens com outro nó numa conexão
+type peerConn struct {
+	net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+	text   bool // Usa o formato de texto anterior
+}
+
+func newPeerConn(conn net.Conn, text bool) *peerConn {
+	return &peerConn{Conn: conn, reader: bufio.NewReader(conn), writer: bufio.NewWriter(conn), text: text}
+}
+
+// Envolve uma conexão recebida, identificando o formato pelo primeiro byte: linhas de texto
+// começam por uma letra, e quadros binários pela versão
+func acceptPeerConn(conn net.Conn) (*peerConn, error) {
+	c := newPeerConn(conn, false)
+	first, err := c.reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	c.text = first[0] >= ' '
+	return c, nil
+}
+
+// Envia uma mensagem
+func (c *peerConn) send(fields ...string) error {
+	c.queue(fields...)
+	return c.flush()
+}
+
+// Acrescenta uma mensagem ao buffer de envio, enviado no próximo send ou flush. Os erros de
+// escrita aparecem no flush.
+func (c *peerConn) queue(fields ...string) {
+	if c.text {
+		c.writer.WriteString(strings.Join(fields, " "))
+		c.writer.WriteByte('\n')
+		return
+	}
+	size := 0
+	for _, field := range fields {
+		size += uvarintLen(uint64(len(field))) + len(field)
+	}
+	var header [1 + binary.MaxVarintLen64]byte
+	header[0] = wireVersion
+	n := binary.PutUvarint(header[1:], uint64(size))
+	c.writer.Write(header[:1+n])
+	for _, field := range fields {
+		n := binary.PutUvarint(header[:], uint64(len(field)))
+		c.writer.Write(header[:n])
+		c.writer.WriteString(field)
+	}
+}
+
+// Envia as mensagens acumuladas por queue
+func (c *peerConn) flush() error {
+	return c.writer.Flush()
+}
+
+// Recebe uma mensagem
+func (c *peerConn) receive() ([]string, error) {
+	if c.text {
+		line, err := c.readLine()
+		if err != nil {
+			return nil, err
+		}
+		return strings.Fields(line), nil
+	}
+
+	version, err := c.reader.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if version != wireVersion {
+		return nil, fmt.Errorf("unsupported protocol version %d (this node speaks version %d)", version, wireVersion)
+	}
+	header := &countingReader{reader: c.reader}
+	size, err := binary.ReadUvarint(header)
+	if err != nil {
+		return nil, noEOF(err)
+	}
+	if header.n != uvarintLen(size) {
+		return nil, errors.New("malformed message size")
+	}
+	if size > maxMessageSize {
+		return nil, fmt.Errorf("message of %d bytes exceeds the limit of %d bytes", size, maxMessageSize)
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(c.reader, body); err != nil {
+		return nil, noEOF(err)
+	}
+	return decodeFields(body)
+}
+
+// Lê uma linha do formato de texto, com o mesmo limite de tamanho das mensagens binárias
+func (c *peerConn) readLine() (string, error) {
+	var line []byte
+	for {
+		chunk, err := c.reader.ReadSlice('\n')
+		if len(line)+len(chunk) > maxMessageSize {
+			return "", fmt.Errorf("message exceeds the limit of %d bytes", maxMessageSize)
+		}
+		line = append(line, chunk...)
+		switch {
+		case err == nil:
+			return string(line), nil
+		case !errors.Is(err, bufio.ErrBufferFull):
+			return "", err
+		}
+	}
+}
+
+// Separa os campos do corpo de uma mensagem binária. Um tamanho codificado com mais bytes que o
+// necessário (0x80 0x00 para 0, por exemplo) é recusado, para que cada mensagem tenha uma única
+// codificação.
+func decodeFields(body []byte) ([]string, error) {
+	var fields []string
+	for len(body) > 0 {
+		size, n := binary.Uvarint(body)
+		if n <= 0 || n != uvarintLen(size) || size > uint64(len(body)-n) {
+			return nil, errors.New("malformed message field")
+		}
+		fields = append(fields, string(body[n:n+int(size)]))
+		body = body[n+int(size):]
+	}
+	return fields, nil
+}
+
+// Uma mensagem interrompida no meio não é um fim normal da conexão
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// countingReader conta os bytes lidos, para conferir o tamanho de um uvarint
+type countingReader struct {
+	reader io.ByteReader
+	n      int
+}
+
+func (r *countingReader) ReadByte() (byte, error) {
+	b, err := r.reader.ReadByte()
+	if err == nil {
+		r.n++
+	}
+	return b, err
+}
+
+func uvarintLen(x uint64) int {
+	n := 1
+	for ; x >= 0x80; x >>= 7 {
+		n++
+	}
+	return n
+}
+
+// Descreve uma mensagem recebida para os logs e erros
+func formatMessage(fields []string) string {
+	return strings.Join(fields, " ")
+}
+
+// Retorna o texto depois do status de uma resposta ("ERROR <mensagem>", "DENIED <motivo>"); no
+// formato de texto a mensagem chega separada em vários campos
+func messageText(fields []string) string {
+	if len(fields) < 2 {
+		return ""
+	}
+	return strings.Join(fields[1:], " ")
+}
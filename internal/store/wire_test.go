@@ -0,0 +1,155 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Codifica uma mensagem como o peerConn a envia, no formato binário ou no de texto
+func encodeMessage(text bool, fields ...string) []byte {
+	var buf bytes.Buffer
+	c := &peerConn{writer: bufio.NewWriter(&buf), text: text}
+	c.send(fields...)
+	return buf.Bytes()
+}
+
+// Mensagens usadas como sementes dos fuzzers
+var seedMessages = [][]string{
+	{"PING", "node2", "1", "node3"},
+	{"PINGREQ", "node2", "node3"},
+	{"REPLICATE", "chave", "valor", "node1=1", "1700000000000000000"},
+	{"REPLICATE", "chave"},
+	{"FETCH", "chave"},
+	{"SCAN", "pedidos/", "", "10"},
+	{"FORWARD", "PUT", "chave", "valor"},
+	{"FORWARD", "DELETE", "chave"},
+	{"FORWARD", "CAS", "chave", "x", "valor"},
+	{"MULTI", "2", "PUT", "a", "1"},
+	{"HINT", "node2", "chave"},
+	{"BATCH", "-1"},
+	{"SETTING", "PREPARE"},
+	{"JOIN", "node2", "node2:7000", ""},
+	{"ELECTION", "node0"},
+	{"MUX"},
+	{""},
+}
+
+// Campos aceitos por decodeFields voltam ao mesmo corpo quando codificados
+func FuzzDecodeFields(f *testing.F) {
+	for _, seed := range seedMessages {
+		frame := encodeMessage(false, seed...)
+		_, n := binary.Uvarint(frame[1:])
+		f.Add(frame[1+n:])
+	}
+	f.Add([]byte{0x05, 'a'})
+	f.Add([]byte{0x80})
+	f.Add([]byte{0x80, 0x00})
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01})
+
+	f.Fuzz(func(t *testing.T, body []byte) {
+		fields, err := decodeFields(body)
+		if err != nil {
+			return
+		}
+		frame := encodeMessage(false, fields...)
+		_, n := binary.Uvarint(frame[1:])
+		if encoded := frame[1+n:]; !bytes.Equal(encoded, body) {
+			t.Fatalf("decodeFields(%x) = %q, which encodes to %x", body, fields, encoded)
+		}
+	})
+}
+
+// Quadros truncados, malformados ou de outra versão terminam em erro, sem pânico; as mensagens
+// lidas chegam iguais ao outro lado quando reenviadas no mesmo formato
+func FuzzReceive(f *testing.F) {
+	for _, seed := range seedMessages {
+		f.Add(encodeMessage(false, seed...))
+		f.Add(encodeMessage(true, seed...))
+	}
+	f.Add(append(encodeMessage(false, "PING", "node2"), encodeMessage(false, "FETCH", "chave")...))
+	f.Add([]byte{wireVersion, 0x03, 0x05, 'a', 'b'})
+	f.Add([]byte{wireVersion, 0xff, 0xff, 0xff, 0xff, 0x7f})
+	f.Add([]byte{2, 0x00})
+	f.Add([]byte{wireVersion, 0x81, 0x00, 0x00})
+	f.Add([]byte("PING node2"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		text := len(data) > 0 && data[0] >= ' '
+		c := &peerConn{reader: bufio.NewReader(bytes.NewReader(data)), text: text}
+		for {
+			fields, err := c.receive()
+			if err != nil {
+				return
+			}
+			again := &peerConn{reader: bufio.NewReader(bytes.NewReader(encodeMessage(text, fields...))), text: text}
+			decoded, err := again.receive()
+			if err != nil {
+				t.Fatalf("message %q does not decode after being encoded: %v", fields, err)
+			}
+			if !slices.Equal(decoded, fields) {
+				t.Fatalf("message %q decodes to %q after being encoded", fields, decoded)
+			}
+		}
+	})
+}
+
+// Um par que envia bytes quaisquer não derruba o nó: handleConnection responde ou recusa a
+// mensagem e devolve a conexão, sem pânico (os recuperados pelo handler também falham o teste)
+func FuzzHandleConnection(f *testing.F) {
+	g := NewGossip("node1", "node1:7000", time.Second, 8, f.TempDir())
+	g.Transport = NewMemoryNetwork() // Endereços vindos da entrada são recusados sem sair do processo
+	f.Cleanup(func() { g.KeyValueStore.Close() })
+	for _, seed := range seedMessages {
+		f.Add(encodeMessage(false, seed...))
+		f.Add(encodeMessage(true, seed...))
+	}
+	f.Add([]byte{wireVersion, 0x0a, 0x04, 'P', 'I', 'N', 'G'})
+	f.Add([]byte(strings.Repeat("x", 100)))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		client, server := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			g.handleConnection(server)
+		}()
+		go io.Copy(io.Discard, client)
+		client.Write(data)
+		client.Close()
+
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("handleConnection did not return for %q", data)
+		}
+		if panics := g.panics.Load(); panics > 0 {
+			t.Fatalf("handling %q panicked", data)
+		}
+	})
+}
+
+// Um nó que envia no protocolo de texto recusa chaves e valores com espaços, que chegariam
+// partidos às outras réplicas
+func TestTextProtocolRefusesWhitespace(t *testing.T) {
+	g := newTestGossip(t, "node1")
+	if err := g.ValidateKey("a b"); err != nil {
+		t.Fatalf("ValidateKey over binary frames: %v", err)
+	}
+	g.TextProtocol = true
+	if err := g.ValidateKey("a b"); err == nil {
+		t.Fatal("ValidateKey accepted a key with whitespace under the text protocol")
+	}
+	if err := g.ValidateValue("a\nb"); err == nil {
+		t.Fatal("ValidateValue accepted a value with a line break under the text protocol")
+	}
+	if err := g.ValidateKey("ab"); err != nil {
+		t.Fatalf("ValidateKey(ab) under the text protocol: %v", err)
+	}
+}
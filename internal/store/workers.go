@@ -0,0 +1,68 @@
+package store
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+)
+
+// WorkerConfig define o tamanho dos pools de workers de disco e rede do nó
+type WorkerConfig struct {
+	FlushWorkers      int // SSTables gravadas em paralelo num Flush grande
+	CompactionWorkers int // Compactações de SSTables em paralelo
+	ReplicaWorkers    int // Chamadas simultâneas às réplicas numa escrita
+	HintWorkers       int // Entregas simultâneas de hinted handoff
+	ScatterWorkers    int // Nós consultados ao mesmo tempo por um comando de todo o cluster (scan) ou lote (MPut)
+}
+
+// Retorna os tamanhos padrão derivados do GOMAXPROCS: o trabalho de rede espera
+// mais do que usa CPU, então recebe mais workers do que o trabalho de disco
+func DefaultWorkerConfig() WorkerConfig {
+	procs := runtime.GOMAXPROCS(0)
+	return WorkerConfig{
+		FlushWorkers:      procs,
+		CompactionWorkers: max(1, procs/4),
+		ReplicaWorkers:    4 * procs,
+		HintWorkers:       2 * procs,
+		ScatterWorkers:    2 * procs,
+	}
+}
+
+// Valida a configuração, exigindo pelo menos um worker em cada pool
+func (c WorkerConfig) Validate() error {
+	pools := map[string]int{
+		"flush":      c.FlushWorkers,
+		"compaction": c.CompactionWorkers,
+		"replica":    c.ReplicaWorkers,
+		"hint":       c.HintWorkers,
+		"scatter":    c.ScatterWorkers,
+	}
+	for name, size := range pools {
+		if size < 1 {
+			return fmt.Errorf("%s workers must be at least 1, got %d", name, size)
+		}
+	}
+	return nil
+}
+
+// Executa fn(i) para i em [0, n) com no máximo workers execuções simultâneas
+func runBounded(workers, n int, fn func(i int)) {
+	if workers < 1 {
+		workers = 1
+	}
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, workers)
+	for i := 0; i < n; i++ {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			fn(i)
+		}(i)
+	}
+	wg.Wait()
+}
@@ -2,33 +2,82 @@ package vectorclock
 
 import (
 	"fmt"
+	"sort"
+	"time"
 )
 
 type VectorClock struct {
-	Clock map[string]int // Mapa que associa NodeID ao contador
+	Clock   map[string]int   // Mapa que associa NodeID ao contador
+	Updated map[string]int64 // Quando cada contador foi incrementado (segundos Unix; ausente = desconhecido)
 }
 
 // Inicializa um VectorClock vazio
 func NewVectorClock() *VectorClock {
 	return &VectorClock{
-		Clock: make(map[string]int),
+		Clock:   make(map[string]int),
+		Updated: make(map[string]int64),
 	}
 }
 
 // Incrementa o contador para um determinado nó (NodeID)
 func (vc *VectorClock) Increment(nodeID string) {
 	vc.Clock[nodeID]++
+	vc.setUpdated(nodeID, time.Now().Unix())
 }
 
-// Atualiza o VectorClock com outro VectorClock (merge)
+// Atualiza o VectorClock com outro VectorClock (merge). Cada contador leva junto o horário
+// em que foi incrementado.
 func (vc *VectorClock) Merge(other *VectorClock) {
 	for nodeID, counter := range other.Clock {
-		if currentCounter, exists := vc.Clock[nodeID]; !exists || counter > currentCounter {
+		currentCounter, exists := vc.Clock[nodeID]
+		switch {
+		case !exists || counter > currentCounter:
 			vc.Clock[nodeID] = counter
+			vc.setUpdated(nodeID, other.Updated[nodeID])
+		case counter == currentCounter && other.Updated[nodeID] > vc.Updated[nodeID]:
+			vc.setUpdated(nodeID, other.Updated[nodeID])
 		}
 	}
 }
 
+func (vc *VectorClock) setUpdated(nodeID string, updated int64) {
+	if updated <= 0 {
+		delete(vc.Updated, nodeID)
+		return
+	}
+	if vc.Updated == nil {
+		vc.Updated = make(map[string]int64)
+	}
+	vc.Updated[nodeID] = updated
+}
+
+// Limita o VectorClock a max nós, descartando os contadores incrementados há mais tempo (os
+// de horário desconhecido primeiro), como no Dynamo. Uma versão podada pode parecer concorrente
+// a uma versão antiga que ela supera. Retorna o número de contadores descartados.
+func (vc *VectorClock) Prune(max int) int {
+	if max <= 0 || len(vc.Clock) <= max {
+		return 0
+	}
+
+	nodeIDs := make([]string, 0, len(vc.Clock))
+	for nodeID := range vc.Clock {
+		nodeIDs = append(nodeIDs, nodeID)
+	}
+	sort.Slice(nodeIDs, func(i, j int) bool {
+		if a, b := vc.Updated[nodeIDs[i]], vc.Updated[nodeIDs[j]]; a != b {
+			return a < b
+		}
+		return nodeIDs[i] < nodeIDs[j]
+	})
+
+	pruned := nodeIDs[:len(nodeIDs)-max]
+	for _, nodeID := range pruned {
+		delete(vc.Clock, nodeID)
+		delete(vc.Updated, nodeID)
+	}
+	return len(pruned)
+}
+
 // Compara dois Vector Clocks para determinar a relação entre eles
 // Retorna:
 //
@@ -0,0 +1,219 @@
+package vectorclock
+
+import (
+	"fmt"
+	"maps"
+	"math/rand/v2"
+	"testing"
+)
+
+// Número de casos gerados por propriedade
+const propertyCases = 2000
+
+// Gera um Vector Clock com até 4 nós de um conjunto pequeno, para que os casos tenham nós em
+// comum, contadores iguais e horários empatados
+func randomClock(r *rand.Rand) *VectorClock {
+	vc := NewVectorClock()
+	for i := 0; i < 4; i++ {
+		if r.IntN(2) == 0 {
+			continue
+		}
+		id := fmt.Sprintf("node%d", i)
+		vc.Clock[id] = 1 + r.IntN(4)
+		if updated := r.Int64N(3); updated > 0 {
+			vc.Updated[id] = updated
+		}
+	}
+	return vc
+}
+
+func clone(vc *VectorClock) *VectorClock {
+	c := NewVectorClock()
+	c.Merge(vc)
+	return c
+}
+
+func merged(clocks ...*VectorClock) *VectorClock {
+	vc := NewVectorClock()
+	for _, c := range clocks {
+		vc.Merge(c)
+	}
+	return vc
+}
+
+func sameClock(a, b *VectorClock) bool {
+	return maps.Equal(a.Clock, b.Clock) && maps.Equal(a.Updated, b.Updated)
+}
+
+// Retorna uma cópia de vc com alguns contadores incrementados (ao menos um), sempre mais recente
+func advance(r *rand.Rand, vc *VectorClock) *VectorClock {
+	next := clone(vc)
+	next.Clock[fmt.Sprintf("node%d", r.IntN(4))]++
+	for i := 0; i < 4; i++ {
+		if r.IntN(3) == 0 {
+			next.Clock[fmt.Sprintf("node%d", i)] += 1 + r.IntN(2)
+		}
+	}
+	return next
+}
+
+func TestMergeIsCommutative(t *testing.T) {
+	r := rand.New(rand.NewPCG(1, 2))
+	for i := 0; i < propertyCases; i++ {
+		a, b := randomClock(r), randomClock(r)
+		if ab, ba := merged(a, b), merged(b, a); !sameClock(ab, ba) {
+			t.Fatalf("merge(%v, %v) = %v@%v, merge(b, a) = %v@%v", a, b, ab, ab.Updated, ba, ba.Updated)
+		}
+	}
+}
+
+func TestMergeIsAssociative(t *testing.T) {
+	r := rand.New(rand.NewPCG(3, 4))
+	for i := 0; i < propertyCases; i++ {
+		a, b, c := randomClock(r), randomClock(r), randomClock(r)
+		left := merged(merged(a, b), c)
+		right := merged(a, merged(b, c))
+		if !sameClock(left, right) {
+			t.Fatalf("(a+b)+c = %v, a+(b+c) = %v for a=%v b=%v c=%v", left, right, a, b, c)
+		}
+	}
+}
+
+func TestMergeIsIdempotent(t *testing.T) {
+	r := rand.New(rand.NewPCG(5, 6))
+	for i := 0; i < propertyCases; i++ {
+		a := randomClock(r)
+		if aa := merged(a, a); !sameClock(aa, a) {
+			t.Fatalf("merge(%v, itself) = %v", a, aa)
+		}
+		b := randomClock(r)
+		once := merged(a, b)
+		if twice := merged(once, b); !sameClock(once, twice) {
+			t.Fatalf("merging %v twice changed %v into %v", b, once, twice)
+		}
+	}
+}
+
+// O resultado do merge não é mais antigo nem concorrente a nenhuma das entradas
+func TestMergeDominatesInputs(t *testing.T) {
+	r := rand.New(rand.NewPCG(7, 8))
+	for i := 0; i < propertyCases; i++ {
+		a, b := randomClock(r), randomClock(r)
+		m := merged(a, b)
+		for _, input := range []*VectorClock{a, b} {
+			if c := m.Compare(input); c != 1 && !maps.Equal(m.Clock, input.Clock) {
+				t.Fatalf("merge(%v, %v).Compare(%v) = %d", a, b, input, c)
+			}
+		}
+	}
+}
+
+func TestCompareIsAntisymmetric(t *testing.T) {
+	r := rand.New(rand.NewPCG(9, 10))
+	for i := 0; i < propertyCases; i++ {
+		a, b := randomClock(r), randomClock(r)
+		if ab, ba := a.Compare(b), b.Compare(a); ab != -ba {
+			t.Fatalf("Compare(%v, %v) = %d but Compare(b, a) = %d", a, b, ab, ba)
+		}
+		if c := a.Compare(clone(a)); c != 0 {
+			t.Fatalf("Compare(%v, copy) = %d, want 0", a, c)
+		}
+	}
+}
+
+func TestCompareIsTransitive(t *testing.T) {
+	r := rand.New(rand.NewPCG(11, 12))
+	for i := 0; i < propertyCases; i++ {
+		a := randomClock(r)
+		b := advance(r, a)
+		c := advance(r, b)
+		if a.Compare(b) != -1 || b.Compare(c) != -1 {
+			t.Fatalf("advance did not produce newer clocks: %v, %v, %v", a, b, c)
+		}
+		if got := a.Compare(c); got != -1 {
+			t.Fatalf("%v < %v < %v but Compare(a, c) = %d", a, b, c, got)
+		}
+		if got := c.Compare(a); got != 1 {
+			t.Fatalf("%v > %v > %v but Compare(c, a) = %d", c, b, a, got)
+		}
+	}
+
+	// Também entre clocks independentes, sempre que a premissa vale
+	for i := 0; i < propertyCases; i++ {
+		a, b, c := randomClock(r), randomClock(r), randomClock(r)
+		if a.Compare(b) == -1 && b.Compare(c) == -1 && a.Compare(c) != -1 {
+			t.Fatalf("%v < %v < %v but Compare(a, c) = %d", a, b, c, a.Compare(c))
+		}
+	}
+}
+
+func TestIncrementMakesNewer(t *testing.T) {
+	r := rand.New(rand.NewPCG(13, 14))
+	for i := 0; i < propertyCases; i++ {
+		a := randomClock(r)
+		b := clone(a)
+		b.Increment(fmt.Sprintf("node%d", r.IntN(5)))
+		if b.Compare(a) != 1 || a.Compare(b) != -1 {
+			t.Fatalf("incremented %v into %v, Compare = %d", a, b, b.Compare(a))
+		}
+	}
+}
+
+// Monta um Vector Clock a partir de bytes quaisquer: cada trio de bytes é o nó (de um conjunto
+// pequeno), o contador (sempre positivo, como os gerados por Increment) e o horário
+func fuzzClock(data []byte) *VectorClock {
+	vc := NewVectorClock()
+	for ; len(data) >= 3; data = data[3:] {
+		id := fmt.Sprintf("node%d", data[0]%5)
+		vc.Clock[id] = 1 + int(data[1]%16)
+		vc.setUpdated(id, int64(data[2]%4))
+	}
+	return vc
+}
+
+// As propriedades de Compare e Merge valem para clocks quaisquer, não só para os gerados acima
+func FuzzCompareAndMerge(f *testing.F) {
+	f.Add([]byte{}, []byte{}, []byte{})
+	f.Add([]byte{0, 1, 1}, []byte{0, 2, 0}, []byte{0, 3, 2})
+	f.Add([]byte{0, 1, 1, 1, 1, 1}, []byte{1, 1, 1}, []byte{2, 5, 3})
+	f.Add([]byte{0, 3, 2, 1, 1, 0}, []byte{0, 3, 1, 1, 2, 0}, []byte{0, 4, 0, 1, 2, 3})
+
+	f.Fuzz(func(t *testing.T, x, y, z []byte) {
+		a, b, c := fuzzClock(x), fuzzClock(y), fuzzClock(z)
+
+		if ab, ba := a.Compare(b), b.Compare(a); ab != -ba {
+			t.Fatalf("Compare(%v, %v) = %d but Compare(b, a) = %d", a, b, ab, ba)
+		}
+		if got := a.Compare(clone(a)); got != 0 {
+			t.Fatalf("Compare(%v, copy) = %d, want 0", a, got)
+		}
+		if a.Compare(b) == -1 && b.Compare(c) == -1 && a.Compare(c) != -1 {
+			t.Fatalf("%v < %v < %v but Compare(a, c) = %d", a, b, c, a.Compare(c))
+		}
+
+		ab, ba := merged(a, b), merged(b, a)
+		if !sameClock(ab, ba) {
+			t.Fatalf("merge(%v, %v) = %v@%v but merge(b, a) = %v@%v", a, b, ab, ab.Updated, ba, ba.Updated)
+		}
+		if again := merged(ab, b); !sameClock(again, ab) {
+			t.Fatalf("merging %v again changed %v into %v", b, ab, again)
+		}
+		if left, right := merged(merged(a, b), c), merged(a, merged(b, c)); !sameClock(left, right) {
+			t.Fatalf("merge is not associative for %v, %v, %v: %v and %v", a, b, c, left, right)
+		}
+		for _, input := range []*VectorClock{a, b} {
+			if got := ab.Compare(input); got == -1 || got == 0 && !maps.Equal(ab.Clock, input.Clock) {
+				t.Fatalf("merge(%v, %v).Compare(%v) = %d", a, b, input, got)
+			}
+		}
+		if a.Compare(b) == -1 && !maps.Equal(ab.Clock, b.Clock) {
+			t.Fatalf("%v < %v but their merge is %v", a, b, ab)
+		}
+
+		next := clone(ab)
+		next.Increment("node0")
+		if next.Compare(a) != 1 || next.Compare(b) != 1 {
+			t.Fatalf("incremented merge %v is not newer than %v and %v", next, a, b)
+		}
+	})
+}
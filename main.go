@@ -2,108 +2,1478 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"os/exec"
+	"os/signal"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/bquerino/kv-g/internal/config"
+	"github.com/bquerino/kv-g/internal/grpcapi"
+	"github.com/bquerino/kv-g/internal/httpapi"
 	"github.com/bquerino/kv-g/internal/store"
 )
 
+// Logger das mensagens da inicialização e do console
+var logger = store.Logger("main")
+
 func main() {
+	// Com um comando ou --script, executa operações pela API de um nó em vez de subir um nó
+	if isOneShot(os.Args[1:]) {
+		os.Exit(runOneShot(os.Args[1:]))
+	}
+
 	// Parâmetros para porta, ID e modo CLI-only
 	port := flag.String("port", "8081", "Porta para o nó atual")
 	nodeID := flag.String("id", "node1", "ID do nó atual")
+	address := flag.String("address", "", "Endereço anunciado aos pares (host:port); um endereço diferente do registrado na configuração do cluster é gravado e anunciado (padrão: localhost:<port>)")
+	previousID := flag.String("previous-id", "", "ID anterior do nó, para renomeá-lo mantendo os dados e os tokens do anel")
 	cliOnly := flag.Bool("cli-only", false, "Rodar somente o CLI sem o protocolo Gossip")
+	dataDir := flag.String("data-dir", ".", "Diretório de dados do nó (páginas e bucket de sistema gravado pelo kvctl cluster init)")
+	configFile := flag.String("config", "", "Arquivo de configuração (subconjunto de TOML) com as opções deste comando, ex.: http-port = \"7001\"; as opções da linha de comando têm precedência")
+	vNodes := flag.Int("vnodes", 3, "vNodes (tokens no anel) de cada nó; vale para os nós sem tokens na configuração do cluster")
+	gossipInterval := flag.Duration("gossip-interval", 3*time.Second, "Intervalo das rodadas do gossip; o push-pull e o timeout de suspeita partem dele")
+	handoffInterval := flag.Duration("handoff-interval", 5*time.Second, "Intervalo entre as tentativas de entregar os hints aos nós que voltaram")
+	peers := flag.String("peers", "node1=localhost:8081,node2=localhost:8082,node3=localhost:8083", "Membros (<id>=<host:port> separados por vírgula) usados sem a configuração do cluster e sem --seeds; o próprio nó é ignorado")
+	degradation := flag.String("degradation", "", "Comportamento com menos de N réplicas vivas: hint, degrade ou reject (padrão: configuração do cluster)")
+	fanout := flag.Int("gossip-fanout", 0, "Pares contatados por rodada de gossip (0 = adaptativo, log2 do tamanho do cluster)")
+	fixedInterval := flag.Bool("gossip-fixed-interval", false, "Não ajustar o intervalo do gossip ao tamanho do cluster")
+	suspicionTimeout := flag.Duration("suspicion-timeout", 0, "Tempo que um nó suspeito tem para refutar a suspeita antes de ser declarado fora (0 = 5 rodadas de gossip)")
+	phiSuspect := flag.Float64("phi-suspect", store.DefaultPhiSuspect, "Nível de suspeita (phi) a partir do qual um nó passa a ser suspeito")
+	phiDead := flag.Float64("phi-dead", store.DefaultPhiDead, "Nível de suspeita (phi) a partir do qual um nó é declarado fora")
+	defaults := store.DefaultWorkerConfig()
+	flushWorkers := flag.Int("flush-workers", defaults.FlushWorkers, "SSTables gravadas em paralelo num flush grande")
+	compactionWorkers := flag.Int("compaction-workers", defaults.CompactionWorkers, "Compactações de SSTables em paralelo")
+	replicaWorkers := flag.Int("replica-workers", defaults.ReplicaWorkers, "Chamadas simultâneas às réplicas numa escrita")
+	hintWorkers := flag.Int("hint-workers", defaults.HintWorkers, "Entregas simultâneas de hinted handoff")
+	scatterWorkers := flag.Int("scatter-workers", defaults.ScatterWorkers, "Nós consultados ao mesmo tempo por um comando de todo o cluster (scan, export)")
+	scatterTimeout := flag.Duration("scatter-timeout", store.DefaultScatterTimeout, "Prazo de cada nó para responder a um comando de todo o cluster; os que passam dele ficam fora do resultado (0 = sem prazo)")
+	preferPrimary := flag.Bool("prefer-primary", false, "Encaminhar as requisições ao primeiro nó vivo da lista de preferência da chave")
+	replication := flag.Int("n", 0, "Número de réplicas por chave (0 = valor do cluster ou 3)")
+	readQuorum := flag.Int("r", 0, "Réplicas que precisam responder a uma leitura (0 = valor do cluster)")
+	writeQuorum := flag.Int("w", 0, "Réplicas que precisam confirmar uma escrita (0 = valor do cluster)")
+	captureLog := flag.String("capture-log", "", "Arquivo onde as operações de cliente coordenadas pelo nó são gravadas para o kvctl replay (vazio = desativado)")
+	auditLog := flag.String("audit-log", "", "Arquivo onde uma amostra das leituras de clientes é gravada, com a chave e o token de quem leu (vazio = desativado)")
+	auditSampleRate := flag.Float64("audit-sample-rate", store.DefaultAuditSampleRate, "Percentual das leituras de clientes gravadas no -audit-log")
+	auditBuckets := flag.String("audit-buckets", "", "Buckets cujas leituras entram no -audit-log, separados por vírgula (vazio = todos)")
+	conflictSink := flag.String("conflict-sink", "", "Destino dos eventos de conflito: log, file:<caminho> ou webhook:<url> (padrão: nenhum)")
+	conflictResolution := flag.String("conflict-resolution", "siblings", "Estratégia para versões concorrentes: siblings, lww ou merge:<nome> (função registrada com store.RegisterMergeFunc)")
+	maxSiblings := flag.Int("max-siblings", store.DefaultMaxSiblings, "Máximo de versões concorrentes guardadas por chave (0 = sem limite)")
+	siblingOverflow := flag.String("sibling-overflow", string(store.SiblingsResolve), "Escrita que passaria de -max-siblings: resolve (aplica -conflict-resolution, ou lww se ela guarda as irmãs) ou reject (recusa a escrita)")
+	tombstoneGrace := flag.Duration("tombstone-grace", store.DefaultTombstoneGrace, "Tempo que uma remoção (tombstone) é mantida antes de ser descartada (0 = nunca)")
+	grpcPort := flag.String("grpc-port", "", "Porta da API gRPC para aplicações clientes (vazio = desativada)")
+	seeds := flag.String("seeds", "", "Nós (host:port separados por vírgula) contatados para entrar num cluster em execução")
+	joinToken := flag.String("token", "", "Segredo do cluster enviado aos seeds ao entrar no cluster")
+	httpPort := flag.String("http-port", "", "Porta da API HTTP de dados e administração (vazio = desativada)")
+	hintRerouteAfter := flag.Duration("hint-reroute-after", store.DefaultRerouteAfter, "Tempo que um nó com hints pendentes pode ficar fora do anel antes de os hints irem para as réplicas atuais das chaves (0 = nunca)")
+	hintLimit := flag.Int("hint-limit", store.DefaultHintLimit, "Máximo de hints em memória; o excedente fica somente em disco (0 = sem limite)")
+	autoRebalance := flag.Bool("auto-rebalance", true, "Transfere aos novos donos os trechos do anel que mudam de réplicas quando um nó entra ou sai")
+	rebalanceRate := flag.Int("rebalance-rate", 0, "Chaves por segundo enviadas pelo rebalanceamento (0 = sem limite)")
+	clockEntries := flag.Int("clock-entries", store.DefaultClockEntries, "Máximo de nós num Vector Clock; os contadores atualizados há mais tempo são descartados (0 = sem limite)")
+	negativeCacheTTL := flag.Duration("negative-cache-ttl", 0, "Tempo que uma chave não encontrada é lembrada, evitando consultas repetidas ao disco e às réplicas (0 = desativado)")
+	fastAck := flag.Bool("fast-ack", false, "Confirma os PUTs e DELETEs com a consistência padrão depois de gravados no commit log local, replicando-os em segundo plano (a leitura informa se a versão já tem as W confirmações)")
+	staleReads := flag.Bool("stale-reads", true, "Com réplicas da chave fora, serve as leituras (nível padrão ou one) de hints ou cópias guardadas pelo nó, marcadas como possivelmente desatualizadas")
+	warmupRate := flag.Int("warmup-rate", 0, "Chaves por segundo carregadas do disco para a memória na inicialização, das mais lidas antes do último desligamento (0 = sem aquecimento)")
+	maxValueSize := flag.Int("max-value-size", store.DefaultMaxValueSize>>10, fmt.Sprintf("Maior valor aceito numa escrita, em KB (até %d); valores maiores que uma página são gravados em pedaços", store.MaxValueSizeLimit>>10))
+	cacheMemory := flag.Int64("cache-memory", store.DefaultCacheMemory>>20, "Memória (MB) das chaves dos buckets de cache; acima dela as menos usadas são descartadas (0 = sem limite)")
+	gossipTimeouts := flag.String("gossip-timeouts", "", "Timeouts <conexão>,<leitura>,<escrita> do gossip, da entrada no cluster, da eleição e das mudanças de configuração (ex.: 1s,2s,2s; vazio = 2s para todos)")
+	replicaTimeouts := flag.String("replica-timeouts", "", "Timeouts <conexão>,<leitura>,<escrita> das RPCs de réplica: REPLICATE, FETCH, REPAIR, SCAN, FORWARD e MULTI (vazio = 2s para todos)")
+	hintTimeouts := flag.String("hint-timeouts", "", "Timeouts <conexão>,<leitura>,<escrita> da entrega de hints: BATCH e HINT (vazio = 2s para todos)")
+	coldDir := flag.String("cold-dir", "", "Diretório da camada fria, para onde vão as SSTables sem leitura há --cold-after (vazio = desativada)")
+	coldAfter := flag.Duration("cold-after", store.DefaultColdAfter, "Tempo sem leitura depois do qual uma SSTable vai para a camada fria")
+	resolveInterval := flag.Duration("resolve-interval", store.DefaultResolveInterval, "Intervalo entre as resoluções dos nomes dos pares, para acompanhar trocas de IP (0 = desativada)")
+	ringInterval := flag.Duration("ring-interval", store.DefaultRingInterval, "Intervalo entre as verificações da distribuição do anel entre os nós, registrada no log quando o anel muda (0 = desativada)")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 10*time.Second, "Prazo de cada etapa do desligamento: requisições em andamento, loops em segundo plano e conexões dos pares")
+	maxClockSkew := flag.Duration("max-clock-skew", store.DefaultMaxClockSkew, "Diferença entre o relógio de um par e o deste nó a partir da qual ela é alertada (0 = sem alerta)")
+	textProtocol := flag.Bool("text-protocol", false, "Envia as mensagens aos outros nós no protocolo de texto anterior, enquanto houver nós de versões anteriores no cluster")
+	tlsCert := flag.String("tls-cert", "", "Certificado (PEM) do nó; com --tls-key e --tls-ca, as conexões entre nós usam TLS com autenticação mútua e as APIs HTTP e gRPC são servidas com TLS")
+	tlsKey := flag.String("tls-key", "", "Chave privada (PEM) do --tls-cert")
+	tlsCA := flag.String("tls-ca", "", "CA (PEM) do cluster: só pares com certificados emitidos por ela são aceitos")
+	tlsClientAuth := flag.Bool("tls-client-auth", false, "Exige dos clientes das APIs HTTP e gRPC um certificado emitido pela --tls-ca")
+	peerConns := flag.Int("peer-conns", store.DefaultPeerConns, "Conexões persistentes com cada par, cada uma com várias mensagens em andamento (0 = uma conexão por mensagem)")
+	logLevel := flag.String("log-level", "info", "Nível dos logs (debug, info, warn ou error), com níveis por módulo opcionais: ex.: info,gossip=warn,storage=debug (módulos: main, gossip, replication, storage, cluster, http, grpc)")
+	logFormat := flag.String("log-format", "text", "Formato dos logs: text (chave=valor) ou json (uma mensagem JSON por linha)")
+	checkConfig := flag.Bool("check-config", false, "Verifica a configuração (quóruns, portas, diretórios, disco e relógio), mostra o resultado e sai")
 	flag.Parse()
 
-	// Inicializar os nós e a comunicação TCP
-	gossip, err := initializeCluster(*nodeID, *port)
+	// O arquivo de configuração preenche as opções que não vieram na linha de comando
+	if *configFile != "" {
+		if err := config.Apply(flag.CommandLine, *configFile, "config"); err != nil {
+			log.Fatalf("Invalid config file: %v", err)
+		}
+	}
+
+	if err := store.ConfigureLogging(store.LogConfig{Level: *logLevel, Format: *logFormat, NodeID: *nodeID}); err != nil {
+		log.Fatalf("Invalid logging settings: %v", err)
+	}
+
+	// Impedir que outro processo use os mesmos diretórios antes de abrir os dados
+	for _, dir := range []string{*dataDir, *coldDir} {
+		if dir == "" {
+			continue
+		}
+		if err := store.LockDataDir(dir); err != nil {
+			log.Fatalf("Cannot lock directory: %v", err)
+		}
+	}
+
+	if *vNodes < 1 || *gossipInterval <= 0 || *handoffInterval <= 0 {
+		log.Fatalf("Invalid -vnodes, -gossip-interval or -handoff-interval: must be positive (got %d, %s, %s)", *vNodes, *gossipInterval, *handoffInterval)
+	}
+
+	// Inicializar os nós e a comunicação TCP; com seeds, os membros vêm deles
+	seedList := parseSeeds(*seeds)
+	peerList, err := parsePeers(*peers)
+	if err != nil {
+		log.Fatalf("Invalid -peers: %v", err)
+	}
+	if len(seedList) > 0 {
+		peerList = nil
+	}
+	gossip, err := initializeCluster(*nodeID, *port, *address, *previousID, *dataDir, *vNodes, *gossipInterval, peerList)
 	if err != nil {
 		log.Fatalf("Failed to initialize cluster: %v", err)
 	}
+	gossip.KeyValueStore.HandoffInterval = *handoffInterval
+
+	gossip.Fanout = *fanout
+	gossip.AdaptiveInterval = !*fixedInterval
+	if *suspicionTimeout > 0 {
+		gossip.SuspicionTimeout = *suspicionTimeout
+	}
+	if *phiSuspect <= 0 || *phiDead < *phiSuspect {
+		log.Fatalf("Invalid phi thresholds: suspect %.2f, dead %.2f (need 0 < suspect <= dead)", *phiSuspect, *phiDead)
+	}
+	gossip.PhiSuspect, gossip.PhiDead = *phiSuspect, *phiDead
+	gossip.PreferPrimary = *preferPrimary
+	gossip.ResolveInterval = *resolveInterval
+	gossip.RingInterval = *ringInterval
+	if *shutdownTimeout <= 0 {
+		log.Fatalf("Invalid -shutdown-timeout: must be positive (got %s)", *shutdownTimeout)
+	}
+	gossip.MaxClockSkew = *maxClockSkew
+	gossip.TextProtocol = *textProtocol
+	if *peerConns < 0 {
+		log.Fatalf("Invalid -peer-conns: must not be negative (got %d)", *peerConns)
+	}
+	gossip.PeerConns = *peerConns
+	var apiTLS *tls.Config
+	if *tlsCert != "" || *tlsKey != "" || *tlsCA != "" {
+		if gossip.TLS, err = store.LoadTLSConfig(*tlsCert, *tlsKey, *tlsCA); err != nil {
+			log.Fatalf("Invalid TLS settings: %v", err)
+		}
+		apiTLS = gossip.TLS.Clone()
+		if !*tlsClientAuth {
+			apiTLS.ClientAuth = tls.NoClientCert
+		}
+	} else if *tlsClientAuth {
+		log.Fatalf("--tls-client-auth needs --tls-cert, --tls-key and --tls-ca")
+	}
+	for _, t := range []struct {
+		flag, value string
+		target      *store.PeerTimeouts
+	}{
+		{"gossip-timeouts", *gossipTimeouts, &gossip.Timeouts.Gossip},
+		{"replica-timeouts", *replicaTimeouts, &gossip.Timeouts.Replication},
+		{"hint-timeouts", *hintTimeouts, &gossip.Timeouts.Hints},
+	} {
+		if t.value == "" {
+			continue
+		}
+		timeouts, err := store.ParsePeerTimeouts(t.value)
+		if err != nil {
+			log.Fatalf("Invalid -%s: %v", t.flag, err)
+		}
+		*t.target = timeouts
+	}
+
+	workers := store.WorkerConfig{
+		FlushWorkers:      *flushWorkers,
+		CompactionWorkers: *compactionWorkers,
+		ReplicaWorkers:    *replicaWorkers,
+		HintWorkers:       *hintWorkers,
+		ScatterWorkers:    *scatterWorkers,
+	}
+	if err := workers.Validate(); err != nil {
+		log.Fatalf("Invalid worker configuration: %v", err)
+	}
+	gossip.KeyValueStore.Workers = workers
+	gossip.KeyValueStore.HintLimit = *hintLimit
+	gossip.KeyValueStore.RerouteAfter = *hintRerouteAfter
+	gossip.KeyValueStore.ReplayHints()
+	gossip.KeyValueStore.TombstoneGrace = *tombstoneGrace
+	if *replication < 0 || *readQuorum < 0 || *writeQuorum < 0 {
+		log.Fatalf("Invalid quorum settings: -n, -r and -w must not be negative (got %d, %d, %d)", *replication, *readQuorum, *writeQuorum)
+	}
+	gossip.KeyValueStore.ReplicationFactor = *replication
+	gossip.KeyValueStore.ReadQuorum = *readQuorum
+	gossip.KeyValueStore.WriteQuorum = *writeQuorum
+	if *clockEntries < 0 {
+		log.Fatalf("Invalid -clock-entries: must not be negative (got %d)", *clockEntries)
+	}
+	gossip.KeyValueStore.ClockEntries = *clockEntries
+	if *rebalanceRate < 0 {
+		log.Fatalf("Invalid -rebalance-rate: must not be negative (got %d)", *rebalanceRate)
+	}
+	gossip.KeyValueStore.AutoRebalance = *autoRebalance
+	gossip.KeyValueStore.RebalanceRate = *rebalanceRate
+	if *cacheMemory < 0 {
+		log.Fatalf("Invalid -cache-memory: must not be negative (got %d)", *cacheMemory)
+	}
+	gossip.KeyValueStore.CacheMemory = *cacheMemory << 20
+	gossip.KeyValueStore.NegativeCacheTTL = *negativeCacheTTL
+	if *warmupRate < 0 {
+		log.Fatalf("Invalid -warmup-rate: must not be negative (got %d)", *warmupRate)
+	}
+	gossip.KeyValueStore.WarmupRate = *warmupRate
+	if *maxValueSize < 1 || *maxValueSize > store.MaxValueSizeLimit>>10 {
+		log.Fatalf("Invalid -max-value-size: must be between 1 and %d KB (got %d)", store.MaxValueSizeLimit>>10, *maxValueSize)
+	}
+	gossip.KeyValueStore.MaxValueSize = *maxValueSize << 10
+	gossip.KeyValueStore.StaleReads = *staleReads
+	gossip.KeyValueStore.FastAck = *fastAck
+	if *scatterTimeout < 0 {
+		log.Fatalf("Invalid -scatter-timeout: must not be negative (got %s)", *scatterTimeout)
+	}
+	gossip.KeyValueStore.ScatterTimeout = *scatterTimeout
+
+	// Verificar a configuração antes de usá-la, interrompendo a inicialização nos problemas
+	// que fariam o nó falhar em execução
+	check := store.SelfCheckConfig{ColdDir: *coldDir}
+	if !*cliOnly {
+		check.Ports = map[string]string{"http-port": *httpPort, "grpc-port": *grpcPort}
+	}
+	report := gossip.SelfCheck(check)
+	for _, warning := range report.Warnings {
+		logger.Warn("Config warning", "problem", warning)
+	}
+	if *checkConfig {
+		for _, problem := range report.Errors {
+			logger.Error("Config error", "problem", problem)
+		}
+		if len(report.Errors) > 0 {
+			os.Exit(1)
+		}
+		fmt.Println("Configuration OK")
+		os.Exit(0)
+	}
+	if len(report.Errors) > 0 {
+		log.Fatalf("Invalid configuration:\n  %s", strings.Join(report.Errors, "\n  "))
+	}
+
+	if *coldDir != "" {
+		if *coldAfter <= 0 {
+			log.Fatalf("Invalid -cold-after: must be positive (got %s)", *coldAfter)
+		}
+		if err := gossip.KeyValueStore.LSM.SetColdDir(*coldDir); err != nil {
+			log.Fatalf("Invalid -cold-dir: %v", err)
+		}
+		gossip.KeyValueStore.ColdAfter = *coldAfter
+	}
+
+	if *conflictSink != "" {
+		sink, err := store.ParseConflictSink(*conflictSink)
+		if err != nil {
+			log.Fatalf("Invalid -conflict-sink: %v", err)
+		}
+		gossip.KeyValueStore.ConflictSink = sink
+	}
+
+	if *captureLog != "" {
+		capture, err := store.NewCaptureLog(*captureLog)
+		if err != nil {
+			log.Fatalf("Invalid -capture-log: %v", err)
+		}
+		gossip.KeyValueStore.CaptureLog = capture
+	}
+
+	if *auditLog != "" {
+		var buckets []string
+		for _, bucket := range strings.Split(*auditBuckets, ",") {
+			if bucket = strings.TrimSpace(bucket); bucket != "" {
+				buckets = append(buckets, bucket)
+			}
+		}
+		audit, err := store.NewAuditLog(*auditLog, *auditSampleRate, buckets)
+		if err != nil {
+			log.Fatalf("Invalid -audit-log: %v", err)
+		}
+		gossip.KeyValueStore.AuditLog = audit
+	}
+
+	resolver, err := store.ParseConflictResolver(*conflictResolution)
+	if err != nil {
+		log.Fatalf("Invalid -conflict-resolution: %v", err)
+	}
+	gossip.KeyValueStore.ConflictResolver = resolver
+	if *maxSiblings < 0 {
+		log.Fatalf("Invalid -max-siblings: must not be negative (got %d)", *maxSiblings)
+	}
+	gossip.KeyValueStore.MaxSiblings = *maxSiblings
+	overflow, err := store.ParseSiblingOverflow(*siblingOverflow)
+	if err != nil {
+		log.Fatalf("Invalid -sibling-overflow: %v", err)
+	}
+	gossip.KeyValueStore.SiblingOverflow = overflow
+
+	if *degradation != "" {
+		policy, err := store.ParseDegradationPolicy(*degradation)
+		if err != nil {
+			log.Fatalf("Invalid -degradation: %v", err)
+		}
+		gossip.KeyValueStore.Degradation = policy
+	}
+
+	// As escritas com ack rápido que ficaram no commit log voltam à memória e às réplicas
+	if err := gossip.KeyValueStore.ReplayCommitLog(); err != nil {
+		log.Fatalf("Failed to replay the commit log: %v", err)
+	}
+
+	// Os loops em segundo plano e o servidor do gossip terminam quando ctx é cancelado
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// Persistir periodicamente os dados alterados em memória
+	go gossip.KeyValueStore.StartFlusher(ctx)
+	go gossip.KeyValueStore.StartCompactor(ctx)
+	go gossip.KeyValueStore.StartTiering(ctx)
+	go gossip.KeyValueStore.StartTombstoneGC(ctx)
+	go gossip.KeyValueStore.StartCacheEvictor(ctx)
+	go gossip.KeyValueStore.StartWarmup(ctx)
+
+	// O desligamento pelo console ou por SIGINT/SIGTERM encerra as APIs e o nó uma única vez
+	stopper := &nodeStopper{gossip: gossip, cancel: cancel, timeout: *shutdownTimeout}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		logger.Info("Received signal, shutting down", "signal", sig.String())
+		if err := stopper.stop(false); err != nil {
+			logger.Error("Error shutting down", "err", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}()
 
 	// Se não estiver no modo CLI-only, iniciar o protocolo Gossip
 	if !*cliOnly {
 		// Start Gossip Protocol (GossipOut)
-		go gossip.StartGossip()
+		go gossip.StartGossip(ctx)
+
+		// Sincronizar periodicamente o estado completo com um par aleatório (push-pull)
+		go gossip.StartPushPull(ctx)
+
+		// Acompanhar as trocas de IP dos pares configurados por nome
+		go gossip.StartAddressResolver(ctx)
+		go gossip.StartRingStats(ctx)
 
 		// Iniciar servidor para ouvir conexões (GossipIn)
-		go gossip.GossipIn()
+		go gossip.GossipIn(ctx)
+
+		// Sem configuração do cluster, entrar no cluster em execução pelos seeds
+		if config, _ := gossip.Settings(); config == nil && len(seedList) > 0 {
+			if err := gossip.JoinCluster(seedList, *joinToken); err != nil {
+				log.Fatalf("Failed to join cluster: %v", err)
+			}
+		}
+
+		// Reenviar periodicamente os hints para os nós que voltarem
+		go gossip.KeyValueStore.StartHintedHandoff(ctx)
+
+		// Servir a API gRPC para as aplicações, coordenando as requisições recebidas
+		if *grpcPort != "" {
+			server := grpcapi.NewServer(gossip, apiTLS)
+			stopper.apis = append(stopper.apis, server)
+			go func() {
+				if err := server.Serve(*grpcPort); err != nil {
+					log.Fatalf("Failed to serve gRPC API: %v", err)
+				}
+			}()
+		}
+
+		// Servir a API HTTP (chaves e visão do cluster) para scripts e dashboards
+		if *httpPort != "" {
+			server := httpapi.NewServer(gossip, apiTLS)
+			stopper.apis = append(stopper.apis, server)
+			go func() {
+				if err := server.Serve(*httpPort); err != nil {
+					log.Fatalf("Failed to serve HTTP API: %v", err)
+				}
+			}()
+		}
+
+		// Decidir uma mudança de configuração que estava preparada no último restart
+		if err := gossip.ResumePendingSetting(); err != nil {
+			logger.Error("Failed to resume setting change", "err", err)
+		}
+
+		// Retomar os jobs (rebalanceamento, migrações...) interrompidos pelo último restart
+		if err := gossip.KeyValueStore.Jobs.ResumeAll(); err != nil {
+			logger.Error("Failed to resume jobs", "err", err)
+		}
 	}
 
-	// CLI interativa
-	runCLI(gossip)
+	// CLI interativa; o exit só retorna depois do desligamento
+	runCLI(gossip, stopper)
+	if stopper.err != nil {
+		os.Exit(1)
+	}
+}
+
+// apiServer é um servidor de API encerrado no desligamento do nó
+type apiServer interface {
+	Shutdown(timeout time.Duration) error
 }
 
-func initializeCluster(nodeID, port string) (*store.Gossip, error) {
-	address := fmt.Sprintf("localhost:%s", port)
+// nodeStopper desliga o nó uma única vez, pelo console ou por um sinal
+type nodeStopper struct {
+	gossip  *store.Gossip
+	apis    []apiServer
+	cancel  context.CancelFunc // Cancela o contexto dos loops e do gossip depois do desligamento
+	timeout time.Duration
+	once    sync.Once
+	err     error
+}
 
-	gossip := store.NewGossip(nodeID, address, 3*time.Second, 3)
+// Encerra as APIs, esperando as requisições em andamento, e desliga o nó; com decommission, o
+// nó transfere os trechos dele e sai do anel. Por fim cancela o contexto das goroutines em
+// segundo plano. Chamadas seguintes esperam a primeira terminar.
+func (s *nodeStopper) stop(decommission bool) error {
+	s.once.Do(func() {
+		for _, api := range s.apis {
+			if err := api.Shutdown(s.timeout); err != nil {
+				logger.Warn("API shutdown incomplete", "err", err)
+			}
+		}
+		if decommission {
+			s.err = s.gossip.Decommission(s.timeout)
+		} else {
+			s.err = s.gossip.Shutdown(s.timeout)
+		}
+		s.cancel()
+	})
+	return s.err
+}
 
-	// Adicionar todos os nós ao cluster
-	if nodeID == "node1" {
-		gossip.AddNode("node2", "localhost:8082")
-		gossip.AddNode("node3", "localhost:8083")
-	} else if nodeID == "node2" {
-		gossip.AddNode("node1", "localhost:8081")
-		gossip.AddNode("node3", "localhost:8083")
-	} else if nodeID == "node3" {
-		gossip.AddNode("node1", "localhost:8081")
-		gossip.AddNode("node2", "localhost:8082")
+// Separa a lista de seeds do flag -seeds
+func parseSeeds(list string) []string {
+	var seeds []string
+	for _, seed := range strings.Split(list, ",") {
+		if seed = strings.TrimSpace(seed); seed != "" {
+			seeds = append(seeds, seed)
+		}
+	}
+	return seeds
+}
+
+func initializeCluster(nodeID, port, address, previousID, dataDir string, vNodes int, interval time.Duration, peers []staticPeer) (*store.Gossip, error) {
+	advertised := address
+	if advertised == "" {
+		advertised = fmt.Sprintf("localhost:%s", port)
+	}
+
+	gossip := store.NewGossip(nodeID, advertised, interval, vNodes, dataDir)
+
+	// Se o cluster foi inicializado pelo kvctl, usar a configuração do bucket de sistema
+	config, err := store.LoadClusterConfig(dataDir)
+	if err == nil {
+		// Uma troca de endereço ou de ID é gravada na configuração e anunciada aos pares
+		relocated := address != "" || previousID != ""
+		if relocated {
+			if config, err = config.Relocate(nodeID, previousID, address); err != nil {
+				return nil, err
+			}
+			if err := config.Save(dataDir); err != nil {
+				return nil, err
+			}
+		}
+		gossip.ApplyClusterConfig(config)
+		logger.Info("Loaded cluster config", "nodes", len(config.Nodes), "n", config.N, "r", config.R, "w", config.W)
+		if relocated {
+			gossip.AnnounceRelocation()
+		}
+		return gossip, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if previousID != "" {
+		return nil, fmt.Errorf("-previous-id needs the cluster config (run kvctl cluster init)")
+	}
+
+	// Sem configuração, usar os membros de --peers (com seeds, a lista vem vazia e os membros são
+	// obtidos dos seeds depois que o servidor do Gossip começa a ouvir)
+	for _, peer := range peers {
+		if peer.ID != nodeID {
+			gossip.AddNode(peer.ID, peer.Address)
+		}
 	}
 
 	return gossip, nil
 }
 
+// staticPeer é um membro da lista de --peers
+type staticPeer struct {
+	ID      string
+	Address string
+}
+
+// Separa a lista de membros do flag -peers (<id>=<host:port> separados por vírgula)
+func parsePeers(list string) ([]staticPeer, error) {
+	var peers []staticPeer
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		id, address, ok := strings.Cut(entry, "=")
+		if !ok || id == "" || address == "" {
+			return nil, fmt.Errorf("invalid peer %q (use <id>=<host:port>)", entry)
+		}
+		peers = append(peers, staticPeer{ID: id, Address: address})
+	}
+	return peers, nil
+}
+
 // Função que inicia a interface CLI interativa
-func runCLI(gossip *store.Gossip) {
+func runCLI(gossip *store.Gossip, stopper *nodeStopper) {
 	reader := bufio.NewReader(os.Stdin)
 	fmt.Println("Welcome to the KV Store CLI!")
 	fmt.Println("-----------------------------")
 
 	for {
 		fmt.Print("> ")
-		input, _ := reader.ReadString('\n')
+		input, err := reader.ReadString('\n')
+		if err != nil && input == "" {
+			// Sem console (stdin fechado, como num serviço), o nó roda até receber SIGINT ou SIGTERM
+			logger.Info("Console input closed, running until SIGINT or SIGTERM")
+			select {}
+		}
 		input = strings.TrimSpace(input)
 		args := strings.Split(input, " ")
 
 		switch args[0] {
 		case "put":
-			if len(args) != 3 {
-				fmt.Println("Usage: put <key> <value>")
+			level, rest, err := parseConsistencyFlag(args[1:])
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
 				continue
 			}
-			key, value := args[1], args[2]
-			gossip.Put(key, value)
-		case "get":
-			if len(args) != 2 {
-				fmt.Println("Usage: get <key>")
+			if len(rest) != 2 {
+				fmt.Println("Usage: put [-c one|quorum|all] <key> <value>")
 				continue
 			}
-			key := args[1]
-			value, vc, found := gossip.Get(key)
-			if found {
-				fmt.Printf("Value: %s, VectorClock: %v\n", value, vc)
-			} else {
-				fmt.Println("Key not found.")
+			key, value := rest[0], rest[1]
+			result, err := gossip.Put(key, value, level)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				continue
+			}
+			printWriteResult(gossip, result)
+		case "resolve":
+			level, rest, err := parseConsistencyFlag(args[1:])
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				continue
+			}
+			if len(rest) != 2 {
+				fmt.Println("Usage: resolve [-c one|quorum|all] <key> <value>")
+				continue
+			}
+			result, err := gossip.KeyValueStore.Resolve(rest[0], rest[1], level)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				continue
 			}
+			printWriteResult(gossip, result)
+		case "get":
+			runGetCommand(gossip, args[1:])
+		case "cas":
+			runCASCommand(gossip, args[1:])
+		case "edit":
+			runEditCommand(gossip, args[1:])
+		case "mput", "mget", "mdelete":
+			runBatchCommand(gossip, args[0], args[1:])
+		case "scan":
+			runScanCommand(gossip, args[1:])
+		case "range":
+			runRangeCommand(gossip, args[1:])
+		case "delprefix":
+			runDeletePrefixCommand(gossip, args[1:])
 		case "delete":
-			if len(args) != 2 {
-				fmt.Println("Usage: delete <key>")
+			level, rest, err := parseConsistencyFlag(args[1:])
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				continue
+			}
+			if len(rest) != 1 {
+				fmt.Println("Usage: delete [-c one|quorum|all] <key>")
+				continue
+			}
+			result, err := gossip.Delete(rest[0], level)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
 				continue
 			}
-			key := args[1]
-			gossip.Delete(key)
+			printWriteResult(gossip, result)
 		case "nodes":
 			gossip.PrintNodes()
+		case "routing":
+			runRoutingCommand(gossip)
+		case "ring":
+			runRingCommand(gossip)
+		case "health":
+			runHealthCommand(gossip)
+		case "verify":
+			runVerifyCommand(gossip)
+		case "jobs":
+			runJobsCommand(gossip, args[1:])
+		case "migrate":
+			runMigrateCommand(gossip, args[1:])
+		case "defrag":
+			runDefragCommand(gossip, args[1:])
+		case "tier":
+			runTierCommand(gossip, args[1:])
+		case "export":
+			runExportCommand(gossip, args[1:])
+		case "snapshot":
+			runSnapshotCommand(gossip, args[1:])
+		case "promote":
+			runPromoteCommand(gossip, args[1:])
+		case "rebalance":
+			runRebalanceCommand(gossip, args[1:])
+		case "settings":
+			runSettingsCommand(gossip, args[1:])
+		case "bucket":
+			runBucketCommand(gossip, args[1:])
+		case "token":
+			runTokenCommand(gossip, args[1:])
 		case "exit":
 			fmt.Println("Exiting...")
+			if err := stopper.stop(false); err != nil {
+				logger.Error("Error shutting down", "err", err)
+			}
+			return
+		case "decommission":
+			if err := gossip.CheckDecommission(); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				continue
+			}
+			fmt.Println("Decommissioning: transferring this node's ranges and leaving the ring...")
+			if err := stopper.stop(true); err != nil {
+				logger.Error("Error decommissioning", "err", err)
+			}
 			return
 		default:
-			fmt.Println("Unknown command. Available commands: put, get, delete, nodes, exit")
+			fmt.Println("Unknown command. Available commands: put, get, resolve, cas, edit, scan, range, delete, delprefix, mput, mget, mdelete, nodes, health, verify, routing, ring, rebalance, defrag, tier, migrate, export, snapshot, jobs, settings, bucket, token, promote, decommission, exit")
+		}
+	}
+}
+
+// Retira do início dos argumentos o nível de consistência ("-c <nível>"), se houver
+func parseConsistencyFlag(args []string) (store.ConsistencyLevel, []string, error) {
+	if len(args) >= 2 && args[0] == "-c" {
+		level, err := store.ParseConsistencyLevel(args[1])
+		return level, args[2:], err
+	}
+	return store.ConsistencyDefault, args, nil
+}
+
+// Mostra quantas réplicas gravaram uma escrita e quem a coordenou, se não foi este nó
+func printWriteResult(gossip *store.Gossip, result *store.PutResult) {
+	if result.Coordinator != gossip.Self.ID {
+		fmt.Printf("OK (%s, coordinated by %s)\n", result, result.Coordinator)
+		return
+	}
+	fmt.Printf("OK (%s)\n", result)
+}
+
+// Grava a chave só se a versão atual satisfaz a condição: cas <chave> <valor> value=<valor>|clock=<vc>|absent
+func runCASCommand(gossip *store.Gossip, args []string) {
+	level, args, err := parseConsistencyFlag(args)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	if len(args) != 3 {
+		fmt.Println("Usage: cas [-c one|quorum|all] <key> <value> value=<expected>|clock=<node>=<counter>,...|absent")
+		return
+	}
+	cond, err := store.ParseCASCondition(args[2])
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+
+	result, err := gossip.CompareAndSwap(args[0], args[1], cond, level)
+	var conflict *store.CASConflictError
+	switch {
+	case errors.As(err, &conflict) && conflict.Current.Found:
+		fmt.Printf("Not written: current value is %s, VectorClock %s\n", conflict.Current.Value, store.FormatVectorClock(conflict.Current.VectorClock))
+	case errors.As(err, &conflict):
+		fmt.Println("Not written: the key does not exist")
+	case err != nil:
+		fmt.Printf("Error: %v\n", err)
+	default:
+		printWriteResult(gossip, result)
+	}
+}
+
+// Abre o valor da chave no $EDITOR e grava o resultado com um compare-and-swap sobre a versão
+// lida: se a chave mudou enquanto o editor estava aberto, nada é gravado e o conflito é mostrado
+func runEditCommand(gossip *store.Gossip, args []string) {
+	level, args, err := parseConsistencyFlag(args)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	if len(args) != 1 {
+		fmt.Println("Usage: edit [-c one|quorum|all] <key>")
+		return
+	}
+	key := args[0]
+
+	current, err := gossip.Get(key, level)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	if len(current.Siblings) > 0 {
+		fmt.Printf("Key %s has %d concurrent versions; merge them with resolve before editing\n", key, len(current.Siblings))
+		return
+	}
+	cond := store.CASCondition{Absent: true}
+	if current.Found {
+		cond = store.CASCondition{VectorClock: current.VectorClock}
+	}
+
+	edited, err := editText(current.Value)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	switch {
+	case edited == current.Value:
+		fmt.Println("No changes.")
+		return
+	case edited == "":
+		fmt.Printf("Not written: the value is empty (remove the key with: delete %s)\n", key)
+		return
+	}
+
+	result, err := gossip.CompareAndSwap(key, edited, cond, level)
+	var conflict *store.CASConflictError
+	switch {
+	case errors.As(err, &conflict) && conflict.Current.Found:
+		fmt.Printf("Conflict: key %s changed while it was being edited; current value is %s, VectorClock %s. Nothing was written.\n", key, conflict.Current.Value, store.FormatVectorClock(conflict.Current.VectorClock))
+	case errors.As(err, &conflict):
+		fmt.Printf("Conflict: key %s was removed while it was being edited. Nothing was written.\n", key)
+	case err != nil:
+		fmt.Printf("Error: %v\n", err)
+	default:
+		printWriteResult(gossip, result)
+	}
+}
+
+// Abre o texto num arquivo temporário no editor do usuário ($VISUAL, $EDITOR ou vi) e retorna o
+// conteúdo salvo, sem as quebras de linha do final
+func editText(text string) (string, error) {
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = "vi"
+	}
+	file, err := os.CreateTemp("", "kvg-edit-*.txt")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(file.Name())
+	_, err = file.WriteString(text + "\n")
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// O editor pode ter argumentos (ex.: "code --wait")
+	parts := strings.Fields(editor)
+	cmd := exec.Command(parts[0], append(parts[1:], file.Name())...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("editor %s failed: %w", editor, err)
+	}
+	data, err := os.ReadFile(file.Name())
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// Grava, lê ou remove várias chaves de uma vez: mput k1=v1 k2=v2, mget k1 k2, mdelete k1 k2
+func runBatchCommand(gossip *store.Gossip, command string, args []string) {
+	level, args, err := parseConsistencyFlag(args)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	if len(args) == 0 {
+		if command == "mput" {
+			fmt.Println("Usage: mput [-c one|quorum|all] <key>=<value> [<key>=<value> ...]")
+		} else {
+			fmt.Printf("Usage: %s [-c one|quorum|all] <key> [<key> ...]\n", command)
+		}
+		return
+	}
+
+	switch command {
+	case "mget":
+		for _, result := range gossip.MGet(args, level) {
+			switch {
+			case result.Err != nil:
+				fmt.Printf("%s: Error: %v\n", result.Key, result.Err)
+			case !result.Result.Found:
+				fmt.Printf("%s: not found%s\n", result.Key, staleNote(result.Result))
+			case len(result.Result.Siblings) > 0:
+				fmt.Printf("%s: %s (%d concurrent versions)%s\n", result.Key, result.Result.Value, len(result.Result.Siblings), staleNote(result.Result))
+			default:
+				fmt.Printf("%s: %s%s\n", result.Key, result.Result.Value, staleNote(result.Result))
+			}
+		}
+		return
+	case "mput":
+		entries := make([]store.KeyValue, len(args))
+		for i, arg := range args {
+			key, value, ok := strings.Cut(arg, "=")
+			if !ok {
+				fmt.Printf("Error: %q is not <key>=<value>\n", arg)
+				return
+			}
+			entries[i] = store.KeyValue{Key: key, Value: value}
 		}
+		printBatchWrites(gossip, gossip.MPut(entries, level))
+	case "mdelete":
+		printBatchWrites(gossip, gossip.MDelete(args, level))
+	}
+}
+
+// Marca uma leitura servida de dados guardados para réplicas fora
+func staleNote(result *store.GetResult) string {
+	if result.Stale {
+		return " (possibly stale)"
+	}
+	return ""
+}
+
+// Mostra o resultado de cada chave de um mput ou mdelete
+func printBatchWrites(gossip *store.Gossip, results []store.BatchWrite) {
+	failed := 0
+	for _, result := range results {
+		if result.Err != nil {
+			failed++
+			fmt.Printf("%s: Error: %v\n", result.Key, result.Err)
+			continue
+		}
+		fmt.Printf("%s: ", result.Key)
+		printWriteResult(gossip, result.Result)
+	}
+	fmt.Printf("%d of %d keys written\n", len(results)-failed, len(results))
+}
+
+// Lê uma chave; com --verbose, mostra também como a leitura foi atendida
+func runGetCommand(gossip *store.Gossip, args []string) {
+	verbose := len(args) > 0 && args[0] == "--verbose"
+	if verbose {
+		args = args[1:]
+	}
+	level, args, err := parseConsistencyFlag(args)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	if len(args) != 1 {
+		fmt.Println("Usage: get [--verbose] [-c one|quorum|all] <key>")
+		return
+	}
+
+	result, err := gossip.Get(args[0], level)
+	switch {
+	case err != nil:
+		fmt.Printf("Error: %v\n", err)
+		return
+	case result.Found:
+		fmt.Printf("Value: %s, VectorClock: %v\n", result.Value, result.VectorClock)
+	default:
+		fmt.Println("Key not found.")
+	}
+	if result.Stale {
+		fmt.Println("Possibly stale: replicas of the key are down and the answer came from data held for them (hints or leftover copies).")
+	}
+	if len(result.Siblings) > 0 {
+		fmt.Printf("%d concurrent versions (merge them with: resolve %s <value>):\n", len(result.Siblings), result.Key)
+		for _, sibling := range result.Siblings {
+			if sibling.Deleted() {
+				fmt.Printf("  (deleted), VectorClock: %v\n", sibling.VectorClock)
+			} else {
+				fmt.Printf("  Value: %s, VectorClock: %v\n", sibling.Value, sibling.VectorClock)
+			}
+		}
+	}
+
+	if verbose {
+		fmt.Printf("Coordinator: %s\n", result.Coordinator)
+		if result.Found {
+			fmt.Printf("Served by: %s\n", result.ServedBy)
+			if result.WrittenAt.IsZero() {
+				fmt.Println("Written at: unknown")
+			} else {
+				fmt.Printf("Written at: %s (%s ago)\n", result.WrittenAt.Format(time.RFC3339Nano), time.Since(result.WrittenAt).Round(time.Millisecond))
+			}
+		}
+		fmt.Printf("Consistency: %s\n", result.Consistency())
+	}
+}
+
+// Lista as chaves com o prefixo: scan [--page <token>] <prefixo> [limite] [filtro]
+func runScanCommand(gossip *store.Gossip, args []string) {
+	token := ""
+	if len(args) >= 2 && args[0] == "--page" {
+		token, args = args[1], args[2:]
+	}
+	if len(args) < 1 || len(args) > 3 {
+		fmt.Println("Usage: scan [--page <token>] <prefix> [limit] [contains:<text>|json:<field>=<value>]")
+		return
+	}
+	limit := 0
+	if len(args) > 1 {
+		var err error
+		if limit, err = strconv.Atoi(args[1]); err != nil || limit < 0 {
+			fmt.Printf("Invalid limit %q\n", args[1])
+			return
+		}
+	}
+	var filter *store.ScanFilter
+	if len(args) > 2 {
+		var err error
+		if filter, err = store.ParseScanFilter(args[2]); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+	}
+	cursor, err := store.ParseScanToken(token, args[0], filter)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+
+	page, err := gossip.KeyValueStore.Scan(args[0], limit, filter, cursor)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	printScanPage(page, filter, "scan", args)
+}
+
+// Lê as chaves do intervalo [start, end) em ordem; "-" como fim vai até a última chave
+func runRangeCommand(gossip *store.Gossip, args []string) {
+	token := ""
+	if len(args) >= 2 && args[0] == "--page" {
+		token, args = args[1], args[2:]
+	}
+	if len(args) < 2 || len(args) > 4 {
+		fmt.Println("Usage: range [--page <token>] <start> <end|-> [limit] [contains:<text>|json:<field>=<value>]")
+		return
+	}
+	start, end := args[0], args[1]
+	if end == "-" {
+		end = ""
+	}
+	limit := 0
+	if len(args) > 2 {
+		var err error
+		if limit, err = strconv.Atoi(args[2]); err != nil || limit < 0 {
+			fmt.Printf("Invalid limit %q\n", args[2])
+			return
+		}
+	}
+	var filter *store.ScanFilter
+	if len(args) > 3 {
+		var err error
+		if filter, err = store.ParseScanFilter(args[3]); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+	}
+	cursor, err := store.ParseScanRangeToken(token, start, end, filter)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+
+	page, err := gossip.KeyValueStore.ScanRange(start, end, limit, filter, cursor)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	printScanPage(page, filter, "range", args)
+}
+
+// Remove do cluster as chaves com o prefixo; com --dry-run só conta as que seriam removidas
+func runDeletePrefixCommand(gossip *store.Gossip, args []string) {
+	dryRun := len(args) == 2 && args[0] == "--dry-run"
+	if dryRun {
+		args = args[1:]
+	}
+	if len(args) != 1 {
+		fmt.Println("Usage: delprefix [--dry-run] <prefix>")
+		return
+	}
+	result, err := gossip.KeyValueStore.DeletePrefix(args[0], dryRun)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	if result.DryRun {
+		fmt.Printf("Dry run: %d key(s) with prefix %s would be deleted on %d node(s): %s\n", result.Keys, result.Prefix, len(result.Nodes), strings.Join(result.Nodes, ", "))
+	} else {
+		fmt.Printf("Prefix %s deleted up to %s on %d node(s): %s\n", result.Prefix, result.At.Format(time.RFC3339Nano), len(result.Nodes), strings.Join(result.Nodes, ", "))
+	}
+	if len(result.Failed) > 0 {
+		fmt.Printf("Partial result: %d node(s) did not answer: %s\n", len(result.Failed), store.FormatNodeFailures(result.Failed))
+	}
+}
+
+// Mostra uma página de scan e, se houver, o comando da próxima página
+func printScanPage(page *store.ScanPage, filter *store.ScanFilter, command string, args []string) {
+	for _, result := range page.Results {
+		fmt.Printf("%s = %s (from %s)\n", result.Key, result.Value, result.ServedBy)
+	}
+	fmt.Printf("%d key(s), filter: %s\n", len(page.Results), filter)
+	if len(page.Failed) > 0 {
+		fmt.Printf("Partial result: %d node(s) did not answer: %s\n", len(page.Failed), store.FormatNodeFailures(page.Failed))
+	}
+	if page.Next != nil {
+		fmt.Printf("Next page: %s --page %s %s\n", command, page.Next.Token(), strings.Join(args, " "))
+	}
+}
+
+// Mostra os sinais de saúde do cluster e o veredito OK/DEGRADED/CRITICAL na última linha
+func runHealthCommand(gossip *store.Gossip) {
+	report := gossip.Health()
+
+	fmt.Printf("Nodes down: %d %v\n", len(report.NodesDown), report.NodesDown)
+	fmt.Printf("Ranges: %d, without read quorum: %d, without write quorum: %d, under-replicated: %d\n",
+		report.Ranges, len(report.NoReadQuorum), len(report.NoWriteQuorum), report.UnderReplicated)
+	fmt.Printf("Hint backlog: %d (%d in memory, %d on disk, limit %d, spilled %d, limit reached %d times)\n",
+		report.HintBacklog, report.Hints.InMemory, report.Hints.OnDisk, report.Hints.Limit, report.Hints.Spilled, report.Hints.CapHits)
+	fmt.Printf("Ranges needing repair: %d\n", len(report.NeedRepair))
+	fmt.Printf("SSTables: %d (%d records, %d KB), bloom filters: %d KB, %d lookups skipped\n",
+		report.Storage.Tables, report.Storage.Records, report.Storage.Bytes>>10, report.Storage.FilterBytes>>10, report.Storage.Skipped)
+	fmt.Printf("Cold tier: %d SSTables (%d KB), %d moved since start\n",
+		report.Storage.ColdTables, report.Storage.ColdBytes>>10, report.Storage.Moved)
+	fmt.Printf("Peer message panics: %d\n", report.HandlerPanics)
+	if report.Disk != nil {
+		fmt.Printf("Disk: %.1f%% used, %d MB free\n", report.Disk.UsedFraction()*100, report.Disk.Free>>20)
+	} else {
+		fmt.Println("Disk: unknown")
+	}
+	for _, issue := range report.Issues {
+		fmt.Printf("  - %s\n", issue)
+	}
+	fmt.Println(report.Status)
+}
+
+// Confere os checksums das páginas dos hints e dos registros das SSTables e mostra os corrompidos
+func runVerifyCommand(gossip *store.Gossip) {
+	report := gossip.KeyValueStore.Verify()
+	for _, entry := range report.Corrupt {
+		if entry.Page >= 0 {
+			fmt.Printf("Corrupt page %d of %s (keys: %s): %s\n", entry.Page, entry.Path, strings.Join(entry.Keys, ", "), entry.Error)
+		} else {
+			fmt.Printf("Corrupt record of %s (key %s): %s\n", entry.Path, strings.Join(entry.Keys, ", "), entry.Error)
+		}
+	}
+	fmt.Printf("Checked %d hint pages and %d SSTable records: %d corrupt\n", report.Pages, report.Records, len(report.Corrupt))
+}
+
+// Mostra a carga de coordenação por nó e a posição dos coordenadores nas listas de preferência
+func runRoutingCommand(gossip *store.Gossip) {
+	stats := gossip.RoutingStats()
+
+	ids := make([]string, 0, len(stats.Load))
+	for id := range stats.Load {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		load := stats.Load[id]
+		fmt.Printf("Node %s coordinated %d puts, %d gets\n", id, load.Puts, load.Gets)
+	}
+	fmt.Printf("Coordinator position: %d primary, %d other replica, %d not a replica\n", stats.Primary, stats.Replica, stats.NonReplica)
+	fmt.Printf("Forwarded: %d (%d fell back to local), coordinated for other nodes: %d\n", stats.Forwarded, stats.Fallbacks, stats.Received)
+}
+
+// Mostra a distribuição do anel entre os nós
+func runRingCommand(gossip *store.Gossip) {
+	stats := gossip.RingStats()
+	for _, node := range stats.Nodes {
+		fmt.Printf("Node %s: %d vnodes, primary %.1f%%, replica %.1f%%, largest range %.1f%%\n",
+			node.ID, node.Tokens, node.Primary*100, node.Replica*100, node.LargestRange*100)
+	}
+	fmt.Printf("Ring epoch %d, N=%d: %s\n", stats.Epoch, stats.N, stats)
+	for _, promoted := range stats.Promoted {
+		fmt.Printf("Range %s: primary promoted to %s\n", promoted.Range, promoted.NodeID)
+	}
+}
+
+// Inicia um rebalanceamento ou mostra o progresso do que está em andamento
+func runRebalanceCommand(gossip *store.Gossip, args []string) {
+	kv := gossip.KeyValueStore
+
+	if len(args) == 1 && args[0] == "status" {
+		plan, err := kv.RebalanceStatus()
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		if plan == nil {
+			fmt.Println("No rebalance in progress.")
+			return
+		}
+		for _, task := range plan.Tasks {
+			state := "pending"
+			if task.Done {
+				state = "done"
+			}
+			fmt.Printf("Range %s -> %s: %s, %d keys transferred\n", task.Range, task.TargetID, state, task.Transferred)
+		}
+		return
+	}
+	if len(args) != 0 {
+		fmt.Println("Usage: rebalance [status]")
+		return
+	}
+
+	startJob(gossip, "rebalance")
+}
+
+// Mostra a configuração do cluster ou propõe a mudança de uma configuração a todos os nós
+func runSettingsCommand(gossip *store.Gossip, args []string) {
+	usage := fmt.Sprintf("Usage: settings | settings set <%s> <value>", strings.Join(store.SettingNames(), "|"))
+
+	if len(args) == 0 {
+		config, pending := gossip.Settings()
+		if config == nil {
+			fmt.Println("Cluster not initialized.")
+			return
+		}
+		fmt.Printf("Config epoch %d: n=%d r=%d w=%d degradation=%s\n", config.Epoch, config.N, config.R, config.W, config.Degradation)
+		fmt.Printf("Routing by %s\n", config.Routing)
+		if config.Export != nil {
+			window, _ := store.ParseTimeWindow(config.Export.Window)
+			rate := "unlimited"
+			if config.Export.Rate > 0 {
+				rate = fmt.Sprintf("%d keys/s", config.Export.Rate)
+			}
+			fmt.Printf("Exports: %s, %s\n", rate, window)
+		}
+		if len(config.Caches) > 0 {
+			fmt.Printf("Cache buckets: %s\n", strings.Join(config.Caches, ", "))
+		}
+		if len(config.APITokens) > 0 {
+			fmt.Printf("API tokens: %d (see token list)\n", len(config.APITokens))
+		}
+		for _, name := range sortedKeys(config.Buckets) {
+			state := config.Buckets[name]
+			action := "truncated"
+			if state.Dropped {
+				action = "dropped"
+			}
+			fmt.Printf("Bucket %s %s at %s\n", name, action, state.At.Format(time.RFC3339))
+		}
+		if pending != nil {
+			fmt.Printf("Pending: %s=%s for epoch %d, proposed by %s\n", pending.Name, pending.Value, pending.Epoch, pending.Coordinator)
+		}
+		return
+	}
+	if len(args) != 3 || args[0] != "set" {
+		fmt.Println(usage)
+		return
+	}
+
+	epoch, err := gossip.ProposeSetting(args[1], args[2])
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	fmt.Printf("OK (%s=%s on every node, config epoch %d)\n", args[1], args[2], epoch)
+}
+
+// Remove um bucket ou todas as chaves dele em todos os nós, ou troca o modo do bucket entre
+// cache (só na memória, com descarte LRU) e durável
+func runBucketCommand(gossip *store.Gossip, args []string) {
+	usage := "Usage: bucket drop|truncate|cache|durable <name>"
+	if len(args) != 2 {
+		fmt.Println(usage)
+		return
+	}
+
+	switch args[0] {
+	case "drop", "truncate":
+		drop := gossip.DropBucket
+		if args[0] == "truncate" {
+			drop = gossip.TruncateBucket
+		}
+		epoch, err := drop(args[1])
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		fmt.Printf("OK (bucket %s %s committed at config epoch %d, cleanup running on every node)\n", args[0], args[1], epoch)
+	case "cache", "durable":
+		change, mode := gossip.CacheBucket, "a cache"
+		if args[0] == "durable" {
+			change, mode = gossip.DurableBucket, "durable"
+		}
+		epoch, err := change(args[1])
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		fmt.Printf("OK (bucket %s is now %s on every node, config epoch %d)\n", args[1], mode, epoch)
+	default:
+		fmt.Println(usage)
+	}
+}
+
+// Cria, lista ou revoga os tokens dos clientes das APIs em todos os nós. As regras são
+// "<prefixo>=<r|w|d>" separadas por vírgulas (ex.: orders/=rw,reports/=r) ou "admin".
+func runTokenCommand(gossip *store.Gossip, args []string) {
+	usage := "Usage: token list | token create <name> admin|<prefix>=<r|w|d>[,...] | token revoke <name>"
+	switch {
+	case len(args) == 1 && args[0] == "list":
+		tokens := gossip.Tokens()
+		if len(tokens) == 0 {
+			fmt.Println("No tokens: API authentication is disabled.")
+			return
+		}
+		for _, token := range tokens {
+			rules := store.FormatACLRules(token.Rules)
+			if token.Admin {
+				rules = "admin"
+			}
+			fmt.Printf("%s: %s (created %s)\n", token.Name, rules, token.CreatedAt.Format(time.RFC3339))
+		}
+	case len(args) == 3 && args[0] == "create":
+		admin := args[2] == "admin"
+		var rules []store.ACLRule
+		if !admin {
+			var err error
+			if rules, err = store.ParseACLRules(args[2]); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+		}
+		secret, epoch, err := gossip.CreateToken(args[1], admin, rules)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		fmt.Printf("OK (token %s created on every node, config epoch %d)\n", args[1], epoch)
+		fmt.Printf("Secret: %s\n", secret)
+		fmt.Println("Store it now: it cannot be shown again.")
+	case len(args) == 2 && args[0] == "revoke":
+		epoch, err := gossip.RevokeToken(args[1])
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		fmt.Printf("OK (token %s revoked on every node, config epoch %d)\n", args[1], epoch)
+	default:
+		fmt.Println(usage)
+	}
+}
+
+// Retorna as chaves de um mapa em ordem
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Reescreve o arquivo de páginas recuperando o espaço das versões antigas
+func runDefragCommand(gossip *store.Gossip, args []string) {
+	if len(args) > 1 {
+		fmt.Println("Usage: defrag [keys-per-second]")
+		return
+	}
+	if len(args) == 1 {
+		if n, err := strconv.Atoi(args[0]); err != nil || n < 0 {
+			fmt.Println("Usage: defrag [keys-per-second]")
+			return
+		}
+	}
+	startJob(gossip, "defrag", args...)
+}
+
+// Mostra as SSTables de cada camada de armazenamento e a política da camada fria
+func runTierCommand(gossip *store.Gossip, args []string) {
+	if len(args) != 1 || args[0] != "status" {
+		fmt.Println("Usage: tier status")
+		return
+	}
+	kv := gossip.KeyValueStore
+	for _, tier := range kv.LSM.Tiers() {
+		fmt.Printf("Tier %s: %s, %d SSTables (%d records, %d KB)", tier.Name, tier.Dir, tier.Tables, tier.Records, tier.Bytes>>10)
+		if !tier.LastUsed.IsZero() {
+			fmt.Printf(", least recently read %s ago", time.Since(tier.LastUsed).Round(time.Second))
+		}
+		fmt.Println()
+	}
+	if kv.ColdAfter > 0 {
+		fmt.Printf("SSTables unused for %s move to the cold tier\n", kv.ColdAfter)
+	} else {
+		fmt.Println("Cold tier disabled (start the node with --cold-dir)")
+	}
+}
+
+// Exporta as chaves do prefixo (todas, se omitido) para um arquivo neste nó, respeitando a
+// taxa e a janela de export da configuração do cluster
+func runExportCommand(gossip *store.Gossip, args []string) {
+	if len(args) < 1 || len(args) > 2 {
+		fmt.Println("Usage: export <file> [prefix]")
+		return
+	}
+	if len(args) == 2 {
+		if err := gossip.ValidateKey(args[1]); err != nil {
+			fmt.Printf("Invalid prefix: %v\n", err)
+			return
+		}
+	}
+	startJob(gossip, "export", args...)
+}
+
+// Grava neste nó um snapshot dos buckets em arquivos Parquet, um por bucket, respeitando a taxa e
+// a janela de export da configuração do cluster. As chaves gravadas durante o snapshot vêm na
+// versão nova (ver store.Snapshot).
+func runSnapshotCommand(gossip *store.Gossip, args []string) {
+	if len(args) < 2 {
+		fmt.Println("Usage: snapshot <dir> <bucket>...")
+		return
+	}
+	startJob(gossip, "snapshot", args...)
+}
+
+// Promove uma réplica a primário do trecho que contém a posição do anel (ou a chave, com key:<chave>)
+func runPromoteCommand(gossip *store.Gossip, args []string) {
+	if len(args) != 2 {
+		fmt.Println("Usage: promote <node> <position|key:<key>>")
+		return
+	}
+	position := args[1]
+	if key, found := strings.CutPrefix(position, "key:"); found {
+		position = strconv.FormatUint(uint64(gossip.ConsistentHash.HashKey(key)), 10)
+	} else if _, err := strconv.ParseUint(position, 10, 32); err != nil {
+		fmt.Printf("Invalid ring position %q\n", position)
+		return
+	}
+	startJob(gossip, "promote", args[0], position)
+}
+
+// Migra os valores de um bucket para a versão de schema mais recente, ou mostra o estado da migração
+func runMigrateCommand(gossip *store.Gossip, args []string) {
+	if len(args) < 1 || len(args) > 2 {
+		fmt.Println("Usage: migrate <bucket> [status]")
+		return
+	}
+	bucket := args[0]
+	kv := gossip.KeyValueStore
+
+	if len(args) == 2 {
+		if args[1] != "status" {
+			fmt.Println("Usage: migrate <bucket> [status]")
+			return
+		}
+		schema, err := kv.BucketSchema(bucket)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		fmt.Printf("Bucket %s: schema version %d", bucket, schema.Version)
+		if schema.Target > schema.Version {
+			fmt.Printf(", migrating to %d (last key %q)", schema.Target, schema.LastKey)
+		}
+		fmt.Println()
+		return
+	}
+
+	startJob(gossip, "migrate", bucket)
+}
+
+// Inicia um job em segundo plano e mostra o ID dele
+func startJob(gossip *store.Gossip, kind string, args ...string) {
+	job, err := gossip.KeyValueStore.Jobs.Start(kind, args...)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	fmt.Printf("Started %s as %s. Use 'jobs list' to follow it.\n", kind, job.ID)
+}
+
+// Lista, pausa, retoma ou cancela os jobs em segundo plano
+func runJobsCommand(gossip *store.Gossip, args []string) {
+	jobs := gossip.KeyValueStore.Jobs
+
+	if len(args) == 1 && args[0] == "list" {
+		list := jobs.List()
+		if len(list) == 0 {
+			fmt.Println("No jobs.")
+		}
+		for _, job := range list {
+			fmt.Printf("%s %s %v: %s", job.ID, job.Kind, job.Args, job.State)
+			if job.Total > 0 {
+				fmt.Printf(" (%d/%d)", job.Done, job.Total)
+			}
+			if job.Error != "" {
+				fmt.Printf(" error: %s", job.Error)
+			}
+			fmt.Println()
+		}
+		return
+	}
+	if len(args) != 2 {
+		fmt.Println("Usage: jobs list | jobs pause|resume|cancel <id>")
+		return
+	}
+
+	var err error
+	switch args[0] {
+	case "pause":
+		err = jobs.Pause(args[1])
+	case "resume":
+		err = jobs.Resume(args[1])
+	case "cancel":
+		err = jobs.Cancel(args[1])
+	default:
+		fmt.Println("Usage: jobs list | jobs pause|resume|cancel <id>")
+		return
+	}
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
 	}
+	fmt.Println("OK")
 }
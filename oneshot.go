@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bquerino/kv-g/internal/store"
+	"github.com/bquerino/kv-g/pkg/client"
+)
+
+// No modo não interativo, "kv-g <comando> <argumentos> --addr <host:port>" executa uma operação
+// pela API HTTP de um nó e sai, sem subir um nó, e "kv-g --script <arquivo> --addr <host:port>"
+// executa um comando por linha do arquivo. O código de saída diz o resultado, para scripts de
+// shell e pipelines de CI.
+
+const oneShotUsage = `Usage: kv-g <command> [args] [--addr host:port] [options]
+       kv-g --script <file> [--addr host:port] [options]
+
+Commands:
+  put <key> <value>        Grava o valor na chave
+  get <key>                Mostra o valor da chave (código de saída 3 se ela não existe)
+  delete <key>             Remove a chave
+  scan <prefix> [limit]    Lista as chaves com o prefixo, uma "<chave> <valor>" por linha
+
+Exit codes: 0 ok, 1 error, 2 usage, 3 key not found`
+
+// Códigos de saída do modo não interativo
+const (
+	exitOK       = 0
+	exitError    = 1
+	exitUsage    = 2
+	exitNotFound = 3
+)
+
+// Comandos aceitos na linha de comando e nos scripts
+var oneShotCommands = map[string]bool{"put": true, "get": true, "delete": true, "scan": true}
+
+// Indica se os argumentos pedem o modo não interativo: um comando como primeiro argumento ou --script
+func isOneShot(args []string) bool {
+	if len(args) > 0 && oneShotCommands[args[0]] {
+		return true
+	}
+	for _, arg := range args {
+		name := strings.TrimLeft(arg, "-")
+		if strings.HasPrefix(arg, "-") && (name == "script" || strings.HasPrefix(name, "script=")) {
+			return true
+		}
+	}
+	return false
+}
+
+// Executa o comando ou o script dos argumentos contra a API HTTP de um nó e retorna o código de saída
+func runOneShot(args []string) int {
+	fs := flag.NewFlagSet("kv-g", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, oneShotUsage)
+		fmt.Fprintln(os.Stderr, "\nOptions:")
+		fs.PrintDefaults()
+	}
+	addr := fs.String("addr", "localhost:7001", "Endereço da API HTTP do nó (--http-port), como host:port ou URL")
+	script := fs.String("script", "", "Arquivo com um comando por linha (- = entrada padrão); linhas vazias e iniciadas por # são ignoradas")
+	consistency := fs.String("c", "", "Nível de consistência das operações: one, quorum ou all (vazio = R ou W do cluster)")
+	token := fs.String("api-token", os.Getenv("KVG_TOKEN"), "Token da API, se o cluster tiver tokens (padrão: variável KVG_TOKEN)")
+	checksums := fs.Bool("checksums", false, "Envia o checksum dos valores gravados e confere o dos valores lidos")
+	timeout := fs.Duration("timeout", 10*time.Second, "Prazo de cada operação")
+	keepGoing := fs.Bool("keep-going", false, "Continua o script depois de um comando que falhou")
+	positional, err := parseInterspersed(fs, args)
+	if err != nil {
+		return exitUsage
+	}
+	if _, err := store.ParseConsistencyLevel(*consistency); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -c: %v\n", err)
+		return exitUsage
+	}
+
+	c := client.New(*addr)
+	c.Consistency, c.Token, c.Checksums = *consistency, *token, *checksums
+	if *script == "" {
+		return runClientCommand(c, *timeout, positional)
+	}
+	if len(positional) > 0 {
+		fmt.Fprintln(os.Stderr, "Use either a command or --script")
+		return exitUsage
+	}
+	return runScript(c, *timeout, *script, *keepGoing)
+}
+
+// Interpreta as opções em qualquer posição, retornando os demais argumentos em ordem; depois de
+// "--" todos são argumentos
+func parseInterspersed(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for len(args) > 0 {
+		if !strings.HasPrefix(args[0], "-") || args[0] == "-" {
+			positional, args = append(positional, args[0]), args[1:]
+			continue
+		}
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		consumed := args[:len(args)-fs.NArg()]
+		args = fs.Args()
+		if consumed[len(consumed)-1] == "--" {
+			return append(positional, args...), nil
+		}
+	}
+	return positional, nil
+}
+
+// Executa os comandos de um script, um por linha, parando no primeiro que falha (a menos que
+// keepGoing), e retorna o código de saída do último que falhou
+func runScript(c *client.Client, timeout time.Duration, path string, keepGoing bool) int {
+	var input io.Reader = os.Stdin
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return exitError
+		}
+		defer file.Close()
+		input = file
+	}
+
+	scanner := bufio.NewScanner(input)
+	scanner.Buffer(make([]byte, 64*1024), store.MaxValueSizeLimit+store.PageSize)
+	code, line := exitOK, 0
+	for scanner.Scan() {
+		line++
+		args := strings.Fields(scanner.Text())
+		if len(args) == 0 || strings.HasPrefix(args[0], "#") {
+			continue
+		}
+		if result := runClientCommand(c, timeout, args); result != exitOK {
+			fmt.Fprintf(os.Stderr, "%s:%d: %s failed\n", path, line, args[0])
+			if !keepGoing {
+				return result
+			}
+			code = result
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading %s: %v\n", path, err)
+		return exitError
+	}
+	return code
+}
+
+// Executa um comando contra o nó, com o resultado na saída padrão e os erros na de erro
+func runClientCommand(c *client.Client, timeout time.Duration, args []string) int {
+	if len(args) == 0 || !oneShotCommands[args[0]] {
+		fmt.Fprintln(os.Stderr, oneShotUsage)
+		return exitUsage
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	switch command, args := args[0], args[1:]; {
+	case command == "put" && len(args) == 2:
+		result, err := c.Put(ctx, args[0], args[1])
+		return printClientWrite(result, err)
+	case command == "delete" && len(args) == 1:
+		result, err := c.Delete(ctx, args[0])
+		return printClientWrite(result, err)
+	case command == "get" && len(args) == 1:
+		item, err := c.Get(ctx, args[0])
+		switch {
+		case errors.Is(err, client.ErrNotFound):
+			fmt.Fprintf(os.Stderr, "Key %s not found\n", args[0])
+			return exitNotFound
+		case err != nil:
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return exitError
+		}
+		if item.Stale {
+			fmt.Fprintf(os.Stderr, "Possibly stale: key %s came from data held for down replicas\n", args[0])
+		}
+		fmt.Println(item.Value)
+		return exitOK
+	case command == "scan" && (len(args) == 1 || len(args) == 2):
+		limit := 0
+		if len(args) == 2 {
+			var err error
+			if limit, err = strconv.Atoi(args[1]); err != nil || limit < 1 {
+				fmt.Fprintf(os.Stderr, "Invalid limit %q\n", args[1])
+				return exitUsage
+			}
+		}
+		return runClientScan(ctx, c, args[0], limit)
+	}
+	fmt.Fprintln(os.Stderr, oneShotUsage)
+	return exitUsage
+}
+
+// Mostra as chaves com o prefixo, seguindo as páginas até o limite (0 = todas)
+func runClientScan(ctx context.Context, c *client.Client, prefix string, limit int) int {
+	page, shown := "", 0
+	for {
+		result, err := c.Scan(ctx, prefix, limit-shown, page)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return exitError
+		}
+		for _, item := range result.Items {
+			fmt.Printf("%s %s\n", item.Key, item.Value)
+		}
+		shown += len(result.Items)
+		if result.Next == "" || limit > 0 && shown >= limit {
+			return exitOK
+		}
+		page = result.Next
+	}
+}
+
+func printClientWrite(result *client.WriteResult, err error) int {
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return exitError
+	}
+	fmt.Printf("OK (%d/%d replicas, %d hinted, coordinated by %s)\n", result.Replicas, result.Requested, result.Hinted, result.Coordinator)
+	return exitOK
+}
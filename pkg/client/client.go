@@ -0,0 +1,284 @@
+// Package client acessa um nó do kv-g pela API HTTP (--http-port), com operações que aceitam
+// context.Context e helpers genéricos para valores tipados (GetAs e PutJSON).
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrNotFound é retornado por Get e GetAs quando a chave não existe
+var ErrNotFound = errors.New("key not found")
+
+// ErrChecksumMismatch é retornado por Get quando o valor lido não confere com o checksum do nó
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+var checksumTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Error é uma resposta de erro da API
+type Error struct {
+	Status  int    // Status HTTP
+	Message string // Mensagem do nó
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("kv-g: %s (status %d)", e.Message, e.Status)
+}
+
+// Indica se a operação pode ser repetida: falta de quórum, nó em desligamento ou eleição
+func (e *Error) Temporary() bool {
+	return e.Status == http.StatusServiceUnavailable
+}
+
+// Client envia as operações a um nó, que as coordena
+type Client struct {
+	BaseURL     string       // Endereço da API HTTP do nó (ex.: http://localhost:7001)
+	HTTP        *http.Client // Cliente HTTP usado nas requisições
+	Codec       Codec        // Codec dos valores tipados (padrão: JSONCodec)
+	Consistency string       // Nível das operações: one, quorum ou all (vazio = R ou W do cluster)
+	Token       string       // Token da API, enviado como Authorization: Bearer (vazio = sem autenticação)
+	Checksums   bool         // Envia o checksum de cada valor gravado e confere o de cada valor lido
+}
+
+// Item é o resultado de uma leitura
+type Item struct {
+	Key         string
+	Value       string
+	VectorClock string // Mesmo formato do cabeçalho X-KV-Vector-Clock
+	Coordinator string
+	ServedBy    string
+	Stale       bool   // Servida de dados guardados para réplicas fora; pode estar desatualizada
+	Checksum    string // CRC-32C do valor em 8 dígitos hexadecimais (vazio em nós anteriores)
+	Pending     bool   // Versão de uma escrita com ack rápido ainda sem as W confirmações (ver WaitDurable)
+}
+
+// ScanItem é uma chave devolvida por um scan
+type ScanItem struct {
+	Key         string `json:"key"`
+	Value       string `json:"value"`
+	VectorClock string `json:"vector_clock"` // Mesmo formato do cabeçalho X-KV-Vector-Clock
+	ServedBy    string `json:"served_by"`
+}
+
+// ScanPage é uma página de um scan
+type ScanPage struct {
+	Items []ScanItem
+	Next  string // Token da próxima página (vazio na última)
+}
+
+// WriteResult é o resultado de uma escrita ou remoção
+type WriteResult struct {
+	Key         string `json:"key"`
+	Requested   int    `json:"requested"` // Fator de replicação (N)
+	Replicas    int    `json:"replicas"`  // Réplicas que confirmaram a escrita
+	Hinted      int    `json:"hinted"`    // Réplicas que receberão a escrita via hinted handoff
+	Coordinator string `json:"coordinator"`
+	Pending     bool   `json:"pending"` // Confirmada pelo ack rápido; as outras réplicas recebem a escrita em segundo plano
+}
+
+// Cria um cliente para a API HTTP de um nó; addr pode ser host:port ou uma URL
+func New(addr string) *Client {
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	return &Client{BaseURL: strings.TrimRight(addr, "/"), HTTP: http.DefaultClient, Codec: JSONCodec{}}
+}
+
+// Lê a chave; retorna ErrNotFound se ela não existe
+func (c *Client) Get(ctx context.Context, key string) (*Item, error) {
+	resp, err := c.do(ctx, http.MethodGet, key, "")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp); err != nil {
+		return nil, err
+	}
+	value, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	item := &Item{
+		Key:         key,
+		Value:       string(value),
+		VectorClock: resp.Header.Get("X-KV-Vector-Clock"),
+		Coordinator: resp.Header.Get("X-KV-Coordinator"),
+		ServedBy:    resp.Header.Get("X-KV-Served-By"),
+		Stale:       resp.Header.Get("X-KV-Stale") == "true",
+		Checksum:    resp.Header.Get("X-KV-Checksum"),
+		Pending:     resp.Header.Get("X-KV-Durable") == "false",
+	}
+	if c.Checksums && item.Checksum != "" {
+		if actual := Checksum(item.Value); actual != strings.ToLower(item.Checksum) {
+			return nil, fmt.Errorf("%w: key %s has %s, node sent %s", ErrChecksumMismatch, key, actual, item.Checksum)
+		}
+	}
+	return item, nil
+}
+
+// Retorna o checksum de um valor como a API o espera: o CRC-32C em 8 dígitos hexadecimais
+func Checksum(value string) string {
+	return fmt.Sprintf("%08x", crc32.Checksum([]byte(value), checksumTable))
+}
+
+// Grava o valor na chave
+func (c *Client) Put(ctx context.Context, key, value string) (*WriteResult, error) {
+	if value == "" {
+		return nil, fmt.Errorf("value of key %s must not be empty", key)
+	}
+	return c.write(ctx, http.MethodPut, key, value)
+}
+
+// Remove a chave
+func (c *Client) Delete(ctx context.Context, key string) (*WriteResult, error) {
+	return c.write(ctx, http.MethodDelete, key, "")
+}
+
+func (c *Client) write(ctx context.Context, method, key, value string) (*WriteResult, error) {
+	resp, err := c.do(ctx, method, key, value)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp); err != nil {
+		return nil, err
+	}
+	result := &WriteResult{}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return nil, fmt.Errorf("invalid response for key %s: %w", key, err)
+	}
+	return result, nil
+}
+
+// Espera a última escrita com ack rápido da chave alcançar as W réplicas. A marca fica com o nó
+// que coordenou a escrita, então o cliente deve ser o mesmo do Put. Retorna nil se não há escrita
+// pendente, *Error se a escrita não alcançou o W ou o prazo de ctx terminou.
+func (c *Client) WaitDurable(ctx context.Context, key string) error {
+	query := url.Values{}
+	if deadline, ok := ctx.Deadline(); ok {
+		// Com o prazo, o nó responde 504 quando ele termina em vez de esperar a conexão cair
+		query.Set("timeout", max(time.Until(deadline), time.Millisecond).String())
+	}
+	resp, err := c.request(ctx, http.MethodGet, "/durable/"+key, query, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkResponse(resp)
+}
+
+// Lê uma página das chaves com o prefixo, em ordem; page é o Next da página anterior (vazio na
+// primeira) e limit = 0 usa o limite do nó
+func (c *Client) Scan(ctx context.Context, prefix string, limit int, page string) (*ScanPage, error) {
+	query := url.Values{"prefix": {prefix}}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	if page != "" {
+		query.Set("page", page)
+	}
+	resp, err := c.request(ctx, http.MethodGet, "/scan", query, "")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp); err != nil {
+		return nil, err
+	}
+	result := &ScanPage{Next: resp.Header.Get("X-KV-Next-Page")}
+	if err := json.NewDecoder(resp.Body).Decode(&result.Items); err != nil {
+		return nil, fmt.Errorf("invalid scan response: %w", err)
+	}
+	return result, nil
+}
+
+func (c *Client) do(ctx context.Context, method, key, value string) (*http.Response, error) {
+	query := url.Values{}
+	if c.Consistency != "" {
+		query.Set("consistency", c.Consistency)
+	}
+	return c.request(ctx, method, "/kv/"+key, query, value)
+}
+
+func (c *Client) request(ctx context.Context, method, path string, query url.Values, value string) (*http.Response, error) {
+	target, err := url.Parse(c.BaseURL)
+	if err != nil {
+		return nil, err
+	}
+	target.Path += path
+	target.RawQuery = query.Encode()
+	var body io.Reader
+	if value != "" {
+		body = strings.NewReader(value)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	if c.Checksums && value != "" {
+		req.Header.Set("X-KV-Checksum", Checksum(value))
+	}
+	httpClient := c.HTTP
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return httpClient.Do(req)
+}
+
+// Converte uma resposta de erro da API em ErrNotFound ou *Error
+func checkResponse(resp *http.Response) error {
+	if resp.StatusCode < 300 {
+		return nil
+	}
+	var answer struct {
+		Error string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&answer); err != nil || answer.Error == "" {
+		answer.Error = resp.Status
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%w: %s", ErrNotFound, answer.Error)
+	}
+	return &Error{Status: resp.StatusCode, Message: answer.Error}
+}
+
+func (c *Client) codec() Codec {
+	if c.Codec == nil {
+		return JSONCodec{}
+	}
+	return c.Codec
+}
+
+// Lê a chave e decodifica o valor como T com o codec do cliente
+func GetAs[T any](ctx context.Context, c *Client, key string) (T, error) {
+	var value T
+	item, err := c.Get(ctx, key)
+	if err != nil {
+		return value, err
+	}
+	if err := c.codec().Decode(item.Value, &value); err != nil {
+		return value, fmt.Errorf("failed to decode value of key %s: %w", key, err)
+	}
+	return value, nil
+}
+
+// Codifica o valor com o codec do cliente (JSON, se nenhum foi configurado) e o grava na chave
+func PutJSON[T any](ctx context.Context, c *Client, key string, value T) (*WriteResult, error) {
+	encoded, err := c.codec().Encode(value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode value of key %s: %w", key, err)
+	}
+	return c.Put(ctx, key, encoded)
+}
@@ -0,0 +1,40 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Codec converte os valores tipados de GetAs e PutJSON no texto gravado no store. Os valores do
+// store não podem ser vazios, e um nó com --text-protocol recusa valores com espaços.
+type Codec interface {
+	Encode(v any) (string, error)
+	Decode(data string, v any) error
+}
+
+// JSONCodec codifica os valores como JSON compacto, com os espaços de dentro das strings
+// escapados como \uXXXX (o que continua sendo o mesmo JSON)
+type JSONCodec struct{}
+
+func (JSONCodec) Encode(v any) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	// O JSON compacto só tem espaços dentro de strings, onde o escape é equivalente
+	var b strings.Builder
+	for _, r := range string(data) {
+		if unicode.IsSpace(r) {
+			fmt.Fprintf(&b, `\u%04x`, r)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String(), nil
+}
+
+func (JSONCodec) Decode(data string, v any) error {
+	return json.Unmarshal([]byte(data), v)
+}